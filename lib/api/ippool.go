@@ -51,6 +51,49 @@ type IPPoolSpec struct {
 
 	// When disabled is true, Calico IPAM will not assign addresses from this pool.
 	Disabled bool `json:"disabled,omitempty"`
+
+	// PreferredHosts is an optional list of hostnames that should prefer this
+	// pool.  When claiming a new block for one of these hosts, Calico IPAM
+	// tries this pool before any other pools.
+	PreferredHosts []string `json:"preferredHosts,omitempty"`
+
+	// BlockSize is the prefix length of the blocks that Calico IPAM
+	// allocates from this pool, overriding the block size in the IPAM
+	// configuration.  It must be between 20 and 32 for an IPv4 pool, or
+	// between 116 and 128 for an IPv6 pool, and no shorter than the pool's
+	// own prefix length.  It can't be changed once blocks have been
+	// allocated from the pool.
+	BlockSize *int `json:"blockSize,omitempty"`
+
+	// ExcludedCIDRs is an optional list of CIDRs within the pool from which
+	// Calico IPAM does not assign addresses.  Blocks which overlap an
+	// excluded CIDR are not claimed automatically, and addresses within an
+	// excluded CIDR are not assigned from blocks which already exist.
+	ExcludedCIDRs []net.IPNet `json:"excludedCIDRs,omitempty"`
+
+	// ReservedAddresses is an optional list of addresses within the pool,
+	// such as gateway or DNS server addresses, which Calico IPAM never
+	// auto-assigns.  Unlike an excluded CIDR, a reserved address does not
+	// stop the block containing it from being claimed.
+	ReservedAddresses []net.IP `json:"reservedAddresses,omitempty"`
+
+	// NodeSelector is an optional selector expression, using the same
+	// syntax as a policy selector, which restricts the hosts that may claim
+	// new blocks from this pool to those whose node labels match.  The
+	// node labels are supplied by the client's NodeLabels function.  If
+	// not specified, any host may claim blocks from this pool.
+	NodeSelector string `json:"nodeSelector,omitempty"`
+
+	// Zone is an optional topology zone, such as a rack or availability
+	// zone, that the pool serves.  When claiming a new block for a host
+	// whose zone is given, Calico IPAM tries the pools in the same zone
+	// before pools in other zones.
+	Zone string `json:"zone,omitempty"`
+
+	// Priority orders the pools when the IPAM configuration's pool
+	// distribution is "priority".  New blocks are claimed from the pools
+	// with the highest priority first.  The default is 0.
+	Priority int `json:"priority,omitempty"`
 }
 
 type IPIPConfiguration struct {
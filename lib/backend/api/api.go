@@ -18,6 +18,7 @@ import (
 	"fmt"
 
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"golang.org/x/net/context"
 )
 
 // SyncStatus represents the overall state of the datastore.
@@ -71,8 +72,9 @@ type Client interface {
 	// Apply updates or creates the object specified in the KVPair.
 	// On success, returns a KVPair for the object with revision
 	// information filled-in.  If the input KVPair has revision
-	// information then the update only succeeds if the revision is still
-	// current.
+	// information then Apply behaves as Update: the object must exist,
+	// and the update only succeeds if the revision is still current.
+	// Otherwise the object is written whatever its current revision.
 	Apply(object *model.KVPair) (*model.KVPair, error)
 
 	// Delete removes the object specified by the KVPair.  If the KVPair
@@ -87,15 +89,42 @@ type Client interface {
 	// also remove the Workload.
 	Delete(object *model.KVPair) error
 
+	// DeleteKeys removes the objects identified by the supplied keys, batching
+	// the deletes where the datastore allows.  Keys that do not exist are
+	// treated as successfully deleted.  Returns a map of errors for each key
+	// that could not be deleted, indexed by the String() of the key.  The map
+	// is empty if all of the deletes succeeded.
+	DeleteKeys(keys []model.Key) map[string]error
+
+	// Txn performs the supplied operations as a single transaction, so that
+	// either all of them are made or none are.  Returns the KVPair resulting
+	// from each operation, in order, or nil for a delete.  If the datastore
+	// cannot perform the operations atomically, an ErrorTransactionNotAtomic
+	// is returned without making any changes, unless bestEffort is set, in
+	// which case the operations are made in turn as by BestEffortTxn.
+	Txn(ops []TxnOp, bestEffort bool) ([]*model.KVPair, error)
+
 	// Get returns the object identified by the given key as a KVPair with
 	// revision information.
 	Get(key model.Key) (*model.KVPair, error)
 
 	// List returns a slice of KVPairs matching the input list options.
 	// list should be passed one of the model.<Type>ListOptions structs.
-	// Non-zero fields in the struct are used as filters.
+	// Non-zero fields in the struct are used as filters.  If only some
+	// of the matching entries could be read, those entries are returned
+	// along with an ErrorPartialList.
 	List(list model.ListInterface) ([]*model.KVPair, error)
 
+	// ListPage returns at most limit of the entries matching the supplied
+	// ListInterface, ordered by key, along with an opaque continue token that
+	// may be passed back in to retrieve the next page.  The continue token is
+	// empty when there are no more entries.  A limit of 0 or less returns all
+	// of the remaining entries.  An invalid or expired continue token returns
+	// an ErrorInvalidContinueToken.  As for List, a page may be returned
+	// along with an ErrorPartialList, in which case the continue token is
+	// still valid.
+	ListPage(list model.ListInterface, limit int, continueToken string) ([]*model.KVPair, string, error)
+
 	// Syncer creates an object that generates a series of KVPair updates,
 	// which paint an eventually-consistent picture of the full state of
 	// the datastore and then generates subsequent KVPair updates for
@@ -106,6 +135,12 @@ type Client interface {
 	// any ready to be used.
 	EnsureInitialized() error
 
+	// Ping checks that the datastore is reachable, using a cheap request that
+	// does not depend on any Calico data being present.  Returns an
+	// ErrorDatastoreUnavailable if the datastore cannot be reached before the
+	// context is done.
+	Ping(ctx context.Context) error
+
 	// Perform any "backdoor" initialization required by the components
 	// used in calico/node.  This is a temporary mechanism and will be
 	// removed.
@@ -0,0 +1,86 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+// continueToken is the decoded form of the continue token returned by
+// PageKVPairs.  It records the type of list the token was issued for, and
+// the key of the last entry returned.
+type continueToken struct {
+	List  string `json:"list"`
+	After string `json:"after"`
+}
+
+// PageKVPairs returns a single page of the supplied list results, for use by
+// backends that do not support paginated reads natively.  The results are
+// ordered by key, and the page starts after the key recorded in the continue
+// token.  A limit of 0 or less returns all remaining entries.
+func PageKVPairs(kvps []*model.KVPair, list model.ListInterface, limit int, token string) ([]*model.KVPair, string, error) {
+	listType := fmt.Sprintf("%T", list)
+
+	// Decode the continue token, if supplied, and check that it was issued
+	// for this type of list.
+	after := ""
+	if token != "" {
+		b, err := base64.URLEncoding.DecodeString(token)
+		if err != nil {
+			return nil, "", errors.ErrorInvalidContinueToken{Token: token, Reason: "token is malformed"}
+		}
+		ct := continueToken{}
+		if err = json.Unmarshal(b, &ct); err != nil || ct.After == "" {
+			return nil, "", errors.ErrorInvalidContinueToken{Token: token, Reason: "token is malformed"}
+		}
+		if ct.List != listType {
+			return nil, "", errors.ErrorInvalidContinueToken{Token: token, Reason: "token was issued for a different list"}
+		}
+		after = ct.After
+	}
+
+	sorted := make(kvPairsByKey, len(kvps))
+	copy(sorted, kvps)
+	sort.Sort(sorted)
+
+	// Skip over the entries that have already been returned.
+	start := sort.Search(len(sorted), func(i int) bool {
+		return sorted[i].Key.String() > after
+	})
+	page := []*model.KVPair(sorted[start:])
+	if limit <= 0 || len(page) <= limit {
+		return page, "", nil
+	}
+
+	page = page[:limit]
+	b, err := json.Marshal(continueToken{List: listType, After: page[limit-1].Key.String()})
+	if err != nil {
+		return nil, "", err
+	}
+	return page, base64.URLEncoding.EncodeToString(b), nil
+}
+
+// kvPairsByKey sorts a slice of KVPairs by the string form of their keys.
+type kvPairsByKey []*model.KVPair
+
+func (s kvPairsByKey) Len() int           { return len(s) }
+func (s kvPairsByKey) Less(i, j int) bool { return s[i].Key.String() < s[j].Key.String() }
+func (s kvPairsByKey) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,81 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api_test
+
+import (
+	. "github.com/projectcalico/libcalico-go/lib/backend/api"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+var _ = Describe("PageKVPairs", func() {
+	kvps := []*model.KVPair{
+		{Key: model.ProfileKey{Name: "c"}},
+		{Key: model.ProfileKey{Name: "a"}},
+		{Key: model.ProfileKey{Name: "d"}},
+		{Key: model.ProfileKey{Name: "b"}},
+		{Key: model.ProfileKey{Name: "e"}},
+	}
+	list := model.ProfileListOptions{}
+
+	names := func(page []*model.KVPair) []string {
+		n := []string{}
+		for _, kvp := range page {
+			n = append(n, kvp.Key.(model.ProfileKey).Name)
+		}
+		return n
+	}
+
+	It("should return all entries in key order when no limit is set", func() {
+		page, next, err := PageKVPairs(kvps, list, 0, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(next).To(Equal(""))
+		Expect(names(page)).To(Equal([]string{"a", "b", "c", "d", "e"}))
+	})
+
+	It("should page through all entries using the continue token", func() {
+		page, next, err := PageKVPairs(kvps, list, 2, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names(page)).To(Equal([]string{"a", "b"}))
+		Expect(next).NotTo(Equal(""))
+
+		page, next, err = PageKVPairs(kvps, list, 2, next)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names(page)).To(Equal([]string{"c", "d"}))
+		Expect(next).NotTo(Equal(""))
+
+		page, next, err = PageKVPairs(kvps, list, 2, next)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names(page)).To(Equal([]string{"e"}))
+		Expect(next).To(Equal(""))
+	})
+
+	It("should reject a malformed continue token", func() {
+		_, _, err := PageKVPairs(kvps, list, 2, "not-a-token")
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorInvalidContinueToken{}))
+	})
+
+	It("should reject a continue token issued for a different list", func() {
+		_, next, err := PageKVPairs(kvps, list, 2, "")
+		Expect(err).NotTo(HaveOccurred())
+
+		_, _, err = PageKVPairs(nil, model.NodeListOptions{}, 2, next)
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorInvalidContinueToken{}))
+	})
+})
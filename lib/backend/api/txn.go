@@ -0,0 +1,120 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+// TxnOpType is the type of a single operation within a transaction.
+type TxnOpType int
+
+const (
+	TxnCreate TxnOpType = iota
+	TxnUpdate
+	TxnApply
+	TxnDelete
+)
+
+func (t TxnOpType) String() string {
+	switch t {
+	case TxnCreate:
+		return "create"
+	case TxnUpdate:
+		return "update"
+	case TxnApply:
+		return "apply"
+	case TxnDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("Unknown<%v>", int(t))
+	}
+}
+
+// TxnOp is a single operation within a transaction.  The KVPair is as would
+// be passed to the Client method of the same name.
+type TxnOp struct {
+	Type   TxnOpType
+	KVPair *model.KVPair
+}
+
+// BestEffortTxn emulates a transaction on a datastore that does not support
+// them, by performing the operations in turn.  If an operation fails, those
+// already made are undone in reverse order and the error is returned.
+//
+// This is not atomic: other clients may see the operations made before a
+// failure, undoing an operation fails if the entry has since been modified
+// by another client, and if the process exits part way through, the
+// operations made so far are not undone.
+func BestEffortTxn(c Client, ops []TxnOp) ([]*model.KVPair, error) {
+	results := make([]*model.KVPair, len(ops))
+	undo := []TxnOp{}
+	for i, op := range ops {
+		// Read the current entry, so that we can restore it.
+		var prev *model.KVPair
+		if op.Type != TxnCreate {
+			prev, _ = c.Get(op.KVPair.Key)
+		}
+
+		kvp, err := doTxnOp(c, op)
+		if err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"op":  op.Type,
+				"key": op.KVPair.Key,
+			}).Info("Transaction operation failed, undoing earlier operations")
+			for j := len(undo) - 1; j >= 0; j-- {
+				if _, err := doTxnOp(c, undo[j]); err != nil {
+					log.WithError(err).WithField("key", undo[j].KVPair.Key).Warning("Unable to undo transaction operation")
+				}
+			}
+			return nil, err
+		}
+		results[i] = kvp
+
+		// Record how to undo the operation.  The undo is conditional on
+		// the revision we wrote, so it does not overwrite a later change.
+		switch {
+		case op.Type == TxnDelete && prev != nil:
+			undo = append(undo, TxnOp{Type: TxnCreate, KVPair: &model.KVPair{Key: prev.Key, Value: prev.Value}})
+		case op.Type == TxnDelete:
+			// The entry did not exist, so there is nothing to restore.
+		case prev != nil:
+			undo = append(undo, TxnOp{Type: TxnUpdate, KVPair: &model.KVPair{Key: prev.Key, Value: prev.Value, Revision: kvp.Revision}})
+		default:
+			undo = append(undo, TxnOp{Type: TxnDelete, KVPair: &model.KVPair{Key: kvp.Key, Revision: kvp.Revision}})
+		}
+	}
+	return results, nil
+}
+
+// doTxnOp performs a single transaction operation using the Client method of
+// the same name.
+func doTxnOp(c Client, op TxnOp) (*model.KVPair, error) {
+	switch op.Type {
+	case TxnCreate:
+		return c.Create(op.KVPair)
+	case TxnUpdate:
+		return c.Update(op.KVPair)
+	case TxnApply:
+		return c.Apply(op.KVPair)
+	case TxnDelete:
+		return nil, c.Delete(op.KVPair)
+	}
+	return nil, fmt.Errorf("unknown transaction operation %v", op.Type)
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api_test
+
+import (
+	. "github.com/projectcalico/libcalico-go/lib/backend/api"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+// memClient is a minimal in-memory Client that supports the single-key
+// operations used by BestEffortTxn.  Calling any other method will panic.
+type memClient struct {
+	Client
+	kvps     map[string]*model.KVPair
+	revision int
+}
+
+func (m *memClient) store(kvp *model.KVPair) *model.KVPair {
+	m.revision++
+	stored := &model.KVPair{Key: kvp.Key, Value: kvp.Value, Revision: m.revision}
+	m.kvps[kvp.Key.String()] = stored
+	return stored
+}
+
+func (m *memClient) Create(kvp *model.KVPair) (*model.KVPair, error) {
+	if _, ok := m.kvps[kvp.Key.String()]; ok {
+		return nil, errors.ErrorResourceAlreadyExists{Identifier: kvp.Key}
+	}
+	return m.store(kvp), nil
+}
+
+func (m *memClient) Update(kvp *model.KVPair) (*model.KVPair, error) {
+	existing, ok := m.kvps[kvp.Key.String()]
+	if !ok {
+		return nil, errors.ErrorResourceDoesNotExist{Identifier: kvp.Key}
+	}
+	if kvp.Revision != nil && kvp.Revision != existing.Revision {
+		return nil, errors.ErrorResourceUpdateConflict{Identifier: kvp.Key}
+	}
+	return m.store(kvp), nil
+}
+
+func (m *memClient) Apply(kvp *model.KVPair) (*model.KVPair, error) {
+	return m.store(kvp), nil
+}
+
+func (m *memClient) Delete(kvp *model.KVPair) error {
+	existing, ok := m.kvps[kvp.Key.String()]
+	if !ok {
+		return errors.ErrorResourceDoesNotExist{Identifier: kvp.Key}
+	}
+	if kvp.Revision != nil && kvp.Revision != existing.Revision {
+		return errors.ErrorResourceUpdateConflict{Identifier: kvp.Key}
+	}
+	delete(m.kvps, kvp.Key.String())
+	return nil
+}
+
+func (m *memClient) Get(k model.Key) (*model.KVPair, error) {
+	kvp, ok := m.kvps[k.String()]
+	if !ok {
+		return nil, errors.ErrorResourceDoesNotExist{Identifier: k}
+	}
+	return kvp, nil
+}
+
+var _ = Describe("BestEffortTxn", func() {
+	keyA := model.GlobalConfigKey{Name: "A"}
+	keyB := model.GlobalConfigKey{Name: "B"}
+	keyC := model.GlobalConfigKey{Name: "C"}
+
+	var c *memClient
+
+	value := func(k model.Key) interface{} {
+		kvp, err := c.Get(k)
+		if err != nil {
+			return nil
+		}
+		return kvp.Value
+	}
+
+	BeforeEach(func() {
+		c = &memClient{kvps: map[string]*model.KVPair{}}
+		c.store(&model.KVPair{Key: keyA, Value: "a"})
+		c.store(&model.KVPair{Key: keyB, Value: "b"})
+	})
+
+	It("should perform each operation in turn", func() {
+		results, err := BestEffortTxn(c, []TxnOp{
+			{Type: TxnUpdate, KVPair: &model.KVPair{Key: keyA, Value: "a2"}},
+			{Type: TxnDelete, KVPair: &model.KVPair{Key: keyB}},
+			{Type: TxnCreate, KVPair: &model.KVPair{Key: keyC, Value: "c"}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(3))
+		Expect(results[0].Value).To(Equal("a2"))
+		Expect(results[1]).To(BeNil())
+		Expect(results[2].Value).To(Equal("c"))
+		Expect(value(keyA)).To(Equal("a2"))
+		Expect(value(keyB)).To(BeNil())
+		Expect(value(keyC)).To(Equal("c"))
+	})
+
+	It("should undo earlier operations when one fails", func() {
+		_, err := BestEffortTxn(c, []TxnOp{
+			{Type: TxnApply, KVPair: &model.KVPair{Key: keyA, Value: "a2"}},
+			{Type: TxnDelete, KVPair: &model.KVPair{Key: keyB}},
+			{Type: TxnApply, KVPair: &model.KVPair{Key: keyC, Value: "c"}},
+			{Type: TxnCreate, KVPair: &model.KVPair{Key: keyA, Value: "a3"}},
+		})
+		Expect(errors.IsAlreadyExists(err)).To(BeTrue())
+		Expect(value(keyA)).To(Equal("a"))
+		Expect(value(keyB)).To(Equal("b"))
+		Expect(value(keyC)).To(BeNil())
+	})
+
+	It("should not undo over a change made by another client", func() {
+		c.Delete(&model.KVPair{Key: keyB})
+		failing := &interferingClient{memClient: c, key: keyA}
+		_, err := BestEffortTxn(failing, []TxnOp{
+			{Type: TxnUpdate, KVPair: &model.KVPair{Key: keyA, Value: "a2"}},
+			{Type: TxnUpdate, KVPair: &model.KVPair{Key: keyB, Value: "b2"}},
+		})
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+		Expect(value(keyA)).To(Equal("other"))
+	})
+})
+
+// interferingClient is a memClient in which another client overwrites the
+// given key immediately after it is updated.
+type interferingClient struct {
+	*memClient
+	key model.Key
+}
+
+func (i *interferingClient) Update(kvp *model.KVPair) (*model.KVPair, error) {
+	result, err := i.memClient.Update(kvp)
+	if err == nil && kvp.Key == i.key {
+		i.store(&model.KVPair{Key: i.key, Value: "other"})
+	}
+	return result, err
+}
@@ -15,10 +15,6 @@
 package backend
 
 import (
-	"errors"
-	"fmt"
-
-	log "github.com/Sirupsen/logrus"
 	"github.com/projectcalico/libcalico-go/lib/api"
 	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
 	"github.com/projectcalico/libcalico-go/lib/backend/compat"
@@ -26,27 +22,23 @@ import (
 	"github.com/projectcalico/libcalico-go/lib/backend/k8s"
 )
 
-// NewClient creates a new backend datastore client.
-func NewClient(config api.CalicoAPIConfig) (c bapi.Client, err error) {
-	log.Debugf("Using datastore type '%s'", config.Spec.DatastoreType)
-	switch config.Spec.DatastoreType {
-	case api.EtcdV2:
-		c, err = etcd.NewEtcdClient(&config.Spec.EtcdConfig)
-		if c != nil {
-			// Wrap the backend, which deals only in raw KV pairs with an
-			// adaptor that handles aggregate datatypes.  This allows for
-			// reading and writing Profile and Node objects, which for etcdv2
-			// are composed of multiple backend keys.
-			//
-			// This is only required for etcdv2 backend as Kuberenetes driver
-			// uses the composite Profile and Node KV types.
-			c = compat.NewAdaptor(c)
+// Register the datastores built in to libcalico-go.
+func init() {
+	Register(api.EtcdV2, func(config api.CalicoAPIConfig) (bapi.Client, error) {
+		c, err := etcd.NewEtcdClient(&config.Spec.EtcdConfig)
+		if c == nil {
+			return nil, err
 		}
-	case api.Kubernetes:
-		c, err = k8s.NewKubeClient(&config.Spec.KubeConfig)
-	default:
-		err = errors.New(fmt.Sprintf("Unknown datastore type: %v",
-			config.Spec.DatastoreType))
-	}
-	return
+		// Wrap the backend, which deals only in raw KV pairs with an
+		// adaptor that handles aggregate datatypes.  This allows for
+		// reading and writing Profile and Node objects, which for etcdv2
+		// are composed of multiple backend keys.
+		//
+		// This is only required for etcdv2 backend as Kuberenetes driver
+		// uses the composite Profile and Node KV types.
+		return compat.NewAdaptor(c), err
+	})
+	Register(api.Kubernetes, func(config api.CalicoAPIConfig) (bapi.Client, error) {
+		return k8s.NewKubeClient(&config.Spec.KubeConfig)
+	})
 }
@@ -17,6 +17,7 @@ package compat
 import (
 	"encoding/json"
 	goerrors "errors"
+	"fmt"
 
 	log "github.com/Sirupsen/logrus"
 
@@ -25,6 +26,7 @@ import (
 	"github.com/projectcalico/libcalico-go/lib/errors"
 	"github.com/projectcalico/libcalico-go/lib/net"
 	"github.com/projectcalico/libcalico-go/lib/numorstring"
+	"golang.org/x/net/context"
 )
 
 type ModelAdaptor struct {
@@ -41,6 +43,10 @@ func (c *ModelAdaptor) EnsureInitialized() error {
 	return c.client.EnsureInitialized()
 }
 
+func (c *ModelAdaptor) Ping(ctx context.Context) error {
+	return c.client.Ping(ctx)
+}
+
 func (c *ModelAdaptor) EnsureCalicoNodeInitialized(node string) error {
 	return c.client.EnsureCalicoNodeInitialized(node)
 }
@@ -216,6 +222,54 @@ func (c *ModelAdaptor) Delete(d *model.KVPair) error {
 	}
 }
 
+// DeleteKeys deletes the entries identified by the supplied keys.  Keys that
+// map directly onto backend keys are passed through to the backend as a single
+// batch, whereas composite keys are deleted individually.
+func (c *ModelAdaptor) DeleteKeys(keys []model.Key) map[string]error {
+	errs := map[string]error{}
+	batch := []model.Key{}
+	for _, k := range keys {
+		switch k.(type) {
+		case model.NodeKey, model.GlobalBGPConfigKey:
+			err := c.Delete(&model.KVPair{Key: k})
+			if err != nil {
+				if _, ok := err.(errors.ErrorResourceDoesNotExist); !ok {
+					errs[k.String()] = err
+				}
+			}
+		default:
+			batch = append(batch, k)
+		}
+	}
+	for k, err := range c.client.DeleteKeys(batch) {
+		errs[k] = err
+	}
+	return errs
+}
+
+// Txn performs the supplied operations.  Operations on keys that map directly
+// onto backend keys are passed through to the backend as a single
+// transaction, whereas keys that are stored as several backend keys, or
+// under a different key, can only be written as by api.BestEffortTxn.
+func (c *ModelAdaptor) Txn(ops []api.TxnOp, bestEffort bool) ([]*model.KVPair, error) {
+	for _, op := range ops {
+		switch op.KVPair.Key.(type) {
+		case model.ProfileKey, model.NodeKey, model.GlobalBGPConfigKey:
+			if !bestEffort {
+				return nil, errors.ErrorTransactionNotAtomic{Reason: fmt.Sprintf("%s is not stored as a single backend key", op.KVPair.Key)}
+			}
+			return api.BestEffortTxn(c, ops)
+		case model.BlockKey:
+			if op.Type != api.TxnDelete {
+				if err := validateBlockValue(op.KVPair); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	return c.client.Txn(ops, bestEffort)
+}
+
 // Get an entry from the datastore.  This errors if the entry does not exist.
 func (c *ModelAdaptor) Get(k model.Key) (*model.KVPair, error) {
 	switch kt := k.(type) {
@@ -237,6 +291,23 @@ func (c *ModelAdaptor) Get(k model.Key) (*model.KVPair, error) {
 	}
 }
 
+// ListPage returns a page of the entries matching the request in the
+// ListInterface.  Composite resources are assembled from several backend
+// entries, so are listed in full and paged here.  Other resources are paged
+// by the backend.
+func (c *ModelAdaptor) ListPage(l model.ListInterface, limit int, continueToken string) ([]*model.KVPair, string, error) {
+	switch l.(type) {
+	case model.NodeListOptions, model.BlockListOptions, model.GlobalBGPConfigListOptions:
+		kvps, err := c.List(l)
+		if err != nil {
+			return nil, "", err
+		}
+		return api.PageKVPairs(kvps, l, limit, continueToken)
+	default:
+		return c.client.ListPage(l, limit, continueToken)
+	}
+}
+
 // List entries in the datastore.  This may return an empty list of there are
 // no entries matching the request in the ListInterface.
 func (c *ModelAdaptor) List(l model.ListInterface) ([]*model.KVPair, error) {
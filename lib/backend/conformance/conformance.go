@@ -0,0 +1,280 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package conformance contains tests that a backend datastore client must pass
+to be used by the rest of libcalico-go.
+
+The IPAM code relies on the datastore errors and on compare-and-swap on the
+revision to stay consistent when many hosts assign addresses at once, so the
+tests check those semantics for the IPAM keys: that each operation returns the
+right error type, that a write with a stale revision fails with an
+ErrorResourceUpdateConflict, and that a transaction is either atomic or is
+refused with an ErrorTransactionNotAtomic.
+
+The author of a backend runs the tests from a Ginkgo suite in their own
+package:
+
+	var _ = conformance.Describe("My backend", func() api.Client {
+		return newClientForEmptyDatastore()
+	})
+*/
+package conformance
+
+import (
+	"time"
+
+	"github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// Describe registers the conformance tests for a backend client with Ginkgo,
+// in the same way as ginkgo.Describe.  newClient is called before each test
+// and must return a client for an empty datastore.
+func Describe(description string, newClient func() api.Client) bool {
+	return ginkgo.Describe(description+" (backend conformance)", func() {
+		blockA := net.MustParseNetwork("10.0.0.0/26")
+		blockB := net.MustParseNetwork("10.0.0.64/26")
+		keyA := model.BlockKey{CIDR: blockA}
+		keyB := model.BlockKey{CIDR: blockB}
+
+		var c api.Client
+
+		ginkgo.BeforeEach(func() {
+			c = newClient()
+		})
+
+		block := func(key model.BlockKey) *model.KVPair {
+			return &model.KVPair{Key: key, Value: &model.AllocationBlock{
+				CIDR:        key.CIDR,
+				Allocations: make([]*int, 64),
+				Unallocated: []int{},
+			}}
+		}
+
+		create := func(kvp *model.KVPair) *model.KVPair {
+			created, err := c.Create(kvp)
+			Expect(err).NotTo(HaveOccurred())
+			return created
+		}
+
+		exists := func(key model.Key) bool {
+			_, err := c.Get(key)
+			if errors.IsNotExist(err) {
+				return false
+			}
+			Expect(err).NotTo(HaveOccurred())
+			return true
+		}
+
+		ginkgo.It("should be reachable", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			Expect(c.Ping(ctx)).To(Succeed())
+		})
+
+		ginkgo.It("should create, get, update and delete an entry", func() {
+			created := create(block(keyA))
+			Expect(created.Revision).NotTo(BeNil())
+
+			got, err := c.Get(keyA)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got.Key).To(Equal(keyA))
+			Expect(got.Value.(*model.AllocationBlock).CIDR).To(Equal(blockA))
+			Expect(got.Revision).NotTo(BeNil())
+
+			got.Value.(*model.AllocationBlock).StrictAffinity = true
+			updated, err := c.Update(got)
+			Expect(err).NotTo(HaveOccurred())
+			got, err = c.Get(keyA)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(got.Value.(*model.AllocationBlock).StrictAffinity).To(BeTrue())
+
+			Expect(c.Delete(updated)).To(Succeed())
+			Expect(exists(keyA)).To(BeFalse())
+		})
+
+		ginkgo.It("should return an ErrorResourceDoesNotExist for a missing entry", func() {
+			_, err := c.Get(keyA)
+			Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+			_, err = c.Update(block(keyA))
+			Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+			Expect(c.Delete(block(keyA))).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+			_, err = c.Get(model.IPAMHandleKey{HandleID: "handle-a"})
+			Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+			_, err = c.Get(model.IPAMConfigKey{})
+			Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+		})
+
+		ginkgo.It("should return an ErrorResourceAlreadyExists when creating an existing entry", func() {
+			create(block(keyA))
+			_, err := c.Create(block(keyA))
+			Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceAlreadyExists{}))
+
+			affinity := &model.KVPair{Key: model.BlockAffinityKey{Host: "host-a", CIDR: blockA}, Value: model.BlockAffinityValue}
+			create(affinity)
+			_, err = c.Create(affinity)
+			Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceAlreadyExists{}))
+		})
+
+		ginkgo.It("should only update or delete an entry at its current revision", func() {
+			create(block(keyA))
+			first, err := c.Get(keyA)
+			Expect(err).NotTo(HaveOccurred())
+			second, err := c.Get(keyA)
+			Expect(err).NotTo(HaveOccurred())
+
+			// Of two clients writing the same revision, only the first
+			// succeeds, and the second may retry.
+			_, err = c.Update(first)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = c.Update(second)
+			Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceUpdateConflict{}))
+			Expect(errors.IsRetryable(err)).To(BeTrue())
+			err = c.Delete(second)
+			Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceUpdateConflict{}))
+			Expect(exists(keyA)).To(BeTrue())
+
+			// Having re-read the entry, the second client succeeds.
+			second, err = c.Get(keyA)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.Delete(second)).To(Succeed())
+		})
+
+		ginkgo.It("should honor a revision copied onto a new entry", func() {
+			created := create(block(keyA))
+
+			kvp := block(keyA)
+			kvp.Revision = created.Revision
+			updated, err := c.Update(kvp)
+			Expect(err).NotTo(HaveOccurred())
+
+			kvp = block(keyA)
+			kvp.Revision = created.Revision
+			_, err = c.Update(kvp)
+			Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceUpdateConflict{}))
+
+			kvp.Revision = updated.Revision
+			_, err = c.Update(kvp)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		ginkgo.It("should apply an entry with a revision as an update", func() {
+			created := create(block(keyA))
+			_, err := c.Update(created)
+			Expect(err).NotTo(HaveOccurred())
+
+			// The revision is no longer current.
+			_, err = c.Apply(created)
+			Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceUpdateConflict{}))
+
+			// An entry which doesn't exist can't be updated.
+			kvp := block(keyB)
+			kvp.Revision = created.Revision
+			_, err = c.Apply(kvp)
+			Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+			Expect(exists(keyB)).To(BeFalse())
+		})
+
+		ginkgo.It("should write an entry without a revision unconditionally", func() {
+			create(block(keyA))
+			_, err := c.Get(keyA)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = c.Update(block(keyA))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = c.Apply(block(keyA))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = c.Apply(block(keyB))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exists(keyB)).To(BeTrue())
+		})
+
+		ginkgo.It("should list and page the matching entries", func() {
+			create(block(keyB))
+			create(block(keyA))
+			create(&model.KVPair{Key: model.IPAMHandleKey{HandleID: "handle-a"}, Value: &model.IPAMHandle{HandleID: "handle-a", Block: map[string]int{blockA.String(): 1}}})
+
+			kvps, err := c.List(model.BlockListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(kvps).To(HaveLen(2))
+			kvps, err = c.List(model.IPAMHandleListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(kvps).To(HaveLen(1))
+			Expect(kvps[0].Revision).NotTo(BeNil())
+
+			// Each entry is returned once across the pages.
+			keys := []model.Key{}
+			token := ""
+			for {
+				page, next, err := c.ListPage(model.BlockListOptions{}, 1, token)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(page)).To(BeNumerically("<=", 1))
+				for _, kvp := range page {
+					keys = append(keys, kvp.Key)
+				}
+				if next == "" {
+					break
+				}
+				token = next
+			}
+			Expect(keys).To(ConsistOf(keyA, keyB))
+		})
+
+		ginkgo.It("should list no entries without error when there are none", func() {
+			kvps, err := c.List(model.BlockListOptions{})
+			if err != nil {
+				Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+			}
+			Expect(kvps).To(BeEmpty())
+		})
+
+		ginkgo.It("should delete the keys given, ignoring missing keys", func() {
+			create(block(keyA))
+			Expect(c.DeleteKeys([]model.Key{keyA, keyB})).To(BeEmpty())
+			Expect(exists(keyA)).To(BeFalse())
+		})
+
+		ginkgo.It("should perform a transaction atomically or refuse it", func() {
+			create(block(keyB))
+
+			_, err := c.Txn([]api.TxnOp{
+				{Type: api.TxnCreate, KVPair: block(keyA)},
+				{Type: api.TxnCreate, KVPair: block(keyB)},
+			}, false)
+			Expect(err).To(HaveOccurred())
+			Expect(exists(keyA)).To(BeFalse())
+			if errors.IsTransactionNotAtomic(err) {
+				return
+			}
+			Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceAlreadyExists{}))
+
+			results, err := c.Txn([]api.TxnOp{
+				{Type: api.TxnCreate, KVPair: block(keyA)},
+				{Type: api.TxnDelete, KVPair: &model.KVPair{Key: keyB}},
+			}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(results).To(HaveLen(2))
+			Expect(results[0].Revision).NotTo(BeNil())
+			Expect(results[1]).To(BeNil())
+			Expect(exists(keyA)).To(BeTrue())
+			Expect(exists(keyB)).To(BeFalse())
+		})
+	})
+}
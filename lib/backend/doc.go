@@ -14,5 +14,9 @@
 
 /*
 Package backend implements the backend data store client and associated backend data type.
+
+NewClient creates the client for the datastore named in the API config.  The
+etcdv2 and kubernetes datastores are built in; another datastore can be used
+by implementing the api.Client interface and registering it with Register.
 */
 package backend
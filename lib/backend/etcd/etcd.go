@@ -17,6 +17,7 @@ package etcd
 import (
 	goerrors "errors"
 	"strings"
+	"sync"
 
 	"time"
 
@@ -39,6 +40,9 @@ var (
 	etcdListOpts         = &etcd.GetOptions{Quorum: true, Recursive: true, Sort: true}
 	etcdListChildrenOpts = &etcd.GetOptions{Quorum: true, Recursive: false, Sort: true}
 	clientTimeout        = 30 * time.Second
+
+	// The number of deletes DeleteKeys has in flight at once.
+	deleteKeysConcurrency = 8
 )
 
 type EtcdClient struct {
@@ -114,6 +118,22 @@ func (c *EtcdClient) EnsureInitialized() error {
 	return nil
 }
 
+// Ping checks that etcd is reachable by reading the Ready flag.  Any response
+// from etcd, including the key not being found, shows that it is reachable.
+func (c *EtcdClient) Ping(ctx context.Context) error {
+	key, _ := model.KeyToDefaultPath(model.ReadyFlagKey{})
+	_, err := c.etcdKeysAPI.Get(ctx, key, etcdGetOpts)
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(etcd.Error); ok {
+		log.WithError(err).Debug("etcd responded to ping")
+		return nil
+	}
+	log.WithError(err).Warning("etcd is unavailable")
+	return errors.ErrorDatastoreUnavailable{Err: err}
+}
+
 // EnsureCalicoNodeInitialized performs additional initialization required
 // by the calico/node components [startup/ipip-allocation/confd].  This is a
 // temporary requirement until the calico/node components are updated to not
@@ -165,8 +185,12 @@ func (c *EtcdClient) Update(d *model.KVPair) (*model.KVPair, error) {
 }
 
 // Set an existing entry in the datastore.  This ignores whether an entry already
-// exists.
+// exists, unless the request includes a revision, in which case the entry
+// must exist and be at that revision.
 func (c *EtcdClient) Apply(d *model.KVPair) (*model.KVPair, error) {
+	if d.Revision != nil {
+		return c.Update(d)
+	}
 	return c.set(d, etcdApplyOpts)
 }
 
@@ -204,6 +228,52 @@ func (c *EtcdClient) Delete(d *model.KVPair) error {
 	return convertEtcdError(err, d.Key)
 }
 
+// DeleteKeys deletes the entries identified by the supplied keys.  The etcd v2
+// API does not support multi-key transactions, so the deletes are issued in
+// parallel by a fixed number of workers, and any failures are returned
+// indexed by key.
+func (c *EtcdClient) DeleteKeys(keys []model.Key) map[string]error {
+	errs := map[string]error{}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	todo := make(chan model.Key)
+	for i := 0; i < deleteKeysConcurrency && i < len(keys); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range todo {
+				err := c.Delete(&model.KVPair{Key: k})
+				if err == nil {
+					continue
+				}
+				if _, ok := err.(errors.ErrorResourceDoesNotExist); ok {
+					log.Debugf("Key already deleted: %s", k)
+					continue
+				}
+				lock.Lock()
+				errs[k.String()] = err
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, k := range keys {
+		todo <- k
+	}
+	close(todo)
+	wg.Wait()
+	return errs
+}
+
+// Txn performs the supplied operations.  The etcd v2 API does not support
+// multi-key transactions, so unless bestEffort is set, no changes are made
+// and an ErrorTransactionNotAtomic is returned.
+func (c *EtcdClient) Txn(ops []api.TxnOp, bestEffort bool) ([]*model.KVPair, error) {
+	if !bestEffort {
+		return nil, errors.ErrorTransactionNotAtomic{Reason: "etcd v2 does not support multi-key transactions"}
+	}
+	return api.BestEffortTxn(c, ops)
+}
+
 // Get an entry from the datastore.  This errors if the entry does not exist.
 func (c *EtcdClient) Get(k model.Key) (*model.KVPair, error) {
 	key, err := model.KeyToDefaultPath(k)
@@ -237,6 +307,17 @@ func (c *EtcdClient) Get(k model.Key) (*model.KVPair, error) {
 	return &model.KVPair{Key: k, Value: v, Revision: r.Node.ModifiedIndex}, nil
 }
 
+// ListPage returns a page of the entries matching the request in the
+// ListInterface.  The etcd v2 API does not support ranged reads, so the full
+// set of entries is read and paged locally.
+func (c *EtcdClient) ListPage(l model.ListInterface, limit int, continueToken string) ([]*model.KVPair, string, error) {
+	kvps, err := c.List(l)
+	if err != nil {
+		return nil, "", err
+	}
+	return api.PageKVPairs(kvps, l, limit, continueToken)
+}
+
 // List entries in the datastore.  This may return an empty list of there are
 // no entries matching the request in the ListInterface.
 func (c *EtcdClient) List(l model.ListInterface) ([]*model.KVPair, error) {
@@ -0,0 +1,457 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package fake implements an in-memory backend client for use in tests.
+
+The fake client stores entries in a map, and implements the same error
+semantics as the real datastores: creating an entry that exists returns an
+ErrorResourceAlreadyExists, reading, updating or deleting an entry that does
+not exist returns an ErrorResourceDoesNotExist, and a write whose revision
+is not current returns an ErrorResourceUpdateConflict.  Revisions are
+uint64, as with the etcd backend.
+
+Errors may be injected for particular operations and keys, to exercise the
+retry and cleanup paths of the code under test.
+*/
+package fake
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+// Operation identifies a Client method, for injecting errors.
+type Operation string
+
+const (
+	OperationCreate Operation = "create"
+	OperationUpdate Operation = "update"
+	OperationApply  Operation = "apply"
+	OperationDelete Operation = "delete"
+	OperationGet    Operation = "get"
+	OperationList   Operation = "list"
+	OperationTxn    Operation = "txn"
+	OperationPing   Operation = "ping"
+)
+
+// injectedError is an error to return from an operation.
+type injectedError struct {
+	op  Operation
+	key string
+	err error
+	// remaining is the number of times the error is still to be
+	// returned, or -1 to return it until the errors are cleared.
+	remaining int
+}
+
+// Client is an in-memory implementation of the backend api.Client.  It is
+// safe for concurrent use.  Stored values are copies of those passed in, and
+// values returned are copies of those stored, so callers never share values
+// with the store, as with a real datastore.
+type Client struct {
+	lock     sync.Mutex
+	kvps     map[string]*model.KVPair
+	revision uint64
+	errs     []*injectedError
+
+	// The lists being paged through, keyed by the ID in their continue
+	// tokens.
+	lists  map[uint64]*listSnapshot
+	listID uint64
+}
+
+// listSnapshot holds the entries matching a list, sorted by key, as they were
+// when the first page was read.
+type listSnapshot struct {
+	listType string
+	kvps     []*model.KVPair
+}
+
+// NewClient returns an empty fake client.
+func NewClient() *Client {
+	return &Client{kvps: map[string]*model.KVPair{}, lists: map[uint64]*listSnapshot{}}
+}
+
+var _ api.Client = (*Client)(nil)
+
+// InjectError arranges for the next count calls of the operation on the key
+// to fail with the given error, without making any change.  A nil key
+// matches every key, and is the only key that matches a List or Ping.  If
+// count is 0 or less, the error is returned until ClearErrors is called.
+// Errors injected for an operation within a transaction fail the
+// transaction.
+func (c *Client) InjectError(op Operation, key model.Key, err error, count int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ie := &injectedError{op: op, err: err, remaining: count}
+	if key != nil {
+		ie.key = key.String()
+	}
+	if count <= 0 {
+		ie.remaining = -1
+	}
+	c.errs = append(c.errs, ie)
+}
+
+// ClearErrors removes all of the injected errors.
+func (c *Client) ClearErrors() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.errs = nil
+}
+
+// injected returns the error injected for the operation on the key, if any.
+// Must be called with the lock held.
+func (c *Client) injected(op Operation, key model.Key) error {
+	for i, ie := range c.errs {
+		if ie.op != op || (ie.key != "" && (key == nil || ie.key != key.String())) {
+			continue
+		}
+		if ie.remaining > 0 {
+			ie.remaining--
+			if ie.remaining == 0 {
+				c.errs = append(c.errs[:i], c.errs[i+1:]...)
+			}
+		}
+		log.WithFields(log.Fields{"op": op, "key": key}).Debug("Returning injected error")
+		return ie.err
+	}
+	return nil
+}
+
+// Create creates the entry, which must not already exist.
+func (c *Client) Create(kvp *model.KVPair) (*model.KVPair, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.injected(OperationCreate, kvp.Key); err != nil {
+		return nil, err
+	}
+	return c.create(kvp)
+}
+
+// Update modifies the existing entry.  If the KVPair has a revision, it
+// must be the current revision of the entry.
+func (c *Client) Update(kvp *model.KVPair) (*model.KVPair, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.injected(OperationUpdate, kvp.Key); err != nil {
+		return nil, err
+	}
+	return c.update(kvp)
+}
+
+// Apply creates or modifies the entry.  If the KVPair has a revision, the
+// entry must exist and be at that revision.
+func (c *Client) Apply(kvp *model.KVPair) (*model.KVPair, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.injected(OperationApply, kvp.Key); err != nil {
+		return nil, err
+	}
+	return c.apply(kvp)
+}
+
+// Delete removes the entry, along with any entries beneath it in the
+// hierarchy of default paths.  If the KVPair has a revision, it must be the
+// current revision of the entry.
+func (c *Client) Delete(kvp *model.KVPair) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.injected(OperationDelete, kvp.Key); err != nil {
+		return err
+	}
+	return c.delete(kvp)
+}
+
+// DeleteKeys removes the entries with the given keys.  Keys that do not exist
+// are treated as successfully deleted.
+func (c *Client) DeleteKeys(keys []model.Key) map[string]error {
+	errs := map[string]error{}
+	for _, k := range keys {
+		err := c.Delete(&model.KVPair{Key: k})
+		if err != nil && !errors.IsNotExist(err) {
+			errs[k.String()] = err
+		}
+	}
+	return errs
+}
+
+// Txn performs the operations atomically.  If any operation fails, the
+// entries are restored to their state before the transaction.
+func (c *Client) Txn(ops []api.TxnOp, bestEffort bool) ([]*model.KVPair, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.injected(OperationTxn, nil); err != nil {
+		return nil, err
+	}
+
+	saved := map[string]*model.KVPair{}
+	for k, v := range c.kvps {
+		saved[k] = v
+	}
+	results := make([]*model.KVPair, len(ops))
+	for i, op := range ops {
+		kvp, err := c.txnOp(op)
+		if err != nil {
+			c.kvps = saved
+			return nil, err
+		}
+		results[i] = kvp
+	}
+	return results, nil
+}
+
+// txnOp performs a single transaction operation.  Must be called with the
+// lock held.
+func (c *Client) txnOp(op api.TxnOp) (*model.KVPair, error) {
+	switch op.Type {
+	case api.TxnCreate:
+		if err := c.injected(OperationCreate, op.KVPair.Key); err != nil {
+			return nil, err
+		}
+		return c.create(op.KVPair)
+	case api.TxnUpdate:
+		if err := c.injected(OperationUpdate, op.KVPair.Key); err != nil {
+			return nil, err
+		}
+		return c.update(op.KVPair)
+	case api.TxnApply:
+		if err := c.injected(OperationApply, op.KVPair.Key); err != nil {
+			return nil, err
+		}
+		return c.apply(op.KVPair)
+	case api.TxnDelete:
+		if err := c.injected(OperationDelete, op.KVPair.Key); err != nil {
+			return nil, err
+		}
+		return nil, c.delete(op.KVPair)
+	}
+	return nil, errors.ErrorOperationNotSupported{
+		Identifier: op.KVPair.Key,
+		Operation:  op.Type.String(),
+	}
+}
+
+// Get returns the entry with the given key.
+func (c *Client) Get(key model.Key) (*model.KVPair, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.injected(OperationGet, key); err != nil {
+		return nil, err
+	}
+	kvp, ok := c.kvps[key.String()]
+	if !ok {
+		return nil, errors.ErrorResourceDoesNotExist{Identifier: key}
+	}
+	return copyKVPair(kvp), nil
+}
+
+// List returns the entries matching the list options.
+func (c *Client) List(l model.ListInterface) ([]*model.KVPair, error) {
+	kvps, _, err := c.ListPage(l, 0, "")
+	return kvps, err
+}
+
+// ListPage returns a page of the entries matching the list options, ordered
+// by key.  The first page takes a sorted snapshot of the matching entries and
+// later pages are sliced from it, so that paging through a list reads each
+// entry once and, as with a datastore that lists from a consistent snapshot,
+// changes made after the first page are not seen.
+func (c *Client) ListPage(l model.ListInterface, limit int, token string) ([]*model.KVPair, string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.injected(OperationList, nil); err != nil {
+		return nil, "", err
+	}
+	listType := fmt.Sprintf("%T", l)
+
+	var id uint64
+	var offset int
+	var snapshot *listSnapshot
+	if token == "" {
+		root := model.ListOptionsToDefaultPathRoot(l)
+		kvps := []*model.KVPair{}
+		for _, kvp := range c.kvps {
+			path, err := model.KeyToDefaultPath(kvp.Key)
+			if err == nil && strings.HasPrefix(path, root) && l.KeyFromDefaultPath(path) != nil {
+				kvps = append(kvps, kvp)
+			}
+		}
+		sorted, _, err := api.PageKVPairs(kvps, l, 0, "")
+		if err != nil {
+			return nil, "", err
+		}
+		c.listID++
+		id = c.listID
+		snapshot = &listSnapshot{listType: listType, kvps: sorted}
+	} else {
+		if _, err := fmt.Sscanf(token, "%d:%d", &id, &offset); err != nil {
+			return nil, "", errors.ErrorInvalidContinueToken{Token: token, Reason: "token is malformed"}
+		}
+		snapshot = c.lists[id]
+		if snapshot == nil || offset < 0 || offset > len(snapshot.kvps) {
+			return nil, "", errors.ErrorInvalidContinueToken{Token: token, Reason: "token has expired"}
+		}
+		if snapshot.listType != listType {
+			return nil, "", errors.ErrorInvalidContinueToken{Token: token, Reason: "token was issued for a different list"}
+		}
+	}
+
+	end := len(snapshot.kvps)
+	next := ""
+	if limit > 0 && offset+limit < end {
+		end = offset + limit
+		next = fmt.Sprintf("%d:%d", id, end)
+		c.lists[id] = snapshot
+	} else {
+		delete(c.lists, id)
+	}
+	page := []*model.KVPair{}
+	for _, kvp := range snapshot.kvps[offset:end] {
+		page = append(page, copyKVPair(kvp))
+	}
+	return page, next, nil
+}
+
+// Syncer returns a syncer which sends the entries stored when it is started,
+// and then reports that it is in sync.  Later changes are not sent.
+func (c *Client) Syncer(callbacks api.SyncerCallbacks) api.Syncer {
+	return &syncer{client: c, callbacks: callbacks}
+}
+
+// EnsureInitialized does nothing.
+func (c *Client) EnsureInitialized() error {
+	return nil
+}
+
+// Ping returns any error injected for OperationPing.
+func (c *Client) Ping(ctx context.Context) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.injected(OperationPing, nil)
+}
+
+// EnsureCalicoNodeInitialized does nothing.
+func (c *Client) EnsureCalicoNodeInitialized(node string) error {
+	return nil
+}
+
+// create, update, apply and delete make the changes for the Client methods
+// of the same name.  They must be called with the lock held.
+
+func (c *Client) create(kvp *model.KVPair) (*model.KVPair, error) {
+	if _, ok := c.kvps[kvp.Key.String()]; ok {
+		return nil, errors.ErrorResourceAlreadyExists{Identifier: kvp.Key}
+	}
+	return c.store(kvp)
+}
+
+func (c *Client) update(kvp *model.KVPair) (*model.KVPair, error) {
+	existing, ok := c.kvps[kvp.Key.String()]
+	if !ok {
+		return nil, errors.ErrorResourceDoesNotExist{Identifier: kvp.Key}
+	}
+	if kvp.Revision != nil && kvp.Revision != existing.Revision {
+		return nil, errors.ErrorResourceUpdateConflict{Identifier: kvp.Key}
+	}
+	return c.store(kvp)
+}
+
+func (c *Client) apply(kvp *model.KVPair) (*model.KVPair, error) {
+	if kvp.Revision != nil {
+		return c.update(kvp)
+	}
+	return c.store(kvp)
+}
+
+func (c *Client) delete(kvp *model.KVPair) error {
+	existing, ok := c.kvps[kvp.Key.String()]
+	if !ok {
+		return errors.ErrorResourceDoesNotExist{Identifier: kvp.Key}
+	}
+	if kvp.Revision != nil && kvp.Revision != existing.Revision {
+		return errors.ErrorResourceUpdateConflict{Identifier: kvp.Key}
+	}
+	delete(c.kvps, kvp.Key.String())
+
+	// Delete is recursive, so remove any entries beneath this one.
+	if path, err := model.KeyToDefaultPath(kvp.Key); err == nil {
+		for k, v := range c.kvps {
+			if p, err := model.KeyToDefaultPath(v.Key); err == nil && strings.HasPrefix(p, path+"/") {
+				delete(c.kvps, k)
+			}
+		}
+	}
+	return nil
+}
+
+// store stores a copy of the KVPair at the next revision, and returns
+// another copy of the stored KVPair.
+func (c *Client) store(kvp *model.KVPair) (*model.KVPair, error) {
+	stored := copyKVPair(kvp)
+	if stored == nil {
+		return nil, errors.ErrorValidation{
+			ErroredFields: []errors.ErroredField{{Name: "Value", Value: kvp.Value}},
+		}
+	}
+	c.revision++
+	stored.Revision = c.revision
+	c.kvps[kvp.Key.String()] = stored
+	return copyKVPair(stored), nil
+}
+
+// copyKVPair returns a deep copy of the KVPair, made by serializing and
+// parsing its value.  Returns nil if the value cannot be serialized.
+func copyKVPair(kvp *model.KVPair) *model.KVPair {
+	data, err := model.SerializeValue(kvp)
+	if err != nil {
+		log.WithError(err).WithField("key", kvp.Key).Warning("Unable to serialize value")
+		return nil
+	}
+	value, err := model.ParseValue(kvp.Key, data)
+	if err != nil {
+		log.WithError(err).WithField("key", kvp.Key).Warning("Unable to parse value")
+		return nil
+	}
+	return &model.KVPair{Key: kvp.Key, Value: value, Revision: kvp.Revision}
+}
+
+// syncer sends a snapshot of the entries in a fake client.
+type syncer struct {
+	client    *Client
+	callbacks api.SyncerCallbacks
+}
+
+func (s *syncer) Start() {
+	s.callbacks.OnStatusUpdated(api.ResyncInProgress)
+	s.client.lock.Lock()
+	updates := []api.Update{}
+	for _, kvp := range s.client.kvps {
+		updates = append(updates, api.Update{KVPair: *copyKVPair(kvp), UpdateType: api.UpdateTypeKVNew})
+	}
+	s.client.lock.Unlock()
+	if len(updates) > 0 {
+		s.callbacks.OnUpdates(updates)
+	}
+	s.callbacks.OnStatusUpdated(api.InSync)
+}
@@ -0,0 +1,305 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fake_test
+
+import (
+	goerrors "errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/fake"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// recordingCallbacks records the updates and statuses sent by a syncer.
+type recordingCallbacks struct {
+	statuses []api.SyncStatus
+	updates  []api.Update
+}
+
+func (r *recordingCallbacks) OnStatusUpdated(status api.SyncStatus) {
+	r.statuses = append(r.statuses, status)
+}
+
+func (r *recordingCallbacks) OnUpdates(updates []api.Update) {
+	r.updates = append(r.updates, updates...)
+}
+
+var _ = Describe("Fake backend client", func() {
+	blockA := net.MustParseNetwork("10.0.0.0/26")
+	blockB := net.MustParseNetwork("10.0.0.64/26")
+	keyA := model.BlockKey{CIDR: blockA}
+	keyB := model.BlockKey{CIDR: blockB}
+
+	var c *fake.Client
+
+	BeforeEach(func() {
+		c = fake.NewClient()
+	})
+
+	block := func(key model.BlockKey) *model.KVPair {
+		return &model.KVPair{Key: key, Value: &model.AllocationBlock{
+			CIDR:        key.CIDR,
+			Allocations: make([]*int, 64),
+			Unallocated: []int{},
+		}}
+	}
+
+	It("should create, get, update and delete an entry", func() {
+		created, err := c.Create(block(keyA))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(created.Revision).To(Equal(uint64(1)))
+
+		got, err := c.Get(keyA)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got.Revision).To(Equal(created.Revision))
+
+		updated, err := c.Update(got)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(updated.Revision).To(Equal(uint64(2)))
+
+		Expect(c.Delete(updated)).To(Succeed())
+		_, err = c.Get(keyA)
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should return the datastore errors", func() {
+		_, err := c.Update(block(keyA))
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+		Expect(errors.IsNotExist(c.Delete(block(keyA)))).To(BeTrue())
+
+		_, err = c.Create(block(keyA))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = c.Create(block(keyA))
+		Expect(errors.IsAlreadyExists(err)).To(BeTrue())
+	})
+
+	It("should compare and swap on the revision", func() {
+		_, err := c.Create(block(keyA))
+		Expect(err).NotTo(HaveOccurred())
+		first, err := c.Get(keyA)
+		Expect(err).NotTo(HaveOccurred())
+		second, err := c.Get(keyA)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = c.Update(first)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = c.Update(second)
+		Expect(errors.IsUpdateConflict(err)).To(BeTrue())
+		_, err = c.Apply(second)
+		Expect(errors.IsUpdateConflict(err)).To(BeTrue())
+		Expect(errors.IsUpdateConflict(c.Delete(second))).To(BeTrue())
+
+		// Without a revision, the write is unconditional.
+		_, err = c.Apply(block(keyA))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should honor a revision copied onto a new entry", func() {
+		created, err := c.Create(block(keyA))
+		Expect(err).NotTo(HaveOccurred())
+
+		// A write conditional on the current revision succeeds.
+		kvp := block(keyA)
+		kvp.Revision = created.Revision
+		updated, err := c.Update(kvp)
+		Expect(err).NotTo(HaveOccurred())
+
+		// The revision it replaced is now stale.
+		kvp = block(keyA)
+		kvp.Revision = created.Revision
+		_, err = c.Update(kvp)
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceUpdateConflict{}))
+
+		kvp.Revision = updated.Revision
+		_, err = c.Update(kvp)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should not share values with the caller", func() {
+		kvp := block(keyA)
+		_, err := c.Create(kvp)
+		Expect(err).NotTo(HaveOccurred())
+		kvp.Value.(*model.AllocationBlock).StrictAffinity = true
+
+		got, err := c.Get(keyA)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got.Value.(*model.AllocationBlock).StrictAffinity).To(BeFalse())
+		got.Value.(*model.AllocationBlock).StrictAffinity = true
+
+		got, err = c.Get(keyA)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got.Value.(*model.AllocationBlock).StrictAffinity).To(BeFalse())
+	})
+
+	It("should list and page the matching entries", func() {
+		for _, kvp := range []*model.KVPair{
+			block(keyB),
+			block(keyA),
+			{Key: model.IPAMHandleKey{HandleID: "handle-a"}, Value: &model.IPAMHandle{Block: map[string]int{}}},
+		} {
+			_, err := c.Create(kvp)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		kvps, err := c.List(model.BlockListOptions{IPVersion: 4})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kvps).To(HaveLen(2))
+		kvps, err = c.List(model.BlockListOptions{IPVersion: 6})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kvps).To(BeEmpty())
+
+		page, token, err := c.ListPage(model.BlockListOptions{}, 1, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(page).To(HaveLen(1))
+		Expect(page[0].Key).To(Equal(keyA))
+		page, token, err = c.ListPage(model.BlockListOptions{}, 1, token)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(page[0].Key).To(Equal(keyB))
+		Expect(token).To(Equal(""))
+	})
+
+	It("should page from a snapshot taken by the first page", func() {
+		_, err := c.Create(block(keyA))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = c.Create(block(keyB))
+		Expect(err).NotTo(HaveOccurred())
+
+		page, token, err := c.ListPage(model.BlockListOptions{}, 1, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(page[0].Key).To(Equal(keyA))
+
+		// Changes made after the first page are not seen.
+		Expect(c.Delete(&model.KVPair{Key: keyB})).To(Succeed())
+		_, err = c.Create(block(model.BlockKey{CIDR: net.MustParseNetwork("10.0.0.128/26")}))
+		Expect(err).NotTo(HaveOccurred())
+		page, next, err := c.ListPage(model.BlockListOptions{}, 1, token)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(page[0].Key).To(Equal(keyB))
+		Expect(next).To(Equal(""))
+
+		// The token cannot be used once the list is done, or for another
+		// list.
+		_, _, err = c.ListPage(model.BlockListOptions{}, 1, token)
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorInvalidContinueToken{}))
+		_, token, err = c.ListPage(model.BlockListOptions{}, 1, "")
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = c.ListPage(model.IPAMHandleListOptions{}, 1, token)
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorInvalidContinueToken{}))
+		_, _, err = c.ListPage(model.BlockListOptions{}, 1, "garbage")
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorInvalidContinueToken{}))
+	})
+
+	It("should delete the keys given", func() {
+		_, err := c.Create(block(keyA))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.DeleteKeys([]model.Key{keyA, keyB})).To(BeEmpty())
+		_, err = c.Get(keyA)
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should perform a transaction atomically", func() {
+		_, err := c.Create(block(keyB))
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = c.Txn([]api.TxnOp{
+			{Type: api.TxnCreate, KVPair: block(keyA)},
+			{Type: api.TxnCreate, KVPair: block(keyB)},
+		}, false)
+		Expect(errors.IsAlreadyExists(err)).To(BeTrue())
+		_, err = c.Get(keyA)
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+
+		results, err := c.Txn([]api.TxnOp{
+			{Type: api.TxnCreate, KVPair: block(keyA)},
+			{Type: api.TxnDelete, KVPair: &model.KVPair{Key: keyB}},
+		}, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(results).To(HaveLen(2))
+		Expect(results[1]).To(BeNil())
+		_, err = c.Get(keyB)
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should send the stored entries from the syncer", func() {
+		_, err := c.Create(block(keyA))
+		Expect(err).NotTo(HaveOccurred())
+		callbacks := &recordingCallbacks{}
+		c.Syncer(callbacks).Start()
+		Expect(callbacks.statuses).To(Equal([]api.SyncStatus{api.ResyncInProgress, api.InSync}))
+		Expect(callbacks.updates).To(HaveLen(1))
+		Expect(callbacks.updates[0].Key).To(Equal(keyA))
+	})
+
+	Describe("with injected errors", func() {
+		injected := goerrors.New("injected")
+
+		It("should fail the operation on the key the given number of times", func() {
+			c.InjectError(fake.OperationCreate, keyA, injected, 2)
+			for i := 0; i < 2; i++ {
+				_, err := c.Create(block(keyA))
+				Expect(err).To(Equal(injected))
+			}
+			_, err := c.Get(keyA)
+			Expect(errors.IsNotExist(err)).To(BeTrue())
+
+			_, err = c.Create(block(keyA))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should only fail the operation on the key", func() {
+			c.InjectError(fake.OperationCreate, keyA, injected, 0)
+			_, err := c.Create(block(keyB))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = c.Apply(block(keyA))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should fail the operation on every key until cleared", func() {
+			c.InjectError(fake.OperationGet, nil, injected, 0)
+			for _, k := range []model.Key{keyA, keyB, keyA} {
+				_, err := c.Get(k)
+				Expect(err).To(Equal(injected))
+			}
+			c.ClearErrors()
+			_, err := c.Get(keyA)
+			Expect(errors.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("should fail lists and pings", func() {
+			c.InjectError(fake.OperationList, nil, injected, 1)
+			c.InjectError(fake.OperationPing, nil, injected, 1)
+			_, err := c.List(model.BlockListOptions{})
+			Expect(err).To(Equal(injected))
+			Expect(c.Ping(nil)).To(Equal(injected))
+			Expect(c.Ping(nil)).To(Succeed())
+		})
+
+		It("should roll back a transaction with a failed operation", func() {
+			c.InjectError(fake.OperationCreate, keyB, injected, 1)
+			_, err := c.Txn([]api.TxnOp{
+				{Type: api.TxnCreate, KVPair: block(keyA)},
+				{Type: api.TxnCreate, KVPair: block(keyB)},
+			}, false)
+			Expect(err).To(Equal(injected))
+			_, err = c.Get(keyA)
+			Expect(errors.IsNotExist(err)).To(BeTrue())
+		})
+	})
+})
@@ -158,12 +158,13 @@ func (c converter) podToWorkloadEndpoint(pod *kapiv1.Pod) (*model.KVPair, error)
 	// a DELETE update will not include an IP.
 	ipNets := []cnet.IPNet{}
 	if c.hasIPAddress(pod) {
-		_, ipNet, err := cnet.ParseCIDR(fmt.Sprintf("%s/32", pod.Status.PodIP))
-		if err != nil {
+		ip := cnet.ParseIP(pod.Status.PodIP)
+		if ip == nil {
+			err := fmt.Errorf("invalid pod IP %s", pod.Status.PodIP)
 			log.WithFields(log.Fields{"ip": pod.Status.PodIP, "pod": pod.Name}).WithError(err).Error("Failed to parse pod IP")
 			return nil, err
 		}
-		ipNets = append(ipNets, *ipNet)
+		ipNets = append(ipNets, cnet.HostIPNet(*ip))
 	}
 
 	// Generate the interface name and MAC based on workload.  This must match
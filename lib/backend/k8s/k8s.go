@@ -29,6 +29,7 @@ import (
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
 	"github.com/projectcalico/libcalico-go/lib/errors"
 	"github.com/projectcalico/libcalico-go/lib/net"
+	"golang.org/x/net/context"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -164,6 +165,28 @@ func (c *KubeClient) EnsureInitialized() error {
 	return nil
 }
 
+// Ping checks that the Kubernetes API server is reachable by querying its
+// version.
+func (c *KubeClient) Ping(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.clientSet.Discovery().ServerVersion()
+		done <- err
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		log.WithError(err).Warning("Kubernetes API server is unavailable")
+		return errors.ErrorDatastoreUnavailable{Err: err}
+	}
+	return nil
+}
+
 func (c *KubeClient) EnsureCalicoNodeInitialized(node string) error {
 	log.WithField("Node", node).Info("Ensuring node is initialized")
 	return nil
@@ -375,9 +398,18 @@ func (c *KubeClient) Update(d *model.KVPair) (*model.KVPair, error) {
 }
 
 // Set an existing entry in the datastore.  This ignores whether an entry already
-// exists.
+// exists, unless the KVPair has revision information, in which case the entry
+// is updated as by Update, as it is for etcd.  Workload endpoints are backed by
+// pods whose status is always overwritten, so their revision is ignored.
 func (c *KubeClient) Apply(d *model.KVPair) (*model.KVPair, error) {
 	log.Debugf("Performing 'Apply' for %+v", d)
+	if d.Revision != nil {
+		switch d.Key.(type) {
+		case model.GlobalConfigKey, model.IPPoolKey, model.NodeKey, model.GlobalBGPPeerKey,
+			model.NodeBGPPeerKey, model.GlobalBGPConfigKey, model.NodeBGPConfigKey:
+			return c.Update(d)
+		}
+	}
 	switch d.Key.(type) {
 	case model.WorkloadEndpointKey:
 		return c.applyWorkloadEndpoint(d)
@@ -437,6 +469,32 @@ func (c *KubeClient) Delete(d *model.KVPair) error {
 	}
 }
 
+// DeleteKeys deletes the entries identified by the supplied keys.  The
+// Kubernetes API does not support batched deletes, so each key is deleted
+// in turn.
+func (c *KubeClient) DeleteKeys(keys []model.Key) map[string]error {
+	errs := map[string]error{}
+	for _, k := range keys {
+		err := c.Delete(&model.KVPair{Key: k})
+		if err != nil {
+			if _, ok := err.(errors.ErrorResourceDoesNotExist); !ok {
+				errs[k.String()] = err
+			}
+		}
+	}
+	return errs
+}
+
+// Txn performs the supplied operations.  The Kubernetes API does not support
+// multi-resource transactions, so unless bestEffort is set, no changes are
+// made and an ErrorTransactionNotAtomic is returned.
+func (c *KubeClient) Txn(ops []api.TxnOp, bestEffort bool) ([]*model.KVPair, error) {
+	if !bestEffort {
+		return nil, errors.ErrorTransactionNotAtomic{Reason: "the Kubernetes API does not support multi-resource transactions"}
+	}
+	return api.BestEffortTxn(c, ops)
+}
+
 // Get an entry from the datastore.  This errors if the entry does not exist.
 func (c *KubeClient) Get(k model.Key) (*model.KVPair, error) {
 	log.Debugf("Performing 'Get' for %+v", k)
@@ -473,6 +531,17 @@ func (c *KubeClient) Get(k model.Key) (*model.KVPair, error) {
 	}
 }
 
+// ListPage returns a page of the entries matching the request in the
+// ListInterface.  Paginated reads are not supported by the version of the
+// Kubernetes API in use, so the full set of entries is read and paged locally.
+func (c *KubeClient) ListPage(l model.ListInterface, limit int, continueToken string) ([]*model.KVPair, string, error) {
+	kvps, err := c.List(l)
+	if err != nil {
+		return nil, "", err
+	}
+	return api.PageKVPairs(kvps, l, limit, continueToken)
+}
+
 // List entries in the datastore.  This may return an empty list if there are
 // no entries matching the request in the ListInterface.
 func (c *KubeClient) List(l model.ListInterface) ([]*model.KVPair, error) {
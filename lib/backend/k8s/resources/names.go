@@ -16,6 +16,8 @@ package resources
 
 import (
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/projectcalico/libcalico-go/lib/net"
@@ -26,10 +28,20 @@ import (
 // This file contains various name conversion methods that can be used to convert
 // between Calico key types and resource names.
 
+// maxPrefixedNameLength is the maximum length of a name with a prefix, which
+// is the maximum length of a DNS-1123 label.
+const maxPrefixedNameLength = 63
+
+// matchNamePrefix matches a prefix made up of DNS-1123 label characters,
+// starting and ending with an alphanumeric character.
+var matchNamePrefix = regexp.MustCompile("^[a-z0-9]([-a-z0-9]*[a-z0-9])?$")
+
 // IPToResourceName converts an IP address to a name used for a k8s resource.
+// An IPv6 address is converted from its compressed canonical form, so the
+// "::" in the address becomes a single "--" in the name.
 func IPToResourceName(ip net.IP) string {
-	name := strings.Replace(ip.String(), ".", "-", 3)
-	name = strings.Replace(name, ":", "-", 7)
+	ip = ip.Normalize()
+	name := ipNameForm(ip)
 
 	log.WithFields(log.Fields{
 		"Name": name,
@@ -40,14 +52,48 @@ func IPToResourceName(ip net.IP) string {
 }
 
 // ResourceNameToIP converts a name used for a k8s resource to an IP address.
+// Only the name returned by IPToResourceName is accepted, so that each
+// address has exactly one name.
 func ResourceNameToIP(name string) (*net.IP, error) {
 	ip := net.ParseIP(resourceNameToIPString(name))
-	if ip == nil {
+	if ip == nil || ipNameForm(*ip) != name {
 		return nil, fmt.Errorf("invalid resource name %s: does not follow Calico IP name format", name)
 	}
 	return ip, nil
 }
 
+// IPToResourceNameWithPrefix converts an IP address to a name used for a k8s
+// resource, as IPToResourceName does, prefixed with the given prefix and a
+// dash.  The prefix distinguishes the names of different resource types
+// converted from the same IP.  It must only contain lower case alphanumeric
+// characters and dashes, start and end with an alphanumeric character, and
+// the name must be no longer than 63 characters.
+func IPToResourceNameWithPrefix(prefix string, ip net.IP) (string, error) {
+	if err := validateNamePrefix(prefix); err != nil {
+		return "", err
+	}
+	name := prefix + "-" + IPToResourceName(ip)
+	if len(name) > maxPrefixedNameLength {
+		return "", fmt.Errorf("resource name %s is longer than %d characters", name, maxPrefixedNameLength)
+	}
+	return name, nil
+}
+
+// ResourceNameWithPrefixToIP converts a name returned by
+// IPToResourceNameWithPrefix with the given prefix back to an IP address.
+func ResourceNameWithPrefixToIP(prefix string, name string) (*net.IP, error) {
+	if err := validateNamePrefix(prefix); err != nil {
+		return nil, err
+	}
+	if len(name) > maxPrefixedNameLength {
+		return nil, fmt.Errorf("invalid resource name %s: longer than %d characters", name, maxPrefixedNameLength)
+	}
+	if !strings.HasPrefix(name, prefix+"-") {
+		return nil, fmt.Errorf("invalid resource name %s: does not have prefix %s", name, prefix)
+	}
+	return ResourceNameToIP(name[len(prefix)+1:])
+}
+
 // IPNetToResourceName converts the given IPNet into a name used for a k8s resource.
 func IPNetToResourceName(net net.IPNet) string {
 	name := strings.Replace(net.String(), ".", "-", 3)
@@ -64,42 +110,158 @@ func IPNetToResourceName(net net.IPNet) string {
 
 // ResourceNameToIPNet converts a name used for a k8s resource to an IPNet.
 func ResourceNameToIPNet(name string) (*net.IPNet, error) {
+	cidr, _, _, err := ParseIPNetResourceName(name)
+	return cidr, err
+}
+
+// ParseIPNetResourceName converts a name used for a k8s resource to an IPNet,
+// as ResourceNameToIPNet does.  It also returns the canonical string form of
+// the IPNet, and whether the IP address encoded in the name had host bits set,
+// meaning that the name was not converted from a network address and the
+// IPNet was masked.  The IP address must be encoded in its canonical form,
+// which for IPv6 is the compressed form.
+func ParseIPNetResourceName(name string) (cidr *net.IPNet, canonical string, hostBits bool, err error) {
 	// The last dash should be replaced by a "/"
 	idx := strings.LastIndex(name, "-")
 	if idx == -1 {
-		return nil, fmt.Errorf("invalid resource name: %s: does not follow Calico IPNet name format", name)
+		return nil, "", false, fmt.Errorf("invalid resource name: %s: does not follow Calico IPNet name format", name)
 	}
 	ipstr := resourceNameToIPString(name[:idx])
 	size := name[idx+1:]
 
-	_, cidr, err := net.ParseCIDR(ipstr + "/" + size)
+	ip, cidr, err := net.ParseCIDR(ipstr + "/" + size)
+	if err != nil || ipNameForm(*ip) != name[:idx] {
+		return nil, "", false, fmt.Errorf("invalid resource name %s: does not follow Calico IPNet name format", name)
+	}
+	return cidr, cidr.String(), !ip.Equal(cidr.IP), nil
+}
+
+// IPNetPortToResourceName converts the given IPNet and port into a name used
+// for a k8s resource.  The name is the IPNet name, as returned by
+// IPNetToResourceName, followed by a dash and the port.
+func IPNetPortToResourceName(net net.IPNet, port uint16) string {
+	name := IPNetToResourceName(net) + "-" + strconv.Itoa(int(port))
+
+	log.WithFields(log.Fields{
+		"Name":  name,
+		"IPNet": net.String(),
+		"Port":  port,
+	}).Debug("Converting IPNet and port to resource name")
+
+	return name
+}
+
+// ResourceNameToIPNetPort converts a name used for a k8s resource to an IPNet
+// and port.  The port must be between 1 and 65535, written without leading
+// zeros.
+func ResourceNameToIPNetPort(name string) (*net.IPNet, uint16, error) {
+	// The last dash separates the port from the IPNet.
+	idx := strings.LastIndex(name, "-")
+	if idx == -1 {
+		return nil, 0, fmt.Errorf("invalid resource name %s: does not follow Calico IPNet and port name format", name)
+	}
+	suffix := name[idx+1:]
+	port, err := strconv.ParseUint(suffix, 10, 16)
+	if err != nil || port == 0 || strconv.FormatUint(port, 10) != suffix {
+		return nil, 0, fmt.Errorf("invalid resource name %s: %q is not a valid port", name, suffix)
+	}
+	cidr, err := ResourceNameToIPNet(name[:idx])
 	if err != nil {
-		return nil, fmt.Errorf("invalid resource name %s: does not follow Calico IPNet name format", name)
+		return nil, 0, fmt.Errorf("invalid resource name %s: does not follow Calico IPNet and port name format", name)
 	}
-	return cidr, nil
+	return cidr, uint16(port), nil
+}
+
+// validateNamePrefix returns an error if the prefix is not valid for use with
+// IPToResourceNameWithPrefix.
+func validateNamePrefix(prefix string) error {
+	if !matchNamePrefix.MatchString(prefix) {
+		return fmt.Errorf("invalid resource name prefix %q: must consist of lower case alphanumeric characters or '-', and start and end with an alphanumeric character", prefix)
+	}
+	return nil
+}
+
+// IsCalicoIPResourceName returns true if the name is in the format used by
+// IPToResourceName, and so may be converted back to an IP address using
+// ResourceNameToIP.
+func IsCalicoIPResourceName(name string) bool {
+	if !isIPResourceNameFormat(name) {
+		return false
+	}
+	ip := net.ParseIP(convertResourceNameToIPString(name))
+	return ip != nil && ipNameForm(*ip) == name
+}
+
+// IsCalicoIPNetResourceName returns true if the name is in the format used by
+// IPNetToResourceName, and so may be converted back to an IP network using
+// ResourceNameToIPNet.
+func IsCalicoIPNetResourceName(name string) bool {
+	idx := strings.LastIndex(name, "-")
+	if idx == -1 || !isIPResourceNameFormat(name[:idx]) {
+		return false
+	}
+	size := name[idx+1:]
+	if size == "" || strings.IndexFunc(size, func(r rune) bool { return r < '0' || r > '9' }) != -1 {
+		return false
+	}
+	ip, _, err := net.ParseCIDR(convertResourceNameToIPString(name[:idx]) + "/" + size)
+	return err == nil && ipNameForm(*ip) == name[:idx]
+}
+
+// ipNameForm returns the canonical text form of the IP address, with the
+// periods or colons replaced by dashes.  This is the form an IP address takes
+// in a resource name.
+func ipNameForm(ip net.IP) string {
+	if ip.To4() != nil {
+		return strings.Replace(ip.String(), ".", "-", 3)
+	}
+	return strings.Replace(ip.String(), ":", "-", 7)
+}
+
+// isIPResourceNameFormat performs a quick check that the name only contains
+// the characters and number of dashes used in the name of an IP address, so
+// that names which are clearly not IP addresses can be rejected without
+// parsing them.
+func isIPResourceNameFormat(name string) bool {
+	if name == "" || strings.Count(name, "-") > 7 {
+		return false
+	}
+	for _, r := range name {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') && r != '-' {
+			return false
+		}
+	}
+	return true
 }
 
 // resourceNameToIPString converts a name used for a k8s resource to an IP address string.
 // This function does not check the validity of the result - it merely reverses the
 // character conversion used to convert an IP address to a k8s compatible name.
+// Callers should check that the name is the canonical form of the result, using
+// ipNameForm, since the conversion also accepts non-canonical forms.
 func resourceNameToIPString(name string) string {
+	ipstr := convertResourceNameToIPString(name)
+	log.WithFields(log.Fields{
+		"Name": name,
+		"IP":   ipstr,
+	}).Debug("Converting resource name to IP String")
+	return ipstr
+}
+
+// convertResourceNameToIPString performs the conversion for
+// resourceNameToIPString, without logging.
+func convertResourceNameToIPString(name string) string {
 	// The IP address is stored in the name with periods and colons replaced
 	// by dashes.  To determine if this is IPv4 or IPv6 count the dashes.  If
 	// either of the following are true, it's IPv6:
-	// -  There is a "--"
+	// -  There is a "--", which is the "::" of a compressed IPv6 address.
 	// -  The number of "-" is greater than 3.
-	var ipstr string
+	// A compressed IPv6 address has at most 7 colons, and an uncompressed
+	// one has exactly 7, so neither can be mistaken for an IPv4 address.
 	if strings.Contains(name, "--") || strings.Count(name, "-") > 3 {
 		// IPv6:  replace - with :
-		ipstr = strings.Replace(name, "-", ":", 7)
-	} else {
-		// IPv4:  replace - with .
-		ipstr = strings.Replace(name, "-", ".", 3)
+		return strings.Replace(name, "-", ":", 7)
 	}
-
-	log.WithFields(log.Fields{
-		"Name": name,
-		"IP":   ipstr,
-	}).Debug("Converting resource name to IP String")
-	return ipstr
+	// IPv4:  replace - with .
+	return strings.Replace(name, "-", ".", 3)
 }
@@ -15,6 +15,8 @@
 package resources_test
 
 import (
+	"strings"
+
 	"github.com/projectcalico/libcalico-go/lib/backend/k8s/resources"
 	"github.com/projectcalico/libcalico-go/lib/net"
 
@@ -26,6 +28,11 @@ var _ = Describe("Name conversion methods", func() {
 	It("should convert an IPv4 address to a resource compatible name", func() {
 		Expect(resources.IPToResourceName(net.MustParseIP("11.223.3.41"))).To(Equal("11-223-3-41"))
 	})
+	It("should convert an IPv4 address held in 16-byte form to the same name", func() {
+		ip := net.MustParseIP("11.223.3.41")
+		ip.IP = ip.To16()
+		Expect(resources.IPToResourceName(ip)).To(Equal("11-223-3-41"))
+	})
 	It("should convert an IPv6 address to a resource compatible name", func() {
 		Expect(resources.IPToResourceName(net.MustParseIP("AA:1234::BBee:CC"))).To(Equal("aa-1234--bbee-cc"))
 	})
@@ -88,4 +95,166 @@ var _ = Describe("Name conversion methods", func() {
 		_, err := resources.ResourceNameToIPNet("11--223--3-41")
 		Expect(err).To(HaveOccurred())
 	})
+	It("should round trip a single address network", func() {
+		n := net.HostIPNet(net.MustParseIP("11.223.3.41"))
+		name := resources.IPNetToResourceName(n)
+		Expect(name).To(Equal("11-223-3-41-32"))
+		rn, err := resources.ResourceNameToIPNet(name)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(rn.IsSingleAddress()).To(BeTrue())
+		Expect(rn.Equal(n)).To(BeTrue())
+	})
+	It("should encode the compressed form of IPv6 addresses and networks", func() {
+		Expect(resources.IPNetToResourceName(net.MustParseNetwork("2001:db8::1/128"))).To(Equal("2001-db8--1-128"))
+		Expect(resources.IPToResourceName(net.MustParseIP("2001:0db8:0000:0000:0000:0000:0000:0001"))).To(Equal("2001-db8--1"))
+	})
+	It("should round trip IPv6 addresses with :: in different positions", func() {
+		for _, s := range []string{"::", "::1", "2001:db8::", "2001:db8::1", "2001:db8::1:0:0:1", "2001:db8:0:1:1:1:1:1", "fe80::1:2:3:4:5"} {
+			ip := net.MustParseIP(s)
+			name := resources.IPToResourceName(ip)
+			Expect(strings.Count(name, "--")).To(BeNumerically("<=", 1), name)
+			rip, err := resources.ResourceNameToIP(name)
+			Expect(err).NotTo(HaveOccurred(), name)
+			Expect(rip.Equal(ip.IP)).To(BeTrue(), name)
+			Expect(resources.IsCalicoIPResourceName(name)).To(BeTrue(), name)
+
+			n := net.HostIPNet(ip)
+			rn, err := resources.ResourceNameToIPNet(resources.IPNetToResourceName(n))
+			Expect(err).NotTo(HaveOccurred(), name)
+			Expect(rn.Equal(n)).To(BeTrue(), name)
+		}
+	})
+	It("should round trip the CIDRs of IPAM blocks", func() {
+		for _, s := range []string{"10.0.0.0/26", "10.0.0.192/26", "fd80:24e2:f998:72d6::/122", "fd80:24e2:f998:72d6::1c0/122", "2001:db8::1/128", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffc0/122"} {
+			n := net.MustParseNetwork(s)
+			name := resources.IPNetToResourceName(n)
+			Expect(len(name)).To(BeNumerically("<=", 63), name)
+			Expect(resources.IsCalicoIPNetResourceName(name)).To(BeTrue(), name)
+			rn, err := resources.ResourceNameToIPNet(name)
+			Expect(err).NotTo(HaveOccurred(), name)
+			Expect(rn.String()).To(Equal(s))
+		}
+	})
+	It("should not convert names which are not the canonical form of an address", func() {
+		for _, name := range []string{"2001-db8-0-0-0-0-0-1", "2001-0db8--1", "2001-db8----1", "10--0-1", "011-223-3-41"} {
+			_, err := resources.ResourceNameToIP(name)
+			Expect(err).To(HaveOccurred(), name)
+			Expect(resources.IsCalicoIPResourceName(name)).To(BeFalse(), name)
+			_, err = resources.ResourceNameToIPNet(name + "-128")
+			Expect(err).To(HaveOccurred(), name)
+			Expect(resources.IsCalicoIPNetResourceName(name+"-128")).To(BeFalse(), name)
+		}
+	})
+	It("should return the canonical form of a resource name for an IPv4 Network", func() {
+		n, canonical, hostBits, err := resources.ParseIPNetResourceName("11-223-3-128-25")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*n).To(Equal(net.MustParseNetwork("11.223.3.128/25")))
+		Expect(canonical).To(Equal("11.223.3.128/25"))
+		Expect(hostBits).To(BeFalse())
+	})
+	It("should return the canonical form of a resource name for an IPv6 Network", func() {
+		n, canonical, hostBits, err := resources.ParseIPNetResourceName("aa-1234-bbee---120")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*n).To(Equal(net.MustParseNetwork("AA:1234:BBee::/120")))
+		Expect(canonical).To(Equal("aa:1234:bbee::/120"))
+		Expect(hostBits).To(BeFalse())
+	})
+	It("should report a resource name with host bits set", func() {
+		n, canonical, hostBits, err := resources.ParseIPNetResourceName("11-223-3-41-24")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*n).To(Equal(net.MustParseNetwork("11.223.3.0/24")))
+		Expect(canonical).To(Equal("11.223.3.0/24"))
+		Expect(hostBits).To(BeTrue())
+
+		_, _, hostBits, err = resources.ParseIPNetResourceName("aa-1234--bbee-cc-120")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hostBits).To(BeTrue())
+	})
+	It("should not parse an invalid resource name", func() {
+		_, _, _, err := resources.ParseIPNetResourceName("11--223--3-41")
+		Expect(err).To(HaveOccurred())
+	})
+	It("should recognize names converted from IP addresses", func() {
+		Expect(resources.IsCalicoIPResourceName(resources.IPToResourceName(net.MustParseIP("11.223.3.41")))).To(BeTrue())
+		Expect(resources.IsCalicoIPResourceName(resources.IPToResourceName(net.MustParseIP("AA:1234::BBee:CC")))).To(BeTrue())
+	})
+	It("should not recognize names that are not converted from IP addresses", func() {
+		for _, name := range []string{"", "default", "kube-system", "11-223-3", "11-223-3-256", "11-223-3-41-32", "1-2-3-4-5-6-7-8-9"} {
+			Expect(resources.IsCalicoIPResourceName(name)).To(BeFalse(), name)
+		}
+	})
+	It("should recognize names converted from IP networks", func() {
+		Expect(resources.IsCalicoIPNetResourceName(resources.IPNetToResourceName(net.MustParseNetwork("11.223.3.0/24")))).To(BeTrue())
+		Expect(resources.IsCalicoIPNetResourceName(resources.IPNetToResourceName(net.MustParseNetwork("aa:1234::bbee:cc/120")))).To(BeTrue())
+	})
+	It("should not recognize names that are not converted from IP networks", func() {
+		for _, name := range []string{"", "default", "11-223-3-41", "11-223-3-0-33", "11-223-3-0-", "11-223-3-0-2a", "aa-1234--bbee-cc-129"} {
+			Expect(resources.IsCalicoIPNetResourceName(name)).To(BeFalse(), name)
+		}
+	})
+
+	It("should convert an IPv4 Network and port to a resource compatible name", func() {
+		Expect(resources.IPNetPortToResourceName(net.MustParseNetwork("11.223.3.0/24"), 8080)).To(Equal("11-223-3-0-24-8080"))
+	})
+	It("should convert an IPv6 Network and port to a resource compatible name", func() {
+		Expect(resources.IPNetPortToResourceName(net.MustParseNetwork("AA:1234:BBee::/120"), 443)).To(Equal("aa-1234-bbee---120-443"))
+	})
+	It("should round trip IP networks and ports", func() {
+		for _, cidr := range []string{"11.223.3.0/24", "11.223.3.41/32", "aa:1234::bbee:cc00/120", "aa:1234:bbee::/128"} {
+			for _, port := range []uint16{1, 80, 65535} {
+				n, p, err := resources.ResourceNameToIPNetPort(resources.IPNetPortToResourceName(net.MustParseNetwork(cidr), port))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(*n).To(Equal(net.MustParseNetwork(cidr)))
+				Expect(p).To(Equal(port))
+			}
+		}
+	})
+	It("should not convert a resource name with an invalid port", func() {
+		for _, name := range []string{"11-223-3-0-24-0", "11-223-3-0-24-65536", "11-223-3-0-24-080", "11-223-3-0-24-+80", "11-223-3-0-24-http", "11-223-3-0-24-"} {
+			_, _, err := resources.ResourceNameToIPNetPort(name)
+			Expect(err).To(HaveOccurred(), name)
+		}
+	})
+	It("should not convert a resource name without an IP network to an IP network and port", func() {
+		for _, name := range []string{"", "8080", "11-223-3-0-24", "11-223-3-41-80", "default-80"} {
+			_, _, err := resources.ResourceNameToIPNetPort(name)
+			Expect(err).To(HaveOccurred(), name)
+		}
+	})
+
+	It("should convert an IP address to a name with a prefix", func() {
+		name, err := resources.IPToResourceNameWithPrefix("ipam-handle", net.MustParseIP("11.223.3.41"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(name).To(Equal("ipam-handle-11-223-3-41"))
+	})
+	It("should round trip IP addresses through names with a prefix", func() {
+		for _, ip := range []string{"11.223.3.41", "aa:1234::bbee:cc", "aa:1234:bbee::", "::1"} {
+			name, err := resources.IPToResourceNameWithPrefix("p1", net.MustParseIP(ip))
+			Expect(err).NotTo(HaveOccurred())
+			i, err := resources.ResourceNameWithPrefixToIP("p1", name)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*i).To(Equal(net.MustParseIP(ip)))
+		}
+	})
+	It("should reject invalid prefixes", func() {
+		for _, prefix := range []string{"", "-ipam", "ipam-", "IPAM", "ipam.handle", "ipam_handle"} {
+			_, err := resources.IPToResourceNameWithPrefix(prefix, net.MustParseIP("11.223.3.41"))
+			Expect(err).To(HaveOccurred(), prefix)
+			_, err = resources.ResourceNameWithPrefixToIP(prefix, prefix+"-11-223-3-41")
+			Expect(err).To(HaveOccurred(), prefix)
+		}
+	})
+	It("should reject names that are too long", func() {
+		prefix := "a123456789012345678901234567890"
+		_, err := resources.IPToResourceNameWithPrefix(prefix, net.MustParseIP("11.223.3.41"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = resources.IPToResourceNameWithPrefix(prefix, net.MustParseIP("aaaa:1234:bbee:cccc:dddd:eeee:ffff:1"))
+		Expect(err).To(HaveOccurred())
+	})
+	It("should not convert a name without the prefix", func() {
+		for _, name := range []string{"11-223-3-41", "other-11-223-3-41", "p1", "p1-", "p111-223-3-41", "p1-11-223-3-4a"} {
+			_, err := resources.ResourceNameWithPrefixToIP("p1", name)
+			Expect(err).To(HaveOccurred(), name)
+		}
+	})
 })
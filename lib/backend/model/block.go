@@ -19,6 +19,7 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/projectcalico/libcalico-go/lib/errors"
@@ -61,12 +62,18 @@ func (key BlockKey) String() string {
 
 type BlockListOptions struct {
 	IPVersion int `json:"-"`
+
+	// Pool limits the list to the blocks lying entirely within the given
+	// CIDR.  If not set, blocks are listed regardless of where they lie.
+	Pool net.IPNet `json:"-"`
 }
 
 func (options BlockListOptions) defaultPathRoot() string {
 	k := "/calico/ipam/v2/assignment/"
 	if options.IPVersion != 0 {
 		k = k + fmt.Sprintf("ipv%d/", options.IPVersion)
+	} else if options.Pool.IP != nil {
+		k = k + fmt.Sprintf("ipv%d/", options.Pool.Version())
 	}
 	return k
 }
@@ -79,10 +86,28 @@ func (options BlockListOptions) KeyFromDefaultPath(path string) Key {
 		return nil
 	}
 	cidrStr := strings.Replace(r[0][1], "-", "/", 1)
-	_, cidr, _ := net.ParseCIDR(cidrStr)
+	_, cidr, err := net.ParseCIDR(cidrStr)
+	if err != nil {
+		log.Debugf("%s has an invalid CIDR: %v", path, err)
+		return nil
+	}
+	if options.Pool.IP != nil && !cidrWithin(*cidr, options.Pool) {
+		log.Debugf("Didn't match pool %s: %s", options.Pool.String(), cidr.String())
+		return nil
+	}
 	return BlockKey{CIDR: *cidr}
 }
 
+// cidrWithin returns whether the CIDR lies entirely within the outer CIDR.
+func cidrWithin(cidr, outer net.IPNet) bool {
+	if cidr.Version() != outer.Version() {
+		return false
+	}
+	ones, _ := cidr.Mask.Size()
+	outerOnes, _ := outer.Mask.Size()
+	return ones >= outerOnes && outer.Contains(cidr.IP)
+}
+
 type AllocationBlock struct {
 	CIDR           net.IPNet             `json:"cidr"`
 	Affinity       *string               `json:"affinity"`
@@ -91,13 +116,152 @@ type AllocationBlock struct {
 	Unallocated    []int                 `json:"unallocated"`
 	Attributes     []AllocationAttribute `json:"attributes"`
 
+	// CreationTime is the time at which the block was first claimed, and
+	// Annotations records details of the claim.  Blocks created before these
+	// fields were added read back with zero values.
+	CreationTime time.Time         `json:"creationTime"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+
 	// HostAffinity is deprecated in favor of Affinity.
 	// This is only to keep compatiblity with existing deployments.
 	// The data format should be `Affinity: host:hostname` (not `hostAffinity: hostname`).
 	HostAffinity *string `json:"hostAffinity,omitempty"`
+
+	// Reserved blocks are never chosen for automatic assignment, but
+	// addresses may still be assigned from them explicitly.
+	Reserved bool `json:"reserved,omitempty"`
+
+	// Shared blocks have no host affinity, but unlike a block whose
+	// affinity was released they are never claimed by a host or deleted
+	// when empty, so that every host may assign from them.
+	Shared bool `json:"shared,omitempty"`
+
+	// Pool is the CIDR of the IP pool the block was claimed from.  Blocks
+	// claimed before this field was added, or claimed when no pool
+	// contained them, have no pool.
+	Pool *net.IPNet `json:"pool,omitempty"`
+
+	// EmptySince is the time at which the block was last written empty
+	// after a release.  It is cleared when an address is assigned from the
+	// block.  Blocks emptied before this field was added have none.
+	EmptySince *time.Time `json:"emptySince,omitempty"`
 }
 
 type AllocationAttribute struct {
 	AttrPrimary   *string           `json:"handle_id"`
 	AttrSecondary map[string]string `json:"secondary"`
+
+	// Expiry is the time at which the lease of the addresses with this
+	// attribute expires, after which they may be freed.  Addresses
+	// assigned without a lease have no expiry.
+	Expiry *time.Time `json:"expiry,omitempty"`
+}
+
+// Clone returns a deep copy of the block, so that the copy may be modified
+// without affecting the original.
+func (b *AllocationBlock) Clone() *AllocationBlock {
+	c := *b
+	c.CIDR = cloneIPNet(b.CIDR)
+	c.Affinity = cloneString(b.Affinity)
+	c.HostAffinity = cloneString(b.HostAffinity)
+	if b.Allocations != nil {
+		c.Allocations = make([]*int, len(b.Allocations))
+		for i, a := range b.Allocations {
+			if a != nil {
+				v := *a
+				c.Allocations[i] = &v
+			}
+		}
+	}
+	if b.Unallocated != nil {
+		c.Unallocated = append([]int{}, b.Unallocated...)
+	}
+	if b.Attributes != nil {
+		c.Attributes = make([]AllocationAttribute, len(b.Attributes))
+		for i, a := range b.Attributes {
+			c.Attributes[i] = AllocationAttribute{
+				AttrPrimary:   cloneString(a.AttrPrimary),
+				AttrSecondary: cloneStringMap(a.AttrSecondary),
+			}
+			if a.Expiry != nil {
+				expiry := *a.Expiry
+				c.Attributes[i].Expiry = &expiry
+			}
+		}
+	}
+	c.Annotations = cloneStringMap(b.Annotations)
+	if b.Pool != nil {
+		p := cloneIPNet(*b.Pool)
+		c.Pool = &p
+	}
+	return &c
+}
+
+// AllocationBitmap returns whether each of the block's addresses is
+// allocated, indexed by ordinal, so that the length of the bitmap is the
+// number of addresses in the block.  DiffAllocationBitmaps compares the
+// bitmaps of two versions of a block, so that a watcher can find the
+// addresses which changed without expanding the block into addresses.
+func (b *AllocationBlock) AllocationBitmap() []bool {
+	bitmap := make([]bool, len(b.Allocations))
+	for o, a := range b.Allocations {
+		bitmap[o] = a != nil
+	}
+	return bitmap
+}
+
+// DiffAllocationBitmaps returns the ordinals, in ascending order, which are
+// allocated in after but not in before, and those which are allocated in
+// before but not in after.  If the bitmaps differ in length the missing
+// ordinals are treated as unallocated, so a nil before gives every allocated
+// ordinal of a new block.
+func DiffAllocationBitmaps(before, after []bool) (added, removed []int) {
+	added = []int{}
+	removed = []int{}
+	allocated := func(bitmap []bool, o int) bool {
+		return o < len(bitmap) && bitmap[o]
+	}
+	n := len(before)
+	if len(after) > n {
+		n = len(after)
+	}
+	for o := 0; o < n; o++ {
+		wasAllocated, isAllocated := allocated(before, o), allocated(after, o)
+		if isAllocated && !wasAllocated {
+			added = append(added, o)
+		} else if wasAllocated && !isAllocated {
+			removed = append(removed, o)
+		}
+	}
+	return added, removed
+}
+
+func cloneString(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	return &c
+}
+
+func cloneStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func cloneIPNet(n net.IPNet) net.IPNet {
+	c := n
+	if n.IP != nil {
+		c.IP = append(n.IP[:0:0], n.IP...)
+	}
+	if n.Mask != nil {
+		c.Mask = append(n.Mask[:0:0], n.Mask...)
+	}
+	return c
 }
@@ -102,7 +102,11 @@ func (options BlockAffinityListOptions) KeyFromDefaultPath(path string) Key {
 		return nil
 	}
 	cidrStr := strings.Replace(r[0][2], "-", "/", 1)
-	_, cidr, _ := net.ParseCIDR(cidrStr)
+	_, cidr, err := net.ParseCIDR(cidrStr)
+	if err != nil {
+		log.Debugf("%s has an invalid CIDR: %v", path, err)
+		return nil
+	}
 	host := r[0][1]
 
 	if options.Host != "" && options.Host != host {
@@ -0,0 +1,241 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model_test
+
+import (
+	"encoding/json"
+	"time"
+
+	. "github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AllocationBlock", func() {
+	It("should read a block without claim metadata with zero values", func() {
+		b := AllocationBlock{}
+		err := json.Unmarshal([]byte(`{"cidr":"10.0.0.0/26","affinity":"host:host-a","strictAffinity":false,"allocations":[null],"unallocated":[0],"attributes":[]}`), &b)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*b.Affinity).To(Equal("host:host-a"))
+		Expect(b.CreationTime.IsZero()).To(BeTrue())
+		Expect(b.Annotations).To(BeNil())
+	})
+
+	It("should round trip the claim metadata", func() {
+		created := time.Date(2017, 5, 1, 12, 0, 0, 0, time.UTC)
+		b := AllocationBlock{
+			CIDR:         net.MustParseNetwork("10.0.0.0/26"),
+			CreationTime: created,
+			Annotations:  map[string]string{"host": "host-a"},
+		}
+		bytes, err := json.Marshal(b)
+		Expect(err).NotTo(HaveOccurred())
+
+		out := AllocationBlock{}
+		Expect(json.Unmarshal(bytes, &out)).To(Succeed())
+		Expect(out.CreationTime.Equal(created)).To(BeTrue())
+		Expect(out.Annotations).To(Equal(map[string]string{"host": "host-a"}))
+	})
+
+	It("should read a block written before the newer fields were added", func() {
+		// A block as written by earlier releases, with one address assigned.
+		raw := `{"cidr":"192.168.0.0/30","affinity":"host:node-1","strictAffinity":false,` +
+			`"allocations":[0,null,null,null],"unallocated":[1,2,3],` +
+			`"attributes":[{"handle_id":"handle-a","secondary":{"pod":"pod-a"}}]}`
+		key := BlockKey{CIDR: net.MustParseNetwork("192.168.0.0/30")}
+		v, err := ParseValue(key, []byte(raw))
+		Expect(err).NotTo(HaveOccurred())
+
+		handle := "handle-a"
+		affinity := "host:node-1"
+		zero := 0
+		Expect(v).To(Equal(&AllocationBlock{
+			CIDR:        net.MustParseNetwork("192.168.0.0/30"),
+			Affinity:    &affinity,
+			Allocations: []*int{&zero, nil, nil, nil},
+			Unallocated: []int{1, 2, 3},
+			Attributes:  []AllocationAttribute{{AttrPrimary: &handle, AttrSecondary: map[string]string{"pod": "pod-a"}}},
+		}))
+		b := v.(*AllocationBlock)
+		Expect(b.CreationTime.IsZero()).To(BeTrue())
+		Expect(b.Annotations).To(BeNil())
+		Expect(b.HostAffinity).To(BeNil())
+		Expect(b.Reserved).To(BeFalse())
+		Expect(b.Pool).To(BeNil())
+	})
+
+	It("should round trip every field of a block", func() {
+		affinity := "host:host-a"
+		handle := "handle-a"
+		zero := 0
+		pool := net.MustParseNetwork("fd00::/120")
+		b := &AllocationBlock{
+			CIDR:           net.MustParseNetwork("fd00::/126"),
+			Affinity:       &affinity,
+			StrictAffinity: true,
+			Allocations:    []*int{&zero, nil, nil, nil},
+			Unallocated:    []int{3, 1, 2},
+			Attributes:     []AllocationAttribute{{AttrPrimary: &handle, AttrSecondary: map[string]string{"pod": "a"}}},
+			CreationTime:   time.Date(2017, 5, 1, 12, 0, 0, 123, time.UTC),
+			Annotations:    map[string]string{"host": "host-a"},
+			Reserved:       true,
+			Pool:           &pool,
+		}
+		key := BlockKey{CIDR: b.CIDR}
+		bytes, err := SerializeValue(&KVPair{Key: key, Value: b})
+		Expect(err).NotTo(HaveOccurred())
+		v, err := ParseValue(key, bytes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v).To(Equal(b))
+
+		// An unaffine block keeps its nil affinity.
+		b = &AllocationBlock{CIDR: net.MustParseNetwork("10.0.0.0/26")}
+		bytes, err = SerializeValue(&KVPair{Key: key, Value: b})
+		Expect(err).NotTo(HaveOccurred())
+		v, err = ParseValue(key, bytes)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v.(*AllocationBlock).Affinity).To(BeNil())
+		Expect(v.(*AllocationBlock).Pool).To(BeNil())
+	})
+
+	It("should clone a block without sharing any of its contents", func() {
+		affinity := "host:host-a"
+		handle := "handle-a"
+		zero := 0
+		pool := net.MustParseNetwork("10.0.0.0/24")
+		b := &AllocationBlock{
+			CIDR:        net.MustParseNetwork("10.0.0.0/30"),
+			Affinity:    &affinity,
+			Allocations: []*int{&zero, nil, nil, nil},
+			Unallocated: []int{1, 2, 3},
+			Attributes:  []AllocationAttribute{{AttrPrimary: &handle, AttrSecondary: map[string]string{"pod": "a"}}},
+			Annotations: map[string]string{"host": "host-a"},
+			Pool:        &pool,
+		}
+		c := b.Clone()
+		Expect(c).To(Equal(b))
+
+		*c.Affinity = "host:host-b"
+		*c.Allocations[0] = 1
+		c.Allocations[1] = &zero
+		c.Unallocated[0] = 3
+		*c.Attributes[0].AttrPrimary = "handle-b"
+		c.Attributes[0].AttrSecondary["pod"] = "b"
+		c.Annotations["host"] = "host-b"
+		c.CIDR.IP[0] = 11
+		c.Pool.IP[0] = 11
+
+		Expect(*b.Affinity).To(Equal("host:host-a"))
+		Expect(*b.Allocations[0]).To(Equal(0))
+		Expect(b.Allocations[1]).To(BeNil())
+		Expect(b.Unallocated).To(Equal([]int{1, 2, 3}))
+		Expect(*b.Attributes[0].AttrPrimary).To(Equal("handle-a"))
+		Expect(b.Attributes[0].AttrSecondary).To(Equal(map[string]string{"pod": "a"}))
+		Expect(b.Annotations).To(Equal(map[string]string{"host": "host-a"}))
+		Expect(b.CIDR.String()).To(Equal("10.0.0.0/30"))
+		Expect(b.Pool.String()).To(Equal("10.0.0.0/24"))
+	})
+
+	It("should clone the block in a KVPair", func() {
+		affinity := "host:host-a"
+		kvp := &KVPair{
+			Key:      BlockKey{CIDR: net.MustParseNetwork("10.0.0.0/30")},
+			Value:    &AllocationBlock{CIDR: net.MustParseNetwork("10.0.0.0/30"), Affinity: &affinity},
+			Revision: "5",
+		}
+		c := kvp.Clone()
+		Expect(c).To(Equal(kvp))
+		c.Value.(*AllocationBlock).Affinity = nil
+		c.Revision = "6"
+		Expect(kvp.Value.(*AllocationBlock).Affinity).To(Equal(&affinity))
+		Expect(kvp.Revision).To(Equal("5"))
+	})
+})
+
+var _ = Describe("BlockListOptions", func() {
+	pool := net.MustParseNetwork("10.0.1.0/24")
+
+	It("should only match blocks within the pool", func() {
+		opts := BlockListOptions{Pool: pool}
+		Expect(ListOptionsToDefaultPathRoot(opts)).To(Equal("/calico/ipam/v2/assignment/ipv4/"))
+		Expect(opts.KeyFromDefaultPath("/calico/ipam/v2/assignment/ipv4/block/10.0.1.64-26")).To(Equal(BlockKey{CIDR: net.MustParseNetwork("10.0.1.64/26")}))
+		Expect(opts.KeyFromDefaultPath("/calico/ipam/v2/assignment/ipv4/block/10.0.2.0-26")).To(BeNil())
+		Expect(opts.KeyFromDefaultPath("/calico/ipam/v2/assignment/ipv4/block/10.0.0.0-23")).To(BeNil())
+	})
+
+	It("should match every block when no pool is set", func() {
+		opts := BlockListOptions{}
+		Expect(ListOptionsToDefaultPathRoot(opts)).To(Equal("/calico/ipam/v2/assignment/"))
+		Expect(opts.KeyFromDefaultPath("/calico/ipam/v2/assignment/ipv4/block/10.0.2.0-26")).To(Equal(BlockKey{CIDR: net.MustParseNetwork("10.0.2.0/26")}))
+		Expect(opts.KeyFromDefaultPath("/calico/ipam/v2/assignment/ipv6/block/fd00::-122")).To(Equal(BlockKey{CIDR: net.MustParseNetwork("fd00::/122")}))
+	})
+
+	It("should not match a block with an invalid CIDR", func() {
+		Expect(BlockListOptions{}.KeyFromDefaultPath("/calico/ipam/v2/assignment/ipv4/block/10.0.0.bad-26")).To(BeNil())
+		Expect(BlockAffinityListOptions{}.KeyFromDefaultPath("/calico/ipam/v2/host/host-a/ipv4/block/10.0.0.bad-26")).To(BeNil())
+	})
+})
+
+var _ = Describe("AllocationBlock bitmap", func() {
+	// block returns a block of eight addresses with the given ordinals
+	// allocated.
+	block := func(ordinals ...int) *AllocationBlock {
+		b := &AllocationBlock{CIDR: net.MustParseNetwork("10.0.0.0/29"), Allocations: make([]*int, 8)}
+		for _, o := range ordinals {
+			attr := 0
+			b.Allocations[o] = &attr
+		}
+		return b
+	}
+
+	It("should have an entry for every address in the block", func() {
+		Expect(block(1, 2, 6).AllocationBitmap()).To(Equal([]bool{false, true, true, false, false, false, true, false}))
+		Expect(block().AllocationBitmap()).To(HaveLen(8))
+	})
+
+	It("should diff the ordinals allocated and released between versions", func() {
+		before := block(1, 2, 6).AllocationBitmap()
+		after := block(0, 1, 7).AllocationBitmap()
+
+		added, removed := DiffAllocationBitmaps(before, after)
+		Expect(added).To(Equal([]int{0, 7}))
+		Expect(removed).To(Equal([]int{2, 6}))
+
+		// Diffing the other way round swaps the sets.
+		added, removed = DiffAllocationBitmaps(after, before)
+		Expect(added).To(Equal([]int{2, 6}))
+		Expect(removed).To(Equal([]int{0, 7}))
+	})
+
+	It("should find no changes between identical bitmaps", func() {
+		b := block(1, 2, 6)
+		added, removed := DiffAllocationBitmaps(b.AllocationBitmap(), b.AllocationBitmap())
+		Expect(added).To(BeEmpty())
+		Expect(removed).To(BeEmpty())
+	})
+
+	It("should treat a missing bitmap as having nothing allocated", func() {
+		bitmap := block(1, 2, 6).AllocationBitmap()
+		added, removed := DiffAllocationBitmaps(nil, bitmap)
+		Expect(added).To(Equal([]int{1, 2, 6}))
+		Expect(removed).To(BeEmpty())
+
+		added, removed = DiffAllocationBitmaps(bitmap, nil)
+		Expect(added).To(BeEmpty())
+		Expect(removed).To(Equal([]int{1, 2, 6}))
+	})
+})
@@ -14,7 +14,12 @@
 
 package model
 
-import "reflect"
+import (
+	"reflect"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/net"
+)
 
 var (
 	typeIPAMConfig = reflect.TypeOf(IPAMConfig{})
@@ -44,6 +49,25 @@ func (key IPAMConfigKey) String() string {
 }
 
 type IPAMConfig struct {
-	StrictAffinity     bool `json:"strict_affinity,omitempty"`
-	AutoAllocateBlocks bool `json:"auto_allocate_blocks,omitempty"`
+	StrictAffinity        bool          `json:"strict_affinity,omitempty"`
+	AutoAllocateBlocks    bool          `json:"auto_allocate_blocks,omitempty"`
+	MaxBlocksPerHost      int           `json:"max_blocks_per_host,omitempty"`
+	AssignmentStrategy    string        `json:"assignment_strategy,omitempty"`
+	AssignOrder           string        `json:"assign_order,omitempty"`
+	PoolDistribution      string        `json:"pool_distribution,omitempty"`
+	RetryMaxAttempts      int           `json:"retry_max_attempts,omitempty"`
+	RetryBaseBackoff      time.Duration `json:"retry_base_backoff,omitempty"`
+	RetryMaxBackoff       time.Duration `json:"retry_max_backoff,omitempty"`
+	RetryJitter           float64       `json:"retry_jitter,omitempty"`
+	RetryTimeout          time.Duration `json:"retry_timeout,omitempty"`
+	RetainEmptyBlocks     bool          `json:"retain_empty_blocks,omitempty"`
+	UniqueHandles         bool          `json:"unique_handles,omitempty"`
+	RequiredAttributes    []string      `json:"required_attributes,omitempty"`
+	IPv4BlockSize         int           `json:"ipv4_block_size,omitempty"`
+	IPv6BlockSize         int           `json:"ipv6_block_size,omitempty"`
+	AutoCreateDefaultPool bool          `json:"auto_create_default_pool,omitempty"`
+	DefaultPoolCIDR       *net.IPNet    `json:"default_pool_cidr,omitempty"`
+	DestructiveOpsAllowed bool          `json:"destructive_ops_allowed,omitempty"`
+	BulkConcurrency       int           `json:"bulk_concurrency,omitempty"`
+	EmptyBlockLinger      time.Duration `json:"empty_block_linger,omitempty"`
 }
@@ -68,7 +68,7 @@ func (options IPAMHandleListOptions) defaultPathRoot() string {
 
 func (options IPAMHandleListOptions) KeyFromDefaultPath(path string) Key {
 	log.Debugf("Get IPAM handle key from %s", path)
-	r := matchBlock.FindAllStringSubmatch(path, -1)
+	r := matchHandle.FindAllStringSubmatch(path, -1)
 	if len(r) != 1 {
 		log.Debugf("%s didn't match regex", path)
 		return nil
@@ -78,5 +78,6 @@ func (options IPAMHandleListOptions) KeyFromDefaultPath(path string) Key {
 
 type IPAMHandle struct {
 	HandleID string         `json:"-"`
+	Owner    string         `json:"owner,omitempty"`
 	Block    map[string]int `json:"block"`
 }
@@ -92,10 +92,17 @@ func (options IPPoolListOptions) KeyFromDefaultPath(path string) Key {
 }
 
 type IPPool struct {
-	CIDR          net.IPNet `json:"cidr"`
-	IPIPInterface string    `json:"ipip"`
-	IPIPMode      ipip.Mode `json:"ipip_mode"`
-	Masquerade    bool      `json:"masquerade"`
-	IPAM          bool      `json:"ipam"`
-	Disabled      bool      `json:"disabled"`
+	CIDR              net.IPNet   `json:"cidr"`
+	IPIPInterface     string      `json:"ipip"`
+	IPIPMode          ipip.Mode   `json:"ipip_mode"`
+	Masquerade        bool        `json:"masquerade"`
+	IPAM              bool        `json:"ipam"`
+	Disabled          bool        `json:"disabled"`
+	PreferredHosts    []string    `json:"preferred_hosts,omitempty"`
+	BlockSize         *int        `json:"block_size,omitempty"`
+	ExcludedCIDRs     []net.IPNet `json:"excluded_cidrs,omitempty"`
+	ReservedAddresses []net.IP    `json:"reserved_addresses,omitempty"`
+	NodeSelector      string      `json:"node_selector,omitempty"`
+	Zone              string      `json:"zone,omitempty"`
+	Priority          int         `json:"priority,omitempty"`
 }
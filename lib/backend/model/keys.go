@@ -87,6 +87,15 @@ type ListInterface interface {
 // -  A slice or map
 // -  A bare string, boolean value or IP address (i.e. without quotes, so not
 //    JSON format).
+//
+// The Revision is populated by the backend when an entry is read or written.
+// Its value is opaque and backend-specific (the etcd modified index, or the
+// Kubernetes resourceVersion), so it should only be copied from one KVPair to
+// another, never constructed or compared for order.  When a KVPair with a
+// Revision is passed to Update, Apply or Delete, the write is conditional:
+// if the entry has changed since that revision was read, the backend returns
+// an ErrorResourceUpdateConflict.  A nil Revision makes the write
+// unconditional.
 type KVPair struct {
 	Key      Key
 	Value    interface{}
@@ -94,6 +103,18 @@ type KVPair struct {
 	TTL      time.Duration // For writes, if non-zero, key has a TTL.
 }
 
+// Clone returns a copy of the KVPair which may be modified and written back
+// without affecting the original.  An *AllocationBlock value is deep copied.
+// Other values are shared with the original, so they should be replaced
+// rather than modified.
+func (kvp *KVPair) Clone() *KVPair {
+	c := *kvp
+	if b, ok := kvp.Value.(*AllocationBlock); ok {
+		c.Value = b.Clone()
+	}
+	return &c
+}
+
 // KeyToDefaultPath converts one of the Keys from this package into a unique
 // '/'-delimited path, which is suitable for use as the key when storing the
 // value in a hierarchical (i.e. one with directories and leaves) key/value
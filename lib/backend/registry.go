@@ -0,0 +1,87 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/libcalico-go/lib/api"
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+)
+
+// ClientFactory creates a backend datastore client from the API config.
+type ClientFactory func(config api.CalicoAPIConfig) (bapi.Client, error)
+
+var (
+	factoriesLock sync.Mutex
+	factories     = map[api.DatastoreType]ClientFactory{}
+)
+
+// Register makes a backend datastore available by name, so that NewClient
+// creates a client for it when the config's datastore type is the given
+// name.  A third party datastore registers itself from the init function of
+// its package, which the program then imports for its side effects; the
+// factory is passed the whole API config, and reads any further connection
+// information it needs itself.  The client must implement the error and
+// revision semantics of the bapi.Client interface, which can be verified
+// with the conformance package.
+//
+// Register panics if the name is already registered or the factory is nil.
+func Register(datastoreType api.DatastoreType, factory ClientFactory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	if factory == nil {
+		panic(fmt.Sprintf("backend: nil factory registered for datastore type %v", datastoreType))
+	}
+	if _, ok := factories[datastoreType]; ok {
+		panic(fmt.Sprintf("backend: datastore type %v registered twice", datastoreType))
+	}
+	factories[datastoreType] = factory
+}
+
+// DatastoreTypes returns the names of the registered backend datastores,
+// sorted.
+func DatastoreTypes() []api.DatastoreType {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	names := []string{}
+	for t := range factories {
+		names = append(names, string(t))
+	}
+	sort.Strings(names)
+	types := make([]api.DatastoreType, len(names))
+	for i, name := range names {
+		types[i] = api.DatastoreType(name)
+	}
+	return types
+}
+
+// NewClient creates a new backend datastore client, using the factory
+// registered for the config's datastore type.
+func NewClient(config api.CalicoAPIConfig) (bapi.Client, error) {
+	log.Debugf("Using datastore type '%s'", config.Spec.DatastoreType)
+	factoriesLock.Lock()
+	factory, ok := factories[config.Spec.DatastoreType]
+	factoriesLock.Unlock()
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unknown datastore type: %v",
+			config.Spec.DatastoreType))
+	}
+	return factory(config)
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/api"
+	"github.com/projectcalico/libcalico-go/lib/backend"
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/fake"
+)
+
+var _ = Describe("Backend registration", func() {
+	fakeType := api.DatastoreType("fake")
+	fakeClient := fake.NewClient()
+	var configs []api.CalicoAPIConfig
+
+	backend.Register(fakeType, func(config api.CalicoAPIConfig) (bapi.Client, error) {
+		configs = append(configs, config)
+		return fakeClient, nil
+	})
+
+	BeforeEach(func() {
+		configs = nil
+	})
+
+	It("should create a client for a registered datastore type", func() {
+		config := api.CalicoAPIConfig{Spec: api.CalicoAPIConfigSpec{DatastoreType: fakeType}}
+		c, err := backend.NewClient(config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c).To(BeIdenticalTo(fakeClient))
+		Expect(configs).To(Equal([]api.CalicoAPIConfig{config}))
+	})
+
+	It("should list the registered datastore types", func() {
+		Expect(backend.DatastoreTypes()).To(ContainElement(fakeType))
+	})
+
+	It("should fail for an unknown datastore type", func() {
+		_, err := backend.NewClient(api.CalicoAPIConfig{Spec: api.CalicoAPIConfigSpec{DatastoreType: "unknown"}})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should not register a datastore type twice", func() {
+		Expect(func() {
+			backend.Register(fakeType, func(api.CalicoAPIConfig) (bapi.Client, error) { return nil, nil })
+		}).To(Panic())
+		Expect(func() { backend.Register("other", nil) }).To(Panic())
+	})
+})
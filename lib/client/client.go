@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"reflect"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/kelseyhightower/envconfig"
@@ -32,6 +33,7 @@ import (
 	"github.com/projectcalico/libcalico-go/lib/errors"
 	"github.com/projectcalico/libcalico-go/lib/validator"
 	"github.com/satori/go.uuid"
+	"golang.org/x/net/context"
 )
 
 // Client contains
@@ -41,19 +43,82 @@ type Client struct {
 	// measure and users of the client API should not assume that the backend
 	// will be available in the future.
 	Backend bapi.Client
+
+	// If specified, IPAMObserver is notified of IPAM events such as
+	// block claims and assignment failures.
+	IPAMObserver IPAMObserver
+
+	// If specified, NodeLabels returns the labels of a host, which are
+	// matched against the node selectors of IP pools to decide whether the
+	// host may claim blocks from them.  If not specified, every host has
+	// no labels.
+	NodeLabels NodeLabelsFunc
+
+	// If specified, BlockClaimResolver decides whether a host claiming a
+	// block which is affine to another host may steal its affinity.  If
+	// not specified, the claim fails.
+	BlockClaimResolver BlockClaimResolverFunc
+
+	// ipPoolCache caches the IP pools read by IPAM.  It is nil, and so
+	// caches nothing, unless the client was created by New.
+	ipPoolCache *ipPoolCache
+
+	// blockLocks serializes the IPAM updates made to each block through
+	// this client.  It is nil, and so locks nothing, unless the client was
+	// created by New.
+	blockLocks *blockLocks
 }
 
 // New returns a connected Client. The ClientConfig can either be created explicitly,
 // or can be loaded from a config file or environment variables using the LoadClientConfig() function.
 func New(config api.CalicoAPIConfig) (*Client, error) {
 	var err error
-	cc := Client{}
+	cc := Client{ipPoolCache: newIPPoolCache(defaultIPPoolCacheTTL), blockLocks: newBlockLocks()}
 	if cc.Backend, err = backend.NewClient(config); err != nil {
 		return nil, err
 	}
 	return &cc, err
 }
 
+// SetIPPoolCacheTTL sets how long IPAM caches the list of IP pools for.  The
+// cache is invalidated whenever a pool is written through this client, so the
+// TTL limits how long changes made by other clients may go unseen.  A TTL of 0
+// disables caching, which may be useful in tests.  This should be called
+// before the client is used.
+func (c *Client) SetIPPoolCacheTTL(ttl time.Duration) {
+	if c.ipPoolCache == nil {
+		c.ipPoolCache = newIPPoolCache(ttl)
+		return
+	}
+	c.ipPoolCache.setTTL(ttl)
+}
+
+// PrewarmIPPoolCache reads the list of IP pools into the IPAM cache in the
+// background, so that the first IPAM operation does not have to wait for it.
+// If the pools cannot be read, a warning is logged and the cache is left
+// empty.  This should be called once the client has been created, after any
+// call to SetIPPoolCacheTTL.
+func (c *Client) PrewarmIPPoolCache() {
+	go func() {
+		if err := c.RefreshIPPoolCache(); err != nil {
+			log.WithError(err).Warning("Failed to pre-warm the IP pool cache")
+		}
+	}()
+}
+
+// RefreshIPPoolCache reads the list of IP pools into the IPAM cache, replacing
+// any list already cached.  If the pools cannot be read, the error is returned
+// and the cache is left empty.  It does nothing if caching is not enabled.
+func (c *Client) RefreshIPPoolCache() error {
+	return c.ipPoolCache.refresh(c.readIPPools)
+}
+
+// readIPPools lists all of the IP pools from the datastore, bypassing the
+// cache.
+func (c *Client) readIPPools() (*api.IPPoolList, error) {
+	return c.IPPools().List(api.IPPoolMetadata{})
+}
+
 // NewFromEnv loads the config from ENV variables and returns a connected Client.
 func NewFromEnv() (*Client, error) {
 
@@ -110,6 +175,13 @@ func (c *Client) Config() ConfigInterface {
 	return newConfigs(c)
 }
 
+// Ping checks that the backend datastore is reachable.  This may be used
+// before performing other operations to fail fast, or as a readiness check.
+// Returns an ErrorDatastoreUnavailable if the datastore cannot be reached.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.Backend.Ping(ctx)
+}
+
 // EnsureInitialized is used to ensure the backend datastore is correctly
 // initialized for use by Calico.  This method may be called multiple times, and
 // will have no effect if the datastore is already correctly initialized.
@@ -17,10 +17,16 @@ package client
 import (
 	goerrors "errors"
 	"fmt"
+	"math/big"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/projectcalico/libcalico-go/lib/api"
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
 	"github.com/projectcalico/libcalico-go/lib/errors"
 	"github.com/projectcalico/libcalico-go/lib/net"
@@ -28,12 +34,37 @@ import (
 
 const (
 	// Number of retries when we have an error writing data
-	// to etcd.
+	// to etcd, unless configured otherwise in the RetryConfig.
 	ipamEtcdRetries   = 100
 	ipamKeyErrRetries = 3
+
+	// Maximum delay between retries when a retry backoff is configured
+	// without a maximum.
+	ipamRetryMaxBackoff = 5 * time.Second
+
+	// Number of blocks read and written at once by bulk operations, unless
+	// configured otherwise, and the most that may be configured.
+	defaultBulkConcurrency = 4
+	maxBulkConcurrency     = 64
+
+	// Number of entries to request per page when listing
+	// IPAM data from the datastore.
+	ipamListPageSize = 500
 )
 
-// IPAMInterface has methods to perform IP address management.
+// defaultPoolCIDR is the CIDR of the pool created when AutoCreateDefaultPool
+// is set and the IPAM configuration has no DefaultPoolCIDR.
+var defaultPoolCIDR = net.MustParseNetwork("192.168.0.0/16")
+
+// IPAMInterface has methods to perform IP address management.  Callers should
+// depend on this interface, returned by Client.IPAM, rather than on the
+// implementation, so that it can be replaced in tests.
+//
+// All of the methods are safe for concurrent use, both by goroutines sharing
+// a client and by clients on different hosts: every update is made with a
+// compare-and-swap against the datastore and retried if it conflicts.  The
+// exception is SetIPAMConfig, whose check that no blocks exist is not atomic
+// with the update, so it must not be called while addresses may be assigned.
 type IPAMInterface interface {
 	// AssignIP assigns the provided IP address to the provided host.  The IP address
 	// must fall within a configured pool.  AssignIP will claim block affinity as needed
@@ -42,33 +73,126 @@ type IPAMInterface interface {
 	// a block that does not have affinity for the given host.
 	AssignIP(args AssignIPArgs) error
 
+	// AssignIPWithResult is AssignIP, returning the pool and block the address
+	// was assigned from, whether the block was claimed to assign it, and the
+	// encapsulation used to route to it.
+	AssignIPWithResult(args AssignIPArgs) (*AssignmentResult, error)
+
 	// AutoAssign automatically assigns one or more IP addresses as specified by the
 	// provided AutoAssignArgs.  AutoAssign returns the list of the assigned IPv4 addresses,
 	// and the list of the assigned IPv6 addresses.
 	AutoAssign(args AutoAssignArgs) ([]net.IP, []net.IP, error)
 
+	// AutoAssignWithResult is AutoAssign, returning the pool and block each
+	// address was assigned from, whether the block was claimed to assign it,
+	// and the encapsulation used to route to it.  If addresses were assigned
+	// before an error, the result holds them.
+	AutoAssignWithResult(args AutoAssignArgs) (*AssignmentResult, error)
+
+	// AutoAssignDualStack assigns IPv4 and IPv6 addresses as specified by the
+	// provided AutoAssignArgs, choosing the pools for both IP versions from one
+	// listing of the configured IP pools.  Claiming a new block lists the pools
+	// again, to check the claim against their current configuration.  The
+	// result holds the assigned addresses and any error for each IP version, so
+	// a failure for one version does not discard the addresses assigned for the
+	// other.  An error is returned only if the IP pools could not be listed, or
+	// the default pool could not be created.
+	AutoAssignDualStack(args AutoAssignArgs) (*DualStackAssignResult, error)
+
+	// AssignPreferred assigns the IPv4 and IPv6 addresses specified by the
+	// provided AutoAssignArgs, trying each of the preferred addresses in order
+	// before automatically assigning any that remain.  Preferred addresses
+	// that are not within a configured pool are skipped.
+	AssignPreferred(preferred []net.IP, args AutoAssignArgs) (*PreferredAssignResult, error)
+
+	// AssignFromBlock assigns up to num addresses to the given host from the
+	// given block, rather than letting the pools decide where to assign from.
+	// The block must be affine to the host if it has StrictAffinity set,
+	// and it may be reserved.  If the block does not exist, the
+	// ErrorResourceDoesNotExist from the datastore is returned.
+	AssignFromBlock(blockCIDR net.IPNet, num int, host string, handleID *string) ([]net.IP, error)
+
 	// ReleaseIPs releases any of the given IP addresses that are currently assigned,
-	// so that they are available to be used in another assignment.
+	// so that they are available to be used in another assignment.  An address
+	// outside every configured pool is still released from its block, since its
+	// pool may have been deleted after it was assigned, and is returned as
+	// unallocated if it has no block.
 	ReleaseIPs(ips []net.IP) ([]net.IP, error)
 
 	// GetAssignmentAttributes returns the attributes stored with the given IP address
 	// upon assignment.
 	GetAssignmentAttributes(addr net.IP) (map[string]string, error)
 
+	// IsAssigned returns whether the given IP address is currently assigned,
+	// along with the handle it was assigned with, which is nil if it was
+	// assigned without one.  The block containing the address is only read,
+	// never created, so an address whose block does not exist is not
+	// assigned.  An error is returned if no configured pool contains the
+	// address.
+	IsAssigned(addr net.IP) (bool, *string, error)
+
+	// HostForIP returns the host whose affine block contains the given IP
+	// address, which is the host that routes to the address.  Returns an
+	// empty host if the block has no host affinity, for example because it
+	// is shared or its affinity was released.  The block is only read, never
+	// created.  An error is returned if the block does not exist, or if no
+	// configured pool contains the address.
+	HostForIP(addr net.IP) (string, error)
+
 	// IpsByHandle returns a list of all IP addresses that have been
-	// assigned using the provided handle.
+	// assigned using the provided handle, such as the handle of a workload
+	// endpoint.  If the handle index's entry for the handle is missing or
+	// does not match the blocks, every block is scanned for its addresses
+	// and the entry is rebuilt.
 	IPsByHandle(handleID string) ([]net.IP, error)
 
 	// ReleaseByHandle releases all IP addresses that have been assigned
-	// using the provided handle.  Returns an error if no addresses
-	// are assigned with the given handle.
+	// using the provided handle.  Like IPsByHandle, it falls back to
+	// scanning every block if the handle index is stale.  Returns an error
+	// if no addresses are assigned with the given handle.
 	ReleaseByHandle(handleID string) error
 
+	// UpdateHandle moves all of the addresses assigned with oldHandleID to
+	// newHandleID without releasing them, such as when a workload is renamed,
+	// and returns the number of addresses moved.  If newHandleID already has
+	// addresses assigned, the moved addresses are added to them.  If the move
+	// fails part way through, running UpdateHandle again completes it.
+	UpdateHandle(oldHandleID, newHandleID string) (int, error)
+
+	// ReassignHandle moves a single assigned address to newHandleID without
+	// releasing it, so that no other assignment can take the address in
+	// between.  The address keeps its secondary attributes.  An error is
+	// returned if the address is not assigned.
+	ReassignHandle(ip net.IP, newHandleID string) error
+
+	// ListHandles returns a summary of the addresses assigned with every
+	// handle, sorted by handle ID.  The summaries are read from the handle
+	// index, or from every block if the datastore cannot list handles.
+	ListHandles() ([]HandleInfo, error)
+
+	// CountByHandlePrefix returns the number of addresses assigned with the
+	// handles whose IDs start with the given prefix, such as the handles of
+	// every workload in a namespace when handle IDs start with the namespace.
+	// Returns 0 if no handle matches.
+	CountByHandlePrefix(prefix string) (int, error)
+
+	// RebuildHandleIndex rewrites every handle in the handle index from the
+	// addresses assigned in the blocks, and returns the number of handles
+	// changed.  It may delete the handle of an assignment in progress, so
+	// should only be run while nothing is being assigned.
+	RebuildHandleIndex() (int, error)
+
 	// ClaimAffinity claims affinity to the given host for all blocks
 	// within the given CIDR.  The given CIDR must fall within a configured
 	// pool. If an empty string is passed as the host, then the value returned by os.Hostname is used.
 	ClaimAffinity(cidr net.IPNet, host string) ([]net.IPNet, []net.IPNet, error)
 
+	// PartitionPool divides the blocks of the given pool evenly between the
+	// given hosts and claims affinity for each block to its host.  Blocks
+	// already affine to the correct host are left as they are.  Returns the
+	// number of blocks in each host's share that are affine to it.
+	PartitionPool(pool net.IPNet, hosts []string) (map[string]int, error)
+
 	// ReleaseAffinity releases affinity for all blocks within the given CIDR
 	// on the given host.  If an empty string is passed as the host, then the
 	// value returned by os.Hostname will be used.
@@ -83,6 +207,143 @@ type IPAMInterface interface {
 	// the specified pool across all hosts.
 	ReleasePoolAffinities(pool net.IPNet) error
 
+	// ForceReleaseBlockAffinity releases the affinity of the given block,
+	// whichever host it is affine to, to recover the blocks of hosts that no
+	// longer exist.  The block is deleted if it is empty; otherwise only its
+	// affinity is removed, so that its allocations are preserved.  This is a
+	// destructive operation, so it fails unless the IPAM configuration
+	// allows destructive operations.
+	ForceReleaseBlockAffinity(blockCIDR net.IPNet) error
+
+	// DeletePoolBlocks deletes all blocks within the specified pool, along
+	// with their affinities.  Unless force is set, no blocks are deleted if
+	// any block still has addresses assigned.
+	DeletePoolBlocks(pool net.IPNet, force bool) error
+
+	// Compact moves the addresses assigned from the host's sparsely used
+	// affine blocks in the pool into its fuller affine blocks, and releases
+	// the blocks that are emptied, so that the host holds fewer blocks.
+	// Each address is moved by assigning a new address with the same handle
+	// and attributes before releasing the old one, so workloads must be
+	// told of their new addresses from the report.  Reserved blocks, and
+	// blocks with addresses assigned without a handle, are never emptied.
+	// The move must be confirmed in the options unless it is a dry run, and
+	// it fails unless the IPAM configuration allows destructive operations.
+	Compact(host string, pool net.IPNet, opts CompactOptions) (*CompactReport, error)
+
+	// DrainPool frees every address allocated from the pool, releases the
+	// affinities of the pool's blocks and deletes them, so that the pool can
+	// be deleted.  The addresses are freed whether or not they are still in
+	// use, so the workloads using them must be gone first.  Unless confirm
+	// is set, nothing is changed and the result reports what would be freed.
+	// If it fails part way through, calling it again completes the drain.  A
+	// confirmed drain fails unless the IPAM configuration allows destructive
+	// operations.
+	DrainPool(pool net.IPNet, confirm bool) (PoolDrainResult, error)
+
+	// ExportPoolState reads the complete IPAM state of the pool: its blocks,
+	// their affinities and the handles of their addresses, in a form that
+	// can be serialized to back up the pool or migrate it to another
+	// datastore.  Nothing is locked while the state is read, so export from
+	// a datastore that is not in use.
+	ExportPoolState(pool net.IPNet) (PoolState, error)
+
+	// ImportPoolState writes the state exported by ExportPoolState.  State
+	// which already exists and is identical is left as it is, so if the
+	// import fails part way through, importing again completes it.  Existing
+	// state which differs is only overwritten if force is set, and a forced
+	// import fails unless the IPAM configuration allows destructive
+	// operations.
+	ImportPoolState(state PoolState, force bool) error
+
+	// GetUtilization returns the utilization of each block within the given
+	// pool, ordered from the least utilized to the most utilized.
+	GetUtilization(pool net.IPNet) ([]BlockUtil, error)
+
+	// BlockOwnershipByHost returns the number of blocks of the given IP
+	// version that are affine to each host, to find hosts holding more than
+	// their share of a pool.  If pool is not nil, only the blocks within it
+	// are counted.  Blocks without a host affinity are counted under the
+	// empty host name.
+	BlockOwnershipByHost(pool *net.IPNet, version ipVersion) (map[string]int, error)
+
+	// FullPoolsForHost returns the enabled pools of the given IP version
+	// from which the host cannot claim a new block, so that a scheduler can
+	// avoid hosts which can't get more addresses.  A pool is full for the
+	// host if every block in it exists, if its node selector does not select
+	// the host, or if the host has reached the configured maximum number of
+	// blocks.  Returns an empty slice if the host can claim a block from
+	// every pool.
+	FullPoolsForHost(host string, version ipVersion) ([]net.IPNet, error)
+
+	// TotalFreeAddresses returns the number of free addresses and the total
+	// number of addresses in all pools of the given IP version, such as for a
+	// cluster-wide utilization summary.  Addresses within a pool's excluded
+	// CIDRs or reserved addresses are not free.  The pools and blocks are
+	// each read with a single list, rather than reading every block.
+	TotalFreeAddresses(version ipVersion) (*big.Int, *big.Int, error)
+
+	// PoolsOverlapping returns the enabled pools which overlap the given
+	// CIDR, whether they contain it, are contained by it or only partly
+	// overlap it, sorted by CIDR.  This finds the pools a proposed pool
+	// would conflict with, or the pools a block spans.
+	PoolsOverlapping(cidr net.IPNet) ([]api.IPPool, error)
+
+	// PoolExhausted returns whether no address is free in the pool: every
+	// block the pool holds exists, and none of them has a free address.
+	// Addresses count as free whether or not automatic assignment may use
+	// them, for example those in reserved blocks.
+	PoolExhausted(pool net.IPNet) (bool, error)
+
+	// UnclaimedBlocks returns the blocks within the pool that have not yet
+	// been claimed, in ascending order, to show how fragmented the pool is.
+	// Blocks overlapping the pool's excluded CIDRs are never claimed, so
+	// they are not returned.  If limit is greater than 0, at most limit
+	// blocks are returned.
+	UnclaimedBlocks(pool net.IPNet, limit int) ([]net.IPNet, error)
+
+	// FreeIPsInPool returns up to limit of the addresses in the given pool
+	// which are free to be assigned, in ascending order.  Only as many of
+	// the pool's blocks are read as are needed to reach the limit.
+	FreeIPsInPool(pool net.IPNet, limit int) ([]net.IP, error)
+
+	// AssignedIPsForHost returns the addresses of the given IP version which
+	// are assigned from the blocks affine to the given host, in ascending
+	// order.  Addresses assigned to the host from other hosts' blocks are not
+	// recorded against the host, so if handleID is not nil every other block
+	// is also scanned for the addresses assigned with that handle.
+	AssignedIPsForHost(host string, version ipVersion, handleID *string) ([]net.IP, error)
+
+	// ListAssignedIPs describes the addresses of the given IP version, across
+	// all blocks, which are assigned with attributes containing every
+	// key/value pair in the filter, such as the addresses of the workloads in
+	// one namespace.  An empty filter returns every assigned address.
+	ListAssignedIPs(version ipVersion, filter map[string]string) ([]AssignedIP, error)
+
+	// ReserveBlock reserves an existing block so that it is never chosen
+	// for automatic assignment.  Addresses may still be assigned from the
+	// block explicitly, and the block is kept when it is empty.
+	ReserveBlock(blockCIDR net.IPNet) error
+
+	// UnreserveBlock clears the reservation of an existing block, so that
+	// it may be chosen for automatic assignment again.
+	UnreserveBlock(blockCIDR net.IPNet) error
+
+	// SetBlockStrictAffinity sets or clears the StrictAffinity of an
+	// existing block, which is otherwise fixed from the IPAM configuration
+	// when the block is claimed.  Only the block's own flag decides whether
+	// other hosts may assign from it, so this lets a change to the IPAM
+	// configuration be applied to existing blocks one at a time.  Strict
+	// affinity may only be set on a block that is affine to a host.
+	SetBlockStrictAffinity(blockCIDR net.IPNet, strict bool) error
+
+	// ClaimSharedBlock claims the given block as a shared block, for
+	// addresses such as anycast service IPs that belong to no single host.
+	// A shared block has no host affinity, so any host may assign from it,
+	// and it is never claimed by a host or deleted when empty.  The block
+	// must fall within a configured pool and must not be affine to a host.
+	ClaimSharedBlock(blockCIDR net.IPNet) error
+
 	// GetIPAMConfig returns the global IPAM configuration.  If no IPAM configuration
 	// has been set, returns a default configuration with StrictAffinity disabled
 	// and AutoAllocateBlocks enabled.
@@ -97,11 +358,50 @@ type IPAMInterface interface {
 	// RemoveIPAMHost does not release any IP addresses claimed on the given host.
 	// If an empty string is passed as the host then the value returned by os.Hostname is used.
 	RemoveIPAMHost(host string) error
+
+	// ReclaimOrphanedBlocks releases the affinity of every block that is
+	// affine to a host which is not in the given list of valid hosts, such
+	// as the hosts that have a Node resource.  Empty blocks are freed for
+	// any host to claim.  Returns the blocks that were reclaimed, and the
+	// blocks whose affinity was released but which still have addresses
+	// assigned, so could not be freed.
+	ReclaimOrphanedBlocks(hosts []string) ([]net.IPNet, []net.IPNet, error)
+
+	// ReleaseLingeringBlocks releases the affinity of every empty block that
+	// was emptied more than the EmptyBlockLinger ago, deleting the block
+	// unless empty blocks are retained.  Releasing addresses keeps the empty
+	// block for its host, so this should be run periodically, such as by the
+	// controller that runs ReclaimOrphanedBlocks.  Returns the blocks that
+	// were released.
+	ReleaseLingeringBlocks() ([]net.IPNet, error)
+
+	// ReleaseExpiredAllocations releases every address assigned with a TTL
+	// whose lease expired more than grace ago, so that the addresses of
+	// workloads which died without releasing them can be reused.  Addresses
+	// assigned without a TTL are never released.  This should be run
+	// periodically when addresses are assigned with a TTL.  Returns the
+	// addresses that were released.
+	ReleaseExpiredAllocations(grace time.Duration) ([]net.IP, error)
+
+	// CheckBlockConsistency cross-references all block affinity keys against
+	// all allocation blocks and returns a report of any inconsistencies.  If
+	// repair is true, the blocks are treated as the source of truth: orphaned
+	// and mismatched affinity keys are deleted, and missing affinity keys are
+	// created for blocks with a host affinity.  A repair releases reservations
+	// whose block has not been created yet, so it should not be run while
+	// hosts are claiming blocks.
+	CheckBlockConsistency(repair bool) (*BlockConsistencyReport, error)
+
+	// FindDoubleAllocations returns every address which is allocated in more
+	// than one block, in ascending order.  This should never happen, but may
+	// if blocks overlap because of overlapping pools or corrupted blocks.
+	// Only the blocks which overlap another are read in full.
+	FindDoubleAllocations() ([]DoubleAllocation, error)
 }
 
 // newIPAM returns a new ipamClient, which implements the IPAMInterface
 func newIPAM(c *Client) *ipams {
-	return &ipams{c, blockReaderWriter{c}}
+	return &ipams{client: c, blockReaderWriter: blockReaderWriter{client: c}}
 }
 
 // ipamClient implements the IPAMInterface
@@ -112,42 +412,116 @@ type ipams struct {
 
 // AutoAssign automatically assigns one or more IP addresses as specified by the
 // provided AutoAssignArgs.  AutoAssign returns the list of the assigned IPv4 addresses,
-// and the list of the assigned IPv6 addresses.
+// and the list of the assigned IPv6 addresses.  If StrictAffinity is enabled and the
+// host's affine blocks run out without a new block being claimed, the addresses
+// assigned so far are returned along with a strictAffinityExhaustedError.
 func (c ipams) AutoAssign(args AutoAssignArgs) ([]net.IP, []net.IP, error) {
+	v4, v6, err := c.autoAssignIPs(args)
+	return assignedIPs(v4), assignedIPs(v6), err
+}
+
+// AutoAssignWithResult is AutoAssign, returning the pool and block each
+// address was assigned from, and whether the block was claimed to assign it.
+// If StrictAffinity is enabled and the host's affine blocks run out, the
+// result holds the addresses assigned so far, along with a
+// strictAffinityExhaustedError.
+func (c ipams) AutoAssignWithResult(args AutoAssignArgs) (*AssignmentResult, error) {
+	v4, v6, err := c.autoAssignIPs(args)
+	if err != nil && v4 == nil && v6 == nil {
+		return nil, err
+	}
+	c.describeEncap(v4)
+	c.describeEncap(v6)
+	return &AssignmentResult{IPv4: v4, IPv6: v6}, err
+}
+
+// describeEncap sets the encapsulation of each of the assigned addresses from
+// its pool, finding the encapsulation once for each block.  An address whose
+// encapsulation can't be found is left without one, since it is assigned
+// regardless.
+func (c ipams) describeEncap(assigned []AssignedIP) {
+	byBlock := map[string]EncapMode{}
+	for i := range assigned {
+		block := assigned[i].Block.String()
+		encap, ok := byBlock[block]
+		if !ok {
+			var err error
+			encap, err = c.blockReaderWriter.encapForIP(assigned[i].IP)
+			if err != nil {
+				c.requestLog().WithError(err).WithField("ip", assigned[i].IP).Warning("Unable to find the encapsulation for the address")
+			}
+			byBlock[block] = encap
+		}
+		assigned[i].Encap = encap
+	}
+}
+
+// autoAssignIPs implements AutoAssign, describing each assigned address as it
+// was assigned.
+func (c ipams) autoAssignIPs(args AutoAssignArgs) ([]AssignedIP, []AssignedIP, error) {
+	c = c.withRequestID(args.RequestID).withLease(args.TTL)
+	c, err := c.withIPAMConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Determine the hostname to use - prefer the provided hostname if
 	// non-nil, otherwise use the hostname reported by os.
 	hostname := decideHostname(args.Hostname)
-	log.Infof("Auto-assign %d ipv4, %d ipv6 addrs for host '%s'", args.Num4, args.Num6, hostname)
+	c.requestLog().Infof("Auto-assign %d ipv4, %d ipv6 addrs for host '%s'", args.Num4, args.Num6, hostname)
 
-	var v4list, v6list []net.IP
-	var err error
+	if err := c.checkHandleOwner(args.HandleID, hostname); err != nil {
+		return nil, nil, err
+	}
+	if err := c.checkAttributes(args.Attrs); err != nil {
+		return nil, nil, err
+	}
+
+	var v4list, v6list []AssignedIP
+
+	assign := c.autoAssign
+	if args.Contiguous {
+		assign = c.autoAssignContiguous
+	}
 
 	if args.Num4 != 0 {
 		// Assign IPv4 addresses.
-		log.Debugf("Assigning IPv4 addresses")
+		c.requestLog().Debugf("Assigning IPv4 addresses")
 		for _, pool := range args.IPv4Pools {
-			if pool.IP.To4() == nil {
+			if !(net.IP{pool.IP}).IsIPv4() {
 				return nil, nil, fmt.Errorf("provided IPv4 IPPools list contains one or more IPv6 IPPools")
 			}
 		}
-		v4list, err = c.autoAssign(args.Num4, args.HandleID, args.Attrs, args.IPv4Pools, ipv4, hostname)
+		v4list, err = assign(args.Num4, args.HandleID, args.Attrs, args.IPv4Pools, ipv4, hostname, args.Zone)
+		c.blockReaderWriter.observeAssign(hostname, ipv4, args.Num4, assignedIPs(v4list), err)
 		if err != nil {
-			log.Errorf("Error assigning IPV4 addresses: %s", err)
+			c.requestLog().Errorf("Error assigning IPV4 addresses: %s", err)
+			if _, ok := err.(strictAffinityExhaustedError); ok {
+				// Return the addresses that were assigned, so that
+				// the caller can release them.
+				return v4list, nil, err
+			}
 			return nil, nil, err
 		}
 	}
 
 	if args.Num6 != 0 {
 		// If no err assigning V4, try to assign any V6.
-		log.Debugf("Assigning IPv6 addresses")
+		c.requestLog().Debugf("Assigning IPv6 addresses")
 		for _, pool := range args.IPv6Pools {
-			if pool.IP.To4() != nil {
+			if !(net.IP{pool.IP}).IsIPv6() {
 				return nil, nil, fmt.Errorf("provided IPv6 IPPools list contains one or more IPv4 IPPools")
 			}
 		}
-		v6list, err = c.autoAssign(args.Num6, args.HandleID, args.Attrs, args.IPv6Pools, ipv6, hostname)
+		v6list, err = assign(args.Num6, args.HandleID, args.Attrs, args.IPv6Pools, ipv6, hostname, args.Zone)
+		c.blockReaderWriter.observeAssign(hostname, ipv6, args.Num6, assignedIPs(v6list), err)
 		if err != nil {
-			log.Errorf("Error assigning IPV6 addresses: %s", err)
+			c.requestLog().Errorf("Error assigning IPV6 addresses: %s", err)
+			if _, ok := err.(strictAffinityExhaustedError); ok {
+				// Return the addresses that were assigned, so that
+				// the caller can release them.
+				return v4list, v6list, err
+			}
 			return nil, nil, err
 		}
 	}
@@ -155,64 +529,349 @@ func (c ipams) AutoAssign(args AutoAssignArgs) ([]net.IP, []net.IP, error) {
 	return v4list, v6list, nil
 }
 
-func (c ipams) autoAssign(num int, handleID *string, attrs map[string]string, pools []net.IPNet, version ipVersion, host string) ([]net.IP, error) {
+// autoAssignContiguous assigns a run of num contiguous addresses from a single
+// block, trying the host's affine blocks before claiming a new block.  The
+// run is never split across blocks, and non-affine blocks are not used.  A
+// newly claimed block which can't hold the run is released again.  Returns a
+// noContiguousRangeError if no block can provide the run.
+func (c ipams) autoAssignContiguous(num int, handleID *string, attrs map[string]string, pools []net.IPNet, version ipVersion, host, zone string) ([]AssignedIP, error) {
+	logContext := c.requestLog().WithFields(log.Fields{
+		"host":    host,
+		"version": version.Number,
+	})
+	affBlocks, err := c.blockReaderWriter.getAffineBlocks(host, version, pools)
+	if err != nil {
+		return nil, err
+	}
+	for _, cidr := range affBlocks {
+		assigned, err := c.assignFromExistingBlock(cidr, num, handleID, attrs, host, true, true, false)
+		if err != nil {
+			return nil, err
+		}
+		if len(assigned) == num {
+			return assigned, nil
+		}
+		logContext.WithField("blockCIDR", cidr.String()).Debugf("Block has no run of %d free addresses", num)
+	}
+
+	config, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return nil, err
+	}
+	if config.AutoAllocateBlocks {
+		// Don't claim a block that is too small to hold the run.
+		largest, err := c.blockReaderWriter.largestBlockSize(version, pools, *config)
+		if err != nil {
+			return nil, err
+		}
+		if largest > 0 && num > largest {
+			logContext.Infof("No block can hold a run of %d addresses", num)
+			return nil, noContiguousRangeError{Num: num}
+		}
+		for retries := config.Retry.maxAttempts(); retries > 0; retries-- {
+			b, err := c.blockReaderWriter.claimNewAffineBlock(host, zone, version, pools, config)
+			if err != nil {
+				if e, ok := err.(affinityClaimedError); ok && !e.Strict {
+					continue
+				}
+				if _, ok := err.(noFreeBlocksError); ok {
+					break
+				}
+				if _, ok := err.(maxBlocksExceededError); ok {
+					break
+				}
+				logContext.WithError(err).Error("Error claiming new block")
+				return nil, err
+			}
+			assigned, err := c.assignFromExistingBlock(*b, num, handleID, attrs, host, config.StrictAffinity, true, false)
+			if err == nil && len(assigned) == num {
+				return claimedAssignments(assigned), nil
+			}
+
+			// The run can't be placed in the new block, for example because
+			// of its reserved addresses, so give the block back rather than
+			// leave an empty block affine to the host.
+			if relErr := c.blockReaderWriter.releaseEmptyBlockAffinity(host, *b); relErr != nil {
+				logContext.WithError(relErr).WithField("blockCIDR", b.String()).Warning("Error releasing claimed block")
+			}
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return nil, noContiguousRangeError{Num: num}
+}
+
+// AutoAssignDualStack assigns IPv4 and IPv6 addresses as specified by the
+// provided AutoAssignArgs, choosing the pools for both IP versions from one
+// listing of the configured IP pools.  Claiming a new block lists the pools
+// again, to check the claim against their current configuration.  The
+// result holds the assigned addresses and any error for each IP version, so
+// a failure for one version does not discard the addresses assigned for the
+// other.  An error is returned only if the IP pools could not be listed, or
+// the default pool could not be created.
+func (c ipams) AutoAssignDualStack(args AutoAssignArgs) (*DualStackAssignResult, error) {
+	c = c.withRequestID(args.RequestID).withLease(args.TTL)
+	c, err := c.withIPAMConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkHandleOwner(args.HandleID, decideHostname(args.Hostname)); err != nil {
+		return nil, err
+	}
+	if err := c.checkAttributes(args.Attrs); err != nil {
+		return nil, err
+	}
+
+	// Create the default pool if there are no pools, so that there is a
+	// pool to assign from.
+	createVersions := []ipVersion{}
+	if args.Num4 != 0 && len(args.IPv4Pools) == 0 {
+		createVersions = append(createVersions, ipv4)
+	}
+	if args.Num6 != 0 && len(args.IPv6Pools) == 0 {
+		createVersions = append(createVersions, ipv6)
+	}
+	allPools, err := c.blockReaderWriter.listPoolsOrCreateDefault(c.blockReaderWriter.config, createVersions...)
+	if err != nil {
+		c.requestLog().WithError(err).Error("Error reading configured pools")
+		return nil, err
+	}
+	result := c.autoAssignDualStack(args, allPools.Items)
+	return &result, nil
+}
+
+// AssignPreferred assigns the IPv4 and IPv6 addresses specified by the
+// provided AutoAssignArgs, trying each of the preferred addresses in order
+// before automatically assigning any that remain.  Preferred addresses count
+// towards Num4 and Num6, and are no longer tried once enough addresses of
+// their IP version have been assigned.  A preferred address that is not
+// within a configured pool is skipped with a warning, and one that cannot be
+// assigned, for example because it is already in use, is skipped.  If the
+// remaining addresses cannot be auto-assigned, the addresses assigned so far
+// are returned along with the error, so that the caller can release them.
+func (c ipams) AssignPreferred(preferred []net.IP, args AutoAssignArgs) (*PreferredAssignResult, error) {
+	// The preferred and auto-assigned addresses are assigned under the
+	// same request ID.
+	c = c.withRequestID(args.RequestID)
+	args.RequestID = c.blockReaderWriter.requestID
+	c, err := c.withIPAMConfig()
+	if err != nil {
+		return nil, err
+	}
+	hostname := decideHostname(args.Hostname)
+	c.requestLog().Infof("Assign %d ipv4, %d ipv6 addrs for host '%s' preferring %v", args.Num4, args.Num6, hostname, preferred)
+
+	if err := c.checkHandleOwner(args.HandleID, hostname); err != nil {
+		return nil, err
+	}
+	if err := c.checkAttributes(args.Attrs); err != nil {
+		return nil, err
+	}
+
+	result := &PreferredAssignResult{Honored: []net.IP{}}
+	num4, num6 := args.Num4, args.Num6
+	for _, ip := range preferred {
+		logContext := c.requestLog().WithField("ip", ip.String())
+		remaining := &num4
+		if ip.Version() == 6 {
+			remaining = &num6
+		}
+		if *remaining <= 0 {
+			logContext.Debug("Enough addresses already assigned, not trying preferred address")
+			continue
+		}
+		if _, err := c.blockReaderWriter.poolForIP(ip); err != nil {
+			if _, ok := err.(notInAnyPoolError); ok {
+				logContext.Warning("Preferred address is not in any configured pool, skipping it")
+				continue
+			}
+			return result, err
+		}
+		err := c.AssignIP(AssignIPArgs{
+			IP:        ip,
+			HandleID:  args.HandleID,
+			Attrs:     args.Attrs,
+			Hostname:  hostname,
+			RequestID: args.RequestID,
+			TTL:       args.TTL,
+		})
+		if err != nil {
+			logContext.WithError(err).Info("Preferred address could not be assigned, skipping it")
+			continue
+		}
+		result.Honored = append(result.Honored, ip)
+		*remaining--
+	}
+
+	if num4 <= 0 && num6 <= 0 {
+		return result, nil
+	}
+	args.Num4, args.Num6 = num4, num6
+	v4, v6, err := c.AutoAssign(args)
+	result.IPv4, result.IPv6 = v4, v6
+	return result, err
+}
+
+// autoAssignDualStack assigns the addresses of each IP version from the given
+// pools.
+func (c ipams) autoAssignDualStack(args AutoAssignArgs, allPools []api.IPPool) DualStackAssignResult {
+	hostname := decideHostname(args.Hostname)
+	c.requestLog().Infof("Dual-stack auto-assign %d ipv4, %d ipv6 addrs for host '%s'", args.Num4, args.Num6, hostname)
+
+	result := DualStackAssignResult{}
+	result.IPv4, result.IPv4Error = c.autoAssignFromPools(args.Num4, args, args.IPv4Pools, allPools, ipv4, hostname)
+	if args.Num4 != 0 {
+		c.blockReaderWriter.observeAssign(hostname, ipv4, args.Num4, result.IPv4, result.IPv4Error)
+	}
+	if result.IPv4Error != nil {
+		c.requestLog().WithError(result.IPv4Error).Warning("Error assigning IPv4 addresses")
+	}
+	result.IPv6, result.IPv6Error = c.autoAssignFromPools(args.Num6, args, args.IPv6Pools, allPools, ipv6, hostname)
+	if args.Num6 != 0 {
+		c.blockReaderWriter.observeAssign(hostname, ipv6, args.Num6, result.IPv6, result.IPv6Error)
+	}
+	if result.IPv6Error != nil {
+		c.requestLog().WithError(result.IPv6Error).Warning("Error assigning IPv6 addresses")
+	}
+	return result
+}
+
+// autoAssignFromPools assigns num addresses of the given IP version from the
+// requested pools, or from all of the enabled pools of that version if none
+// are requested.  Returns the assigned addresses along with an error if fewer
+// than num addresses could be assigned.
+func (c ipams) autoAssignFromPools(num int, args AutoAssignArgs, requested []net.IPNet, allPools []api.IPPool, version ipVersion, host string) ([]net.IP, error) {
+	if num == 0 {
+		return nil, nil
+	}
+	pools := requested
+	if len(pools) == 0 {
+		pools = enabledPools(allPools, version)
+		if len(pools) == 0 {
+			return nil, noFreeBlocksError(fmt.Sprintf("No enabled IPv%d pools", version.Number))
+		}
+	}
+	for _, pool := range pools {
+		if pool.Version() != version.Number {
+			return nil, fmt.Errorf("provided IPv%d IPPools list contains one or more IPv%d IPPools", version.Number, pool.Version())
+		}
+	}
+
+	assign := c.autoAssign
+	if args.Contiguous {
+		assign = c.autoAssignContiguous
+	}
+	assigned, err := assign(num, args.HandleID, args.Attrs, pools, version, host, args.Zone)
+	ips := assignedIPs(assigned)
+	if _, ok := err.(strictAffinityExhaustedError); ok {
+		return ips, err
+	} else if err != nil {
+		return nil, err
+	}
+	if len(ips) < num {
+		return ips, noFreeBlocksError(fmt.Sprintf("Assigned %d of %d IPv%d addresses", len(ips), num, version.Number))
+	}
+	return ips, nil
+}
+
+// autoAssign assigns num addresses, first from the host's affine blocks, then
+// from new blocks claimed for the host, and then, unless StrictAffinity is
+// enabled, from any block with free addresses.  Returns a description of
+// each assigned address.
+func (c ipams) autoAssign(num int, handleID *string, attrs map[string]string, pools []net.IPNet, version ipVersion, host, zone string) ([]AssignedIP, error) {
 
 	// Start by trying to assign from one of the host-affine blocks.  We
 	// always do strict checking at this stage, so it doesn't matter whether
 	// globally we have strict_affinity or not.
-	log.Debugf("Looking for addresses in current affine blocks for host '%s'", host)
+	logContext := c.requestLog().WithFields(log.Fields{
+		"host":    host,
+		"version": version.Number,
+	})
+	logContext.Debug("Looking for addresses in current affine blocks")
 	affBlocks, err := c.blockReaderWriter.getAffineBlocks(host, version, pools)
 	if err != nil {
 		return nil, err
 	}
-	log.Debugf("Found %d affine IPv%d blocks for host '%s': %v", len(affBlocks), version.Number, host, affBlocks)
-	ips := []net.IP{}
+	logContext.Debugf("Found %d affine blocks: %v", len(affBlocks), affBlocks)
+
+	ips := []AssignedIP{}
 	for len(ips) < num {
 		if len(affBlocks) == 0 {
-			log.Infof("Ran out of existing affine blocks for host '%s'", host)
+			logContext.Info("Ran out of existing affine blocks")
 			break
 		}
 		cidr := affBlocks[0]
 		affBlocks = affBlocks[1:]
-		ips, _ = c.assignFromExistingBlock(cidr, num, handleID, attrs, host, true)
-		log.Debugf("Block '%s' provided addresses: %v", cidr.String(), ips)
+		newIPs, _ := c.assignFromAffineBlock(cidr, num-len(ips), handleID, attrs, host)
+		logContext.WithField("blockCIDR", cidr.String()).Debugf("Block provided addresses: %v", assignedIPs(newIPs))
+		ips = append(ips, newIPs...)
 	}
 
 	// If there are still addresses to allocate, then we've run out of
 	// blocks with affinity.  Before we can assign new blocks or assign in
 	// non-affine blocks, we need to check that our IPAM configuration
 	// allows that.
-	config, err := c.GetIPAMConfig()
+	config, err := c.blockReaderWriter.ipamConfig()
 	if err != nil {
 		return nil, err
 	}
-	log.Debugf("Allocate new blocks? Config: %+v", config)
+	logContext.Debugf("Allocate new blocks? Config: %+v", config)
 	if config.AutoAllocateBlocks == true {
 		rem := num - len(ips)
-		retries := ipamEtcdRetries
+		retries := config.Retry.maxAttempts()
 		for rem > 0 && retries > 0 {
 			// Claim a new block.
-			log.Infof("Need to allocate %d more addresses - allocate another block", rem)
+			logContext.Infof("Need to allocate %d more addresses - allocate another block", rem)
 			retries = retries - 1
-			b, err := c.blockReaderWriter.claimNewAffineBlock(host, version, pools, *config)
+			var b *net.IPNet
+			var claimedIPs []AssignedIP
+			if rem == 1 {
+				// The common case of a single address.  Assign it as
+				// the block is claimed, so that a failure never leaves
+				// a claimed but empty block.
+				b, err = c.blockReaderWriter.claimNewAffineBlockWith(host, zone, version, pools, config, func(subnet net.IPNet, pool *net.IPNet, cfg IPAMConfig) error {
+					var err error
+					claimedIPs, err = c.claimBlockAndAssign(subnet, pool, handleID, attrs, host, cfg)
+					return err
+				})
+			} else {
+				b, err = c.blockReaderWriter.claimNewAffineBlock(host, zone, version, pools, config)
+			}
 			if err != nil {
 				// Error claiming new block.
 				if _, ok := err.(noFreeBlocksError); ok {
 					// No free blocks.  Break.
 					break
+				} else if _, ok := err.(maxBlocksExceededError); ok {
+					// This host already has as many blocks as it is
+					// allowed.  Break, and overflow into non-affine
+					// blocks below if StrictAffinity allows it.
+					logContext.WithError(err).Info("Not claiming new block")
+					break
+				} else if e, ok := err.(affinityClaimedError); ok && !e.Strict {
+					// Another host claimed the block first.  Try again
+					// with a different block.
+					logContext.WithError(err).Info("Block claimed by another host, retrying")
+					continue
 				}
-				log.Errorf("Error claiming new block: %s", err)
+				logContext.WithError(err).Error("Error claiming new block")
 				return nil, err
 			} else {
 				// Claim successful.  Assign addresses from the new block.
-				log.Infof("Claimed new block %s - assigning %d addresses", b.String(), rem)
-				newIPs, err := c.assignFromExistingBlock(*b, rem, handleID, attrs, host, config.StrictAffinity)
-				if err != nil {
-					log.Warningf("Failed to assign IPs:", err)
-					break
+				blockContext := logContext.WithField("blockCIDR", b.String())
+				newIPs := claimedIPs
+				if rem > 1 {
+					blockContext.Infof("Claimed new block - assigning %d addresses", rem)
+					newIPs, err = c.assignFromExistingBlock(*b, rem, handleID, attrs, host, config.StrictAffinity, false, false)
+					if err != nil {
+						blockContext.WithError(err).Warning("Failed to assign IPs")
+						break
+					}
 				}
-				log.Debugf("Assigned IPs from new block: %s", newIPs)
-				ips = append(ips, newIPs...)
+				blockContext.Debugf("Assigned IPs from new block: %v", assignedIPs(newIPs))
+				ips = append(ips, claimedAssignments(newIPs)...)
 				rem = num - len(ips)
 			}
 		}
@@ -224,8 +883,17 @@ func (c ipams) autoAssign(num int, handleID *string, attrs map[string]string, po
 
 	// If there are still addresses to allocate, we've now tried all blocks
 	// with some affinity to us, and tried (and failed) to allocate new
-	// ones.  If we do not require strict host affinity, our last option is
-	// a random hunt through any blocks we haven't yet tried.
+	// ones.  With strict host affinity there is nowhere else to look, so
+	// fail with a distinct error rather than the generic one.
+	rem := num - len(ips)
+	if config.StrictAffinity && rem != 0 {
+		err := strictAffinityExhaustedError{Host: host, Version: version.Number, Requested: num, Assigned: len(ips)}
+		logContext.WithError(err).Warning("Unable to assign addresses")
+		return ips, err
+	}
+
+	// If we do not require strict host affinity, our last option is a
+	// random hunt through any blocks we haven't yet tried.
 	//
 	// Note that this processing simply takes all of the IP pools and breaks
 	// them up into block-sized CIDRs, then shuffles and searches through each
@@ -236,44 +904,39 @@ func (c ipams) autoAssign(num int, handleID *string, attrs map[string]string, po
 	// If we need to support non-strict affinity and no auto-allocation of
 	// blocks, then we should query the actual allocation blocks and assign
 	// from those.
-	rem := num - len(ips)
-	if config.StrictAffinity != true && rem != 0 {
-		log.Infof("Attempting to assign %d more addresses from non-affine blocks", rem)
+	if rem != 0 {
+		logContext.Infof("Attempting to assign %d more addresses from non-affine blocks", rem)
 		// Figure out the pools to allocate from.
 		if len(pools) == 0 {
-			// Default to all configured pools.
-			allPools, err := c.client.IPPools().List(api.IPPoolMetadata{})
+			// Default to all enabled pools of this version.
+			pools, err = c.blockReaderWriter.enabledPoolsForVersion(version)
 			if err != nil {
-				log.Errorf("Error reading configured pools: %s", err)
 				return ips, nil
 			}
-
-			// Grab all the IP networks in these pools.
-			for _, p := range allPools.Items {
-				// Don't include disabled pools.
-				if !p.Spec.Disabled {
-					pools = append(pools, p.Metadata.CIDR)
-				}
-			}
 		}
 
 		// Iterate over pools and assign addresses until we either run out of pools,
 		// or the request has been satisfied.
 		for _, p := range pools {
-			log.Debugf("Assigning from random blocks in pool %s", p.String())
-			newBlock := randomBlockGenerator(p, host)
+			poolContext := logContext.WithField("cidr", p.String())
+			poolContext.Debug("Assigning from random blocks in pool")
+			prefix, err := c.blockReaderWriter.blockPrefixLengthForCIDR(p, *config)
+			if err != nil {
+				return ips, err
+			}
+			newBlock := randomBlockGenerator(p, prefix, host)
 			for rem > 0 {
 				// Grab a new random block.
 				blockCIDR := newBlock()
 				if blockCIDR == nil {
-					log.Warningf("All addresses exhausted in pool %s", p.String())
+					poolContext.Warning("All addresses exhausted in pool")
 					break
 				}
 
 				// Attempt to assign from the block.
-				newIPs, err := c.assignFromExistingBlock(*blockCIDR, rem, handleID, attrs, host, false)
+				newIPs, err := c.assignFromExistingBlock(*blockCIDR, rem, handleID, attrs, host, false, false, false)
 				if err != nil {
-					log.Warningf("Failed to assign IPs in pool %s: %s", p.String(), err)
+					poolContext.WithField("blockCIDR", blockCIDR.String()).WithError(err).Warning("Failed to assign IPs in pool")
 					break
 				}
 				ips = append(ips, newIPs...)
@@ -282,68 +945,166 @@ func (c ipams) autoAssign(num int, handleID *string, attrs map[string]string, po
 		}
 	}
 
-	log.Infof("Auto-assigned %d out of %d IPv%ds: %v", len(ips), num, version.Number, ips)
+	logContext.Infof("Auto-assigned %d out of %d addresses: %v", len(ips), num, assignedIPs(ips))
 	return ips, nil
 }
 
+// claimedAssignments marks the given assignments as being from a block
+// claimed to assign them.
+func claimedAssignments(assigned []AssignedIP) []AssignedIP {
+	for i := range assigned {
+		assigned[i].ClaimedBlock = true
+	}
+	return assigned
+}
+
 // AssignIP assigns the provided IP address to the provided host.  The IP address
 // must fall within a configured pool.  AssignIP will claim block affinity as needed
 // in order to satisfy the assignment.  An error will be returned if the IP address
 // is already assigned, or if StrictAffinity is enabled and the address is within
 // a block that does not have affinity for the given host.
 func (c ipams) AssignIP(args AssignIPArgs) error {
+	_, err := c.observedAssignIP(args)
+	return err
+}
+
+// AssignIPWithResult is AssignIP, returning the pool and block the address
+// was assigned from, and whether the block was claimed to assign it.
+func (c ipams) AssignIPWithResult(args AssignIPArgs) (*AssignmentResult, error) {
+	assigned, err := c.observedAssignIP(args)
+	if err != nil {
+		return nil, err
+	}
+	result := []AssignedIP{*assigned}
+	c.describeEncap(result)
+	if args.IP.Version() == 4 {
+		return &AssignmentResult{IPv4: result}, nil
+	}
+	return &AssignmentResult{IPv6: result}, nil
+}
+
+// observedAssignIP assigns the address and notifies the observer of the
+// outcome.  Returns a description of the assignment.
+func (c ipams) observedAssignIP(args AssignIPArgs) (*AssignedIP, error) {
+	c = c.withRequestID(args.RequestID).withLease(args.TTL)
+	c, err := c.withIPAMConfig()
+	if err != nil {
+		return nil, err
+	}
+	assigned, err := c.assignIP(args)
+	ips := []net.IP{}
+	if err == nil {
+		ips = append(ips, args.IP)
+	}
+	c.blockReaderWriter.observeAssign(decideHostname(args.Hostname), getIPVersion(args.IP), 1, ips, err)
+	return assigned, err
+}
+
+// assignIP assigns the address, returning a description of the assignment.
+func (c ipams) assignIP(args AssignIPArgs) (*AssignedIP, error) {
 	hostname := decideHostname(args.Hostname)
-	log.Infof("Assigning IP %s to host: %s", args.IP, hostname)
+	logContext := c.requestLog().WithFields(log.Fields{
+		"host": hostname,
+		"ip":   args.IP.String(),
+	})
+	logContext.Info("Assigning IP")
+
+	if err := c.checkHandleOwner(args.HandleID, hostname); err != nil {
+		return nil, err
+	}
+	if err := c.checkAttributes(args.Attrs); err != nil {
+		return nil, err
+	}
+
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		logContext.WithError(err).Error("Error getting IPAM Config")
+		return nil, err
+	}
+
+	// Create the default pool if there are no pools and the default pool
+	// would contain the address.
+	if defaultPool := cfg.defaultPool(); defaultPool.Contains(args.IP.IP) {
+		version := ipv4
+		if args.IP.Version() == 6 {
+			version = ipv6
+		}
+		if _, err := c.blockReaderWriter.listPoolsOrCreateDefault(cfg, version); err != nil {
+			logContext.WithError(err).Error("Error reading configured pools")
+			return nil, err
+		}
+	}
 
 	if !c.blockReaderWriter.withinConfiguredPools(args.IP) {
-		return goerrors.New("The provided IP address is not in a configured pool\n")
+		return nil, goerrors.New("The provided IP address is not in a configured pool\n")
 	}
 
-	blockCIDR := getBlockCIDRForAddress(args.IP)
-	log.Debugf("IP %s is in block '%s'", args.IP.String(), blockCIDR.String())
-	for i := 0; i < ipamEtcdRetries; i++ {
-		obj, err := c.client.Backend.Get(model.BlockKey{blockCIDR})
+	blockCIDR, err := c.blockReaderWriter.blockCIDRForAddress(args.IP, *cfg)
+	if err != nil {
+		return nil, err
+	}
+	claimed := false
+	logContext = logContext.WithField("blockCIDR", blockCIDR.String())
+	logContext.Debug("IP is in block")
+	defer c.client.blockLocks.lockBlock(blockCIDR)()
+	var lastErr error
+	retry := cfg.Retry.start()
+	for i := 0; i < retry.maxAttempts(); i++ {
+		if !c.blockReaderWriter.waitForRetry(retry, i, model.BlockKey{CIDR: blockCIDR}) {
+			break
+		}
+		obj, err := c.blockReaderWriter.getBlock(blockCIDR)
 		if err != nil {
-			if _, ok := err.(errors.ErrorResourceDoesNotExist); ok {
+			if errors.IsNotExist(err) {
 				// Block doesn't exist, we need to create it.  First,
 				// validate the given IP address is within a configured pool.
 				if !c.blockReaderWriter.withinConfiguredPools(args.IP) {
 					estr := fmt.Sprintf("The given IP address (%s) is not in any configured pools", args.IP.String())
-					log.Errorf(estr)
-					return goerrors.New(estr)
-				}
-				log.Debugf("Block for IP %s does not yet exist, creating", args.IP)
-				cfg, err := c.GetIPAMConfig()
-				if err != nil {
-					log.Errorf("Error getting IPAM Config: %s", err)
-					return err
+					logContext.Error(estr)
+					return nil, goerrors.New(estr)
 				}
+				logContext.Debug("Block for IP does not yet exist, creating")
 				err = c.blockReaderWriter.claimBlockAffinity(blockCIDR, hostname, *cfg)
 				if err != nil {
-					if _, ok := err.(*affinityClaimedError); ok {
-						log.Warningf("Someone else claimed block %s before us", blockCIDR.String())
+					if e, ok := err.(affinityClaimedError); ok {
+						if e.Strict {
+							// The block is strictly affine to another host,
+							// so the address can never be assigned here.
+							logContext.Error("Block is strictly affine to another host")
+							return nil, err
+						}
+						logContext.Warning("Someone else claimed block before us")
+						lastErr = err
 						continue
 					} else {
-						return err
+						return nil, err
 					}
 				}
-				log.Infof("Claimed new block: %s", blockCIDR)
+				logContext.Info("Claimed new block")
+				claimed = true
 				continue
 			} else {
 				// Unexpected error
-				return err
+				return nil, err
 			}
 		}
 		block := allocationBlock{obj.Value.(*model.AllocationBlock)}
 		err = block.assign(args.IP, args.HandleID, args.Attrs, hostname)
 		if err != nil {
-			log.Errorf("Failed to assign address %s: %s", args.IP, err)
-			return err
+			logContext.WithError(err).Error("Failed to assign address")
+			return nil, err
+		}
+		if expiry := c.blockReaderWriter.leaseExpiry; expiry != nil {
+			if err := block.setLeaseExpiry([]net.IP{args.IP}, *expiry); err != nil {
+				return nil, err
+			}
 		}
 
 		// Increment handle.
 		if args.HandleID != nil {
-			c.incrementHandle(*args.HandleID, blockCIDR, 1)
+			if err := c.incrementHandle(*args.HandleID, blockCIDR, 1, hostname); err != nil {
+				return nil, err
+			}
 		}
 
 		// Update the block using the original KVPair to do a CAS.  No need to
@@ -351,29 +1112,46 @@ func (c ipams) AssignIP(args AssignIPArgs) error {
 		// in the KVPair.
 		_, err = c.client.Backend.Update(obj)
 		if err != nil {
-			log.Warningf("Update failed on block %s", block.CIDR.String())
 			if args.HandleID != nil {
 				c.decrementHandle(*args.HandleID, blockCIDR, 1)
 			}
-			return err
+			if errors.IsRetryable(err) {
+				logContext.WithError(err).Info("Failed to update block - try again")
+				lastErr = err
+				continue
+			}
+			logContext.WithError(err).Warning("Update failed on block")
+			return nil, err
 		}
-		return nil
+		assigned := block.assignments([]net.IP{args.IP}, args.HandleID)[0]
+		assigned.ClaimedBlock = claimed
+		return &assigned, nil
 	}
-	return goerrors.New("Max retries hit")
+	return nil, maxRetriesError{Key: model.BlockKey{CIDR: blockCIDR}, Err: lastErr}
 }
 
 // ReleaseIPs releases any of the given IP addresses that are currently assigned,
 // so that they are available to be used in another assignment.
 func (c ipams) ReleaseIPs(ips []net.IP) ([]net.IP, error) {
-	log.Infof("Releasing IP addresses: %v", ips)
+	c = c.withRequestID("")
+	c.requestLog().Infof("Releasing IP addresses: %v", ips)
 	unallocated := []net.IP{}
 
+	c, err := c.withIPAMConfig()
+	if err != nil {
+		return nil, err
+	}
+	cfg := c.blockReaderWriter.config
+
 	// Group IP addresses by block to minimize the number of writes
 	// to the datastore required to release the given addresses.
 	ipsByBlock := map[string][]net.IP{}
 	for _, ip := range ips {
 		// Check if we've already got an entry for this block.
-		blockCIDR := getBlockCIDRForAddress(ip)
+		blockCIDR, err := c.blockReaderWriter.blockCIDRForAddress(ip, *cfg)
+		if err != nil {
+			return nil, err
+		}
 		cidrStr := blockCIDR.String()
 		if _, exists := ipsByBlock[cidrStr]; !exists {
 			// Entry does not exist, create it.
@@ -389,7 +1167,7 @@ func (c ipams) ReleaseIPs(ips []net.IP) ([]net.IP, error) {
 		_, cidr, _ := net.ParseCIDR(cidrStr)
 		unalloc, err := c.releaseIPsFromBlock(ips, *cidr)
 		if err != nil {
-			log.Errorf("Error releasing IPs: %s", err)
+			c.requestLog().Errorf("Error releasing IPs: %s", err)
 			return nil, err
 		}
 		unallocated = append(unallocated, unalloc...)
@@ -398,10 +1176,20 @@ func (c ipams) ReleaseIPs(ips []net.IP) ([]net.IP, error) {
 }
 
 func (c ipams) releaseIPsFromBlock(ips []net.IP, blockCIDR net.IPNet) ([]net.IP, error) {
-	for i := 0; i < ipamEtcdRetries; i++ {
-		obj, err := c.client.Backend.Get(model.BlockKey{CIDR: blockCIDR})
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return nil, err
+	}
+	deleteEmpty := !cfg.RetainEmptyBlocks
+	defer c.client.blockLocks.lockBlock(blockCIDR)()
+	retry := cfg.Retry.start()
+	for i := 0; i < retry.maxAttempts(); i++ {
+		if !c.blockReaderWriter.waitForRetry(retry, i, model.BlockKey{CIDR: blockCIDR}) {
+			break
+		}
+		obj, err := c.blockReaderWriter.getBlock(blockCIDR)
 		if err != nil {
-			if _, ok := err.(errors.ErrorResourceDoesNotExist); ok {
+			if errors.IsNotExist(err) {
 				// The block does not exist - all addresses must be unassigned.
 				return ips, nil
 			} else {
@@ -424,33 +1212,24 @@ func (c ipams) releaseIPsFromBlock(ips []net.IP, blockCIDR net.IPNet) ([]net.IP,
 			return unallocated, nil
 		}
 
-		// If the block is empty and has no affinity, we can delete it.
-		// Otherwise, update the block using CAS.  There is no need to update
-		// the Value since we have updated the structure pointed to in the
-		// KVPair.
-		var updateErr error
-		if b.empty() && b.Affinity == nil {
-			log.Debugf("Deleting non-affine block '%s'", b.CIDR.String())
-			updateErr = c.client.Backend.Delete(obj)
-		} else {
-			log.Debugf("Updating assignments in block '%s'", b.CIDR.String())
-			_, updateErr = c.client.Backend.Update(obj)
-		}
-
+		// Write back the block, deleting it if it is now empty.  There is
+		// no need to update the Value since we have updated the structure
+		// pointed to in the KVPair.
+		updateErr := c.blockReaderWriter.writeReleasedBlock(obj, deleteEmpty)
 		if updateErr != nil {
-			if _, ok := updateErr.(errors.ErrorResourceUpdateConflict); ok {
+			if errors.IsRetryable(updateErr) {
 				// Comparison error - retry.
-				log.Warningf("Failed to update block '%s' - retry #%d", b.CIDR.String(), i)
+				c.requestLog().Warningf("Failed to update block '%s' - retry #%d", b.CIDR.String(), i)
 				continue
 			} else {
 				// Something else - return the error.
-				log.Errorf("Error updating block '%s': %s", b.CIDR.String(), updateErr)
+				c.requestLog().Errorf("Error updating block '%s': %s", b.CIDR.String(), updateErr)
 				return nil, updateErr
 			}
 		}
 
 		// Success - decrement handles.
-		log.Debugf("Decrementing handles: %v", handles)
+		c.requestLog().Debugf("Decrementing handles: %v", handles)
 		for handleID, amount := range handles {
 			c.decrementHandle(handleID, blockCIDR, amount)
 		}
@@ -459,35 +1238,80 @@ func (c ipams) releaseIPsFromBlock(ips []net.IP, blockCIDR net.IPNet) ([]net.IP,
 	return nil, goerrors.New("Max retries hit")
 }
 
+// AssignFromBlock assigns up to num addresses from the given block.  The block
+// must be affine to the host if the block has StrictAffinity set, whatever the
+// IPAM configuration now says.  The block may be reserved.  If the block does
+// not exist, the ErrorResourceDoesNotExist from the datastore is returned.
+func (c ipams) AssignFromBlock(blockCIDR net.IPNet, num int, host string, handleID *string) ([]net.IP, error) {
+	assigned, err := c.assignFromExistingBlock(blockCIDR, num, handleID, nil, decideHostname(host), false, false, true)
+	return assignedIPs(assigned), err
+}
+
+// assignFromExistingBlock assigns up to num addresses from the given block,
+// returning a description of each assigned address.
 func (c ipams) assignFromExistingBlock(
-	blockCIDR net.IPNet, num int, handleID *string, attrs map[string]string, host string, affCheck bool) ([]net.IP, error) {
+	blockCIDR net.IPNet, num int, handleID *string, attrs map[string]string, host string, affCheck bool, contiguous bool, allowReserved bool) ([]AssignedIP, error) {
 	// Limit number of retries.
-	var ips []net.IP
-	for i := 0; i < ipamEtcdRetries; i++ {
-		log.Debugf("Auto-assign from %s - retry %d", blockCIDR.String(), i)
-		obj, err := c.client.Backend.Get(model.BlockKey{blockCIDR})
+	logContext := c.requestLog().WithFields(log.Fields{
+		"host":      host,
+		"blockCIDR": blockCIDR.String(),
+	})
+	excluded, err := c.blockReaderWriter.unassignableCIDRs(blockCIDR)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return nil, err
+	}
+	order := cfg.AssignOrder
+
+	// Take turns with the other goroutines assigning from the block, so
+	// that we don't all fail the compare-and-swap but one.
+	defer c.client.blockLocks.lockBlock(blockCIDR)()
+
+	var lastErr error
+	retry := cfg.Retry.start()
+	for i := 0; i < retry.maxAttempts(); i++ {
+		if !c.blockReaderWriter.waitForRetry(retry, i, model.BlockKey{CIDR: blockCIDR}) {
+			break
+		}
+		logContext.Debugf("Auto-assign from block - retry %d", i)
+		obj, err := c.blockReaderWriter.getBlock(blockCIDR)
 		if err != nil {
-			log.Errorf("Error getting block: %s", err)
+			logContext.WithError(err).Error("Error getting block")
 			return nil, err
 		}
 
-		// Pull out the block.
+		// Pull out the block.  Reserved blocks are only used when the
+		// block is chosen explicitly.
 		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		if b.Reserved && !allowReserved {
+			logContext.Info("Block is reserved")
+			return []AssignedIP{}, nil
+		}
 
-		log.Debugf("Got block: %+v", b)
-		ips, err = b.autoAssign(num, handleID, host, attrs, affCheck)
+		logContext.Debugf("Got block: %+v", b)
+		ips, err := b.autoAssign(num, handleID, host, attrs, affCheck, contiguous, excluded, order)
 		if err != nil {
-			log.Errorf("Error in auto assign: %s", err)
+			logContext.WithError(err).Error("Error in auto assign")
 			return nil, err
 		}
 		if len(ips) == 0 {
-			log.Infof("Block %s is full", blockCIDR)
-			return []net.IP{}, nil
+			logContext.Info("Block is full")
+			return []AssignedIP{}, nil
+		}
+		if expiry := c.blockReaderWriter.leaseExpiry; expiry != nil {
+			if err := b.setLeaseExpiry(ips, *expiry); err != nil {
+				return nil, err
+			}
 		}
 
 		// Increment handle count.
 		if handleID != nil {
-			c.incrementHandle(*handleID, blockCIDR, num)
+			if err := c.incrementHandle(*handleID, blockCIDR, num, host); err != nil {
+				return nil, err
+			}
 		}
 
 		// Update the block using CAS by passing back the original
@@ -495,15 +1319,160 @@ func (c ipams) assignFromExistingBlock(
 		obj.Value = b.AllocationBlock
 		_, err = c.client.Backend.Update(obj)
 		if err != nil {
-			log.Infof("Failed to update block '%s' - try again", b.CIDR.String())
 			if handleID != nil {
 				c.decrementHandle(*handleID, blockCIDR, num)
 			}
-			continue
+			if errors.IsRetryable(err) {
+				logContext.WithError(err).Info("Failed to update block - try again")
+				lastErr = err
+				continue
+			}
+			logContext.WithError(err).Error("Error updating block")
+			return nil, err
 		}
-		break
+		return b.assignments(ips, handleID), nil
 	}
-	return ips, nil
+	return nil, maxRetriesError{Key: model.BlockKey{CIDR: blockCIDR}, Err: lastErr}
+}
+
+// assignFromAffineBlock assigns addresses from a block that is affine to the
+// host.  The affinity may have been reserved without creating the block, in
+// which case the block is created with the recorded affinity before
+// assigning from it.
+func (c ipams) assignFromAffineBlock(
+	blockCIDR net.IPNet, num int, handleID *string, attrs map[string]string, host string) ([]AssignedIP, error) {
+	assigned, err := c.assignFromExistingBlock(blockCIDR, num, handleID, attrs, host, true, false, false)
+	if !errors.IsNotExist(err) {
+		return assigned, err
+	}
+
+	c.requestLog().WithFields(log.Fields{
+		"host":      host,
+		"blockCIDR": blockCIDR.String(),
+	}).Info("Creating block for reserved affinity")
+	config, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return nil, err
+	}
+	pool, err := c.blockReaderWriter.blockPool(blockCIDR)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.blockReaderWriter.createAffineBlock(blockCIDR, pool, host, *config); err != nil {
+		return nil, err
+	}
+	return c.assignFromExistingBlock(blockCIDR, num, handleID, attrs, host, true, false, false)
+}
+
+// claimBlockAndAssign claims the given block for the host and assigns one
+// address from it.  Where the datastore supports it, the handle, the block
+// affinity and the block with the address allocated are written in a single
+// transaction, so that nothing is written if the claim fails, and a failure
+// part way through never leaves a claimed but empty block.  Otherwise, or if
+// the block already exists, the block is claimed and then assigned from in
+// turn.  Whether the datastore supports transactions is checked first, so
+// that nothing is read for a transaction it would refuse.
+func (c ipams) claimBlockAndAssign(
+	subnet net.IPNet, pool *net.IPNet, handleID *string, attrs map[string]string, host string, config IPAMConfig) ([]AssignedIP, error) {
+	logContext := c.requestLog().WithFields(log.Fields{
+		"host":      host,
+		"blockCIDR": subnet.String(),
+	})
+	inTurn := func() ([]AssignedIP, error) {
+		if err := c.blockReaderWriter.claimBlockAffinityInTurn(subnet, pool, host, config); err != nil {
+			return nil, err
+		}
+		return c.assignFromExistingBlock(subnet, 1, handleID, attrs, host, config.StrictAffinity, false, false)
+	}
+	if !c.blockReaderWriter.supportsTxn() {
+		logContext.Debug("Datastore does not support transactions, claiming the block and assigning from it in turn")
+		return inTurn()
+	}
+
+	excluded, err := c.blockReaderWriter.unassignableCIDRs(subnet)
+	if err != nil {
+		return nil, err
+	}
+	order := config.AssignOrder
+
+	var lastErr error
+	retry := config.Retry.start()
+	for i := 0; i < retry.maxAttempts(); i++ {
+		if !c.blockReaderWriter.waitForRetry(retry, i, model.BlockKey{CIDR: subnet}) {
+			break
+		}
+		block := newAffineBlock(subnet, pool, host, config)
+		ips, err := block.autoAssign(1, handleID, host, attrs, true, false, excluded, order)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			// Every address in the block is excluded, so there is
+			// nothing to assign as it is claimed.
+			return inTurn()
+		}
+		if expiry := c.blockReaderWriter.leaseExpiry; expiry != nil {
+			if err := block.setLeaseExpiry(ips, *expiry); err != nil {
+				return nil, err
+			}
+		}
+
+		// The transaction writes a new affinity for the host.
+		if err := validateHostName(host); err != nil {
+			return nil, err
+		}
+		ops := []bapi.TxnOp{}
+		if handleID != nil {
+			op, err := c.incrementHandleOp(*handleID, subnet, len(ips), host)
+			if err != nil {
+				return nil, err
+			}
+			ops = append(ops, op)
+		}
+		ops = append(ops,
+			bapi.TxnOp{
+				Type: bapi.TxnApply,
+				KVPair: &model.KVPair{
+					Key:   model.BlockAffinityKey{Host: host, CIDR: subnet},
+					Value: model.BlockAffinityValue,
+				},
+			},
+			bapi.TxnOp{
+				Type: bapi.TxnCreate,
+				KVPair: &model.KVPair{
+					Key:   model.BlockKey{CIDR: subnet},
+					Value: block.AllocationBlock,
+				},
+			},
+		)
+		_, err = c.client.Backend.Txn(ops, false)
+		if err == nil {
+			logContext.Debugf("Claimed block and assigned %v", ips)
+			c.blockReaderWriter.observer().BlockClaimed(host, subnet)
+			return block.assignments(ips, handleID), nil
+		}
+		if errors.IsTransactionNotAtomic(err) {
+			logContext.Warning("Datastore does not support transactions, claiming the block and assigning from it in turn")
+			return inTurn()
+		}
+		if e, ok := err.(errors.ErrorResourceAlreadyExists); ok {
+			if _, ok := e.Identifier.(model.BlockKey); ok {
+				// The block exists, so claimBlockAffinityInTurn must
+				// decide whether we may claim it.
+				logContext.Info("Block already exists, claiming it and assigning from it in turn")
+				return inTurn()
+			}
+		}
+		if !errors.IsRetryable(err) && !errors.IsAlreadyExists(err) {
+			logContext.WithError(err).Error("Error claiming block and assigning address")
+			return nil, err
+		}
+
+		// The handle was written by another process since we read it.
+		logContext.WithError(err).Info("Handle was updated, trying again")
+		lastErr = err
+	}
+	return nil, maxRetriesError{Key: model.BlockKey{CIDR: subnet}, Err: lastErr}
 }
 
 // ClaimAffinity makes a best effort to claim affinity to the given host for all blocks
@@ -511,9 +1480,24 @@ func (c ipams) assignFromExistingBlock(
 // pool.  Returns a list of blocks that were claimed, as well as a
 // list of blocks that were claimed by another host.
 // If an empty string is passed as the host, then the value of os.Hostname is used.
+// The blocks are claimed concurrently, up to the configured BulkConcurrency,
+// and if any claim fails with an error the other blocks are still claimed,
+// and a bulkError holding each failure is returned.
 func (c ipams) ClaimAffinity(cidr net.IPNet, host string) ([]net.IPNet, []net.IPNet, error) {
+	// Get IPAM config.
+	c, err := c.withIPAMConfig()
+	if err != nil {
+		c.requestLog().Errorf("Failed to get IPAM Config: %s", err)
+		return nil, nil, err
+	}
+	cfg := c.blockReaderWriter.config
+
 	// Validate that the given CIDR is at least as big as a block.
-	if !largerThanOrEqualToBlock(cidr) {
+	prefix, err := c.blockReaderWriter.blockPrefixLengthForCIDR(cidr, *cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !largerThanOrEqualToBlock(cidr, prefix) {
 		estr := fmt.Sprintf("The requested CIDR (%s) is smaller than the minimum.", cidr.String())
 		return nil, nil, invalidSizeError(estr)
 	}
@@ -529,31 +1513,117 @@ func (c ipams) ClaimAffinity(cidr net.IPNet, host string) ([]net.IPNet, []net.IP
 		return nil, nil, goerrors.New(estr)
 	}
 
+	// Claim all blocks within the given cidr, several at once.  A block
+	// which can't be claimed doesn't stop the others from being claimed.
+	blockCIDRs := []net.IPNet{}
+	blocks := blockGenerator(cidr, prefix)
+	for blockCIDR := blocks(); blockCIDR != nil; blockCIDR = blocks() {
+		blockCIDRs = append(blockCIDRs, *blockCIDR)
+	}
+	errs := forEachConcurrently(len(blockCIDRs), cfg.bulkConcurrency(), func(i int) error {
+		return c.blockReaderWriter.claimBlockAffinity(blockCIDRs[i], hostname, *cfg)
+	})
+	bulkErr := bulkError{Op: "ClaimAffinity", Errs: map[string]error{}}
+	for i, err := range errs {
+		if err == nil {
+			claimed = append(claimed, blockCIDRs[i])
+		} else if _, ok := err.(affinityClaimedError); ok {
+			// Claimed by someone else - add to failed list.
+			failed = append(failed, blockCIDRs[i])
+		} else {
+			c.requestLog().Errorf("Failed to claim block %s: %s", blockCIDRs[i], err)
+			bulkErr.Errs[blockCIDRs[i].String()] = err
+		}
+	}
+	if len(bulkErr.Errs) > 0 {
+		return claimed, failed, bulkErr
+	}
+	return claimed, failed, nil
+
+}
+
+// PartitionPool divides the blocks of the given pool evenly between the given
+// hosts and claims affinity for each block to its host.  Each host is given a
+// contiguous range of blocks, with hosts taken in sorted order so the result
+// does not depend on the order they are supplied.  If there are fewer blocks
+// than hosts, some hosts are not given any blocks.  Blocks claimed by a host
+// other than the one they are partitioned to are skipped.  Returns the number
+// of blocks in each host's share that are affine to it.
+func (c ipams) PartitionPool(pool net.IPNet, hosts []string) (map[string]int, error) {
+	if len(hosts) == 0 {
+		return nil, goerrors.New("at least one host must be specified to partition a pool")
+	}
+
+	// Verify the requested CIDR is a configured pool.
+	if !c.blockReaderWriter.withinConfiguredPools(net.IP{pool.IP}) {
+		estr := fmt.Sprintf("The requested CIDR (%s) is not within any configured pools.", pool.String())
+		return nil, goerrors.New(estr)
+	}
+
 	// Get IPAM config.
-	cfg, err := c.GetIPAMConfig()
+	c, err := c.withIPAMConfig()
 	if err != nil {
-		log.Errorf("Failed to get IPAM Config: %s", err)
-		return nil, nil, err
+		c.requestLog().WithError(err).Error("Failed to get IPAM Config")
+		return nil, err
+	}
+	cfg := c.blockReaderWriter.config
+	prefix, err := c.blockReaderWriter.blockPrefixLengthForCIDR(pool, *cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	// Claim all blocks within the given cidr.
-	blocks := blockGenerator(cidr)
-	for blockCIDR := blocks(); blockCIDR != nil; blockCIDR = blocks() {
-		err := c.blockReaderWriter.claimBlockAffinity(*blockCIDR, hostname, *cfg)
-		if err != nil {
-			if _, ok := err.(affinityClaimedError); ok {
-				// Claimed by someone else - add to failed list.
-				failed = append(failed, *blockCIDR)
-			} else {
-				log.Errorf("Failed to claim block: %s", err)
-				return claimed, failed, err
+	excluded, err := c.blockReaderWriter.excludedCIDRs(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := []net.IPNet{}
+	next := excludingBlockGenerator(blockGenerator(pool, prefix), excluded)
+	for blockCIDR := next(); blockCIDR != nil; blockCIDR = next() {
+		blocks = append(blocks, *blockCIDR)
+	}
+	return c.claimPartitions(partitionBlocks(blocks, hosts), *cfg)
+}
+
+// partitionBlocks divides the blocks into a contiguous range for each host,
+// with hosts taken in sorted order.  The ranges differ in size by at most one
+// block.
+func partitionBlocks(blocks []net.IPNet, hosts []string) map[string][]net.IPNet {
+	sorted := make([]string, len(hosts))
+	copy(sorted, hosts)
+	sort.Strings(sorted)
+
+	partitions := map[string][]net.IPNet{}
+	for i, host := range sorted {
+		start := i * len(blocks) / len(sorted)
+		end := (i + 1) * len(blocks) / len(sorted)
+		partitions[host] = append(partitions[host], blocks[start:end]...)
+	}
+	return partitions
+}
+
+// claimPartitions claims affinity for each host to its blocks, and returns
+// the number of each host's blocks that are affine to it.
+func (c ipams) claimPartitions(partitions map[string][]net.IPNet, cfg IPAMConfig) (map[string]int, error) {
+	claimed := map[string]int{}
+	for host, blocks := range partitions {
+		claimed[host] = 0
+		for _, blockCIDR := range blocks {
+			err := c.blockReaderWriter.claimBlockAffinity(blockCIDR, host, cfg)
+			if err != nil {
+				if _, ok := err.(affinityClaimedError); ok {
+					c.requestLog().WithFields(log.Fields{
+						"host":      host,
+						"blockCIDR": blockCIDR.String(),
+					}).Warning("Block is claimed by another host, skipping")
+					continue
+				}
+				return claimed, err
 			}
-		} else {
-			claimed = append(claimed, *blockCIDR)
+			claimed[host]++
 		}
 	}
-	return claimed, failed, nil
-
+	return claimed, nil
 }
 
 // ReleaseAffinity releases affinity for all blocks within the given CIDR
@@ -561,8 +1631,18 @@ func (c ipams) ClaimAffinity(cidr net.IPNet, host string) ([]net.IPNet, []net.IP
 // its affinity will not be released and no error will be returned.
 // If an empty string is passed as the host, then the value of os.Hostname is used.
 func (c ipams) ReleaseAffinity(cidr net.IPNet, host string) error {
+	c, err := c.withIPAMConfig()
+	if err != nil {
+		return err
+	}
+	cfg := c.blockReaderWriter.config
+
 	// Validate that the given CIDR is at least as big as a block.
-	if !largerThanOrEqualToBlock(cidr) {
+	prefix, err := c.blockReaderWriter.blockPrefixLengthForCIDR(cidr, *cfg)
+	if err != nil {
+		return err
+	}
+	if !largerThanOrEqualToBlock(cidr, prefix) {
 		estr := fmt.Sprintf("The requested CIDR (%s) is smaller than the minimum.", cidr.String())
 		return invalidSizeError(estr)
 	}
@@ -571,16 +1651,16 @@ func (c ipams) ReleaseAffinity(cidr net.IPNet, host string) error {
 	hostname := decideHostname(host)
 
 	// Release all blocks within the given cidr.
-	blocks := blockGenerator(cidr)
+	blocks := blockGenerator(cidr, prefix)
 	for blockCIDR := blocks(); blockCIDR != nil; blockCIDR = blocks() {
 		err := c.blockReaderWriter.releaseBlockAffinity(hostname, *blockCIDR)
 		if err != nil {
 			if _, ok := err.(affinityClaimedError); ok {
 				// Not claimed by this host - ignore.
-			} else if _, ok := err.(errors.ErrorResourceDoesNotExist); ok {
+			} else if errors.IsNotExist(err) {
 				// Block does not exist - ignore.
 			} else {
-				log.Errorf("Error releasing affinity for '%s': %s", *blockCIDR, err)
+				c.requestLog().Errorf("Error releasing affinity for '%s': %s", *blockCIDR, err)
 				return err
 			}
 		}
@@ -592,6 +1672,10 @@ func (c ipams) ReleaseAffinity(cidr net.IPNet, host string) error {
 // to the given host.  If an empty string is passed as the host,
 // then the value of os.Hostname is used.
 func (c ipams) ReleaseHostAffinities(host string) error {
+	c, err := c.withIPAMConfig()
+	if err != nil {
+		return err
+	}
 	hostname := decideHostname(host)
 
 	versions := []ipVersion{ipv4, ipv6}
@@ -601,16 +1685,29 @@ func (c ipams) ReleaseHostAffinities(host string) error {
 			return err
 		}
 
+		// Affinities that refer to blocks that no longer exist are
+		// collected up and deleted in a single batch.
+		dangling := []model.Key{}
 		for _, blockCIDR := range blockCIDRs {
-			err := c.ReleaseAffinity(blockCIDR, hostname)
+			err := c.blockReaderWriter.releaseBlockAffinity(hostname, blockCIDR)
 			if err != nil {
 				if _, ok := err.(affinityClaimedError); ok {
 					// Claimed by a different host.
+				} else if errors.IsNotExist(err) {
+					dangling = append(dangling, model.BlockAffinityKey{Host: hostname, CIDR: blockCIDR})
 				} else {
 					return err
 				}
 			}
 		}
+
+		if len(dangling) > 0 {
+			c.requestLog().Infof("Removing %d affinities for non-existent blocks on host '%s'", len(dangling), hostname)
+			for k, err := range c.client.Backend.DeleteKeys(dangling) {
+				c.requestLog().Errorf("Error removing affinity %s: %s", k, err)
+				return err
+			}
+		}
 	}
 	return nil
 }
@@ -618,7 +1715,11 @@ func (c ipams) ReleaseHostAffinities(host string) error {
 // ReleasePoolAffinities releases affinity for all blocks within
 // the specified pool across all hosts.
 func (c ipams) ReleasePoolAffinities(pool net.IPNet) error {
-	log.Infof("Releasing block affinities within pool '%s'", pool.String())
+	c, err := c.withIPAMConfig()
+	if err != nil {
+		return err
+	}
+	c.requestLog().Infof("Releasing block affinities within pool '%s'", pool.String())
 	for i := 0; i < ipamKeyErrRetries; i++ {
 		retry := false
 		pairs, err := c.hostBlockPairs(pool)
@@ -627,7 +1728,7 @@ func (c ipams) ReleasePoolAffinities(pool net.IPNet) error {
 		}
 
 		if len(pairs) == 0 {
-			log.Debugf("No blocks have affinity")
+			c.requestLog().Debugf("No blocks have affinity")
 			return nil
 		}
 
@@ -637,11 +1738,11 @@ func (c ipams) ReleasePoolAffinities(pool net.IPNet) error {
 			if err != nil {
 				if _, ok := err.(affinityClaimedError); ok {
 					retry = true
-				} else if _, ok := err.(errors.ErrorResourceDoesNotExist); ok {
-					log.Debugf("No such block '%s'", blockCIDR.String())
+				} else if errors.IsNotExist(err) {
+					c.requestLog().Debugf("No such block '%s'", blockCIDR.String())
 					continue
 				} else {
-					log.Errorf("Error releasing affinity for '%s': %s", blockCIDR.String(), err)
+					c.requestLog().Errorf("Error releasing affinity for '%s': %s", blockCIDR.String(), err)
 					return err
 				}
 			}
@@ -655,6 +1756,201 @@ func (c ipams) ReleasePoolAffinities(pool net.IPNet) error {
 	return goerrors.New("Max retries hit")
 }
 
+// ForceReleaseBlockAffinity releases the affinity of the given block, whichever
+// host it is affine to.  It fails unless the IPAM configuration allows
+// destructive operations.
+func (c ipams) ForceReleaseBlockAffinity(blockCIDR net.IPNet) error {
+	return c.blockReaderWriter.forceReleaseBlockAffinity(blockCIDR)
+}
+
+// DeletePoolBlocks deletes all blocks within the specified pool, along with
+// their affinities, so that the blocks are not orphaned when the pool is
+// deleted.  If any block still has addresses assigned, no blocks are deleted
+// and a blocksInUseError listing those blocks is returned, unless force is
+// set, in which case the blocks are deleted regardless and their
+// allocations are lost.  Forcing the deletion is a destructive operation, so
+// it fails unless the IPAM configuration allows destructive operations.
+//
+// A block belongs to the pool it was claimed from.  Blocks claimed before
+// the pool was recorded on them belong to any pool that contains them.
+func (c ipams) DeletePoolBlocks(pool net.IPNet, force bool) error {
+	logContext := c.requestLog().WithField("cidr", pool.String())
+	if force {
+		if err := c.blockReaderWriter.checkDestructiveOpsAllowed("DeletePoolBlocks"); err != nil {
+			return err
+		}
+	}
+
+	// Find the blocks belonging to the pool, and check that none are in
+	// use before deleting any of them.
+	version := getIPVersion(net.IP{pool.IP})
+	all, err := c.blockReaderWriter.listAll(model.BlockListOptions{IPVersion: version.Number, Pool: pool}, ipamListPageSize)
+	if err != nil && !errors.IsNotExist(err) {
+		logContext.WithError(err).Error("Error listing blocks")
+		return err
+	}
+	kvps := []*model.KVPair{}
+	inUse := []net.IPNet{}
+	for _, obj := range all {
+		if err := checkBlockCIDR(obj.Key, obj); err != nil {
+			logContext.WithError(err).Warning("Skipping block")
+			continue
+		}
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		if !blockBelongsToPool(b.AllocationBlock, pool) {
+			continue
+		}
+		kvps = append(kvps, obj)
+		if !b.empty() {
+			inUse = append(inUse, b.CIDR)
+		}
+	}
+	if len(inUse) > 0 {
+		if !force {
+			return blocksInUseError{Pool: pool, Blocks: inUse}
+		}
+		logContext.WithField("blocks", inUse).Warning("Force deleting blocks with assigned addresses, their allocations will be lost")
+	}
+
+	for _, obj := range kvps {
+		b := obj.Value.(*model.AllocationBlock)
+		blockContext := logContext.WithField("blockCIDR", b.CIDR.String())
+		blockContext.Info("Deleting block")
+		if err := c.client.Backend.Delete(obj); err != nil && !errors.IsNotExist(err) {
+			blockContext.WithError(err).Error("Error deleting block")
+			return err
+		}
+		if host, ok := blockAffinityHost(b); ok {
+			if err := c.blockReaderWriter.deleteBlockAffinity(host, b.CIDR); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GetUtilization returns the utilization of each block within the given pool,
+// ordered from the least utilized to the most utilized.
+func (c ipams) GetUtilization(pool net.IPNet) ([]BlockUtil, error) {
+	return c.blockReaderWriter.blocksByUtilization(&pool, getIPVersion(net.IP{pool.IP}), 0, false)
+}
+
+// BlockOwnershipByHost returns the number of blocks of the given IP version
+// that are affine to each host, within the pool if one is given.
+func (c ipams) BlockOwnershipByHost(pool *net.IPNet, version ipVersion) (map[string]int, error) {
+	return c.blockReaderWriter.blockOwnershipByHost(pool, version)
+}
+
+// FullPoolsForHost returns the enabled pools of the given IP version from
+// which the host cannot claim a new block.
+func (c ipams) FullPoolsForHost(host string, version ipVersion) ([]net.IPNet, error) {
+	return c.blockReaderWriter.fullPoolsForHost(host, version)
+}
+
+// PoolsOverlapping returns the enabled pools which overlap the given CIDR,
+// sorted by CIDR.
+func (c ipams) PoolsOverlapping(cidr net.IPNet) ([]api.IPPool, error) {
+	return c.blockReaderWriter.poolsOverlapping(cidr)
+}
+
+// PoolExhausted returns whether no address is free in the pool.
+func (c ipams) PoolExhausted(pool net.IPNet) (bool, error) {
+	return c.blockReaderWriter.poolExhausted(pool)
+}
+
+// UnclaimedBlocks returns up to limit of the blocks within the pool which
+// have not been claimed, in ascending order.
+func (c ipams) UnclaimedBlocks(pool net.IPNet, limit int) ([]net.IPNet, error) {
+	return c.blockReaderWriter.unclaimedBlocks(pool, limit)
+}
+
+// TotalFreeAddresses returns the number of free addresses and the total
+// number of addresses in all pools of the given IP version.
+func (c ipams) TotalFreeAddresses(version ipVersion) (*big.Int, *big.Int, error) {
+	return c.blockReaderWriter.totalFreeAddresses(version)
+}
+
+// ReserveBlock reserves an existing block so that it is never chosen for
+// automatic assignment.  Addresses may still be assigned from the block
+// explicitly, and the block is kept when it is empty.
+func (c ipams) ReserveBlock(blockCIDR net.IPNet) error {
+	return c.blockReaderWriter.setBlockReserved(blockCIDR, true)
+}
+
+// UnreserveBlock clears the reservation of an existing block, so that it may
+// be chosen for automatic assignment again.
+func (c ipams) UnreserveBlock(blockCIDR net.IPNet) error {
+	return c.blockReaderWriter.setBlockReserved(blockCIDR, false)
+}
+
+// SetBlockStrictAffinity sets or clears the StrictAffinity of an existing
+// block.  Strict affinity may only be set on a block that is affine to a
+// host.
+func (c ipams) SetBlockStrictAffinity(blockCIDR net.IPNet, strict bool) error {
+	return c.blockReaderWriter.updateBlockStrictAffinity(blockCIDR, strict)
+}
+
+// ClaimSharedBlock claims the given block as a shared block, from which any
+// host may assign.  An existing block is made shared unless it is affine to a
+// host.
+func (c ipams) ClaimSharedBlock(blockCIDR net.IPNet) error {
+	if err := c.blockReaderWriter.checkWithinPools(net.IP{blockCIDR.IP}); err != nil {
+		return err
+	}
+	c, err := c.withIPAMConfig()
+	if err != nil {
+		return err
+	}
+	cfg := c.blockReaderWriter.config
+	block, err := c.blockReaderWriter.blockCIDRForAddress(net.IP{blockCIDR.IP}, *cfg)
+	if err != nil {
+		return err
+	} else if block.String() != blockCIDR.String() {
+		return fmt.Errorf("%s is not a block, the block containing it is %s", blockCIDR, block)
+	}
+	return c.blockReaderWriter.claimSharedBlock(blockCIDR)
+}
+
+// FreeIPsInPool returns up to limit of the free IPs in the pool, in ascending
+// order, for tooling that shows which addresses are available.  Blocks that have not yet been created are entirely free.  The pool's
+// blocks are walked in order and the walk stops as soon as the limit is
+// reached, so large pools are not expanded in full.
+func (c ipams) FreeIPsInPool(pool net.IPNet, limit int) ([]net.IP, error) {
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := c.blockReaderWriter.blockPrefixLengthForCIDR(pool, *cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Addresses excluded from the pool, and its reserved addresses, are
+	// never assigned, so they are not free.
+	excluded, err := c.blockReaderWriter.unassignableCIDRs(pool)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := []net.IP{}
+	blocks := blockGenerator(pool, prefix)
+	for blockCIDR := blocks(); blockCIDR != nil && len(ips) < limit; blockCIDR = blocks() {
+		b := newBlock(*blockCIDR)
+		obj, err := c.blockReaderWriter.getBlock(*blockCIDR)
+		if err == nil {
+			b = allocationBlock{obj.Value.(*model.AllocationBlock)}
+		} else if !errors.IsNotExist(err) {
+			c.requestLog().WithFields(log.Fields{
+				"cidr":      pool.String(),
+				"blockCIDR": blockCIDR.String(),
+			}).WithError(err).Error("Error reading block")
+			return nil, err
+		}
+		ips = append(ips, b.freeIPs(limit-len(ips), excluded)...)
+	}
+	return ips, nil
+}
+
 // RemoveIPAMHost releases affinity for all blocks on the given host,
 // and removes all host-specific IPAM data from the datastore.
 // RemoveIPAMHost does not release any IP addresses claimed on the given host.
@@ -672,27 +1968,100 @@ func (c ipams) RemoveIPAMHost(host string) error {
 	})
 	if err != nil {
 		// Return the error unless the resource does not exist.
-		if _, ok := err.(errors.ErrorResourceDoesNotExist); !ok {
-			log.Errorf("Error removing IPAM host: %s", err)
+		if !errors.IsNotExist(err) {
+			c.requestLog().Errorf("Error removing IPAM host: %s", err)
 			return err
 		}
 	}
 	return nil
 }
 
+// ReclaimOrphanedBlocks releases the affinity of every block that is affine
+// to a host which is not in the given list of valid hosts.  Empty blocks are
+// freed for any host to claim.  Returns the blocks that were reclaimed, and
+// the blocks whose affinity was released but which still have addresses
+// assigned.  This may be run periodically, and concurrently with assignment
+// on other hosts.
+func (c ipams) ReclaimOrphanedBlocks(hosts []string) ([]net.IPNet, []net.IPNet, error) {
+	c, err := c.withIPAMConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	valid := map[string]bool{}
+	for _, host := range hosts {
+		valid[host] = true
+	}
+
+	kvps, err := c.blockReaderWriter.listAll(model.BlockAffinityListOptions{}, ipamListPageSize)
+	if err != nil {
+		c.requestLog().WithError(err).Error("Error querying block affinities")
+		return nil, nil, err
+	}
+
+	reclaimed := []net.IPNet{}
+	inUse := []net.IPNet{}
+	for _, kvp := range kvps {
+		k := kvp.Key.(model.BlockAffinityKey)
+		if valid[k.Host] {
+			continue
+		}
+		logContext := c.requestLog().WithFields(log.Fields{
+			"host":      k.Host,
+			"blockCIDR": k.CIDR.String(),
+		})
+		logContext.Info("Reclaiming block affine to nonexistent host")
+
+		// Releasing the affinity re-reads the block and retries on
+		// conflicts, so that assignments made concurrently are preserved.
+		err := c.blockReaderWriter.releaseBlockAffinity(k.Host, k.CIDR)
+		if _, ok := err.(affinityClaimedError); ok {
+			// The block was claimed by another host after the affinity
+			// was listed, so only the stale affinity needs removing.
+			logContext.Info("Block has been claimed by another host")
+			if err := c.blockReaderWriter.deleteBlockAffinity(k.Host, k.CIDR); err != nil {
+				return reclaimed, inUse, err
+			}
+			continue
+		} else if err != nil {
+			logContext.WithError(err).Error("Error releasing block affinity")
+			return reclaimed, inUse, err
+		}
+
+		// The block was deleted if it was empty.  Otherwise it is kept,
+		// without affinity, until its addresses are released.
+		obj, err := c.blockReaderWriter.getBlock(k.CIDR)
+		if err != nil {
+			if errors.IsNotExist(err) {
+				reclaimed = append(reclaimed, k.CIDR)
+				continue
+			}
+			logContext.WithError(err).Error("Error getting block")
+			return reclaimed, inUse, err
+		}
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		if b.Affinity == nil && !b.empty() {
+			logContext.Warning("Block still has addresses assigned")
+			inUse = append(inUse, k.CIDR)
+		} else {
+			reclaimed = append(reclaimed, k.CIDR)
+		}
+	}
+	return reclaimed, inUse, nil
+}
+
 func (c ipams) hostBlockPairs(pool net.IPNet) (map[string]string, error) {
 	pairs := map[string]string{}
 
 	// Get all blocks and their affinities.
 	objs, err := c.client.Backend.List(model.BlockAffinityListOptions{})
 	if err != nil {
-		log.Errorf("Error querying block affinities: %s", err)
+		c.requestLog().Errorf("Error querying block affinities: %s", err)
 		return nil, err
 	}
 
 	// Iterate through each block affinity and build up a mapping
 	// of blockCidr -> host.
-	log.Debugf("Getting block -> host mappings")
+	c.requestLog().Debugf("Getting block -> host mappings")
 	for _, o := range objs {
 		k := o.Key.(model.BlockAffinityKey)
 
@@ -700,122 +2069,310 @@ func (c ipams) hostBlockPairs(pool net.IPNet) (map[string]string, error) {
 		if pool.Contains(k.CIDR.IPNet.IP) {
 			pairs[k.CIDR.String()] = k.Host
 		}
-		log.Debugf("Block %s -> %s", k.CIDR.String(), k.Host)
+		c.requestLog().Debugf("Block %s -> %s", k.CIDR.String(), k.Host)
 	}
 
 	return pairs, nil
 }
 
 // IpsByHandle returns a list of all IP addresses that have been
-// assigned using the provided handle.
+// assigned using the provided handle, both IPv4 and IPv6.  If the handle's
+// entry in the handle index is missing, corrupt or stale, every block is
+// scanned for the handle's addresses instead and the entry is rebuilt.
 func (c ipams) IPsByHandle(handleID string) ([]net.IP, error) {
-	obj, err := c.client.Backend.Get(model.IPAMHandleKey{HandleID: handleID})
+	blocks, err := c.handleBlocks(handleID)
 	if err != nil {
 		return nil, err
 	}
-	handle := allocationHandle{obj.Value.(*model.IPAMHandle)}
 
+	assignments, stale := c.handleIPs(handleID, blocks)
+	if stale {
+		c.requestLog().WithField("handle", handleID).Warning("Handle index is stale, scanning all blocks for the handle's addresses")
+		if blocks, err = c.rebuildHandleEntry(handleID); err != nil {
+			return nil, err
+		}
+		assignments, _ = c.handleIPs(handleID, blocks)
+	}
+	return assignments, nil
+}
+
+// handleIPs returns the addresses assigned with the handle in the given
+// blocks, and whether any block held a different number of the handle's
+// addresses than the handle recorded for it.  Blocks that can't be read are
+// skipped.
+func (c ipams) handleIPs(handleID string, blocks map[string]int) ([]net.IP, bool) {
 	assignments := []net.IP{}
-	for k, _ := range handle.Block {
+	stale := false
+	for k, num := range blocks {
 		_, blockCIDR, _ := net.ParseCIDR(k)
-		obj, err := c.client.Backend.Get(model.BlockKey{*blockCIDR})
+		obj, err := c.blockReaderWriter.getBlock(*blockCIDR)
 		if err != nil {
-			log.Warningf("Couldn't read block %s referenced by handle %s", blockCIDR, handleID)
+			if errors.IsNotExist(err) {
+				stale = true
+			} else {
+				c.requestLog().Warningf("Couldn't read block %s referenced by handle %s", blockCIDR, handleID)
+			}
 			continue
 		}
 
 		// Pull out the allocationBlock and get all the assignments
 		// from it.
 		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
-		assignments = append(assignments, b.ipsByHandle(handleID)...)
+		ips := b.ipsByHandle(handleID)
+		if len(ips) != num {
+			stale = true
+		}
+		assignments = append(assignments, ips...)
 	}
-	return assignments, nil
+	return assignments, stale
 }
 
-// ReleaseByHandle releases all IP addresses that have been assigned
-// using the provided handle.
-func (c ipams) ReleaseByHandle(handleID string) error {
-	log.Infof("Releasing all IPs with handle '%s'", handleID)
-	obj, err := c.client.Backend.Get(model.IPAMHandleKey{HandleID: handleID})
+// ListHandles returns a summary of every handle, sorted by handle ID.  The
+// summaries are read from the handle index.  If the datastore does not
+// support listing handles, every block is scanned instead.
+func (c ipams) ListHandles() ([]HandleInfo, error) {
+	kvps, err := c.blockReaderWriter.listAll(model.IPAMHandleListOptions{}, ipamListPageSize)
 	if err != nil {
-		return err
+		if _, ok := err.(errors.ErrorOperationNotSupported); !ok {
+			c.requestLog().WithError(err).Error("Error listing handles")
+			return nil, err
+		}
+		c.requestLog().Warning("Datastore cannot list handles, scanning all blocks for them")
+		return c.scanHandles()
 	}
-	handle := allocationHandle{obj.Value.(*model.IPAMHandle)}
 
-	for blockStr, _ := range handle.Block {
-		_, blockCIDR, _ := net.ParseCIDR(blockStr)
-		err = c.releaseByHandle(handleID, *blockCIDR)
+	infos := []HandleInfo{}
+	for _, kvp := range kvps {
+		handle := kvp.Value.(*model.IPAMHandle)
+		info := HandleInfo{HandleID: kvp.Key.(model.IPAMHandleKey).HandleID, IPVersions: []int{}}
+		versions := map[int]bool{}
+		for cidr, num := range handle.Block {
+			_, blockCIDR, err := net.ParseCIDR(cidr)
+			if err != nil {
+				c.requestLog().WithField("handle", info.HandleID).WithError(err).Warning("Ignoring invalid block in handle")
+				continue
+			}
+			info.NumIPs += num
+			info.NumBlocks++
+			versions[blockCIDR.Version()] = true
+		}
+		for _, v := range []int{4, 6} {
+			if versions[v] {
+				info.IPVersions = append(info.IPVersions, v)
+			}
+		}
+		infos = append(infos, info)
 	}
-	return nil
+	sort.Sort(handleInfosByID(infos))
+	return infos, nil
 }
 
-func (c ipams) releaseByHandle(handleID string, blockCIDR net.IPNet) error {
-	for i := 0; i < ipamEtcdRetries; i++ {
-		obj, err := c.client.Backend.Get(model.BlockKey{CIDR: blockCIDR})
-		if err != nil {
-			if _, ok := err.(errors.ErrorResourceDoesNotExist); ok {
-				// Block doesn't exist, so all addresses are already
-				// unallocated.  This can happen when a handle is
-				// overestimating the number of assigned addresses.
-				return nil
-			} else {
-				return err
+// scanHandles returns a summary of every handle with addresses assigned,
+// sorted by handle ID, by scanning every block.
+func (c ipams) scanHandles() ([]HandleInfo, error) {
+	kvps, err := c.blockReaderWriter.listAll(model.BlockListOptions{}, ipamListPageSize)
+	if err != nil {
+		c.requestLog().WithError(err).Error("Error listing blocks")
+		return nil, err
+	}
+	byID := map[string]*HandleInfo{}
+	for _, kvp := range kvps {
+		block := allocationBlock{kvp.Value.(*model.AllocationBlock)}
+		version := block.CIDR.Version()
+		inBlock := map[string]bool{}
+		for _, a := range block.assignedIPsMatching(nil) {
+			if a.HandleID == nil {
+				continue
 			}
-		}
+			info, ok := byID[*a.HandleID]
+			if !ok {
+				info = &HandleInfo{HandleID: *a.HandleID, IPVersions: []int{}}
+				byID[*a.HandleID] = info
+			}
+			info.NumIPs++
+			if !inBlock[*a.HandleID] {
+				inBlock[*a.HandleID] = true
+				info.NumBlocks++
+				// Blocks are listed with IPv4 first, so the versions
+				// are appended in ascending order.
+				if n := len(info.IPVersions); n == 0 || info.IPVersions[n-1] != version {
+					info.IPVersions = append(info.IPVersions, version)
+				}
+			}
+		}
+	}
+
+	infos := []HandleInfo{}
+	for _, info := range byID {
+		infos = append(infos, *info)
+	}
+	sort.Sort(handleInfosByID(infos))
+	return infos, nil
+}
+
+// CountByHandlePrefix returns the number of addresses assigned with the
+// handles whose IDs start with the given prefix, for example the handles of
+// every workload in a namespace when handle IDs start with the namespace.  The
+// counts are read from the handle index, as for ListHandles.  Returns 0 if no
+// handle matches.
+func (c ipams) CountByHandlePrefix(prefix string) (int, error) {
+	infos, err := c.ListHandles()
+	if err != nil {
+		return 0, err
+	}
+	num := 0
+	for _, info := range infos {
+		if strings.HasPrefix(info.HandleID, prefix) {
+			num += info.NumIPs
+		}
+	}
+	return num, nil
+}
+
+// handleInfosByID sorts handle summaries by handle ID.
+type handleInfosByID []HandleInfo
+
+func (s handleInfosByID) Len() int           { return len(s) }
+func (s handleInfosByID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s handleInfosByID) Less(i, j int) bool { return s[i].HandleID < s[j].HandleID }
+
+// ReleaseByHandle releases all IP addresses that have been assigned
+// using the provided handle.
+func (c ipams) ReleaseByHandle(handleID string) error {
+	c = c.withRequestID("")
+	c, err := c.withIPAMConfig()
+	if err != nil {
+		return err
+	}
+	c.requestLog().Infof("Releasing all IPs with handle '%s'", handleID)
+	blocks, err := c.handleBlocks(handleID)
+	if err != nil {
+		return err
+	}
+	stale, err := c.releaseHandleBlocks(handleID, blocks)
+	if err != nil || !stale {
+		return err
+	}
+
+	// A block held a different number of the handle's addresses than the
+	// handle recorded, so the handle may be missing blocks too.  Rebuild its
+	// entry from the blocks and release whatever is left.
+	c.requestLog().WithField("handle", handleID).Warning("Handle index is stale, scanning all blocks for the handle's addresses")
+	if blocks, err = c.rebuildHandleEntry(handleID); err != nil {
+		return err
+	}
+	_, err = c.releaseHandleBlocks(handleID, blocks)
+	return err
+}
+
+// releaseHandleBlocks releases the handle's addresses in each of the given
+// blocks.  Returns whether any block released a different number of
+// addresses than the handle recorded for it, and the first error hit.
+func (c ipams) releaseHandleBlocks(handleID string, blocks map[string]int) (bool, error) {
+	// The handle is only deleted once its count for every block has been
+	// removed, so if any block fails to release, the handle still records
+	// that block and the release can be retried.
+	var firstErr error
+	stale := false
+	for blockStr, count := range blocks {
+		_, blockCIDR, _ := net.ParseCIDR(blockStr)
+		num, err := c.releaseByHandle(handleID, *blockCIDR)
+		if err != nil {
+			c.requestLog().WithFields(log.Fields{
+				"handle":    handleID,
+				"blockCIDR": blockStr,
+			}).WithError(err).Error("Error releasing addresses with handle")
+			if firstErr == nil {
+				firstErr = err
+			}
+		} else if num != count {
+			stale = true
+		}
+	}
+	return stale, firstErr
+}
+
+// releaseByHandle releases the addresses in the given block that were
+// assigned using the handle, and removes them from the handle.  If the block
+// is left empty and is not affine to a host it is deleted, as when releasing
+// addresses by IP.  Returns the number of addresses released.
+func (c ipams) releaseByHandle(handleID string, blockCIDR net.IPNet) (int, error) {
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return 0, err
+	}
+	deleteEmpty := !cfg.RetainEmptyBlocks
+	defer c.client.blockLocks.lockBlock(blockCIDR)()
+	retry := cfg.Retry.start()
+	for i := 0; i < retry.maxAttempts(); i++ {
+		if !c.blockReaderWriter.waitForRetry(retry, i, model.BlockKey{CIDR: blockCIDR}) {
+			break
+		}
+		obj, err := c.blockReaderWriter.getBlock(blockCIDR)
+		if err != nil {
+			if errors.IsNotExist(err) {
+				// Block doesn't exist, so all addresses are already
+				// unallocated.  This can happen when a handle is
+				// overestimating the number of assigned addresses.
+				return 0, c.setHandleBlockCount(handleID, blockCIDR, 0)
+			} else {
+				return 0, err
+			}
+		}
 		block := allocationBlock{obj.Value.(*model.AllocationBlock)}
 		num := block.releaseByHandle(handleID)
 		if num == 0 {
 			// Block has no addresses with this handle, so
 			// all addresses are already unallocated.
-			return nil
+			return 0, c.setHandleBlockCount(handleID, blockCIDR, 0)
 		}
 
-		if block.empty() && block.Affinity == nil {
-			err = c.client.Backend.Delete(&model.KVPair{
-				Key: model.BlockKey{blockCIDR},
-			})
-			if err != nil {
-				// Return the error unless the resource does not exist.
-				if _, ok := err.(errors.ErrorResourceDoesNotExist); !ok {
-					log.Errorf("Error deleting block: %s", err)
-					return err
-				}
-			}
-		} else {
-			// Compare and swap the AllocationBlock using the original
-			// KVPair read from before.  No need to update the Value since we
-			// have been directly manipulating the value referenced by the KVPair.
-			_, err = c.client.Backend.Update(obj)
-			if err != nil {
-				if _, ok := err.(errors.ErrorResourceUpdateConflict); ok {
-					// Comparison failed - retry.
-					log.Warningf("CAS error for block, retry #%d: %s", i, err)
-					continue
-				} else {
-					// Something else - return the error.
-					log.Errorf("Error updating block '%s': %s", block.CIDR.String(), err)
-					return err
-				}
+		// Compare and swap the AllocationBlock using the original KVPair
+		// read from before, deleting it if it is now empty.  No need to
+		// update the Value since we have been directly manipulating the
+		// value referenced by the KVPair.
+		err = c.blockReaderWriter.writeReleasedBlock(obj, deleteEmpty)
+		if err != nil {
+			if errors.IsRetryable(err) {
+				// Comparison failed - retry.
+				c.requestLog().Warningf("CAS error for block, retry #%d: %s", i, err)
+				continue
+			} else {
+				// Something else - return the error.
+				c.requestLog().Errorf("Error updating block '%s': %s", block.CIDR.String(), err)
+				return 0, err
 			}
 		}
 
-		c.decrementHandle(handleID, blockCIDR, num)
-		return nil
+		return num, c.decrementHandle(handleID, blockCIDR, num)
 	}
-	return goerrors.New("Hit max retries")
+	return 0, goerrors.New("Hit max retries")
 }
 
-func (c ipams) incrementHandle(handleID string, blockCIDR net.IPNet, num int) error {
+// incrementHandle adds num addresses from the block to the handle, creating
+// the handle if needed.  The host is recorded as the handle's owner if it
+// has none.  If UniqueHandles is enabled and the handle is owned by another
+// host, a handleInUseError is returned and the handle is not changed.
+func (c ipams) incrementHandle(handleID string, blockCIDR net.IPNet, num int, host string) error {
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return err
+	}
 	var obj *model.KVPair
-	var err error
-	for i := 0; i < ipamEtcdRetries; i++ {
+	unique := cfg.UniqueHandles
+	retry := cfg.Retry.start()
+	for i := 0; i < retry.maxAttempts(); i++ {
+		if !c.blockReaderWriter.waitForRetry(retry, i, model.IPAMHandleKey{HandleID: handleID}) {
+			break
+		}
 		obj, err = c.client.Backend.Get(model.IPAMHandleKey{HandleID: handleID})
 		if err != nil {
-			if _, ok := err.(errors.ErrorResourceDoesNotExist); ok {
+			if errors.IsNotExist(err) {
 				// Handle doesn't exist - create it.
-				log.Infof("Creating new handle: %s", handleID)
+				c.requestLog().Infof("Creating new handle: %s", handleID)
 				bh := model.IPAMHandle{
 					HandleID: handleID,
+					Owner:    host,
 					Block:    map[string]int{},
 				}
 				obj = &model.KVPair{
@@ -830,6 +2387,9 @@ func (c ipams) incrementHandle(handleID string, blockCIDR net.IPNet, num int) er
 
 		// Get the handle from the KVPair.
 		handle := allocationHandle{obj.Value.(*model.IPAMHandle)}
+		if err := handle.claimOwner(host, unique); err != nil {
+			return err
+		}
 
 		// Increment the handle for this block.
 		handle.incrementBlock(blockCIDR, num)
@@ -839,7 +2399,11 @@ func (c ipams) incrementHandle(handleID string, blockCIDR net.IPNet, num int) er
 		// apply the changes.
 		_, err = c.client.Backend.Apply(obj)
 		if err != nil {
-			continue
+			if errors.IsRetryable(err) {
+				continue
+			}
+			c.requestLog().Errorf("Error updating handle '%s': %s", handleID, err)
+			return err
 		}
 		return nil
 	}
@@ -847,67 +2411,544 @@ func (c ipams) incrementHandle(handleID string, blockCIDR net.IPNet, num int) er
 
 }
 
+// incrementHandleOp returns the transaction operation that adds num
+// addresses from the block to the handle, as incrementHandle does.  The
+// operation creates the handle if it does not exist, and otherwise updates
+// it with a compare-and-swap against the revision read here.
+func (c ipams) incrementHandleOp(handleID string, blockCIDR net.IPNet, num int, host string) (bapi.TxnOp, error) {
+	key := model.IPAMHandleKey{HandleID: handleID}
+	handle := allocationHandle{&model.IPAMHandle{HandleID: handleID, Block: map[string]int{}}}
+	op := bapi.TxnOp{Type: bapi.TxnCreate, KVPair: &model.KVPair{Key: key, Value: handle.IPAMHandle}}
+	obj, err := c.client.Backend.Get(key)
+	if err == nil {
+		// Update a copy of the handle, so that the handle we read is
+		// left as it was if the transaction fails.
+		existing := obj.Value.(*model.IPAMHandle)
+		handle.Owner = existing.Owner
+		for cidr, n := range existing.Block {
+			handle.Block[cidr] = n
+		}
+		op = bapi.TxnOp{Type: bapi.TxnUpdate, KVPair: &model.KVPair{Key: key, Value: handle.IPAMHandle, Revision: obj.Revision}}
+	} else if !errors.IsNotExist(err) {
+		return bapi.TxnOp{}, err
+	}
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return bapi.TxnOp{}, err
+	}
+	if err := handle.claimOwner(host, cfg.UniqueHandles); err != nil {
+		return bapi.TxnOp{}, err
+	}
+	handle.incrementBlock(blockCIDR, num)
+	return op, nil
+}
+
 func (c ipams) decrementHandle(handleID string, blockCIDR net.IPNet, num int) error {
-	for i := 0; i < ipamEtcdRetries; i++ {
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return err
+	}
+	retry := cfg.Retry.start()
+	for i := 0; i < retry.maxAttempts(); i++ {
+		if !c.blockReaderWriter.waitForRetry(retry, i, model.IPAMHandleKey{HandleID: handleID}) {
+			break
+		}
 		obj, err := c.client.Backend.Get(model.IPAMHandleKey{HandleID: handleID})
-		if err != nil {
-			log.Fatalf("Can't decrement block because it doesn't exist")
+		if err != nil && !errors.IsNotExist(err) {
+			return err
+		}
+		if err == nil {
+			_, err = allocationHandle{obj.Value.(*model.IPAMHandle)}.decrementBlock(blockCIDR, num)
 		}
-		handle := allocationHandle{obj.Value.(*model.IPAMHandle)}
-
-		_, err = handle.decrementBlock(blockCIDR, num)
 		if err != nil {
-			log.Fatalf("Can't decrement block - too few allocated")
+			// The handle's entry is missing or records too few addresses,
+			// so the index is stale.  The block has already been
+			// updated, so rebuild the entry from the blocks.
+			c.requestLog().WithField("handle", handleID).WithError(err).Warning("Handle index is stale, scanning all blocks for the handle's addresses")
+			_, err = c.rebuildHandleEntry(handleID)
+			return err
 		}
+		handle := allocationHandle{obj.Value.(*model.IPAMHandle)}
 
 		// Update / Delete as appropriate.  Since we have been manipulating the
 		// data in the KVPair, just pass this straight back to the client.
 		if handle.empty() {
-			log.Debugf("Deleting handle: %s", handleID)
+			c.requestLog().Debugf("Deleting handle: %s", handleID)
 			err = c.client.Backend.Delete(obj)
 		} else {
-			log.Debugf("Updating handle: %s", handleID)
+			c.requestLog().Debugf("Updating handle: %s", handleID)
 			_, err = c.client.Backend.Update(obj)
 		}
 
 		// Check error.
 		if err != nil {
-			continue
+			if errors.IsRetryable(err) {
+				continue
+			}
+			c.requestLog().Errorf("Error updating handle '%s': %s", handleID, err)
+			return err
 		}
-		log.Infof("Decremented handle '%s' by %d", handleID, num)
+		c.requestLog().Infof("Decremented handle '%s' by %d", handleID, num)
 		return nil
 	}
 	return goerrors.New("Max retries hit")
 }
 
+// UpdateHandle moves all of the addresses assigned with oldHandleID to
+// newHandleID, returning the number of addresses moved.  If newHandleID
+// already has addresses assigned, the moved addresses are added to them.
+//
+// Each block referenced by the old handle is rewritten before the handles'
+// per-block counts are set from the block itself, so running UpdateHandle
+// again after a failure part way through completes the move.  Addresses
+// assigned with oldHandleID while the move is in progress may not be moved.
+func (c ipams) UpdateHandle(oldHandleID, newHandleID string) (int, error) {
+	if oldHandleID == newHandleID {
+		return 0, nil
+	}
+	logContext := c.requestLog().WithFields(log.Fields{"oldHandle": oldHandleID, "newHandle": newHandleID})
+
+	obj, err := c.client.Backend.Get(model.IPAMHandleKey{HandleID: oldHandleID})
+	if err != nil {
+		if errors.IsNotExist(err) {
+			// Nothing is assigned with the old handle, so either it
+			// has already been moved or there is nothing to move.
+			logContext.Debug("Handle does not exist, nothing to update")
+			return 0, nil
+		}
+		return 0, err
+	}
+	handle := allocationHandle{obj.Value.(*model.IPAMHandle)}
+
+	updated := 0
+	for blockStr := range handle.Block {
+		_, blockCIDR, err := net.ParseCIDR(blockStr)
+		if err != nil {
+			logContext.WithField("block", blockStr).Warning("Handle references an invalid block CIDR")
+			continue
+		}
+
+		var num, total int
+		err = c.blockReaderWriter.updateWithRetry(model.BlockKey{CIDR: *blockCIDR}, func(obj *model.KVPair) error {
+			b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+			num = b.renameHandle(oldHandleID, newHandleID)
+			total = len(b.ipsByHandle(newHandleID))
+			if num == 0 {
+				return errSkipUpdate
+			}
+			return nil
+		})
+		if err != nil && !errors.IsNotExist(err) {
+			logContext.WithError(err).WithField("block", blockCIDR).Error("Error updating handle in block")
+			return updated, err
+		}
+		updated += num
+
+		// The block now holds the authoritative number of addresses for
+		// each handle, so set the counts rather than adjusting them.
+		if err := c.setHandleBlockCount(newHandleID, *blockCIDR, total); err != nil {
+			return updated, err
+		}
+		if err := c.setHandleBlockCount(oldHandleID, *blockCIDR, 0); err != nil {
+			return updated, err
+		}
+	}
+	logContext.WithField("updated", updated).Info("Updated handle")
+	return updated, nil
+}
+
+// ReassignHandle moves a single assigned address to newHandleID without
+// releasing it, so that no other assignment can take the address in between.
+// The address keeps its secondary attributes.  Returns a notAssignedError if
+// the address is not assigned.
+//
+// As when assigning, the new handle is incremented before the block is
+// updated and the old handle is decremented after, so a release racing with
+// the reassignment always finds the handle which the block records for the
+// address.
+func (c ipams) ReassignHandle(ip net.IP, newHandleID string) error {
+	if err := validateHandleID(newHandleID); err != nil {
+		return err
+	}
+	if err := c.blockReaderWriter.checkWithinPools(ip); err != nil {
+		return err
+	}
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return err
+	}
+	blockCIDR, err := c.blockReaderWriter.blockCIDRForAddress(ip, *cfg)
+	if err != nil {
+		return err
+	}
+	logContext := c.requestLog().WithFields(log.Fields{"ip": ip.String(), "newHandle": newHandleID})
+
+	if err := c.incrementHandle(newHandleID, blockCIDR, 1, ""); err != nil {
+		return err
+	}
+	var oldHandleID *string
+	unchanged := false
+	err = c.blockReaderWriter.updateWithRetry(model.BlockKey{CIDR: blockCIDR}, func(obj *model.KVPair) error {
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		attr, err := b.attributeForIP(ip)
+		if err != nil {
+			return err
+		}
+		if attr.AttrPrimary != nil && *attr.AttrPrimary == newHandleID {
+			unchanged = true
+			return errSkipUpdate
+		}
+		oldHandleID, err = b.reassignHandle(ip, newHandleID)
+		return err
+	})
+	if errors.IsNotExist(err) {
+		err = notAssignedError{IP: ip}
+	}
+	if err != nil || unchanged {
+		// The block was not changed, so undo the increment.
+		if decErr := c.decrementHandle(newHandleID, blockCIDR, 1); decErr != nil {
+			return decErr
+		}
+		if err != nil {
+			logContext.WithError(err).Debug("Address not reassigned")
+		}
+		return err
+	}
+	if oldHandleID != nil {
+		if err := c.decrementHandle(*oldHandleID, blockCIDR, 1); err != nil {
+			return err
+		}
+	}
+	logContext.Info("Reassigned address")
+	return nil
+}
+
+// checkAttributes returns a missingAttributesError if the attributes lack any
+// of the keys in the RequiredAttributes of the global IPAM configuration, or
+// an attributeTooLongError if any are required and a value is too long, so that
+// an assignment can fail before any addresses are assigned.
+func (c ipams) checkAttributes(attrs map[string]string) error {
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return err
+	}
+	required := cfg.RequiredAttributes
+	if len(required) == 0 {
+		return nil
+	}
+	missing := []string{}
+	for _, k := range required {
+		if _, ok := attrs[k]; !ok {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		return missingAttributesError{Missing: missing}
+	}
+	for k, v := range attrs {
+		if len(v) > maxAttributeValueLength {
+			return attributeTooLongError{Key: k, Length: len(v)}
+		}
+	}
+	return nil
+}
+
+// validateHandleID returns an invalidHandleIDError if the handle ID contains a
+// '/' or '%'.  Handles assigned before IDs were checked may still have such
+// IDs, and can still be read and released.
+func validateHandleID(handleID string) error {
+	if strings.ContainsAny(handleID, "/%") {
+		return invalidHandleIDError{HandleID: handleID}
+	}
+	return nil
+}
+
+// checkHandleOwner returns an invalidHandleIDError if the handle ID is not
+// valid, or a handleInUseError if UniqueHandles is enabled and the handle is
+// owned by a host other than the given host, so that an assignment can fail
+// before any addresses are assigned.
+func (c ipams) checkHandleOwner(handleID *string, host string) error {
+	if handleID == nil {
+		return nil
+	}
+	if err := validateHandleID(*handleID); err != nil {
+		return err
+	}
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return err
+	}
+	if !cfg.UniqueHandles {
+		return nil
+	}
+	obj, err := c.client.Backend.Get(model.IPAMHandleKey{HandleID: *handleID})
+	if err != nil {
+		if errors.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if owner := obj.Value.(*model.IPAMHandle).Owner; owner != "" && owner != host {
+		c.requestLog().WithFields(log.Fields{
+			"handle": *handleID,
+			"host":   host,
+			"owner":  owner,
+		}).Warning("Handle is in use by another host")
+		return handleInUseError{HandleID: *handleID, Owner: owner}
+	}
+	return nil
+}
+
+// setHandleBlockCount sets the number of addresses assigned to the handle from
+// the given block, creating the handle if needed and deleting it once it has
+// no addresses.
+func (c ipams) setHandleBlockCount(handleID string, blockCIDR net.IPNet, num int) error {
+	key := model.IPAMHandleKey{HandleID: handleID}
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return err
+	}
+	retry := cfg.Retry.start()
+	var lastErr error
+	for i := 0; i < retry.maxAttempts(); i++ {
+		if !c.blockReaderWriter.waitForRetry(retry, i, key) {
+			break
+		}
+		obj, err := c.client.Backend.Get(key)
+		create := false
+		if err != nil {
+			if !errors.IsNotExist(err) {
+				return err
+			} else if num == 0 {
+				// Nothing to remove.
+				return nil
+			}
+			create = true
+			obj = &model.KVPair{
+				Key:   key,
+				Value: &model.IPAMHandle{HandleID: handleID, Block: map[string]int{}},
+			}
+		}
+		handle := allocationHandle{obj.Value.(*model.IPAMHandle)}
+		handle.setBlock(blockCIDR, num)
+
+		switch {
+		case create:
+			_, err = c.client.Backend.Create(obj)
+		case handle.empty():
+			err = c.client.Backend.Delete(obj)
+		default:
+			_, err = c.client.Backend.Update(obj)
+		}
+		if err != nil {
+			if errors.IsRetryable(err) || (create && errors.IsAlreadyExists(err)) {
+				lastErr = err
+				continue
+			} else if !create && handle.empty() && errors.IsNotExist(err) {
+				return nil
+			}
+			c.requestLog().Errorf("Error updating handle '%s': %s", handleID, err)
+			return err
+		}
+		return nil
+	}
+	return maxRetriesError{Key: key, Err: lastErr}
+}
+
 // GetAssignmentAttributes returns the attributes stored with the given IP address
 // upon assignment.
 func (c ipams) GetAssignmentAttributes(addr net.IP) (map[string]string, error) {
-	blockCIDR := getBlockCIDRForAddress(addr)
-	obj, err := c.client.Backend.Get(model.BlockKey{blockCIDR})
+	attrs, _, err := c.getAssignmentAttributes(addr)
+	return attrs, err
+}
+
+// getAssignmentAttributes returns the attributes and the handle stored with
+// the given IP address upon assignment.  The handle is nil if the address was
+// assigned without one.  Returns a notAssignedError if the address is not
+// currently assigned.
+func (c ipams) getAssignmentAttributes(addr net.IP) (map[string]string, *string, error) {
+	if err := c.blockReaderWriter.checkWithinPools(addr); err != nil {
+		return nil, nil, err
+	}
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	blockCIDR, err := c.blockReaderWriter.blockCIDRForAddress(addr, *cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	obj, err := c.blockReaderWriter.getBlock(blockCIDR)
 	if err != nil {
-		log.Errorf("Error reading block %s: %s", blockCIDR, err)
-		return nil, goerrors.New(fmt.Sprintf("%s is not assigned", addr))
+		if errors.IsNotExist(err) {
+			c.requestLog().Debugf("Block %s does not exist", blockCIDR)
+			return nil, nil, notAssignedError{IP: addr}
+		}
+		c.requestLog().Errorf("Error reading block %s: %s", blockCIDR, err)
+		return nil, nil, err
 	}
 	block := allocationBlock{obj.Value.(*model.AllocationBlock)}
-	return block.attributesForIP(addr)
+	attr, err := block.attributeForIP(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return attr.AttrSecondary, attr.AttrPrimary, nil
 }
 
-// GetIPAMConfig returns the global IPAM configuration.  If no IPAM configuration
-// has been set, returns a default configuration with StrictAffinity disabled
-// and AutoAllocateBlocks enabled.
-func (c ipams) GetIPAMConfig() (*IPAMConfig, error) {
-	obj, err := c.client.Backend.Get(model.IPAMConfigKey{})
+// HostForIP returns the host whose affine block contains the given IP address,
+// which is the host that routes to the address.  Returns an empty host if
+// the block has no host affinity, for example because it is shared or its
+// affinity was released.  Like IsAssigned, the block is only read, never
+// created.  Returns a blockNotFoundError if the block does not exist, or a
+// notInAnyPoolError if no configured pool contains the address.
+func (c ipams) HostForIP(addr net.IP) (string, error) {
+	if err := c.blockReaderWriter.checkWithinPools(addr); err != nil {
+		return "", err
+	}
+	cfg, err := c.blockReaderWriter.ipamConfig()
 	if err != nil {
-		if _, ok := err.(errors.ErrorResourceDoesNotExist); ok {
-			// IPAMConfig has not been explicitly set.  Return
-			// a default IPAM configuration.
-			return &IPAMConfig{AutoAllocateBlocks: true, StrictAffinity: false}, nil
+		return "", err
+	}
+	blockCIDR, err := c.blockReaderWriter.blockCIDRForAddress(addr, *cfg)
+	if err != nil {
+		return "", err
+	}
+	obj, err := c.blockReaderWriter.getBlock(blockCIDR)
+	if err != nil {
+		if errors.IsNotExist(err) {
+			return "", blockNotFoundError{IP: addr, Block: blockCIDR}
 		}
-		log.Errorf("Error getting IPAMConfig: %s", err)
+		c.requestLog().Errorf("Error reading block %s: %s", blockCIDR, err)
+		return "", err
+	}
+	host, _ := blockAffinityHost(obj.Value.(*model.AllocationBlock))
+	return host, nil
+}
+
+// IsAssigned returns whether the given IP address is currently assigned, along
+// with the handle it was assigned with, which is nil if it was assigned without
+// one.  The block containing the address is only read, never created, so an
+// address whose block does not exist is not assigned.  Returns a
+// notInAnyPoolError if no configured pool contains the address.
+func (c ipams) IsAssigned(addr net.IP) (bool, *string, error) {
+	if err := c.blockReaderWriter.checkWithinPools(addr); err != nil {
+		return false, nil, err
+	}
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return false, nil, err
+	}
+	blockCIDR, err := c.blockReaderWriter.blockCIDRForAddress(addr, *cfg)
+	if err != nil {
+		return false, nil, err
+	}
+	obj, err := c.blockReaderWriter.getBlock(blockCIDR)
+	if err != nil {
+		if errors.IsNotExist(err) {
+			c.requestLog().Debugf("Block %s does not exist", blockCIDR)
+			return false, nil, nil
+		}
+		c.requestLog().Errorf("Error reading block %s: %s", blockCIDR, err)
+		return false, nil, err
+	}
+	block := allocationBlock{obj.Value.(*model.AllocationBlock)}
+	attr, err := block.attributeForIP(addr)
+	if _, ok := err.(notAssignedError); ok {
+		return false, nil, nil
+	} else if err != nil {
+		return false, nil, err
+	}
+	return true, attr.AttrPrimary, nil
+}
+
+// AssignedIPsForHost returns the IPs of the given version which are assigned
+// from blocks affine to the given host, sorted in ascending order.  Addresses
+// assigned to the host from non-affine blocks are not recorded against the
+// host, so if handleID is not nil all other blocks are also scanned for
+// addresses assigned with that handle.
+func (c ipams) AssignedIPsForHost(host string, version ipVersion, handleID *string) ([]net.IP, error) {
+	logContext := c.requestLog().WithFields(log.Fields{
+		"host":    host,
+		"version": version.Number,
+	})
+	affBlocks, err := c.blockReaderWriter.getAffineBlocks(host, version, nil)
+	if err != nil {
 		return nil, err
 	}
-	return c.convertBackendToIPAMConfig(obj.Value.(*model.IPAMConfig)), nil
+
+	ips := []net.IP{}
+	affine := map[string]bool{}
+	for _, blockCIDR := range affBlocks {
+		affine[blockCIDR.String()] = true
+		obj, err := c.blockReaderWriter.getBlock(blockCIDR)
+		if err != nil {
+			if errors.IsNotExist(err) {
+				// The affinity refers to a block which no longer exists.
+				logContext.WithField("blockCIDR", blockCIDR.String()).Debug("Affine block does not exist")
+				continue
+			}
+			logContext.WithField("blockCIDR", blockCIDR.String()).WithError(err).Error("Error reading block")
+			return nil, err
+		}
+		block := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		ips = append(ips, block.assignedIPs()...)
+	}
+
+	if handleID != nil {
+		kvps, err := c.blockReaderWriter.listAll(model.BlockListOptions{IPVersion: version.Number}, ipamListPageSize)
+		if err != nil {
+			if !errors.IsNotExist(err) {
+				logContext.WithError(err).Error("Error listing blocks")
+				return nil, err
+			}
+		}
+		for _, kvp := range kvps {
+			block := allocationBlock{kvp.Value.(*model.AllocationBlock)}
+			if !affine[block.CIDR.String()] {
+				ips = append(ips, block.ipsByHandle(*handleID)...)
+			}
+		}
+	}
+
+	sort.Sort(ipsByValue(ips))
+	return ips, nil
+}
+
+// ListAssignedIPs describes the IPs of the given version, across all blocks,
+// which are assigned with attributes containing every key/value pair in the
+// filter.  An empty filter returns every assigned IP.  The blocks are listed a
+// page at a time and the IPs are returned in block order.
+func (c ipams) ListAssignedIPs(version ipVersion, filter map[string]string) ([]AssignedIP, error) {
+	list := model.BlockListOptions{IPVersion: version.Number}
+	ips := []AssignedIP{}
+	token := ""
+	for {
+		page, next, err := c.client.Backend.ListPage(list, ipamListPageSize, token)
+		if err != nil {
+			if errors.IsNotExist(err) {
+				break
+			}
+			c.requestLog().WithField("version", version.Number).WithError(err).Error("Error listing blocks")
+			return nil, err
+		}
+		for _, kvp := range page {
+			block := allocationBlock{kvp.Value.(*model.AllocationBlock)}
+			ips = append(ips, block.assignedIPsMatching(filter)...)
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	c.describeEncap(ips)
+	return ips, nil
+}
+
+// GetIPAMConfig returns the global IPAM configuration.  If no IPAM configuration
+// has been set, returns a default configuration with StrictAffinity disabled
+// and AutoAllocateBlocks enabled.
+func (c ipams) GetIPAMConfig() (*IPAMConfig, error) {
+	return c.blockReaderWriter.getIPAMConfig()
 }
 
 // SetIPAMConfig sets global IPAM configuration.  This can only
@@ -918,27 +2959,99 @@ func (c ipams) SetIPAMConfig(cfg IPAMConfig) error {
 		return err
 	}
 
-	if *current == cfg {
+	if reflect.DeepEqual(*current, cfg) {
 		return nil
 	}
 
+	if cfg.Retry.MaxAttempts < 0 || cfg.Retry.BaseBackoff < 0 || cfg.Retry.MaxBackoff < 0 || cfg.Retry.Timeout < 0 {
+		return goerrors.New("'Retry' values must not be negative")
+	}
+	if cfg.Retry.Jitter < 0 || cfg.Retry.Jitter > 1 {
+		return goerrors.New("'Retry.Jitter' must be between 0 and 1")
+	}
+
+	switch cfg.AssignOrder {
+	case "", AssignOrderLowest, AssignOrderHighest, AssignOrderRandom:
+	default:
+		return fmt.Errorf("Unknown 'AssignOrder': %s", cfg.AssignOrder)
+	}
+
+	switch cfg.PoolDistribution {
+	case "", PoolDistributionSequential, PoolDistributionBalanced, PoolDistributionPriority:
+	default:
+		return fmt.Errorf("Unknown 'PoolDistribution': %s", cfg.PoolDistribution)
+	}
+
+	if cfg.EmptyBlockLinger < 0 {
+		return goerrors.New("'EmptyBlockLinger' must not be negative")
+	}
+	if cfg.BulkConcurrency < 0 || cfg.BulkConcurrency > maxBulkConcurrency {
+		return fmt.Errorf("'BulkConcurrency' must be between 0 and %d", maxBulkConcurrency)
+	}
+
+	// If only the mutable fields have changed, the new configuration can be
+	// written while allocations exist.
+	if reflect.DeepEqual(current.withMutableFields(cfg), cfg) {
+		return c.writeIPAMConfig(cfg)
+	}
+
 	if !cfg.StrictAffinity && !cfg.AutoAllocateBlocks {
 		return goerrors.New("Cannot disable 'StrictAffinity' and 'AutoAllocateBlocks' at the same time")
 	}
 
+	if cfg.MaxBlocksPerHost < 0 {
+		return goerrors.New("'MaxBlocksPerHost' must not be negative")
+	}
+
+	switch cfg.AssignmentStrategy {
+	case "", AssignmentStrategyRandom, AssignmentStrategySequential:
+	default:
+		return fmt.Errorf("Unknown 'AssignmentStrategy': %s", cfg.AssignmentStrategy)
+	}
+
+	if cfg.IPv4BlockSize != 0 && (cfg.IPv4BlockSize < 20 || cfg.IPv4BlockSize > 32) {
+		return invalidSizeError(fmt.Sprintf("'IPv4BlockSize' /%d must be between /20 and /32", cfg.IPv4BlockSize))
+	}
+	if cfg.IPv6BlockSize != 0 && (cfg.IPv6BlockSize < 116 || cfg.IPv6BlockSize > 128) {
+		return invalidSizeError(fmt.Sprintf("'IPv6BlockSize' /%d must be between /116 and /128", cfg.IPv6BlockSize))
+	}
+
 	allObjs, err := c.client.Backend.List(model.BlockListOptions{})
+	if err != nil {
+		return err
+	}
 	if len(allObjs) != 0 {
 		return goerrors.New("Cannot change IPAM config while allocations exist")
 	}
+	return c.writeIPAMConfig(cfg)
+}
 
-	// Write to datastore.
+// withMutableFields returns a copy of cfg with the fields which may be changed
+// while allocations exist, as listed on IPAMConfig, taken from other.
+func (cfg IPAMConfig) withMutableFields(other IPAMConfig) IPAMConfig {
+	cfg.Retry = other.Retry
+	cfg.RetainEmptyBlocks = other.RetainEmptyBlocks
+	cfg.EmptyBlockLinger = other.EmptyBlockLinger
+	cfg.UniqueHandles = other.UniqueHandles
+	cfg.RequiredAttributes = other.RequiredAttributes
+	cfg.AutoCreateDefaultPool = other.AutoCreateDefaultPool
+	cfg.DefaultPoolCIDR = other.DefaultPoolCIDR
+	cfg.AssignOrder = other.AssignOrder
+	cfg.PoolDistribution = other.PoolDistribution
+	cfg.DestructiveOpsAllowed = other.DestructiveOpsAllowed
+	cfg.BulkConcurrency = other.BulkConcurrency
+	return cfg
+}
+
+// writeIPAMConfig writes the global IPAM configuration to the datastore.
+func (c ipams) writeIPAMConfig(cfg IPAMConfig) error {
 	obj := model.KVPair{
 		Key:   model.IPAMConfigKey{},
 		Value: c.convertIPAMConfigToBackend(&cfg),
 	}
-	_, err = c.client.Backend.Apply(&obj)
+	_, err := c.client.Backend.Apply(&obj)
 	if err != nil {
-		log.Errorf("Error applying IPAMConfig: %s", err)
+		c.requestLog().Errorf("Error applying IPAMConfig: %s", err)
 		return err
 	}
 	return nil
@@ -946,15 +3059,63 @@ func (c ipams) SetIPAMConfig(cfg IPAMConfig) error {
 
 func (c ipams) convertIPAMConfigToBackend(cfg *IPAMConfig) *model.IPAMConfig {
 	return &model.IPAMConfig{
-		StrictAffinity:     cfg.StrictAffinity,
-		AutoAllocateBlocks: cfg.AutoAllocateBlocks,
+		StrictAffinity:        cfg.StrictAffinity,
+		AutoAllocateBlocks:    cfg.AutoAllocateBlocks,
+		MaxBlocksPerHost:      cfg.MaxBlocksPerHost,
+		AssignmentStrategy:    string(cfg.AssignmentStrategy),
+		AssignOrder:           string(cfg.AssignOrder),
+		PoolDistribution:      string(cfg.PoolDistribution),
+		RetryMaxAttempts:      cfg.Retry.MaxAttempts,
+		RetryBaseBackoff:      cfg.Retry.BaseBackoff,
+		RetryMaxBackoff:       cfg.Retry.MaxBackoff,
+		RetryJitter:           cfg.Retry.Jitter,
+		RetryTimeout:          cfg.Retry.Timeout,
+		RetainEmptyBlocks:     cfg.RetainEmptyBlocks,
+		UniqueHandles:         cfg.UniqueHandles,
+		RequiredAttributes:    cfg.RequiredAttributes,
+		IPv4BlockSize:         cfg.IPv4BlockSize,
+		IPv6BlockSize:         cfg.IPv6BlockSize,
+		AutoCreateDefaultPool: cfg.AutoCreateDefaultPool,
+		DefaultPoolCIDR:       cfg.DefaultPoolCIDR,
+		DestructiveOpsAllowed: cfg.DestructiveOpsAllowed,
+		BulkConcurrency:       cfg.BulkConcurrency,
+		EmptyBlockLinger:      cfg.EmptyBlockLinger,
 	}
 }
 
-func (c ipams) convertBackendToIPAMConfig(cfg *model.IPAMConfig) *IPAMConfig {
+// ipamConfigFromBackend returns the IPAMConfig from the backend IPAM
+// configuration.
+func ipamConfigFromBackend(cfg *model.IPAMConfig) *IPAMConfig {
 	return &IPAMConfig{
-		StrictAffinity:     cfg.StrictAffinity,
-		AutoAllocateBlocks: cfg.AutoAllocateBlocks,
+		StrictAffinity:        cfg.StrictAffinity,
+		AutoAllocateBlocks:    cfg.AutoAllocateBlocks,
+		MaxBlocksPerHost:      cfg.MaxBlocksPerHost,
+		AssignmentStrategy:    AssignmentStrategy(cfg.AssignmentStrategy),
+		AssignOrder:           AssignOrder(cfg.AssignOrder),
+		PoolDistribution:      PoolDistribution(cfg.PoolDistribution),
+		Retry:                 retryConfigFromBackend(cfg),
+		RetainEmptyBlocks:     cfg.RetainEmptyBlocks,
+		UniqueHandles:         cfg.UniqueHandles,
+		RequiredAttributes:    cfg.RequiredAttributes,
+		IPv4BlockSize:         cfg.IPv4BlockSize,
+		IPv6BlockSize:         cfg.IPv6BlockSize,
+		AutoCreateDefaultPool: cfg.AutoCreateDefaultPool,
+		DefaultPoolCIDR:       cfg.DefaultPoolCIDR,
+		DestructiveOpsAllowed: cfg.DestructiveOpsAllowed,
+		BulkConcurrency:       cfg.BulkConcurrency,
+		EmptyBlockLinger:      cfg.EmptyBlockLinger,
+	}
+}
+
+// retryConfigFromBackend returns the RetryConfig from the backend IPAM
+// configuration.
+func retryConfigFromBackend(cfg *model.IPAMConfig) RetryConfig {
+	return RetryConfig{
+		MaxAttempts: cfg.RetryMaxAttempts,
+		BaseBackoff: cfg.RetryBaseBackoff,
+		MaxBackoff:  cfg.RetryMaxBackoff,
+		Jitter:      cfg.RetryJitter,
+		Timeout:     cfg.RetryTimeout,
 	}
 }
 
@@ -0,0 +1,2008 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	goerrors "errors"
+	"math/big"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/fake"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+var _ = Describe("AssignFromBlock", func() {
+	subnet := cnet.MustParseNetwork("10.0.0.0/26")
+	handle := "handle-1"
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		ic = newIPAM(&Client{Backend: backend})
+		Expect(ic.blockReaderWriter.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+	})
+
+	setStrictAffinity := func(strict bool) {
+		backend.store(&model.KVPair{
+			Key:   model.IPAMConfigKey{},
+			Value: &model.IPAMConfig{StrictAffinity: strict, AutoAllocateBlocks: true},
+		})
+	}
+
+	It("should assign addresses from a block affine to the host", func() {
+		ips, err := ic.AssignFromBlock(subnet, 2, "host-a", &handle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(2))
+		for _, ip := range ips {
+			Expect(subnet.Contains(ip.IP)).To(BeTrue())
+		}
+
+		obj, err := backend.Get(model.BlockKey{CIDR: subnet})
+		Expect(err).NotTo(HaveOccurred())
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		Expect(b.ipsByHandle(handle)).To(Equal(ips))
+	})
+
+	It("should assign from a block affine to another host when overflow is allowed", func() {
+		setStrictAffinity(false)
+		ips, err := ic.AssignFromBlock(subnet, 1, "host-b", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+	})
+
+	It("should not assign from a block affine to another host with strict affinity", func() {
+		Expect(ic.SetBlockStrictAffinity(subnet, true)).To(Succeed())
+		_, err := ic.AssignFromBlock(subnet, 1, "host-b", nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should honor the block's strict affinity rather than the configuration", func() {
+		// Changing the configuration does not change the existing block.
+		setStrictAffinity(true)
+		ips, err := ic.AssignFromBlock(subnet, 1, "host-b", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+
+		// Until the block itself is updated.
+		Expect(ic.SetBlockStrictAffinity(subnet, true)).To(Succeed())
+		_, err = ic.AssignFromBlock(subnet, 1, "host-b", nil)
+		Expect(err).To(HaveOccurred())
+
+		// The host the block is affine to may still assign from it.
+		ips, err = ic.AssignFromBlock(subnet, 1, "host-a", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+
+		setStrictAffinity(false)
+		_, err = ic.AssignFromBlock(subnet, 1, "host-b", nil)
+		Expect(err).To(HaveOccurred())
+		Expect(ic.SetBlockStrictAffinity(subnet, false)).To(Succeed())
+		ips, err = ic.AssignFromBlock(subnet, 1, "host-b", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+	})
+
+	It("should not set strict affinity on a block with no affinity", func() {
+		Expect(ic.blockReaderWriter.releaseBlockAffinity("host-a", subnet)).To(Succeed())
+		backend.store(&model.KVPair{Key: model.BlockKey{CIDR: subnet}, Value: &model.AllocationBlock{CIDR: subnet}})
+		Expect(ic.SetBlockStrictAffinity(subnet, true)).To(Equal(blockNotAffineError{Block: subnet}))
+		Expect(ic.SetBlockStrictAffinity(subnet, false)).To(Succeed())
+	})
+
+	It("should assign in the configured order", func() {
+		backend.store(&model.KVPair{
+			Key:   model.IPAMConfigKey{},
+			Value: &model.IPAMConfig{AutoAllocateBlocks: true, AssignOrder: string(AssignOrderHighest)},
+		})
+		ips, err := ic.AssignFromBlock(subnet, 1, "host-a", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips[0].String()).To(Equal("10.0.0.63"))
+	})
+
+	It("should allow the assign order to be changed while allocations exist", func() {
+		_, err := ic.AssignFromBlock(subnet, 1, "host-a", nil)
+		Expect(err).NotTo(HaveOccurred())
+		cfg, err := ic.GetIPAMConfig()
+		Expect(err).NotTo(HaveOccurred())
+
+		cfg.AssignOrder = AssignOrderLowest
+		Expect(ic.SetIPAMConfig(*cfg)).To(Succeed())
+		cfg.AssignOrder = "middle"
+		Expect(ic.SetIPAMConfig(*cfg)).NotTo(Succeed())
+	})
+
+	It("should allow the pool distribution to be changed while allocations exist", func() {
+		_, err := ic.AssignFromBlock(subnet, 1, "host-a", nil)
+		Expect(err).NotTo(HaveOccurred())
+		cfg, err := ic.GetIPAMConfig()
+		Expect(err).NotTo(HaveOccurred())
+
+		cfg.PoolDistribution = PoolDistributionBalanced
+		Expect(ic.SetIPAMConfig(*cfg)).To(Succeed())
+		cfg, err = ic.GetIPAMConfig()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.PoolDistribution).To(Equal(PoolDistributionBalanced))
+
+		cfg.PoolDistribution = "round-robin"
+		Expect(ic.SetIPAMConfig(*cfg)).NotTo(Succeed())
+	})
+
+	It("should return the datastore error when the block does not exist", func() {
+		_, err := ic.AssignFromBlock(cnet.MustParseNetwork("10.0.0.64/26"), 1, "host-a", nil)
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+	})
+})
+
+var _ = Describe("assignFromAffineBlock", func() {
+	subnet := cnet.MustParseNetwork("10.0.0.0/26")
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		ic = newIPAM(&Client{Backend: backend})
+		backend.store(&model.KVPair{
+			Key:   model.IPAMConfigKey{},
+			Value: &model.IPAMConfig{StrictAffinity: true, AutoAllocateBlocks: true},
+		})
+	})
+
+	It("should create the block for a reserved affinity on first assignment", func() {
+		Expect(ic.blockReaderWriter.reserveBlockAffinity(subnet, "host-a")).To(Succeed())
+
+		ips, err := ic.assignFromAffineBlock(subnet, 2, nil, nil, "host-a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(2))
+
+		obj, err := backend.Get(model.BlockKey{CIDR: subnet})
+		Expect(err).NotTo(HaveOccurred())
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		Expect(hostAffinityMatches("host-a", b.AllocationBlock)).To(BeTrue())
+		Expect(b.StrictAffinity).To(BeTrue())
+		Expect(b.assignedIPs()).To(Equal(assignedIPs(ips)))
+	})
+
+	It("should assign from an existing affine block", func() {
+		Expect(ic.blockReaderWriter.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+		ips, err := ic.assignFromAffineBlock(subnet, 1, nil, nil, "host-a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+	})
+
+	It("should not assign from a block created by another host first", func() {
+		Expect(ic.blockReaderWriter.reserveBlockAffinity(subnet, "host-a")).To(Succeed())
+		Expect(ic.blockReaderWriter.claimBlockAffinity(subnet, "host-b", IPAMConfig{})).To(Succeed())
+
+		// The block exists, so the affinity check rejects the assignment.
+		ips, err := ic.assignFromAffineBlock(subnet, 1, nil, nil, "host-a")
+		Expect(err).To(HaveOccurred())
+		Expect(ips).To(BeEmpty())
+	})
+
+	It("should return every address assigned across several affine blocks", func() {
+		second := cnet.MustParseNetwork("10.0.0.64/26")
+		backend.storePool("10.0.0.0/25", false)
+		Expect(ic.blockReaderWriter.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+		Expect(ic.blockReaderWriter.claimBlockAffinity(second, "host-a", IPAMConfig{})).To(Succeed())
+		_, err := ic.assignFromAffineBlock(subnet, 60, nil, nil, "host-a")
+		Expect(err).NotTo(HaveOccurred())
+
+		// The first block has 4 addresses left, so the rest come from the
+		// second, and none of the first block's are lost.
+		ips, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 10, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(10))
+		assigned := 0
+		for _, cidr := range []cnet.IPNet{subnet, second} {
+			obj, err := backend.Get(model.BlockKey{CIDR: cidr})
+			Expect(err).NotTo(HaveOccurred())
+			assigned += len(allocationBlock{obj.Value.(*model.AllocationBlock)}.assignedIPs())
+		}
+		Expect(assigned).To(Equal(70))
+	})
+})
+
+var _ = Describe("partitionBlocks", func() {
+	blocks := []cnet.IPNet{
+		cnet.MustParseNetwork("10.0.0.0/26"),
+		cnet.MustParseNetwork("10.0.0.64/26"),
+		cnet.MustParseNetwork("10.0.0.128/26"),
+		cnet.MustParseNetwork("10.0.0.192/26"),
+	}
+
+	It("should give each host an equal contiguous share", func() {
+		Expect(partitionBlocks(blocks, []string{"host-b", "host-a"})).To(Equal(map[string][]cnet.IPNet{
+			"host-a": blocks[0:2],
+			"host-b": blocks[2:4],
+		}))
+	})
+
+	It("should give shares differing by at most one block", func() {
+		partitions := partitionBlocks(blocks, []string{"host-a", "host-b", "host-c"})
+		Expect(partitions["host-a"]).To(HaveLen(1))
+		Expect(partitions["host-b"]).To(HaveLen(1))
+		Expect(partitions["host-c"]).To(HaveLen(2))
+	})
+
+	It("should leave some hosts with no blocks when there are fewer blocks than hosts", func() {
+		partitions := partitionBlocks(blocks[:1], []string{"host-a", "host-b"})
+		Expect(partitions["host-a"]).To(BeEmpty())
+		Expect(partitions["host-b"]).To(Equal(blocks[:1]))
+	})
+})
+
+var _ = Describe("claimPartitions", func() {
+	blockA := cnet.MustParseNetwork("10.0.0.0/26")
+	blockB := cnet.MustParseNetwork("10.0.0.64/26")
+	partitions := map[string][]cnet.IPNet{
+		"host-a": {blockA},
+		"host-b": {blockB},
+		"host-c": {},
+	}
+
+	var ic *ipams
+
+	BeforeEach(func() {
+		ic = newIPAM(&Client{Backend: newFakeBlockBackend()})
+	})
+
+	It("should claim each block for its host", func() {
+		claimed, err := ic.claimPartitions(partitions, IPAMConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(claimed).To(Equal(map[string]int{"host-a": 1, "host-b": 1, "host-c": 0}))
+	})
+
+	It("should be idempotent", func() {
+		_, err := ic.claimPartitions(partitions, IPAMConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		claimed, err := ic.claimPartitions(partitions, IPAMConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(claimed).To(Equal(map[string]int{"host-a": 1, "host-b": 1, "host-c": 0}))
+	})
+
+	It("should skip blocks claimed by another host", func() {
+		Expect(ic.blockReaderWriter.claimBlockAffinity(blockB, "host-a", IPAMConfig{})).To(Succeed())
+		claimed, err := ic.claimPartitions(partitions, IPAMConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(claimed).To(Equal(map[string]int{"host-a": 1, "host-b": 0, "host-c": 0}))
+	})
+})
+
+var _ = Describe("ListAssignedIPs", func() {
+	handle := "handle-1"
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		ic = newIPAM(&Client{Backend: backend})
+		for _, cidr := range []string{"10.0.0.0/26", "10.0.0.64/26", "fd80:24e2:f998:72d6::/122"} {
+			b := newBlock(cnet.MustParseNetwork(cidr))
+			ip := ordinalToIP(b.CIDR, 1)
+			Expect(b.assign(ip, &handle, map[string]string{"namespace": cidr}, "host-a")).To(Succeed())
+			backend.store(&model.KVPair{Key: model.BlockKey{CIDR: b.CIDR}, Value: b.AllocationBlock})
+		}
+	})
+
+	It("should list the assigned IPs of the version across all blocks", func() {
+		ips, err := ic.ListAssignedIPs(ipv4, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(2))
+		for _, ip := range ips {
+			Expect(ip.IP.Version()).To(Equal(4))
+			Expect(ip.HandleID).To(Equal(&handle))
+		}
+	})
+
+	It("should only list the IPs matching the filter", func() {
+		ips, err := ic.ListAssignedIPs(ipv4, map[string]string{"namespace": "10.0.0.64/26"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+		Expect(ips[0].IP.String()).To(Equal("10.0.0.65"))
+		Expect(ips[0].Block.String()).To(Equal("10.0.0.64/26"))
+	})
+
+	It("should return no IPs when there are no blocks", func() {
+		ic = newIPAM(&Client{Backend: newFakeBlockBackend()})
+		ips, err := ic.ListAssignedIPs(ipv6, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(BeEmpty())
+	})
+})
+
+var _ = Describe("AssignedIPsForHost", func() {
+	affine := cnet.MustParseNetwork("10.0.0.0/26")
+	other := cnet.MustParseNetwork("10.0.0.64/26")
+	handle := "handle-1"
+
+	var i IPAMInterface
+
+	BeforeEach(func() {
+		backend := newFakeBlockBackend()
+		backend.storePool("10.0.0.0/25", false)
+		ic := newIPAM(&Client{Backend: backend})
+		i = ic
+		Expect(ic.blockReaderWriter.claimBlockAffinity(affine, "host-a", IPAMConfig{})).To(Succeed())
+		Expect(ic.blockReaderWriter.claimBlockAffinity(other, "host-b", IPAMConfig{})).To(Succeed())
+		for _, ip := range []string{"10.0.0.9", "10.0.0.2"} {
+			Expect(i.AssignIP(AssignIPArgs{IP: cnet.MustParseIP(ip), Hostname: "host-a"})).To(Succeed())
+		}
+		Expect(i.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.70"), HandleID: &handle, Hostname: "host-a"})).To(Succeed())
+	})
+
+	It("should return the addresses of the host's affine blocks in order", func() {
+		ips, err := i.AssignedIPsForHost("host-a", IPVersion4, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsToStrings(ips)).To(Equal([]string{"10.0.0.2", "10.0.0.9"}))
+	})
+
+	It("should also return the addresses of the handle in other blocks", func() {
+		ips, err := i.AssignedIPsForHost("host-a", IPVersion4, &handle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsToStrings(ips)).To(Equal([]string{"10.0.0.2", "10.0.0.9", "10.0.0.70"}))
+	})
+})
+
+var _ = Describe("DeletePoolBlocks", func() {
+	pool := cnet.MustParseNetwork("10.0.0.0/25")
+	blockA := cnet.MustParseNetwork("10.0.0.0/26")
+	blockB := cnet.MustParseNetwork("10.0.0.64/26")
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		ic = newIPAM(&Client{Backend: backend})
+		Expect(ic.blockReaderWriter.claimBlockAffinity(blockA, "host-a", IPAMConfig{})).To(Succeed())
+		Expect(ic.blockReaderWriter.claimBlockAffinity(blockB, "host-b", IPAMConfig{})).To(Succeed())
+	})
+
+	assign := func(blockCIDR cnet.IPNet) {
+		obj, err := backend.Get(model.BlockKey{CIDR: blockCIDR})
+		Expect(err).NotTo(HaveOccurred())
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		Expect(b.assign(cnet.IP{blockCIDR.IP}, nil, nil, "host-a")).To(Succeed())
+		_, err = backend.Update(obj)
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	expectDeleted := func(blockCIDR cnet.IPNet, host string) {
+		_, err := backend.Get(model.BlockKey{CIDR: blockCIDR})
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+		_, err = backend.Get(model.BlockAffinityKey{Host: host, CIDR: blockCIDR})
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+	}
+
+	It("should delete empty blocks and their affinities", func() {
+		Expect(ic.DeletePoolBlocks(pool, false)).To(Succeed())
+		expectDeleted(blockA, "host-a")
+		expectDeleted(blockB, "host-b")
+	})
+
+	It("should refuse to delete any blocks if a block is in use", func() {
+		assign(blockB)
+		err := ic.DeletePoolBlocks(pool, false)
+		Expect(err).To(Equal(blocksInUseError{Pool: pool, Blocks: []cnet.IPNet{blockB}}))
+
+		_, err = backend.Get(model.BlockKey{CIDR: blockA})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = backend.Get(model.BlockAffinityKey{Host: "host-a", CIDR: blockA})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should delete blocks in use when forced", func() {
+		backend.allowDestructiveOps()
+		assign(blockB)
+		Expect(ic.DeletePoolBlocks(pool, true)).To(Succeed())
+		expectDeleted(blockA, "host-a")
+		expectDeleted(blockB, "host-b")
+	})
+
+	It("should ignore blocks outside the pool", func() {
+		other := cnet.MustParseNetwork("10.0.0.128/26")
+		Expect(ic.blockReaderWriter.claimBlockAffinity(other, "host-a", IPAMConfig{})).To(Succeed())
+		Expect(ic.DeletePoolBlocks(pool, false)).To(Succeed())
+		_, err := backend.Get(model.BlockKey{CIDR: other})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should only delete the blocks claimed from the pool", func() {
+		// A block claimed from an overlapping pool is left alone even
+		// though the pool contains it.
+		backend.storePool("10.0.0.0/24", false)
+		other := cnet.MustParseNetwork("10.0.0.64/26")
+		Expect(ic.blockReaderWriter.releaseBlockAffinity("host-b", blockB)).To(Succeed())
+		Expect(ic.blockReaderWriter.claimBlockAffinity(other, "host-b", IPAMConfig{})).To(Succeed())
+
+		Expect(ic.DeletePoolBlocks(pool, false)).To(Succeed())
+		expectDeleted(blockA, "host-a")
+		_, err := backend.Get(model.BlockKey{CIDR: other})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(ic.DeletePoolBlocks(cnet.MustParseNetwork("10.0.0.0/24"), false)).To(Succeed())
+		expectDeleted(other, "host-b")
+	})
+})
+
+var _ = Describe("Block pool", func() {
+	It("should record the pool a block is claimed from", func() {
+		backend := newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		backend.storePool("10.0.0.0/16", false)
+		backend.storePool("10.1.0.0/24", false)
+		ic := newIPAM(&Client{Backend: backend})
+		_, _, err := ic.AutoAssign(AutoAssignArgs{
+			Num4:      1,
+			Hostname:  "host-a",
+			IPv4Pools: []cnet.IPNet{cnet.MustParseNetwork("10.1.0.0/24")},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		// An explicitly claimed block is recorded against the most
+		// specific pool that contains it.
+		Expect(ic.blockReaderWriter.claimBlockAffinity(cnet.MustParseNetwork("10.0.0.64/26"), "host-a", IPAMConfig{})).To(Succeed())
+		Expect(ic.blockReaderWriter.claimBlockAffinity(cnet.MustParseNetwork("10.0.1.0/26"), "host-a", IPAMConfig{})).To(Succeed())
+
+		pools := map[string]string{}
+		kvps, err := backend.List(model.BlockListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		for _, kvp := range kvps {
+			b := kvp.Value.(*model.AllocationBlock)
+			Expect(b.Pool).NotTo(BeNil())
+			pools[b.CIDR.String()] = b.Pool.String()
+		}
+		Expect(pools).To(HaveLen(3))
+		Expect(pools["10.0.0.64/26"]).To(Equal("10.0.0.0/24"))
+		Expect(pools["10.0.1.0/26"]).To(Equal("10.0.0.0/16"))
+		for cidr, pool := range pools {
+			if cidr != "10.0.0.64/26" && cidr != "10.0.1.0/26" {
+				Expect(pool).To(Equal("10.1.0.0/24"))
+			}
+		}
+	})
+
+	It("should not record a pool when no pool contains the block", func() {
+		backend := newFakeBlockBackend()
+		ic := newIPAM(&Client{Backend: backend})
+		subnet := cnet.MustParseNetwork("10.0.0.0/26")
+		Expect(ic.blockReaderWriter.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+		obj, err := backend.Get(model.BlockKey{CIDR: subnet})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.Value.(*model.AllocationBlock).Pool).To(BeNil())
+	})
+})
+
+var _ = Describe("autoAssignContiguous", func() {
+	subnet := cnet.MustParseNetwork("10.0.0.0/26")
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		ic = newIPAM(&Client{Backend: backend})
+		backend.store(&model.KVPair{
+			Key:   model.IPAMConfigKey{},
+			Value: &model.IPAMConfig{AutoAllocateBlocks: false},
+		})
+		Expect(ic.blockReaderWriter.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+	})
+
+	It("should assign a contiguous run from an affine block", func() {
+		assigned, err := ic.autoAssignContiguous(4, nil, nil, nil, ipv4, "host-a", "")
+		Expect(err).NotTo(HaveOccurred())
+		ips := assignedIPs(assigned)
+		Expect(ips).To(HaveLen(4))
+		for i := 1; i < len(ips); i++ {
+			Expect(ips[i].String()).To(Equal(incrementIP(ips[0], big.NewInt(int64(i))).String()))
+		}
+
+		// A run of a power of two addresses covers a single CIDR.
+		result := DualStackAssignResult{IPv4: ips}
+		v4nets, v6nets := result.IPNets()
+		Expect(v4nets).To(Equal([]cnet.IPNet{cnet.MustParseNetwork(ips[0].String() + "/30")}))
+		Expect(v6nets).To(BeEmpty())
+	})
+
+	It("should return a noContiguousRangeError rather than split the run", func() {
+		// Fragment the block so that only alternate addresses are free.
+		obj, err := backend.Get(model.BlockKey{CIDR: subnet})
+		Expect(err).NotTo(HaveOccurred())
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		for o := 0; o < 64; o += 2 {
+			Expect(b.assign(ordinalToIP(subnet, o), nil, nil, "host-a")).To(Succeed())
+		}
+		backend.store(obj)
+
+		_, err = ic.autoAssignContiguous(2, nil, nil, nil, ipv4, "host-a", "")
+		Expect(err).To(Equal(noContiguousRangeError{Num: 2}))
+
+		obj, err = backend.Get(model.BlockKey{CIDR: subnet})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(allocationBlock{obj.Value.(*model.AllocationBlock)}.numFreeAddresses()).To(Equal(32))
+	})
+
+	It("should not claim a block when the run is larger than a block", func() {
+		backend.storePool("10.0.0.0/24", false)
+		backend.store(&model.KVPair{Key: model.IPAMConfigKey{}, Value: &model.IPAMConfig{AutoAllocateBlocks: true}})
+
+		_, err := ic.autoAssignContiguous(65, nil, nil, nil, ipv4, "host-a", "")
+		Expect(err).To(Equal(noContiguousRangeError{Num: 65}))
+		blocks, err := ic.blockReaderWriter.getAffineBlocks("host-a", ipv4, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(blocks).To(Equal([]cnet.IPNet{subnet}))
+	})
+
+	It("should release a claimed block which can't hold the run", func() {
+		// The pool's only block has no four aligned addresses free.
+		pool := cnet.MustParseNetwork("10.1.0.0/29")
+		backend.storePoolWithReservedAddresses(pool.String(), "10.1.0.3", "10.1.0.5")
+		backend.store(&model.KVPair{Key: model.IPAMConfigKey{}, Value: &model.IPAMConfig{AutoAllocateBlocks: true}})
+
+		_, err := ic.autoAssignContiguous(4, nil, nil, []cnet.IPNet{pool}, ipv4, "host-a", "")
+		Expect(err).To(Equal(noContiguousRangeError{Num: 4}))
+		_, err = backend.Get(model.BlockAffinityKey{Host: "host-a", CIDR: pool})
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+		_, err = backend.Get(model.BlockKey{CIDR: pool})
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should return a datastore error as it is", func() {
+		key := model.BlockKey{CIDR: subnet}
+		injected := errors.ErrorDatastoreError{Err: goerrors.New("injected failure"), Identifier: key}
+		backend.InjectError(fake.OperationUpdate, key, injected, 0)
+
+		_, err := ic.autoAssignContiguous(4, nil, nil, nil, ipv4, "host-a", "")
+		Expect(err).To(Equal(injected))
+	})
+})
+
+var _ = Describe("claimBlockAndAssign", func() {
+	pool := cnet.MustParseNetwork("10.0.0.0/24")
+	subnet := cnet.MustParseNetwork("10.0.0.0/26")
+	handle := "handle-a"
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool(pool.String(), false)
+		ic = newIPAM(&Client{Backend: backend})
+	})
+
+	exists := func(key model.Key) bool {
+		_, err := backend.Get(key)
+		if errors.IsNotExist(err) {
+			return false
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return true
+	}
+
+	expectAssigned := func(num int) {
+		obj, err := backend.Get(model.BlockKey{CIDR: subnet})
+		Expect(err).NotTo(HaveOccurred())
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		Expect(b.numFreeAddresses()).To(Equal(64 - num))
+		Expect(hostAffinityMatches("host-a", b.AllocationBlock)).To(BeTrue())
+		Expect(exists(model.BlockAffinityKey{Host: "host-a", CIDR: subnet})).To(BeTrue())
+		ips, err := ic.IPsByHandle(handle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(num))
+	}
+
+	It("should claim the block and assign an address", func() {
+		ips, err := ic.claimBlockAndAssign(subnet, &pool, &handle, nil, "host-a", IPAMConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsToStrings(assignedIPs(ips))).To(Equal([]string{"10.0.0.0"}))
+		expectAssigned(1)
+	})
+
+	It("should write nothing if the transaction fails", func() {
+		key := model.BlockKey{CIDR: subnet}
+		backend.InjectError(fake.OperationCreate, key, errors.ErrorDatastoreError{Err: goerrors.New("injected failure"), Identifier: key}, 0)
+		_, err := ic.claimBlockAndAssign(subnet, &pool, &handle, nil, "host-a", IPAMConfig{})
+		Expect(err).To(HaveOccurred())
+		Expect(exists(model.BlockKey{CIDR: subnet})).To(BeFalse())
+		Expect(exists(model.BlockAffinityKey{Host: "host-a", CIDR: subnet})).To(BeFalse())
+		Expect(exists(model.IPAMHandleKey{HandleID: handle})).To(BeFalse())
+	})
+
+	It("should claim the block and assign in turn if the datastore can't do transactions", func() {
+		nonAtomic := &nonAtomicBackend{fakeBlockBackend: backend}
+		ic.client.Backend = nonAtomic
+		ips, err := ic.claimBlockAndAssign(subnet, &pool, &handle, nil, "host-a", IPAMConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+		Expect(nonAtomic.txns).To(BeNumerically(">", 0))
+		expectAssigned(1)
+	})
+
+	It("should assign from the block if it is already affine to the host", func() {
+		_, err := ic.claimBlockAndAssign(subnet, &pool, &handle, nil, "host-a", IPAMConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		ips, err := ic.claimBlockAndAssign(subnet, &pool, &handle, nil, "host-a", IPAMConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsToStrings(assignedIPs(ips))).To(Equal([]string{"10.0.0.1"}))
+		expectAssigned(2)
+	})
+
+	It("should not assign from a block claimed by another host", func() {
+		Expect(ic.blockReaderWriter.claimBlockAffinity(subnet, "host-b", IPAMConfig{StrictAffinity: true})).To(Succeed())
+		_, err := ic.claimBlockAndAssign(subnet, &pool, &handle, nil, "host-a", IPAMConfig{})
+		Expect(err).To(BeAssignableToTypeOf(affinityClaimedError{}))
+		Expect(exists(model.BlockAffinityKey{Host: "host-a", CIDR: subnet})).To(BeFalse())
+		Expect(exists(model.IPAMHandleKey{HandleID: handle})).To(BeFalse())
+	})
+
+	It("should be used by AutoAssign for a single address from a new block", func() {
+		nonAtomic := &nonAtomicBackend{fakeBlockBackend: backend}
+		ic.client.Backend = nonAtomic
+		_, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, HandleID: &handle, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(nonAtomic.txns).To(Equal(1))
+		expectAssigned(1)
+	})
+})
+
+var _ = Describe("FreeIPsInPool", func() {
+	pool := cnet.MustParseNetwork("10.0.0.0/25")
+	blockA := cnet.MustParseNetwork("10.0.0.0/26")
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		ic = newIPAM(&Client{Backend: backend})
+		Expect(ic.blockReaderWriter.claimBlockAffinity(blockA, "host-a", IPAMConfig{})).To(Succeed())
+
+		// Assign every address in the first block except the last two.
+		obj, err := backend.Get(model.BlockKey{CIDR: blockA})
+		Expect(err).NotTo(HaveOccurred())
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		for o := 0; o < 62; o++ {
+			Expect(b.assign(ordinalToIP(blockA, o), nil, nil, "host-a")).To(Succeed())
+		}
+		backend.store(obj)
+	})
+
+	It("should return free IPs in ascending order, treating missing blocks as free", func() {
+		ips, err := ic.FreeIPsInPool(pool, 4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsToStrings(ips)).To(Equal([]string{"10.0.0.62", "10.0.0.63", "10.0.0.64", "10.0.0.65"}))
+	})
+
+	It("should return every free IP when the limit is not reached", func() {
+		ips, err := ic.FreeIPsInPool(pool, 1000)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(66))
+		Expect(ips[65].String()).To(Equal("10.0.0.127"))
+	})
+
+	It("should stop at the limit in a large IPv6 pool", func() {
+		ips, err := ic.FreeIPsInPool(cnet.MustParseNetwork("fd80:24e2:f998:72d6::/64"), 3)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsToStrings(ips)).To(Equal([]string{"fd80:24e2:f998:72d6::", "fd80:24e2:f998:72d6::1", "fd80:24e2:f998:72d6::2"}))
+	})
+})
+
+var _ = Describe("autoAssignDualStack", func() {
+	v4Block := cnet.MustParseNetwork("10.0.0.0/26")
+	pools := []api.IPPool{
+		testPool("10.0.0.0/24", false),
+		testPool("fd80:24e2:f998:72d6::/120", false),
+	}
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		ic = newIPAM(&Client{Backend: backend})
+
+		// Only the existing affine blocks may be used, and the host only
+		// has an IPv4 block.
+		backend.store(&model.KVPair{
+			Key:   model.IPAMConfigKey{},
+			Value: &model.IPAMConfig{StrictAffinity: true, AutoAllocateBlocks: false},
+		})
+		Expect(ic.blockReaderWriter.claimBlockAffinity(v4Block, "host-a", IPAMConfig{})).To(Succeed())
+	})
+
+	It("should keep the IPv4 addresses when IPv6 assignment fails", func() {
+		result := ic.autoAssignDualStack(AutoAssignArgs{Num4: 1, Num6: 1, Hostname: "host-a"}, pools)
+		Expect(result.IPv4Error).NotTo(HaveOccurred())
+		Expect(result.IPv4).To(HaveLen(1))
+		Expect(v4Block.Contains(result.IPv4[0].IP)).To(BeTrue())
+		Expect(result.IPv6Error).To(BeAssignableToTypeOf(strictAffinityExhaustedError{}))
+		Expect(result.IPv6).To(BeEmpty())
+	})
+
+	It("should report an error when there are no enabled pools of a version", func() {
+		result := ic.autoAssignDualStack(AutoAssignArgs{Num4: 1, Num6: 1, Hostname: "host-a"}, pools[:1])
+		Expect(result.IPv4).To(HaveLen(1))
+		Expect(result.IPv6Error).To(Equal(noFreeBlocksError("No enabled IPv6 pools")))
+	})
+
+	It("should reject requested pools of the wrong version", func() {
+		args := AutoAssignArgs{Num4: 1, Hostname: "host-a", IPv4Pools: []cnet.IPNet{pools[1].Metadata.CIDR}}
+		result := ic.autoAssignDualStack(args, pools)
+		Expect(result.IPv4Error).To(HaveOccurred())
+		Expect(result.IPv4).To(BeEmpty())
+	})
+
+	It("should not assign addresses of a version that are not requested", func() {
+		result := ic.autoAssignDualStack(AutoAssignArgs{Num4: 2, Hostname: "host-a"}, pools)
+		Expect(result.IPv4).To(HaveLen(2))
+		Expect(result.IPv6).To(BeNil())
+		Expect(result.IPv6Error).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("IPsByHandle", func() {
+	v4Block := cnet.MustParseNetwork("10.0.0.0/26")
+	v6Block := cnet.MustParseNetwork("fd80:24e2:f998:72d6::/122")
+	handle := "handle-1"
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+	var assigned []string
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		ic = newIPAM(&Client{Backend: backend})
+		assigned = []string{}
+		for _, b := range []cnet.IPNet{v4Block, v6Block} {
+			Expect(ic.blockReaderWriter.claimBlockAffinity(b, "host-a", IPAMConfig{})).To(Succeed())
+			ips, err := ic.AssignFromBlock(b, 2, "host-a", &handle)
+			Expect(err).NotTo(HaveOccurred())
+			assigned = append(assigned, ipsToStrings(ips)...)
+		}
+		other := "handle-2"
+		_, err := ic.AssignFromBlock(v4Block, 1, "host-a", &other)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should return the IPv4 and IPv6 addresses of the handle", func() {
+		ips, err := ic.IPsByHandle(handle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsToStrings(ips)).To(ConsistOf(assigned))
+	})
+
+	It("should scan the blocks when the handle does not exist", func() {
+		Expect(backend.Delete(&model.KVPair{Key: model.IPAMHandleKey{HandleID: handle}})).To(Succeed())
+		ips, err := ic.IPsByHandle(handle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsToStrings(ips)).To(ConsistOf(assigned))
+	})
+
+	It("should return the datastore error for a handle with no addresses", func() {
+		_, err := ic.IPsByHandle("handle-3")
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+})
+
+var _ = Describe("Strict affinity exhaustion", func() {
+	subnet := cnet.MustParseNetwork("10.0.0.0/30")
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePoolWithBlockSize("10.0.0.0/30", 30)
+		ic = newIPAM(&Client{Backend: backend})
+	})
+
+	It("should fail with a distinct error once the pool has no free blocks", func() {
+		Expect(ic.SetIPAMConfig(IPAMConfig{StrictAffinity: true, AutoAllocateBlocks: true})).To(Succeed())
+
+		// Another host owns the only block, so host-a can't claim one.
+		Expect(ic.blockReaderWriter.claimBlockAffinity(subnet, "host-b", IPAMConfig{StrictAffinity: true})).To(Succeed())
+		v4, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, Hostname: "host-a"})
+		Expect(err).To(Equal(strictAffinityExhaustedError{Host: "host-a", Version: 4, Requested: 1, Assigned: 0}))
+		Expect(v4).To(BeEmpty())
+	})
+
+	It("should return the addresses assigned from affine blocks", func() {
+		Expect(ic.SetIPAMConfig(IPAMConfig{StrictAffinity: true, AutoAllocateBlocks: true})).To(Succeed())
+		v4, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 5, Hostname: "host-a"})
+		Expect(err).To(Equal(strictAffinityExhaustedError{Host: "host-a", Version: 4, Requested: 5, Assigned: 4}))
+		Expect(v4).To(HaveLen(4))
+		for _, ip := range v4 {
+			Expect(subnet.Contains(ip.IP)).To(BeTrue())
+		}
+	})
+
+	It("should overflow into non-affine blocks without strict affinity", func() {
+		Expect(ic.blockReaderWriter.claimBlockAffinity(subnet, "host-b", IPAMConfig{})).To(Succeed())
+		v4, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v4).To(HaveLen(1))
+	})
+
+	It("should only overflow into a non-affine block while the block allows it", func() {
+		Expect(ic.blockReaderWriter.claimBlockAffinity(subnet, "host-b", IPAMConfig{})).To(Succeed())
+		Expect(ic.SetBlockStrictAffinity(subnet, true)).To(Succeed())
+		v4, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v4).To(BeEmpty())
+
+		Expect(ic.SetBlockStrictAffinity(subnet, false)).To(Succeed())
+		v4, _, err = ic.AutoAssign(AutoAssignArgs{Num4: 1, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v4).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("Balanced pool distribution", func() {
+	poolA := cnet.MustParseNetwork("10.0.0.0/26")
+	poolB := cnet.MustParseNetwork("10.1.0.0/26")
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	assign := func(num int, host string, pools ...cnet.IPNet) []cnet.IP {
+		v4, _, err := ic.AutoAssign(AutoAssignArgs{Num4: num, Hostname: host, IPv4Pools: pools})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v4).To(HaveLen(num))
+		return v4
+	}
+
+	freeBlocks := func(pool cnet.IPNet) int {
+		blocks, err := ic.blockReaderWriter.existingBlocks(pool)
+		Expect(err).NotTo(HaveOccurred())
+		return 8 - len(blocks)
+	}
+
+	BeforeEach(func() {
+		// Two pools of eight blocks each.
+		backend = newFakeBlockBackend()
+		backend.storePoolWithBlockSize(poolA.String(), 29)
+		backend.storePoolWithBlockSize(poolB.String(), 29)
+		ic = newIPAM(&Client{Backend: backend})
+		Expect(ic.SetIPAMConfig(IPAMConfig{AutoAllocateBlocks: true, PoolDistribution: PoolDistributionBalanced})).To(Succeed())
+
+		// Another host fills four of pool A's blocks.
+		assign(32, "host-b", poolA)
+		Expect(freeBlocks(poolA)).To(Equal(4))
+		Expect(freeBlocks(poolB)).To(Equal(8))
+	})
+
+	It("should claim blocks in the emptier pool until the pools are equally full", func() {
+		// Each assignment fills the block it claims.
+		for i := 0; i < 4; i++ {
+			for _, ip := range assign(8, "host-a") {
+				Expect(poolB.Contains(ip.IP)).To(BeTrue(), "assignment %d was %s", i, ip)
+			}
+		}
+		Expect(freeBlocks(poolA)).To(Equal(4))
+		Expect(freeBlocks(poolB)).To(Equal(4))
+
+		// With the pools equally full, the lower pool comes first.
+		ip := assign(1, "host-a")[0]
+		Expect(poolA.Contains(ip.IP)).To(BeTrue())
+	})
+
+	It("should assign from affine blocks before claiming in the emptier pool", func() {
+		ip := assign(1, "host-a", poolA)[0]
+		Expect(poolA.Contains(ip.IP)).To(BeTrue())
+		ip = assign(1, "host-a")[0]
+		Expect(poolA.Contains(ip.IP)).To(BeTrue())
+		Expect(freeBlocks(poolB)).To(Equal(8))
+	})
+
+	It("should not list the blocks when assigning from affine blocks", func() {
+		assign(1, "host-a")
+		counting := &blockListCountingBackend{fakeBlockBackend: backend}
+		ic = newIPAM(&Client{Backend: counting})
+		assign(1, "host-a")
+		Expect(counting.blockLists).To(BeZero())
+	})
+})
+
+var _ = Describe("Reserved blocks", func() {
+	subnet := cnet.MustParseNetwork("10.0.0.0/26")
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		ic = newIPAM(&Client{Backend: backend})
+		backend.store(&model.KVPair{
+			Key:   model.IPAMConfigKey{},
+			Value: &model.IPAMConfig{StrictAffinity: true, AutoAllocateBlocks: false},
+		})
+		Expect(ic.blockReaderWriter.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+		Expect(ic.ReserveBlock(subnet)).To(Succeed())
+	})
+
+	reserved := func() bool {
+		obj, err := backend.Get(model.BlockKey{CIDR: subnet})
+		Expect(err).NotTo(HaveOccurred())
+		return obj.Value.(*model.AllocationBlock).Reserved
+	}
+
+	It("should set and clear the reservation", func() {
+		Expect(reserved()).To(BeTrue())
+		Expect(ic.UnreserveBlock(subnet)).To(Succeed())
+		Expect(reserved()).To(BeFalse())
+	})
+
+	It("should not auto-assign from a reserved affine block", func() {
+		ips, err := ic.autoAssign(1, nil, nil, nil, ipv4, "host-a", "")
+		Expect(err).To(BeAssignableToTypeOf(strictAffinityExhaustedError{}))
+		Expect(ips).To(BeEmpty())
+
+		Expect(ic.UnreserveBlock(subnet)).To(Succeed())
+		ips, err = ic.autoAssign(1, nil, nil, nil, ipv4, "host-a", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+	})
+
+	It("should allow explicit assignment from a reserved block", func() {
+		ips, err := ic.AssignFromBlock(subnet, 2, "host-a", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(2))
+	})
+
+	It("should keep a reserved block when its affinity is released", func() {
+		Expect(ic.blockReaderWriter.releaseBlockAffinity("host-a", subnet)).To(Succeed())
+		Expect(reserved()).To(BeTrue())
+	})
+
+	It("should return an error when the block does not exist", func() {
+		err := ic.ReserveBlock(cnet.MustParseNetwork("10.0.0.64/26"))
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+})
+
+var _ = Describe("UpdateHandle", func() {
+	blockA := cnet.MustParseNetwork("10.0.0.0/26")
+	blockB := cnet.MustParseNetwork("10.0.0.64/26")
+	oldHandle := "handle-old"
+	newHandle := "handle-new"
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		ic = newIPAM(&Client{Backend: backend})
+		for _, b := range []cnet.IPNet{blockA, blockB} {
+			Expect(ic.blockReaderWriter.claimBlockAffinity(b, "host-a", IPAMConfig{})).To(Succeed())
+			_, err := ic.AssignFromBlock(b, 2, "host-a", &oldHandle)
+			Expect(err).NotTo(HaveOccurred())
+		}
+	})
+
+	handleBlocks := func(handleID string) map[string]int {
+		obj, err := backend.Get(model.IPAMHandleKey{HandleID: handleID})
+		if errors.IsNotExist(err) {
+			return nil
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return obj.Value.(*model.IPAMHandle).Block
+	}
+
+	It("should move the addresses and the handle's blocks to the new handle", func() {
+		ips, err := ic.IPsByHandle(oldHandle)
+		Expect(err).NotTo(HaveOccurred())
+
+		num, err := ic.UpdateHandle(oldHandle, newHandle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(num).To(Equal(4))
+
+		Expect(handleBlocks(oldHandle)).To(BeNil())
+		Expect(handleBlocks(newHandle)).To(Equal(map[string]int{
+			blockA.String(): 2,
+			blockB.String(): 2,
+		}))
+		moved, err := ic.IPsByHandle(newHandle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(moved).To(ConsistOf(ips))
+	})
+
+	It("should merge the addresses into an existing new handle", func() {
+		_, err := ic.AssignFromBlock(blockA, 1, "host-a", &newHandle)
+		Expect(err).NotTo(HaveOccurred())
+
+		num, err := ic.UpdateHandle(oldHandle, newHandle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(num).To(Equal(4))
+		Expect(handleBlocks(newHandle)).To(Equal(map[string]int{
+			blockA.String(): 3,
+			blockB.String(): 2,
+		}))
+	})
+
+	It("should be idempotent", func() {
+		_, err := ic.UpdateHandle(oldHandle, newHandle)
+		Expect(err).NotTo(HaveOccurred())
+
+		num, err := ic.UpdateHandle(oldHandle, newHandle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(num).To(Equal(0))
+		Expect(handleBlocks(newHandle)).To(HaveLen(2))
+	})
+
+	It("should complete an update which failed after rewriting some blocks", func() {
+		// Rewrite one block without updating the handles, as if the
+		// update failed part way through.
+		obj, err := backend.Get(model.BlockKey{CIDR: blockA})
+		Expect(err).NotTo(HaveOccurred())
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		Expect(b.renameHandle(oldHandle, newHandle)).To(Equal(2))
+		backend.store(&model.KVPair{Key: obj.Key, Value: b.AllocationBlock})
+
+		num, err := ic.UpdateHandle(oldHandle, newHandle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(num).To(Equal(2))
+
+		Expect(handleBlocks(oldHandle)).To(BeNil())
+		Expect(handleBlocks(newHandle)).To(Equal(map[string]int{
+			blockA.String(): 2,
+			blockB.String(): 2,
+		}))
+	})
+})
+
+var _ = Describe("reassignHandle", func() {
+	ip := cnet.MustParseIP("10.0.0.1")
+	oldHandle := "handle-old"
+	newHandle := "handle-new"
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+		attrs := map[string]string{"pod": "pod-1"}
+		Expect(ic.AssignIP(AssignIPArgs{IP: ip, HandleID: &oldHandle, Attrs: attrs, Hostname: "host-a"})).To(Succeed())
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.2"), HandleID: &oldHandle, Hostname: "host-a"})).To(Succeed())
+	})
+
+	handleExists := func(handleID string) bool {
+		_, err := ic.client.Backend.Get(model.IPAMHandleKey{HandleID: handleID})
+		if errors.IsNotExist(err) {
+			return false
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return true
+	}
+
+	It("should move the address to the new handle and keep its attributes", func() {
+		Expect(ic.ReassignHandle(ip, newHandle)).To(Succeed())
+
+		ips, err := ic.IPsByHandle(newHandle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+		Expect(ips[0].String()).To(Equal("10.0.0.1"))
+		ips, err = ic.IPsByHandle(oldHandle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+		Expect(ips[0].String()).To(Equal("10.0.0.2"))
+
+		attrs, handle, err := ic.getAssignmentAttributes(ip)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(attrs).To(Equal(map[string]string{"pod": "pod-1"}))
+		Expect(*handle).To(Equal(newHandle))
+	})
+
+	It("should delete the old handle once it has no addresses", func() {
+		Expect(ic.ReassignHandle(ip, newHandle)).To(Succeed())
+		Expect(ic.ReassignHandle(cnet.MustParseIP("10.0.0.2"), newHandle)).To(Succeed())
+		Expect(handleExists(oldHandle)).To(BeFalse())
+
+		// Reassigning to the same handle changes nothing.
+		Expect(ic.ReassignHandle(ip, newHandle)).To(Succeed())
+		ips, err := ic.IPsByHandle(newHandle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(2))
+	})
+
+	It("should return a notAssignedError for an unassigned address", func() {
+		err := ic.ReassignHandle(cnet.MustParseIP("10.0.0.3"), newHandle)
+		Expect(err).To(Equal(notAssignedError{IP: cnet.MustParseIP("10.0.0.3")}))
+		err = ic.ReassignHandle(cnet.MustParseIP("10.0.0.200"), newHandle)
+		Expect(err).To(Equal(notAssignedError{IP: cnet.MustParseIP("10.0.0.200")}))
+		Expect(handleExists(newHandle)).To(BeFalse())
+	})
+
+	It("should leave the handles consistent when racing a release", func() {
+		Expect(ic.ReleaseByHandle(oldHandle)).To(Succeed())
+		for i := 0; i < 20; i++ {
+			Expect(ic.AssignIP(AssignIPArgs{IP: ip, HandleID: &oldHandle, Hostname: "host-a"})).To(Succeed())
+
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				err := ic.ReassignHandle(ip, newHandle)
+				if err != nil {
+					Expect(err).To(Equal(notAssignedError{IP: ip}))
+				}
+			}()
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				unallocated, err := ic.ReleaseIPs([]cnet.IP{ip})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(unallocated).To(BeEmpty())
+			}()
+			wg.Wait()
+
+			assigned, _, err := ic.IsAssigned(ip)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(assigned).To(BeFalse())
+			Expect(handleExists(oldHandle)).To(BeFalse())
+			Expect(handleExists(newHandle)).To(BeFalse())
+		}
+	})
+})
+
+var _ = Describe("ReleaseByHandle", func() {
+	blockA := cnet.MustParseNetwork("10.0.0.0/26")
+	blockB := cnet.MustParseNetwork("10.0.0.64/26")
+	handle := "handle-a"
+	other := "handle-other"
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		ic = newIPAM(&Client{Backend: backend})
+
+		// The handle has addresses in both blocks.  Block B also has an
+		// address assigned with another handle.
+		for _, b := range []cnet.IPNet{blockA, blockB} {
+			Expect(ic.blockReaderWriter.claimBlockAffinity(b, "host-a", IPAMConfig{})).To(Succeed())
+			_, err := ic.AssignFromBlock(b, 2, "host-a", &handle)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		_, err := ic.AssignFromBlock(blockB, 1, "host-a", &other)
+		Expect(err).NotTo(HaveOccurred())
+
+		// Release the host's affinity for the blocks, which keeps them
+		// since they are not empty.
+		for _, b := range []cnet.IPNet{blockA, blockB} {
+			Expect(ic.blockReaderWriter.releaseBlockAffinity("host-a", b)).To(Succeed())
+		}
+	})
+
+	It("should delete a non-affine block emptied by the release", func() {
+		Expect(ic.ReleaseByHandle(handle)).To(Succeed())
+
+		_, err := backend.Get(model.BlockKey{CIDR: blockA})
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+		obj, err := backend.Get(model.BlockKey{CIDR: blockB})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(allocationBlock{obj.Value.(*model.AllocationBlock)}.numFreeAddresses()).To(Equal(63))
+
+		_, err = backend.Get(model.IPAMHandleKey{HandleID: handle})
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+		ips, err := ic.IPsByHandle(other)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+	})
+
+	It("should keep the emptied block when empty blocks are retained", func() {
+		_, err := backend.Apply(&model.KVPair{
+			Key:   model.IPAMConfigKey{},
+			Value: &model.IPAMConfig{AutoAllocateBlocks: true, RetainEmptyBlocks: true},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(ic.ReleaseByHandle(handle)).To(Succeed())
+		obj, err := backend.Get(model.BlockKey{CIDR: blockA})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(allocationBlock{obj.Value.(*model.AllocationBlock)}.empty()).To(BeTrue())
+	})
+
+	It("should keep the handle's entry for a block that fails to release", func() {
+		backend.InjectError(fake.OperationUpdate, model.BlockKey{CIDR: blockB}, goerrors.New("injected failure"), 1)
+
+		Expect(ic.ReleaseByHandle(handle)).To(MatchError("injected failure"))
+		obj, err := backend.Get(model.IPAMHandleKey{HandleID: handle})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.Value.(*model.IPAMHandle).Block).To(Equal(map[string]int{blockB.String(): 2}))
+
+		// Retrying the release completes it.
+		Expect(ic.ReleaseByHandle(handle)).To(Succeed())
+		_, err = backend.Get(model.IPAMHandleKey{HandleID: handle})
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should remove the handle's entry for a block that no longer exists", func() {
+		Expect(backend.Delete(&model.KVPair{Key: model.BlockKey{CIDR: blockA}})).To(Succeed())
+
+		Expect(ic.ReleaseByHandle(handle)).To(Succeed())
+		_, err := backend.Get(model.IPAMHandleKey{HandleID: handle})
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+})
+
+var _ = Describe("IsAssigned", func() {
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+	})
+
+	It("should report an assigned address and its handle", func() {
+		handle := "handle-a"
+		ip := cnet.MustParseIP("10.0.0.5")
+		Expect(ic.AssignIP(AssignIPArgs{IP: ip, HandleID: &handle, Hostname: "host-a"})).To(Succeed())
+
+		assigned, h, err := ic.IsAssigned(ip)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(assigned).To(BeTrue())
+		Expect(h).To(Equal(&handle))
+
+		// Another address in the same block is not assigned.
+		assigned, h, err = ic.IsAssigned(cnet.MustParseIP("10.0.0.6"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(assigned).To(BeFalse())
+		Expect(h).To(BeNil())
+	})
+
+	It("should report an address whose block does not exist as not assigned", func() {
+		assigned, h, err := ic.IsAssigned(cnet.MustParseIP("10.0.0.200"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(assigned).To(BeFalse())
+		Expect(h).To(BeNil())
+
+		// The block is not created.
+		kvps, err := backend.List(model.BlockListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(kvps).To(BeEmpty())
+	})
+
+	It("should return an error for an address outside all pools", func() {
+		ip := cnet.MustParseIP("192.168.0.1")
+		assigned, h, err := ic.IsAssigned(ip)
+		Expect(err).To(Equal(notInAnyPoolError{IP: ip}))
+		Expect(assigned).To(BeFalse())
+		Expect(h).To(BeNil())
+	})
+})
+
+var _ = Describe("Assignment results", func() {
+	pool := cnet.MustParseNetwork("10.0.0.0/24")
+	handle := "handle-a"
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+	})
+
+	autoAssign := func(num int) []AssignedIP {
+		result, err := ic.AutoAssignWithResult(AutoAssignArgs{Num4: num, Hostname: "host-a", HandleID: &handle})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPv6).To(BeEmpty())
+		Expect(result.IPv4).To(HaveLen(num))
+		return result.IPv4
+	}
+
+	expectAssigned := func(assigned []AssignedIP, block cnet.IPNet, claimed bool) {
+		for _, a := range assigned {
+			Expect(a.Pool).To(Equal(pool))
+			Expect(a.Block).To(Equal(block))
+			Expect(block.Contains(a.IP.IP)).To(BeTrue())
+			Expect(*a.HandleID).To(Equal(handle))
+			Expect(a.ClaimedBlock).To(Equal(claimed))
+		}
+	}
+
+	It("should describe addresses assigned from a new block and then from the existing block", func() {
+		assigned := autoAssign(3)
+		block := assigned[0].Block
+		ones, _ := block.Mask.Size()
+		Expect(ones).To(Equal(26))
+		expectAssigned(assigned, block, true)
+
+		expectAssigned(autoAssign(2), block, false)
+	})
+
+	It("should describe a single address assigned as its block is claimed", func() {
+		assigned := autoAssign(1)
+		expectAssigned(assigned, assigned[0].Block, true)
+	})
+
+	It("should describe addresses assigned from a new block and an existing block at once", func() {
+		// The first block has 4 free addresses left.
+		first := autoAssign(60)
+		assigned := autoAssign(8)
+		expectAssigned(assigned[:4], first[0].Block, false)
+		expectAssigned(assigned[4:], assigned[4].Block, true)
+		Expect(assigned[4].Block).NotTo(Equal(first[0].Block))
+	})
+
+	It("should return just the addresses from the result", func() {
+		result, err := ic.AutoAssignWithResult(AutoAssignArgs{Num4: 2, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPv4[0].HandleID).To(BeNil())
+		v4, v6 := result.IPs()
+		Expect(v4).To(Equal([]cnet.IP{result.IPv4[0].IP, result.IPv4[1].IP}))
+		Expect(v6).To(BeNil())
+	})
+
+	It("should describe an address assigned by AssignIP", func() {
+		ip := cnet.MustParseIP("10.0.0.70")
+		result, err := ic.AssignIPWithResult(AssignIPArgs{IP: ip, Hostname: "host-a", HandleID: &handle})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPv4).To(HaveLen(1))
+		Expect(result.IPv4[0].IP).To(Equal(ip))
+		expectAssigned(result.IPv4, cnet.MustParseNetwork("10.0.0.64/26"), true)
+
+		result, err = ic.AssignIPWithResult(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.71"), Hostname: "host-a", HandleID: &handle})
+		Expect(err).NotTo(HaveOccurred())
+		expectAssigned(result.IPv4, cnet.MustParseNetwork("10.0.0.64/26"), false)
+	})
+
+	It("should describe the blocks of a pool with its own block size", func() {
+		small := cnet.MustParseNetwork("10.1.0.0/24")
+		backend.storePoolWithBlockSize("10.1.0.0/24", 28)
+		result, err := ic.AutoAssignWithResult(AutoAssignArgs{Num4: 2, Hostname: "host-a", IPv4Pools: []cnet.IPNet{small}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPv4).To(HaveLen(2))
+		for _, a := range result.IPv4 {
+			Expect(a.Pool).To(Equal(small))
+			Expect(a.Block).To(Equal(result.IPv4[0].Block))
+			Expect(a.Block.Contains(a.IP.IP)).To(BeTrue())
+		}
+		ones, _ := result.IPv4[0].Block.Mask.Size()
+		Expect(ones).To(Equal(28))
+
+		ip := cnet.MustParseIP("10.1.0.200")
+		result, err = ic.AssignIPWithResult(AssignIPArgs{IP: ip, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPv4[0].Pool).To(Equal(small))
+		Expect(result.IPv4[0].Block).To(Equal(cnet.MustParseNetwork("10.1.0.192/28")))
+	})
+})
+
+var _ = Describe("HostForIP", func() {
+	block := cnet.MustParseNetwork("10.0.0.0/26")
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.5"), Hostname: "host-a"})).To(Succeed())
+	})
+
+	It("should return the host affine to the block, whether or not the address is assigned", func() {
+		for _, ip := range []string{"10.0.0.5", "10.0.0.6"} {
+			host, err := ic.HostForIP(cnet.MustParseIP(ip))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(host).To(Equal("host-a"))
+		}
+	})
+
+	It("should return no host for a block without affinity", func() {
+		Expect(ic.blockReaderWriter.releaseBlockAffinity("host-a", block)).To(Succeed())
+		host, err := ic.HostForIP(cnet.MustParseIP("10.0.0.5"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(host).To(Equal(""))
+	})
+
+	It("should return an error for an address whose block does not exist", func() {
+		ip := cnet.MustParseIP("10.0.0.200")
+		_, err := ic.HostForIP(ip)
+		Expect(err).To(Equal(blockNotFoundError{IP: ip, Block: cnet.MustParseNetwork("10.0.0.192/26")}))
+
+		// The block is not created.
+		_, err = backend.Get(model.BlockKey{CIDR: cnet.MustParseNetwork("10.0.0.192/26")})
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should return an error for an address outside all pools", func() {
+		ip := cnet.MustParseIP("192.168.0.1")
+		_, err := ic.HostForIP(ip)
+		Expect(err).To(Equal(notInAnyPoolError{IP: ip}))
+	})
+})
+
+var _ = Describe("Releasing and querying addresses outside all pools", func() {
+	var backend *fakeBlockBackend
+	var ic *ipams
+	outside := cnet.MustParseIP("192.168.0.1")
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.1"), Hostname: "host-a"})).To(Succeed())
+	})
+
+	It("should release the other addresses and report the address as unallocated", func() {
+		unallocated, err := ic.ReleaseIPs([]cnet.IP{cnet.MustParseIP("10.0.0.1"), outside})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unallocated).To(Equal([]cnet.IP{outside}))
+
+		assigned, _, err := ic.IsAssigned(cnet.MustParseIP("10.0.0.1"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(assigned).To(BeFalse())
+	})
+
+	It("should release an address whose pool has been deleted", func() {
+		Expect(backend.Delete(&model.KVPair{Key: model.IPPoolKey{CIDR: cnet.MustParseNetwork("10.0.0.0/24")}})).To(Succeed())
+		unallocated, err := ic.ReleaseIPs([]cnet.IP{cnet.MustParseIP("10.0.0.1")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unallocated).To(BeEmpty())
+		obj, err := backend.Get(model.BlockKey{CIDR: cnet.MustParseNetwork("10.0.0.0/26")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(allocationBlock{obj.Value.(*model.AllocationBlock)}.numFreeAddresses()).To(Equal(64))
+	})
+
+	It("should reject a query for the attributes of the address", func() {
+		attrs, err := ic.GetAssignmentAttributes(outside)
+		Expect(err).To(Equal(notInAnyPoolError{IP: outside}))
+		Expect(attrs).To(BeNil())
+	})
+
+	It("should still release addresses in a disabled pool", func() {
+		backend.storePool("10.0.0.0/24", true)
+		unallocated, err := ic.ReleaseIPs([]cnet.IP{cnet.MustParseIP("10.0.0.1")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unallocated).To(BeEmpty())
+	})
+})
+
+var _ = Describe("AssignPreferred", func() {
+	var ic *ipams
+	handle := "handle-a"
+
+	BeforeEach(func() {
+		backend := newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+	})
+
+	It("should assign the preferred addresses in order", func() {
+		result, err := ic.AssignPreferred(
+			[]cnet.IP{cnet.MustParseIP("10.0.0.7"), cnet.MustParseIP("10.0.0.3"), cnet.MustParseIP("10.0.0.9")},
+			AutoAssignArgs{Num4: 2, HandleID: &handle, Hostname: "host-a"},
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Honored).To(Equal([]cnet.IP{cnet.MustParseIP("10.0.0.7"), cnet.MustParseIP("10.0.0.3")}))
+		Expect(result.IPv4).To(BeEmpty())
+
+		// The address that was not needed is left unassigned.
+		assigned, _, err := ic.IsAssigned(cnet.MustParseIP("10.0.0.9"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(assigned).To(BeFalse())
+	})
+
+	It("should skip preferred addresses in use and auto-assign the rest", func() {
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.7"), Hostname: "host-b"})).To(Succeed())
+
+		result, err := ic.AssignPreferred(
+			[]cnet.IP{cnet.MustParseIP("10.0.0.7"), cnet.MustParseIP("10.0.0.3")},
+			AutoAssignArgs{Num4: 3, HandleID: &handle, Hostname: "host-a"},
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Honored).To(Equal([]cnet.IP{cnet.MustParseIP("10.0.0.3")}))
+		Expect(result.IPv4).To(HaveLen(2))
+		Expect(ipsToStrings(result.IPv4)).NotTo(ContainElement("10.0.0.3"))
+		Expect(ipsToStrings(result.IPv4)).NotTo(ContainElement("10.0.0.7"))
+
+		ips, err := ic.IPsByHandle(handle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(3))
+	})
+
+	It("should skip preferred addresses outside all pools", func() {
+		result, err := ic.AssignPreferred(
+			[]cnet.IP{cnet.MustParseIP("192.168.0.1")},
+			AutoAssignArgs{Num4: 1, HandleID: &handle, Hostname: "host-a"},
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Honored).To(BeEmpty())
+		Expect(result.IPv4).To(HaveLen(1))
+		Expect(result.IPv4[0].String()).To(HavePrefix("10.0.0."))
+	})
+})
+
+var _ = Describe("Unique handles", func() {
+	var backend *fakeBlockBackend
+	var ic *ipams
+	handle := "handle-a"
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+		_, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, HandleID: &handle, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	enable := func() {
+		cfg, err := ic.GetIPAMConfig()
+		Expect(err).NotTo(HaveOccurred())
+		cfg.UniqueHandles = true
+		Expect(ic.SetIPAMConfig(*cfg)).To(Succeed())
+	}
+
+	It("should record the host that created the handle", func() {
+		obj, err := backend.Get(model.IPAMHandleKey{HandleID: handle})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.Value.(*model.IPAMHandle).Owner).To(Equal("host-a"))
+	})
+
+	It("should allow another host to share the handle by default", func() {
+		_, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, HandleID: &handle, Hostname: "host-b"})
+		Expect(err).NotTo(HaveOccurred())
+		ips, err := ic.IPsByHandle(handle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(2))
+	})
+
+	It("should reject another host's use of the handle once enabled", func() {
+		enable()
+
+		_, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, HandleID: &handle, Hostname: "host-b"})
+		Expect(err).To(Equal(handleInUseError{HandleID: handle, Owner: "host-a"}))
+		err = ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.200"), HandleID: &handle, Hostname: "host-b"})
+		Expect(err).To(Equal(handleInUseError{HandleID: handle, Owner: "host-a"}))
+
+		// No addresses were assigned to the other host.
+		ips, err := ic.IPsByHandle(handle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+	})
+
+	It("should allow the owner to assign more addresses with the handle", func() {
+		enable()
+
+		_, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 2, HandleID: &handle, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.200"), HandleID: &handle, Hostname: "host-a"})).To(Succeed())
+		ips, err := ic.IPsByHandle(handle)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(4))
+	})
+
+	It("should free the handle for another host once it is released", func() {
+		enable()
+
+		Expect(ic.ReleaseByHandle(handle)).To(Succeed())
+		_, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, HandleID: &handle, Hostname: "host-b"})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+// noHandleListBackend is a fakeBlockBackend which cannot list handles.
+type noHandleListBackend struct {
+	*fakeBlockBackend
+}
+
+func (b noHandleListBackend) ListPage(l model.ListInterface, limit int, token string) ([]*model.KVPair, string, error) {
+	if _, ok := l.(model.IPAMHandleListOptions); ok {
+		return nil, "", errors.ErrorOperationNotSupported{Operation: "List", Identifier: l}
+	}
+	return b.fakeBlockBackend.ListPage(l, limit, token)
+}
+
+var _ = Describe("ListHandles", func() {
+	var backend *fakeBlockBackend
+	var ic *ipams
+	handleA := "handle-a"
+	handleB := "handle-b"
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		backend.storePool("fd00::/120", false)
+		ic = newIPAM(&Client{Backend: backend})
+
+		// handle-b has addresses in two IPv4 blocks and an IPv6 block.
+		for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.70", "fd00::1"} {
+			Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP(ip), HandleID: &handleB, Hostname: "host-a"})).To(Succeed())
+		}
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.3"), HandleID: &handleA, Hostname: "host-a"})).To(Succeed())
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.4"), Hostname: "host-a"})).To(Succeed())
+	})
+
+	expected := []HandleInfo{
+		{HandleID: handleA, NumIPs: 1, NumBlocks: 1, IPVersions: []int{4}},
+		{HandleID: handleB, NumIPs: 4, NumBlocks: 3, IPVersions: []int{4, 6}},
+	}
+
+	It("should summarize the handles in the handle index", func() {
+		infos, err := ic.ListHandles()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(infos).To(Equal(expected))
+	})
+
+	It("should scan the blocks if the datastore cannot list handles", func() {
+		ic = newIPAM(&Client{Backend: noHandleListBackend{backend}})
+		infos, err := ic.ListHandles()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(infos).To(Equal(expected))
+	})
+
+	It("should return an empty list when there are no handles", func() {
+		ic = newIPAM(&Client{Backend: newFakeBlockBackend()})
+		infos, err := ic.ListHandles()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(infos).To(BeEmpty())
+	})
+})
+
+var _ = Describe("CountByHandlePrefix", func() {
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend := newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+
+		for handle, num := range map[string]int{"ns-a.pod-1": 2, "ns-a.pod-2": 3, "ns-ab.pod-1": 4, "ns-b.pod-1": 1} {
+			handle := handle
+			_, _, err := ic.AutoAssign(AutoAssignArgs{Num4: num, HandleID: &handle, Hostname: "host-a"})
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.200"), Hostname: "host-a"})).To(Succeed())
+	})
+
+	count := func(prefix string) int {
+		num, err := ic.CountByHandlePrefix(prefix)
+		Expect(err).NotTo(HaveOccurred())
+		return num
+	}
+
+	It("should sum the addresses of the handles with the prefix", func() {
+		Expect(count("ns-a.")).To(Equal(5))
+		Expect(count("ns-a")).To(Equal(9))
+		Expect(count("ns-b.")).To(Equal(1))
+		Expect(count("ns-a.pod-2")).To(Equal(3))
+		Expect(count("")).To(Equal(10))
+	})
+
+	It("should return zero for a prefix without handles", func() {
+		Expect(count("ns-c.")).To(Equal(0))
+	})
+
+	It("should reject a handle ID which could not be listed", func() {
+		for _, handle := range []string{"ns-c/pod-1", "ns-c%pod-1"} {
+			handle := handle
+			_, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, HandleID: &handle, Hostname: "host-a"})
+			Expect(err).To(Equal(invalidHandleIDError{HandleID: handle}))
+			err = ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.201"), HandleID: &handle, Hostname: "host-a"})
+			Expect(err).To(Equal(invalidHandleIDError{HandleID: handle}))
+		}
+		Expect(count("")).To(Equal(10))
+	})
+})
+
+var _ = Describe("Reserved addresses", func() {
+	var backend *fakeBlockBackend
+	var ic *ipams
+	pool := cnet.MustParseNetwork("10.0.0.0/24")
+	reserved := cnet.MustParseIP("10.0.0.5")
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePoolWithReservedAddresses("10.0.0.0/24", "10.0.0.5")
+		ic = newIPAM(&Client{Backend: backend})
+	})
+
+	It("should not auto-assign a reserved address in the middle of a free block", func() {
+		v4, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 10, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsToStrings(v4)).To(Equal([]string{
+			"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4",
+			"10.0.0.6", "10.0.0.7", "10.0.0.8", "10.0.0.9", "10.0.0.10",
+		}))
+
+		// The block containing the reserved address was still claimed.
+		blocks, err := ic.blockReaderWriter.getAffineBlocks("host-a", ipv4, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(blocks).To(Equal([]cnet.IPNet{cnet.MustParseNetwork("10.0.0.0/26")}))
+
+		assigned, _, err := ic.IsAssigned(reserved)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(assigned).To(BeFalse())
+	})
+
+	It("should not list a reserved address as free", func() {
+		ips, err := ic.FreeIPsInPool(pool, 8)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsToStrings(ips)).To(Equal([]string{
+			"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.6", "10.0.0.7", "10.0.0.8",
+		}))
+	})
+})
+
+var _ = Describe("Required attributes", func() {
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend := newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+	})
+
+	require := func(keys ...string) {
+		cfg, err := ic.GetIPAMConfig()
+		Expect(err).NotTo(HaveOccurred())
+		cfg.RequiredAttributes = keys
+		Expect(ic.SetIPAMConfig(*cfg)).To(Succeed())
+	}
+
+	It("should accept any attributes by default", func() {
+		_, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should reject assignments missing required attributes", func() {
+		require("namespace", "pod", "node")
+		attrs := map[string]string{"pod": "pod-1"}
+
+		_, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, Attrs: attrs, Hostname: "host-a"})
+		Expect(err).To(Equal(missingAttributesError{Missing: []string{"namespace", "node"}}))
+		_, err = ic.AutoAssignDualStack(AutoAssignArgs{Num4: 1, Attrs: attrs, Hostname: "host-a"})
+		Expect(err).To(BeAssignableToTypeOf(missingAttributesError{}))
+		err = ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.5"), Attrs: attrs, Hostname: "host-a"})
+		Expect(err).To(BeAssignableToTypeOf(missingAttributesError{}))
+
+		// Nothing was assigned.
+		assigned, _, err := ic.IsAssigned(cnet.MustParseIP("10.0.0.5"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(assigned).To(BeFalse())
+		blocks, err := ic.blockReaderWriter.getAffineBlocks("host-a", ipv4, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(blocks).To(BeEmpty())
+	})
+
+	It("should accept assignments with the required attributes", func() {
+		require("namespace", "pod")
+		attrs := map[string]string{"namespace": "default", "pod": "pod-1", "extra": "x"}
+
+		v4, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, Attrs: attrs, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v4).To(HaveLen(1))
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.200"), Attrs: attrs, Hostname: "host-a"})).To(Succeed())
+	})
+
+	It("should reject attribute values that are too long", func() {
+		require("pod")
+		attrs := map[string]string{"pod": strings.Repeat("p", maxAttributeValueLength+1)}
+
+		_, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, Attrs: attrs, Hostname: "host-a"})
+		Expect(err).To(Equal(attributeTooLongError{Key: "pod", Length: maxAttributeValueLength + 1}))
+	})
+})
+
+var _ = Describe("Pools smaller than a block", func() {
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend := newFakeBlockBackend()
+		backend.storePool("10.0.0.16/28", false)
+		backend.storePool("10.1.0.0/26", false)
+		backend.storePool("10.2.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+	})
+
+	It("should treat a pool smaller than a block as the block", func() {
+		for ip, block := range map[string]string{
+			"10.0.0.20":  "10.0.0.16/28",
+			"10.1.0.20":  "10.1.0.0/26",
+			"10.2.0.200": "10.2.0.192/26",
+		} {
+			cidr, err := ic.blockReaderWriter.blockCIDRForAddress(cnet.MustParseIP(ip), IPAMConfig{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cidr.String()).To(Equal(block), ip)
+		}
+	})
+
+	It("should assign and release addresses in a pool smaller than a block", func() {
+		pool := cnet.MustParseNetwork("10.0.0.16/28")
+		v4, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 20, Hostname: "host-a", IPv4Pools: []cnet.IPNet{pool}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v4).To(HaveLen(16))
+		for _, ip := range v4 {
+			Expect(pool.Contains(ip.IP)).To(BeTrue())
+		}
+
+		unallocated, err := ic.ReleaseIPs(v4[:1])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unallocated).To(BeEmpty())
+		Expect(ic.AssignIP(AssignIPArgs{IP: v4[0], Hostname: "host-a"})).To(Succeed())
+	})
+})
+
+var _ = Describe("Destructive operations", func() {
+	pool := cnet.MustParseNetwork("10.0.0.0/24")
+	blockCIDR := cnet.MustParseNetwork("10.0.0.0/26")
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.1"), Hostname: "host-a"})).To(Succeed())
+	})
+
+	// expectUnchanged checks that the block and its allocation survived.
+	expectUnchanged := func() {
+		assigned, _, err := ic.IsAssigned(cnet.MustParseIP("10.0.0.1"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(assigned).To(BeTrue())
+		_, err = backend.Get(model.BlockAffinityKey{Host: "host-a", CIDR: blockCIDR})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	It("should be disabled by default", func() {
+		cfg, err := ic.GetIPAMConfig()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.DestructiveOpsAllowed).To(BeFalse())
+	})
+
+	It("should refuse to drain a pool, but allow a dry run", func() {
+		_, err := ic.DrainPool(pool, true)
+		Expect(err).To(Equal(destructiveOpsDisabledError{Op: "DrainPool"}))
+		expectUnchanged()
+
+		result, err := ic.DrainPool(pool, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.NumAllocated).To(Equal(1))
+	})
+
+	It("should refuse to compact, but allow a dry run", func() {
+		_, err := ic.Compact("host-a", pool, CompactOptions{Confirm: true})
+		Expect(err).To(Equal(destructiveOpsDisabledError{Op: "Compact"}))
+		expectUnchanged()
+
+		_, err = ic.Compact("host-a", pool, CompactOptions{DryRun: true})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should refuse to force the release of a block affinity", func() {
+		err := ic.ForceReleaseBlockAffinity(blockCIDR)
+		Expect(err).To(Equal(destructiveOpsDisabledError{Op: "ForceReleaseBlockAffinity"}))
+		expectUnchanged()
+	})
+
+	It("should refuse to force the deletion of a pool's blocks", func() {
+		err := ic.DeletePoolBlocks(pool, true)
+		Expect(err).To(Equal(destructiveOpsDisabledError{Op: "DeletePoolBlocks"}))
+		expectUnchanged()
+	})
+
+	It("should allow them once enabled, without affecting existing allocations", func() {
+		cfg, err := ic.GetIPAMConfig()
+		Expect(err).NotTo(HaveOccurred())
+		cfg.DestructiveOpsAllowed = true
+		Expect(ic.SetIPAMConfig(*cfg)).To(Succeed())
+
+		result, err := ic.DrainPool(pool, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.NumAllocated).To(Equal(1))
+	})
+})
+
+var _ = Describe("Shared blocks", func() {
+	block := cnet.MustParseNetwork("10.0.0.0/26")
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/26", false)
+		ic = newIPAM(&Client{Backend: backend})
+		Expect(ic.ClaimSharedBlock(block)).To(Succeed())
+	})
+
+	getBlock := func() *model.AllocationBlock {
+		obj, err := backend.Get(model.BlockKey{CIDR: block})
+		Expect(err).NotTo(HaveOccurred())
+		return obj.Value.(*model.AllocationBlock)
+	}
+
+	It("should let two hosts assign from the block concurrently", func() {
+		var wg sync.WaitGroup
+		for i, host := range []string{"host-a", "host-b"} {
+			wg.Add(1)
+			go func(first int, host string) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for o := first; o < first+16; o++ {
+					Expect(ic.AssignIP(AssignIPArgs{IP: ordinalToIP(block, o), Hostname: host})).To(Succeed())
+				}
+			}(i*16, host)
+		}
+		wg.Wait()
+
+		b := getBlock()
+		Expect(b.Shared).To(BeTrue())
+		Expect(b.Affinity).To(BeNil())
+		Expect(allocationBlock{b}.numFreeAddresses()).To(Equal(32))
+		affinities, err := backend.List(model.BlockAffinityListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(affinities).To(BeEmpty())
+	})
+
+	It("should overflow into the block from any host", func() {
+		ipsA, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 2, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		ipsB, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 2, Hostname: "host-b"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsA).To(HaveLen(2))
+		Expect(ipsB).To(HaveLen(2))
+		Expect(getBlock().Affinity).To(BeNil())
+	})
+
+	It("should keep the block when it is emptied, and never let a host claim it", func() {
+		ip := cnet.MustParseIP("10.0.0.1")
+		Expect(ic.AssignIP(AssignIPArgs{IP: ip, Hostname: "host-a"})).To(Succeed())
+		Expect(ic.ReleaseIPs([]cnet.IP{ip})).To(BeEmpty())
+		Expect(getBlock().Shared).To(BeTrue())
+
+		err := ic.blockReaderWriter.claimBlockAffinity(block, "host-a", IPAMConfig{})
+		Expect(err).To(BeAssignableToTypeOf(affinityClaimedError{}))
+		Expect(getBlock().Affinity).To(BeNil())
+
+		// Claiming the block as shared again does nothing.
+		Expect(ic.ClaimSharedBlock(block)).To(Succeed())
+	})
+
+	It("should not share a block which is affine to a host", func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+		affine := cnet.MustParseNetwork("10.0.0.64/26")
+		Expect(ic.blockReaderWriter.claimBlockAffinity(affine, "host-a", IPAMConfig{})).To(Succeed())
+		Expect(ic.ClaimSharedBlock(affine)).To(BeAssignableToTypeOf(affinityClaimedError{}))
+
+		// Only whole blocks can be shared.
+		Expect(ic.ClaimSharedBlock(cnet.MustParseNetwork("10.0.0.128/25"))).NotTo(Succeed())
+	})
+})
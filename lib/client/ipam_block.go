@@ -18,8 +18,11 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"math/rand"
 	"net"
 	"reflect"
+	"sort"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
@@ -28,6 +31,10 @@ import (
 
 const (
 	blockSize = 64
+
+	// Annotations recording the host and process that first claimed a block.
+	blockAnnotationHost    = "host"
+	blockAnnotationProcess = "process"
 )
 
 type ipVersion struct {
@@ -51,6 +58,33 @@ var ipv6 ipVersion = ipVersion{
 	BlockPrefixMask:   net.CIDRMask(122, 128),
 }
 
+// IPVersion4 and IPVersion6 are the IP versions taken by the IPAM methods
+// which assign or list by IP version, so that callers need not construct one.
+var (
+	IPVersion4 = ipv4
+	IPVersion6 = ipv6
+)
+
+// newIPVersion returns the IP version with the given number, which must be 4
+// or 6.  Otherwise an invalidIPVersionError is returned.
+func newIPVersion(number int) (ipVersion, error) {
+	switch number {
+	case 4:
+		return ipv4, nil
+	case 6:
+		return ipv6, nil
+	}
+	return ipVersion{}, invalidIPVersionError{Number: number}
+}
+
+// normalize returns the complete IP version with the same number, so that a
+// version constructed by hand with only its number set has the right masks.
+// Returns an invalidIPVersionError, rather than a version that would produce
+// wrong masks, if the number is not 4 or 6.
+func (v ipVersion) normalize() (ipVersion, error) {
+	return newIPVersion(v.Number)
+}
+
 // Wrap the backend AllocationBlock struct so that we can
 // attach methods to it.
 type allocationBlock struct {
@@ -58,22 +92,40 @@ type allocationBlock struct {
 }
 
 func newBlock(cidr cnet.IPNet) allocationBlock {
+	// A block contains every address in its CIDR.  This is normally
+	// blockSize addresses, but blocks may be smaller for pools that are
+	// smaller than a block, or larger if a shorter block prefix is used.
+	numAddresses := blockSize
+	ones, bits := cidr.Mask.Size()
+	if hostBits := uint(bits - ones); hostBits < 31 {
+		numAddresses = 1 << hostBits
+	}
+
 	b := model.AllocationBlock{}
-	b.Allocations = make([]*int, blockSize)
-	b.Unallocated = make([]int, blockSize)
+	b.Allocations = make([]*int, numAddresses)
+	b.Unallocated = make([]int, numAddresses)
 	b.StrictAffinity = false
 	b.CIDR = cidr
 
 	// Initialize unallocated ordinals.
-	for i := 0; i < blockSize; i++ {
+	for i := 0; i < numAddresses; i++ {
 		b.Unallocated[i] = i
 	}
 
 	return allocationBlock{&b}
 }
 
+// numAddresses returns the number of addresses in the block.
+func (b allocationBlock) numAddresses() int {
+	return len(b.Allocations)
+}
+
+// autoAssign assigns up to num addresses from the block.  If contiguous is
+// set, either exactly num contiguous addresses are assigned, or none are.
+// Otherwise, the free addresses are assigned in the given order.  Addresses
+// within any of the excluded CIDRs are not assigned.
 func (b *allocationBlock) autoAssign(
-	num int, handleID *string, host string, attrs map[string]string, affinityCheck bool) ([]cnet.IP, error) {
+	num int, handleID *string, host string, attrs map[string]string, affinityCheck bool, contiguous bool, excluded []cnet.IPNet, order AssignOrder) ([]cnet.IP, error) {
 
 	// Determine if we need to check for affinity.
 	checkAffinity := b.StrictAffinity || affinityCheck
@@ -83,7 +135,112 @@ func (b *allocationBlock) autoAssign(
 		return nil, errors.New(s)
 	}
 
-	// Walk the allocations until we find enough addresses.
+	// Withhold the excluded ordinals from the unallocated list while
+	// assigning, so that they are neither assigned nor lost from the list.
+	skip := b.excludedOrdinals(excluded)
+	if len(skip) > 0 {
+		unallocated, withheld := []int{}, []int{}
+		for _, o := range b.Unallocated {
+			if skip[o] {
+				withheld = append(withheld, o)
+			} else {
+				unallocated = append(unallocated, o)
+			}
+		}
+		b.Unallocated = unallocated
+		defer func() {
+			b.Unallocated = append(b.Unallocated, withheld...)
+		}()
+	}
+
+	var ips []cnet.IP
+	if contiguous {
+		ips = []cnet.IP{}
+		base, length := b.assignContiguousOrdinals(num, handleID, attrs)
+		for i := 0; i < length; i++ {
+			ips = append(ips, incrementIP(base, big.NewInt(int64(i))))
+		}
+	} else {
+		b.orderUnallocated(order)
+		ips, _ = b.assignFreeOrdinals(num, handleID, attrs)
+	}
+	log.Debugf("Block %s returned ips: %v", b.CIDR.String(), ips)
+	return ips, nil
+}
+
+// assignContiguousOrdinals assigns a run of num contiguous free ordinals,
+// recording the given handle and attributes against each of them.  The run
+// starts at a multiple of the smallest power of two that is at least num, so
+// a run whose length is a power of two covers a CIDR.  Returns the first IP
+// of the run and its length, or a length of 0 if the block has no such run
+// of free ordinals.
+func (b *allocationBlock) assignContiguousOrdinals(num int, handleID *string, attrs map[string]string) (cnet.IP, int) {
+	if num <= 0 {
+		return cnet.IP{}, 0
+	}
+	free := make([]bool, b.numAddresses())
+	for _, o := range b.Unallocated {
+		free[o] = true
+	}
+	align := 1
+	for align < num {
+		align *= 2
+	}
+
+	for start := 0; start+num <= b.numAddresses(); start += align {
+		run := 0
+		for run < num && free[start+run] {
+			run++
+		}
+		if run < num {
+			continue
+		}
+
+		// Found a run.  Remove its ordinals from the unallocated list and
+		// perform the allocations.
+		unallocated := []int{}
+		for _, o := range b.Unallocated {
+			if o < start || o >= start+num {
+				unallocated = append(unallocated, o)
+			}
+		}
+		b.Unallocated = unallocated
+		b.EmptySince = nil
+		attrIndex := b.findOrAddAttribute(handleID, attrs)
+		for o := start; o < start+num; o++ {
+			index := attrIndex
+			b.Allocations[o] = &index
+		}
+		return ordinalToIP(b.CIDR, start), num
+	}
+	return cnet.IP{}, 0
+}
+
+// orderUnallocated reorders the block's unallocated list so that the free
+// ordinals are assigned in the given order.  An empty order leaves the list
+// unchanged.
+func (b *allocationBlock) orderUnallocated(order AssignOrder) {
+	switch order {
+	case AssignOrderLowest:
+		sort.Ints(b.Unallocated)
+	case AssignOrderHighest:
+		sort.Sort(sort.Reverse(sort.IntSlice(b.Unallocated)))
+	case AssignOrderRandom:
+		for i := len(b.Unallocated) - 1; i > 0; i-- {
+			j := rand.Intn(i + 1)
+			b.Unallocated[i], b.Unallocated[j] = b.Unallocated[j], b.Unallocated[i]
+		}
+	}
+}
+
+// assignFreeOrdinals assigns up to num of the block's free ordinals, recording
+// the given handle and attributes against each of them.  Only ordinals in the
+// block's Unallocated list are free, so ordinals that are already assigned or
+// otherwise withheld from that list are never returned.  Returns the assigned
+// IPs and the number of requested addresses that could not be assigned.
+func (b *allocationBlock) assignFreeOrdinals(num int, handleID *string, attrs map[string]string) ([]cnet.IP, int) {
+	// Take ordinals from the front of the unallocated list until we have
+	// enough addresses.
 	ordinals := []int{}
 	for len(b.Unallocated) > 0 && len(ordinals) < num {
 		ordinals = append(ordinals, b.Unallocated[0])
@@ -92,14 +249,17 @@ func (b *allocationBlock) autoAssign(
 
 	// Create slice of IPs and perform the allocations.
 	ips := []cnet.IP{}
+	if len(ordinals) == 0 {
+		return ips, num
+	}
+	b.EmptySince = nil
+	attrIndex := b.findOrAddAttribute(handleID, attrs)
 	for _, o := range ordinals {
-		attrIndex := b.findOrAddAttribute(handleID, attrs)
-		b.Allocations[o] = &attrIndex
-		ips = append(ips, incrementIP(cnet.IP{b.CIDR.IP}, big.NewInt(int64(o))))
+		index := attrIndex
+		b.Allocations[o] = &index
+		ips = append(ips, ordinalToIP(b.CIDR, o))
 	}
-
-	log.Debugf("Block %s returned ips: %v", b.CIDR.String(), ips)
-	return ips, nil
+	return ips, num - len(ordinals)
 }
 
 func (b *allocationBlock) assign(address cnet.IP, handleID *string, attrs map[string]string, host string) error {
@@ -109,9 +269,9 @@ func (b *allocationBlock) assign(address cnet.IP, handleID *string, attrs map[st
 	}
 
 	// Convert to an ordinal.
-	ordinal := ipToOrdinal(address, *b)
-	if (ordinal < 0) || (ordinal > blockSize) {
-		return errors.New("IP address not in block")
+	ordinal, err := ipToOrdinal(b.CIDR, address)
+	if err != nil {
+		return err
 	}
 
 	// Check if already allocated.
@@ -122,6 +282,7 @@ func (b *allocationBlock) assign(address cnet.IP, handleID *string, attrs map[st
 	// Set up attributes.
 	attrIndex := b.findOrAddAttribute(handleID, attrs)
 	b.Allocations[ordinal] = &attrIndex
+	b.EmptySince = nil
 
 	// Remove from unallocated.
 	for i, unallocated := range b.Unallocated {
@@ -138,12 +299,35 @@ func hostAffinityMatches(host string, block *model.AllocationBlock) bool {
 	return *block.Affinity == "host:"+host
 }
 
+// assignments describes the given addresses, assigned from the block with the
+// given handle.
+func (b allocationBlock) assignments(ips []cnet.IP, handleID *string) []AssignedIP {
+	if ips == nil {
+		return nil
+	}
+	assigned := []AssignedIP{}
+	for _, ip := range ips {
+		a := AssignedIP{IP: ip, Block: b.CIDR, HandleID: handleID}
+		if b.Pool != nil {
+			a.Pool = *b.Pool
+		}
+		assigned = append(assigned, a)
+	}
+	return assigned
+}
+
 func (b allocationBlock) numFreeAddresses() int {
 	return len(b.Unallocated)
 }
 
 func (b allocationBlock) empty() bool {
-	return b.numFreeAddresses() == blockSize
+	return b.numFreeAddresses() == b.numAddresses()
+}
+
+// lingering returns whether the block is empty and was emptied less than
+// linger before now, so that its host's affinity should be kept.
+func (b allocationBlock) lingering(now time.Time, linger time.Duration) bool {
+	return linger > 0 && b.empty() && b.EmptySince != nil && now.Before(b.EmptySince.Add(linger))
 }
 
 func (b *allocationBlock) release(addresses []cnet.IP) ([]cnet.IP, map[string]int, error) {
@@ -160,9 +344,9 @@ func (b *allocationBlock) release(addresses []cnet.IP) ([]cnet.IP, map[string]in
 	// attributes that need to be cleaned up.
 	for _, ip := range addresses {
 		// Convert to an ordinal.
-		ordinal := ipToOrdinal(ip, *b)
-		if (ordinal < 0) || (ordinal > blockSize) {
-			return nil, nil, errors.New("IP address not in block")
+		ordinal, err := ipToOrdinal(b.CIDR, ip)
+		if err != nil {
+			return nil, nil, err
 		}
 
 		// Check if allocated.
@@ -185,12 +369,7 @@ func (b *allocationBlock) release(addresses []cnet.IP) ([]cnet.IP, map[string]in
 		// exists.
 		handleID := b.Attributes[*attrIdx].AttrPrimary
 		if handleID != nil {
-			handleCount := 0
-			if count, ok := countByHandle[*handleID]; !ok {
-				handleCount = count
-			}
-			handleCount += 1
-			countByHandle[*handleID] = handleCount
+			countByHandle[*handleID]++
 		}
 	}
 
@@ -204,7 +383,7 @@ func (b *allocationBlock) release(addresses []cnet.IP) ([]cnet.IP, map[string]in
 		}
 	}
 	if len(attrsToDelete) != 0 {
-		log.Infof("Deleting attributes: %s", attrsToDelete)
+		log.Infof("Deleting attributes: %v", attrsToDelete)
 		b.deleteAttributes(attrsToDelete, ordinals)
 	}
 
@@ -224,7 +403,7 @@ func (b *allocationBlock) deleteAttributes(delIndexes, ordinals []int) {
 		if !intInSlice(x, delIndexes) {
 			// Attribute at x is not being deleted.  Build a mapping
 			// of old attribute index (x) to new attribute index (y).
-			log.Debugf("%d in %s", x, delIndexes)
+			log.Debugf("%d in %v", x, delIndexes)
 			newIndex := y
 			newIndexes[x] = &newIndex
 			y += 1
@@ -234,7 +413,7 @@ func (b *allocationBlock) deleteAttributes(delIndexes, ordinals []int) {
 	b.Attributes = newAttrs
 
 	// Update attribute indexes for all allocations in this block.
-	for i := 0; i < blockSize; i++ {
+	for i := 0; i < b.numAddresses(); i++ {
 		if b.Allocations[i] != nil {
 			// Get the new index that corresponds to the old index
 			// and update the allocation.
@@ -283,7 +462,7 @@ func (b *allocationBlock) releaseByHandle(handleID string) int {
 	// There are addresses to release.
 	ordinals := []int{}
 	var o int
-	for o = 0; o < blockSize; o++ {
+	for o = 0; o < b.numAddresses(); o++ {
 		// Only check allocated ordinals.
 		if b.Allocations[o] != nil && intInSlice(*b.Allocations[o], attrIndexes) {
 			// Release this ordinal.
@@ -302,36 +481,215 @@ func (b *allocationBlock) releaseByHandle(handleID string) int {
 	return len(ordinals)
 }
 
+// renameHandle moves the addresses assigned with oldHandleID to newHandleID
+// by rewriting the handle stored in their attributes.  Returns the number of
+// allocated ordinals which were moved.
+func (b *allocationBlock) renameHandle(oldHandleID, newHandleID string) int {
+	attrIndexes := b.attributeIndexesByHandle(oldHandleID)
+	if len(attrIndexes) == 0 {
+		return 0
+	}
+
+	num := 0
+	for o := 0; o < b.numAddresses(); o++ {
+		if b.Allocations[o] != nil && intInSlice(*b.Allocations[o], attrIndexes) {
+			num++
+		}
+	}
+	for _, i := range attrIndexes {
+		handleID := newHandleID
+		b.Attributes[i].AttrPrimary = &handleID
+	}
+	return num
+}
+
+// setLeaseExpiry gives the assigned addresses a lease which expires at the
+// given time, keeping their handles and secondary attributes.  Returns a
+// notAssignedError if an address is not assigned.
+func (b *allocationBlock) setLeaseExpiry(ips []cnet.IP, expiry time.Time) error {
+	for _, ip := range ips {
+		ordinal, err := ipToOrdinal(b.CIDR, ip)
+		if err != nil {
+			return err
+		}
+		if b.Allocations[ordinal] == nil {
+			return notAssignedError{IP: ip}
+		}
+		oldIndex := *b.Allocations[ordinal]
+		old := b.Attributes[oldIndex]
+		newIndex := b.findOrAddAttr(model.AllocationAttribute{AttrPrimary: old.AttrPrimary, AttrSecondary: old.AttrSecondary, Expiry: &expiry})
+		b.Allocations[ordinal] = &newIndex
+
+		// Remove the old attribute if no other address uses it.
+		if b.attributeRefCounts()[oldIndex] == 0 {
+			b.deleteAttributes([]int{oldIndex}, nil)
+		}
+	}
+	return nil
+}
+
+// expiredIPs returns the assigned addresses whose lease expired before the
+// given time.  Addresses assigned without a lease never expire.
+func (b allocationBlock) expiredIPs(before time.Time) []cnet.IP {
+	ips := []cnet.IP{}
+	for o, a := range b.Allocations {
+		if a == nil {
+			continue
+		}
+		if expiry := b.Attributes[*a].Expiry; expiry != nil && expiry.Before(before) {
+			ips = append(ips, ordinalToIP(b.CIDR, o))
+		}
+	}
+	return ips
+}
+
+// reassignHandle moves a single assigned address to newHandleID, keeping its
+// secondary attributes, and returns the handle it was assigned with, which is
+// nil if it had none.  Returns a notAssignedError if the address is not
+// assigned.
+func (b *allocationBlock) reassignHandle(ip cnet.IP, newHandleID string) (*string, error) {
+	ordinal, err := ipToOrdinal(b.CIDR, ip)
+	if err != nil {
+		return nil, err
+	}
+	if b.Allocations[ordinal] == nil {
+		return nil, notAssignedError{IP: ip}
+	}
+	oldIndex := *b.Allocations[ordinal]
+	old := b.Attributes[oldIndex]
+
+	handleID := newHandleID
+	newIndex := b.findOrAddAttr(model.AllocationAttribute{AttrPrimary: &handleID, AttrSecondary: old.AttrSecondary, Expiry: old.Expiry})
+	b.Allocations[ordinal] = &newIndex
+
+	// Remove the old attribute if no other address uses it.
+	if b.attributeRefCounts()[oldIndex] == 0 {
+		b.deleteAttributes([]int{oldIndex}, nil)
+	}
+	return old.AttrPrimary, nil
+}
+
 func (b allocationBlock) ipsByHandle(handleID string) []cnet.IP {
 	ips := []cnet.IP{}
 	attrIndexes := b.attributeIndexesByHandle(handleID)
 	var o int
-	for o = 0; o < blockSize; o++ {
+	for o = 0; o < b.numAddresses(); o++ {
 		if b.Allocations[o] != nil && intInSlice(*b.Allocations[o], attrIndexes) {
-			ip := ordinalToIP(o, b)
+			ip := ordinalToIP(b.CIDR, o)
 			ips = append(ips, ip)
 		}
 	}
 	return ips
 }
 
+// assignedIPs returns all of the IPs in the block which are currently assigned.
+func (b allocationBlock) assignedIPs() []cnet.IP {
+	ips := []cnet.IP{}
+	for o := 0; o < b.numAddresses(); o++ {
+		if b.Allocations[o] != nil {
+			ips = append(ips, ordinalToIP(b.CIDR, o))
+		}
+	}
+	return ips
+}
+
+// freeIPs returns up to limit of the block's free IPs in ascending order.  An
+// IP is free if it is not allocated, its ordinal is in the Unallocated list
+// and it is not within any of the excluded CIDRs.
+func (b allocationBlock) freeIPs(limit int, excluded []cnet.IPNet) []cnet.IP {
+	unallocated := map[int]bool{}
+	for _, o := range b.Unallocated {
+		unallocated[o] = true
+	}
+	skip := b.excludedOrdinals(excluded)
+	ips := []cnet.IP{}
+	for o := 0; o < b.numAddresses() && len(ips) < limit; o++ {
+		if b.Allocations[o] == nil && unallocated[o] && !skip[o] {
+			ips = append(ips, ordinalToIP(b.CIDR, o))
+		}
+	}
+	return ips
+}
+
+// excludedOrdinals returns the set of ordinals of the block's addresses which
+// fall within any of the excluded CIDRs.
+func (b allocationBlock) excludedOrdinals(excluded []cnet.IPNet) map[int]bool {
+	skip := map[int]bool{}
+	for _, cidr := range excluded {
+		if !cidr.IsNetOverlap(b.CIDR.IPNet) {
+			continue
+		}
+		for o := 0; o < b.numAddresses(); o++ {
+			if cidr.Contains(ordinalToIP(b.CIDR, o).IP) {
+				skip[o] = true
+			}
+		}
+	}
+	return skip
+}
+
+// assignedIPsMatching describes the IPs in the block which are currently
+// assigned with attributes containing every key/value pair in the filter.
+// An empty filter matches every assigned IP.
+func (b allocationBlock) assignedIPsMatching(filter map[string]string) []AssignedIP {
+	ips := []AssignedIP{}
+	for o := 0; o < b.numAddresses(); o++ {
+		if b.Allocations[o] == nil {
+			continue
+		}
+		attr := b.Attributes[*b.Allocations[o]]
+		if !attributesMatch(attr.AttrSecondary, filter) {
+			continue
+		}
+		ips = append(ips, b.assignments([]cnet.IP{ordinalToIP(b.CIDR, o)}, attr.AttrPrimary)...)
+	}
+	return ips
+}
+
+// attributesMatch returns true if the attributes contain every key/value pair
+// in the filter.
+func attributesMatch(attrs map[string]string, filter map[string]string) bool {
+	for k, v := range filter {
+		if av, ok := attrs[k]; !ok || av != v {
+			return false
+		}
+	}
+	return true
+}
+
 func (b allocationBlock) attributesForIP(ip cnet.IP) (map[string]string, error) {
+	attr, err := b.attributeForIP(ip)
+	if err != nil {
+		return nil, err
+	}
+	return attr.AttrSecondary, nil
+}
+
+// attributeForIP returns the allocation attribute (handle and secondary
+// attributes) stored for the given IP.  Returns a notAssignedError if
+// the IP is not currently assigned in this block.
+func (b allocationBlock) attributeForIP(ip cnet.IP) (*model.AllocationAttribute, error) {
 	// Convert to an ordinal.
-	ordinal := ipToOrdinal(ip, b)
-	if (ordinal < 0) || (ordinal > blockSize) {
-		return nil, errors.New(fmt.Sprintf("IP %s not in block %s", ip, b.AllocationBlock.CIDR))
+	ordinal, err := ipToOrdinal(b.CIDR, ip)
+	if err != nil {
+		return nil, err
 	}
 
 	// Check if allocated.
 	attrIndex := b.Allocations[ordinal]
 	if attrIndex == nil {
-		return nil, errors.New(fmt.Sprintf("IP %s is not currently assigned in block", ip))
+		return nil, notAssignedError{IP: ip}
 	}
-	return b.Attributes[*attrIndex].AttrSecondary, nil
+	return &b.Attributes[*attrIndex], nil
 }
 
 func (b *allocationBlock) findOrAddAttribute(handleID *string, attrs map[string]string) int {
-	attr := model.AllocationAttribute{handleID, attrs}
+	return b.findOrAddAttr(model.AllocationAttribute{AttrPrimary: handleID, AttrSecondary: attrs})
+}
+
+// findOrAddAttr returns the index of the given attribute, adding it if the
+// block does not already hold it.
+func (b *allocationBlock) findOrAddAttr(attr model.AllocationAttribute) int {
 	for idx, existing := range b.Attributes {
 		if reflect.DeepEqual(attr, existing) {
 			log.Debugf("Attribute '%+v' already exists", attr)
@@ -346,30 +704,66 @@ func (b *allocationBlock) findOrAddAttribute(handleID *string, attrs map[string]
 	return attrIndex
 }
 
-func getBlockCIDRForAddress(addr cnet.IP) cnet.IPNet {
-	var mask net.IPMask
-	if addr.Version() == 6 {
-		// This is an IPv6 address.
-		mask = ipv6.BlockPrefixMask
-	} else {
-		// This is an IPv4 address.
-		mask = ipv4.BlockPrefixMask
-	}
+// blockCIDRWithPrefixLength returns the CIDR of the block with the given
+// prefix length that contains the given address.
+func blockCIDRWithPrefixLength(addr cnet.IP, prefixLength int) cnet.IPNet {
+	version := getIPVersion(addr)
+	mask := net.CIDRMask(prefixLength, version.TotalBits)
 	masked := addr.Mask(mask)
 	return cnet.IPNet{net.IPNet{IP: masked, Mask: mask}}
 }
 
+// blockPrefixLength returns the configured block prefix length for the given
+// IP version, or the default for the IP version if none is configured.
+func (cfg IPAMConfig) blockPrefixLength(version ipVersion) int {
+	if version.Number == 4 && cfg.IPv4BlockSize != 0 {
+		return cfg.IPv4BlockSize
+	}
+	if version.Number == 6 && cfg.IPv6BlockSize != 0 {
+		return cfg.IPv6BlockSize
+	}
+	return version.BlockPrefixLength
+}
+
+// getIPVersion returns the IP version of an IP that is known to be valid.
+// IPv4-mapped IPv6 addresses are IPv4.  Use ipVersionOf for IPs that may not
+// be valid.
 func getIPVersion(ip cnet.IP) ipVersion {
-	if ip.To4() == nil {
-		return ipv6
+	if ip.IsIPv4() {
+		return ipv4
 	}
-	return ipv4
+	return ipv6
 }
 
-func largerThanOrEqualToBlock(blockCIDR cnet.IPNet) bool {
-	ones, _ := blockCIDR.Mask.Size()
-	ipVersion := getIPVersion(cnet.IP{blockCIDR.IP})
-	return ones <= ipVersion.BlockPrefixLength
+// ipVersionOf returns the IP version of the given IP.  IPv4-mapped IPv6
+// addresses, such as ::ffff:192.0.2.0, are IPv4.  Returns an error if the IP
+// is nil or is not a valid IP address.
+func ipVersionOf(ip cnet.IP) (ipVersion, error) {
+	switch len(ip.Normalize().IP) {
+	case net.IPv4len:
+		return ipv4, nil
+	case net.IPv6len:
+		return ipv6, nil
+	}
+	return ipVersion{}, fmt.Errorf("%v is not a valid IP address", ip.IP)
+}
+
+// normalizeNetwork returns the network with its IP and mask sized for its IP
+// version, so that an IPv4 network held in 16 bytes is converted to 4 bytes.
+func normalizeNetwork(n cnet.IPNet) cnet.IPNet {
+	ip := cnet.IP{n.IP}.Normalize()
+	mask := n.Mask
+	if len(ip.IP) == net.IPv4len && len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	return cnet.IPNet{net.IPNet{IP: ip.IP, Mask: mask}}
+}
+
+// largerThanOrEqualToBlock returns true if the CIDR is at least as large as
+// a block with the given prefix length.
+func largerThanOrEqualToBlock(cidr cnet.IPNet, blockPrefixLength int) bool {
+	ones, _ := normalizeNetwork(cidr).Mask.Size()
+	return ones <= blockPrefixLength
 }
 
 func intInSlice(searchInt int, slice []int) bool {
@@ -382,35 +776,53 @@ func intInSlice(searchInt int, slice []int) bool {
 }
 
 func ipToInt(ip cnet.IP) *big.Int {
-	if ip.To4() != nil {
-		return big.NewInt(0).SetBytes(ip.To4())
-	} else {
-		return big.NewInt(0).SetBytes(ip.To16())
-	}
+	return big.NewInt(0).SetBytes(ip.Normalize().IP)
 }
 
-func intToIP(ipInt *big.Int) cnet.IP {
-	ip := cnet.IP{net.IP(ipInt.Bytes())}
-	return ip
+// intToIP converts an integer to an IP address of the given IP version.  The
+// address is padded to the full 4 or 16 bytes of the IP version.  Returns a
+// nil IP if the integer is outside the address space of the IP version.
+func intToIP(ipInt *big.Int, version ipVersion) cnet.IP {
+	if ipInt.Sign() < 0 || ipInt.BitLen() > version.TotalBits {
+		return cnet.IP{}
+	}
+	b := ipInt.Bytes()
+	ip := make(net.IP, version.TotalBits/8)
+	copy(ip[len(ip)-len(b):], b)
+	return cnet.IP{ip}
 }
 
+// incrementIP returns the IP address that is increment addresses after ip,
+// with the same IP version as ip.  The addition carries across every byte of
+// the address.  Returns a nil IP if the result would overflow the address
+// space of the IP version.
 func incrementIP(ip cnet.IP, increment *big.Int) cnet.IP {
 	sum := big.NewInt(0).Add(ipToInt(ip), increment)
-	return intToIP(sum)
+	return intToIP(sum, getIPVersion(ip))
 }
 
-func ipToOrdinal(ip cnet.IP, b allocationBlock) int {
-	ip_int := ipToInt(ip)
-	base_int := ipToInt(cnet.IP{b.CIDR.IP})
-	ord := big.NewInt(0).Sub(ip_int, base_int).Int64()
-	if ord < 0 || ord >= blockSize {
-		// IP address not in the given block.
-		log.Fatalf("IP %s not in block %s", ip, b.CIDR)
+// ipsByValue sorts a slice of IPs in ascending numerical order.
+type ipsByValue []cnet.IP
+
+func (s ipsByValue) Len() int           { return len(s) }
+func (s ipsByValue) Less(i, j int) bool { return ipToInt(s[i]).Cmp(ipToInt(s[j])) < 0 }
+func (s ipsByValue) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// ipToOrdinal returns the ordinal of the IP within the block, that is its
+// offset from the base address of the block.  Returns an error if the IP is
+// not within the block.
+func ipToOrdinal(blockCIDR cnet.IPNet, ip cnet.IP) (int, error) {
+	if !blockCIDR.Contains(ip.IP) {
+		return 0, fmt.Errorf("IP %s not in block %s", ip, blockCIDR)
 	}
-	return int(ord)
+	base := cnet.IP{blockCIDR.IP.Mask(blockCIDR.Mask)}
+	ord := big.NewInt(0).Sub(ipToInt(ip), ipToInt(base))
+	return int(ord.Int64()), nil
 }
 
-func ordinalToIP(ord int, b allocationBlock) cnet.IP {
-	sum := big.NewInt(0).Add(ipToInt(cnet.IP{b.CIDR.IP}), big.NewInt(int64(ord)))
-	return intToIP(sum)
+// ordinalToIP returns the IP at the given ordinal within the block.  This is
+// the inverse of ipToOrdinal.
+func ordinalToIP(blockCIDR cnet.IPNet, ordinal int) cnet.IP {
+	base := cnet.IP{blockCIDR.IP.Mask(blockCIDR.Mask)}
+	return incrementIP(base, big.NewInt(int64(ordinal)))
 }
@@ -0,0 +1,107 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// defaultBlockDescriptionLimit is the largest number of addresses that
+// Describe lists individually.  Larger blocks are summarized.
+const defaultBlockDescriptionLimit = 256
+
+// BlockDescription is a readable view of an allocation block, for display
+// and debugging.
+type BlockDescription struct {
+	CIDR cnet.IPNet
+
+	// Affinity is the block's affinity, for example "host:host-a", or empty
+	// if the block has no affinity.
+	Affinity       string
+	StrictAffinity bool
+
+	// Shared is set if the block is shared by every host.
+	Shared bool
+
+	NumAddresses int
+	NumAllocated int
+	NumFree      int
+
+	// Summarized is set if the block has too many addresses to list, in
+	// which case only the counts are filled in and Addresses is nil.
+	Summarized bool
+
+	// Addresses describes each address in the block, in ordinal order.
+	Addresses []AddressDescription
+}
+
+// AddressDescription describes a single address within a BlockDescription.
+// The handle and attributes are only set if the address is allocated.
+type AddressDescription struct {
+	IP         cnet.IP
+	Allocated  bool
+	Handle     string
+	Attributes map[string]string
+}
+
+// Describe returns a readable view of the block.  Blocks with more than
+// defaultBlockDescriptionLimit addresses are summarized.
+func (b allocationBlock) Describe() BlockDescription {
+	return b.describe(defaultBlockDescriptionLimit)
+}
+
+// describe returns a readable view of the block, listing each address unless
+// the block has more than limit addresses, in which case it is summarized.
+func (b allocationBlock) describe(limit int) BlockDescription {
+	d := BlockDescription{
+		CIDR:           b.CIDR,
+		StrictAffinity: b.StrictAffinity,
+		Shared:         b.Shared,
+		NumAddresses:   b.numAddresses(),
+		NumFree:        b.numFreeAddresses(),
+	}
+	if b.Affinity != nil {
+		d.Affinity = *b.Affinity
+	}
+	for _, a := range b.Allocations {
+		if a != nil {
+			d.NumAllocated++
+		}
+	}
+	if d.NumAddresses > limit {
+		d.Summarized = true
+		return d
+	}
+
+	d.Addresses = make([]AddressDescription, d.NumAddresses)
+	for o := 0; o < d.NumAddresses; o++ {
+		d.Addresses[o] = AddressDescription{IP: ordinalToIP(b.CIDR, o)}
+		if b.Allocations[o] == nil {
+			continue
+		}
+		attr := b.Attributes[*b.Allocations[o]]
+		d.Addresses[o].Allocated = true
+		if attr.AttrPrimary != nil {
+			d.Addresses[o].Handle = *attr.AttrPrimary
+		}
+		if attr.AttrSecondary != nil {
+			d.Addresses[o].Attributes = map[string]string{}
+			for k, v := range attr.AttrSecondary {
+				d.Addresses[o].Attributes[k] = v
+			}
+		}
+	}
+	return d
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+var _ = Describe("Allocation block description", func() {
+	handle := "handle-1"
+	attrs := map[string]string{"pod": "pod-1"}
+
+	It("should describe each address of a small block", func() {
+		b := newBlock(cnet.MustParseNetwork("10.0.0.0/30"))
+		affinity := "host:host-a"
+		b.Affinity = &affinity
+		b.StrictAffinity = true
+		Expect(b.assign(cnet.MustParseIP("10.0.0.1"), &handle, attrs, "host-a")).To(Succeed())
+
+		d := b.Describe()
+		Expect(d.CIDR.String()).To(Equal("10.0.0.0/30"))
+		Expect(d.Affinity).To(Equal("host:host-a"))
+		Expect(d.StrictAffinity).To(BeTrue())
+		Expect(d.NumAddresses).To(Equal(4))
+		Expect(d.NumAllocated).To(Equal(1))
+		Expect(d.NumFree).To(Equal(3))
+		Expect(d.Summarized).To(BeFalse())
+		Expect(d.Addresses).To(HaveLen(4))
+
+		Expect(d.Addresses[0].IP.String()).To(Equal("10.0.0.0"))
+		Expect(d.Addresses[0].Allocated).To(BeFalse())
+		Expect(d.Addresses[0].Handle).To(BeEmpty())
+		Expect(d.Addresses[1].IP.String()).To(Equal("10.0.0.1"))
+		Expect(d.Addresses[1].Allocated).To(BeTrue())
+		Expect(d.Addresses[1].Handle).To(Equal("handle-1"))
+		Expect(d.Addresses[1].Attributes).To(Equal(attrs))
+		Expect(d.Addresses[3].IP.String()).To(Equal("10.0.0.3"))
+
+		// The description does not share the block's attributes.
+		d.Addresses[1].Attributes["pod"] = "pod-2"
+		Expect(attrs["pod"]).To(Equal("pod-1"))
+	})
+
+	It("should summarize a block with more addresses than the limit", func() {
+		b := newBlock(cnet.MustParseNetwork("10.0.0.0/26"))
+		Expect(b.assign(cnet.MustParseIP("10.0.0.1"), &handle, attrs, "host-a")).To(Succeed())
+		Expect(b.assign(cnet.MustParseIP("10.0.0.2"), nil, nil, "host-a")).To(Succeed())
+
+		d := b.describe(16)
+		Expect(d.Summarized).To(BeTrue())
+		Expect(d.Addresses).To(BeNil())
+		Expect(d.Affinity).To(BeEmpty())
+		Expect(d.NumAddresses).To(Equal(64))
+		Expect(d.NumAllocated).To(Equal(2))
+		Expect(d.NumFree).To(Equal(62))
+	})
+
+	It("should describe an IPv6 block", func() {
+		b := newBlock(cnet.MustParseNetwork("fd00::/126"))
+		d := b.Describe()
+		Expect(d.Addresses).To(HaveLen(4))
+		Expect(d.Addresses[3].IP.String()).To(Equal("fd00::3"))
+	})
+})
@@ -0,0 +1,75 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"sync"
+
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// blockLocks is an in-process advisory lock for each block, keyed by block
+// CIDR.  Goroutines sharing a client take a block's lock before reading and
+// writing the block, so that they take turns rather than all reading the
+// same revision and all but one failing the compare-and-swap.  It is only an
+// optimization: the compare-and-swap still guards against other processes.
+// A block's entry is removed once no goroutine holds or waits for its lock,
+// so only the blocks in use have entries.  It is safe for concurrent use.  A
+// nil *blockLocks locks nothing.
+type blockLocks struct {
+	lock  sync.Mutex
+	locks map[string]*blockLock
+}
+
+type blockLock struct {
+	sync.Mutex
+
+	// refs is the number of goroutines holding or waiting for the lock.
+	// It is guarded by blockLocks.lock.
+	refs int
+}
+
+func newBlockLocks() *blockLocks {
+	return &blockLocks{locks: map[string]*blockLock{}}
+}
+
+// lockBlock takes the lock of the block, waiting for any other goroutine
+// holding it, and returns a function which releases it.
+func (l *blockLocks) lockBlock(cidr cnet.IPNet) func() {
+	if l == nil {
+		return func() {}
+	}
+
+	key := cidr.String()
+	l.lock.Lock()
+	bl, ok := l.locks[key]
+	if !ok {
+		bl = &blockLock{}
+		l.locks[key] = bl
+	}
+	bl.refs++
+	l.lock.Unlock()
+
+	bl.Lock()
+	return func() {
+		bl.Unlock()
+		l.lock.Lock()
+		bl.refs--
+		if bl.refs == 0 {
+			delete(l.locks, key)
+		}
+		l.lock.Unlock()
+	}
+}
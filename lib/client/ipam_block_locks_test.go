@@ -0,0 +1,179 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// size returns the number of blocks with an entry, so that tests can check
+// that the entries are removed.
+func (l *blockLocks) size() int {
+	if l == nil {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.locks)
+}
+
+// casCountingBackend is a fakeBlockBackend which counts the compare-and-swap
+// updates of blocks, and how many of them conflicted.  Reading a block takes
+// the given latency, as a round trip to a datastore would.
+type casCountingBackend struct {
+	*fakeBlockBackend
+	latency   time.Duration
+	updates   int64
+	conflicts int64
+}
+
+func (c *casCountingBackend) Get(k model.Key) (*model.KVPair, error) {
+	kvp, err := c.fakeBlockBackend.Get(k)
+	if _, ok := k.(model.BlockKey); ok {
+		time.Sleep(c.latency)
+	}
+	return kvp, err
+}
+
+func (c *casCountingBackend) Update(kvp *model.KVPair) (*model.KVPair, error) {
+	updated, err := c.fakeBlockBackend.Update(kvp)
+	if _, ok := kvp.Key.(model.BlockKey); ok {
+		atomic.AddInt64(&c.updates, 1)
+		if errors.IsRetryable(err) {
+			atomic.AddInt64(&c.conflicts, 1)
+		}
+	}
+	return updated, err
+}
+
+var _ = Describe("blockLocks", func() {
+	blockA := cnet.MustParseNetwork("10.0.0.0/26")
+	blockB := cnet.MustParseNetwork("10.0.0.64/26")
+
+	It("should serialize the holders of a block's lock", func() {
+		locks := newBlockLocks()
+		var wg sync.WaitGroup
+		var held, maxHeld int32
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				unlock := locks.lockBlock(blockA)
+				n := atomic.AddInt32(&held, 1)
+				for {
+					m := atomic.LoadInt32(&maxHeld)
+					if n <= m || atomic.CompareAndSwapInt32(&maxHeld, m, n) {
+						break
+					}
+				}
+				atomic.AddInt32(&held, -1)
+				unlock()
+			}()
+		}
+		wg.Wait()
+		Expect(maxHeld).To(Equal(int32(1)))
+	})
+
+	It("should not hold the lock of one block against another", func() {
+		locks := newBlockLocks()
+		unlockA := locks.lockBlock(blockA)
+		unlockB := locks.lockBlock(blockB)
+		Expect(locks.size()).To(Equal(2))
+		unlockB()
+		unlockA()
+	})
+
+	It("should remove a block's entry once its lock is released", func() {
+		locks := newBlockLocks()
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(block cnet.IPNet) {
+				defer wg.Done()
+				locks.lockBlock(block)()
+			}([]cnet.IPNet{blockA, blockB}[i%2])
+		}
+		wg.Wait()
+		Expect(locks.size()).To(Equal(0))
+	})
+
+	It("should lock nothing if nil", func() {
+		var locks *blockLocks
+		locks.lockBlock(blockA)()
+		Expect(locks.size()).To(Equal(0))
+	})
+})
+
+// benchmarkBlockContention has many goroutines on one host assign and
+// release an address from the same block at once, reporting the block
+// compare-and-swap attempts and conflicts per address, and the fraction of
+// assignments or releases that failed, for example by running out of
+// retries.
+func benchmarkBlockContention(b *testing.B, locks *blockLocks) {
+	const workers = 16
+	backend := newFakeBlockBackend()
+	backend.storePool("10.0.0.0/24", false)
+	counting := &casCountingBackend{fakeBlockBackend: backend, latency: time.Millisecond}
+	ic := newIPAM(&Client{Backend: counting, blockLocks: locks})
+	if err := ic.blockReaderWriter.claimBlockAffinity(cnet.MustParseNetwork("10.0.0.0/26"), "host-a", IPAMConfig{}); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	var failures int64
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < b.N; i += workers {
+				handle := fmt.Sprintf("handle-%d", i)
+				ips, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, HandleID: &handle, Hostname: "host-a"})
+				if err != nil || len(ips) != 1 {
+					atomic.AddInt64(&failures, 1)
+					continue
+				}
+				if err := ic.ReleaseByHandle(handle); err != nil {
+					atomic.AddInt64(&failures, 1)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	b.ReportMetric(float64(counting.updates)/float64(b.N), "cas/op")
+	b.ReportMetric(float64(counting.conflicts)/float64(b.N), "conflicts/op")
+	b.ReportMetric(float64(failures)/float64(b.N), "failures/op")
+}
+
+func BenchmarkBlockContentionUnlocked(b *testing.B) {
+	benchmarkBlockContention(b, nil)
+}
+
+func BenchmarkBlockContentionLocked(b *testing.B) {
+	benchmarkBlockContention(b, newBlockLocks())
+}
@@ -15,39 +15,79 @@
 package client
 
 import (
+	"bytes"
 	goerrors "errors"
 	"hash/fnv"
 	"math/big"
 	"math/rand"
 	"net"
-	"reflect"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
 
 	"fmt"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/projectcalico/libcalico-go/lib/api"
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
 	"github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/ipip"
 	cnet "github.com/projectcalico/libcalico-go/lib/net"
 )
 
 type blockReaderWriter struct {
 	client *Client
+
+	// requestID is the ID of the IPAM request being served, logged with
+	// each line logged by the request.  It is empty outside of a request.
+	requestID string
+
+	// leaseExpiry is the expiry of the lease of the addresses assigned by
+	// the request being served, or nil if they are assigned without one.
+	leaseExpiry *time.Time
+
+	// config is the IPAM configuration read by the request being served,
+	// or nil if it has not been read.  See ipamConfig.
+	config *IPAMConfig
 }
 
+// getAffineBlocks returns the CIDRs of the blocks of the given IP version that
+// are affine to the host.  If pools are specified, only blocks that lie within
+// one of the pools are returned, and pools of the other IP version never match.
+// Affinities which the datastore could not read are skipped.
 func (rw blockReaderWriter) getAffineBlocks(host string, ver ipVersion, pools []cnet.IPNet) ([]cnet.IPNet, error) {
+	ver, err := ver.normalize()
+	if err != nil {
+		return nil, err
+	}
+
 	// Lookup all blocks by providing an empty BlockListOptions
 	// to the List operation.
 	opts := model.BlockAffinityListOptions{Host: host, IPVersion: ver.Number}
-	datastoreObjs, err := rw.client.Backend.List(opts)
+	datastoreObjs, err := rw.listAll(opts, ipamListPageSize)
+	if errors.IsPartialList(err) {
+		// Carry on with the affinities we could read.  The blocks of the
+		// others are not used until they can be read again.
+		rw.requestLog().WithFields(log.Fields{
+			"host":    host,
+			"version": ver.Number,
+		}).WithError(err).Warning("Some block affinities could not be read, ignoring them")
+		err = nil
+	}
 	if err != nil {
-		if _, ok := err.(errors.ErrorResourceDoesNotExist); ok {
+		if errors.IsNotExist(err) {
 			// The block path does not exist yet.  This is OK - it means
 			// there are no affine blocks.
 			return []cnet.IPNet{}, nil
 
 		} else {
-			log.Errorf("Error getting affine blocks: %s", err)
+			rw.requestLog().WithFields(log.Fields{
+				"host":    host,
+				"version": ver.Number,
+			}).WithError(err).Error("Error getting affine blocks")
 			return nil, err
 		}
 	}
@@ -59,287 +99,2141 @@ func (rw blockReaderWriter) getAffineBlocks(host string, ver ipVersion, pools []
 
 		// Add the block if no IP pools were specified, or if IP pools were specified
 		// and the block falls within the given IP pools.
-		if len(pools) == 0 {
+		if len(pools) == 0 || blockInPools(k.CIDR, ver, pools) {
 			ids = append(ids, k.CIDR)
-		} else {
-			for _, pool := range pools {
-				if pool.Contains(k.CIDR.IPNet.IP) {
-					ids = append(ids, k.CIDR)
-					break
-				}
-			}
 		}
 	}
 	return ids, nil
 }
 
-func (rw blockReaderWriter) claimNewAffineBlock(host string, version ipVersion, requestedPools []cnet.IPNet, config IPAMConfig) (*cnet.IPNet, error) {
+// blockOwnershipByHost returns the number of blocks of the given IP version
+// that are affine to each host.  If a pool is given, only blocks within the
+// pool are counted.  Blocks without a host affinity are counted under the
+// empty host name.
+func (rw blockReaderWriter) blockOwnershipByHost(pool *cnet.IPNet, version ipVersion) (map[string]int, error) {
+	var pools []cnet.IPNet
+	if pool != nil {
+		pools = []cnet.IPNet{*pool}
+	}
+	inScope := func(cidr cnet.IPNet) bool {
+		return pool == nil || blockInPools(cidr, version, pools)
+	}
+	logContext := rw.requestLog().WithField("version", version.Number)
+
+	// Tally the affinities of every host.
+	owned := map[string]int{}
+	affinities, err := rw.listAll(model.BlockAffinityListOptions{IPVersion: version.Number}, ipamListPageSize)
+	if err != nil && !errors.IsNotExist(err) {
+		logContext.WithError(err).Error("Error listing block affinities")
+		return nil, err
+	}
+	for _, o := range affinities {
+		k := o.Key.(model.BlockAffinityKey)
+		if inScope(k.CIDR) {
+			owned[k.Host]++
+		}
+	}
+
+	// Blocks without affinity have no affinity entry, so find them from the
+	// blocks themselves.
+	blockOpts := model.BlockListOptions{IPVersion: version.Number}
+	if pool != nil {
+		blockOpts.Pool = *pool
+	}
+	blocks, err := rw.listAll(blockOpts, ipamListPageSize)
+	if err != nil && !errors.IsNotExist(err) {
+		logContext.WithError(err).Error("Error listing blocks")
+		return nil, err
+	}
+	for _, o := range blocks {
+		b := o.Value.(*model.AllocationBlock)
+		if _, ok := blockAffinityHost(b); !ok && inScope(b.CIDR) {
+			owned[""]++
+		}
+	}
+	return owned, nil
+}
+
+// blockInPools returns true if the block lies entirely within one of the
+// pools of the given IP version.
+func blockInPools(block cnet.IPNet, ver ipVersion, pools []cnet.IPNet) bool {
+	blockOnes, _ := block.Mask.Size()
+	for _, pool := range pools {
+		if pool.Version() != ver.Number {
+			continue
+		}
+		poolOnes, _ := pool.Mask.Size()
+		if pool.Contains(block.IP) && blockOnes >= poolOnes {
+			return true
+		}
+	}
+	return false
+}
+
+// listAll lists all entries matching the supplied list options, reading
+// them from the datastore a page at a time.  The entries are returned in
+// ipamKeyOrder, so the order does not depend on the datastore.  If some of
+// the entries could not be read, the others are still returned, along with
+// an ErrorPartialList covering every page.
+func (rw blockReaderWriter) listAll(l model.ListInterface, pageSize int) ([]*model.KVPair, error) {
+	kvps := []*model.KVPair{}
+	unread := []error{}
+	token := ""
+	for {
+		page, next, err := rw.client.Backend.ListPage(l, pageSize, token)
+		if err != nil {
+			partial, ok := err.(errors.ErrorPartialList)
+			if !ok {
+				return nil, err
+			}
+			unread = append(unread, partial.Errs...)
+		}
+		kvps = append(kvps, page...)
+		if next == "" {
+			sort.Sort(ipamKeyOrder(kvps))
+			if len(unread) > 0 {
+				return kvps, errors.ErrorPartialList{Identifier: l, Errs: unread}
+			}
+			return kvps, nil
+		}
+		token = next
+	}
+}
+
+// ipamKeyOrder sorts KVPairs by their keys.  Blocks are sorted by CIDR, and
+// block affinities by host and then CIDR.  CIDRs are sorted by IP version,
+// then address, then prefix length.  Other keys are sorted by their string
+// form.
+type ipamKeyOrder []*model.KVPair
+
+func (s ipamKeyOrder) Len() int      { return len(s) }
+func (s ipamKeyOrder) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s ipamKeyOrder) Less(i, j int) bool {
+	switch ki := s[i].Key.(type) {
+	case model.BlockKey:
+		if kj, ok := s[j].Key.(model.BlockKey); ok {
+			return compareCIDRs(ki.CIDR, kj.CIDR) < 0
+		}
+	case model.BlockAffinityKey:
+		if kj, ok := s[j].Key.(model.BlockAffinityKey); ok {
+			if ki.Host != kj.Host {
+				return ki.Host < kj.Host
+			}
+			return compareCIDRs(ki.CIDR, kj.CIDR) < 0
+		}
+	}
+	return s[i].Key.String() < s[j].Key.String()
+}
+
+// compareCIDRs returns an integer comparing two CIDRs by IP version, then
+// address, then prefix length.  The result is 0 if a == b, -1 if a < b, and
+// +1 if a > b.
+func compareCIDRs(a, b cnet.IPNet) int {
+	if a.Version() != b.Version() {
+		if a.Version() < b.Version() {
+			return -1
+		}
+		return 1
+	}
+	if c := bytes.Compare(a.IP.To16(), b.IP.To16()); c != 0 {
+		return c
+	}
+	aOnes, _ := a.Mask.Size()
+	bOnes, _ := b.Mask.Size()
+	if aOnes != bOnes {
+		if aOnes < bOnes {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// claimNewAffineBlock claims a new block with affinity to the host from the
+// requested pools, or from all enabled pools of the IP version if none are
+// requested.  Pools in the host's zone, if given, are tried before pools in
+// other zones.  If config is nil, the global IPAM configuration is used.
+func (rw blockReaderWriter) claimNewAffineBlock(host, zone string, version ipVersion, requestedPools []cnet.IPNet, config *IPAMConfig) (*cnet.IPNet, error) {
+	return rw.claimNewAffineBlockWith(host, zone, version, requestedPools, config, func(subnet cnet.IPNet, pool *cnet.IPNet, config IPAMConfig) error {
+		return rw.claimBlockAffinityFromPool(subnet, pool, host, config)
+	})
+}
+
+// claimNewAffineBlockWith chooses a new block for the host as
+// claimNewAffineBlock does, and claims it by calling claim with the block,
+// the pool it is claimed from and the IPAM configuration.
+func (rw blockReaderWriter) claimNewAffineBlockWith(host, zone string, version ipVersion, requestedPools []cnet.IPNet, config *IPAMConfig,
+	claim func(subnet cnet.IPNet, pool *cnet.IPNet, config IPAMConfig) error) (*cnet.IPNet, error) {
+	version, err := version.normalize()
+	if err != nil {
+		return nil, err
+	}
+	logContext := rw.requestLog().WithFields(log.Fields{
+		"host":    host,
+		"version": version.Number,
+	})
+
+	if config == nil {
+		var err error
+		config, err = rw.ipamConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// If requestedPools is not empty, use it.  Otherwise, default to
 	// all configured pools.
 	pools := []cnet.IPNet{}
 
-	// Get all the configured pools.
-	allPools, err := rw.client.IPPools().List(api.IPPoolMetadata{})
+	// Get all the configured pools, creating the default pool if there are
+	// none and no pools were requested.
+	createVersions := []ipVersion{}
+	if len(requestedPools) == 0 {
+		createVersions = append(createVersions, version)
+	}
+	allPools, err := rw.listPoolsOrCreateDefault(config, createVersions...)
 	if err != nil {
-		log.Errorf("Error reading configured pools: %s", err)
+		logContext.WithError(err).Error("Error reading configured pools")
 		return nil, err
 	}
 
+	// Requested pools are tried in the order they were requested.
+	if len(requestedPools) == 0 {
+		pools = enabledPools(allPools.Items, version)
+	} else {
+		enabled := enabledPools(allPools.Items, version)
+		for _, rp := range requestedPools {
+			for _, p := range enabled {
+				if p.Equal(rp) {
+					pools = append(pools, p)
+					break
+				}
+			}
+		}
+	}
+
+	// Count the candidate pools of this version, enabled or not, so that if
+	// there are none to claim from we can say why.
+	numForVersion := 0
 	for _, p := range allPools.Items {
-		// Only include pools that are not disabled and are the correct version.
-		if !p.Spec.Disabled && version.Number == p.Metadata.CIDR.Version() && isPoolInRequestedPools(p.Metadata.CIDR, requestedPools) {
-			pools = append(pools, p.Metadata.CIDR)
+		if p.Metadata.CIDR.Version() == version.Number && isPoolInRequestedPools(p.Metadata.CIDR, requestedPools) {
+			numForVersion++
 		}
 	}
 
 	// Build a map so we can lookup existing pools.
-	pm := map[string]bool{}
+	pm := map[string]api.IPPool{}
 	for _, ap := range allPools.Items {
-		pm[ap.Metadata.CIDR.String()] = true
+		pm[ap.Metadata.CIDR.String()] = ap
 	}
 
-	// Make sure each requested pool exists.
+	// Make sure each requested pool exists and is enabled.  The requested
+	// pool may have host bits set, so compare its network address.
 	for _, rp := range requestedPools {
-		if _, ok := pm[rp.String()]; !ok {
+		p, ok := pm[poolNetwork(rp).String()]
+		if !ok {
 			// The requested pool doesn't exist.
 			return nil, fmt.Errorf("The given pool (%s) does not exist", rp.IPNet.String())
 		}
+		if p.Spec.Disabled {
+			return nil, poolDisabledError{Pool: rp}
+		}
 	}
 
 	// If there are no pools, we cannot assign addresses.
 	if len(pools) == 0 {
-		return nil, goerrors.New("No configured Calico pools")
+		if len(allPools.Items) == 0 {
+			return nil, noPoolsError{}
+		} else if numForVersion == 0 {
+			return nil, noPoolsForVersionError{Version: version.Number}
+		}
+		return nil, poolsDisabledError{Version: version.Number}
+	}
+
+	// Only claim blocks from the pools whose node selector selects this
+	// host.
+	pools, err = rw.poolsSelectingHost(pools, allPools.Items, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(pools) == 0 {
+		return nil, fmt.Errorf("No configured Calico pools select host '%s'", host)
+	}
+
+	// Order the pools by the configured distribution.  When no pools were
+	// requested, start from the lowest CIDR first so that the order does not
+	// depend on the order the pools were listed in.  Then try the pools in
+	// this host's zone before other zones, and the pools that prefer this
+	// host before any others.
+	if len(requestedPools) == 0 {
+		sort.Sort(poolsByCIDR(pools))
+	}
+	// List the blocks claimed in every pool once, rather than once for each
+	// pool tried.  If they can't be listed, each pool is checked block by
+	// block.
+	claimed, err := rw.claimedBlocks(version)
+	if err != nil {
+		logContext.WithError(err).Warning("Unable to list claimed blocks, checking each block")
+		claimed = nil
+	}
+	switch config.PoolDistribution {
+	case PoolDistributionBalanced:
+		if claimed == nil {
+			break
+		}
+		pools, err = rw.mostFreeBlocksFirst(pools, *config, claimed)
+		if err != nil {
+			return nil, err
+		}
+	case PoolDistributionPriority:
+		pools = highestPriorityFirst(pools, allPools.Items)
+	}
+	pools = sameZonePoolsFirst(pools, allPools.Items, zone)
+	pools = preferredPoolsFirst(pools, allPools.Items, host)
+
+	// Check that this host hasn't already claimed the maximum number
+	// of blocks for this IP version.
+	if config.MaxBlocksPerHost > 0 {
+		affBlocks, err := rw.getAffineBlocks(host, version, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(affBlocks) >= config.MaxBlocksPerHost {
+			logContext.WithFields(log.Fields{
+				"blocks": len(affBlocks),
+				"max":    config.MaxBlocksPerHost,
+			}).Info("Host has reached the maximum number of affine blocks")
+			return nil, maxBlocksExceededError(fmt.Sprintf("Host '%s' has reached the maximum of %d IPv%d blocks", host, config.MaxBlocksPerHost, version.Number))
+		}
 	}
 
 	// Iterate through pools to find a new block.
-	log.Infof("Claiming a new affine block for host '%s'", host)
+	logContext.Info("Claiming a new affine block")
+	var disabled *cnet.IPNet
 	for _, pool := range pools {
-		// Use a block generator to iterate through all of the blocks
-		// that fall within the pool.
-		blocks := randomBlockGenerator(pool, host)
-		for subnet := blocks(); subnet != nil; subnet = blocks() {
-			// Check if a block already exists for this subnet.
-			log.Debugf("Getting block: %s", subnet.String())
-			key := model.BlockKey{CIDR: *subnet}
-			_, err := rw.client.Backend.Get(key)
-			if err != nil {
-				if _, ok := err.(errors.ErrorResourceDoesNotExist); ok {
-					// The block does not yet exist in etcd.  Try to grab it.
-					log.Debugf("Found free block: %+v", *subnet)
-					err = rw.claimBlockAffinity(*subnet, host, config)
-					return subnet, err
-				} else {
-					log.Errorf("Error getting block: %s", err)
-					return nil, err
-				}
+		poolContext := logContext.WithField("cidr", pool.String())
+		subnet, err := rw.nextFreeBlock(host, pool, *config, claimed)
+		if err != nil {
+			if _, ok := err.(noFreeBlocksError); ok {
+				continue
 			}
+			return nil, err
+		}
+
+		// The pool may have been disabled since we listed the pools, so
+		// check it again before we try to grab the block.
+		enabled, err := rw.poolEnabled(pool)
+		if err != nil {
+			return nil, err
 		}
+		if !enabled {
+			poolContext.Warning("Pool is no longer enabled, not claiming blocks from it")
+			p := pool
+			disabled = &p
+			continue
+		}
+		poolContext.WithField("blockCIDR", subnet.String()).Debug("Found free block")
+		p := pool
+		err = claim(*subnet, &p, *config)
+		return subnet, err
+	}
+	if disabled != nil {
+		return nil, poolDisabledError{Pool: *disabled}
 	}
 	return nil, noFreeBlocksError("No Free Blocks")
 }
 
-// isPoolInRequestedPools checks if the IP Pool that is passed in belongs to the list of IP Pools
-// that should be used for assigning IPs from.
-func isPoolInRequestedPools(pool cnet.IPNet, requestedPools []cnet.IPNet) bool {
-	if len(requestedPools) == 0 {
-		return true
+// nextFreeBlock returns the CIDR of the first block in the pool, in the order
+// the host walks the pool's blocks, that does not yet exist.  claimed holds
+// the blocks listed by claimedBlocks, or is nil if they couldn't be listed.
+// Nothing is written, so the block may have been claimed by another host by
+// the time the caller tries to claim it.  Returns a noFreeBlocksError if
+// every block in the pool exists.
+func (rw blockReaderWriter) nextFreeBlock(host string, pool cnet.IPNet, config IPAMConfig, claimed []cnet.IPNet) (*cnet.IPNet, error) {
+	logContext := rw.requestLog().WithFields(log.Fields{
+		"host": host,
+		"cidr": pool.String(),
+	})
+	prefix, err := rw.blockPrefixLengthForCIDR(pool, config)
+	if err != nil {
+		return nil, err
 	}
-	for _, cidr := range requestedPools {
-		if reflect.DeepEqual(pool, cidr) {
-			return true
+
+	// Only consider the blocks which were not listed as existing or
+	// reserved, rather than reading every block in the pool.  The list is a
+	// snapshot, and another host may claim the block we return before we
+	// do, in which case the claim fails and the caller tries again.
+	excluded, err := rw.excludedCIDRs(pool)
+	if err != nil {
+		return nil, err
+	}
+	blocks := excludingBlockGenerator(newBlockGenerator(config.AssignmentStrategy, pool, prefix, host), excluded)
+	if claimed != nil {
+		if !hasFreeBlocks(pool, prefix, claimed) {
+			logContext.Info("Pool has no free blocks")
+			return nil, noFreeBlocksError(fmt.Sprintf("No free blocks in pool %s", pool))
+		}
+		if subnet := unclaimedBlockGenerator(blocks, claimed)(); subnet != nil {
+			return subnet, nil
 		}
+		return nil, noFreeBlocksError(fmt.Sprintf("No free blocks in pool %s", pool))
 	}
-	return false
-}
 
-func (rw blockReaderWriter) claimBlockAffinity(subnet cnet.IPNet, host string, config IPAMConfig) error {
-	// Claim the block affinity for this host.  See model.BlockAffinityValue
-	// for details on the hard-coded value that is used.
-	log.Infof("Host %s claiming block affinity for %s", host, subnet)
-	obj := model.KVPair{
-		Key:   model.BlockAffinityKey{Host: host, CIDR: subnet},
-		Value: model.BlockAffinityValue,
+	// The blocks weren't listed, so fall back to checking whether each
+	// block in the pool exists in turn.  A reserved block can't be found
+	// this way, but if we claim one, the host that reserved it finds the
+	// block exists when it comes to create it, and releases its affinity.
+	logContext.Debug("Checking each block in pool")
+	for subnet := blocks(); subnet != nil; subnet = blocks() {
+		// Check if a block already exists for this subnet.
+		blockContext := logContext.WithField("blockCIDR", subnet.String())
+		blockContext.Debug("Getting block")
+		_, err := rw.client.Backend.Get(model.BlockKey{CIDR: *subnet})
+		if err != nil {
+			if errors.IsNotExist(err) {
+				// The block does not yet exist in etcd.
+				return subnet, nil
+			}
+			blockContext.WithError(err).Error("Error getting block")
+			return nil, err
+		}
 	}
-	_, err := rw.client.Backend.Create(&obj)
+	return nil, noFreeBlocksError(fmt.Sprintf("No free blocks in pool %s", pool))
+}
 
-	// Create the new block.
-	block := newBlock(subnet)
+// fullPoolsForHost returns the CIDRs of the enabled pools of the given IP
+// version from which the host cannot claim a new block, either because every
+// block in the pool exists, because the pool's node selector does not select
+// the host or because the host has reached the configured maximum number of
+// blocks.  Returns an empty slice if the host can claim a
+// block from every pool.  The result is a snapshot, and blocks may be claimed
+// or released by other hosts at any time.
+func (rw blockReaderWriter) fullPoolsForHost(host string, version ipVersion) ([]cnet.IPNet, error) {
+	config, err := rw.ipamConfig()
+	if err != nil {
+		return nil, err
+	}
+	allPools, err := rw.listPools()
+	if err != nil {
+		return nil, err
+	}
+	pools := enabledPools(allPools.Items, version)
 
-	// Make sure hostname is not empty.
-	if host == "" {
-		log.Errorf("Hostname can't be empty")
-		return goerrors.New("Hostname must be sepcified to claim block affinity")
+	// If the host has reached its block cap, it can't claim a block from
+	// any pool.
+	if config.MaxBlocksPerHost > 0 {
+		affBlocks, err := rw.getAffineBlocks(host, version, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(affBlocks) >= config.MaxBlocksPerHost {
+			return pools, nil
+		}
 	}
-	affinityKeyStr := "host:" + host
-	block.Affinity = &affinityKeyStr
-	block.StrictAffinity = config.StrictAffinity
 
-	// Create the new block in the datastore.
-	o := model.KVPair{
-		Key:   model.BlockKey{block.CIDR},
-		Value: block.AllocationBlock,
+	selected, err := rw.poolsSelectingHost(pools, allPools.Items, host)
+	if err != nil {
+		return nil, err
+	}
+	isSelected := map[string]bool{}
+	for _, pool := range selected {
+		isSelected[pool.String()] = true
 	}
-	_, err = rw.client.Backend.Create(&o)
+	claimed, err := rw.claimedBlocks(version)
 	if err != nil {
-		if _, ok := err.(errors.ErrorResourceAlreadyExists); ok {
-			// Block already exists, check affinity.
-			log.Warningf("Problem claiming block affinity:", err)
-			obj, err := rw.client.Backend.Get(model.BlockKey{subnet})
-			if err != nil {
-				log.Errorf("Error reading block:", err)
-				return err
-			}
-
-			// Pull out the allocationBlock object.
-			b := allocationBlock{obj.Value.(*model.AllocationBlock)}
-
-			if b.Affinity != nil && *b.Affinity == affinityKeyStr {
-				// Block has affinity to this host, meaning another
-				// process on this host claimed it.
-				log.Debugf("Block %s already claimed by us.  Success", subnet)
-				return nil
-			}
-
-			// Some other host beat us to this block.  Cleanup and return error.
-			err = rw.client.Backend.Delete(&model.KVPair{
-				Key: model.BlockAffinityKey{Host: host, CIDR: b.CIDR},
-			})
-			if err != nil {
-				log.Errorf("Error cleaning up block affinity: %s", err)
-				return err
+		return nil, err
+	}
+	full := []cnet.IPNet{}
+	for _, pool := range pools {
+		if !isSelected[pool.String()] {
+			full = append(full, pool)
+			continue
+		}
+		if _, err := rw.nextFreeBlock(host, pool, *config, claimed); err != nil {
+			if _, ok := err.(noFreeBlocksError); ok {
+				full = append(full, pool)
+				continue
 			}
-			return affinityClaimedError{Block: b}
-		} else {
-			return err
+			return nil, err
 		}
 	}
-	return nil
+	return full, nil
 }
 
-func (rw blockReaderWriter) releaseBlockAffinity(host string, blockCIDR cnet.IPNet) error {
-	for i := 0; i < ipamEtcdRetries; i++ {
-		// Read the model.KVPair containing the block
-		// and pull out the allocationBlock object.  We need to hold on to this
-		// so that we can pass it back to the datastore on Update.
-		obj, err := rw.client.Backend.Get(model.BlockKey{CIDR: blockCIDR})
-		if err != nil {
-			log.Errorf("Error getting block %s: %s", blockCIDR.String(), err)
-			return err
+// totalFreeAddresses returns the number of free addresses and the total
+// number of addresses in all pools of the given IP version.  The total is the
+// capacity of the pools, and an address is free unless it is assigned,
+// within one of the pools' excluded CIDRs, or one of the pools' reserved
+// addresses.  Blocks that don't exist are
+// entirely free, so the pools and blocks are each read with a single list
+// rather than by reading every block in the pools.
+func (rw blockReaderWriter) totalFreeAddresses(version ipVersion) (*big.Int, *big.Int, error) {
+	allPools, err := rw.listPools()
+	if err != nil {
+		rw.requestLog().WithError(err).Error("Error reading configured pools")
+		return nil, nil, err
+	}
+	pools := []cnet.IPNet{}
+	excluded := []cnet.IPNet{}
+	for _, p := range allPools.Items {
+		if p.Metadata.CIDR.Version() != version.Number {
+			continue
 		}
-		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
-
-		// Make sure hostname is not empty.
-		if host == "" {
-			log.Errorf("Hostname can't be empty")
-			return goerrors.New("Hostname must be sepcified to release block affinity")
+		pools = append(pools, normalizeNetwork(p.Metadata.CIDR))
+		for _, e := range p.Spec.ExcludedCIDRs {
+			excluded = append(excluded, normalizeNetwork(e))
 		}
+		excluded = append(excluded, reservedAddressCIDRs(p)...)
+	}
 
-		// Check that the block affinity matches the given affinity.
-		if b.Affinity != nil && !hostAffinityMatches(host, b.AllocationBlock) {
-			log.Errorf("Mismatched affinity: %s != %s", *b.Affinity, "host:"+host)
-			return affinityClaimedError{Block: b}
+	// A pool nested within another pool adds no capacity, and neither
+	// does an excluded CIDR or reserved address nested within another.
+	pools = outermostCIDRs(pools)
+	excluded = outermostCIDRs(excluded)
+	total := big.NewInt(0)
+	for _, p := range pools {
+		total.Add(total, numAddressesInCIDR(p))
+	}
+	free := new(big.Int).Set(total)
+	for _, e := range excluded {
+		free.Sub(free, numAddressesInCIDR(e))
+	}
+
+	kvps, err := rw.listAll(model.BlockListOptions{IPVersion: version.Number}, ipamListPageSize)
+	if err != nil && !errors.IsNotExist(err) {
+		return nil, nil, err
+	}
+	for _, kvp := range kvps {
+		b := allocationBlock{kvp.Value.(*model.AllocationBlock)}
+		if !blockInPools(b.CIDR, version, pools) {
+			continue
 		}
 
-		if b.empty() {
-			// If the block is empty, we can delete it.
-			err := rw.client.Backend.Delete(&model.KVPair{
-				Key: model.BlockKey{CIDR: b.CIDR},
-			})
-			if err != nil {
-				// Return the error unless the block didn't exist.
-				if _, ok := err.(errors.ErrorResourceDoesNotExist); !ok {
-					log.Errorf("Error deleting block: %s", err)
-					return err
-				}
+		// Excluded and reserved addresses have already been removed from
+		// the free count, so don't remove them again if they are assigned.
+		skip := b.excludedOrdinals(excluded)
+		assigned := 0
+		for o, a := range b.Allocations {
+			if a != nil && !skip[o] {
+				assigned++
 			}
-		} else {
-			// Otherwise, we need to remove affinity from it.
-			// This prevents the host from automatically assigning
-			// from this block unless we're allowed to overflow into
-			// non-affine blocks.
-			b.Affinity = nil
+		}
+		free.Sub(free, big.NewInt(int64(assigned)))
+	}
+	return free, total, nil
+}
 
-			// Pass back the original KVPair with the new
-			// block information so we can do a CAS.
-			obj.Value = b.AllocationBlock
-			_, err = rw.client.Backend.Update(obj)
-			if err != nil {
-				if _, ok := err.(errors.ErrorResourceUpdateConflict); ok {
-					// CASError - continue.
-					continue
-				} else {
-					return err
-				}
+// outermostCIDRs returns the given CIDRs, without any CIDR which is contained
+// within another.  Two CIDRs are either disjoint or one contains the other,
+// so the returned CIDRs are disjoint.
+func outermostCIDRs(cidrs []cnet.IPNet) []cnet.IPNet {
+	outermost := []cnet.IPNet{}
+	for i, c := range cidrs {
+		ones, _ := c.Mask.Size()
+		contained := false
+		for j, o := range cidrs {
+			oOnes, _ := o.Mask.Size()
+			if i == j || !o.Contains(c.IP) || oOnes > ones {
+				continue
 			}
+			// Keep the first of two identical CIDRs.
+			if oOnes < ones || j < i {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			outermost = append(outermost, c)
 		}
+	}
+	return outermost
+}
 
-		// We've removed / updated the block, so update the host config
-		// to remove the CIDR.
-		err = rw.client.Backend.Delete(&model.KVPair{
-			Key: model.BlockAffinityKey{Host: host, CIDR: b.CIDR},
-		})
+// numAddressesInCIDR returns the number of addresses in the CIDR.
+func numAddressesInCIDR(cidr cnet.IPNet) *big.Int {
+	ones, bits := cidr.Mask.Size()
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+}
+
+// poolEnabled reads the pool from the datastore and returns true if it exists
+// and is not disabled.
+func (rw blockReaderWriter) poolEnabled(pool cnet.IPNet) (bool, error) {
+	p, err := rw.client.IPPools().Get(api.IPPoolMetadata{CIDR: pool})
+	if err != nil {
+		if errors.IsNotExist(err) {
+			return false, nil
+		}
+		rw.requestLog().WithField("cidr", pool.String()).WithError(err).Error("Error reading pool")
+		return false, err
+	}
+	return !p.Spec.Disabled, nil
+}
+
+// listPools returns all of the configured IP pools.  The list may be cached,
+// and must not be modified.
+func (rw blockReaderWriter) listPools() (*api.IPPoolList, error) {
+	return rw.client.ipPoolCache.list(rw.client.readIPPools)
+}
+
+// listPoolsOrCreateDefault returns all of the configured IP pools.  If there
+// are none and AutoCreateDefaultPool is set, it first creates the default
+// pool, provided that the pool is of one of the given IP versions.
+func (rw blockReaderWriter) listPoolsOrCreateDefault(config *IPAMConfig, versions ...ipVersion) (*api.IPPoolList, error) {
+	allPools, err := rw.listPools()
+	if err != nil || len(allPools.Items) != 0 || !config.AutoCreateDefaultPool {
+		return allPools, err
+	}
+	for _, version := range versions {
+		created, err := rw.createDefaultPool(version, config)
 		if err != nil {
-			// Return the error unless the affinity didn't exist.
-			if _, ok := err.(errors.ErrorResourceDoesNotExist); !ok {
-				log.Errorf("Error deleting block affinity: %s", err)
-				return err
-			}
+			return nil, err
 		}
-		return nil
+		if created {
+			return rw.listPools()
+		}
+	}
+	return allPools, nil
+}
 
+// defaultPool returns the CIDR of the pool created when AutoCreateDefaultPool
+// is set.
+func (cfg IPAMConfig) defaultPool() cnet.IPNet {
+	if cfg.DefaultPoolCIDR != nil {
+		return *cfg.DefaultPoolCIDR
 	}
-	return goerrors.New("Max retries hit")
+	return defaultPoolCIDR
 }
 
-// withinConfiguredPools returns true if the given IP is within a configured
-// Calico pool, and false otherwise.
-func (rw blockReaderWriter) withinConfiguredPools(ip cnet.IP) bool {
-	allPools, _ := rw.client.IPPools().List(api.IPPoolMetadata{})
-	for _, p := range allPools.Items {
-		// Compare any enabled pools.
-		if !p.Spec.Disabled && p.Metadata.CIDR.Contains(ip.IP) {
-			return true
+// createDefaultPool creates the default pool from the IPAM configuration, if
+// it is of the given IP version.  Returns whether the pool now exists.  The
+// pool may have been created by another host since the pools were read, so
+// finding it already exists is not an error.
+func (rw blockReaderWriter) createDefaultPool(version ipVersion, config *IPAMConfig) (bool, error) {
+	cidr := config.defaultPool()
+	if cidr.Version() != version.Number {
+		return false, nil
+	}
+
+	logContext := rw.requestLog().WithField("pool", cidr.String())
+	_, err := rw.client.IPPools().Create(&api.IPPool{Metadata: api.IPPoolMetadata{CIDR: cidr}})
+	if err != nil {
+		if _, ok := err.(errors.ErrorResourceAlreadyExists); ok {
+			logContext.Info("Default pool has already been created")
+			return true, nil
 		}
+		logContext.WithError(err).Error("Error creating default pool")
+		return false, err
 	}
-	return false
+	logContext.Info("Created default pool")
+	return true, nil
 }
 
-// Generator to get list of block CIDRs which
-// fall within the given pool. Returns nil when no more
-// blocks can be generated.
-func blockGenerator(pool cnet.IPNet) func() *cnet.IPNet {
-	// Determine the IP type to use.
-	version := getIPVersion(cnet.IP{pool.IP})
-	ip := cnet.IP{pool.IP}
-	return func() *cnet.IPNet {
-		returnIP := ip
-		if pool.Contains(ip.IP) {
-			ipnet := net.IPNet{returnIP.IP, version.BlockPrefixMask}
-			cidr := cnet.IPNet{ipnet}
-			ip = incrementIP(ip, big.NewInt(blockSize))
-			return &cidr
-		} else {
-			return nil
+// getIPAMConfig returns the global IPAM configuration.  If no IPAM
+// configuration has been set, returns a default configuration with
+// StrictAffinity disabled and AutoAllocateBlocks enabled.
+func (rw blockReaderWriter) getIPAMConfig() (*IPAMConfig, error) {
+	obj, err := rw.client.Backend.Get(model.IPAMConfigKey{})
+	if err != nil {
+		if errors.IsNotExist(err) {
+			// IPAMConfig has not been explicitly set.  Return
+			// a default IPAM configuration.
+			return &IPAMConfig{AutoAllocateBlocks: true, StrictAffinity: false}, nil
 		}
+		rw.requestLog().Errorf("Error getting IPAMConfig: %s", err)
+		return nil, err
 	}
+	return ipamConfigFromBackend(obj.Value.(*model.IPAMConfig)), nil
 }
 
-// Returns a generator that, when called, returns a random
+// checkDestructiveOpsAllowed returns a destructiveOpsDisabledError for the
+// named operation unless the IPAM configuration allows destructive
+// operations.  Each operation listed on IPAMConfig.DestructiveOpsAllowed
+// calls it before changing anything.
+func (rw blockReaderWriter) checkDestructiveOpsAllowed(op string) error {
+	config, err := rw.ipamConfig()
+	if err != nil {
+		return err
+	}
+	if !config.DestructiveOpsAllowed {
+		rw.requestLog().WithField("op", op).Warning("Destructive IPAM operations are disabled")
+		return destructiveOpsDisabledError{Op: op}
+	}
+	return nil
+}
+
+// getBlock reads the block with the given CIDR.  Returns a
+// blockCIDRMismatchError if the block stored under the CIDR's key holds a
+// different CIDR, so that callers don't update or delete the wrong block.
+func (rw blockReaderWriter) getBlock(cidr cnet.IPNet) (*model.KVPair, error) {
+	key := model.BlockKey{CIDR: cidr}
+	obj, err := rw.client.Backend.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBlockCIDR(key, obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// checkBlockCIDR returns a blockCIDRMismatchError if the given key is a block
+// key and obj, read with that key, holds a block with a different CIDR.
+// Other objects are not checked.
+func checkBlockCIDR(key model.Key, obj *model.KVPair) error {
+	k, ok := key.(model.BlockKey)
+	if !ok {
+		return nil
+	}
+	b, ok := obj.Value.(*model.AllocationBlock)
+	if !ok {
+		return nil
+	}
+	if normalizeNetwork(k.CIDR).String() != normalizeNetwork(b.CIDR).String() {
+		log.WithFields(log.Fields{
+			"key":  k.CIDR.String(),
+			"cidr": b.CIDR.String(),
+		}).Error("Block CIDR does not match its key")
+		return blockCIDRMismatchError{Key: k.CIDR, CIDR: b.CIDR}
+	}
+	return nil
+}
+
+// existingBlocks returns the CIDRs of the blocks within the given pool that
+// exist in the datastore.  The result is a snapshot and may be out of date by
+// the time a block is claimed.
+func (rw blockReaderWriter) existingBlocks(pool cnet.IPNet) ([]cnet.IPNet, error) {
+	version := getIPVersion(cnet.IP{pool.IP})
+	rw.requestLog().WithField("cidr", pool.String()).Debug("Listing existing blocks in pool")
+	kvps, err := rw.listAll(model.BlockListOptions{IPVersion: version.Number, Pool: pool}, ipamListPageSize)
+	if err != nil {
+		if errors.IsNotExist(err) {
+			// No blocks exist yet.
+			return []cnet.IPNet{}, nil
+		}
+		return nil, err
+	}
+
+	existing := []cnet.IPNet{}
+	for _, kvp := range kvps {
+		existing = append(existing, kvp.Key.(model.BlockKey).CIDR)
+	}
+	return existing, nil
+}
+
+// claimedBlocks returns the CIDRs of the blocks of the given IP version that
+// exist in the datastore, or whose affinity has been reserved by a host
+// without the block being created yet.  The blocks of every pool are listed
+// together, so that a claim which tries several pools lists them once.  The
+// result is a snapshot and may be out of date by the time a block is
+// claimed.
+func (rw blockReaderWriter) claimedBlocks(version ipVersion) ([]cnet.IPNet, error) {
+	rw.requestLog().WithField("version", version.Number).Debug("Listing claimed blocks")
+	blocks, err := rw.listAll(model.BlockListOptions{IPVersion: version.Number}, ipamListPageSize)
+	if err != nil && !errors.IsNotExist(err) {
+		return nil, err
+	}
+	affinities, err := rw.listAll(model.BlockAffinityListOptions{IPVersion: version.Number}, ipamListPageSize)
+	if err != nil && !errors.IsNotExist(err) {
+		return nil, err
+	}
+	claimed := []cnet.IPNet{}
+	seen := map[string]bool{}
+	for _, kvp := range blocks {
+		cidr := kvp.Key.(model.BlockKey).CIDR
+		seen[cidr.String()] = true
+		claimed = append(claimed, cidr)
+	}
+	for _, kvp := range affinities {
+		cidr := kvp.Key.(model.BlockAffinityKey).CIDR
+		if !seen[cidr.String()] {
+			seen[cidr.String()] = true
+			claimed = append(claimed, cidr)
+		}
+	}
+	return claimed, nil
+}
+
+// unclaimedBlocks returns the CIDRs of the blocks within the given pool that
+// do not yet exist and are not reserved, in ascending order; it is the
+// complement of claimedBlocks.  Blocks which overlap the pool's excluded
+// CIDRs can never be claimed, so they are not returned.  If limit is greater
+// than 0, at most limit CIDRs are returned, so that the result stays small for
+// a large pool.
+// The result is a snapshot and may be out of date by the time a block is
+// claimed.
+func (rw blockReaderWriter) unclaimedBlocks(pool cnet.IPNet, limit int) ([]cnet.IPNet, error) {
+	cfg, err := rw.ipamConfig()
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := rw.blockPrefixLengthForCIDR(pool, *cfg)
+	if err != nil {
+		return nil, err
+	}
+	excluded, err := rw.excludedCIDRs(pool)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := rw.claimedBlocks(getIPVersion(cnet.IP{pool.IP}))
+	if err != nil {
+		rw.requestLog().WithField("cidr", pool.String()).WithError(err).Error("Error listing claimed blocks")
+		return nil, err
+	}
+
+	unclaimed := []cnet.IPNet{}
+	blocks := unclaimedBlockGenerator(excludingBlockGenerator(blockGenerator(pool, prefix), excluded), existing)
+	for subnet := blocks(); subnet != nil; subnet = blocks() {
+		if limit > 0 && len(unclaimed) >= limit {
+			break
+		}
+		unclaimed = append(unclaimed, *subnet)
+	}
+	return unclaimed, nil
+}
+
+// hasFreeBlocks returns whether the number of existing blocks which fall
+// within the given pool is less than the number of blocks with the given
+// prefix length that the pool holds.
+func hasFreeBlocks(pool cnet.IPNet, blockPrefixLength int, existing []cnet.IPNet) bool {
+	numBlocks, _, _ := poolBlockLayout(pool, blockPrefixLength)
+	inPool := big.NewInt(0)
+	for _, b := range existing {
+		if pool.Contains(b.IP) {
+			inPool.Add(inPool, big.NewInt(1))
+		}
+	}
+	return inPool.Cmp(numBlocks) < 0
+}
+
+// poolExhausted returns whether no address is free in the pool: every block
+// the pool holds exists, and none of them has a free address.  A pool whose
+// blocks all exist may still have free addresses within them, so both are
+// checked.  Free addresses count whether or not automatic assignment may use
+// them, for example those in reserved blocks.  The result is a snapshot.
+func (rw blockReaderWriter) poolExhausted(pool cnet.IPNet) (bool, error) {
+	cfg, err := rw.ipamConfig()
+	if err != nil {
+		return false, err
+	}
+	prefix, err := rw.blockPrefixLengthForCIDR(pool, *cfg)
+	if err != nil {
+		return false, err
+	}
+	version := getIPVersion(cnet.IP{pool.IP})
+	kvps, err := rw.listAll(model.BlockListOptions{IPVersion: version.Number, Pool: pool}, ipamListPageSize)
+	if err != nil {
+		if errors.IsNotExist(err) {
+			// No blocks exist yet.
+			return false, nil
+		}
+		return false, err
+	}
+
+	// Count the blocks first, since the count alone usually shows that
+	// the pool is not exhausted.
+	blocks := []allocationBlock{}
+	for _, kvp := range kvps {
+		b := allocationBlock{kvp.Value.(*model.AllocationBlock)}
+		if pool.Contains(b.CIDR.IP) {
+			blocks = append(blocks, b)
+		}
+	}
+	numBlocks, _, _ := poolBlockLayout(pool, prefix)
+	if big.NewInt(int64(len(blocks))).Cmp(numBlocks) < 0 {
+		return false, nil
+	}
+	for _, b := range blocks {
+		if b.numFreeAddresses() > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// mostFreeBlocksFirst reorders the given pool CIDRs so that the pools with
+// the most blocks that are not yet claimed come first.  Pools with the same
+// number of free blocks keep their relative order.  The counts come from the
+// blocks listed by claimedBlocks, which are a snapshot.
+func (rw blockReaderWriter) mostFreeBlocksFirst(pools []cnet.IPNet, config IPAMConfig, claimed []cnet.IPNet) ([]cnet.IPNet, error) {
+	if len(pools) < 2 {
+		return pools, nil
+	}
+	ordered := poolsByFreeBlocks{pools: make([]cnet.IPNet, len(pools)), free: map[string]*big.Int{}}
+	copy(ordered.pools, pools)
+	for _, pool := range pools {
+		prefix, err := rw.blockPrefixLengthForCIDR(pool, config)
+		if err != nil {
+			return nil, err
+		}
+		numBlocks, _, _ := poolBlockLayout(pool, prefix)
+		n := new(big.Int).Set(numBlocks)
+		for _, cidr := range claimed {
+			if pool.Contains(cidr.IP) {
+				n.Sub(n, big.NewInt(1))
+			}
+		}
+		ordered.free[pool.String()] = n
+	}
+	sort.Stable(ordered)
+	rw.requestLog().WithField("pools", ordered.pools).Debug("Ordered pools by free blocks")
+	return ordered.pools, nil
+}
+
+// poolsByFreeBlocks sorts pool CIDRs by their number of free blocks, most
+// first.
+type poolsByFreeBlocks struct {
+	pools []cnet.IPNet
+	free  map[string]*big.Int
+}
+
+func (s poolsByFreeBlocks) Len() int      { return len(s.pools) }
+func (s poolsByFreeBlocks) Swap(i, j int) { s.pools[i], s.pools[j] = s.pools[j], s.pools[i] }
+func (s poolsByFreeBlocks) Less(i, j int) bool {
+	return s.free[s.pools[i].String()].Cmp(s.free[s.pools[j].String()]) > 0
+}
+
+// poolsByCIDR sorts pool CIDRs by IP version, then address, then prefix
+// length.
+type poolsByCIDR []cnet.IPNet
+
+func (s poolsByCIDR) Len() int           { return len(s) }
+func (s poolsByCIDR) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s poolsByCIDR) Less(i, j int) bool { return compareCIDRs(s[i], s[j]) < 0 }
+
+// highestPriorityFirst reorders the given pool CIDRs by the Priority of their
+// pools, highest first.  The relative order of pools with the same priority
+// is unchanged.
+func highestPriorityFirst(cidrs []cnet.IPNet, pools []api.IPPool) []cnet.IPNet {
+	ordered := poolsByPriority{pools: make([]cnet.IPNet, len(cidrs)), priority: map[string]int{}}
+	copy(ordered.pools, cidrs)
+	for _, p := range pools {
+		ordered.priority[p.Metadata.CIDR.String()] = p.Spec.Priority
+	}
+	sort.Stable(ordered)
+	return ordered.pools
+}
+
+// poolsByPriority sorts pool CIDRs by the Priority of their pools, highest
+// first.
+type poolsByPriority struct {
+	pools    []cnet.IPNet
+	priority map[string]int
+}
+
+func (s poolsByPriority) Len() int      { return len(s.pools) }
+func (s poolsByPriority) Swap(i, j int) { s.pools[i], s.pools[j] = s.pools[j], s.pools[i] }
+func (s poolsByPriority) Less(i, j int) bool {
+	return s.priority[s.pools[i].String()] > s.priority[s.pools[j].String()]
+}
+
+// preferredPoolsFirst reorders the given pool CIDRs so that the pools which
+// list the host in their PreferredHosts come first.  The relative order of
+// the preferred pools, and of the remaining pools, is unchanged.
+func preferredPoolsFirst(cidrs []cnet.IPNet, pools []api.IPPool, host string) []cnet.IPNet {
+	preferred := map[string]bool{}
+	for _, p := range pools {
+		for _, h := range p.Spec.PreferredHosts {
+			if h == host {
+				preferred[p.Metadata.CIDR.String()] = true
+				break
+			}
+		}
+	}
+
+	ordered := []cnet.IPNet{}
+	others := []cnet.IPNet{}
+	for _, c := range cidrs {
+		if preferred[c.String()] {
+			ordered = append(ordered, c)
+		} else {
+			others = append(others, c)
+		}
+	}
+	return append(ordered, others...)
+}
+
+// sameZonePoolsFirst reorders the given pool CIDRs so that the pools in the
+// given zone come first.  The relative order of the pools in the zone, and of
+// the remaining pools, is unchanged.  If no zone is given, the order is
+// unchanged.
+func sameZonePoolsFirst(cidrs []cnet.IPNet, pools []api.IPPool, zone string) []cnet.IPNet {
+	if zone == "" {
+		return cidrs
+	}
+	local := map[string]bool{}
+	for _, p := range pools {
+		if p.Spec.Zone == zone {
+			local[p.Metadata.CIDR.String()] = true
+		}
+	}
+
+	ordered := []cnet.IPNet{}
+	others := []cnet.IPNet{}
+	for _, c := range cidrs {
+		if local[c.String()] {
+			ordered = append(ordered, c)
+		} else {
+			others = append(others, c)
+		}
+	}
+	return append(ordered, others...)
+}
+
+// isPoolInRequestedPools checks if the IP Pool that is passed in belongs to the list of IP Pools
+// that should be used for assigning IPs from.
+func isPoolInRequestedPools(pool cnet.IPNet, requestedPools []cnet.IPNet) bool {
+	if len(requestedPools) == 0 {
+		return true
+	}
+	for _, cidr := range requestedPools {
+		if pool.Equal(cidr) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxHostNameLength is the maximum length of a host name in a block affinity,
+// which is the maximum length of a DNS-1123 subdomain.
+const maxHostNameLength = 253
+
+// matchHostName matches a DNS-1123 subdomain: lower case alphanumeric labels
+// which may contain dashes, separated by dots.  This is the format of a
+// Kubernetes node name, and such a name can also be stored verbatim in an
+// etcd key, so block affinities for it can be read back from every backend.
+var matchHostName = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// validateHostName returns an invalidHostNameError unless the host name can be
+// used in a block affinity key.  Host names are not normalized, since an
+// affinity written under a normalized name would not be found by the host.
+func validateHostName(host string) error {
+	if len(host) > maxHostNameLength {
+		return invalidHostNameError{Host: host, Reason: fmt.Sprintf("longer than %d characters", maxHostNameLength)}
+	}
+	if !matchHostName.MatchString(host) {
+		return invalidHostNameError{Host: host, Reason: "must consist of lower case alphanumeric characters, '-' or '.', and start and end with an alphanumeric character"}
+	}
+	return nil
+}
+
+// claimBlockAffinity claims the given block for the host, writing both the
+// block affinity and the block itself.  Where the datastore supports it, the
+// two are written in a single transaction.  Otherwise the affinity is
+// written first, so that an interrupted claim leaves an affinity without a
+// block, which is completed by the next claim or by createAffineBlock.
+func (rw blockReaderWriter) claimBlockAffinity(subnet cnet.IPNet, host string, config IPAMConfig) error {
+	pool, err := rw.blockPool(subnet)
+	if err != nil {
+		return err
+	}
+	return rw.claimBlockAffinityFromPool(subnet, pool, host, config)
+}
+
+// claimBlockAffinityFromPool claims the given block for the host as
+// claimBlockAffinity does, recording on the block that it was claimed from
+// the given pool, which may be nil.
+func (rw blockReaderWriter) claimBlockAffinityFromPool(subnet cnet.IPNet, pool *cnet.IPNet, host string, config IPAMConfig) error {
+	if err := validateHostName(host); err != nil {
+		return err
+	}
+	if !rw.supportsTxn() {
+		return rw.claimBlockAffinityInTurn(subnet, pool, host, config)
+	}
+	err := rw.createBlockAndAffinity(subnet, pool, host, config)
+	if err == nil {
+		rw.observer().BlockClaimed(host, subnet)
+		return nil
+	}
+	if !errors.IsTransactionNotAtomic(err) && !errors.IsAlreadyExists(err) {
+		return err
+	}
+
+	// Either the datastore can't write both atomically, or the block
+	// already exists and createAffineBlock must decide whether we may
+	// claim it.
+	return rw.claimBlockAffinityInTurn(subnet, pool, host, config)
+}
+
+// supportsTxn returns whether the datastore can perform transactions
+// atomically, by asking it to perform an empty one.  A datastore which can't
+// refuses every transaction without reading or writing anything, so this is
+// cheap to call before reading the objects for a transaction.
+func (rw blockReaderWriter) supportsTxn() bool {
+	_, err := rw.client.Backend.Txn(nil, false)
+	return !errors.IsTransactionNotAtomic(err)
+}
+
+// claimBlockAffinityInTurn claims the given block for the host by writing
+// the block affinity and then creating the block, or claiming it if it
+// already exists, without a transaction.
+func (rw blockReaderWriter) claimBlockAffinityInTurn(subnet cnet.IPNet, pool *cnet.IPNet, host string, config IPAMConfig) error {
+	if err := validateHostName(host); err != nil {
+		return err
+	}
+	if err := rw.reserveBlockAffinity(subnet, host); err != nil {
+		return err
+	}
+	if err := rw.createAffineBlock(subnet, pool, host, config); err != nil {
+		return err
+	}
+	rw.observer().BlockClaimed(host, subnet)
+	return nil
+}
+
+// createBlockAndAffinity creates the block with an affinity to the host,
+// along with the host's block affinity, in a single transaction.  Returns an
+// ErrorTransactionNotAtomic if the datastore can't write both atomically, or
+// an ErrorResourceAlreadyExists if the block exists, in which case nothing
+// is written.
+func (rw blockReaderWriter) createBlockAndAffinity(subnet cnet.IPNet, pool *cnet.IPNet, host string, config IPAMConfig) error {
+	if host == "" {
+		return goerrors.New("Hostname must be sepcified to claim block affinity")
+	}
+	rw.requestLog().WithFields(log.Fields{
+		"host":      host,
+		"blockCIDR": subnet.String(),
+	}).Debug("Claiming block affinity in a transaction")
+	block := newAffineBlock(subnet, pool, host, config)
+	_, err := rw.client.Backend.Txn([]bapi.TxnOp{
+		{
+			Type: bapi.TxnApply,
+			KVPair: &model.KVPair{
+				Key:   model.BlockAffinityKey{Host: host, CIDR: subnet},
+				Value: model.BlockAffinityValue,
+			},
+		},
+		{
+			Type: bapi.TxnCreate,
+			KVPair: &model.KVPair{
+				Key:   model.BlockKey{CIDR: block.CIDR},
+				Value: block.AllocationBlock,
+			},
+		},
+	}, false)
+	return err
+}
+
+// reserveBlockAffinity writes the block affinity for the host without
+// creating the block.  The block is created with the recorded affinity by
+// createAffineBlock when addresses are first assigned from it.
+func (rw blockReaderWriter) reserveBlockAffinity(subnet cnet.IPNet, host string) error {
+	logContext := rw.requestLog().WithFields(log.Fields{
+		"host":      host,
+		"blockCIDR": subnet.String(),
+	})
+
+	// Make sure hostname is not empty.
+	if host == "" {
+		logContext.Error("Hostname can't be empty")
+		return goerrors.New("Hostname must be sepcified to claim block affinity")
+	}
+
+	// Claim the block affinity for this host.  See model.BlockAffinityValue
+	// for details on the hard-coded value that is used.  The value is
+	// constant, so it doesn't matter whether another process on this host
+	// has already written the affinity - just make sure it exists.  This
+	// also recreates the affinity if a previous claim of a block that is
+	// affine to us was interrupted before the affinity was written.
+	logContext.Info("Claiming block affinity")
+	obj := model.KVPair{
+		Key:   model.BlockAffinityKey{Host: host, CIDR: subnet},
+		Value: model.BlockAffinityValue,
+	}
+	_, err := rw.client.Backend.Apply(&obj)
+	if err != nil {
+		logContext.WithError(err).Error("Error writing block affinity")
+		return err
+	}
+	return nil
+}
+
+// createAffineBlock creates the block with an affinity to the host, which
+// should already hold the block affinity.  If the block already exists with
+// an affinity to the host, for example because another process on this host
+// claimed it at the same time, the claim succeeds and the host's block
+// affinity is left in place.  If the block was created by another host
+// first, the client's BlockClaimResolver may steal it, and otherwise the
+// host's block affinity is removed and an affinityClaimedError is returned.
+//
+// A release of the block on this host may delete the block affinity while
+// the block is being claimed, so once the block is affine to the host the
+// affinity is written again if need be, and the block is read back to check
+// that it was not released in the meantime.
+func (rw blockReaderWriter) createAffineBlock(subnet cnet.IPNet, pool *cnet.IPNet, host string, config IPAMConfig) error {
+	logContext := rw.requestLog().WithFields(log.Fields{
+		"host":      host,
+		"blockCIDR": subnet.String(),
+	})
+
+	affinityKeyStr := "host:" + host
+	var lastErr error
+	retry := config.Retry.start()
+	for i := 0; i < retry.maxAttempts(); i++ {
+		if !rw.waitForRetry(retry, i, model.BlockKey{CIDR: subnet}) {
+			break
+		}
+
+		// Create the new block in the datastore.
+		block := newAffineBlock(subnet, pool, host, config)
+		o := model.KVPair{
+			Key:   model.BlockKey{block.CIDR},
+			Value: block.AllocationBlock,
+		}
+		_, err := rw.client.Backend.Create(&o)
+		if err == nil {
+			affine, err := rw.confirmBlockAffinity(subnet, host)
+			if err != nil || affine {
+				return err
+			}
+			logContext.Info("Block was released while it was claimed, claiming it again")
+			lastErr = blockReleasedError{Block: subnet}
+			continue
+		}
+		if !errors.IsAlreadyExists(err) {
+			return err
+		}
+
+		// Block already exists, check affinity.
+		logContext.WithError(err).Info("Block already exists, checking its affinity")
+		obj, err := rw.getBlock(subnet)
+		if err != nil {
+			if errors.IsNotExist(err) {
+				// The block was released since we tried to create
+				// it, so try again.
+				lastErr = err
+				continue
+			}
+			logContext.WithError(err).Error("Error reading block")
+			return err
+		}
+
+		// Pull out the allocationBlock object.
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+
+		if b.Affinity != nil && *b.Affinity == affinityKeyStr {
+			// Block has affinity to this host, meaning another
+			// process on this host claimed it, or we are retrying an
+			// earlier claim.  The block affinity is shared with the
+			// other claim, so it must not be removed, but the other
+			// claim may not have written it yet.  Make sure the block
+			// reflects the current config so that re-running the claim
+			// converges.
+			affine, err := rw.confirmBlockAffinity(subnet, host)
+			if err != nil {
+				return err
+			} else if !affine {
+				logContext.Info("Block was released while it was claimed, claiming it again")
+				lastErr = blockReleasedError{Block: subnet}
+				continue
+			}
+			if b.StrictAffinity != config.StrictAffinity {
+				return rw.setBlockStrictAffinity(subnet, host, config.StrictAffinity)
+			}
+			logContext.Debug("Block already claimed by us.  Success")
+			return nil
+		}
+
+		if b.Affinity == nil && b.empty() && !b.Reserved && !b.Shared {
+			// The block was kept after it was emptied and its
+			// affinity released, so take it over.
+			logContext.Info("Claiming existing empty block")
+			claimed := *b.AllocationBlock
+			claimed.Affinity = &affinityKeyStr
+			claimed.StrictAffinity = config.StrictAffinity
+			_, err = rw.client.Backend.Update(&model.KVPair{Key: obj.Key, Value: &claimed, Revision: obj.Revision})
+			if err == nil {
+				affine, err := rw.confirmBlockAffinity(subnet, host)
+				if err != nil || affine {
+					return err
+				}
+				logContext.Info("Block was released while it was claimed, claiming it again")
+				lastErr = blockReleasedError{Block: subnet}
+				continue
+			}
+			if !errors.IsRetryable(err) {
+				logContext.WithError(err).Error("Error claiming existing empty block")
+				return err
+			}
+
+			// The block changed underneath us, perhaps because another
+			// process on this host claimed it, so read it again.
+			logContext.WithError(err).Info("Existing empty block was updated, checking it again")
+			lastErr = err
+			continue
+		}
+
+		// Some other host beat us to this block.  The client's resolver
+		// decides whether we may take the block from it.
+		if owner, ok := blockAffinityHost(b.AllocationBlock); ok && rw.resolveBlockClaim(b, owner, host) == BlockClaimSteal {
+			err = rw.stealBlockAffinity(obj, owner, host, config)
+			if err == nil {
+				return nil
+			}
+			if !errors.IsRetryable(err) {
+				return err
+			}
+			logContext.WithError(err).Info("Block was updated while stealing its affinity, checking it again")
+			lastErr = err
+			continue
+		}
+
+		// Cleanup and return error.
+		err = rw.client.Backend.Delete(&model.KVPair{
+			Key: model.BlockAffinityKey{Host: host, CIDR: b.CIDR},
+		})
+		if err != nil {
+			logContext.WithError(err).Error("Error cleaning up block affinity")
+			return err
+		}
+
+		// If the existing block has strict affinity then it can never
+		// be shared with this host, so flag the error as a hard failure.
+		// Otherwise the caller may choose to overflow into the block.
+		if b.StrictAffinity {
+			logContext.WithField("affinity", *b.Affinity).Warning("Block has strict affinity to another host")
+		}
+		return affinityClaimedError{Block: b, Strict: b.StrictAffinity}
+	}
+	return maxRetriesError{Key: model.BlockKey{CIDR: subnet}, Err: lastErr}
+}
+
+// ensureBlockAffinity creates the block affinity for the host if it does not
+// already exist.  Unlike reserveBlockAffinity, an existing affinity is not
+// rewritten.
+func (rw blockReaderWriter) ensureBlockAffinity(subnet cnet.IPNet, host string) error {
+	_, err := rw.client.Backend.Create(&model.KVPair{
+		Key:   model.BlockAffinityKey{Host: host, CIDR: subnet},
+		Value: model.BlockAffinityValue,
+	})
+	if err != nil && !errors.IsAlreadyExists(err) {
+		rw.requestLog().WithFields(log.Fields{
+			"host":      host,
+			"blockCIDR": subnet.String(),
+		}).WithError(err).Error("Error writing block affinity")
+		return err
+	}
+	return nil
+}
+
+// confirmBlockAffinity makes sure the host's block affinity exists, then
+// reads the block back and returns whether it still exists with an affinity
+// to the host.  If it does not, the block was released after it was claimed
+// and the affinity written here is left for the release, or the next claim,
+// to settle.
+func (rw blockReaderWriter) confirmBlockAffinity(subnet cnet.IPNet, host string) (bool, error) {
+	if err := rw.ensureBlockAffinity(subnet, host); err != nil {
+		return false, err
+	}
+	return rw.blockAffineToHost(subnet, host)
+}
+
+// blockAffineToHost returns whether the block exists with an affinity to the
+// host.
+func (rw blockReaderWriter) blockAffineToHost(subnet cnet.IPNet, host string) (bool, error) {
+	obj, err := rw.getBlock(subnet)
+	if err != nil {
+		if errors.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	b := obj.Value.(*model.AllocationBlock)
+	return b.Affinity != nil && hostAffinityMatches(host, b), nil
+}
+
+// newAffineBlock returns a new block with an affinity to the host, recording
+// when, by whom and from which pool it was claimed.  The pool may be nil.
+func newAffineBlock(subnet cnet.IPNet, pool *cnet.IPNet, host string, config IPAMConfig) allocationBlock {
+	block := newBlock(subnet)
+	if pool != nil {
+		p := poolNetwork(*pool)
+		block.Pool = &p
+	}
+	affinityKeyStr := "host:" + host
+	block.Affinity = &affinityKeyStr
+	block.StrictAffinity = config.StrictAffinity
+	block.CreationTime = time.Now().UTC()
+	block.Annotations = map[string]string{
+		blockAnnotationHost:    host,
+		blockAnnotationProcess: filepath.Base(os.Args[0]),
+	}
+	return block
+}
+
+// claimSharedBlock creates the given block as a shared block, which has no
+// host affinity and from which every host may assign.  An existing block
+// without an affinity is made shared, keeping its allocations, but an
+// affinityClaimedError is returned if the block is affine to a host.
+func (rw blockReaderWriter) claimSharedBlock(subnet cnet.IPNet) error {
+	logContext := rw.requestLog().WithField("blockCIDR", subnet.String())
+	pool, err := rw.blockPool(subnet)
+	if err != nil {
+		return err
+	}
+	block := newBlock(subnet)
+	if pool != nil {
+		p := poolNetwork(*pool)
+		block.Pool = &p
+	}
+	block.Shared = true
+	block.CreationTime = time.Now().UTC()
+	block.Annotations = map[string]string{
+		blockAnnotationProcess: filepath.Base(os.Args[0]),
+	}
+	_, err = rw.client.Backend.Create(&model.KVPair{Key: model.BlockKey{CIDR: subnet}, Value: block.AllocationBlock})
+	if err == nil {
+		logContext.Info("Created shared block")
+		return nil
+	} else if !errors.IsAlreadyExists(err) {
+		logContext.WithError(err).Error("Error creating shared block")
+		return err
+	}
+
+	return rw.updateWithRetry(model.BlockKey{CIDR: subnet}, func(obj *model.KVPair) error {
+		b := obj.Value.(*model.AllocationBlock)
+		if b.Shared {
+			return errSkipUpdate
+		} else if b.Affinity != nil {
+			return affinityClaimedError{Block: allocationBlock{b}, Strict: b.StrictAffinity}
+		}
+		logContext.Info("Sharing existing block")
+		b.Shared = true
+		return nil
+	})
+}
+
+// setBlockReserved sets or clears the Reserved flag of the given block.
+func (rw blockReaderWriter) setBlockReserved(blockCIDR cnet.IPNet, reserved bool) error {
+	return rw.updateWithRetry(model.BlockKey{CIDR: blockCIDR}, func(obj *model.KVPair) error {
+		b := obj.Value.(*model.AllocationBlock)
+		if b.Reserved == reserved {
+			return errSkipUpdate
+		}
+		rw.requestLog().WithField("blockCIDR", blockCIDR.String()).Infof("Updating block Reserved to %t", reserved)
+		b.Reserved = reserved
+		return nil
+	})
+}
+
+// updateBlockStrictAffinity sets or clears the StrictAffinity of the given
+// block, whichever host it is affine to.  Returns a blockNotAffineError if
+// strict affinity is set on a block with no affinity.
+func (rw blockReaderWriter) updateBlockStrictAffinity(blockCIDR cnet.IPNet, strict bool) error {
+	return rw.updateWithRetry(model.BlockKey{CIDR: blockCIDR}, func(obj *model.KVPair) error {
+		b := obj.Value.(*model.AllocationBlock)
+		if strict && b.Affinity == nil {
+			return blockNotAffineError{Block: blockCIDR}
+		}
+		if b.StrictAffinity == strict {
+			return errSkipUpdate
+		}
+		rw.requestLog().WithField("blockCIDR", blockCIDR.String()).Infof("Updating block StrictAffinity to %t", strict)
+		b.StrictAffinity = strict
+		return nil
+	})
+}
+
+// setBlockStrictAffinity updates the StrictAffinity of the given block, which
+// must be affine to the given host.
+func (rw blockReaderWriter) setBlockStrictAffinity(subnet cnet.IPNet, host string, strict bool) error {
+	logContext := rw.requestLog().WithFields(log.Fields{
+		"host":      host,
+		"blockCIDR": subnet.String(),
+	})
+	cfg, err := rw.ipamConfig()
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	retry := cfg.Retry.start()
+	for i := 0; i < retry.maxAttempts(); i++ {
+		if !rw.waitForRetry(retry, i, model.BlockKey{CIDR: subnet}) {
+			break
+		}
+		obj, err := rw.getBlock(subnet)
+		if err != nil {
+			logContext.WithError(err).Error("Error reading block")
+			return err
+		}
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		if b.Affinity == nil || !hostAffinityMatches(host, b.AllocationBlock) {
+			return affinityClaimedError{Block: b, Strict: b.StrictAffinity}
+		}
+		if b.StrictAffinity == strict {
+			return nil
+		}
+
+		// Pass back the original KVPair with the new block
+		// information so we can do a CAS.
+		logContext.Infof("Updating block StrictAffinity to %t", strict)
+		b.StrictAffinity = strict
+		obj.Value = b.AllocationBlock
+		_, err = rw.client.Backend.Update(obj)
+		if err != nil {
+			if errors.IsRetryable(err) {
+				// CASError - continue.
+				lastErr = err
+				continue
+			}
+			logContext.WithError(err).Error("Error updating block")
+			return err
+		}
+		return nil
+	}
+	return maxRetriesError{Key: model.BlockKey{CIDR: subnet}, Err: lastErr}
+}
+
+// releaseBlockAffinity releases the host's affinity for the block, even if
+// addresses are still assigned from it.  An empty block is deleted unless
+// empty blocks are retained.
+func (rw blockReaderWriter) releaseBlockAffinity(host string, blockCIDR cnet.IPNet) error {
+	return rw.releaseAffinity(host, blockCIDR, false, time.Now())
+}
+
+// releaseEmptyBlockAffinity releases the host's affinity for the block, as
+// releaseBlockAffinity does, but only if no addresses are assigned from the
+// block.  If addresses are assigned, the affinity is kept and a
+// blockNotEmptyError is returned, so that the host keeps the locality of its
+// addresses until the block is free.  If the block was emptied less than the
+// EmptyBlockLinger ago, the affinity is kept and a blockLingeringError is
+// returned, so that the host can reuse the block.
+func (rw blockReaderWriter) releaseEmptyBlockAffinity(host string, blockCIDR cnet.IPNet) error {
+	return rw.releaseAffinity(host, blockCIDR, true, time.Now())
+}
+
+// releaseAffinity releases the host's affinity for the block.  If onlyIfEmpty
+// is set, the affinity is only released if the block is empty and its linger
+// has expired by now.
+func (rw blockReaderWriter) releaseAffinity(host string, blockCIDR cnet.IPNet, onlyIfEmpty bool, now time.Time) error {
+	logContext := rw.requestLog().WithFields(log.Fields{
+		"host":      host,
+		"blockCIDR": blockCIDR.String(),
+	})
+
+	// Make sure hostname is not empty.
+	if host == "" {
+		logContext.Error("Hostname can't be empty")
+		return goerrors.New("Hostname must be sepcified to release block affinity")
+	}
+
+	cfg, err := rw.ipamConfig()
+	if err != nil {
+		return err
+	}
+	deleteEmpty := !cfg.RetainEmptyBlocks
+	var linger time.Duration
+	if onlyIfEmpty {
+		linger = cfg.EmptyBlockLinger
+	}
+	err = rw.writeWithRetry(model.BlockKey{CIDR: blockCIDR}, func(obj *model.KVPair) error {
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+
+		// Check that the block affinity matches the given affinity.
+		if b.Affinity != nil && !hostAffinityMatches(host, b.AllocationBlock) {
+			logContext.WithField("affinity", *b.Affinity).Error("Mismatched affinity")
+			return affinityClaimedError{Block: b}
+		}
+		if onlyIfEmpty && !b.empty() {
+			logContext.Info("Block is not empty, keeping affinity")
+			return blockNotEmptyError{Block: blockCIDR}
+		}
+		if onlyIfEmpty && b.lingering(now, linger) {
+			logContext.Info("Block was emptied recently, keeping affinity")
+			return blockLingeringError{Block: blockCIDR, Until: b.EmptySince.Add(linger)}
+		}
+
+		// Remove the affinity from the block.  This prevents the host
+		// from automatically assigning from this block unless we're
+		// allowed to overflow into non-affine blocks.  If the block is
+		// empty it is deleted instead.
+		b.Affinity = nil
+		return nil
+	}, func(obj *model.KVPair) error {
+		return rw.writeReleasedBlock(obj, deleteEmpty)
+	})
+	if err != nil {
+		if errors.IsNotExist(err) {
+			// The affinity was reserved but the block was never
+			// created, so there is only the affinity to remove.
+			logContext.Info("Block does not exist, releasing reserved affinity")
+			return rw.deleteBlockAffinity(host, blockCIDR)
+		}
+		logContext.WithError(err).Error("Error releasing block")
+		return err
+	}
+
+	// We've removed / updated the block, so update the host config
+	// to remove the CIDR.
+	if err := rw.deleteBlockAffinity(host, blockCIDR); err != nil {
+		return err
+	}
+
+	// Another process on this host may have claimed the block again
+	// since it was released, in which case the affinity just deleted
+	// is now its affinity, so write it back.
+	affine, err := rw.blockAffineToHost(blockCIDR, host)
+	if err != nil {
+		return err
+	} else if affine {
+		logContext.Info("Block was claimed again while it was released, keeping affinity")
+		if err := rw.ensureBlockAffinity(blockCIDR, host); err != nil {
+			return err
+		}
+	}
+	rw.observer().BlockReleased(host, blockCIDR)
+	return nil
+}
+
+// writeReleasedBlock writes back a block from which addresses or the host
+// affinity have been released, with a compare-and-swap against the revision
+// of obj.  A block left empty records when it was emptied, for the
+// EmptyBlockLinger.  If the block is now empty, not affine to any host, not
+// reserved and not shared, it is deleted instead, unless empty blocks are
+// retained.  Every release path writes the block this way, so that they all
+// clean up empty blocks in the same way.
+func (rw blockReaderWriter) writeReleasedBlock(obj *model.KVPair, deleteEmpty bool) error {
+	b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+	if b.empty() && b.EmptySince == nil {
+		now := time.Now().UTC()
+		b.EmptySince = &now
+	}
+	if deleteEmpty && b.empty() && b.Affinity == nil && !b.Reserved && !b.Shared {
+		rw.requestLog().WithField("blockCIDR", b.CIDR.String()).Debug("Deleting empty non-affine block")
+		err := rw.client.Backend.Delete(obj)
+		if err != nil && errors.IsNotExist(err) {
+			// The block has already been deleted.
+			return nil
+		}
+		return err
+	}
+	rw.requestLog().WithField("blockCIDR", b.CIDR.String()).Debug("Updating released block")
+	_, err := rw.client.Backend.Update(obj)
+	return err
+}
+
+// deleteBlockAffinity deletes the block affinity of the host, treating an
+// affinity that does not exist as already deleted.
+func (rw blockReaderWriter) deleteBlockAffinity(host string, blockCIDR cnet.IPNet) error {
+	err := rw.client.Backend.Delete(&model.KVPair{
+		Key: model.BlockAffinityKey{Host: host, CIDR: blockCIDR},
+	})
+	if err != nil {
+		// Return the error unless the affinity didn't exist.
+		if !errors.IsNotExist(err) {
+			rw.requestLog().WithFields(log.Fields{
+				"host":      host,
+				"blockCIDR": blockCIDR.String(),
+			}).WithError(err).Error("Error deleting block affinity")
+			return err
+		}
+	}
+	return nil
+}
+
+// forceReleaseBlockAffinity releases the affinity of the given block, whichever
+// host it is affine to.  This is intended for recovering blocks from hosts
+// that no longer exist.  As with releaseBlockAffinity, the block is deleted if
+// it is empty; otherwise only its affinity is removed so that existing
+// allocations are preserved.  It fails unless the IPAM configuration allows
+// destructive operations.
+func (rw blockReaderWriter) forceReleaseBlockAffinity(blockCIDR cnet.IPNet) error {
+	if err := rw.checkDestructiveOpsAllowed("ForceReleaseBlockAffinity"); err != nil {
+		return err
+	}
+	logContext := rw.requestLog().WithField("blockCIDR", blockCIDR.String())
+	cfg, err := rw.ipamConfig()
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	retry := cfg.Retry.start()
+	for i := 0; i < retry.maxAttempts(); i++ {
+		if !rw.waitForRetry(retry, i, model.BlockKey{CIDR: blockCIDR}) {
+			break
+		}
+		obj, err := rw.getBlock(blockCIDR)
+		if err != nil {
+			logContext.WithError(err).Error("Error getting block")
+			return err
+		}
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		host, affine := blockAffinityHost(b.AllocationBlock)
+		logContext.WithField("host", host).Warning("Forcibly releasing block affinity")
+
+		if b.empty() && !b.Reserved {
+			// If the block is empty, we can delete it.  Pass back the
+			// KVPair we read so that the delete fails if the block has
+			// been assigned from in the meantime.
+			err = rw.client.Backend.Delete(obj)
+		} else if b.Affinity != nil {
+			// Otherwise remove the affinity, preserving the allocations.
+			b.Affinity = nil
+			obj.Value = b.AllocationBlock
+			_, err = rw.client.Backend.Update(obj)
+		}
+		if err != nil {
+			if errors.IsRetryable(err) {
+				lastErr = err
+				continue
+			}
+			if !errors.IsNotExist(err) {
+				logContext.WithError(err).Error("Error releasing block")
+				return err
+			}
+		}
+
+		// Remove the affinity for the host the block was affine to.
+		if affine {
+			err = rw.client.Backend.Delete(&model.KVPair{
+				Key: model.BlockAffinityKey{Host: host, CIDR: b.CIDR},
+			})
+			if err != nil && !errors.IsNotExist(err) {
+				logContext.WithField("host", host).WithError(err).Error("Error deleting block affinity")
+				return err
+			}
+			rw.observer().BlockReleased(host, blockCIDR)
+		}
+		return nil
+	}
+	return maxRetriesError{Key: model.BlockKey{CIDR: blockCIDR}, Err: lastErr}
+}
+
+// withinConfiguredPools returns true if the given IP is within a configured
+// Calico pool, and false otherwise.
+func (rw blockReaderWriter) withinConfiguredPools(ip cnet.IP) bool {
+	_, err := rw.poolForIP(ip)
+	return err == nil
+}
+
+// checkWithinPools returns a notInAnyPoolError for the first of the given IPs
+// that is not within any pool.  Unlike withinConfiguredPools, disabled pools
+// count, so that the addresses in a pool that is being deleted can still be
+// queried and released.
+func (rw blockReaderWriter) checkWithinPools(ips ...cnet.IP) error {
+	allPools, err := rw.listPools()
+	if err != nil {
+		rw.requestLog().WithError(err).Error("Error reading configured pools")
+		return err
+	}
+	for _, ip := range ips {
+		if containingPool(allPools.Items, ip) == nil {
+			return notInAnyPoolError{IP: ip}
+		}
+	}
+	return nil
+}
+
+// poolForIP returns the enabled pool that contains the given IP.  If more
+// than one enabled pool contains the IP, the most specific pool is returned.
+// Returns a notInAnyPoolError if no enabled pool contains the IP.
+func (rw blockReaderWriter) poolForIP(ip cnet.IP) (*api.IPPool, error) {
+	allPools, err := rw.listPools()
+	if err != nil {
+		rw.requestLog().WithError(err).Error("Error reading configured pools")
+		return nil, err
+	}
+	if p := mostSpecificPool(allPools.Items, ip); p != nil {
+		return p, nil
+	}
+	return nil, notInAnyPoolError{IP: ip}
+}
+
+// encapForIP returns the encapsulation of the enabled pool that contains the
+// given IP, as chosen by poolForIP, so that routes to an assigned address
+// can be programmed without reading the pool again.  An IPIP pool with no
+// mode uses ipip.DefaultMode.  Returns a notInAnyPoolError if no enabled pool
+// contains the IP.
+func (rw blockReaderWriter) encapForIP(ip cnet.IP) (EncapMode, error) {
+	p, err := rw.poolForIP(ip)
+	if err != nil {
+		return "", err
+	}
+	if p.Spec.IPIP == nil || !p.Spec.IPIP.Enabled {
+		return EncapNone, nil
+	}
+	mode := p.Spec.IPIP.Mode
+	if mode == ipip.Undefined {
+		mode = ipip.DefaultMode
+	}
+	switch mode {
+	case ipip.Always:
+		return EncapIPIPAlways, nil
+	case ipip.CrossSubnet:
+		return EncapIPIPCrossSubnet, nil
+	}
+	return "", fmt.Errorf("pool %s has unknown IPIP mode '%s'", p.Metadata.CIDR, mode)
+}
+
+// mostSpecificPool returns the enabled pool with the longest prefix that
+// contains the given IP, or nil if no enabled pool contains the IP.
+func mostSpecificPool(pools []api.IPPool, ip cnet.IP) *api.IPPool {
+	var match *api.IPPool
+	matchOnes := -1
+	for i := range pools {
+		p := &pools[i]
+		if p.Spec.Disabled || !p.Metadata.CIDR.Contains(ip.IP) {
+			continue
+		}
+		if ones, _ := p.Metadata.CIDR.Mask.Size(); ones > matchOnes {
+			match = p
+			matchOnes = ones
+		}
+	}
+	return match
+}
+
+// blockPool returns the CIDR of the pool with the longest prefix that
+// contains the given block, whether or not it is enabled, or nil if there is
+// none.
+func (rw blockReaderWriter) blockPool(blockCIDR cnet.IPNet) (*cnet.IPNet, error) {
+	allPools, err := rw.listPools()
+	if err != nil {
+		rw.requestLog().WithError(err).Error("Error reading configured pools")
+		return nil, err
+	}
+	p := containingPool(allPools.Items, cnet.IP{normalizeNetwork(blockCIDR).IP})
+	if p == nil {
+		return nil, nil
+	}
+	return &p.Metadata.CIDR, nil
+}
+
+// blockBelongsToPool returns whether the block belongs to the given pool.  A
+// block belongs to the pool it was claimed from, or if it has no recorded
+// pool, to any pool that contains it.
+func blockBelongsToPool(b *model.AllocationBlock, pool cnet.IPNet) bool {
+	if b.Pool != nil {
+		return poolNetwork(*b.Pool).String() == poolNetwork(pool).String()
+	}
+	return pool.Contains(b.CIDR.IP)
+}
+
+// containingPool returns the pool with the longest prefix that contains the
+// given IP, whether or not it is enabled, or nil if there is none.
+func containingPool(pools []api.IPPool, ip cnet.IP) *api.IPPool {
+	var match *api.IPPool
+	matchOnes := -1
+	for i := range pools {
+		p := &pools[i]
+		if !p.Metadata.CIDR.Contains(ip.IP) {
+			continue
+		}
+		if ones, _ := p.Metadata.CIDR.Mask.Size(); ones > matchOnes {
+			match = p
+			matchOnes = ones
+		}
+	}
+	return match
+}
+
+// poolsOverlapping returns the enabled pools which overlap the given CIDR,
+// whether they contain it, are contained by it or only partly overlap it,
+// sorted by CIDR.
+func (rw blockReaderWriter) poolsOverlapping(cidr cnet.IPNet) ([]api.IPPool, error) {
+	allPools, err := rw.listPools()
+	if err != nil {
+		rw.requestLog().WithError(err).Error("Error reading configured pools")
+		return nil, err
+	}
+	cidr = poolNetwork(cidr)
+	overlapping := []api.IPPool{}
+	for _, p := range allPools.Items {
+		if !p.Spec.Disabled && p.Metadata.CIDR.IsNetOverlap(cidr.IPNet) {
+			overlapping = append(overlapping, p)
+		}
+	}
+	sort.Sort(ipPoolsByCIDR(overlapping))
+	return overlapping, nil
+}
+
+// ipPoolsByCIDR sorts pools by their CIDRs, as poolsByCIDR does.
+type ipPoolsByCIDR []api.IPPool
+
+func (s ipPoolsByCIDR) Len() int      { return len(s) }
+func (s ipPoolsByCIDR) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s ipPoolsByCIDR) Less(i, j int) bool {
+	return compareCIDRs(s[i].Metadata.CIDR, s[j].Metadata.CIDR) < 0
+}
+
+// excludedCIDRs returns the CIDRs excluded from the pool containing the given
+// CIDR which overlap it.  The CIDR is normally a pool or a block.
+func (rw blockReaderWriter) excludedCIDRs(cidr cnet.IPNet) ([]cnet.IPNet, error) {
+	allPools, err := rw.listPools()
+	if err != nil {
+		rw.requestLog().WithError(err).Error("Error reading configured pools")
+		return nil, err
+	}
+	p := containingPool(allPools.Items, cnet.IP{normalizeNetwork(cidr).IP})
+	if p == nil {
+		return nil, nil
+	}
+	return overlappingCIDRs(cidr, p.Spec.ExcludedCIDRs), nil
+}
+
+// unassignableCIDRs returns the CIDRs overlapping the given CIDR from which
+// addresses are never auto-assigned.  These are the CIDRs excluded from the
+// pool containing the given CIDR, and a single address CIDR for each of the
+// pool's reserved addresses.
+func (rw blockReaderWriter) unassignableCIDRs(cidr cnet.IPNet) ([]cnet.IPNet, error) {
+	allPools, err := rw.listPools()
+	if err != nil {
+		rw.requestLog().WithError(err).Error("Error reading configured pools")
+		return nil, err
+	}
+	p := containingPool(allPools.Items, cnet.IP{normalizeNetwork(cidr).IP})
+	if p == nil {
+		return nil, nil
+	}
+	return overlappingCIDRs(cidr, append(reservedAddressCIDRs(*p), p.Spec.ExcludedCIDRs...)), nil
+}
+
+// reservedAddressCIDRs returns a single address CIDR for each of the pool's
+// reserved addresses.
+func reservedAddressCIDRs(p api.IPPool) []cnet.IPNet {
+	cidrs := []cnet.IPNet{}
+	for _, ip := range p.Spec.ReservedAddresses {
+		cidrs = append(cidrs, cnet.HostIPNet(ip))
+	}
+	return cidrs
+}
+
+// overlappingCIDRs returns those of the given CIDRs which overlap cidr.
+func overlappingCIDRs(cidr cnet.IPNet, cidrs []cnet.IPNet) []cnet.IPNet {
+	overlapping := []cnet.IPNet{}
+	for _, c := range cidrs {
+		if c.IsNetOverlap(cidr.IPNet) {
+			overlapping = append(overlapping, c)
+		}
+	}
+	return overlapping
+}
+
+// enabledPoolsForVersion returns the CIDRs of all configured pools of the
+// given IP version that are not disabled.
+func (rw blockReaderWriter) enabledPoolsForVersion(version ipVersion) ([]cnet.IPNet, error) {
+	allPools, err := rw.listPools()
+	if err != nil {
+		rw.requestLog().WithError(err).Error("Error reading configured pools")
+		return nil, err
+	}
+	return enabledPools(allPools.Items, version), nil
+}
+
+// enabledPools filters the given pools, returning the CIDRs of the pools
+// of the given IP version that are not disabled.
+func enabledPools(pools []api.IPPool, version ipVersion) []cnet.IPNet {
+	cidrs := []cnet.IPNet{}
+	for _, p := range pools {
+		if !p.Spec.Disabled && p.Metadata.CIDR.Version() == version.Number {
+			cidrs = append(cidrs, p.Metadata.CIDR)
+		}
+	}
+	return cidrs
+}
+
+// Generator to get list of block CIDRs which
+// fall within the given pool. Returns nil when no more
+// blocks can be generated.
+func blockGenerator(pool cnet.IPNet, blockPrefixLength int) func() *cnet.IPNet {
+	pool = normalizeNetwork(pool)
+	numBlocks, blockAddrs, blockMask := poolBlockLayout(pool, blockPrefixLength)
+	ip := cnet.IP{pool.IP.Mask(pool.Mask)}
+	i := big.NewInt(0)
+	return func() *cnet.IPNet {
+		if i.Cmp(numBlocks) >= 0 {
+			return nil
+		}
+		cidr := cnet.IPNet{net.IPNet{ip.IP, blockMask}}
+		ip = incrementIP(ip, blockAddrs)
+		i.Add(i, big.NewInt(1))
+		return &cidr
+	}
+}
+
+// poolBlockLayout returns the number of blocks with the given prefix length
+// within the pool, the number of addresses in each block and the block mask.
+// The pool is always a whole number of blocks, except where the pool is
+// smaller than a block, in which case the pool consists of a single block
+// covering the whole pool.
+func poolBlockLayout(pool cnet.IPNet, blockPrefixLength int) (*big.Int, *big.Int, net.IPMask) {
+	ones, bits := pool.Mask.Size()
+	if ones > blockPrefixLength {
+		blockAddrs := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+		return big.NewInt(1), blockAddrs, pool.Mask
+	}
+	numBlocks := new(big.Int).Lsh(big.NewInt(1), uint(blockPrefixLength-ones))
+	blockAddrs := new(big.Int).Lsh(big.NewInt(1), uint(bits-blockPrefixLength))
+	return numBlocks, blockAddrs, net.CIDRMask(blockPrefixLength, bits)
+}
+
+// blockPrefixLengthForIP returns the prefix length of the blocks containing
+// the given IP.  The block size set on the most specific pool containing the
+// IP, whether or not the pool is enabled, takes precedence over the block
+// size in the IPAM configuration, which in turn defaults to the block size
+// for the IP version.  A pool smaller than a block forms a single block
+// covering the pool, as it does for the block generators.
+func (rw blockReaderWriter) blockPrefixLengthForIP(ip cnet.IP, cfg IPAMConfig) (int, error) {
+	version, err := ipVersionOf(ip)
+	if err != nil {
+		return 0, err
+	}
+	allPools, err := rw.listPools()
+	if err != nil {
+		rw.requestLog().WithError(err).Error("Error reading configured pools")
+		return 0, err
+	}
+	if p := containingPool(allPools.Items, ip); p != nil {
+		return poolBlockPrefixLength(*p, cfg), nil
+	}
+	return cfg.blockPrefixLength(version), nil
+}
+
+// poolBlockPrefixLength returns the prefix length of the blocks of the given
+// pool: the pool's block size if set, otherwise the block size in the IPAM
+// configuration for the pool's IP version.  A pool smaller than a block forms
+// a single block covering the pool.
+func poolBlockPrefixLength(p api.IPPool, cfg IPAMConfig) int {
+	prefix := cfg.blockPrefixLength(getIPVersion(cnet.IP{p.Metadata.CIDR.IP}))
+	if p.Spec.BlockSize != nil {
+		prefix = *p.Spec.BlockSize
+	}
+	if ones, _ := p.Metadata.CIDR.Mask.Size(); ones > prefix {
+		prefix = ones
+	}
+	return prefix
+}
+
+// largestBlockSize returns the number of addresses in the largest block that
+// could be claimed from the requested pools, or from all enabled pools of the
+// IP version if none are requested, capped at 1<<30.  Returns 0 if there are
+// no such pools.
+func (rw blockReaderWriter) largestBlockSize(version ipVersion, requestedPools []cnet.IPNet, cfg IPAMConfig) (int, error) {
+	allPools, err := rw.listPools()
+	if err != nil {
+		rw.requestLog().WithError(err).Error("Error reading configured pools")
+		return 0, err
+	}
+	largest := 0
+	for _, p := range allPools.Items {
+		if p.Spec.Disabled || p.Metadata.CIDR.Version() != version.Number || !isPoolInRequestedPools(p.Metadata.CIDR, requestedPools) {
+			continue
+		}
+		_, bits := p.Metadata.CIDR.Mask.Size()
+		hostBits := bits - poolBlockPrefixLength(p, cfg)
+		if hostBits > 30 {
+			hostBits = 30
+		}
+		if size := 1 << uint(hostBits); size > largest {
+			largest = size
+		}
+	}
+	return largest, nil
+}
+
+// checkPoolBlockSize returns a blockSizeInUseError if blocks of a size other
+// than the given pool's block size already exist within the pool, outside of
+// any more specific pool.  The size of an existing block is derived from its
+// pool whenever an address in it is assigned or released, so the block size
+// of a pool can't change while the pool has blocks, and a pool can't be
+// created over the blocks of a deleted pool of another block size.
+func (rw blockReaderWriter) checkPoolBlockSize(p api.IPPool) error {
+	cfg, err := rw.ipamConfig()
+	if err != nil {
+		return err
+	}
+	prefix := poolBlockPrefixLength(p, *cfg)
+	existing, err := rw.existingBlocks(p.Metadata.CIDR)
+	if err != nil {
+		return err
+	}
+	allPools, err := rw.listPools()
+	if err != nil {
+		return err
+	}
+	poolOnes, _ := p.Metadata.CIDR.Mask.Size()
+	for _, block := range existing {
+		if ones, _ := block.Mask.Size(); ones == prefix {
+			continue
+		}
+		if q := containingPool(allPools.Items, cnet.IP{block.IP}); q != nil {
+			if ones, _ := q.Metadata.CIDR.Mask.Size(); ones > poolOnes {
+				// The block belongs to the more specific pool.
+				continue
+			}
+		}
+		return blockSizeInUseError{Pool: p.Metadata.CIDR, Block: block, BlockSize: prefix}
+	}
+	return nil
+}
+
+// blockPrefixLengthForCIDR returns the prefix length of the blocks within
+// the given CIDR, which is normally a pool.  See blockPrefixLengthForIP.
+func (rw blockReaderWriter) blockPrefixLengthForCIDR(cidr cnet.IPNet, cfg IPAMConfig) (int, error) {
+	return rw.blockPrefixLengthForIP(cnet.IP{normalizeNetwork(cidr).IP}, cfg)
+}
+
+// blockCIDRForAddress returns the CIDR of the block containing the given
+// address, sized for the pool containing the address.
+func (rw blockReaderWriter) blockCIDRForAddress(addr cnet.IP, cfg IPAMConfig) (cnet.IPNet, error) {
+	prefix, err := rw.blockPrefixLengthForIP(addr, cfg)
+	if err != nil {
+		return cnet.IPNet{}, err
+	}
+	return blockCIDRWithPrefixLength(addr, prefix), nil
+}
+
+// newBlockGenerator returns a block generator for the given pool that
+// walks the blocks in the order required by the assignment strategy.
+func newBlockGenerator(strategy AssignmentStrategy, pool cnet.IPNet, blockPrefixLength int, hostName string) func() *cnet.IPNet {
+	if strategy == AssignmentStrategySequential {
+		return blockGenerator(pool, blockPrefixLength)
+	}
+	return randomBlockGenerator(pool, blockPrefixLength, hostName)
+}
+
+// unclaimedBlockGenerator wraps the given block generator so that it only
+// returns blocks which are not among the given existing blocks.
+func unclaimedBlockGenerator(blocks func() *cnet.IPNet, existing []cnet.IPNet) func() *cnet.IPNet {
+	claimed := map[string]bool{}
+	for _, b := range existing {
+		claimed[b.String()] = true
+	}
+	return func() *cnet.IPNet {
+		for subnet := blocks(); subnet != nil; subnet = blocks() {
+			if !claimed[subnet.String()] {
+				return subnet
+			}
+		}
+		return nil
+	}
+}
+
+// excludingBlockGenerator wraps the given block generator so that it only
+// returns blocks which do not overlap any of the excluded CIDRs.
+func excludingBlockGenerator(blocks func() *cnet.IPNet, excluded []cnet.IPNet) func() *cnet.IPNet {
+	if len(excluded) == 0 {
+		return blocks
+	}
+	return func() *cnet.IPNet {
+		for subnet := blocks(); subnet != nil; subnet = blocks() {
+			if len(overlappingCIDRs(*subnet, excluded)) == 0 {
+				return subnet
+			}
+		}
+		return nil
+	}
+}
+
+// Returns a generator that, when called, returns a random
 // block from the given pool.  When there are no blocks left,
 // the it returns nil.
-func randomBlockGenerator(pool cnet.IPNet, hostName string) func() *cnet.IPNet {
-
-	// Determine the IP type to use.
-	version := getIPVersion(cnet.IP{pool.IP})
-	baseIP := cnet.IP{pool.IP}
+func randomBlockGenerator(pool cnet.IPNet, blockPrefixLength int, hostName string) func() *cnet.IPNet {
 
-	// Determine the number of blocks within this pool.
-	ones, size := pool.Mask.Size()
-	prefixLen := size - ones
-	numIP := new(big.Int).Exp(big.NewInt(2), big.NewInt(int64(prefixLen)), nil)
-	numBlocks := new(big.Int)
-	numBlocks.Div(numIP, big.NewInt(blockSize))
+	// Determine the number of blocks within this pool, using the masked
+	// pool address as the base so that the blocks are aligned.
+	pool = normalizeNetwork(pool)
+	numBlocks, blockAddrs, blockMask := poolBlockLayout(pool, blockPrefixLength)
+	baseIP := cnet.IP{pool.IP.Mask(pool.Mask)}
 
 	// Create a random number generator seed based on the hostname.
 	// This is to avoid assigning multiple blocks when multiple
@@ -363,10 +2257,10 @@ func randomBlockGenerator(pool cnet.IPNet, hostName string) func() *cnet.IPNet {
 	numDiff := new(big.Int)
 
 	return func() *cnet.IPNet {
-		// The `big.NewInt(0)` part creates a temp variable and assigns the result of multiplication of `i` and `big.NewInt(blockSize)`
+		// The `big.NewInt(0)` part creates a temp variable and assigns the result of multiplication of `i` and `blockAddrs`
 		// Note: we are not using `i.Mul()` because that will assign the result of the multiplication to `i`, which will cause unexpected issues
-		ip := incrementIP(baseIP, big.NewInt(0).Mul(i, big.NewInt(blockSize)))
-		ipnet := net.IPNet{ip.IP, version.BlockPrefixMask}
+		ip := incrementIP(baseIP, big.NewInt(0).Mul(i, blockAddrs))
+		ipnet := net.IPNet{ip.IP, blockMask}
 
 		numDiff.Sub(numBlocks, i)
 
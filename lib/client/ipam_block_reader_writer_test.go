@@ -0,0 +1,1999 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	goerrors "errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/api"
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/fake"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// fakeBlockBackend is the in-memory backend for the IPAM tests.  It is the
+// public fake client, with helpers to store the pools and configuration that
+// the tests start from.
+type fakeBlockBackend struct {
+	*fake.Client
+}
+
+func newFakeBlockBackend() *fakeBlockBackend {
+	return &fakeBlockBackend{Client: fake.NewClient()}
+}
+
+// store stores the entry whatever its revision, and returns the stored entry.
+func (f *fakeBlockBackend) store(kvp *model.KVPair) *model.KVPair {
+	stored, err := f.Client.Apply(&model.KVPair{Key: kvp.Key, Value: kvp.Value})
+	if err != nil {
+		panic(err)
+	}
+	return stored
+}
+
+// reversingBackend is a fakeBlockBackend which returns each page of a list
+// in reverse order, to simulate a datastore that lists in a different order.
+type reversingBackend struct {
+	*fakeBlockBackend
+}
+
+func (r reversingBackend) ListPage(l model.ListInterface, limit int, token string) ([]*model.KVPair, string, error) {
+	page, next, err := r.fakeBlockBackend.ListPage(l, limit, token)
+	for i, j := 0, len(page)-1; i < j; i, j = i+1, j-1 {
+		page[i], page[j] = page[j], page[i]
+	}
+	return page, next, err
+}
+
+// rawListBackend is a fakeBlockBackend which also lists entries stored by
+// their raw paths, as a datastore would.  Paths which cannot be parsed into a
+// key are reported in an ErrorPartialList along with the entries that could.
+type rawListBackend struct {
+	*fakeBlockBackend
+	raw []string
+}
+
+func (r rawListBackend) ListPage(l model.ListInterface, limit int, token string) ([]*model.KVPair, string, error) {
+	kvps, _, err := r.fakeBlockBackend.ListPage(l, 0, "")
+	if err != nil {
+		return nil, "", err
+	}
+	root := model.ListOptionsToDefaultPathRoot(l)
+	unread := []error{}
+	for _, path := range r.raw {
+		if !strings.HasPrefix(path, root) {
+			continue
+		}
+		if k := l.KeyFromDefaultPath(path); k != nil {
+			kvps = append(kvps, &model.KVPair{Key: k, Value: model.BlockAffinityValue})
+		} else {
+			unread = append(unread, fmt.Errorf("cannot parse key %s", path))
+		}
+	}
+	page, next, err := bapi.PageKVPairs(kvps, l, limit, token)
+	if err == nil && len(unread) > 0 {
+		err = errors.ErrorPartialList{Identifier: l, Errs: unread}
+	}
+	return page, next, err
+}
+
+// storePool stores an IP pool in the backend.
+func (f *fakeBlockBackend) storePool(cidr string, disabled bool) {
+	pool := cnet.MustParseNetwork(cidr)
+	f.store(&model.KVPair{
+		Key:   model.IPPoolKey{CIDR: pool},
+		Value: &model.IPPool{CIDR: pool, IPAM: !disabled, Disabled: disabled},
+	})
+}
+
+// storePoolWithBlockSize stores an enabled IP pool with the given block size
+// in the backend.
+func (f *fakeBlockBackend) storePoolWithBlockSize(cidr string, blockSize int) {
+	pool := cnet.MustParseNetwork(cidr)
+	f.store(&model.KVPair{
+		Key:   model.IPPoolKey{CIDR: pool},
+		Value: &model.IPPool{CIDR: pool, IPAM: true, BlockSize: &blockSize},
+	})
+}
+
+// storePoolWithExclusions stores an enabled IP pool with the given excluded
+// CIDRs in the backend.
+func (f *fakeBlockBackend) storePoolWithExclusions(cidr string, excluded ...string) {
+	pool := cnet.MustParseNetwork(cidr)
+	cidrs := []cnet.IPNet{}
+	for _, e := range excluded {
+		cidrs = append(cidrs, cnet.MustParseNetwork(e))
+	}
+	f.store(&model.KVPair{
+		Key:   model.IPPoolKey{CIDR: pool},
+		Value: &model.IPPool{CIDR: pool, IPAM: true, ExcludedCIDRs: cidrs},
+	})
+}
+
+// storePoolWithReservedAddresses stores an enabled IP pool with the given
+// reserved addresses in the backend.
+func (f *fakeBlockBackend) storePoolWithReservedAddresses(cidr string, reserved ...string) {
+	pool := cnet.MustParseNetwork(cidr)
+	ips := []cnet.IP{}
+	for _, r := range reserved {
+		ips = append(ips, cnet.MustParseIP(r))
+	}
+	f.store(&model.KVPair{
+		Key:   model.IPPoolKey{CIDR: pool},
+		Value: &model.IPPool{CIDR: pool, IPAM: true, ReservedAddresses: ips},
+	})
+}
+
+// storePoolInZone stores an enabled IP pool in the given zone in the backend.
+func (f *fakeBlockBackend) storePoolInZone(cidr string, zone string) {
+	pool := cnet.MustParseNetwork(cidr)
+	f.store(&model.KVPair{
+		Key:   model.IPPoolKey{CIDR: pool},
+		Value: &model.IPPool{CIDR: pool, IPAM: true, Zone: zone},
+	})
+}
+
+// storePoolWithPriority stores an enabled IP pool with the given priority in
+// the backend.
+func (f *fakeBlockBackend) storePoolWithPriority(cidr string, priority int) {
+	pool := cnet.MustParseNetwork(cidr)
+	f.store(&model.KVPair{
+		Key:   model.IPPoolKey{CIDR: pool},
+		Value: &model.IPPool{CIDR: pool, IPAM: true, Priority: priority},
+	})
+}
+
+// allowDestructiveOps stores the default IPAM configuration in the backend,
+// but with destructive operations allowed.
+func (f *fakeBlockBackend) allowDestructiveOps() {
+	f.store(&model.KVPair{
+		Key:   model.IPAMConfigKey{},
+		Value: &model.IPAMConfig{AutoAllocateBlocks: true, DestructiveOpsAllowed: true},
+	})
+}
+
+// disablingBackend is a fakeBlockBackend which reports every IP pool as
+// disabled when it is read individually, as though each pool was disabled
+// just after the pools were listed.
+type disablingBackend struct {
+	*fakeBlockBackend
+}
+
+func (d disablingBackend) Get(k model.Key) (*model.KVPair, error) {
+	kvp, err := d.fakeBlockBackend.Get(k)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := kvp.Value.(*model.IPPool); ok {
+		disabled := *p
+		disabled.Disabled = true
+		return &model.KVPair{Key: kvp.Key, Value: &disabled, Revision: kvp.Revision}, nil
+	}
+	return kvp, nil
+}
+
+func testPool(cidr string, disabled bool) api.IPPool {
+	p := api.NewIPPool()
+	p.Metadata.CIDR = cnet.MustParseNetwork(cidr)
+	p.Spec.Disabled = disabled
+	return *p
+}
+
+var _ = Describe("Block reader writer pool filtering", func() {
+	pools := []api.IPPool{
+		testPool("10.0.0.0/24", false),
+		testPool("10.1.0.0/24", true),
+		testPool("fd80:24e2:f998:72d6::/120", false),
+		testPool("fd80:24e2:f998:72d7::/120", true),
+		testPool("10.2.0.0/24", false),
+	}
+
+	It("should return only enabled IPv4 pools", func() {
+		Expect(enabledPools(pools, ipv4)).To(Equal([]cnet.IPNet{
+			cnet.MustParseNetwork("10.0.0.0/24"),
+			cnet.MustParseNetwork("10.2.0.0/24"),
+		}))
+	})
+
+	It("should return only enabled IPv6 pools", func() {
+		Expect(enabledPools(pools, ipv6)).To(Equal([]cnet.IPNet{
+			cnet.MustParseNetwork("fd80:24e2:f998:72d6::/120"),
+		}))
+	})
+
+	It("should return an empty list when there are no pools", func() {
+		Expect(enabledPools(nil, ipv4)).To(BeEmpty())
+	})
+})
+
+var _ = Describe("getAffineBlocks", func() {
+	blocks := []cnet.IPNet{
+		cnet.MustParseNetwork("10.0.0.0/26"),
+		cnet.MustParseNetwork("10.0.0.64/26"),
+		cnet.MustParseNetwork("10.0.1.0/26"),
+	}
+
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		rw = blockReaderWriter{client: &Client{Backend: newFakeBlockBackend()}}
+		for _, b := range blocks {
+			Expect(rw.reserveBlockAffinity(b, "host-a")).To(Succeed())
+		}
+		Expect(rw.reserveBlockAffinity(cnet.MustParseNetwork("10.0.0.128/26"), "host-b")).To(Succeed())
+	})
+
+	It("should return all of the host's blocks when no pools are given", func() {
+		Expect(rw.getAffineBlocks("host-a", ipv4, nil)).To(ConsistOf(blocks))
+	})
+
+	It("should return only the host's blocks within the given pools", func() {
+		pools := []cnet.IPNet{cnet.MustParseNetwork("10.0.0.0/24")}
+		Expect(rw.getAffineBlocks("host-a", ipv4, pools)).To(ConsistOf(blocks[0], blocks[1]))
+	})
+
+	It("should not match pools of the other IP version", func() {
+		pools := []cnet.IPNet{cnet.MustParseNetwork("fd80:24e2:f998:72d6::/64")}
+		Expect(rw.getAffineBlocks("host-a", ipv4, pools)).To(BeEmpty())
+	})
+
+	It("should accept a version with only its number set", func() {
+		Expect(rw.getAffineBlocks("host-a", ipVersion{Number: 4}, nil)).To(ConsistOf(blocks))
+		Expect(rw.getAffineBlocks("host-a", IPVersion6, nil)).To(BeEmpty())
+	})
+
+	It("should reject an invalid IP version", func() {
+		for _, v := range []ipVersion{{}, {Number: 5}} {
+			_, err := rw.getAffineBlocks("host-a", v, nil)
+			Expect(err).To(Equal(invalidIPVersionError{Number: v.Number}))
+		}
+	})
+
+	Describe("with an unparseable affinity", func() {
+		var raw rawListBackend
+
+		BeforeEach(func() {
+			raw = rawListBackend{
+				fakeBlockBackend: newFakeBlockBackend(),
+				raw: []string{
+					"/calico/ipam/v2/host/host-a/ipv4/block/10.0.0.0-26",
+					"/calico/ipam/v2/host/host-a/ipv4/block/10.0.0.bad-26",
+				},
+			}
+			rw = blockReaderWriter{client: &Client{Backend: raw}}
+		})
+
+		It("should return the entries it read along with a partial list error", func() {
+			kvps, err := rw.listAll(model.BlockAffinityListOptions{Host: "host-a", IPVersion: 4}, 1)
+			Expect(errors.IsPartialList(err)).To(BeTrue())
+			Expect(err.(errors.ErrorPartialList).Errs).To(HaveLen(1))
+			Expect(kvps).To(HaveLen(1))
+			Expect(kvps[0].Key).To(Equal(model.BlockAffinityKey{Host: "host-a", CIDR: blocks[0]}))
+		})
+
+		It("should return the host's readable blocks", func() {
+			Expect(rw.getAffineBlocks("host-a", ipv4, nil)).To(Equal([]cnet.IPNet{blocks[0]}))
+		})
+	})
+})
+
+var _ = Describe("blockOwnershipByHost", func() {
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend := newFakeBlockBackend()
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+		for _, b := range []string{"10.0.0.0/26", "10.0.0.64/26", "10.0.1.0/26"} {
+			Expect(rw.claimBlockAffinity(cnet.MustParseNetwork(b), "host-a", IPAMConfig{})).To(Succeed())
+		}
+		Expect(rw.reserveBlockAffinity(cnet.MustParseNetwork("10.0.0.128/26"), "host-b")).To(Succeed())
+		Expect(rw.reserveBlockAffinity(cnet.MustParseNetwork("fd80:24e2:f998:72d6::/122"), "host-b")).To(Succeed())
+
+		// A block whose affinity has been released.
+		unaffined := newBlock(cnet.MustParseNetwork("10.0.0.192/26"))
+		backend.store(&model.KVPair{Key: model.BlockKey{CIDR: unaffined.CIDR}, Value: unaffined.AllocationBlock})
+	})
+
+	It("should count the blocks owned by each host", func() {
+		Expect(rw.blockOwnershipByHost(nil, ipv4)).To(Equal(map[string]int{
+			"host-a": 3,
+			"host-b": 1,
+			"":       1,
+		}))
+	})
+
+	It("should only count blocks within the pool", func() {
+		pool := cnet.MustParseNetwork("10.0.0.0/24")
+		Expect(rw.blockOwnershipByHost(&pool, ipv4)).To(Equal(map[string]int{
+			"host-a": 2,
+			"host-b": 1,
+			"":       1,
+		}))
+	})
+
+	It("should only count blocks of the given IP version", func() {
+		Expect(rw.blockOwnershipByHost(nil, ipv6)).To(Equal(map[string]int{"host-b": 1}))
+	})
+
+	It("should be exposed on the IPAM interface", func() {
+		var i IPAMInterface = newIPAM(rw.client)
+		Expect(i.BlockOwnershipByHost(nil, IPVersion6)).To(Equal(map[string]int{"host-b": 1}))
+	})
+})
+
+var _ = Describe("listAll ordering", func() {
+	cidrs := []string{"10.0.0.128/26", "fd80:24e2:f998:72d6::/122", "10.0.0.64/26", "10.0.0.0/26", "10.0.0.0/25"}
+
+	keys := func(backend bapi.Client, l model.ListInterface) []string {
+		rw := blockReaderWriter{client: &Client{Backend: backend}}
+		kvps, err := rw.listAll(l, 2)
+		Expect(err).NotTo(HaveOccurred())
+		keys := []string{}
+		for _, kvp := range kvps {
+			keys = append(keys, kvp.Key.String())
+		}
+		return keys
+	}
+
+	It("should list blocks in CIDR order regardless of the datastore order", func() {
+		backend := newFakeBlockBackend()
+		for _, c := range cidrs {
+			b := newBlock(cnet.MustParseNetwork(c))
+			backend.store(&model.KVPair{Key: model.BlockKey{CIDR: b.CIDR}, Value: b.AllocationBlock})
+		}
+		expected := []string{}
+		for _, c := range []string{"10.0.0.0/25", "10.0.0.0/26", "10.0.0.64/26", "10.0.0.128/26", "fd80:24e2:f998:72d6::/122"} {
+			expected = append(expected, model.BlockKey{CIDR: cnet.MustParseNetwork(c)}.String())
+		}
+		Expect(keys(backend, model.BlockListOptions{})).To(Equal(expected))
+		Expect(keys(reversingBackend{backend}, model.BlockListOptions{})).To(Equal(expected))
+	})
+
+	It("should list block affinities in host and CIDR order regardless of the datastore order", func() {
+		backend := newFakeBlockBackend()
+		rw := blockReaderWriter{client: &Client{Backend: backend}}
+		for _, host := range []string{"host-b", "host-a"} {
+			for _, c := range cidrs[:3] {
+				Expect(rw.reserveBlockAffinity(cnet.MustParseNetwork(c), host)).To(Succeed())
+			}
+		}
+		expected := []string{}
+		for _, host := range []string{"host-a", "host-b"} {
+			for _, c := range []string{"10.0.0.64/26", "10.0.0.128/26", "fd80:24e2:f998:72d6::/122"} {
+				expected = append(expected, model.BlockAffinityKey{Host: host, CIDR: cnet.MustParseNetwork(c)}.String())
+			}
+		}
+		Expect(keys(backend, model.BlockAffinityListOptions{})).To(Equal(expected))
+		Expect(keys(reversingBackend{backend}, model.BlockAffinityListOptions{})).To(Equal(expected))
+	})
+})
+
+var _ = Describe("blockInPools", func() {
+	block := cnet.MustParseNetwork("10.0.0.64/26")
+
+	It("should match a pool containing the whole block", func() {
+		Expect(blockInPools(block, ipv4, []cnet.IPNet{cnet.MustParseNetwork("10.0.0.0/24")})).To(BeTrue())
+	})
+
+	It("should not match a pool containing only part of the block", func() {
+		Expect(blockInPools(block, ipv4, []cnet.IPNet{cnet.MustParseNetwork("10.0.0.64/27")})).To(BeFalse())
+	})
+})
+
+var _ = Describe("isPoolInRequestedPools", func() {
+	pool := cnet.MustParseNetwork("10.0.0.0/24")
+
+	It("should match any pool when no pools are requested", func() {
+		Expect(isPoolInRequestedPools(pool, nil)).To(BeTrue())
+	})
+
+	It("should match a requested pool expressed with a 16-byte IP", func() {
+		requested := cnet.MustParseNetwork("10.0.0.0/24")
+		requested.IP = requested.IP.To16()
+		Expect(isPoolInRequestedPools(pool, []cnet.IPNet{requested})).To(BeTrue())
+	})
+
+	It("should not match a pool that was not requested", func() {
+		requested := []cnet.IPNet{cnet.MustParseNetwork("10.0.1.0/24")}
+		Expect(isPoolInRequestedPools(pool, requested)).To(BeFalse())
+	})
+})
+
+var _ = Describe("mostSpecificPool", func() {
+	pools := []api.IPPool{
+		testPool("10.0.0.0/16", false),
+		testPool("10.0.1.0/24", false),
+		testPool("10.0.2.0/24", true),
+		testPool("fd80:24e2:f998:72d6::/120", false),
+	}
+
+	It("should return the only pool containing the IP", func() {
+		p := mostSpecificPool(pools, cnet.MustParseIP("10.0.3.1"))
+		Expect(p).NotTo(BeNil())
+		Expect(p.Metadata.CIDR.String()).To(Equal("10.0.0.0/16"))
+	})
+
+	It("should prefer the most specific pool", func() {
+		p := mostSpecificPool(pools, cnet.MustParseIP("10.0.1.1"))
+		Expect(p).NotTo(BeNil())
+		Expect(p.Metadata.CIDR.String()).To(Equal("10.0.1.0/24"))
+	})
+
+	It("should ignore disabled pools", func() {
+		p := mostSpecificPool(pools, cnet.MustParseIP("10.0.2.1"))
+		Expect(p).NotTo(BeNil())
+		Expect(p.Metadata.CIDR.String()).To(Equal("10.0.0.0/16"))
+	})
+
+	It("should match IPv6 pools", func() {
+		p := mostSpecificPool(pools, cnet.MustParseIP("fd80:24e2:f998:72d6::1"))
+		Expect(p).NotTo(BeNil())
+		Expect(p.Metadata.CIDR.String()).To(Equal("fd80:24e2:f998:72d6::/120"))
+	})
+
+	It("should return nil when no pool contains the IP", func() {
+		Expect(mostSpecificPool(pools, cnet.MustParseIP("192.168.0.1"))).To(BeNil())
+	})
+})
+
+var _ = Describe("hasFreeBlocks", func() {
+	pool := cnet.MustParseNetwork("10.0.0.0/24")
+
+	It("should report free blocks when no blocks exist", func() {
+		Expect(hasFreeBlocks(pool, 26, nil)).To(BeTrue())
+	})
+
+	It("should report free blocks when the pool is partially claimed", func() {
+		existing := []cnet.IPNet{
+			cnet.MustParseNetwork("10.0.0.0/26"),
+			cnet.MustParseNetwork("10.0.0.64/26"),
+		}
+		Expect(hasFreeBlocks(pool, 26, existing)).To(BeTrue())
+	})
+
+	It("should report no free blocks when every block exists", func() {
+		existing := []cnet.IPNet{
+			cnet.MustParseNetwork("10.0.0.0/26"),
+			cnet.MustParseNetwork("10.0.0.64/26"),
+			cnet.MustParseNetwork("10.0.0.128/26"),
+			cnet.MustParseNetwork("10.0.0.192/26"),
+		}
+		Expect(hasFreeBlocks(pool, 26, existing)).To(BeFalse())
+	})
+
+	It("should ignore blocks from other pools", func() {
+		existing := []cnet.IPNet{
+			cnet.MustParseNetwork("10.0.0.0/26"),
+			cnet.MustParseNetwork("10.0.0.64/26"),
+			cnet.MustParseNetwork("10.0.0.128/26"),
+			cnet.MustParseNetwork("10.1.0.0/26"),
+		}
+		Expect(hasFreeBlocks(pool, 26, existing)).To(BeTrue())
+	})
+	It("should count blocks of the given size", func() {
+		existing := []cnet.IPNet{
+			cnet.MustParseNetwork("10.0.0.0/25"),
+			cnet.MustParseNetwork("10.0.0.128/25"),
+		}
+		Expect(hasFreeBlocks(pool, 25, existing)).To(BeFalse())
+	})
+})
+
+var _ = Describe("UnclaimedBlocks", func() {
+	pool := cnet.MustParseNetwork("10.0.0.0/24")
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePoolWithExclusions(pool.String(), "10.0.0.200/30")
+		ic = newIPAM(&Client{Backend: backend})
+	})
+
+	unclaimed := func(limit int) []string {
+		blocks, err := ic.UnclaimedBlocks(pool, limit)
+		Expect(err).NotTo(HaveOccurred())
+		cidrs := []string{}
+		for _, b := range blocks {
+			cidrs = append(cidrs, b.String())
+		}
+		return cidrs
+	}
+
+	It("should return the blocks that do not exist, in order, skipping excluded blocks", func() {
+		Expect(unclaimed(0)).To(Equal([]string{"10.0.0.0/26", "10.0.0.64/26", "10.0.0.128/26"}))
+
+		_, _, err := ic.ClaimAffinity(cnet.MustParseNetwork("10.0.0.64/26"), "host-a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.1"), Hostname: "host-b"})).To(Succeed())
+		Expect(unclaimed(0)).To(Equal([]string{"10.0.0.128/26"}))
+
+		_, _, err = ic.ClaimAffinity(cnet.MustParseNetwork("10.0.0.128/26"), "host-a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unclaimed(0)).To(BeEmpty())
+	})
+
+	It("should return at most the given number of blocks", func() {
+		Expect(unclaimed(2)).To(Equal([]string{"10.0.0.0/26", "10.0.0.64/26"}))
+		Expect(unclaimed(1)).To(Equal([]string{"10.0.0.0/26"}))
+	})
+})
+
+var _ = Describe("PoolExhausted", func() {
+	pool := cnet.MustParseNetwork("10.0.0.0/28")
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePoolWithBlockSize(pool.String(), 30)
+		ic = newIPAM(&Client{Backend: backend})
+	})
+
+	exhausted := func(pool cnet.IPNet) bool {
+		e, err := ic.PoolExhausted(pool)
+		Expect(err).NotTo(HaveOccurred())
+		return e
+	}
+
+	It("should not report a pool without blocks as exhausted", func() {
+		Expect(exhausted(pool)).To(BeFalse())
+	})
+
+	It("should report a pool as exhausted only once every block exists and is full", func() {
+		// Fill three of the four blocks.
+		for o := 0; o < 12; o++ {
+			Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP(fmt.Sprintf("10.0.0.%d", o)), Hostname: "host-a"})).To(Succeed())
+		}
+		Expect(exhausted(pool)).To(BeFalse())
+
+		// Every block exists, but one address is free.
+		for o := 12; o < 15; o++ {
+			Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP(fmt.Sprintf("10.0.0.%d", o)), Hostname: "host-a"})).To(Succeed())
+		}
+		Expect(exhausted(pool)).To(BeFalse())
+
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.15"), Hostname: "host-a"})).To(Succeed())
+		Expect(exhausted(pool)).To(BeTrue())
+
+		Expect(ic.ReleaseIPs([]cnet.IP{cnet.MustParseIP("10.0.0.5")})).To(BeEmpty())
+		Expect(exhausted(pool)).To(BeFalse())
+	})
+
+	It("should count the blocks of a large IPv6 pool", func() {
+		v6 := cnet.MustParseNetwork("fd00::/64")
+		backend.storePool(v6.String(), false)
+		_, v6IPs, err := ic.AutoAssign(AutoAssignArgs{Num6: 64, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v6IPs).To(HaveLen(64))
+		Expect(exhausted(v6)).To(BeFalse())
+	})
+})
+
+var _ = Describe("claimNewAffineBlock with disabled pools", func() {
+	var backend *fakeBlockBackend
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		backend.storePool("10.0.1.0/24", true)
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+	})
+
+	It("should reject a requested pool that is disabled", func() {
+		pool := cnet.MustParseNetwork("10.0.1.0/24")
+		_, err := rw.claimNewAffineBlock("host-a", "", ipv4, []cnet.IPNet{pool}, &IPAMConfig{})
+		Expect(err).To(Equal(poolDisabledError{Pool: pool}))
+	})
+
+	It("should report a requested pool that does not exist", func() {
+		_, err := rw.claimNewAffineBlock("host-a", "", ipv4, []cnet.IPNet{cnet.MustParseNetwork("10.0.2.0/24")}, &IPAMConfig{})
+		Expect(err).To(HaveOccurred())
+		Expect(err).NotTo(BeAssignableToTypeOf(poolDisabledError{}))
+	})
+
+	It("should claim a block from an enabled pool", func() {
+		pool := cnet.MustParseNetwork("10.0.0.0/24")
+		b, err := rw.claimNewAffineBlock("host-a", "", ipv4, nil, &IPAMConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pool.Contains(b.IP)).To(BeTrue())
+	})
+
+	It("should not claim a block from a pool disabled after it was listed", func() {
+		rw = blockReaderWriter{client: &Client{Backend: disablingBackend{backend}}}
+		_, err := rw.claimNewAffineBlock("host-a", "", ipv4, nil, &IPAMConfig{})
+		Expect(err).To(Equal(poolDisabledError{Pool: cnet.MustParseNetwork("10.0.0.0/24")}))
+		affinities, err := backend.List(model.BlockAffinityListOptions{Host: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(affinities).To(BeEmpty())
+	})
+})
+
+// getCountingBackend is a fakeBlockBackend which counts the objects read.
+type getCountingBackend struct {
+	*fakeBlockBackend
+	gets int
+}
+
+func (g *getCountingBackend) Get(k model.Key) (*model.KVPair, error) {
+	g.gets++
+	return g.fakeBlockBackend.Get(k)
+}
+
+// blockListCountingBackend is a fakeBlockBackend which counts the pages of
+// blocks listed.
+type blockListCountingBackend struct {
+	*fakeBlockBackend
+	blockLists int
+}
+
+func (b *blockListCountingBackend) ListPage(l model.ListInterface, limit int, token string) ([]*model.KVPair, string, error) {
+	if _, ok := l.(model.BlockListOptions); ok {
+		b.blockLists++
+	}
+	return b.fakeBlockBackend.ListPage(l, limit, token)
+}
+
+var _ = Describe("nextFreeBlock", func() {
+	pool := cnet.MustParseNetwork("10.0.0.0/25")
+	config := IPAMConfig{AssignmentStrategy: AssignmentStrategySequential}
+
+	var backend *fakeBlockBackend
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+	})
+
+	next := func() (*cnet.IPNet, error) {
+		claimed, err := rw.claimedBlocks(ipv4)
+		Expect(err).NotTo(HaveOccurred())
+		return rw.nextFreeBlock("host-a", pool, config, claimed)
+	}
+
+	It("should return the first block that does not exist without claiming it", func() {
+		b, err := next()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(b.String()).To(Equal("10.0.0.0/26"))
+
+		// Nothing was written, so the same block is returned again.
+		b, err = next()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(b.String()).To(Equal("10.0.0.0/26"))
+		blocks, err := backend.List(model.BlockListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(blocks).To(BeEmpty())
+	})
+
+	It("should skip blocks that exist", func() {
+		first := cnet.MustParseNetwork("10.0.0.0/26")
+		backend.store(&model.KVPair{Key: model.BlockKey{CIDR: first}, Value: newBlock(first).AllocationBlock})
+		b, err := next()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(b.String()).To(Equal("10.0.0.64/26"))
+	})
+
+	It("should skip blocks whose affinity is reserved", func() {
+		Expect(rw.reserveBlockAffinity(cnet.MustParseNetwork("10.0.0.0/26"), "host-b")).To(Succeed())
+		b, err := next()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(b.String()).To(Equal("10.0.0.64/26"))
+
+		Expect(rw.reserveBlockAffinity(cnet.MustParseNetwork("10.0.0.64/26"), "host-c")).To(Succeed())
+		_, err = next()
+		Expect(err).To(BeAssignableToTypeOf(noFreeBlocksError("")))
+	})
+
+	It("should not read each block when the blocks can be listed", func() {
+		for _, cidr := range []string{"10.0.0.0/26", "10.1.0.0/26"} {
+			n := cnet.MustParseNetwork(cidr)
+			backend.store(&model.KVPair{Key: model.BlockKey{CIDR: n}, Value: newBlock(n).AllocationBlock})
+		}
+		counting := &getCountingBackend{fakeBlockBackend: backend}
+		rw = blockReaderWriter{client: &Client{Backend: counting}}
+		b, err := next()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(b.String()).To(Equal("10.0.0.64/26"))
+		Expect(counting.gets).To(Equal(0))
+	})
+
+	It("should return a noFreeBlocksError when every block exists", func() {
+		for _, cidr := range []string{"10.0.0.0/26", "10.0.0.64/26"} {
+			n := cnet.MustParseNetwork(cidr)
+			backend.store(&model.KVPair{Key: model.BlockKey{CIDR: n}, Value: newBlock(n).AllocationBlock})
+		}
+		_, err := next()
+		Expect(err).To(BeAssignableToTypeOf(noFreeBlocksError("")))
+	})
+})
+
+var _ = Describe("fullPoolsForHost", func() {
+	var backend *fakeBlockBackend
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/25", false)
+		backend.storePool("10.0.1.0/25", false)
+		backend.storePool("10.0.2.0/25", true)
+		backend.storePool("fd80:24e2:f998:72d6::/120", false)
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+	})
+
+	It("should return an empty slice when the host can claim from every pool", func() {
+		full, err := rw.fullPoolsForHost("host-a", ipv4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(full).NotTo(BeNil())
+		Expect(full).To(BeEmpty())
+	})
+
+	It("should return the pools with no free blocks", func() {
+		for _, cidr := range []string{"10.0.0.0/26", "10.0.0.64/26"} {
+			n := cnet.MustParseNetwork(cidr)
+			backend.store(&model.KVPair{Key: model.BlockKey{CIDR: n}, Value: newBlock(n).AllocationBlock})
+		}
+		full, err := rw.fullPoolsForHost("host-a", ipv4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(full).To(ConsistOf(cnet.MustParseNetwork("10.0.0.0/25")))
+	})
+
+	It("should return every enabled pool once the host has reached its block cap", func() {
+		Expect(newIPAM(rw.client).SetIPAMConfig(IPAMConfig{AutoAllocateBlocks: true, MaxBlocksPerHost: 1})).To(Succeed())
+		Expect(rw.reserveBlockAffinity(cnet.MustParseNetwork("10.0.1.0/26"), "host-a")).To(Succeed())
+
+		full, err := rw.fullPoolsForHost("host-a", ipv4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(full).To(ConsistOf(cnet.MustParseNetwork("10.0.0.0/25"), cnet.MustParseNetwork("10.0.1.0/25")))
+
+		// The cap applies per host and per IP version.
+		full, err = rw.fullPoolsForHost("host-b", ipv4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(full).To(BeEmpty())
+		full, err = rw.fullPoolsForHost("host-a", ipv6)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(full).To(BeEmpty())
+	})
+
+	It("should be exposed on the IPAM interface", func() {
+		var i IPAMInterface = newIPAM(rw.client)
+		full, err := i.FullPoolsForHost("host-a", IPVersion4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(full).To(BeEmpty())
+	})
+})
+
+var _ = Describe("totalFreeAddresses", func() {
+	var backend *fakeBlockBackend
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+	})
+
+	storeBlock := func(cidr string, assign int) {
+		n := cnet.MustParseNetwork(cidr)
+		b := newBlock(n)
+		_, err := b.autoAssign(assign, nil, "host-a", nil, false, false, nil, "")
+		Expect(err).NotTo(HaveOccurred())
+		backend.store(&model.KVPair{Key: model.BlockKey{CIDR: n}, Value: b.AllocationBlock})
+	}
+
+	expectCounts := func(version ipVersion, free, total int64) {
+		var i IPAMInterface = newIPAM(rw.client)
+		f, t, err := i.TotalFreeAddresses(version)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Int64()).To(Equal(free))
+		Expect(t.Int64()).To(Equal(total))
+	}
+
+	It("should return zero when there are no pools", func() {
+		expectCounts(ipv4, 0, 0)
+	})
+
+	It("should count blocks that don't exist as free", func() {
+		backend.storePool("10.0.0.0/24", false)
+		backend.storePool("10.0.1.0/25", true)
+		expectCounts(ipv4, 384, 384)
+	})
+
+	It("should subtract the assigned addresses in each block", func() {
+		backend.storePool("10.0.0.0/24", false)
+		storeBlock("10.0.0.0/26", 3)
+		storeBlock("10.0.0.64/26", 64)
+		storeBlock("10.0.0.128/26", 0)
+		expectCounts(ipv4, 189, 256)
+	})
+
+	It("should ignore blocks outside the pools", func() {
+		backend.storePool("10.0.0.0/24", false)
+		storeBlock("10.0.1.0/26", 5)
+		expectCounts(ipv4, 256, 256)
+	})
+
+	It("should not count excluded addresses as free", func() {
+		backend.storePoolWithExclusions("10.0.0.0/24", "10.0.0.0/28", "10.0.0.0/30")
+		// The block's first three addresses are assigned, and are also
+		// excluded, so they are only counted once.
+		storeBlock("10.0.0.0/26", 20)
+		expectCounts(ipv4, 256-16-4, 256)
+	})
+
+	It("should not count reserved addresses as free", func() {
+		backend.storePoolWithReservedAddresses("10.0.0.0/24", "10.0.0.1", "10.0.0.200")
+		storeBlock("10.0.0.0/26", 4)
+		expectCounts(ipv4, 256-2-3, 256)
+	})
+
+	It("should not count nested pools twice", func() {
+		backend.storePool("10.0.0.0/24", false)
+		backend.storePool("10.0.0.0/25", false)
+		expectCounts(ipv4, 256, 256)
+	})
+
+	It("should count IPv6 pools larger than 64 bits", func() {
+		backend.storePool("10.0.0.0/24", false)
+		backend.storePool("fd80:24e2:f998:72d6::/48", false)
+		storeBlock("fd80:24e2:f998:72d6::/122", 2)
+		free, total, err := rw.totalFreeAddresses(ipv6)
+		Expect(err).NotTo(HaveOccurred())
+		expected := new(big.Int).Lsh(big.NewInt(1), 80)
+		Expect(total.Cmp(expected)).To(Equal(0))
+		Expect(free.Cmp(expected.Sub(expected, big.NewInt(2)))).To(Equal(0))
+	})
+})
+
+var _ = Describe("Configured block size", func() {
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+	})
+
+	It("should default to the package block sizes", func() {
+		cfg, err := ic.GetIPAMConfig()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.blockPrefixLength(ipv4)).To(Equal(26))
+		Expect(cfg.blockPrefixLength(ipv6)).To(Equal(122))
+	})
+
+	It("should store the block sizes", func() {
+		Expect(ic.SetIPAMConfig(IPAMConfig{AutoAllocateBlocks: true, IPv4BlockSize: 28, IPv6BlockSize: 120})).To(Succeed())
+		cfg, err := ic.GetIPAMConfig()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.IPv4BlockSize).To(Equal(28))
+		Expect(cfg.IPv6BlockSize).To(Equal(120))
+	})
+
+	It("should reject block sizes out of range", func() {
+		for _, cfg := range []IPAMConfig{
+			{AutoAllocateBlocks: true, IPv4BlockSize: 19},
+			{AutoAllocateBlocks: true, IPv4BlockSize: 33},
+			{AutoAllocateBlocks: true, IPv6BlockSize: 115},
+			{AutoAllocateBlocks: true, IPv6BlockSize: 129},
+		} {
+			Expect(ic.SetIPAMConfig(cfg)).To(BeAssignableToTypeOf(invalidSizeError("")))
+		}
+	})
+
+	It("should claim blocks of the stored size when no config is given", func() {
+		Expect(ic.SetIPAMConfig(IPAMConfig{AutoAllocateBlocks: true, IPv4BlockSize: 28})).To(Succeed())
+		b, err := ic.blockReaderWriter.claimNewAffineBlock("host-a", "", ipv4, nil, nil)
+		Expect(err).NotTo(HaveOccurred())
+		ones, _ := b.Mask.Size()
+		Expect(ones).To(Equal(28))
+	})
+
+	It("should find the block of the configured size for an address", func() {
+		ip := cnet.MustParseIP("10.0.0.21")
+		Expect(ic.blockReaderWriter.blockCIDRForAddress(ip, IPAMConfig{IPv4BlockSize: 28})).To(Equal(cnet.MustParseNetwork("10.0.0.16/28")))
+		Expect(ic.blockReaderWriter.blockCIDRForAddress(ip, IPAMConfig{})).To(Equal(cnet.MustParseNetwork("10.0.0.0/26")))
+	})
+})
+
+var _ = Describe("Pool block size", func() {
+	poolA := cnet.MustParseNetwork("10.0.0.0/24")
+	poolB := cnet.MustParseNetwork("10.1.0.0/24")
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePoolWithBlockSize("10.0.0.0/24", 28)
+		backend.storePool("10.1.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+		Expect(ic.SetIPAMConfig(IPAMConfig{AutoAllocateBlocks: true, IPv4BlockSize: 27})).To(Succeed())
+	})
+
+	It("should prefer the pool's block size to the configured block size", func() {
+		cfg, err := ic.GetIPAMConfig()
+		Expect(err).NotTo(HaveOccurred())
+		prefix, err := ic.blockReaderWriter.blockPrefixLengthForCIDR(poolA, *cfg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(prefix).To(Equal(28))
+		prefix, err = ic.blockReaderWriter.blockPrefixLengthForCIDR(poolB, *cfg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(prefix).To(Equal(27))
+		prefix, err = ic.blockReaderWriter.blockPrefixLengthForCIDR(poolB, IPAMConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(prefix).To(Equal(26))
+
+		blockCIDR, err := ic.blockReaderWriter.blockCIDRForAddress(cnet.MustParseIP("10.0.0.21"), *cfg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(blockCIDR.String()).To(Equal("10.0.0.16/28"))
+		blockCIDR, err = ic.blockReaderWriter.blockCIDRForAddress(cnet.MustParseIP("10.1.0.41"), *cfg)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(blockCIDR.String()).To(Equal("10.1.0.32/27"))
+	})
+
+	It("should assign from pools with different block sizes at the same time", func() {
+		type result struct {
+			host string
+			ips  []cnet.IP
+		}
+		results := make(chan result, 4)
+		var wg sync.WaitGroup
+		for i, pool := range []cnet.IPNet{poolA, poolB, poolA, poolB} {
+			wg.Add(1)
+			go func(host string, pool cnet.IPNet) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				assigned := []cnet.IP{}
+				for j := 0; j < 20; j++ {
+					ips, _, err := ic.AutoAssign(AutoAssignArgs{
+						Num4:      1,
+						Hostname:  host,
+						IPv4Pools: []cnet.IPNet{pool},
+					})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(ips).To(HaveLen(1))
+					assigned = append(assigned, ips...)
+				}
+				results <- result{host: host, ips: assigned}
+			}(fmt.Sprintf("host-%d", i), pool)
+		}
+		wg.Wait()
+		close(results)
+
+		seen := map[string]bool{}
+		all := []cnet.IP{}
+		for r := range results {
+			for _, ip := range r.ips {
+				Expect(seen).NotTo(HaveKey(ip.String()))
+				seen[ip.String()] = true
+				all = append(all, ip)
+			}
+		}
+		Expect(all).To(HaveLen(80))
+
+		// Each pool's blocks are of that pool's size.
+		kvps, err := backend.List(model.BlockListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		for _, kvp := range kvps {
+			cidr := kvp.Key.(model.BlockKey).CIDR
+			ones, _ := cidr.Mask.Size()
+			if poolA.Contains(cidr.IP) {
+				Expect(ones).To(Equal(28))
+			} else {
+				Expect(poolB.Contains(cidr.IP)).To(BeTrue())
+				Expect(ones).To(Equal(27))
+			}
+		}
+
+		// Every address is found in its block, and can be released.
+		for _, ip := range all {
+			_, err := ic.GetAssignmentAttributes(ip)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		unallocated, err := ic.ReleaseIPs(all)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unallocated).To(BeEmpty())
+	})
+
+	It("should not change the block size of a pool with blocks", func() {
+		_, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, Hostname: "host-a", IPv4Pools: []cnet.IPNet{poolA}})
+		Expect(err).NotTo(HaveOccurred())
+
+		pool, err := ic.client.IPPools().Get(api.IPPoolMetadata{CIDR: poolA})
+		Expect(err).NotTo(HaveOccurred())
+		size := 26
+		pool.Spec.BlockSize = &size
+		_, err = ic.client.IPPools().Update(pool)
+		Expect(err).To(BeAssignableToTypeOf(blockSizeInUseError{}))
+		_, err = ic.client.IPPools().Apply(pool)
+		Expect(err).To(BeAssignableToTypeOf(blockSizeInUseError{}))
+
+		// Nor can a pool of another block size replace a deleted pool
+		// whose blocks remain.
+		Expect(ic.client.IPPools().Delete(api.IPPoolMetadata{CIDR: poolA})).To(Succeed())
+		_, err = ic.client.IPPools().Create(pool)
+		Expect(err).To(BeAssignableToTypeOf(blockSizeInUseError{}))
+		size = 28
+		_, err = ic.client.IPPools().Create(pool)
+		Expect(err).NotTo(HaveOccurred())
+
+		// A pool without blocks may change its block size.
+		pool, err = ic.client.IPPools().Get(api.IPPoolMetadata{CIDR: poolB})
+		Expect(err).NotTo(HaveOccurred())
+		pool.Spec.BlockSize = &size
+		_, err = ic.client.IPPools().Update(pool)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("Pool excluded CIDRs", func() {
+	pool := cnet.MustParseNetwork("10.0.0.0/24")
+	partial := cnet.MustParseNetwork("10.0.0.64/26")
+	excluded := cnet.MustParseNetwork("10.0.0.96/28")
+	config := IPAMConfig{AssignmentStrategy: AssignmentStrategySequential}
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePoolWithExclusions("10.0.0.0/24", "10.0.0.0/26", "10.0.0.96/28")
+		ic = newIPAM(&Client{Backend: backend})
+	})
+
+	It("should only return the exclusions overlapping the CIDR", func() {
+		cidrs, err := ic.blockReaderWriter.excludedCIDRs(partial)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cidrs).To(Equal([]cnet.IPNet{excluded}))
+
+		cidrs, err = ic.blockReaderWriter.excludedCIDRs(cnet.MustParseNetwork("10.0.0.128/26"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cidrs).To(BeEmpty())
+	})
+
+	It("should not claim blocks overlapping an excluded CIDR", func() {
+		listed, err := ic.blockReaderWriter.claimedBlocks(ipv4)
+		Expect(err).NotTo(HaveOccurred())
+		b, err := ic.blockReaderWriter.nextFreeBlock("host-a", pool, config, listed)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(b.String()).To(Equal("10.0.0.128/26"))
+
+		claimed, err := ic.PartitionPool(pool, []string{"host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(claimed).To(Equal(map[string]int{"host-a": 2}))
+		_, err = backend.Get(model.BlockKey{CIDR: cnet.MustParseNetwork("10.0.0.0/26")})
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should not assign excluded addresses from a block which overlaps an excluded CIDR", func() {
+		Expect(ic.blockReaderWriter.claimBlockAffinity(partial, "host-a", IPAMConfig{})).To(Succeed())
+		ips, err := ic.AssignFromBlock(partial, 64, "host-a", nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(48))
+		for _, ip := range ips {
+			Expect(excluded.Contains(ip.IP)).To(BeFalse())
+		}
+	})
+
+	It("should not count excluded addresses as free", func() {
+		ips, err := ic.FreeIPsInPool(pool, 1000)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(256 - 64 - 16))
+	})
+})
+
+var _ = Describe("Retaining empty blocks", func() {
+	subnet := cnet.MustParseNetwork("10.0.0.0/26")
+	blockKey := model.BlockKey{CIDR: subnet}
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		ic = newIPAM(&Client{Backend: backend})
+		Expect(ic.SetIPAMConfig(IPAMConfig{AutoAllocateBlocks: true, RetainEmptyBlocks: true})).To(Succeed())
+		Expect(ic.blockReaderWriter.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+	})
+
+	It("should default to deleting empty blocks", func() {
+		cfg, err := newIPAM(&Client{Backend: newFakeBlockBackend()}).GetIPAMConfig()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.RetainEmptyBlocks).To(BeFalse())
+	})
+
+	It("should only remove the affinity when releasing an empty block", func() {
+		Expect(ic.blockReaderWriter.releaseBlockAffinity("host-a", subnet)).To(Succeed())
+
+		obj, err := backend.Get(blockKey)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.Value.(*model.AllocationBlock).Affinity).To(BeNil())
+		_, err = backend.Get(model.BlockAffinityKey{Host: "host-a", CIDR: subnet})
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+
+		// The retained block is still entirely free.
+		ips, err := ic.FreeIPsInPool(subnet, 100)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(64))
+	})
+
+	It("should let another host claim a retained empty block", func() {
+		Expect(ic.blockReaderWriter.releaseBlockAffinity("host-a", subnet)).To(Succeed())
+		Expect(ic.blockReaderWriter.claimBlockAffinity(subnet, "host-b", IPAMConfig{StrictAffinity: true})).To(Succeed())
+
+		obj, err := backend.Get(blockKey)
+		Expect(err).NotTo(HaveOccurred())
+		b := obj.Value.(*model.AllocationBlock)
+		Expect(*b.Affinity).To(Equal("host:host-b"))
+		Expect(b.StrictAffinity).To(BeTrue())
+	})
+
+	It("should keep a non-affine block when its last address is released", func() {
+		Expect(ic.blockReaderWriter.releaseBlockAffinity("host-a", subnet)).To(Succeed())
+		ip := cnet.MustParseIP("10.0.0.1")
+		obj, err := backend.Get(blockKey)
+		Expect(err).NotTo(HaveOccurred())
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		Expect(b.assign(ip, nil, nil, "host-a")).To(Succeed())
+		backend.store(obj)
+
+		_, err = ic.releaseIPsFromBlock([]cnet.IP{ip}, subnet)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = backend.Get(blockKey)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+// nonAtomicBackend is a fakeBlockBackend which, like the etcd v2 backend,
+// cannot perform transactions atomically.
+type nonAtomicBackend struct {
+	*fakeBlockBackend
+	txns int
+}
+
+func (n *nonAtomicBackend) Txn(ops []bapi.TxnOp, bestEffort bool) ([]*model.KVPair, error) {
+	n.txns++
+	return nil, errors.ErrorTransactionNotAtomic{Reason: "not supported by the fake backend"}
+}
+
+var _ = Describe("claimBlockAffinity", func() {
+	subnet := cnet.MustParseNetwork("10.0.0.0/26")
+	blockKey := model.BlockKey{CIDR: subnet}
+	affinityKey := model.BlockAffinityKey{Host: "host-a", CIDR: subnet}
+
+	var backend *fakeBlockBackend
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+	})
+
+	// preclaim simulates a claim which was interrupted after the block was
+	// created, but before the affinity was written.
+	preclaim := func(host string, strict bool) {
+		b := newBlock(subnet)
+		affinity := "host:" + host
+		b.Affinity = &affinity
+		b.StrictAffinity = strict
+		backend.store(&model.KVPair{Key: blockKey, Value: b.AllocationBlock})
+	}
+
+	strictAffinity := func() bool {
+		obj, err := backend.Get(blockKey)
+		Expect(err).NotTo(HaveOccurred())
+		return obj.Value.(*model.AllocationBlock).StrictAffinity
+	}
+
+	It("should create the block and affinity for a new claim", func() {
+		Expect(rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{StrictAffinity: true})).To(Succeed())
+		Expect(strictAffinity()).To(BeTrue())
+		_, err := backend.Get(affinityKey)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should record when and by which host the block was claimed", func() {
+		Expect(rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+		obj, err := backend.Get(blockKey)
+		Expect(err).NotTo(HaveOccurred())
+		b := obj.Value.(*model.AllocationBlock)
+		Expect(b.CreationTime.IsZero()).To(BeFalse())
+		Expect(b.Annotations).To(HaveKeyWithValue(blockAnnotationHost, "host-a"))
+		Expect(b.Annotations).To(HaveKey(blockAnnotationProcess))
+	})
+
+	It("should update StrictAffinity when a claim is retried with changed config", func() {
+		preclaim("host-a", false)
+		Expect(rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{StrictAffinity: true})).To(Succeed())
+		Expect(strictAffinity()).To(BeTrue())
+
+		Expect(rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{StrictAffinity: false})).To(Succeed())
+		Expect(strictAffinity()).To(BeFalse())
+	})
+
+	It("should recreate a missing affinity when the block is ours", func() {
+		preclaim("host-a", false)
+		Expect(rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+		_, err := backend.Get(affinityKey)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should not modify a block claimed by another host", func() {
+		preclaim("host-b", false)
+		err := rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{StrictAffinity: true})
+		Expect(err).To(BeAssignableToTypeOf(affinityClaimedError{}))
+		Expect(strictAffinity()).To(BeFalse())
+		_, err = backend.Get(affinityKey)
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+	})
+
+	It("should write neither the affinity nor the block if the claim fails", func() {
+		backend.InjectError(fake.OperationCreate, blockKey, errors.ErrorDatastoreError{Err: goerrors.New("injected failure"), Identifier: blockKey}, 0)
+		err := rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{})
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorDatastoreError{}))
+		_, err = backend.Get(affinityKey)
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+		_, err = backend.Get(blockKey)
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should write the affinity and block in turn if the backend is not atomic", func() {
+		nonAtomic := &nonAtomicBackend{fakeBlockBackend: backend}
+		rw = blockReaderWriter{client: &Client{Backend: nonAtomic}}
+		Expect(rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{StrictAffinity: true})).To(Succeed())
+		Expect(nonAtomic.txns).To(Equal(1))
+		Expect(strictAffinity()).To(BeTrue())
+		_, err := backend.Get(affinityKey)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("preferredPoolsFirst", func() {
+	preferredPool := func(cidr string, hosts ...string) api.IPPool {
+		p := testPool(cidr, false)
+		p.Spec.PreferredHosts = hosts
+		return p
+	}
+	cidrs := []cnet.IPNet{
+		cnet.MustParseNetwork("10.0.0.0/24"),
+		cnet.MustParseNetwork("10.1.0.0/24"),
+		cnet.MustParseNetwork("10.2.0.0/24"),
+	}
+
+	It("should not reorder pools when no pools prefer the host", func() {
+		pools := []api.IPPool{
+			testPool("10.0.0.0/24", false),
+			preferredPool("10.1.0.0/24", "host-b"),
+			testPool("10.2.0.0/24", false),
+		}
+		Expect(preferredPoolsFirst(cidrs, pools, "host-a")).To(Equal(cidrs))
+	})
+
+	It("should try the pools that prefer the host first", func() {
+		pools := []api.IPPool{
+			testPool("10.0.0.0/24", false),
+			preferredPool("10.1.0.0/24", "host-b"),
+			preferredPool("10.2.0.0/24", "host-a", "host-b"),
+		}
+		Expect(preferredPoolsFirst(cidrs, pools, "host-a")).To(Equal([]cnet.IPNet{
+			cnet.MustParseNetwork("10.2.0.0/24"),
+			cnet.MustParseNetwork("10.0.0.0/24"),
+			cnet.MustParseNetwork("10.1.0.0/24"),
+		}))
+		Expect(preferredPoolsFirst(cidrs, pools, "host-b")).To(Equal([]cnet.IPNet{
+			cnet.MustParseNetwork("10.1.0.0/24"),
+			cnet.MustParseNetwork("10.2.0.0/24"),
+			cnet.MustParseNetwork("10.0.0.0/24"),
+		}))
+	})
+
+	It("should only return the given pool CIDRs", func() {
+		pools := []api.IPPool{
+			preferredPool("10.3.0.0/24", "host-a"),
+		}
+		Expect(preferredPoolsFirst(cidrs, pools, "host-a")).To(Equal(cidrs))
+	})
+})
+
+var _ = Describe("Pool distribution", func() {
+	poolA := cnet.MustParseNetwork("10.0.0.0/24")
+	poolB := cnet.MustParseNetwork("10.0.1.0/24")
+	poolC := cnet.MustParseNetwork("10.0.2.0/24")
+
+	var backend *fakeBlockBackend
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		backend.storePool("10.0.1.0/24", false)
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+	})
+
+	// claim claims num blocks for the host and returns the number claimed
+	// from each pool.  Like a bare AutoAssign, it does not request any
+	// pools.
+	claim := func(num int, config IPAMConfig) map[string]int {
+		claimed := map[string]int{}
+		for i := 0; i < num; i++ {
+			b, err := rw.claimNewAffineBlock("host-a", "", ipv4, nil, &config)
+			Expect(err).NotTo(HaveOccurred())
+			for _, p := range []cnet.IPNet{poolA, poolB, poolC} {
+				if p.Contains(b.IP) {
+					claimed[p.String()]++
+				}
+			}
+		}
+		return claimed
+	}
+
+	It("should list the blocks once however many pools are tried", func() {
+		Expect(claim(4, IPAMConfig{})).To(Equal(map[string]int{"10.0.0.0/24": 4}))
+		counting := &blockListCountingBackend{fakeBlockBackend: backend}
+		rw = blockReaderWriter{client: &Client{Backend: counting}}
+		for _, config := range []IPAMConfig{{}, {PoolDistribution: PoolDistributionBalanced}} {
+			counting.blockLists = 0
+			Expect(claim(1, config)).To(Equal(map[string]int{"10.0.1.0/24": 1}))
+			Expect(counting.blockLists).To(Equal(1))
+		}
+	})
+
+	It("should drain the pools in order by default", func() {
+		Expect(claim(4, IPAMConfig{})).To(Equal(map[string]int{"10.0.0.0/24": 4}))
+		Expect(claim(1, IPAMConfig{})).To(Equal(map[string]int{"10.0.1.0/24": 1}))
+	})
+
+	It("should drain the lowest pool first regardless of the order the pools are listed in", func() {
+		rw.client.Backend = reversingBackend{backend}
+		Expect(claim(1, IPAMConfig{})).To(Equal(map[string]int{"10.0.0.0/24": 1}))
+		Expect(claim(1, IPAMConfig{PoolDistribution: PoolDistributionSequential})).To(Equal(map[string]int{"10.0.0.0/24": 1}))
+	})
+
+	It("should try the requested pools in the order they were requested", func() {
+		config := IPAMConfig{}
+		b, err := rw.claimNewAffineBlock("host-a", "", ipv4, []cnet.IPNet{poolB, poolA}, &config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(poolB.Contains(b.IP)).To(BeTrue())
+	})
+
+	It("should drain the pools with the highest priority first", func() {
+		backend.storePoolWithPriority("10.0.1.0/24", 10)
+		backend.storePoolWithPriority("10.0.2.0/24", 5)
+		config := IPAMConfig{PoolDistribution: PoolDistributionPriority}
+		Expect(claim(4, config)).To(Equal(map[string]int{"10.0.1.0/24": 4}))
+		Expect(claim(4, config)).To(Equal(map[string]int{"10.0.2.0/24": 4}))
+		Expect(claim(1, config)).To(Equal(map[string]int{"10.0.0.0/24": 1}))
+	})
+
+	It("should keep the order of pools with the same priority", func() {
+		pools := highestPriorityFirst([]cnet.IPNet{poolA, poolB, poolC}, []api.IPPool{
+			{Metadata: api.IPPoolMetadata{CIDR: poolA}},
+			{Metadata: api.IPPoolMetadata{CIDR: poolB}},
+			{Metadata: api.IPPoolMetadata{CIDR: poolC}, Spec: api.IPPoolSpec{Priority: 5}},
+		})
+		Expect(pools).To(Equal([]cnet.IPNet{poolC, poolA, poolB}))
+	})
+
+	It("should spread claims across the pools when balanced", func() {
+		Expect(claim(4, IPAMConfig{PoolDistribution: PoolDistributionBalanced})).To(Equal(map[string]int{
+			"10.0.0.0/24": 2,
+			"10.0.1.0/24": 2,
+		}))
+	})
+
+	It("should order the pools by their free blocks", func() {
+		// Pool B has one block claimed, and pool C is smaller.
+		backend.storePool("10.0.2.0/25", false)
+		poolC := cnet.MustParseNetwork("10.0.2.0/25")
+		backend.store(&model.KVPair{
+			Key:   model.BlockKey{CIDR: cnet.MustParseNetwork("10.0.1.0/26")},
+			Value: &model.AllocationBlock{CIDR: cnet.MustParseNetwork("10.0.1.0/26")},
+		})
+		claimed, err := rw.claimedBlocks(ipv4)
+		Expect(err).NotTo(HaveOccurred())
+		pools, err := rw.mostFreeBlocksFirst([]cnet.IPNet{poolC, poolB, poolA}, IPAMConfig{}, claimed)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pools).To(Equal([]cnet.IPNet{poolA, poolB, poolC}))
+	})
+
+	It("should keep the order of pools with the same free blocks", func() {
+		pools, err := rw.mostFreeBlocksFirst([]cnet.IPNet{poolB, poolA}, IPAMConfig{}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pools).To(Equal([]cnet.IPNet{poolB, poolA}))
+	})
+})
+
+var _ = Describe("Pool zones", func() {
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend := newFakeBlockBackend()
+		backend.storePoolInZone("10.0.0.0/24", "zone-b")
+		backend.storePoolInZone("10.0.1.0/24", "zone-a")
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+	})
+
+	// claim claims num blocks for a host in the zone and returns the
+	// number claimed from each pool.
+	claim := func(num int, zone string) map[string]int {
+		claimed := map[string]int{}
+		for i := 0; i < num; i++ {
+			b, err := rw.claimNewAffineBlock("host-a", zone, ipv4, nil, &IPAMConfig{})
+			Expect(err).NotTo(HaveOccurred())
+			claimed[blockCIDRWithPrefixLength(cnet.IP{b.IP}, 24).String()]++
+		}
+		return claimed
+	}
+
+	It("should drain the pool in the host's zone before the other zone", func() {
+		Expect(claim(4, "zone-a")).To(Equal(map[string]int{"10.0.1.0/24": 4}))
+		Expect(claim(1, "zone-a")).To(Equal(map[string]int{"10.0.0.0/24": 1}))
+	})
+
+	It("should keep the pool order when no zone is given", func() {
+		Expect(claim(4, "")).To(Equal(map[string]int{"10.0.0.0/24": 4}))
+	})
+
+	It("should try the pools that prefer the host before the host's zone", func() {
+		pools := []cnet.IPNet{cnet.MustParseNetwork("10.0.0.0/24"), cnet.MustParseNetwork("10.0.1.0/24"), cnet.MustParseNetwork("10.0.2.0/24")}
+		all := []api.IPPool{
+			{Metadata: api.IPPoolMetadata{CIDR: pools[0]}},
+			{Metadata: api.IPPoolMetadata{CIDR: pools[1]}, Spec: api.IPPoolSpec{Zone: "zone-a"}},
+			{Metadata: api.IPPoolMetadata{CIDR: pools[2]}, Spec: api.IPPoolSpec{Zone: "zone-b", PreferredHosts: []string{"host-a"}}},
+		}
+		ordered := preferredPoolsFirst(sameZonePoolsFirst(pools, all, "zone-a"), all, "host-a")
+		Expect(ordered).To(Equal([]cnet.IPNet{pools[2], pools[1], pools[0]}))
+	})
+})
+
+var _ = Describe("forceReleaseBlockAffinity", func() {
+	subnet := cnet.MustParseNetwork("10.0.0.0/26")
+	blockKey := model.BlockKey{CIDR: subnet}
+	affinityKey := model.BlockAffinityKey{Host: "host-b", CIDR: subnet}
+
+	var backend *fakeBlockBackend
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.allowDestructiveOps()
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+		Expect(rw.claimBlockAffinity(subnet, "host-b", IPAMConfig{})).To(Succeed())
+	})
+
+	It("should delete an empty block affine to another host", func() {
+		Expect(rw.forceReleaseBlockAffinity(subnet)).To(Succeed())
+		_, err := backend.Get(blockKey)
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+		_, err = backend.Get(affinityKey)
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+	})
+
+	It("should preserve the allocations of a block affine to another host", func() {
+		obj, err := backend.Get(blockKey)
+		Expect(err).NotTo(HaveOccurred())
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		Expect(b.assign(cnet.MustParseIP("10.0.0.1"), nil, nil, "host-b")).To(Succeed())
+		_, err = backend.Update(obj)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(rw.forceReleaseBlockAffinity(subnet)).To(Succeed())
+		obj, err = backend.Get(blockKey)
+		Expect(err).NotTo(HaveOccurred())
+		b = allocationBlock{obj.Value.(*model.AllocationBlock)}
+		Expect(b.Affinity).To(BeNil())
+		Expect(b.assignedIPs()).To(HaveLen(1))
+		_, err = backend.Get(affinityKey)
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+	})
+
+	It("should still refuse a non-forced release for another host", func() {
+		err := rw.releaseBlockAffinity("host-a", subnet)
+		Expect(err).To(BeAssignableToTypeOf(affinityClaimedError{}))
+		_, err = backend.Get(affinityKey)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("reserveBlockAffinity", func() {
+	subnet := cnet.MustParseNetwork("10.0.0.0/26")
+	blockKey := model.BlockKey{CIDR: subnet}
+	affinityKey := model.BlockAffinityKey{Host: "host-a", CIDR: subnet}
+
+	var backend *fakeBlockBackend
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+		Expect(rw.reserveBlockAffinity(subnet, "host-a")).To(Succeed())
+	})
+
+	It("should write the affinity without creating the block", func() {
+		_, err := backend.Get(affinityKey)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = backend.Get(blockKey)
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+	})
+
+	It("should create the block with the reserved affinity", func() {
+		Expect(rw.createAffineBlock(subnet, nil, "host-a", IPAMConfig{})).To(Succeed())
+		obj, err := backend.Get(blockKey)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hostAffinityMatches("host-a", obj.Value.(*model.AllocationBlock))).To(BeTrue())
+	})
+
+	It("should release a reserved affinity whose block was never created", func() {
+		Expect(rw.releaseBlockAffinity("host-a", subnet)).To(Succeed())
+		_, err := backend.Get(affinityKey)
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+	})
+
+	It("should require a host", func() {
+		Expect(rw.reserveBlockAffinity(subnet, "")).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("releaseEmptyBlockAffinity", func() {
+	subnet := cnet.MustParseNetwork("10.0.0.0/26")
+	blockKey := model.BlockKey{CIDR: subnet}
+	affinityKey := model.BlockAffinityKey{Host: "host-a", CIDR: subnet}
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+		Expect(ic.blockReaderWriter.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+	})
+
+	It("should release the affinity of an empty block", func() {
+		Expect(ic.blockReaderWriter.releaseEmptyBlockAffinity("host-a", subnet)).To(Succeed())
+		_, err := backend.Get(affinityKey)
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+		_, err = backend.Get(blockKey)
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+	})
+
+	It("should keep the affinity of a block with addresses assigned", func() {
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.1"), Hostname: "host-a"})).To(Succeed())
+
+		err := ic.blockReaderWriter.releaseEmptyBlockAffinity("host-a", subnet)
+		Expect(err).To(Equal(blockNotEmptyError{Block: subnet}))
+		_, err = backend.Get(affinityKey)
+		Expect(err).NotTo(HaveOccurred())
+		obj, err := backend.Get(blockKey)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hostAffinityMatches("host-a", obj.Value.(*model.AllocationBlock))).To(BeTrue())
+
+		// Once the address is released, so can the affinity be.
+		_, err = ic.ReleaseIPs([]cnet.IP{cnet.MustParseIP("10.0.0.1")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ic.blockReaderWriter.releaseEmptyBlockAffinity("host-a", subnet)).To(Succeed())
+	})
+
+	It("should refuse to release another host's affinity", func() {
+		err := ic.blockReaderWriter.releaseEmptyBlockAffinity("host-b", subnet)
+		Expect(err).To(BeAssignableToTypeOf(affinityClaimedError{}))
+
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.1"), Hostname: "host-a"})).To(Succeed())
+		err = ic.blockReaderWriter.releaseEmptyBlockAffinity("host-b", subnet)
+		Expect(err).To(BeAssignableToTypeOf(affinityClaimedError{}))
+		_, err = backend.Get(affinityKey)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should release a reserved affinity whose block was never created", func() {
+		other := cnet.MustParseNetwork("10.0.0.64/26")
+		Expect(ic.blockReaderWriter.reserveBlockAffinity(other, "host-a")).To(Succeed())
+		Expect(ic.blockReaderWriter.releaseEmptyBlockAffinity("host-a", other)).To(Succeed())
+		_, err := backend.Get(model.BlockAffinityKey{Host: "host-a", CIDR: other})
+		Expect(err).To(BeAssignableToTypeOf(errors.ErrorResourceDoesNotExist{}))
+	})
+})
+
+// claimingBackend is a fakeBlockBackend which simulates another host claiming
+// a block just before the first block update, which then conflicts.
+type claimingBackend struct {
+	*fakeBlockBackend
+	host    string
+	claimed bool
+}
+
+func (c *claimingBackend) Update(kvp *model.KVPair) (*model.KVPair, error) {
+	if _, ok := kvp.Key.(model.BlockKey); ok && !c.claimed {
+		c.claimed = true
+		existing, _ := c.fakeBlockBackend.Get(kvp.Key)
+		b := *existing.Value.(*model.AllocationBlock)
+		affinity := "host:" + c.host
+		b.Affinity = &affinity
+		c.store(&model.KVPair{Key: kvp.Key, Value: &b})
+		return nil, errors.ErrorResourceUpdateConflict{Identifier: kvp.Key}
+	}
+	return c.fakeBlockBackend.Update(kvp)
+}
+
+var _ = Describe("ReclaimOrphanedBlocks", func() {
+	blockA := cnet.MustParseNetwork("10.0.0.0/26")
+	blockB := cnet.MustParseNetwork("10.0.0.64/26")
+	blockC := cnet.MustParseNetwork("10.0.0.128/26")
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+		Expect(ic.blockReaderWriter.claimBlockAffinity(blockA, "host-a", IPAMConfig{})).To(Succeed())
+		Expect(ic.blockReaderWriter.claimBlockAffinity(blockB, "host-b", IPAMConfig{})).To(Succeed())
+		Expect(ic.blockReaderWriter.claimBlockAffinity(blockC, "host-c", IPAMConfig{})).To(Succeed())
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.130"), Hostname: "host-c"})).To(Succeed())
+	})
+
+	It("should reclaim blocks affine to hosts that no longer exist", func() {
+		reclaimed, inUse, err := ic.ReclaimOrphanedBlocks([]string{"host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reclaimed).To(Equal([]cnet.IPNet{blockB}))
+		Expect(inUse).To(Equal([]cnet.IPNet{blockC}))
+
+		// The empty block is deleted, and the block in use is kept without
+		// affinity.
+		_, err = backend.Get(model.BlockKey{CIDR: blockB})
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+		obj, err := backend.Get(model.BlockKey{CIDR: blockC})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.Value.(*model.AllocationBlock).Affinity).To(BeNil())
+		for host, cidr := range map[string]cnet.IPNet{"host-b": blockB, "host-c": blockC} {
+			_, err = backend.Get(model.BlockAffinityKey{Host: host, CIDR: cidr})
+			Expect(errors.IsNotExist(err)).To(BeTrue())
+		}
+
+		// The valid host keeps its block.
+		_, err = backend.Get(model.BlockAffinityKey{Host: "host-a", CIDR: blockA})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should do nothing when every host is valid", func() {
+		reclaimed, inUse, err := ic.ReclaimOrphanedBlocks([]string{"host-a", "host-b", "host-c"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reclaimed).To(BeEmpty())
+		Expect(inUse).To(BeEmpty())
+	})
+
+	It("should leave a block claimed by another host during the reclaim", func() {
+		claiming := &claimingBackend{fakeBlockBackend: backend, host: "host-z"}
+		ic = newIPAM(&Client{Backend: claiming})
+
+		reclaimed, inUse, err := ic.ReclaimOrphanedBlocks([]string{"host-a", "host-b", "host-z"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(reclaimed).To(BeEmpty())
+		Expect(inUse).To(BeEmpty())
+
+		// The block keeps its new affinity and its allocations, and only
+		// the stale affinity is removed.
+		obj, err := backend.Get(model.BlockKey{CIDR: blockC})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hostAffinityMatches("host-z", obj.Value.(*model.AllocationBlock))).To(BeTrue())
+		Expect(allocationBlock{obj.Value.(*model.AllocationBlock)}.empty()).To(BeFalse())
+		_, err = backend.Get(model.BlockAffinityKey{Host: "host-c", CIDR: blockC})
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+})
+
+// poolHidingBackend is a fakeBlockBackend which lists no IP pools while
+// hidePools is set, to simulate another host creating a pool after the pools
+// were read.
+type poolHidingBackend struct {
+	*fakeBlockBackend
+	hidePools bool
+}
+
+func (p *poolHidingBackend) List(l model.ListInterface) ([]*model.KVPair, error) {
+	if _, ok := l.(model.IPPoolListOptions); ok && p.hidePools {
+		p.hidePools = false
+		return []*model.KVPair{}, nil
+	}
+	return p.fakeBlockBackend.List(l)
+}
+
+var _ = Describe("Default pool", func() {
+	var backend *fakeBlockBackend
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+	})
+
+	pools := func() []string {
+		l, err := rw.listPools()
+		Expect(err).NotTo(HaveOccurred())
+		s := []string{}
+		for _, p := range l.Items {
+			s = append(s, p.Metadata.CIDR.String())
+		}
+		return s
+	}
+
+	It("should not create a pool unless configured to", func() {
+		_, err := rw.claimNewAffineBlock("host-a", "", ipv4, nil, &IPAMConfig{})
+		Expect(err).To(MatchError("No configured Calico pools"))
+		Expect(pools()).To(BeEmpty())
+	})
+
+	It("should create the default pool and claim a block from it", func() {
+		b, err := rw.claimNewAffineBlock("host-a", "", ipv4, nil, &IPAMConfig{AutoCreateDefaultPool: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pools()).To(Equal([]string{"192.168.0.0/16"}))
+		Expect(defaultPoolCIDR.Contains(b.IP)).To(BeTrue())
+	})
+
+	It("should create the configured pool", func() {
+		cidr := cnet.MustParseNetwork("fd00::/120")
+		config := &IPAMConfig{AutoCreateDefaultPool: true, DefaultPoolCIDR: &cidr}
+
+		// The pool is not created for an assignment of the other version.
+		_, err := rw.claimNewAffineBlock("host-a", "", ipv4, nil, config)
+		Expect(err).To(MatchError("No configured Calico pools"))
+		Expect(pools()).To(BeEmpty())
+
+		b, err := rw.claimNewAffineBlock("host-a", "", ipv6, nil, config)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pools()).To(Equal([]string{"fd00::/120"}))
+		Expect(cidr.Contains(b.IP)).To(BeTrue())
+	})
+
+	It("should use the pool created by another host", func() {
+		cidr := cnet.MustParseNetwork("10.0.0.0/24")
+		backend.storePool("10.0.0.0/24", false)
+		rw.client.Backend = &poolHidingBackend{fakeBlockBackend: backend, hidePools: true}
+
+		b, err := rw.claimNewAffineBlock("host-a", "", ipv4, nil, &IPAMConfig{AutoCreateDefaultPool: true, DefaultPoolCIDR: &cidr})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cidr.Contains(b.IP)).To(BeTrue())
+		Expect(pools()).To(Equal([]string{"10.0.0.0/24"}))
+	})
+
+	It("should create the default pool on the first assignment", func() {
+		ic := newIPAM(rw.client)
+		Expect(ic.SetIPAMConfig(IPAMConfig{AutoAllocateBlocks: true, AutoCreateDefaultPool: true})).To(Succeed())
+		v4, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v4).To(HaveLen(1))
+		Expect(defaultPoolCIDR.Contains(v4[0].IP)).To(BeTrue())
+		Expect(pools()).To(Equal([]string{"192.168.0.0/16"}))
+	})
+
+	It("should create the default pool on the first dual-stack assignment", func() {
+		cidr := cnet.MustParseNetwork("fd00::/120")
+		ic := newIPAM(rw.client)
+		Expect(ic.SetIPAMConfig(IPAMConfig{AutoAllocateBlocks: true, AutoCreateDefaultPool: true, DefaultPoolCIDR: &cidr})).To(Succeed())
+		result, err := ic.AutoAssignDualStack(AutoAssignArgs{Num4: 1, Num6: 1, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPv6Error).NotTo(HaveOccurred())
+		Expect(result.IPv6).To(HaveLen(1))
+		Expect(cidr.Contains(result.IPv6[0].IP)).To(BeTrue())
+
+		// There is still no IPv4 pool to assign from.
+		Expect(result.IPv4Error).To(HaveOccurred())
+		Expect(pools()).To(Equal([]string{"fd00::/120"}))
+	})
+
+	It("should create the default pool when assigning an address within it", func() {
+		ic := newIPAM(rw.client)
+		Expect(ic.SetIPAMConfig(IPAMConfig{AutoAllocateBlocks: true, AutoCreateDefaultPool: true})).To(Succeed())
+
+		// The pool is not created for an address it wouldn't contain.
+		err := ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.1"), Hostname: "host-a"})
+		Expect(err).To(HaveOccurred())
+		Expect(pools()).To(BeEmpty())
+
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("192.168.0.1"), Hostname: "host-a"})).To(Succeed())
+		Expect(pools()).To(Equal([]string{"192.168.0.0/16"}))
+	})
+
+	It("should store the option in the IPAM configuration", func() {
+		cidr := cnet.MustParseNetwork("10.0.0.0/24")
+		ic := newIPAM(rw.client)
+		cfg := IPAMConfig{AutoAllocateBlocks: true, AutoCreateDefaultPool: true, DefaultPoolCIDR: &cidr}
+		Expect(ic.SetIPAMConfig(cfg)).To(Succeed())
+		Expect(ic.GetIPAMConfig()).To(Equal(&cfg))
+	})
+})
+
+var _ = Describe("Pools overlapping a CIDR", func() {
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend := newFakeBlockBackend()
+		backend.storePool("10.1.0.0/16", false)
+		backend.storePool("10.0.0.0/24", false)
+		backend.storePool("10.0.1.0/24", false)
+		backend.storePool("10.0.2.0/24", true)
+		backend.storePool("fd00::/64", false)
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+	})
+
+	cidrs := func(pools []api.IPPool) []string {
+		s := []string{}
+		for _, p := range pools {
+			s = append(s, p.Metadata.CIDR.String())
+		}
+		return s
+	}
+
+	It("should return the pools contained by the CIDR, sorted by CIDR", func() {
+		pools, err := rw.poolsOverlapping(cnet.MustParseNetwork("10.0.0.0/8"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cidrs(pools)).To(Equal([]string{"10.0.0.0/24", "10.0.1.0/24", "10.1.0.0/16"}))
+	})
+
+	It("should return the pool containing the CIDR", func() {
+		pools, err := rw.poolsOverlapping(cnet.MustParseNetwork("10.1.2.0/26"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cidrs(pools)).To(Equal([]string{"10.1.0.0/16"}))
+	})
+
+	It("should return the pools partly overlapping the CIDR", func() {
+		pools, err := rw.poolsOverlapping(cnet.MustParseNetwork("10.0.1.0/23"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cidrs(pools)).To(Equal([]string{"10.0.0.0/24", "10.0.1.0/24"}))
+
+		// A CIDR with host bits set is treated as its network.
+		pools, err = rw.poolsOverlapping(cnet.MustParseNetwork("fd00::1:0/32"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cidrs(pools)).To(Equal([]string{"fd00::/64"}))
+	})
+
+	It("should not return disabled pools or pools which do not overlap", func() {
+		pools, err := rw.poolsOverlapping(cnet.MustParseNetwork("10.0.2.0/24"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pools).To(BeEmpty())
+
+		pools, err = rw.poolsOverlapping(cnet.MustParseNetwork("192.168.0.0/16"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pools).To(BeEmpty())
+	})
+
+	It("should be exposed on the IPAM interface", func() {
+		var i IPAMInterface = newIPAM(rw.client)
+		pools, err := i.PoolsOverlapping(cnet.MustParseNetwork("10.1.2.0/26"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cidrs(pools)).To(Equal([]string{"10.1.0.0/16"}))
+	})
+})
+
+var _ = Describe("Claiming a block without a usable pool", func() {
+	var backend *fakeBlockBackend
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+	})
+
+	claim := func(version ipVersion) error {
+		_, err := rw.claimNewAffineBlock("host-a", "", version, nil, &IPAMConfig{})
+		return err
+	}
+
+	It("should report that there are no pools at all", func() {
+		Expect(claim(ipv4)).To(Equal(noPoolsError{}))
+	})
+
+	It("should reject an invalid IP version rather than claim a block", func() {
+		backend.storePool("10.0.0.0/24", false)
+		Expect(claim(ipVersion{})).To(Equal(invalidIPVersionError{Number: 0}))
+		Expect(claim(ipVersion{Number: 5, TotalBits: 32, BlockPrefixLength: 26})).To(Equal(invalidIPVersionError{Number: 5}))
+		blocks, err := backend.List(model.BlockListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(blocks).To(BeEmpty())
+
+		// A version with only its number set gets the right block size.
+		b, err := rw.claimNewAffineBlock("host-a", "", ipVersion{Number: 4}, nil, &IPAMConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(b.String()).To(Equal("10.0.0.0/26"))
+	})
+
+	It("should report that there are no pools of the version", func() {
+		backend.storePool("fd00::/120", false)
+		Expect(claim(ipv4)).To(Equal(noPoolsForVersionError{Version: 4}))
+
+		// Requesting only pools of the other version is the same.
+		backend.storePool("10.0.0.0/24", false)
+		_, err := rw.claimNewAffineBlock("host-a", "", ipv4, []cnet.IPNet{cnet.MustParseNetwork("fd00::/120")}, &IPAMConfig{})
+		Expect(err).To(Equal(noPoolsForVersionError{Version: 4}))
+	})
+
+	It("should report that every pool of the version is disabled", func() {
+		backend.storePool("10.0.0.0/24", true)
+		backend.storePool("10.0.1.0/24", true)
+		backend.storePool("fd00::/120", false)
+		Expect(claim(ipv4)).To(Equal(poolsDisabledError{Version: 4}))
+		Expect(claim(ipv6)).To(Succeed())
+	})
+})
+
+var _ = Describe("Block affinity host names", func() {
+	subnet := cnet.MustParseNetwork("10.0.0.0/26")
+
+	var backend *fakeBlockBackend
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+	})
+
+	It("should claim and release blocks for host names with dots and dashes", func() {
+		for _, host := range []string{"host-a", "node-1.example.com", "0"} {
+			Expect(rw.claimBlockAffinity(subnet, host, IPAMConfig{})).To(Succeed())
+
+			// The affinity's key can be converted to a path and back.
+			key := model.BlockAffinityKey{Host: host, CIDR: subnet}
+			path, err := model.KeyToDefaultPath(key)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(model.BlockAffinityListOptions{}.KeyFromDefaultPath(path)).To(Equal(key))
+			_, err = backend.Get(key)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(rw.releaseBlockAffinity(host, subnet)).To(Succeed())
+		}
+	})
+
+	It("should reject claims for host names which can't be used in an affinity key", func() {
+		long := strings.Repeat("a", 63) + "." + strings.Repeat("b", 63) + "." + strings.Repeat("c", 63) + "." + strings.Repeat("d", 63)
+		for _, host := range []string{"Host-A", "host/a", "host_a", "host a", "-host", "host.", "host..a", long} {
+			err := rw.claimBlockAffinity(subnet, host, IPAMConfig{})
+			Expect(err).To(BeAssignableToTypeOf(invalidHostNameError{}), host)
+			_, _, err = newIPAM(rw.client).AutoAssign(AutoAssignArgs{Num4: 1, Hostname: host})
+			Expect(err).To(BeAssignableToTypeOf(invalidHostNameError{}), host)
+		}
+
+		// Nothing was written.
+		_, err := backend.Get(model.BlockKey{CIDR: subnet})
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+		affinities, err := backend.List(model.BlockAffinityListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(affinities).To(BeEmpty())
+	})
+
+	It("should release affinities written before host names were validated", func() {
+		b := newAffineBlock(subnet, nil, "Host-A", IPAMConfig{})
+		backend.store(&model.KVPair{Key: model.BlockKey{CIDR: subnet}, Value: b.AllocationBlock})
+		backend.store(&model.KVPair{Key: model.BlockAffinityKey{Host: "Host-A", CIDR: subnet}, Value: model.BlockAffinityValue})
+
+		Expect(rw.releaseBlockAffinity("Host-A", subnet)).To(Succeed())
+		affinities, err := backend.List(model.BlockAffinityListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(affinities).To(BeEmpty())
+	})
+})
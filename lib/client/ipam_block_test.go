@@ -0,0 +1,505 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"math/big"
+	"net"
+	"sort"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+var _ = Describe("Allocation block", func() {
+	var b allocationBlock
+	handle := "handle-1"
+	attrs := map[string]string{"pod": "pod-1", "namespace": "default"}
+
+	BeforeEach(func() {
+		b = newBlock(cnet.MustParseNetwork("10.0.0.0/26"))
+	})
+
+	Describe("attributeForIP", func() {
+		It("should return the handle and attributes of an assigned IP", func() {
+			ip := cnet.MustParseIP("10.0.0.5")
+			Expect(b.assign(ip, &handle, attrs, "host-A")).NotTo(HaveOccurred())
+
+			attr, err := b.attributeForIP(ip)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*attr.AttrPrimary).To(Equal(handle))
+			Expect(attr.AttrSecondary).To(Equal(attrs))
+		})
+
+		It("should return a notAssignedError for an unassigned IP", func() {
+			_, err := b.attributeForIP(cnet.MustParseIP("10.0.0.6"))
+			Expect(err).To(Equal(notAssignedError{IP: cnet.MustParseIP("10.0.0.6")}))
+		})
+	})
+})
+
+var _ = Describe("Allocation block for a pool smaller than a block", func() {
+	It("should only contain the addresses in the pool", func() {
+		b := newBlock(cnet.MustParseNetwork("10.0.0.16/28"))
+		Expect(b.numAddresses()).To(Equal(16))
+		Expect(b.numFreeAddresses()).To(Equal(16))
+
+		ips, err := b.autoAssign(20, nil, "host-A", nil, false, false, nil, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(16))
+		for _, ip := range ips {
+			Expect(b.CIDR.Contains(ip.IP)).To(BeTrue())
+		}
+		Expect(b.numFreeAddresses()).To(Equal(0))
+	})
+})
+
+var _ = Describe("Allocation block with a shorter block prefix", func() {
+	It("should contain every address in the block", func() {
+		b := newBlock(cnet.MustParseNetwork("fd80:24e2:f998:72d6::/120"))
+		Expect(b.numAddresses()).To(Equal(256))
+
+		ips, err := b.autoAssign(256, nil, "host-A", nil, false, false, nil, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(256))
+		Expect(ips[255].String()).To(Equal("fd80:24e2:f998:72d6::ff"))
+	})
+})
+
+// ipsToStrings returns the string form of each of the given IPs.
+func ipsToStrings(ips []cnet.IP) []string {
+	s := []string{}
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	return s
+}
+
+var _ = Describe("Allocation block contiguous assignment", func() {
+	var b allocationBlock
+
+	BeforeEach(func() {
+		b = newBlock(cnet.MustParseNetwork("10.0.0.0/26"))
+	})
+
+	It("should assign an aligned run that covers a CIDR", func() {
+		Expect(b.assign(cnet.MustParseIP("10.0.0.1"), nil, nil, "host-A")).NotTo(HaveOccurred())
+
+		ips, err := b.autoAssign(4, nil, "host-A", nil, false, true, nil, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsToStrings(ips)).To(Equal([]string{"10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.7"}))
+		Expect(b.numFreeAddresses()).To(Equal(59))
+	})
+
+	It("should return the base IP and length of the run", func() {
+		handle := "handle-1"
+		base, length := b.assignContiguousOrdinals(8, &handle, nil)
+		Expect(base.String()).To(Equal("10.0.0.0"))
+		Expect(length).To(Equal(8))
+		Expect(b.ipsByHandle(handle)).To(HaveLen(8))
+	})
+
+	It("should assign nothing when free ordinals are not contiguous", func() {
+		// Assign every other address so that half the block is free, but
+		// no two free addresses are adjacent.
+		for o := 0; o < b.numAddresses(); o += 2 {
+			Expect(b.assign(ordinalToIP(b.CIDR, o), nil, nil, "host-A")).NotTo(HaveOccurred())
+		}
+		Expect(b.numFreeAddresses()).To(Equal(32))
+
+		ips, err := b.autoAssign(2, nil, "host-A", nil, false, true, nil, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(BeEmpty())
+		Expect(b.numFreeAddresses()).To(Equal(32))
+	})
+
+	It("should not use an unaligned run of free ordinals", func() {
+		// Free ordinals 2-5 form a run of four, but it straddles the
+		// aligned runs 0-3 and 4-7.
+		for o := 0; o < b.numAddresses(); o++ {
+			if o < 2 || o > 5 {
+				Expect(b.assign(ordinalToIP(b.CIDR, o), nil, nil, "host-A")).NotTo(HaveOccurred())
+			}
+		}
+
+		_, length := b.assignContiguousOrdinals(4, nil, nil)
+		Expect(length).To(Equal(0))
+
+		ips, err := b.autoAssign(2, nil, "host-A", nil, false, true, nil, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsToStrings(ips)).To(Equal([]string{"10.0.0.2", "10.0.0.3"}))
+	})
+
+	It("should assign nothing when the run is larger than the block", func() {
+		ips, err := b.autoAssign(65, nil, "host-A", nil, false, true, nil, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(BeEmpty())
+		Expect(b.numFreeAddresses()).To(Equal(64))
+	})
+})
+
+var _ = Describe("Allocation block assign order", func() {
+	var b allocationBlock
+
+	BeforeEach(func() {
+		// Assign the first eight addresses, and then release 10.0.0.5 so
+		// that it is at the end of the unallocated list.
+		b = newBlock(cnet.MustParseNetwork("10.0.0.0/26"))
+		_, err := b.autoAssign(8, nil, "host-A", nil, false, false, nil, "")
+		Expect(err).NotTo(HaveOccurred())
+		_, _, err = b.release([]cnet.IP{cnet.MustParseIP("10.0.0.5")})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should assign in the order addresses became free by default", func() {
+		ips, err := b.autoAssign(1, nil, "host-A", nil, false, false, nil, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsToStrings(ips)).To(Equal([]string{"10.0.0.8"}))
+	})
+
+	It("should assign the lowest free address", func() {
+		ips, err := b.autoAssign(2, nil, "host-A", nil, false, false, nil, AssignOrderLowest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsToStrings(ips)).To(Equal([]string{"10.0.0.5", "10.0.0.8"}))
+	})
+
+	It("should assign the highest free address", func() {
+		ips, err := b.autoAssign(2, nil, "host-A", nil, false, false, nil, AssignOrderHighest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsToStrings(ips)).To(Equal([]string{"10.0.0.63", "10.0.0.62"}))
+	})
+
+	It("should assign a random free address", func() {
+		ips, err := b.autoAssign(57, nil, "host-A", nil, false, false, nil, AssignOrderRandom)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(57))
+		for _, ip := range ips {
+			ordinal, err := ipToOrdinal(b.CIDR, ip)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ordinal == 5 || ordinal >= 8).To(BeTrue())
+		}
+		Expect(b.numFreeAddresses()).To(Equal(0))
+	})
+})
+
+var _ = DescribeTable("incrementIP",
+	func(ip string, increment int, expected string) {
+		result := incrementIP(cnet.MustParseIP(ip), big.NewInt(int64(increment)))
+		if expected == "" {
+			Expect(result.IP).To(BeNil())
+			return
+		}
+		Expect(result.String()).To(Equal(expected))
+		Expect(result.IP).To(HaveLen(len(cnet.MustParseIP(ip).Normalize().IP)))
+	},
+	Entry("IPv4", "10.0.0.1", 1, "10.0.0.2"),
+	Entry("IPv4 across a byte boundary", "10.0.0.255", 1, "10.0.1.0"),
+	Entry("IPv4 with leading zero bytes", "0.0.0.1", 4, "0.0.0.5"),
+	Entry("IPv4 at the top of the range", "255.255.255.254", 1, "255.255.255.255"),
+	Entry("IPv4 past the top of the range", "255.255.255.255", 1, ""),
+	Entry("IPv6", "2001:db8::1", 1, "2001:db8::2"),
+	Entry("IPv6 across a byte boundary", "2001:db8::ff", 1, "2001:db8::100"),
+	Entry("IPv6 across several bytes", "2001:db8::ffff:ffff:ffff:ffff", 1, "2001:db8:0:1::"),
+	Entry("IPv6 by a block", "2001:db8::ffc0", 64, "2001:db8::1:0"),
+	Entry("IPv6 with leading zero bytes", "::ff", 1, "::100"),
+	Entry("IPv6 at the top of the range", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffe", 1, "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"),
+	Entry("IPv6 past the top of the range", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", 1, ""),
+)
+
+var _ = DescribeTable("ipVersionOf",
+	func(ip cnet.IP, expected ipVersion, expectErr bool) {
+		version, err := ipVersionOf(ip)
+		if expectErr {
+			Expect(err).To(HaveOccurred())
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(version).To(Equal(expected))
+	},
+	Entry("IPv4", cnet.MustParseIP("192.0.2.0"), ipv4, false),
+	Entry("IPv4-mapped IPv6", cnet.IP{net.ParseIP("::ffff:192.0.2.0")}, ipv4, false),
+	Entry("IPv6", cnet.MustParseIP("2001:db8::1"), ipv6, false),
+	Entry("nil IP", cnet.IP{}, ipVersion{}, true),
+	Entry("invalid IP", cnet.IP{net.IP{1, 2, 3}}, ipVersion{}, true),
+)
+
+var _ = DescribeTable("newIPVersion",
+	func(number int, expected ipVersion, expectErr bool) {
+		version, err := newIPVersion(number)
+		if expectErr {
+			Expect(err).To(Equal(invalidIPVersionError{Number: number}))
+			Expect(err.Error()).To(ContainSubstring("must be 4 or 6"))
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(version).To(Equal(expected))
+	},
+	Entry("IPv4", 4, IPVersion4, false),
+	Entry("IPv6", 6, IPVersion6, false),
+	Entry("zero", 0, ipVersion{}, true),
+	Entry("bogus", 5, ipVersion{}, true),
+	Entry("negative", -4, ipVersion{}, true),
+)
+
+var _ = Describe("Block generators for an IPv4-mapped pool", func() {
+	// An IPv4 pool held with a 16-byte IP and mask.
+	_, mapped, _ := net.ParseCIDR("::ffff:192.0.2.0/120")
+	pool := cnet.IPNet{*mapped}
+
+	It("should use the IPv4 block size", func() {
+		prefix := ipv4.BlockPrefixLength
+		for _, blocks := range []func() *cnet.IPNet{blockGenerator(pool, prefix), randomBlockGenerator(pool, prefix, "host-a")} {
+			cidrs := []string{}
+			for b := blocks(); b != nil; b = blocks() {
+				cidrs = append(cidrs, b.String())
+			}
+			Expect(cidrs).To(ConsistOf("192.0.2.0/26", "192.0.2.64/26", "192.0.2.128/26", "192.0.2.192/26"))
+		}
+	})
+})
+
+var _ = Describe("Allocation block free IPs", func() {
+	It("should return unallocated IPs in ascending order up to the limit", func() {
+		b := newBlock(cnet.MustParseNetwork("10.0.0.0/26"))
+		Expect(b.assign(cnet.MustParseIP("10.0.0.1"), nil, nil, "host-A")).NotTo(HaveOccurred())
+		Expect(ipsToStrings(b.freeIPs(3, nil))).To(Equal([]string{"10.0.0.0", "10.0.0.2", "10.0.0.3"}))
+		Expect(b.freeIPs(100, nil)).To(HaveLen(63))
+	})
+
+	It("should not return ordinals missing from the unallocated list", func() {
+		b := newBlock(cnet.MustParseNetwork("10.0.0.0/26"))
+		b.Unallocated = b.Unallocated[1:]
+		Expect(ipsToStrings(b.freeIPs(1, nil))).To(Equal([]string{"10.0.0.1"}))
+	})
+
+	It("should not return excluded IPs", func() {
+		b := newBlock(cnet.MustParseNetwork("10.0.0.0/26"))
+		excluded := []cnet.IPNet{cnet.MustParseNetwork("10.0.0.0/30")}
+		Expect(ipsToStrings(b.freeIPs(1, excluded))).To(Equal([]string{"10.0.0.4"}))
+		Expect(b.freeIPs(100, excluded)).To(HaveLen(60))
+	})
+})
+
+var _ = Describe("Allocation block with excluded CIDRs", func() {
+	excluded := []cnet.IPNet{
+		cnet.MustParseNetwork("10.0.0.0/30"),
+		cnet.MustParseNetwork("10.0.1.0/24"),
+	}
+
+	var b allocationBlock
+
+	BeforeEach(func() {
+		b = newBlock(cnet.MustParseNetwork("10.0.0.0/26"))
+	})
+
+	It("should only exclude ordinals within the excluded CIDRs", func() {
+		Expect(b.excludedOrdinals(excluded)).To(Equal(map[int]bool{0: true, 1: true, 2: true, 3: true}))
+	})
+
+	It("should not assign excluded addresses", func() {
+		ips, err := b.autoAssign(64, nil, "host-A", nil, false, false, excluded, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(60))
+		Expect(ips[0].String()).To(Equal("10.0.0.4"))
+
+		// The excluded addresses remain unallocated.
+		Expect(b.numFreeAddresses()).To(Equal(4))
+		Expect(b.Unallocated).To(ConsistOf(0, 1, 2, 3))
+	})
+
+	It("should not assign a contiguous run containing excluded addresses", func() {
+		ips, err := b.autoAssign(4, nil, "host-A", nil, false, true, excluded, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipsToStrings(ips)).To(Equal([]string{"10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.7"}))
+	})
+})
+
+var _ = Describe("Allocation block assigned IPs", func() {
+	It("should return the assigned IPs in ordinal order", func() {
+		b := newBlock(cnet.MustParseNetwork("10.0.0.0/26"))
+		handle := "handle-1"
+		Expect(b.assign(cnet.MustParseIP("10.0.0.9"), &handle, nil, "host-A")).NotTo(HaveOccurred())
+		Expect(b.assign(cnet.MustParseIP("10.0.0.2"), nil, nil, "host-A")).NotTo(HaveOccurred())
+		Expect(b.assignedIPs()).To(Equal([]cnet.IP{
+			cnet.IP{cnet.MustParseIP("10.0.0.2").To4()},
+			cnet.IP{cnet.MustParseIP("10.0.0.9").To4()},
+		}))
+	})
+
+	It("should return no IPs for an empty block", func() {
+		b := newBlock(cnet.MustParseNetwork("10.0.0.0/26"))
+		Expect(b.assignedIPs()).To(BeEmpty())
+	})
+})
+
+var _ = Describe("ipsByValue", func() {
+	It("should sort IPs numerically", func() {
+		ips := []cnet.IP{
+			cnet.MustParseIP("10.0.0.10"),
+			cnet.MustParseIP("10.0.0.9"),
+			cnet.MustParseIP("10.0.1.0"),
+			cnet.MustParseIP("9.255.255.255"),
+		}
+		sort.Sort(ipsByValue(ips))
+		Expect(ips).To(Equal([]cnet.IP{
+			cnet.MustParseIP("9.255.255.255"),
+			cnet.MustParseIP("10.0.0.9"),
+			cnet.MustParseIP("10.0.0.10"),
+			cnet.MustParseIP("10.0.1.0"),
+		}))
+	})
+})
+
+var _ = Describe("Allocation block assignFreeOrdinals", func() {
+	var b allocationBlock
+	handle := "handle-1"
+	attrs := map[string]string{"pod": "pod-1"}
+
+	BeforeEach(func() {
+		b = newBlock(cnet.MustParseNetwork("10.0.0.0/26"))
+	})
+
+	It("should assign addresses from an empty block in ordinal order", func() {
+		ips, unsatisfied := b.assignFreeOrdinals(3, &handle, attrs)
+		Expect(unsatisfied).To(Equal(0))
+		Expect(ips).To(Equal([]cnet.IP{
+			cnet.IP{cnet.MustParseIP("10.0.0.0").To4()},
+			cnet.IP{cnet.MustParseIP("10.0.0.1").To4()},
+			cnet.IP{cnet.MustParseIP("10.0.0.2").To4()},
+		}))
+		Expect(b.numFreeAddresses()).To(Equal(61))
+		Expect(b.ipsByHandle(handle)).To(Equal(ips))
+
+		attr, err := b.attributeForIP(ips[2])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(attr.AttrSecondary).To(Equal(attrs))
+	})
+
+	It("should skip addresses that are already assigned", func() {
+		Expect(b.assign(cnet.MustParseIP("10.0.0.0"), nil, nil, "host-A")).NotTo(HaveOccurred())
+		Expect(b.assign(cnet.MustParseIP("10.0.0.2"), nil, nil, "host-A")).NotTo(HaveOccurred())
+
+		ips, unsatisfied := b.assignFreeOrdinals(2, &handle, nil)
+		Expect(unsatisfied).To(Equal(0))
+		Expect(ips).To(Equal([]cnet.IP{
+			cnet.IP{cnet.MustParseIP("10.0.0.1").To4()},
+			cnet.IP{cnet.MustParseIP("10.0.0.3").To4()},
+		}))
+	})
+
+	It("should assign what it can from a partially full block", func() {
+		_, unsatisfied := b.assignFreeOrdinals(60, nil, nil)
+		Expect(unsatisfied).To(Equal(0))
+
+		ips, unsatisfied := b.assignFreeOrdinals(10, &handle, nil)
+		Expect(ips).To(HaveLen(4))
+		Expect(unsatisfied).To(Equal(6))
+		Expect(ips[3].String()).To(Equal("10.0.0.63"))
+		Expect(b.numFreeAddresses()).To(Equal(0))
+	})
+
+	It("should assign nothing from a full block", func() {
+		_, unsatisfied := b.assignFreeOrdinals(64, nil, nil)
+		Expect(unsatisfied).To(Equal(0))
+		attributes := len(b.Attributes)
+
+		ips, unsatisfied := b.assignFreeOrdinals(1, &handle, attrs)
+		Expect(ips).To(BeEmpty())
+		Expect(unsatisfied).To(Equal(1))
+		Expect(b.Attributes).To(HaveLen(attributes))
+	})
+
+	It("should never assign more addresses than the block holds", func() {
+		ips, unsatisfied := b.assignFreeOrdinals(100, nil, nil)
+		Expect(ips).To(HaveLen(64))
+		Expect(unsatisfied).To(Equal(36))
+		for _, ip := range ips {
+			Expect(b.CIDR.Contains(ip.IP)).To(BeTrue())
+		}
+	})
+})
+
+var _ = Describe("Allocation block assignedIPsMatching", func() {
+	var b allocationBlock
+	handleA := "handle-a"
+	handleB := "handle-b"
+
+	BeforeEach(func() {
+		b = newBlock(cnet.MustParseNetwork("10.0.0.0/26"))
+		Expect(b.assign(cnet.MustParseIP("10.0.0.1"), &handleA, map[string]string{"namespace": "ns-a", "pod": "pod-1"}, "host-A")).To(Succeed())
+		Expect(b.assign(cnet.MustParseIP("10.0.0.2"), &handleB, map[string]string{"namespace": "ns-b", "pod": "pod-2"}, "host-A")).To(Succeed())
+		Expect(b.assign(cnet.MustParseIP("10.0.0.3"), nil, nil, "host-A")).To(Succeed())
+	})
+
+	It("should return every assigned IP for an empty filter", func() {
+		ips := b.assignedIPsMatching(nil)
+		Expect(ips).To(HaveLen(3))
+		Expect(ips[0].HandleID).To(Equal(&handleA))
+		Expect(ips[2].HandleID).To(BeNil())
+	})
+
+	It("should return only the IPs with matching attributes", func() {
+		Expect(b.assignedIPsMatching(map[string]string{"namespace": "ns-b"})).To(Equal([]AssignedIP{
+			{IP: cnet.IP{cnet.MustParseIP("10.0.0.2").To4()}, Block: b.CIDR, HandleID: &handleB},
+		}))
+	})
+
+	It("should require every attribute in the filter to match", func() {
+		Expect(b.assignedIPsMatching(map[string]string{"namespace": "ns-a", "pod": "pod-2"})).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Block ordinal conversion", func() {
+	v4Block := cnet.MustParseNetwork("10.0.0.64/26")
+	v6Block := cnet.MustParseNetwork("fd80:24e2:f998:72d6::40/122")
+
+	It("should convert the boundary ordinals of an IPv4 block", func() {
+		Expect(ordinalToIP(v4Block, 0).String()).To(Equal("10.0.0.64"))
+		Expect(ordinalToIP(v4Block, blockSize-1).String()).To(Equal("10.0.0.127"))
+	})
+
+	It("should convert the boundary ordinals of an IPv6 block", func() {
+		Expect(ordinalToIP(v6Block, 0).String()).To(Equal("fd80:24e2:f998:72d6::40"))
+		Expect(ordinalToIP(v6Block, blockSize-1).String()).To(Equal("fd80:24e2:f998:72d6::7f"))
+	})
+
+	It("should round trip every ordinal in the block", func() {
+		for _, block := range []cnet.IPNet{v4Block, v6Block} {
+			for o := 0; o < blockSize; o++ {
+				ordinal, err := ipToOrdinal(block, ordinalToIP(block, o))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ordinal).To(Equal(o))
+			}
+		}
+	})
+
+	It("should convert an IPv4 address held in 16-byte form", func() {
+		ip := cnet.MustParseIP("10.0.0.127")
+		ip.IP = ip.To16()
+		Expect(ipToOrdinal(v4Block, ip)).To(Equal(blockSize - 1))
+	})
+
+	It("should return an error for IPs outside the block", func() {
+		for _, ip := range []string{"10.0.0.63", "10.0.0.128", "fd80:24e2:f998:72d6::40"} {
+			_, err := ipToOrdinal(v4Block, cnet.MustParseIP(ip))
+			Expect(err).To(HaveOccurred())
+		}
+		_, err := ipToOrdinal(v6Block, cnet.MustParseIP("fd80:24e2:f998:72d6::80"))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,107 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	log "github.com/Sirupsen/logrus"
+	bapi "github.com/projectcalico/libcalico-go/lib/backend/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+// BlockClaimDecision is the outcome of resolving a block claim which
+// conflicts with the affinity of another host.
+type BlockClaimDecision int
+
+const (
+	// BlockClaimAbort leaves the block affine to its current host, and the
+	// claim fails.
+	BlockClaimAbort BlockClaimDecision = iota
+
+	// BlockClaimSteal moves the affinity of the block to the claiming host.
+	// Addresses already assigned from the block are left assigned.
+	BlockClaimSteal
+)
+
+// BlockClaimResolverFunc decides whether the host may steal the affinity of
+// the given block from its current owner, for example because the owner is
+// known to be dead or the block is empty.  The block is a copy, so it may
+// not be modified.  It is only called for blocks without strict affinity.
+type BlockClaimResolverFunc func(block *model.AllocationBlock, owner, host string) BlockClaimDecision
+
+// resolveBlockClaim returns the decision of the client's BlockClaimResolver
+// for the host's claim of the block affine to owner, or BlockClaimAbort if
+// no resolver is set.
+func (rw blockReaderWriter) resolveBlockClaim(b allocationBlock, owner, host string) BlockClaimDecision {
+	if rw.client.BlockClaimResolver == nil || b.StrictAffinity {
+		return BlockClaimAbort
+	}
+	return rw.client.BlockClaimResolver(b.Clone(), owner, host)
+}
+
+// stealBlockAffinity moves the affinity of the block in obj from owner to
+// host.  The block is updated conditionally on the revision in obj, and the
+// block affinities of both hosts are updated in the same transaction, so the
+// affinity moves atomically where the datastore supports transactions.
+// Returns an error satisfying errors.IsRetryable if the block has changed
+// since it was read.
+func (rw blockReaderWriter) stealBlockAffinity(obj *model.KVPair, owner, host string, config IPAMConfig) error {
+	b := obj.Value.(*model.AllocationBlock)
+	logContext := rw.requestLog().WithFields(log.Fields{
+		"host":      host,
+		"owner":     owner,
+		"blockCIDR": b.CIDR.String(),
+	})
+
+	stolen := b.Clone()
+	affinityKeyStr := "host:" + host
+	stolen.Affinity = &affinityKeyStr
+	stolen.HostAffinity = nil
+	stolen.StrictAffinity = config.StrictAffinity
+	ops := []bapi.TxnOp{
+		{
+			Type:   bapi.TxnUpdate,
+			KVPair: &model.KVPair{Key: obj.Key, Value: stolen, Revision: obj.Revision},
+		},
+		{
+			Type: bapi.TxnApply,
+			KVPair: &model.KVPair{
+				Key:   model.BlockAffinityKey{Host: host, CIDR: b.CIDR},
+				Value: model.BlockAffinityValue,
+			},
+		},
+	}
+
+	// The owner's affinity may be missing if its claim was interrupted, in
+	// which case there is nothing to remove.
+	ownerKey := model.BlockAffinityKey{Host: owner, CIDR: b.CIDR}
+	if existing, err := rw.client.Backend.Get(ownerKey); err == nil {
+		ops = append(ops, bapi.TxnOp{
+			Type:   bapi.TxnDelete,
+			KVPair: &model.KVPair{Key: ownerKey, Revision: existing.Revision},
+		})
+	} else if !errors.IsNotExist(err) {
+		logContext.WithError(err).Error("Error reading block affinity of current owner")
+		return err
+	}
+
+	logContext.Warning("Stealing block affinity from another host")
+	if _, err := rw.client.Backend.Txn(ops, true); err != nil {
+		logContext.WithError(err).Info("Failed to steal block affinity")
+		return err
+	}
+	rw.observer().BlockReleased(owner, b.CIDR)
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+var _ = Describe("BlockClaimResolver", func() {
+	subnet := cnet.MustParseNetwork("10.0.0.0/26")
+	blockKey := model.BlockKey{CIDR: subnet}
+	ourKey := model.BlockAffinityKey{Host: "host-a", CIDR: subnet}
+	ownerKey := model.BlockAffinityKey{Host: "host-b", CIDR: subnet}
+
+	var backend *fakeBlockBackend
+	var rw blockReaderWriter
+	var consulted []string
+
+	// claimedBy stores a block claimed by the given host, with its block
+	// affinity.
+	claimedBy := func(host string, strict bool) {
+		b := newBlock(subnet)
+		affinity := "host:" + host
+		b.Affinity = &affinity
+		b.StrictAffinity = strict
+		backend.store(&model.KVPair{Key: blockKey, Value: b.AllocationBlock})
+		backend.store(&model.KVPair{Key: model.BlockAffinityKey{Host: host, CIDR: subnet}, Value: model.BlockAffinityValue})
+	}
+
+	resolveWith := func(decision BlockClaimDecision) {
+		rw.client.BlockClaimResolver = func(block *model.AllocationBlock, owner, host string) BlockClaimDecision {
+			consulted = append(consulted, owner+"->"+host)
+			return decision
+		}
+	}
+
+	blockAffinity := func() string {
+		obj, err := backend.Get(blockKey)
+		Expect(err).NotTo(HaveOccurred())
+		return *obj.Value.(*model.AllocationBlock).Affinity
+	}
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+		consulted = nil
+	})
+
+	It("should steal the affinity when the resolver decides to", func() {
+		claimedBy("host-b", false)
+		resolveWith(BlockClaimSteal)
+
+		Expect(rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+		Expect(consulted).To(Equal([]string{"host-b->host-a"}))
+		Expect(blockAffinity()).To(Equal("host:host-a"))
+		_, err := backend.Get(ourKey)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = backend.Get(ownerKey)
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should steal the affinity when the owner's affinity is missing", func() {
+		claimedBy("host-b", false)
+		Expect(backend.Delete(&model.KVPair{Key: ownerKey})).To(Succeed())
+		resolveWith(BlockClaimSteal)
+
+		Expect(rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+		Expect(blockAffinity()).To(Equal("host:host-a"))
+	})
+
+	It("should leave the block with its owner when the resolver aborts", func() {
+		claimedBy("host-b", false)
+		resolveWith(BlockClaimAbort)
+
+		err := rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{})
+		Expect(err).To(BeAssignableToTypeOf(affinityClaimedError{}))
+		Expect(consulted).To(Equal([]string{"host-b->host-a"}))
+		Expect(blockAffinity()).To(Equal("host:host-b"))
+		_, err = backend.Get(ownerKey)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = backend.Get(ourKey)
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should abort without a resolver", func() {
+		claimedBy("host-b", false)
+		err := rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{})
+		Expect(err).To(BeAssignableToTypeOf(affinityClaimedError{}))
+		Expect(blockAffinity()).To(Equal("host:host-b"))
+	})
+
+	It("should not consult the resolver for a block with strict affinity", func() {
+		claimedBy("host-b", true)
+		resolveWith(BlockClaimSteal)
+
+		err := rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{})
+		Expect(err).To(BeAssignableToTypeOf(affinityClaimedError{}))
+		Expect(consulted).To(BeEmpty())
+		Expect(blockAffinity()).To(Equal("host:host-b"))
+	})
+})
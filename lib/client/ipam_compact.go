@@ -0,0 +1,334 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	goerrors "errors"
+	"fmt"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// CompactOptions controls how Compact moves addresses.
+type CompactOptions struct {
+	// DryRun reports the addresses that would be moved and the blocks that
+	// would be freed, without changing anything.
+	DryRun bool
+
+	// Confirm must be set unless DryRun is set, since compacting changes
+	// the addresses assigned to workloads.
+	Confirm bool
+}
+
+// CompactMove records an address moved by Compact.
+type CompactMove struct {
+	Handle string
+	From   cnet.IP
+
+	// To is the address that replaced From.  It is not set for a dry run.
+	To cnet.IP
+}
+
+// CompactReport describes the outcome of Compact.
+type CompactReport struct {
+	// Moved lists the addresses that were moved, or for a dry run, would
+	// be moved.
+	Moved []CompactMove
+
+	// FreedBlocks lists the blocks that were released, or for a dry run,
+	// would be released.
+	FreedBlocks []cnet.IPNet
+}
+
+// compactBlock is a block being considered for compaction, along with the
+// number of addresses assigned from it and the number that may still be
+// assigned from it.
+type compactBlock struct {
+	block allocationBlock
+	used  int
+	free  int
+}
+
+// movable returns whether every address assigned from the block has a
+// handle, so that its owner can find the address it is moved to.
+func (b compactBlock) movable() bool {
+	for _, a := range b.block.assignedIPsMatching(nil) {
+		if a.HandleID == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Compact moves the addresses assigned from the host's sparsely used affine
+// blocks in the pool into its fuller affine blocks, and releases the blocks
+// that are emptied.  The sparsest blocks are emptied first, for as long as
+// the remaining blocks have room for their addresses.  Reserved blocks, and
+// blocks with addresses assigned without a handle, are never emptied.
+//
+// Each address is moved by first assigning a new address with the same
+// handle and attributes, and only then releasing the old one, so an address
+// is never assigned twice.  The blocks being emptied are reserved while their
+// addresses are moved so that nothing new is assigned from them.  If Compact
+// fails part way through, the report describes the moves made so far, and
+// the blocks that were not emptied are unreserved.  Unless it is a dry run,
+// Compact fails unless the IPAM configuration allows destructive operations.
+func (c ipams) Compact(host string, pool cnet.IPNet, opts CompactOptions) (*CompactReport, error) {
+	if !opts.DryRun {
+		if !opts.Confirm {
+			return nil, goerrors.New("Compacting changes assigned addresses, it must be confirmed")
+		}
+		if err := c.blockReaderWriter.checkDestructiveOpsAllowed("Compact"); err != nil {
+			return nil, err
+		}
+	}
+	logContext := c.requestLog().WithFields(log.Fields{
+		"host": host,
+		"cidr": pool.String(),
+	})
+
+	sources, dests, err := c.planCompaction(host, pool)
+	if err != nil {
+		return nil, err
+	}
+	report := &CompactReport{Moved: []CompactMove{}, FreedBlocks: []cnet.IPNet{}}
+	if opts.DryRun {
+		for _, s := range sources {
+			for _, a := range s.block.assignedIPsMatching(nil) {
+				report.Moved = append(report.Moved, CompactMove{Handle: *a.HandleID, From: a.IP})
+			}
+			report.FreedBlocks = append(report.FreedBlocks, s.block.CIDR)
+		}
+		return report, nil
+	}
+
+	// Stop new addresses being assigned from the blocks we are emptying.
+	// Any that we don't free are unreserved again before we return.
+	reserved := map[string]cnet.IPNet{}
+	defer func() {
+		for _, cidr := range reserved {
+			if err := c.blockReaderWriter.setBlockReserved(cidr, false); err != nil {
+				logContext.WithField("blockCIDR", cidr.String()).WithError(err).Warning("Failed to unreserve block")
+			}
+		}
+	}()
+	for _, s := range sources {
+		if err := c.blockReaderWriter.setBlockReserved(s.block.CIDR, true); err != nil {
+			return report, err
+		}
+		reserved[s.block.CIDR.String()] = s.block.CIDR
+	}
+
+	for _, s := range sources {
+		blockContext := logContext.WithField("blockCIDR", s.block.CIDR.String())
+		moved, err := c.moveBlockAddresses(s.block.CIDR, dests, host)
+		report.Moved = append(report.Moved, moved...)
+		if err != nil {
+			blockContext.WithError(err).Error("Failed to move addresses out of block")
+			return report, err
+		}
+		freed, err := c.blockReaderWriter.releaseCompactedBlock(host, s.block.CIDR)
+		if err != nil {
+			return report, err
+		}
+		if freed {
+			delete(reserved, s.block.CIDR.String())
+			report.FreedBlocks = append(report.FreedBlocks, s.block.CIDR)
+		} else {
+			blockContext.Warning("Block still has addresses assigned, not releasing it")
+		}
+	}
+	logContext.WithFields(log.Fields{
+		"moved": len(report.Moved),
+		"freed": len(report.FreedBlocks),
+	}).Info("Compacted blocks")
+	return report, nil
+}
+
+// planCompaction returns the host's affine blocks in the pool which Compact
+// should empty, sparsest first, and the blocks it should move their
+// addresses into, fullest first.
+func (c ipams) planCompaction(host string, pool cnet.IPNet) ([]compactBlock, []compactBlock, error) {
+	version := getIPVersion(cnet.IP{pool.IP})
+	cidrs, err := c.blockReaderWriter.getAffineBlocks(host, version, []cnet.IPNet{pool})
+	if err != nil {
+		return nil, nil, err
+	}
+	excluded, err := c.blockReaderWriter.unassignableCIDRs(pool)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blocks := []compactBlock{}
+	for _, cidr := range cidrs {
+		obj, err := c.blockReaderWriter.getBlock(cidr)
+		if err != nil {
+			if errors.IsNotExist(err) {
+				continue
+			}
+			return nil, nil, err
+		}
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		if b.Reserved {
+			continue
+		}
+		skip := b.excludedOrdinals(excluded)
+		free := 0
+		for _, o := range b.Unallocated {
+			if !skip[o] {
+				free++
+			}
+		}
+		blocks = append(blocks, compactBlock{block: b, used: b.numAddresses() - b.numFreeAddresses(), free: free})
+	}
+	sort.Stable(compactBlocksByUse(blocks))
+
+	// Empty the sparsest blocks for as long as the fuller blocks have room
+	// for their addresses, always keeping at least one block.
+	fuller := make([]int, len(blocks))
+	for i := len(blocks) - 2; i >= 0; i-- {
+		fuller[i] = fuller[i+1] + blocks[i+1].free
+	}
+	isSource := map[int]bool{}
+	used := 0
+	for i, b := range blocks {
+		if !b.movable() {
+			continue
+		}
+		if len(isSource) == len(blocks)-1 || used+b.used > fuller[i] {
+			break
+		}
+		used += b.used
+		isSource[i] = true
+	}
+
+	sources := []compactBlock{}
+	dests := []compactBlock{}
+	for i, b := range blocks {
+		if isSource[i] {
+			sources = append(sources, b)
+		} else {
+			dests = append([]compactBlock{b}, dests...)
+		}
+	}
+	return sources, dests, nil
+}
+
+// compactBlocksByUse sorts blocks by the number of addresses assigned from
+// them, fewest first, and then by CIDR.
+type compactBlocksByUse []compactBlock
+
+func (s compactBlocksByUse) Len() int      { return len(s) }
+func (s compactBlocksByUse) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s compactBlocksByUse) Less(i, j int) bool {
+	if s[i].used != s[j].used {
+		return s[i].used < s[j].used
+	}
+	return compareCIDRs(s[i].block.CIDR, s[j].block.CIDR) < 0
+}
+
+// moveBlockAddresses moves every address assigned with a handle from the
+// block into the first of the destination blocks with room for it, assigning
+// the new address before releasing the old one.  Returns the moves made, along with
+// an error if an address could not be moved.
+func (c ipams) moveBlockAddresses(blockCIDR cnet.IPNet, dests []compactBlock, host string) ([]CompactMove, error) {
+	moved := []CompactMove{}
+	obj, err := c.blockReaderWriter.getBlock(blockCIDR)
+	if err != nil {
+		if errors.IsNotExist(err) {
+			return moved, nil
+		}
+		return moved, err
+	}
+	b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+	for _, a := range b.assignedIPsMatching(nil) {
+		if a.HandleID == nil {
+			// The address was assigned since the block was reserved,
+			// and without a handle its owner could not find the new
+			// address, so leave it where it is.
+			c.requestLog().WithField("ip", a.IP.String()).Warning("Not moving address assigned without a handle")
+			continue
+		}
+		attrs, err := b.attributesForIP(a.IP)
+		if err != nil {
+			return moved, err
+		}
+
+		var to []AssignedIP
+		for _, d := range dests {
+			to, err = c.assignFromExistingBlock(d.block.CIDR, 1, a.HandleID, attrs, host, true, false, false)
+			if err != nil {
+				return moved, err
+			}
+			if len(to) > 0 {
+				break
+			}
+		}
+		if len(to) == 0 {
+			return moved, noFreeBlocksError(fmt.Sprintf("No room in the host's blocks to move %s", a.IP))
+		}
+
+		// The new address is assigned, so it is now safe to release the
+		// old one.
+		if _, err := c.ReleaseIPs([]cnet.IP{a.IP}); err != nil {
+			return moved, err
+		}
+		c.requestLog().WithFields(log.Fields{
+			"handle": *a.HandleID,
+			"from":   a.IP.String(),
+			"to":     to[0].IP.String(),
+		}).Info("Moved address")
+		moved = append(moved, CompactMove{Handle: *a.HandleID, From: a.IP, To: to[0].IP})
+	}
+	return moved, nil
+}
+
+// releaseCompactedBlock clears the reservation and affinity of a block that
+// Compact has emptied, deleting the block if empty blocks are not retained,
+// and removes the host's affinity for it.  The block is only released if it
+// is still empty.  Returns whether the block was released.
+func (rw blockReaderWriter) releaseCompactedBlock(host string, blockCIDR cnet.IPNet) (bool, error) {
+	cfg, err := rw.ipamConfig()
+	if err != nil {
+		return false, err
+	}
+	deleteEmpty := !cfg.RetainEmptyBlocks
+	released := false
+	err = rw.writeWithRetry(model.BlockKey{CIDR: blockCIDR}, func(obj *model.KVPair) error {
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		if !b.empty() {
+			released = false
+			return errSkipUpdate
+		}
+		b.Reserved = false
+		b.Affinity = nil
+		released = true
+		return nil
+	}, func(obj *model.KVPair) error {
+		return rw.writeReleasedBlock(obj, deleteEmpty)
+	})
+	if err != nil || !released {
+		return false, err
+	}
+	if err := rw.deleteBlockAffinity(host, blockCIDR); err != nil {
+		return false, err
+	}
+	rw.observer().BlockReleased(host, blockCIDR)
+	return true, nil
+}
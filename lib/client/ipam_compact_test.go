@@ -0,0 +1,143 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+var _ = Describe("Compact", func() {
+	pool := cnet.MustParseNetwork("10.0.0.0/24")
+	full := cnet.MustParseNetwork("10.0.0.0/26")
+	sparseA := cnet.MustParseNetwork("10.0.0.64/26")
+	sparseB := cnet.MustParseNetwork("10.0.0.128/26")
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	// assign assigns num addresses from the block, each with its own
+	// handle, and returns the handles.
+	assign := func(blockCIDR cnet.IPNet, num int) []string {
+		handles := []string{}
+		for i := 0; i < num; i++ {
+			handle := fmt.Sprintf("%s-%d", blockCIDR.IP, i)
+			ips, err := ic.assignFromExistingBlock(blockCIDR, 1, &handle, map[string]string{"pod": handle}, "host-a", true, false, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ips).To(HaveLen(1))
+			handles = append(handles, handle)
+		}
+		return handles
+	}
+
+	blockExists := func(blockCIDR cnet.IPNet) bool {
+		_, err := backend.Get(model.BlockKey{CIDR: blockCIDR})
+		if errors.IsNotExist(err) {
+			return false
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return true
+	}
+
+	var handles []string
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		backend.allowDestructiveOps()
+		ic = newIPAM(&Client{Backend: backend})
+		for _, b := range []cnet.IPNet{full, sparseA, sparseB} {
+			Expect(ic.blockReaderWriter.claimBlockAffinity(b, "host-a", IPAMConfig{})).To(Succeed())
+		}
+		handles = assign(full, 60)
+		handles = append(handles, assign(sparseA, 2)...)
+		handles = append(handles, assign(sparseB, 1)...)
+	})
+
+	It("should require confirmation", func() {
+		_, err := ic.Compact("host-a", pool, CompactOptions{})
+		Expect(err).To(HaveOccurred())
+		Expect(blockExists(sparseA)).To(BeTrue())
+	})
+
+	It("should report the moves without making them in a dry run", func() {
+		report, err := ic.Compact("host-a", pool, CompactOptions{DryRun: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Moved).To(HaveLen(3))
+		for _, m := range report.Moved {
+			Expect(m.To.IP).To(BeNil())
+		}
+		Expect(report.FreedBlocks).To(Equal([]cnet.IPNet{sparseB, sparseA}))
+		Expect(blockExists(sparseA)).To(BeTrue())
+		Expect(blockExists(sparseB)).To(BeTrue())
+	})
+
+	It("should move addresses into the fullest block and free the emptied blocks", func() {
+		report, err := ic.Compact("host-a", pool, CompactOptions{Confirm: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Moved).To(HaveLen(3))
+		Expect(report.FreedBlocks).To(Equal([]cnet.IPNet{sparseB, sparseA}))
+
+		for _, m := range report.Moved {
+			Expect(full.Contains(m.To.IP)).To(BeTrue())
+			attrs, err := ic.GetAssignmentAttributes(m.To)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(attrs).To(Equal(map[string]string{"pod": m.Handle}))
+		}
+
+		// Every handle still has exactly one address.
+		for _, h := range handles {
+			ips, err := ic.IPsByHandle(h)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ips).To(HaveLen(1), h)
+		}
+
+		Expect(blockExists(sparseA)).To(BeFalse())
+		Expect(blockExists(sparseB)).To(BeFalse())
+		_, err = backend.Get(model.BlockAffinityKey{Host: "host-a", CIDR: sparseA})
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+		obj, err := backend.Get(model.BlockKey{CIDR: full})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.Value.(*model.AllocationBlock).Reserved).To(BeFalse())
+	})
+
+	It("should only empty blocks that fit into the other blocks", func() {
+		// The fullest block only has room for one more address.
+		assign(full, 3)
+		report, err := ic.Compact("host-a", pool, CompactOptions{Confirm: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.FreedBlocks).To(Equal([]cnet.IPNet{sparseB}))
+		Expect(blockExists(sparseA)).To(BeTrue())
+		obj, err := backend.Get(model.BlockKey{CIDR: sparseA})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.Value.(*model.AllocationBlock).Reserved).To(BeFalse())
+	})
+
+	It("should not empty blocks with addresses assigned without a handle", func() {
+		ips, err := ic.assignFromExistingBlock(sparseB, 1, nil, nil, "host-a", true, false, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+		report, err := ic.Compact("host-a", pool, CompactOptions{Confirm: true})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.FreedBlocks).To(Equal([]cnet.IPNet{sparseA}))
+		Expect(blockExists(sparseB)).To(BeTrue())
+	})
+})
@@ -0,0 +1,400 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// BlockConsistencyReport describes the inconsistencies found between the
+// block affinity keys and the allocation blocks in the datastore.
+type BlockConsistencyReport struct {
+	// OrphanedAffinities are affinity keys for blocks that do not exist.
+	// These include affinities reserved by reserveBlockAffinity whose
+	// block has not yet been created, which a repair releases.
+	OrphanedAffinities []model.BlockAffinityKey
+
+	// OrphanedBlocks are blocks with a host affinity for which there
+	// is no corresponding affinity key.
+	OrphanedBlocks []model.BlockAffinityKey
+
+	// MismatchedAffinities are affinity keys for blocks that exist, but
+	// whose affinity is for a different host, or for no host at all.
+	MismatchedAffinities []model.BlockAffinityKey
+
+	// MismatchedBlocks are the keys of blocks whose stored CIDR differs
+	// from the CIDR in the key.  Such blocks are excluded from the other
+	// checks, and are never repaired since neither CIDR can be trusted.
+	MismatchedBlocks []model.BlockKey
+}
+
+// Consistent returns true if the report contains no inconsistencies.
+func (r BlockConsistencyReport) Consistent() bool {
+	return len(r.OrphanedAffinities) == 0 && len(r.OrphanedBlocks) == 0 && len(r.MismatchedAffinities) == 0 &&
+		len(r.MismatchedBlocks) == 0
+}
+
+// CheckBlockConsistency cross-references the block affinity keys against
+// the allocation blocks, repairing the affinity keys if repair is true.
+func (c ipams) CheckBlockConsistency(repair bool) (*BlockConsistencyReport, error) {
+	return c.blockReaderWriter.checkBlockConsistency(repair)
+}
+
+// checkBlockConsistency cross-references all block affinity keys against
+// all allocation blocks and returns a report of any inconsistencies.  If
+// repair is true, the block is treated as the source of truth: orphaned and
+// mismatched affinity keys are deleted, and missing affinity keys are
+// created for blocks with a host affinity.  Deleting an orphaned affinity
+// also releases a reservation whose block has not been created, so a repair
+// should not run while hosts are reserving blocks.  The missing affinity keys
+// are created concurrently, up to the configured BulkConcurrency.
+func (rw blockReaderWriter) checkBlockConsistency(repair bool) (*BlockConsistencyReport, error) {
+	affinityKVPs, err := rw.listAll(model.BlockAffinityListOptions{}, ipamListPageSize)
+	if err != nil {
+		if !errors.IsNotExist(err) {
+			rw.requestLog().WithError(err).Error("Error listing block affinities")
+			return nil, err
+		}
+	}
+	blockKVPs, err := rw.listAll(model.BlockListOptions{}, ipamListPageSize)
+	if err != nil {
+		if !errors.IsNotExist(err) {
+			rw.requestLog().WithError(err).Error("Error listing blocks")
+			return nil, err
+		}
+	}
+
+	affinities := []model.BlockAffinityKey{}
+	for _, kvp := range affinityKVPs {
+		affinities = append(affinities, kvp.Key.(model.BlockAffinityKey))
+	}
+	blocks := []*model.AllocationBlock{}
+	mismatched := []model.BlockKey{}
+	for _, kvp := range blockKVPs {
+		if err := checkBlockCIDR(kvp.Key, kvp); err != nil {
+			mismatched = append(mismatched, kvp.Key.(model.BlockKey))
+			continue
+		}
+		blocks = append(blocks, kvp.Value.(*model.AllocationBlock))
+	}
+
+	report := compareBlockAffinities(affinities, blocks)
+	report.MismatchedBlocks = mismatched
+	rw.requestLog().WithFields(log.Fields{
+		"orphanedAffinities":   len(report.OrphanedAffinities),
+		"orphanedBlocks":       len(report.OrphanedBlocks),
+		"mismatchedAffinities": len(report.MismatchedAffinities),
+		"mismatchedBlocks":     len(report.MismatchedBlocks),
+	}).Info("Checked block affinity consistency")
+	if !repair || report.Consistent() {
+		return &report, nil
+	}
+
+	// Delete the affinity keys that do not match a block.  An affinity for
+	// a block stored under a mismatched key only looks orphaned, since the
+	// block was excluded from the comparison, so it is left in place.
+	keys := []model.Key{}
+	for _, k := range report.OrphanedAffinities {
+		if !blockKeysContain(mismatched, k.CIDR) {
+			keys = append(keys, k)
+		}
+	}
+	for _, k := range report.MismatchedAffinities {
+		keys = append(keys, k)
+	}
+	for k, err := range rw.client.Backend.DeleteKeys(keys) {
+		if err != nil {
+			rw.requestLog().WithField("key", k).WithError(err).Error("Error deleting block affinity")
+			return &report, err
+		}
+	}
+
+	// Create the affinity keys that are missing for affine blocks.
+	cfg, err := rw.ipamConfig()
+	if err != nil {
+		return &report, err
+	}
+	errs := forEachConcurrently(len(report.OrphanedBlocks), cfg.bulkConcurrency(), func(i int) error {
+		k := report.OrphanedBlocks[i]
+		_, err := rw.client.Backend.Apply(&model.KVPair{
+			Key:   k,
+			Value: model.BlockAffinityValue,
+		})
+		if err != nil {
+			rw.requestLog().WithFields(log.Fields{
+				"host":      k.Host,
+				"blockCIDR": k.CIDR.String(),
+			}).WithError(err).Error("Error writing block affinity")
+		}
+		return err
+	})
+	bulkErr := bulkError{Op: "checkBlockConsistency", Errs: map[string]error{}}
+	for i, err := range errs {
+		if err != nil {
+			bulkErr.Errs[report.OrphanedBlocks[i].String()] = err
+		}
+	}
+	if len(bulkErr.Errs) > 0 {
+		return &report, bulkErr
+	}
+	return &report, nil
+}
+
+// compareBlockAffinities cross-references the given block affinity keys
+// against the given blocks.
+func compareBlockAffinities(affinities []model.BlockAffinityKey, blocks []*model.AllocationBlock) BlockConsistencyReport {
+	report := BlockConsistencyReport{}
+
+	// Index the blocks by CIDR.
+	blocksByCIDR := map[string]*model.AllocationBlock{}
+	for _, b := range blocks {
+		blocksByCIDR[b.CIDR.String()] = b
+	}
+
+	// Check that each affinity key refers to a block affine to the same host.
+	affined := map[string]bool{}
+	for _, k := range affinities {
+		b, ok := blocksByCIDR[k.CIDR.String()]
+		if !ok {
+			report.OrphanedAffinities = append(report.OrphanedAffinities, k)
+		} else if b.Affinity == nil || !hostAffinityMatches(k.Host, b) {
+			report.MismatchedAffinities = append(report.MismatchedAffinities, k)
+		} else {
+			affined[k.CIDR.String()] = true
+		}
+	}
+
+	// Check that each affine block has an affinity key.
+	for _, b := range blocks {
+		host, ok := blockAffinityHost(b)
+		if ok && !affined[b.CIDR.String()] {
+			report.OrphanedBlocks = append(report.OrphanedBlocks, model.BlockAffinityKey{
+				Host: host,
+				CIDR: b.CIDR,
+			})
+		}
+	}
+	return report
+}
+
+// blockAffinityHost returns the host the given block is affine to, and
+// whether the block has a host affinity.
+func blockAffinityHost(b *model.AllocationBlock) (string, bool) {
+	if b.Affinity == nil || !strings.HasPrefix(*b.Affinity, "host:") {
+		return "", false
+	}
+	return strings.TrimPrefix(*b.Affinity, "host:"), true
+}
+
+// DoubleAllocation describes an address which is allocated in more than one
+// block.
+type DoubleAllocation struct {
+	IP cnet.IP
+
+	// Blocks are the CIDRs of the keys of the blocks the address is
+	// allocated in.
+	Blocks []cnet.IPNet
+}
+
+// allocatedBlock is a block with addresses allocated, identified by the CIDR
+// of its key, along with the network its addresses are allocated from.
+type allocatedBlock struct {
+	key     cnet.IPNet
+	network cnet.IPNet
+}
+
+// FindDoubleAllocations returns every address which is allocated in more than
+// one block, in ascending order.
+func (c ipams) FindDoubleAllocations() ([]DoubleAllocation, error) {
+	return c.blockReaderWriter.findDoubleAllocations()
+}
+
+// findDoubleAllocations returns every address which is allocated in more than
+// one block, which should never happen, but may if blocks overlap because of
+// overlapping pools or corrupted blocks.  The blocks are listed a page at a
+// time, and since an address can only be allocated twice by blocks whose
+// networks overlap, only the allocations of overlapping blocks are expanded
+// into addresses, so the addresses of the other blocks are never all held in
+// memory.  The addresses are returned in ascending order.
+func (rw blockReaderWriter) findDoubleAllocations() ([]DoubleAllocation, error) {
+	// Find the networks of the blocks with addresses allocated.
+	blocks := []allocatedBlock{}
+	token := ""
+	for {
+		page, next, err := rw.client.Backend.ListPage(model.BlockListOptions{}, ipamListPageSize, token)
+		if err != nil {
+			if errors.IsNotExist(err) {
+				break
+			}
+			rw.requestLog().WithError(err).Error("Error listing blocks")
+			return nil, err
+		}
+		for _, kvp := range page {
+			b := allocationBlock{kvp.Value.(*model.AllocationBlock)}
+			if b.empty() {
+				continue
+			}
+			network := cnet.IPNet{IPNet: net.IPNet{IP: b.CIDR.IP.Mask(b.CIDR.Mask), Mask: b.CIDR.Mask}}
+			blocks = append(blocks, allocatedBlock{key: kvp.Key.(model.BlockKey).CIDR, network: network})
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	// Check the groups concurrently, since each reads its own blocks.
+	cfg, err := rw.ipamConfig()
+	if err != nil {
+		return nil, err
+	}
+	groups := overlappingBlocks(blocks)
+	found := make([][]DoubleAllocation, len(groups))
+	errs := forEachConcurrently(len(groups), cfg.bulkConcurrency(), func(i int) error {
+		var err error
+		found[i], err = rw.findGroupDoubleAllocations(groups[i])
+		return err
+	})
+	bulkErr := bulkError{Op: "findDoubleAllocations", Errs: map[string]error{}}
+	doubles := []DoubleAllocation{}
+	for i, err := range errs {
+		if err != nil {
+			bulkErr.Errs[groups[i][0].network.String()] = err
+			continue
+		}
+		doubles = append(doubles, found[i]...)
+	}
+	if len(bulkErr.Errs) > 0 {
+		return nil, bulkErr
+	}
+	sort.Sort(doubleAllocationsByIP(doubles))
+	rw.requestLog().WithField("doubleAllocations", len(doubles)).Info("Checked for addresses allocated in more than one block")
+	return doubles, nil
+}
+
+// findGroupDoubleAllocations reads each of the overlapping blocks, and returns
+// the addresses which are allocated in more than one of them.
+func (rw blockReaderWriter) findGroupDoubleAllocations(group []allocatedBlock) ([]DoubleAllocation, error) {
+	allocated := map[string]*DoubleAllocation{}
+	doubles := []*DoubleAllocation{}
+	for _, ab := range group {
+		// Read the block by its key, since the CIDR stored in the block
+		// may not match it.
+		obj, err := rw.client.Backend.Get(model.BlockKey{CIDR: ab.key})
+		if err != nil {
+			if errors.IsNotExist(err) {
+				continue
+			}
+			rw.requestLog().WithField("blockCIDR", ab.key.String()).WithError(err).Error("Error reading block")
+			return nil, err
+		}
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		for _, ip := range b.assignedIPs() {
+			d, ok := allocated[ip.String()]
+			if !ok {
+				allocated[ip.String()] = &DoubleAllocation{IP: ip, Blocks: []cnet.IPNet{ab.key}}
+				continue
+			}
+			d.Blocks = append(d.Blocks, ab.key)
+			if len(d.Blocks) == 2 {
+				doubles = append(doubles, d)
+			}
+			rw.requestLog().WithFields(log.Fields{
+				"ip":     ip.String(),
+				"blocks": d.Blocks,
+			}).Warning("Address is allocated in more than one block")
+		}
+	}
+
+	result := []DoubleAllocation{}
+	for _, d := range doubles {
+		result = append(result, *d)
+	}
+	return result, nil
+}
+
+// overlappingBlocks groups together the blocks whose networks overlap, and
+// returns the groups with more than one block.
+func overlappingBlocks(blocks []allocatedBlock) [][]allocatedBlock {
+	sort.Sort(allocatedBlocksByNetwork(blocks))
+
+	// Since the blocks are sorted by address and then prefix length, a
+	// block can only overlap an earlier block by being within it.  The
+	// stack holds the chain of earlier blocks which each contain the next.
+	groups := [][]allocatedBlock{}
+	stack := []allocatedBlock{}
+	var group []allocatedBlock
+	for _, b := range blocks {
+		for len(stack) > 0 && !stack[len(stack)-1].network.Contains(b.network.IP) {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			if len(group) > 1 {
+				groups = append(groups, group)
+			}
+			group = nil
+		}
+		group = append(group, b)
+		stack = append(stack, b)
+	}
+	if len(group) > 1 {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// allocatedBlocksByNetwork sorts blocks by network, and then by the CIDR of
+// their key.
+type allocatedBlocksByNetwork []allocatedBlock
+
+func (s allocatedBlocksByNetwork) Len() int      { return len(s) }
+func (s allocatedBlocksByNetwork) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s allocatedBlocksByNetwork) Less(i, j int) bool {
+	if c := compareCIDRs(s[i].network, s[j].network); c != 0 {
+		return c < 0
+	}
+	return compareCIDRs(s[i].key, s[j].key) < 0
+}
+
+// doubleAllocationsByIP sorts double allocations by IP version, and then by
+// address.
+type doubleAllocationsByIP []DoubleAllocation
+
+func (s doubleAllocationsByIP) Len() int      { return len(s) }
+func (s doubleAllocationsByIP) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s doubleAllocationsByIP) Less(i, j int) bool {
+	if s[i].IP.Version() != s[j].IP.Version() {
+		return s[i].IP.Version() < s[j].IP.Version()
+	}
+	return bytes.Compare(s[i].IP.To16(), s[j].IP.To16()) < 0
+}
+
+// blockKeysContain returns whether any of the block keys is for the CIDR.
+func blockKeysContain(keys []model.BlockKey, cidr cnet.IPNet) bool {
+	for _, k := range keys {
+		if k.CIDR.String() == cidr.String() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,272 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+func testAffineBlock(cidr string, affinity string) *model.AllocationBlock {
+	b := newBlock(cnet.MustParseNetwork(cidr))
+	if affinity != "" {
+		b.Affinity = &affinity
+	}
+	return b.AllocationBlock
+}
+
+func testAffinityKey(host, cidr string) model.BlockAffinityKey {
+	return model.BlockAffinityKey{Host: host, CIDR: cnet.MustParseNetwork(cidr)}
+}
+
+var _ = Describe("compareBlockAffinities", func() {
+	It("should report nothing when affinities and blocks agree", func() {
+		report := compareBlockAffinities(
+			[]model.BlockAffinityKey{testAffinityKey("host-a", "10.0.0.0/26")},
+			[]*model.AllocationBlock{
+				testAffineBlock("10.0.0.0/26", "host:host-a"),
+				testAffineBlock("10.0.0.64/26", ""),
+			},
+		)
+		Expect(report.Consistent()).To(BeTrue())
+	})
+
+	It("should report affinity keys without a block as orphaned", func() {
+		report := compareBlockAffinities(
+			[]model.BlockAffinityKey{testAffinityKey("host-a", "10.0.0.0/26")},
+			nil,
+		)
+		Expect(report.OrphanedAffinities).To(Equal([]model.BlockAffinityKey{testAffinityKey("host-a", "10.0.0.0/26")}))
+		Expect(report.OrphanedBlocks).To(BeEmpty())
+		Expect(report.MismatchedAffinities).To(BeEmpty())
+	})
+
+	It("should report affine blocks without an affinity key as orphaned", func() {
+		report := compareBlockAffinities(
+			nil,
+			[]*model.AllocationBlock{testAffineBlock("10.0.0.0/26", "host:host-a")},
+		)
+		Expect(report.OrphanedAffinities).To(BeEmpty())
+		Expect(report.OrphanedBlocks).To(Equal([]model.BlockAffinityKey{testAffinityKey("host-a", "10.0.0.0/26")}))
+		Expect(report.MismatchedAffinities).To(BeEmpty())
+	})
+
+	It("should report affinity keys that disagree with the block", func() {
+		report := compareBlockAffinities(
+			[]model.BlockAffinityKey{
+				testAffinityKey("host-a", "10.0.0.0/26"),
+				testAffinityKey("host-a", "10.0.0.64/26"),
+			},
+			[]*model.AllocationBlock{
+				testAffineBlock("10.0.0.0/26", "host:host-b"),
+				testAffineBlock("10.0.0.64/26", ""),
+			},
+		)
+		Expect(report.OrphanedAffinities).To(BeEmpty())
+		Expect(report.MismatchedAffinities).To(Equal([]model.BlockAffinityKey{
+			testAffinityKey("host-a", "10.0.0.0/26"),
+			testAffinityKey("host-a", "10.0.0.64/26"),
+		}))
+		Expect(report.OrphanedBlocks).To(Equal([]model.BlockAffinityKey{testAffinityKey("host-b", "10.0.0.0/26")}))
+	})
+})
+
+var _ = Describe("Blocks with a CIDR that doesn't match their key", func() {
+	keyCIDR := cnet.MustParseNetwork("10.0.0.0/26")
+	storedCIDR := cnet.MustParseNetwork("10.0.0.64/26")
+	key := model.BlockKey{CIDR: keyCIDR}
+	mismatch := blockCIDRMismatchError{Key: keyCIDR, CIDR: storedCIDR}
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		ic = newIPAM(&Client{Backend: backend})
+
+		backend.storePool("10.0.0.0/24", false)
+
+		// Store a block for the wrong CIDR under the key.
+		_, err := backend.Create(&model.KVPair{Key: key, Value: testAffineBlock(storedCIDR.String(), "host:host-a")})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = backend.Create(&model.KVPair{Key: testAffinityKey("host-a", keyCIDR.String()), Value: model.BlockAffinityValue})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	expectUnchanged := func() {
+		obj, err := backend.Get(key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.Value.(*model.AllocationBlock).CIDR).To(Equal(storedCIDR))
+		_, err = backend.Get(model.BlockKey{CIDR: storedCIDR})
+		Expect(err).To(HaveOccurred())
+	}
+
+	It("should not be returned by getBlock", func() {
+		_, err := ic.blockReaderWriter.getBlock(keyCIDR)
+		Expect(err).To(Equal(mismatch))
+	})
+
+	It("should not be updated", func() {
+		err := ic.blockReaderWriter.updateWithRetry(key, func(obj *model.KVPair) error { return nil })
+		Expect(err).To(Equal(mismatch))
+		expectUnchanged()
+	})
+
+	It("should not have its affinity released", func() {
+		Expect(ic.blockReaderWriter.releaseBlockAffinity("host-a", keyCIDR)).To(Equal(mismatch))
+		expectUnchanged()
+		_, err := backend.Get(testAffinityKey("host-a", keyCIDR.String()))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should not have addresses released from it", func() {
+		_, err := ic.ReleaseIPs([]cnet.IP{cnet.MustParseIP("10.0.0.1")})
+		Expect(err).To(Equal(mismatch))
+		expectUnchanged()
+	})
+
+	It("should be reported, but not repaired, by the consistency check", func() {
+		report, err := ic.blockReaderWriter.checkBlockConsistency(true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Consistent()).To(BeFalse())
+		Expect(report.MismatchedBlocks).To(Equal([]model.BlockKey{key}))
+		Expect(report.OrphanedBlocks).To(BeEmpty())
+		expectUnchanged()
+		_, err = backend.Get(testAffinityKey("host-a", keyCIDR.String()))
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("checkBlockConsistency", func() {
+	var backend *fakeBlockBackend
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+	})
+
+	It("should delete orphaned affinity keys when repairing", func() {
+		orphan := testAffinityKey("host-a", "10.0.0.0/26")
+		_, err := backend.Create(&model.KVPair{Key: orphan, Value: model.BlockAffinityValue})
+		Expect(err).NotTo(HaveOccurred())
+
+		report, err := rw.checkBlockConsistency(false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.OrphanedAffinities).To(Equal([]model.BlockAffinityKey{orphan}))
+		_, err = backend.Get(orphan)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = rw.checkBlockConsistency(true)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = backend.Get(orphan)
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+		report, err = rw.checkBlockConsistency(false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.Consistent()).To(BeTrue())
+	})
+
+	It("should be exposed on the IPAM interface", func() {
+		orphan := testAffinityKey("host-a", "10.0.0.0/26")
+		_, err := backend.Create(&model.KVPair{Key: orphan, Value: model.BlockAffinityValue})
+		Expect(err).NotTo(HaveOccurred())
+
+		var i IPAMInterface = newIPAM(&Client{Backend: backend})
+		report, err := i.CheckBlockConsistency(true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.OrphanedAffinities).To(Equal([]model.BlockAffinityKey{orphan}))
+		_, err = backend.Get(orphan)
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+})
+
+var _ = Describe("findDoubleAllocations", func() {
+	var backend *fakeBlockBackend
+	var rw blockReaderWriter
+
+	// storeBlock stores a block for the CIDR under the key for keyCIDR, with
+	// the given addresses allocated.
+	storeBlock := func(keyCIDR, cidr string, ips ...string) {
+		b := newBlock(cnet.MustParseNetwork(cidr))
+		for _, ip := range ips {
+			Expect(b.assign(cnet.MustParseIP(ip), nil, nil, "host-a")).To(Succeed())
+		}
+		_, err := backend.Create(&model.KVPair{Key: model.BlockKey{CIDR: cnet.MustParseNetwork(keyCIDR)}, Value: b.AllocationBlock})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	// summarize returns the doubly allocated addresses as strings, mapped
+	// to the CIDRs of their blocks.
+	summarize := func(doubles []DoubleAllocation) [][]string {
+		s := [][]string{}
+		for _, d := range doubles {
+			entry := []string{d.IP.String()}
+			for _, b := range d.Blocks {
+				entry = append(entry, b.String())
+			}
+			s = append(s, entry)
+		}
+		return s
+	}
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+	})
+
+	It("should report nothing when no blocks overlap", func() {
+		storeBlock("10.0.0.0/26", "10.0.0.0/26", "10.0.0.1", "10.0.0.2")
+		storeBlock("10.0.0.64/26", "10.0.0.64/26", "10.0.0.65")
+		storeBlock("fd00::/122", "fd00::/122", "fd00::1")
+
+		doubles, err := rw.findDoubleAllocations()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(doubles).To(BeEmpty())
+	})
+
+	It("should report addresses allocated in overlapping blocks", func() {
+		storeBlock("10.0.0.0/24", "10.0.0.0/24", "10.0.0.5", "10.0.0.70", "10.0.0.200")
+		storeBlock("10.0.0.0/26", "10.0.0.0/26", "10.0.0.5", "10.0.0.6")
+		storeBlock("10.0.0.64/26", "10.0.0.64/26", "10.0.0.71")
+		storeBlock("10.0.0.0/28", "10.0.0.0/28", "10.0.0.5")
+		storeBlock("10.0.1.0/26", "10.0.1.0/26", "10.0.1.5")
+
+		doubles, err := rw.findDoubleAllocations()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summarize(doubles)).To(Equal([][]string{
+			{"10.0.0.5", "10.0.0.0/24", "10.0.0.0/26", "10.0.0.0/28"},
+		}))
+	})
+
+	It("should report the keys of blocks storing the same CIDR", func() {
+		storeBlock("10.0.0.0/26", "10.0.0.0/26", "10.0.0.1", "10.0.0.2")
+		storeBlock("10.0.0.64/26", "10.0.0.0/26", "10.0.0.2", "10.0.0.1")
+		storeBlock("fd00::/122", "fd00::/122", "fd00::1")
+		storeBlock("fd00::40/122", "fd00::/122", "fd00::1")
+
+		var i IPAMInterface = newIPAM(rw.client)
+		doubles, err := i.FindDoubleAllocations()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summarize(doubles)).To(Equal([][]string{
+			{"10.0.0.1", "10.0.0.0/26", "10.0.0.64/26"},
+			{"10.0.0.2", "10.0.0.0/26", "10.0.0.64/26"},
+			{"fd00::1", "fd00::/122", "fd00::40/122"},
+		}))
+	})
+})
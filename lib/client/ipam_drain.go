@@ -0,0 +1,176 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// PoolDrainResult reports the blocks and addresses freed by draining a pool,
+// or that would be freed if the drain is not confirmed.
+type PoolDrainResult struct {
+	Pool cnet.IPNet
+
+	// Confirmed is set if the blocks were drained.  Otherwise nothing was
+	// changed and the result reports what a confirmed drain would free.
+	Confirmed bool
+
+	// Blocks lists each block drained, with the number of addresses that
+	// were allocated from it, and NumAllocated is the total number of those
+	// addresses.
+	Blocks       []BlockUtil
+	NumAllocated int
+}
+
+// DrainPool frees every address allocated from the pool, releases the
+// affinities of the pool's blocks and deletes them.  The addresses are freed
+// regardless of whether they are still in use, so the caller must first make
+// sure that the workloads using them are gone.  Unless confirm is set,
+// nothing is changed, and the result reports the blocks and addresses that
+// would be freed.
+//
+// The blocks are drained concurrently, up to the configured BulkConcurrency,
+// and a block which fails to drain doesn't stop the others from being
+// drained; a bulkError holding each failure is returned.  Each step of
+// draining a block may be repeated, so if DrainPool fails part way through,
+// calling it again completes the drain.  Draining a pool with no blocks does
+// nothing.  A confirmed drain fails unless the IPAM configuration allows
+// destructive operations.
+func (c ipams) DrainPool(pool cnet.IPNet, confirm bool) (PoolDrainResult, error) {
+	logContext := c.requestLog().WithFields(log.Fields{
+		"cidr":    pool.String(),
+		"confirm": confirm,
+	})
+	result := PoolDrainResult{Pool: pool, Confirmed: confirm}
+	if confirm {
+		if err := c.blockReaderWriter.checkDestructiveOpsAllowed("DrainPool"); err != nil {
+			return result, err
+		}
+	}
+
+	version := getIPVersion(cnet.IP{pool.IP})
+	all, err := c.blockReaderWriter.listAll(model.BlockListOptions{IPVersion: version.Number, Pool: pool}, ipamListPageSize)
+	if err != nil && !errors.IsNotExist(err) {
+		logContext.WithError(err).Error("Error listing blocks")
+		return result, err
+	}
+	blocks := []*model.AllocationBlock{}
+	for _, obj := range all {
+		if err := checkBlockCIDR(obj.Key, obj); err != nil {
+			logContext.WithError(err).Warning("Skipping block")
+			continue
+		}
+		b := obj.Value.(*model.AllocationBlock)
+		if blockBelongsToPool(b, pool) {
+			blocks = append(blocks, b)
+		}
+	}
+
+	if !confirm {
+		for _, b := range blocks {
+			u := blockUtil(b)
+			result.Blocks = append(result.Blocks, u)
+			result.NumAllocated += u.Allocated
+		}
+		logContext.WithFields(log.Fields{
+			"blocks":    len(result.Blocks),
+			"addresses": result.NumAllocated,
+		}).Info("Pool drain not confirmed")
+		return result, nil
+	}
+
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return result, err
+	}
+	utils := make([]BlockUtil, len(blocks))
+	drained := make([]bool, len(blocks))
+	errs := forEachConcurrently(len(blocks), cfg.bulkConcurrency(), func(i int) error {
+		var err error
+		utils[i], drained[i], err = c.drainBlock(blocks[i].CIDR)
+		return err
+	})
+	bulkErr := bulkError{Op: "DrainPool", Errs: map[string]error{}}
+	for i, err := range errs {
+		if err != nil {
+			bulkErr.Errs[blocks[i].CIDR.String()] = err
+		} else if drained[i] {
+			result.Blocks = append(result.Blocks, utils[i])
+			result.NumAllocated += utils[i].Allocated
+		}
+	}
+	if len(bulkErr.Errs) > 0 {
+		return result, bulkErr
+	}
+
+	logContext.WithFields(log.Fields{
+		"blocks":    len(result.Blocks),
+		"addresses": result.NumAllocated,
+	}).Info("Drained pool")
+	return result, nil
+}
+
+// drainBlock frees the addresses allocated from the block, releases its
+// affinity and deletes it, returning the block's utilization before it was
+// drained.  Returns false if the block no longer exists.
+//
+// The handle counts and the affinity are cleared before the block is
+// deleted, and setting them again has no effect, so a drain interrupted
+// before the block is deleted is completed by draining the block again.
+func (c ipams) drainBlock(blockCIDR cnet.IPNet) (BlockUtil, bool, error) {
+	logContext := c.requestLog().WithField("blockCIDR", blockCIDR.String())
+	var u BlockUtil
+	err := c.blockReaderWriter.writeWithRetry(model.BlockKey{CIDR: blockCIDR}, func(obj *model.KVPair) error {
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		u = blockUtil(b.AllocationBlock)
+		host, affine := blockAffinityHost(b.AllocationBlock)
+
+		// Find the handles with addresses assigned from the block.
+		handles := map[string]bool{}
+		for _, a := range b.Allocations {
+			if a != nil && b.Attributes[*a].AttrPrimary != nil {
+				handles[*b.Attributes[*a].AttrPrimary] = true
+			}
+		}
+		for handleID := range handles {
+			if err := c.setHandleBlockCount(handleID, blockCIDR, 0); err != nil {
+				return err
+			}
+		}
+		if affine {
+			if err := c.blockReaderWriter.deleteBlockAffinity(host, blockCIDR); err != nil {
+				return err
+			}
+		}
+		logContext.WithField("addresses", u.Allocated).Warning("Draining block")
+		return nil
+	}, func(obj *model.KVPair) error {
+		// Delete the block using the revision we read, so that if
+		// addresses were assigned from it in the meantime, we retry and
+		// clear their handles too.
+		return c.client.Backend.Delete(obj)
+	})
+	if err != nil {
+		if errors.IsNotExist(err) {
+			return BlockUtil{}, false, nil
+		}
+		logContext.WithError(err).Error("Error draining block")
+		return BlockUtil{}, false, err
+	}
+	return u, true, nil
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	goerrors "errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// blockDeleteFailingBackend is a fakeBlockBackend which fails to delete
+// blocks.
+type blockDeleteFailingBackend struct {
+	*fakeBlockBackend
+}
+
+func (f blockDeleteFailingBackend) Delete(kvp *model.KVPair) error {
+	if _, ok := kvp.Key.(model.BlockKey); ok {
+		return errors.ErrorDatastoreError{Err: goerrors.New("injected failure"), Identifier: kvp.Key}
+	}
+	return f.fakeBlockBackend.Delete(kvp)
+}
+
+var _ = Describe("DrainPool", func() {
+	pool := cnet.MustParseNetwork("10.0.0.0/24")
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	assign := func(num int, host, handle string, pool string) {
+		_, _, err := ic.AutoAssign(AutoAssignArgs{
+			Num4:      num,
+			Hostname:  host,
+			HandleID:  &handle,
+			IPv4Pools: []cnet.IPNet{cnet.MustParseNetwork(pool)},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	exists := func(key model.Key) bool {
+		_, err := backend.Get(key)
+		if errors.IsNotExist(err) {
+			return false
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return true
+	}
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		backend.storePool("10.1.0.0/24", false)
+		backend.allowDestructiveOps()
+
+		ic = newIPAM(&Client{Backend: backend})
+
+		// Three blocks in the pool, and one in another pool.
+		assign(3, "host-a", "handle-a", "10.0.0.0/24")
+		assign(70, "host-b", "handle-b", "10.0.0.0/24")
+		assign(1, "host-a", "handle-c", "10.1.0.0/24")
+	})
+
+	It("should report what would be freed without changing anything", func() {
+		result, err := ic.DrainPool(pool, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Confirmed).To(BeFalse())
+		Expect(result.Blocks).To(HaveLen(3))
+		Expect(result.NumAllocated).To(Equal(73))
+
+		for _, u := range result.Blocks {
+			Expect(exists(model.BlockKey{CIDR: u.CIDR})).To(BeTrue())
+		}
+		Expect(exists(model.IPAMHandleKey{HandleID: "handle-a"})).To(BeTrue())
+		Expect(exists(model.IPAMHandleKey{HandleID: "handle-b"})).To(BeTrue())
+	})
+
+	It("should free the pool's addresses, affinities and blocks when confirmed", func() {
+		dryRun, err := ic.DrainPool(pool, false)
+		Expect(err).NotTo(HaveOccurred())
+
+		result, err := ic.DrainPool(pool, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Confirmed).To(BeTrue())
+		Expect(result.Blocks).To(ConsistOf(dryRun.Blocks))
+		Expect(result.NumAllocated).To(Equal(73))
+
+		for _, u := range result.Blocks {
+			Expect(exists(model.BlockKey{CIDR: u.CIDR})).To(BeFalse())
+			Expect(exists(model.BlockAffinityKey{Host: "host-a", CIDR: u.CIDR})).To(BeFalse())
+			Expect(exists(model.BlockAffinityKey{Host: "host-b", CIDR: u.CIDR})).To(BeFalse())
+		}
+		Expect(exists(model.IPAMHandleKey{HandleID: "handle-a"})).To(BeFalse())
+		Expect(exists(model.IPAMHandleKey{HandleID: "handle-b"})).To(BeFalse())
+
+		// The other pool is untouched.
+		Expect(exists(model.IPAMHandleKey{HandleID: "handle-c"})).To(BeTrue())
+		ips, err := ic.IPsByHandle("handle-c")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(1))
+	})
+
+	It("should do nothing when drained again", func() {
+		_, err := ic.DrainPool(pool, true)
+		Expect(err).NotTo(HaveOccurred())
+
+		result, err := ic.DrainPool(pool, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Blocks).To(BeEmpty())
+		Expect(result.NumAllocated).To(Equal(0))
+	})
+
+	It("should complete an interrupted drain when drained again", func() {
+		ic.client.Backend = blockDeleteFailingBackend{backend}
+		_, err := ic.DrainPool(pool, true)
+		Expect(err).To(BeAssignableToTypeOf(bulkError{}))
+		Expect(err.(bulkError).Errs).To(HaveLen(3))
+
+		ic.client.Backend = backend
+		result, err := ic.DrainPool(pool, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Blocks).To(HaveLen(3))
+		Expect(result.NumAllocated).To(Equal(73))
+		Expect(exists(model.IPAMHandleKey{HandleID: "handle-a"})).To(BeFalse())
+		Expect(exists(model.IPAMHandleKey{HandleID: "handle-b"})).To(BeFalse())
+	})
+})
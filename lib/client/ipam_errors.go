@@ -16,6 +16,12 @@ package client
 
 import (
 	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
 )
 
 // invalidSizeError indicates that the requested IP network size is not valid.
@@ -41,12 +47,329 @@ func (e noFreeBlocksError) Error() string {
 	return string(e)
 }
 
+// maxBlocksExceededError indicates an attempt to claim a block for a
+// host that already has the maximum number of affine blocks allowed
+// by the IPAM configuration.
+type maxBlocksExceededError string
+
+func (e maxBlocksExceededError) Error() string {
+	return string(e)
+}
+
+// strictAffinityExhaustedError indicates that StrictAffinity is enabled and a
+// host ran out of addresses in its affine blocks without being able to claim
+// a new block, so the remaining addresses could not be assigned.
+type strictAffinityExhaustedError struct {
+	Host      string
+	Version   int
+	Requested int
+	Assigned  int
+}
+
+func (e strictAffinityExhaustedError) Error() string {
+	return fmt.Sprintf("host %s has exhausted its affine IPv%d blocks with strict affinity: assigned %d of %d addresses",
+		e.Host, e.Version, e.Assigned, e.Requested)
+}
+
+// handleInUseError indicates that UniqueHandles is enabled and the handle
+// is owned by another host.
+type handleInUseError struct {
+	HandleID string
+	Owner    string
+}
+
+func (e handleInUseError) Error() string {
+	return fmt.Sprintf("handle %s is in use by host %s", e.HandleID, e.Owner)
+}
+
+// missingAttributesError indicates that an assignment did not supply all of
+// the attributes required by the IPAM configuration.
+type missingAttributesError struct {
+	Missing []string
+}
+
+func (e missingAttributesError) Error() string {
+	return fmt.Sprintf("assignment is missing required attributes: %s", strings.Join(e.Missing, ", "))
+}
+
+// maxAttributeValueLength is the longest attribute value that may be stored
+// with an allocation while attributes are required, to keep blocks small.
+const maxAttributeValueLength = 256
+
+// attributeTooLongError indicates that an assignment supplied an attribute
+// value longer than maxAttributeValueLength.
+type attributeTooLongError struct {
+	Key    string
+	Length int
+}
+
+func (e attributeTooLongError) Error() string {
+	return fmt.Sprintf("attribute %s is %d characters long, the maximum is %d", e.Key, e.Length, maxAttributeValueLength)
+}
+
+// blockNotEmptyError indicates that a block's affinity was not released
+// because addresses are still assigned from the block.
+type blockNotEmptyError struct {
+	Block cnet.IPNet
+}
+
+func (e blockNotEmptyError) Error() string {
+	return fmt.Sprintf("block %s still has addresses assigned", e.Block)
+}
+
+// blockLingeringError indicates that an empty block's affinity was not
+// released because the block was emptied less than the EmptyBlockLinger ago.
+type blockLingeringError struct {
+	Block cnet.IPNet
+	Until time.Time
+}
+
+func (e blockLingeringError) Error() string {
+	return fmt.Sprintf("block %s was emptied recently and lingers until %s", e.Block, e.Until.Format(time.RFC3339))
+}
+
+// blockReleasedError indicates that a block was released by another process
+// while it was being claimed.
+type blockReleasedError struct {
+	Block cnet.IPNet
+}
+
+func (e blockReleasedError) Error() string {
+	return fmt.Sprintf("block %s was released while it was claimed", e.Block)
+}
+
+// blockNotAffineError indicates an attempt to set strict affinity on a block
+// which is not affine to any host, where it would have no effect.
+type blockNotAffineError struct {
+	Block cnet.IPNet
+}
+
+func (e blockNotAffineError) Error() string {
+	return fmt.Sprintf("block %s is not affine to a host, so cannot have strict affinity", e.Block)
+}
+
+// invalidHostNameError indicates a host name which can't be used in a block
+// affinity key, because not every backend could store it and read it back.
+type invalidHostNameError struct {
+	Host   string
+	Reason string
+}
+
+func (e invalidHostNameError) Error() string {
+	return fmt.Sprintf("invalid host name %q: %s", e.Host, e.Reason)
+}
+
+// invalidHandleIDError indicates a handle ID containing a '/' or '%'.  The ID
+// is used as the last element of the handle's path, so such a handle could
+// not be listed.
+type invalidHandleIDError struct {
+	HandleID string
+}
+
+func (e invalidHandleIDError) Error() string {
+	return fmt.Sprintf("invalid handle ID %q: must not contain '/' or '%%'", e.HandleID)
+}
+
+// blockSizeInUseError indicates an attempt to give a pool a block size which
+// differs from the size of a block that already exists within the pool.
+type blockSizeInUseError struct {
+	Pool      cnet.IPNet
+	Block     cnet.IPNet
+	BlockSize int
+}
+
+func (e blockSizeInUseError) Error() string {
+	return fmt.Sprintf("pool %s already has block %s, so its block size can't be /%d", e.Pool, e.Block, e.BlockSize)
+}
+
+// poolStateConflictError indicates that importing a pool's state would
+// overwrite existing state which differs from it.
+type poolStateConflictError struct {
+	Key model.Key
+}
+
+func (e poolStateConflictError) Error() string {
+	return fmt.Sprintf("%s already exists with different state", e.Key)
+}
+
+// notAssignedError indicates that the given IP address is not
+// currently assigned.
+type notAssignedError struct {
+	IP cnet.IP
+}
+
+func (e notAssignedError) Error() string {
+	return fmt.Sprintf("%s is not assigned", e.IP)
+}
+
+// blockNotFoundError indicates that the block containing the given IP address
+// does not exist, so no host serves the address.
+type blockNotFoundError struct {
+	IP    cnet.IP
+	Block cnet.IPNet
+}
+
+func (e blockNotFoundError) Error() string {
+	return fmt.Sprintf("block %s containing %s does not exist", e.Block, e.IP)
+}
+
+// destructiveOpsDisabledError indicates an attempt to run a destructive IPAM
+// operation when the IPAM configuration does not allow them.
+type destructiveOpsDisabledError struct {
+	Op string
+}
+
+func (e destructiveOpsDisabledError) Error() string {
+	return fmt.Sprintf("%s is a destructive operation, and destructive operations are disabled in the IPAM configuration", e.Op)
+}
+
+// notInAnyPoolError indicates that the given IP address is not
+// within any enabled IP pool.
+type notInAnyPoolError struct {
+	IP cnet.IP
+}
+
+func (e notInAnyPoolError) Error() string {
+	return fmt.Sprintf("%s is not in any enabled IP pool", e.IP)
+}
+
+// blocksInUseError indicates an attempt to delete the blocks of a pool
+// when some of the blocks still have addresses assigned.
+type blocksInUseError struct {
+	Pool   cnet.IPNet
+	Blocks []cnet.IPNet
+}
+
+func (e blocksInUseError) Error() string {
+	blocks := make([]string, len(e.Blocks))
+	for i, b := range e.Blocks {
+		blocks[i] = b.String()
+	}
+	return fmt.Sprintf("pool %s has blocks with assigned addresses: %s", e.Pool, strings.Join(blocks, ", "))
+}
+
+// noPoolsError indicates an attempt to claim a block when no pools are
+// configured at all.
+type noPoolsError struct{}
+
+func (e noPoolsError) Error() string {
+	return "No configured Calico pools"
+}
+
+// invalidIPVersionError indicates an IP version other than 4 or 6, such as the
+// zero value of an ipVersion.
+type invalidIPVersionError struct {
+	Number int
+}
+
+func (e invalidIPVersionError) Error() string {
+	return fmt.Sprintf("invalid IP version %d: must be 4 or 6", e.Number)
+}
+
+// noPoolsForVersionError indicates an attempt to claim a block when pools are
+// configured, but none of them, or none of those requested, are of the IP
+// version being assigned.
+type noPoolsForVersionError struct {
+	Version int
+}
+
+func (e noPoolsForVersionError) Error() string {
+	return fmt.Sprintf("No configured Calico IPv%d pools", e.Version)
+}
+
+// poolsDisabledError indicates an attempt to claim a block when every pool of
+// the IP version being assigned, or every such pool requested, is disabled.
+type poolsDisabledError struct {
+	Version int
+}
+
+func (e poolsDisabledError) Error() string {
+	return fmt.Sprintf("All configured Calico IPv%d pools are disabled", e.Version)
+}
+
+// poolDisabledError indicates an attempt to assign from, or claim a block
+// in, a pool that is disabled.
+type poolDisabledError struct {
+	Pool cnet.IPNet
+}
+
+func (e poolDisabledError) Error() string {
+	return fmt.Sprintf("The given pool (%s) is disabled", e.Pool)
+}
+
+// noContiguousRangeError indicates an attempt to assign a run of contiguous
+// addresses when no block has a large enough run of free addresses.
+type noContiguousRangeError struct {
+	Num int
+}
+
+func (e noContiguousRangeError) Error() string {
+	return fmt.Sprintf("no block has %d contiguous free addresses", e.Num)
+}
+
+// maxRetriesError indicates that an update of the object with the given key
+// was abandoned after the maximum number of attempts.  Err is the datastore
+// error from the last attempt, which callers may retrieve with Unwrap.  The
+// datastore error is not wrapped by the IPAM methods otherwise, so that the
+// lib/errors predicates continue to match the errors they return.
+type maxRetriesError struct {
+	Key model.Key
+	Err error
+}
+
+func (e maxRetriesError) Error() string {
+	return fmt.Sprintf("Max retries hit updating %s: %v", e.Key, e.Err)
+}
+
+// Unwrap returns the datastore error from the last attempt.
+func (e maxRetriesError) Unwrap() error {
+	return e.Err
+}
+
+// bulkError is returned by a bulk operation when it fails for some of its
+// items.  The operation carries on with the other items, so Errs holds the
+// error for each item that failed, keyed by the item.
+type bulkError struct {
+	Op   string
+	Errs map[string]error
+}
+
+func (e bulkError) Error() string {
+	items := []string{}
+	for item := range e.Errs {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+	return fmt.Sprintf("%s failed for %d items, first %s: %v", e.Op, len(items), items[0], e.Errs[items[0]])
+}
+
+// blockCIDRMismatchError indicates that the block stored under the key for one
+// CIDR holds a different CIDR, so the stored block can't be trusted.
+type blockCIDRMismatchError struct {
+	Key  cnet.IPNet
+	CIDR cnet.IPNet
+}
+
+func (e blockCIDRMismatchError) Error() string {
+	return fmt.Sprintf("block %s holds mismatched CIDR %s", e.Key, e.CIDR)
+}
+
 // affinityClaimedError indicates that a given block has already
-// been claimed by another host.
+// been claimed by another host.  Strict is set when the existing block
+// has StrictAffinity enabled, in which case the block can never be
+// used by another host and callers should not retry or overflow into it.
 type affinityClaimedError struct {
-	Block allocationBlock
+	Block  allocationBlock
+	Strict bool
 }
 
 func (e affinityClaimedError) Error() string {
-	return fmt.Sprintf("%s already claimed by %s", e.Block.CIDR, e.Block.Affinity)
+	affinity := "<none>"
+	if e.Block.Affinity != nil {
+		affinity = *e.Block.Affinity
+	}
+	if e.Strict {
+		return fmt.Sprintf("%s already claimed by %s with strict affinity", e.Block.CIDR, affinity)
+	}
+	return fmt.Sprintf("%s already claimed by %s", e.Block.CIDR, affinity)
 }
@@ -60,6 +60,27 @@ func (h allocationHandle) decrementBlock(blockCidr net.IPNet, num int) (*int, er
 	}
 }
 
+// setBlock sets the number of addresses assigned to the handle from the given
+// block, removing the block from the handle when num is 0.
+func (h allocationHandle) setBlock(blockCidr net.IPNet, num int) {
+	if num == 0 {
+		delete(h.Block, blockCidr.String())
+	} else {
+		h.Block[blockCidr.String()] = num
+	}
+}
+
+// claimOwner makes host the owner of the handle if it has no owner.  If
+// unique is set, a handleInUseError is returned if another host owns it.
+func (h allocationHandle) claimOwner(host string, unique bool) error {
+	if h.Owner == "" {
+		h.Owner = host
+	} else if unique && h.Owner != host {
+		return handleInUseError{HandleID: h.HandleID, Owner: h.Owner}
+	}
+	return nil
+}
+
 func (h allocationHandle) empty() bool {
 	return len(h.Block) == 0
 }
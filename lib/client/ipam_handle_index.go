@@ -0,0 +1,218 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	goerrors "errors"
+	"reflect"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// The handles form an index of the blocks each handle has addresses in, but
+// the blocks themselves are authoritative.  An entry may be missing on a
+// cluster whose addresses were assigned before the entry was written, or
+// corrupt after an interrupted write, so the functions below recover the
+// index from the blocks.
+
+// handleBlocks returns the handle's number of addresses in each block, keyed
+// by block CIDR, as read from the handle index.  If the handle's entry is
+// missing or corrupt, every block is scanned for the handle's addresses
+// instead, and the entry is rebuilt from them.  Returns the error reading
+// the entry if it is missing and no addresses are assigned with the handle.
+func (c ipams) handleBlocks(handleID string) (map[string]int, error) {
+	obj, err := c.client.Backend.Get(model.IPAMHandleKey{HandleID: handleID})
+	if err != nil && !errors.IsNotExist(err) {
+		return nil, err
+	} else if err == nil && validHandleBlocks(obj.Value.(*model.IPAMHandle).Block) {
+		return obj.Value.(*model.IPAMHandle).Block, nil
+	}
+
+	c.requestLog().WithField("handle", handleID).Warning("Handle index is stale, scanning all blocks for the handle's addresses")
+	counts, rebuildErr := c.rebuildHandleEntry(handleID)
+	if rebuildErr != nil {
+		return nil, rebuildErr
+	} else if err != nil && len(counts) == 0 {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// validHandleBlocks returns whether every block in a handle's entry is a
+// valid CIDR with a positive number of addresses.
+func validHandleBlocks(blocks map[string]int) bool {
+	for cidr, num := range blocks {
+		if _, _, err := net.ParseCIDR(cidr); err != nil || num <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// rebuildHandleEntry scans every block for the addresses assigned with the
+// handle and rewrites the handle's entry in the index from them, deleting
+// it if there are none.  Returns the handle's number of addresses in each
+// block.
+func (c ipams) rebuildHandleEntry(handleID string) (map[string]int, error) {
+	byHandle, err := c.scanHandleCounts()
+	if err != nil {
+		return nil, err
+	}
+	counts := byHandle[handleID]
+	if counts == nil {
+		counts = map[string]int{}
+	}
+	if _, err := c.writeHandleCounts(handleID, counts); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// RebuildHandleIndex scans every block and rewrites every handle's entry in
+// the index from scratch: entries which differ from the blocks are
+// rewritten, missing entries are created, and entries for handles with no
+// addresses are deleted.  The owner of an existing entry is kept.  Returns
+// the number of entries changed.
+//
+// A handle is written before the block when assigning, so RebuildHandleIndex
+// may delete the entry of an assignment in progress; run it while nothing is
+// being assigned.
+func (c ipams) RebuildHandleIndex() (int, error) {
+	byHandle, err := c.scanHandleCounts()
+	if err != nil {
+		return 0, err
+	}
+
+	// Handles with no addresses are found by listing the index.  If the
+	// datastore cannot list handles, only the handles found in the blocks
+	// are rebuilt.
+	kvps, err := c.blockReaderWriter.listAll(model.IPAMHandleListOptions{}, ipamListPageSize)
+	if err != nil {
+		if _, ok := err.(errors.ErrorOperationNotSupported); !ok {
+			c.requestLog().WithError(err).Error("Error listing handles")
+			return 0, err
+		}
+		c.requestLog().Warning("Datastore cannot list handles, only rebuilding handles with addresses")
+	}
+	for _, kvp := range kvps {
+		id := kvp.Key.(model.IPAMHandleKey).HandleID
+		if _, ok := byHandle[id]; !ok {
+			byHandle[id] = map[string]int{}
+		}
+	}
+
+	ids := []string{}
+	for id := range byHandle {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	changed := 0
+	for _, id := range ids {
+		written, err := c.writeHandleCounts(id, byHandle[id])
+		if err != nil {
+			return changed, err
+		}
+		if written {
+			changed++
+		}
+	}
+	c.requestLog().WithFields(log.Fields{"handles": len(ids), "changed": changed}).Info("Rebuilt handle index")
+	return changed, nil
+}
+
+// scanHandleCounts scans every block and returns the number of addresses
+// assigned with each handle in each block, keyed by handle ID and then by
+// block CIDR.
+func (c ipams) scanHandleCounts() (map[string]map[string]int, error) {
+	kvps, err := c.blockReaderWriter.listAll(model.BlockListOptions{}, ipamListPageSize)
+	if err != nil && !errors.IsNotExist(err) {
+		c.requestLog().WithError(err).Error("Error listing blocks")
+		return nil, err
+	}
+	byHandle := map[string]map[string]int{}
+	for _, kvp := range kvps {
+		block := allocationBlock{kvp.Value.(*model.AllocationBlock)}
+		for _, a := range block.assignedIPsMatching(nil) {
+			if a.HandleID == nil {
+				continue
+			}
+			if byHandle[*a.HandleID] == nil {
+				byHandle[*a.HandleID] = map[string]int{}
+			}
+			byHandle[*a.HandleID][block.CIDR.String()]++
+		}
+	}
+	return byHandle, nil
+}
+
+// writeHandleCounts sets the handle's entry in the index to the given
+// counts, creating it if needed and deleting it if there are none.  An
+// existing entry with the same counts is left as it is.  Returns whether the
+// entry was changed.
+func (c ipams) writeHandleCounts(handleID string, counts map[string]int) (bool, error) {
+	key := model.IPAMHandleKey{HandleID: handleID}
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return false, err
+	}
+	retry := cfg.Retry.start()
+	for i := 0; i < retry.maxAttempts(); i++ {
+		if !c.blockReaderWriter.waitForRetry(retry, i, key) {
+			break
+		}
+		obj, err := c.client.Backend.Get(key)
+		if errors.IsNotExist(err) {
+			if len(counts) == 0 {
+				return false, nil
+			}
+			obj = &model.KVPair{Key: key, Value: &model.IPAMHandle{HandleID: handleID, Block: counts}}
+			if _, err := c.client.Backend.Create(obj); err != nil {
+				if errors.IsAlreadyExists(err) {
+					continue
+				}
+				return false, err
+			}
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		handle := obj.Value.(*model.IPAMHandle)
+		if len(counts) == 0 {
+			err = c.client.Backend.Delete(obj)
+			if errors.IsNotExist(err) {
+				return false, nil
+			}
+		} else if reflect.DeepEqual(handle.Block, counts) {
+			return false, nil
+		} else {
+			handle.Block = counts
+			_, err = c.client.Backend.Update(obj)
+		}
+		if err != nil {
+			if errors.IsRetryable(err) {
+				continue
+			}
+			c.requestLog().Errorf("Error rebuilding handle '%s': %s", handleID, err)
+			return false, err
+		}
+		return true, nil
+	}
+	return false, goerrors.New("Max retries hit")
+}
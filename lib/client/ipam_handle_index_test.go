@@ -0,0 +1,157 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+var _ = Describe("Stale handle index", func() {
+	blockA := "10.0.0.0/26"
+	blockB := "10.0.0.64/26"
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	assign := func(num int, host, handle string) {
+		_, _, err := ic.AutoAssign(AutoAssignArgs{Num4: num, Hostname: host, HandleID: &handle})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	// setEntry overwrites the handle's entry in the index, or deletes it if
+	// blocks is nil.
+	setEntry := func(handle string, blocks map[string]int) {
+		key := model.IPAMHandleKey{HandleID: handle}
+		if blocks == nil {
+			Expect(backend.Delete(&model.KVPair{Key: key})).To(Succeed())
+			return
+		}
+		backend.store(&model.KVPair{Key: key, Value: &model.IPAMHandle{HandleID: handle, Owner: "host-a", Block: blocks}})
+	}
+
+	entry := func(handle string) map[string]int {
+		obj, err := backend.Get(model.IPAMHandleKey{HandleID: handle})
+		if errors.IsNotExist(err) {
+			return nil
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return obj.Value.(*model.IPAMHandle).Block
+	}
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/25", false)
+		ic = newIPAM(&Client{Backend: backend})
+
+		// handle-a has addresses in both of the pool's blocks, on
+		// different hosts.
+		assign(3, "host-a", "handle-a")
+		assign(2, "host-b", "handle-a")
+		assign(1, "host-a", "handle-b")
+		Expect(entry("handle-a")).To(Equal(map[string]int{blockA: 3, blockB: 2}))
+	})
+
+	expectReleased := func(handle string) {
+		ips, err := ic.ListAssignedIPs(ipv4, nil)
+		Expect(err).NotTo(HaveOccurred())
+		for _, a := range ips {
+			Expect(*a.HandleID).NotTo(Equal(handle))
+		}
+		Expect(entry(handle)).To(BeNil())
+	}
+
+	It("should release by scanning the blocks when the entry is missing", func() {
+		setEntry("handle-a", nil)
+		Expect(ic.ReleaseByHandle("handle-a")).To(Succeed())
+		expectReleased("handle-a")
+		Expect(entry("handle-b")).To(Equal(map[string]int{blockA: 1}))
+	})
+
+	It("should release by scanning the blocks when the entry is corrupt", func() {
+		setEntry("handle-a", map[string]int{blockA: 3, "not-a-cidr": 2})
+		Expect(ic.ReleaseByHandle("handle-a")).To(Succeed())
+		expectReleased("handle-a")
+	})
+
+	It("should rebuild the entry when it records too few addresses", func() {
+		setEntry("handle-a", map[string]int{blockA: 1, blockB: 2})
+		Expect(ic.ReleaseByHandle("handle-a")).To(Succeed())
+		expectReleased("handle-a")
+	})
+
+	It("should release by scanning the blocks when the entry lists the wrong blocks", func() {
+		// The entry points at a block that doesn't exist and omits blockB.
+		setEntry("handle-a", map[string]int{blockA: 3, "10.0.1.0/26": 2})
+		Expect(ic.ReleaseByHandle("handle-a")).To(Succeed())
+		expectReleased("handle-a")
+		Expect(entry("handle-b")).To(Equal(map[string]int{blockA: 1}))
+	})
+
+	It("should list every address by scanning the blocks when the entry lists the wrong blocks", func() {
+		setEntry("handle-a", map[string]int{blockA: 3, "10.0.1.0/26": 2})
+		ips, err := ic.IPsByHandle("handle-a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(5))
+		Expect(entry("handle-a")).To(Equal(map[string]int{blockA: 3, blockB: 2}))
+	})
+
+	It("should still fail to release a handle with no addresses", func() {
+		err := ic.ReleaseByHandle("handle-unknown")
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should reassign an address when the old handle's entry is missing", func() {
+		setEntry("handle-a", nil)
+		Expect(ic.ReassignHandle(cnet.MustParseIP("10.0.0.0"), "handle-b")).To(Succeed())
+		Expect(entry("handle-a")).To(Equal(map[string]int{blockA: 2, blockB: 2}))
+		Expect(entry("handle-b")).To(Equal(map[string]int{blockA: 2}))
+	})
+
+	Describe("RebuildHandleIndex", func() {
+		It("should rebuild every entry from the blocks", func() {
+			setEntry("handle-a", map[string]int{blockA: 7, "not-a-cidr": 2})
+			setEntry("handle-b", nil)
+			setEntry("handle-stale", map[string]int{blockB: 1})
+
+			changed, err := ic.RebuildHandleIndex()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(changed).To(Equal(3))
+			Expect(entry("handle-a")).To(Equal(map[string]int{blockA: 3, blockB: 2}))
+			Expect(entry("handle-b")).To(Equal(map[string]int{blockA: 1}))
+			Expect(entry("handle-stale")).To(BeNil())
+
+			// The owner of an existing entry is kept.
+			obj, err := backend.Get(model.IPAMHandleKey{HandleID: "handle-a"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(obj.Value.(*model.IPAMHandle).Owner).To(Equal("host-a"))
+		})
+
+		It("should change nothing when the index is consistent", func() {
+			changed, err := ic.RebuildHandleIndex()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(changed).To(Equal(0))
+
+			Expect(ic.ReleaseIPs([]cnet.IP{cnet.MustParseIP("10.0.0.64")})).To(BeEmpty())
+			changed, err = ic.RebuildHandleIndex()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(changed).To(Equal(0))
+		})
+	})
+})
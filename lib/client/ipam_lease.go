@@ -0,0 +1,140 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// withLease returns a copy of c which assigns addresses with a lease that
+// expires ttl from now.  If ttl is 0 or less, addresses are assigned without a
+// lease and never expire.
+func (c ipams) withLease(ttl time.Duration) ipams {
+	c.blockReaderWriter.leaseExpiry = nil
+	if ttl > 0 {
+		expiry := time.Now().Add(ttl).UTC()
+		c.blockReaderWriter.leaseExpiry = &expiry
+	}
+	return c
+}
+
+// ReleaseExpiredAllocations frees the addresses whose lease expired more than
+// grace ago.  This may be run periodically, and concurrently with assignment.
+func (c ipams) ReleaseExpiredAllocations(grace time.Duration) ([]cnet.IP, error) {
+	return c.reapExpiredAllocations(time.Now(), grace)
+}
+
+// reapExpiredAllocations frees the addresses whose lease expired more than
+// grace before now, so that the addresses of workloads which died without
+// releasing them can be reused.  Addresses assigned without a lease are never
+// freed.  Returns the addresses freed.
+//
+// Each block is checked for expired addresses again when it is updated, so
+// an address released and assigned again since the blocks were listed is not
+// freed, and reaping again frees nothing more until further leases expire.
+func (c ipams) reapExpiredAllocations(now time.Time, grace time.Duration) ([]cnet.IP, error) {
+	c = c.withRequestID("")
+	c, err := c.withIPAMConfig()
+	if err != nil {
+		return nil, err
+	}
+	before := now.Add(-grace)
+	objs, err := c.blockReaderWriter.listAll(model.BlockListOptions{}, ipamListPageSize)
+	if errors.IsPartialList(err) {
+		// Reap the blocks we could read.  The others are reaped once they
+		// can be read again.
+		c.requestLog().WithError(err).Warning("Some blocks could not be read, reaping the others")
+	} else if err != nil && !errors.IsNotExist(err) {
+		c.requestLog().WithError(err).Error("Error listing blocks")
+		return nil, err
+	}
+
+	reaped := []cnet.IP{}
+	for _, obj := range objs {
+		if err := checkBlockCIDR(obj.Key, obj); err != nil {
+			c.requestLog().WithError(err).Warning("Skipping block")
+			continue
+		}
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		if len(b.expiredIPs(before)) == 0 {
+			continue
+		}
+		ips, err := c.reapExpiredFromBlock(b.CIDR, before)
+		if err != nil {
+			return reaped, err
+		}
+		reaped = append(reaped, ips...)
+	}
+	c.requestLog().WithField("addresses", len(reaped)).Info("Reaped expired allocations")
+	return reaped, nil
+}
+
+// reapExpiredFromBlock frees the addresses in the block whose lease expired
+// before the given time, and returns them.
+func (c ipams) reapExpiredFromBlock(blockCIDR cnet.IPNet, before time.Time) ([]cnet.IP, error) {
+	logContext := c.requestLog().WithField("blockCIDR", blockCIDR.String())
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return nil, err
+	}
+	deleteEmpty := !cfg.RetainEmptyBlocks
+	var lastErr error
+	retry := cfg.Retry.start()
+	for i := 0; i < retry.maxAttempts(); i++ {
+		if !c.blockReaderWriter.waitForRetry(retry, i, model.BlockKey{CIDR: blockCIDR}) {
+			break
+		}
+		obj, err := c.blockReaderWriter.getBlock(blockCIDR)
+		if err != nil {
+			if errors.IsNotExist(err) {
+				return nil, nil
+			}
+			logContext.WithError(err).Error("Error getting block")
+			return nil, err
+		}
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		expired := b.expiredIPs(before)
+		if len(expired) == 0 {
+			return nil, nil
+		}
+		_, handles, err := b.release(expired)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.blockReaderWriter.writeReleasedBlock(obj, deleteEmpty); err != nil {
+			if errors.IsRetryable(err) {
+				logContext.WithError(err).Info("Failed to update block - try again")
+				lastErr = err
+				continue
+			}
+			logContext.WithError(err).Error("Error updating block")
+			return nil, err
+		}
+
+		// Decrement the handles only once the block is written, as when
+		// releasing addresses.
+		for handleID, amount := range handles {
+			c.decrementHandle(handleID, blockCIDR, amount)
+		}
+		logContext.WithFields(log.Fields{"addresses": expired}).Warning("Freed addresses whose lease expired")
+		return expired, nil
+	}
+	return nil, maxRetriesError{Key: model.BlockKey{CIDR: blockCIDR}, Err: lastErr}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+var _ = Describe("Allocation leases", func() {
+	var backend *fakeBlockBackend
+	var ic *ipams
+	var start time.Time
+
+	assign := func(num int, handle string, ttl time.Duration) []cnet.IP {
+		ips, _, err := ic.AutoAssign(AutoAssignArgs{
+			Num4:     num,
+			Hostname: "host-a",
+			HandleID: &handle,
+			Attrs:    map[string]string{"handle": handle},
+			TTL:      ttl,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		return ips
+	}
+
+	reap := func(now time.Time, grace time.Duration) []string {
+		ips, err := ic.reapExpiredAllocations(now, grace)
+		Expect(err).NotTo(HaveOccurred())
+		reaped := []string{}
+		for _, ip := range ips {
+			reaped = append(reaped, ip.String())
+		}
+		return reaped
+	}
+
+	ipStrings := func(ips []cnet.IP) []string {
+		s := []string{}
+		for _, ip := range ips {
+			s = append(s, ip.String())
+		}
+		return s
+	}
+
+	handleExists := func(handle string) bool {
+		_, err := backend.Get(model.IPAMHandleKey{HandleID: handle})
+		if errors.IsNotExist(err) {
+			return false
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return true
+	}
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+		start = time.Now()
+	})
+
+	It("should free only the addresses whose lease has expired", func() {
+		short := assign(3, "handle-short", time.Minute)
+		long := assign(2, "handle-long", time.Hour)
+		forever := assign(2, "handle-forever", 0)
+
+		Expect(reap(start, 0)).To(BeEmpty())
+		Expect(reap(start.Add(2*time.Minute), 0)).To(ConsistOf(ipStrings(short)))
+		Expect(handleExists("handle-short")).To(BeFalse())
+
+		Expect(reap(start.Add(2*time.Hour), 0)).To(ConsistOf(ipStrings(long)))
+		Expect(handleExists("handle-long")).To(BeFalse())
+
+		// Addresses assigned without a lease never expire.
+		Expect(reap(start.Add(1000*time.Hour), 0)).To(BeEmpty())
+		ips, err := ic.IPsByHandle("handle-forever")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipStrings(ips)).To(ConsistOf(ipStrings(forever)))
+	})
+
+	It("should keep the attributes of addresses with a lease", func() {
+		ips := assign(1, "handle-a", time.Hour)
+		attrs, err := ic.GetAssignmentAttributes(ips[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(attrs).To(Equal(map[string]string{"handle": "handle-a"}))
+	})
+
+	It("should give an explicitly assigned address a lease", func() {
+		ip := cnet.MustParseIP("10.0.0.7")
+		Expect(ic.AssignIP(AssignIPArgs{IP: ip, Hostname: "host-a", TTL: time.Minute})).To(Succeed())
+		Expect(reap(start.Add(2*time.Minute), 0)).To(Equal([]string{"10.0.0.7"}))
+	})
+
+	It("should only free addresses once the grace period has passed", func() {
+		ips := assign(2, "handle-a", time.Minute)
+		Expect(reap(start.Add(5*time.Minute), 10*time.Minute)).To(BeEmpty())
+		Expect(reap(start.Add(12*time.Minute), 10*time.Minute)).To(ConsistOf(ipStrings(ips)))
+	})
+
+	It("should free nothing more when reaped again", func() {
+		ips := assign(2, "handle-a", time.Minute)
+		Expect(reap(start.Add(time.Hour), 0)).To(ConsistOf(ipStrings(ips)))
+		Expect(reap(start.Add(time.Hour), 0)).To(BeEmpty())
+	})
+
+	It("should not free an address assigned again without a lease", func() {
+		ips := assign(1, "handle-a", time.Minute)
+		Expect(ic.ReleaseIPs(ips)).To(BeEmpty())
+		Expect(ic.AssignIP(AssignIPArgs{IP: ips[0], Hostname: "host-a"})).To(Succeed())
+		Expect(reap(start.Add(time.Hour), 0)).To(BeEmpty())
+	})
+
+	It("should free expired addresses through the IPAM interface", func() {
+		var i IPAMInterface = ic
+		ips := assign(2, "handle-a", time.Nanosecond)
+		time.Sleep(time.Millisecond)
+
+		released, err := i.ReleaseExpiredAllocations(time.Hour)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(BeEmpty())
+		released, err = i.ReleaseExpiredAllocations(0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ipStrings(released)).To(ConsistOf(ipStrings(ips)))
+	})
+})
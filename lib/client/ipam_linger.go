@@ -0,0 +1,82 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"strings"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// ReleaseLingeringBlocks releases the affinity of every empty block whose
+// EmptyBlockLinger has expired.  This may be run periodically, and
+// concurrently with assignment.
+func (c ipams) ReleaseLingeringBlocks() ([]cnet.IPNet, error) {
+	return c.reapLingeringBlocks(time.Now())
+}
+
+// reapLingeringBlocks releases the host affinity of each empty block whose
+// EmptyBlockLinger has expired by now, deleting the block unless empty blocks
+// are retained, as releaseEmptyBlockAffinity does.  Only blocks which record
+// when they were emptied are released, and reserved and shared blocks are
+// never released.  Returns the blocks released.
+//
+// Each block is checked again when its affinity is released, so a block
+// assigned from since the blocks were listed keeps its affinity.
+func (c ipams) reapLingeringBlocks(now time.Time) ([]cnet.IPNet, error) {
+	c = c.withRequestID("")
+	c, err := c.withIPAMConfig()
+	if err != nil {
+		return nil, err
+	}
+	objs, err := c.blockReaderWriter.listAll(model.BlockListOptions{}, ipamListPageSize)
+	if errors.IsPartialList(err) {
+		c.requestLog().WithError(err).Warning("Some blocks could not be read, reaping the others")
+	} else if err != nil && !errors.IsNotExist(err) {
+		c.requestLog().WithError(err).Error("Error listing blocks")
+		return nil, err
+	}
+
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return nil, err
+	}
+	linger := cfg.EmptyBlockLinger
+	released := []cnet.IPNet{}
+	for _, obj := range objs {
+		b := allocationBlock{obj.Value.(*model.AllocationBlock)}
+		if b.Affinity == nil || !strings.HasPrefix(*b.Affinity, "host:") || b.Reserved || b.Shared {
+			continue
+		}
+		if !b.empty() || b.EmptySince == nil || b.lingering(now, linger) {
+			continue
+		}
+		host := strings.TrimPrefix(*b.Affinity, "host:")
+		err := c.blockReaderWriter.releaseAffinity(host, b.CIDR, true, now)
+		switch err.(type) {
+		case nil:
+			released = append(released, b.CIDR)
+		case blockNotEmptyError, blockLingeringError:
+			c.requestLog().WithError(err).Debug("Block was assigned from since it was listed")
+		default:
+			return released, err
+		}
+	}
+	c.requestLog().WithField("blocks", len(released)).Info("Reaped lingering empty blocks")
+	return released, nil
+}
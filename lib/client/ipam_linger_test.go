@@ -0,0 +1,120 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+var _ = Describe("Empty block linger", func() {
+	handle := "handle-a"
+	linger := time.Minute
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+	var block cnet.IPNet
+
+	assign := func() cnet.IPNet {
+		v4, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, Hostname: "host-a", HandleID: &handle})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v4).To(HaveLen(1))
+		blocks, err := ic.blockReaderWriter.getAffineBlocks("host-a", ipv4, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(blocks).To(HaveLen(1))
+		return blocks[0]
+	}
+
+	getBlock := func() *model.AllocationBlock {
+		obj, err := backend.Get(model.BlockKey{CIDR: block})
+		if errors.IsNotExist(err) {
+			return nil
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return obj.Value.(*model.AllocationBlock)
+	}
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+		Expect(ic.SetIPAMConfig(IPAMConfig{AutoAllocateBlocks: true, EmptyBlockLinger: linger})).To(Succeed())
+
+		// The host's workload releases its only address.
+		block = assign()
+		Expect(getBlock().EmptySince).To(BeNil())
+		Expect(ic.ReleaseByHandle(handle)).To(Succeed())
+		Expect(getBlock().EmptySince).NotTo(BeNil())
+	})
+
+	It("should keep and reuse the block within the linger", func() {
+		err := ic.blockReaderWriter.releaseEmptyBlockAffinity("host-a", block)
+		Expect(err).To(BeAssignableToTypeOf(blockLingeringError{}))
+		Expect(err.(blockLingeringError).Until).To(Equal(getBlock().EmptySince.Add(linger)))
+
+		released, err := ic.reapLingeringBlocks(time.Now().Add(linger / 2))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(BeEmpty())
+
+		// The restarted workload is assigned from the same block, which
+		// no longer lingers once it is in use.
+		Expect(assign()).To(Equal(block))
+		Expect(getBlock().EmptySince).To(BeNil())
+		released, err = ic.reapLingeringBlocks(time.Now().Add(2 * linger))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(BeEmpty())
+	})
+
+	It("should release and delete the block once the linger has expired", func() {
+		released, err := ic.reapLingeringBlocks(time.Now().Add(2 * linger))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(Equal([]cnet.IPNet{block}))
+
+		Expect(getBlock()).To(BeNil())
+		_, err = backend.Get(model.BlockAffinityKey{Host: "host-a", CIDR: block})
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should release the block through the IPAM interface once the linger has expired", func() {
+		var i IPAMInterface = ic
+		released, err := i.ReleaseLingeringBlocks()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(BeEmpty())
+		Expect(getBlock()).NotTo(BeNil())
+
+		// Without a linger, the block has expired.
+		Expect(ic.SetIPAMConfig(IPAMConfig{AutoAllocateBlocks: true})).To(Succeed())
+		released, err = i.ReleaseLingeringBlocks()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(released).To(Equal([]cnet.IPNet{block}))
+		Expect(getBlock()).To(BeNil())
+	})
+
+	It("should release the block at once without a linger", func() {
+		Expect(ic.SetIPAMConfig(IPAMConfig{AutoAllocateBlocks: true})).To(Succeed())
+		Expect(ic.blockReaderWriter.releaseEmptyBlockAffinity("host-a", block)).To(Succeed())
+		Expect(getBlock()).To(BeNil())
+	})
+
+	It("should reject a negative linger", func() {
+		Expect(ic.SetIPAMConfig(IPAMConfig{AutoAllocateBlocks: true, EmptyBlockLinger: -time.Second})).NotTo(Succeed())
+	})
+})
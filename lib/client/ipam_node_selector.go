@@ -0,0 +1,95 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/libcalico-go/lib/api"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+	"github.com/projectcalico/libcalico-go/lib/selector"
+)
+
+// NodeLabelsFunc returns the labels of the given host, for example the labels
+// of the host's Kubernetes node.
+type NodeLabelsFunc func(host string) (map[string]string, error)
+
+// poolSelectsNode returns whether the pool's node selector matches the given
+// node labels, meaning that the node may claim blocks from the pool.  A pool
+// without a node selector selects every node.
+func poolSelectsNode(pool api.IPPool, labels map[string]string) (bool, error) {
+	if pool.Spec.NodeSelector == "" {
+		return true, nil
+	}
+	sel, err := selector.Parse(pool.Spec.NodeSelector)
+	if err != nil {
+		return false, fmt.Errorf("IP pool %s has an invalid node selector %q: %v", pool.Metadata.CIDR, pool.Spec.NodeSelector, err)
+	}
+	return sel.Evaluate(labels), nil
+}
+
+// poolsSelectingHost filters the given pool CIDRs, returning those whose pool
+// in pools selects the host.  The host's labels are only looked up if one of
+// the pools has a node selector.
+func (rw blockReaderWriter) poolsSelectingHost(cidrs []cnet.IPNet, pools []api.IPPool, host string) ([]cnet.IPNet, error) {
+	pm := map[string]api.IPPool{}
+	for _, p := range pools {
+		pm[p.Metadata.CIDR.String()] = p
+	}
+
+	var labels map[string]string
+	looked := false
+	selected := []cnet.IPNet{}
+	for _, cidr := range cidrs {
+		p := pm[cidr.String()]
+		if p.Spec.NodeSelector != "" && !looked {
+			var err error
+			labels, err = rw.nodeLabels(host)
+			if err != nil {
+				return nil, err
+			}
+			looked = true
+		}
+		ok, err := poolSelectsNode(p, labels)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			rw.requestLog().WithFields(log.Fields{
+				"host":     host,
+				"cidr":     cidr.String(),
+				"selector": p.Spec.NodeSelector,
+			}).Debug("Pool does not select host")
+			continue
+		}
+		selected = append(selected, cidr)
+	}
+	return selected, nil
+}
+
+// nodeLabels returns the labels of the host using the client's NodeLabels
+// function, or no labels if none is set.
+func (rw blockReaderWriter) nodeLabels(host string) (map[string]string, error) {
+	if rw.client.NodeLabels == nil {
+		return map[string]string{}, nil
+	}
+	labels, err := rw.client.NodeLabels(host)
+	if err != nil {
+		rw.requestLog().WithField("host", host).WithError(err).Error("Error looking up node labels")
+		return nil, err
+	}
+	return labels, nil
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	goerrors "errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// storePoolWithNodeSelector stores an enabled IP pool with the given node
+// selector in the backend.
+func (f *fakeBlockBackend) storePoolWithNodeSelector(cidr string, nodeSelector string) {
+	pool := cnet.MustParseNetwork(cidr)
+	f.store(&model.KVPair{
+		Key:   model.IPPoolKey{CIDR: pool},
+		Value: &model.IPPool{CIDR: pool, IPAM: true, NodeSelector: nodeSelector},
+	})
+}
+
+var _ = DescribeTable("poolSelectsNode",
+	func(nodeSelector string, labels map[string]string, expected bool) {
+		pool := api.IPPool{
+			Metadata: api.IPPoolMetadata{CIDR: cnet.MustParseNetwork("10.0.0.0/24")},
+			Spec:     api.IPPoolSpec{NodeSelector: nodeSelector},
+		}
+		selected, err := poolSelectsNode(pool, labels)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(selected).To(Equal(expected))
+	},
+	Entry("no selector", "", map[string]string{}, true),
+	Entry("no selector and nil labels", "", nil, true),
+	Entry("equality", `zone == "a"`, map[string]string{"zone": "a"}, true),
+	Entry("equality not matching", `zone == "a"`, map[string]string{"zone": "b"}, false),
+	Entry("set membership", `zone in {"a", "b"}`, map[string]string{"zone": "b"}, true),
+	Entry("set membership not matching", `zone in {"a", "b"}`, map[string]string{"zone": "c"}, false),
+	Entry("existence", `has(gpu)`, map[string]string{"gpu": ""}, true),
+	Entry("existence not matching", `has(gpu)`, map[string]string{}, false),
+	Entry("non-existence", `!has(gpu)`, nil, true),
+	Entry("conjunction", `zone == "a" && has(gpu)`, map[string]string{"zone": "a"}, false),
+)
+
+var _ = Describe("IP pool node selectors", func() {
+	poolA := cnet.MustParseNetwork("10.0.0.0/24")
+	poolB := cnet.MustParseNetwork("10.0.1.0/24")
+
+	var backend *fakeBlockBackend
+	var client *Client
+	var rw blockReaderWriter
+	var lookups int
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		lookups = 0
+		client = &Client{
+			Backend: backend,
+			NodeLabels: func(host string) (map[string]string, error) {
+				lookups++
+				if host == "host-gpu" {
+					return map[string]string{"gpu": "true"}, nil
+				}
+				return map[string]string{}, nil
+			},
+		}
+		rw = blockReaderWriter{client: client}
+	})
+
+	It("should report an invalid selector", func() {
+		pool := api.IPPool{Spec: api.IPPoolSpec{NodeSelector: "gpu =="}}
+		_, err := poolSelectsNode(pool, nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should only claim blocks from pools which select the host", func() {
+		backend.storePoolWithNodeSelector("10.0.0.0/24", "has(gpu)")
+		backend.storePool("10.0.1.0/24", false)
+
+		b, err := rw.claimNewAffineBlock("host-gpu", "", ipv4, nil, &IPAMConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(poolA.Contains(b.IP)).To(BeTrue())
+
+		b, err = rw.claimNewAffineBlock("host-a", "", ipv4, nil, &IPAMConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(poolB.Contains(b.IP)).To(BeTrue())
+	})
+
+	It("should fail to claim a block when no pool selects the host", func() {
+		backend.storePoolWithNodeSelector("10.0.0.0/24", "has(gpu)")
+		_, err := rw.claimNewAffineBlock("host-a", "", ipv4, nil, &IPAMConfig{})
+		Expect(err).To(MatchError("No configured Calico pools select host 'host-a'"))
+	})
+
+	It("should treat a host as having no labels when there is no NodeLabels function", func() {
+		client.NodeLabels = nil
+		backend.storePoolWithNodeSelector("10.0.0.0/24", "has(gpu)")
+		backend.storePoolWithNodeSelector("10.0.1.0/24", "!has(gpu)")
+		b, err := rw.claimNewAffineBlock("host-gpu", "", ipv4, nil, &IPAMConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(poolB.Contains(b.IP)).To(BeTrue())
+	})
+
+	It("should only look up the host's labels when a pool has a selector", func() {
+		backend.storePool("10.0.0.0/24", false)
+		_, err := rw.claimNewAffineBlock("host-a", "", ipv4, nil, &IPAMConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lookups).To(Equal(0))
+
+		backend.storePoolWithNodeSelector("10.0.1.0/24", "has(gpu)")
+		backend.storePoolWithNodeSelector("10.0.2.0/24", "has(gpu)")
+		_, err = rw.claimNewAffineBlock("host-a", "", ipv4, nil, &IPAMConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lookups).To(Equal(1))
+	})
+
+	It("should return the error from looking up the host's labels", func() {
+		client.NodeLabels = func(host string) (map[string]string, error) {
+			return nil, goerrors.New("node not found")
+		}
+		backend.storePoolWithNodeSelector("10.0.0.0/24", "has(gpu)")
+		_, err := rw.claimNewAffineBlock("host-a", "", ipv4, nil, &IPAMConfig{})
+		Expect(err).To(MatchError("node not found"))
+	})
+
+	It("should report pools which don't select the host as full", func() {
+		backend.storePoolWithNodeSelector("10.0.0.0/24", "has(gpu)")
+		backend.storePool("10.0.1.0/24", false)
+		full, err := rw.fullPoolsForHost("host-a", ipv4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(full).To(ConsistOf(cnet.MustParseNetwork("10.0.0.0/24")))
+		full, err = rw.fullPoolsForHost("host-gpu", ipv4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(full).To(BeEmpty())
+	})
+})
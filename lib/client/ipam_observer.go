@@ -0,0 +1,102 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// IPAMObserver is notified of key IPAM events, for example so that they can
+// be recorded as metrics.  An observer is set on the Client, and is called
+// synchronously from the IPAM operation, so it should return quickly.
+// Implementations should embed NoopIPAMObserver so that they continue to
+// compile if methods are added to this interface.
+type IPAMObserver interface {
+	// BlockClaimed is called when the host claims affinity for a block.
+	BlockClaimed(host string, cidr net.IPNet)
+
+	// BlockReleased is called when the affinity of a block is released,
+	// whether or not the block itself is deleted.  The host is the host
+	// that the block was affine to.
+	BlockReleased(host string, cidr net.IPNet)
+
+	// AssignSucceeded is called when num addresses of the given IP
+	// version are assigned to the host.
+	AssignSucceeded(host string, version int, num int)
+
+	// AssignFailed is called when fewer than the requested num addresses
+	// of the given IP version could be assigned to the host.
+	AssignFailed(host string, version int, num int, err error)
+
+	// UpdateRetried is called before an update of the object with the
+	// given key is retried, after an earlier attempt conflicted with
+	// another client.  The attempt is the number of the attempt about to
+	// be made, starting at 1 for the first retry.
+	UpdateRetried(key model.Key, attempt int)
+}
+
+// NoopIPAMObserver is an IPAMObserver which ignores all events.
+type NoopIPAMObserver struct{}
+
+func (NoopIPAMObserver) BlockClaimed(host string, cidr net.IPNet)                  {}
+func (NoopIPAMObserver) BlockReleased(host string, cidr net.IPNet)                 {}
+func (NoopIPAMObserver) AssignSucceeded(host string, version int, num int)         {}
+func (NoopIPAMObserver) AssignFailed(host string, version int, num int, err error) {}
+func (NoopIPAMObserver) UpdateRetried(key model.Key, attempt int)                  {}
+
+// observer returns the client's IPAMObserver, or a NoopIPAMObserver if none
+// is set.
+func (rw blockReaderWriter) observer() IPAMObserver {
+	if rw.client.IPAMObserver != nil {
+		return rw.client.IPAMObserver
+	}
+	return NoopIPAMObserver{}
+}
+
+// observeAssign notifies the observer of the outcome of assigning num
+// addresses of the given IP version to the host.
+func (rw blockReaderWriter) observeAssign(host string, version ipVersion, num int, ips []net.IP, err error) {
+	if err == nil && len(ips) >= num {
+		rw.observer().AssignSucceeded(host, version.Number, len(ips))
+		return
+	}
+	if err == nil {
+		err = noFreeBlocksError(fmt.Sprintf("Assigned %d of %d IPv%d addresses", len(ips), num, version.Number))
+	}
+	rw.observer().AssignFailed(host, version.Number, num, err)
+}
+
+// waitForRetry sleeps for the backoff before the given attempt at updating
+// the object with the given key, and logs and notifies the observer of
+// retries.  Returns false if the retry timeout leaves no time for the
+// attempt, in which case the update should give up.
+func (rw blockReaderWriter) waitForRetry(retry RetryConfig, attempt int, key model.Key) bool {
+	logContext := rw.requestLog().WithFields(log.Fields{
+		"key":     key.String(),
+		"attempt": attempt,
+	})
+	if !retry.wait(attempt, logContext) {
+		return false
+	}
+	if attempt > 0 {
+		logContext.Debug("Retrying update")
+		rw.observer().UpdateRetried(key, attempt)
+	}
+	return true
+}
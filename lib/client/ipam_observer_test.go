@@ -0,0 +1,121 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// recordingObserver is an IPAMObserver which records the events it sees.
+type recordingObserver struct {
+	NoopIPAMObserver
+	events []string
+	errs   []error
+}
+
+func (r *recordingObserver) BlockClaimed(host string, cidr cnet.IPNet) {
+	r.events = append(r.events, fmt.Sprintf("claimed %s %s", host, cidr))
+}
+
+func (r *recordingObserver) BlockReleased(host string, cidr cnet.IPNet) {
+	r.events = append(r.events, fmt.Sprintf("released %s %s", host, cidr))
+}
+
+func (r *recordingObserver) AssignSucceeded(host string, version int, num int) {
+	r.events = append(r.events, fmt.Sprintf("assigned %s v%d %d", host, version, num))
+}
+
+func (r *recordingObserver) AssignFailed(host string, version int, num int, err error) {
+	r.events = append(r.events, fmt.Sprintf("failed %s v%d %d", host, version, num))
+	r.errs = append(r.errs, err)
+}
+
+func (r *recordingObserver) UpdateRetried(key model.Key, attempt int) {
+	r.events = append(r.events, fmt.Sprintf("retried %s %d", key, attempt))
+}
+
+var _ = Describe("IPAMObserver", func() {
+	subnet := cnet.MustParseNetwork("10.0.0.0/26")
+
+	var backend *fakeBlockBackend
+	var observer *recordingObserver
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		observer = &recordingObserver{}
+		rw = blockReaderWriter{client: &Client{Backend: backend, IPAMObserver: observer}}
+	})
+
+	It("should default to a no-op observer", func() {
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+		Expect(rw.observer()).To(Equal(NoopIPAMObserver{}))
+		Expect(rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+	})
+
+	It("should report claimed and released blocks", func() {
+		Expect(rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+		Expect(rw.releaseBlockAffinity("host-a", subnet)).To(Succeed())
+		Expect(observer.events).To(Equal([]string{
+			"claimed host-a 10.0.0.0/26",
+			"released host-a 10.0.0.0/26",
+		}))
+	})
+
+	It("should not report a block claimed by another host", func() {
+		Expect(rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+		err := rw.claimBlockAffinity(subnet, "host-b", IPAMConfig{})
+		Expect(err).To(BeAssignableToTypeOf(affinityClaimedError{}))
+		Expect(observer.events).To(Equal([]string{"claimed host-a 10.0.0.0/26"}))
+	})
+
+	It("should report each retry of a conflicting update", func() {
+		conflicting := &conflictingBackend{fakeBlockBackend: backend}
+		rw = blockReaderWriter{client: &Client{Backend: conflicting, IPAMObserver: observer}}
+		backend.store(&model.KVPair{
+			Key:   model.IPAMConfigKey{},
+			Value: &model.IPAMConfig{AutoAllocateBlocks: true, RetryMaxAttempts: 3},
+		})
+		key := model.BlockKey{CIDR: subnet}
+		backend.store(&model.KVPair{Key: key, Value: newBlock(subnet).AllocationBlock})
+
+		err := rw.updateWithRetry(key, func(obj *model.KVPair) error { return nil })
+		Expect(err).To(BeAssignableToTypeOf(maxRetriesError{}))
+		Expect(observer.events).To(Equal([]string{
+			fmt.Sprintf("retried %s 1", key),
+			fmt.Sprintf("retried %s 2", key),
+		}))
+	})
+
+	It("should report assignment outcomes", func() {
+		ips := []cnet.IP{cnet.MustParseIP("10.0.0.1"), cnet.MustParseIP("10.0.0.2")}
+		rw.observeAssign("host-a", ipv4, 2, ips, nil)
+		rw.observeAssign("host-a", ipv4, 3, ips, nil)
+		rw.observeAssign("host-a", ipv6, 1, nil, notAssignedError{})
+		Expect(observer.events).To(Equal([]string{
+			"assigned host-a v4 2",
+			"failed host-a v4 3",
+			"failed host-a v6 1",
+		}))
+		Expect(observer.errs[0]).To(BeAssignableToTypeOf(noFreeBlocksError("")))
+		Expect(observer.errs[1]).To(Equal(notAssignedError{}))
+	})
+})
@@ -0,0 +1,218 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	goerrors "errors"
+	"fmt"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/fake"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+var _ = Describe("forEachConcurrently", func() {
+	It("should process every item once, with at most the given number at once", func() {
+		var lock sync.Mutex
+		calls := map[int]int{}
+		inFlight, maxInFlight := 0, 0
+		errs := forEachConcurrently(50, 4, func(i int) error {
+			lock.Lock()
+			calls[i]++
+			inFlight++
+			if inFlight > maxInFlight {
+				maxInFlight = inFlight
+			}
+			lock.Unlock()
+
+			defer func() {
+				lock.Lock()
+				inFlight--
+				lock.Unlock()
+			}()
+			if i%10 == 3 {
+				return fmt.Errorf("item %d failed", i)
+			}
+			return nil
+		})
+
+		Expect(calls).To(HaveLen(50))
+		for i := 0; i < 50; i++ {
+			Expect(calls[i]).To(Equal(1))
+		}
+		Expect(maxInFlight).To(BeNumerically("<=", 4))
+		Expect(errs).To(HaveLen(50))
+		for i, err := range errs {
+			if i%10 == 3 {
+				Expect(err).To(MatchError(fmt.Sprintf("item %d failed", i)))
+			} else {
+				Expect(err).NotTo(HaveOccurred())
+			}
+		}
+	})
+
+	It("should process the items in turn with fewer than one worker", func() {
+		order := []int{}
+		forEachConcurrently(3, 0, func(i int) error {
+			order = append(order, i)
+			return nil
+		})
+		Expect(order).To(Equal([]int{0, 1, 2}))
+	})
+
+	It("should do nothing with no items", func() {
+		Expect(forEachConcurrently(0, 4, func(i int) error {
+			return goerrors.New("unexpected call")
+		})).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Bulk IPAM operations", func() {
+	pool := cnet.MustParseNetwork("10.0.0.0/22")
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	// setup stores a pool of 16 blocks and configures the given bulk
+	// concurrency.
+	setup := func(workers int) {
+		backend = newFakeBlockBackend()
+		backend.storePool(pool.String(), false)
+		_, err := backend.Create(&model.KVPair{
+			Key: model.IPAMConfigKey{},
+			Value: &model.IPAMConfig{
+				AutoAllocateBlocks:    true,
+				DestructiveOpsAllowed: true,
+				BulkConcurrency:       workers,
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		ic = newIPAM(&Client{Backend: backend})
+	}
+
+	blockCIDRs := func() []cnet.IPNet {
+		cidrs := []cnet.IPNet{}
+		blocks := blockGenerator(pool, 26)
+		for b := blocks(); b != nil; b = blocks() {
+			cidrs = append(cidrs, *b)
+		}
+		return cidrs
+	}
+
+	table.DescribeTable("should claim every block in order regardless of concurrency",
+		func(workers int) {
+			setup(workers)
+			taken := cnet.MustParseNetwork("10.0.1.64/26")
+			_, _, err := ic.ClaimAffinity(taken, "host-b")
+			Expect(err).NotTo(HaveOccurred())
+
+			claimed, failed, err := ic.ClaimAffinity(pool, "host-a")
+			Expect(err).NotTo(HaveOccurred())
+			expected := []cnet.IPNet{}
+			for _, cidr := range blockCIDRs() {
+				if cidr.String() != taken.String() {
+					expected = append(expected, cidr)
+				}
+			}
+			Expect(claimed).To(Equal(expected))
+			Expect(failed).To(Equal([]cnet.IPNet{taken}))
+		},
+		table.Entry("with one worker", 1),
+		table.Entry("with four workers", 4),
+		table.Entry("with more workers than blocks", 32),
+	)
+
+	table.DescribeTable("should drain every block regardless of concurrency",
+		func(workers int) {
+			setup(workers)
+
+			// Each handle has addresses in several blocks, so the
+			// workers draining those blocks update it concurrently, and
+			// its first updates fail with a conflict and are retried.
+			claimed, _, err := ic.ClaimAffinity(pool, "host-a")
+			Expect(err).NotTo(HaveOccurred())
+			for i, cidr := range claimed {
+				handle := fmt.Sprintf("handle-%d", i%3)
+				_, err := ic.assignFromAffineBlock(cidr, 2, &handle, nil, "host-a")
+				Expect(err).NotTo(HaveOccurred())
+			}
+			for i := 0; i < 3; i++ {
+				key := model.IPAMHandleKey{HandleID: fmt.Sprintf("handle-%d", i)}
+				backend.InjectError(fake.OperationUpdate, key, errors.ErrorResourceUpdateConflict{Identifier: key}, 2)
+			}
+
+			result, err := ic.DrainPool(pool, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Blocks).To(HaveLen(16))
+			Expect(result.NumAllocated).To(Equal(32))
+			for i := 0; i < 3; i++ {
+				_, err := backend.Get(model.IPAMHandleKey{HandleID: fmt.Sprintf("handle-%d", i)})
+				Expect(err).To(HaveOccurred())
+			}
+			blocks, err := backend.List(model.BlockListOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(blocks).To(BeEmpty())
+		},
+		table.Entry("with one worker", 1),
+		table.Entry("with four workers", 4),
+		table.Entry("with more workers than blocks", 32),
+	)
+
+	table.DescribeTable("should repair every block's affinity regardless of concurrency",
+		func(workers int) {
+			setup(workers)
+			claimed, _, err := ic.ClaimAffinity(pool, "host-a")
+			Expect(err).NotTo(HaveOccurred())
+			for _, cidr := range claimed {
+				_, err := ic.assignFromAffineBlock(cidr, 1, nil, nil, "host-a")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(backend.Delete(&model.KVPair{Key: model.BlockAffinityKey{Host: "host-a", CIDR: cidr}})).To(Succeed())
+			}
+
+			report, err := ic.blockReaderWriter.checkBlockConsistency(true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.OrphanedBlocks).To(HaveLen(16))
+			report, err = ic.blockReaderWriter.checkBlockConsistency(false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(report.Consistent()).To(BeTrue())
+		},
+		table.Entry("with one worker", 1),
+		table.Entry("with four workers", 4),
+		table.Entry("with more workers than blocks", 32),
+	)
+
+	It("should claim the other blocks when some claims fail", func() {
+		setup(4)
+		cidrs := blockCIDRs()
+		for _, cidr := range cidrs[:2] {
+			key := model.BlockKey{CIDR: cidr}
+			backend.InjectError(fake.OperationCreate, key, errors.ErrorDatastoreError{Err: goerrors.New("injected failure"), Identifier: key}, 0)
+		}
+
+		claimed, failed, err := ic.ClaimAffinity(pool, "host-a")
+		Expect(err).To(BeAssignableToTypeOf(bulkError{}))
+		Expect(err.(bulkError).Errs).To(HaveLen(2))
+		Expect(err.(bulkError).Errs).To(HaveKey(cidrs[0].String()))
+		Expect(err.(bulkError).Errs).To(HaveKey(cidrs[1].String()))
+		Expect(claimed).To(Equal(cidrs[2:]))
+		Expect(failed).To(BeEmpty())
+	})
+})
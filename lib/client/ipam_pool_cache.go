@@ -0,0 +1,117 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/projectcalico/libcalico-go/lib/api"
+)
+
+// defaultIPPoolCacheTTL is how long a list of IP pools is cached for by a
+// Client created with New.
+const defaultIPPoolCacheTTL = 2 * time.Second
+
+// ipPoolCache caches the list of all IP pools for a short time, so that the
+// several IPAM checks made while assigning an address do not each read the
+// pools from the datastore.  The cache is invalidated whenever a pool is
+// written through the client, and otherwise entries expire after the TTL, so
+// changes made by other clients are seen within the TTL.  It is safe for
+// concurrent use.  A nil *ipPoolCache caches nothing.
+type ipPoolCache struct {
+	ttl time.Duration
+
+	lock sync.Mutex
+	// generation is incremented on every invalidation, so that a list
+	// which was read before the invalidation is not cached after it.
+	generation uint64
+	pools      *api.IPPoolList
+	expires    time.Time
+}
+
+func newIPPoolCache(ttl time.Duration) *ipPoolCache {
+	return &ipPoolCache{ttl: ttl}
+}
+
+// list returns the cached list of IP pools if it has not expired.
+// Otherwise, it lists the pools with the given function and caches the
+// result.  The returned list must not be modified.
+func (c *ipPoolCache) list(listFn func() (*api.IPPoolList, error)) (*api.IPPoolList, error) {
+	if c == nil {
+		return listFn()
+	}
+
+	c.lock.Lock()
+	ttl := c.ttl
+	if ttl > 0 && c.pools != nil && time.Now().Before(c.expires) {
+		pools := c.pools
+		c.lock.Unlock()
+		return pools, nil
+	}
+	generation := c.generation
+	c.lock.Unlock()
+	if ttl <= 0 {
+		return listFn()
+	}
+
+	// Don't hold the lock while reading from the datastore.
+	expires := time.Now().Add(ttl)
+	pools, err := listFn()
+	if err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	if c.generation == generation {
+		c.pools = pools
+		c.expires = expires
+	}
+	c.lock.Unlock()
+	return pools, nil
+}
+
+// refresh discards the cached list of IP pools and lists them again with the
+// given function, caching the result.  If the list fails, the cache is left
+// empty.
+func (c *ipPoolCache) refresh(listFn func() (*api.IPPoolList, error)) error {
+	if c == nil {
+		return nil
+	}
+	c.invalidate()
+	_, err := c.list(listFn)
+	return err
+}
+
+// invalidate discards the cached list of IP pools.
+func (c *ipPoolCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	c.generation++
+	c.pools = nil
+	c.lock.Unlock()
+}
+
+// setTTL sets how long a list of IP pools is cached for, and discards the
+// cached list.  A TTL of 0 disables caching.
+func (c *ipPoolCache) setTTL(ttl time.Duration) {
+	c.lock.Lock()
+	c.ttl = ttl
+	c.generation++
+	c.pools = nil
+	c.lock.Unlock()
+}
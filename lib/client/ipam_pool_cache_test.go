@@ -0,0 +1,234 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	goerrors "errors"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+var _ = Describe("ipPoolCache", func() {
+	var lists int
+	listFn := func() (*api.IPPoolList, error) {
+		lists++
+		return api.NewIPPoolList(), nil
+	}
+
+	BeforeEach(func() {
+		lists = 0
+	})
+
+	It("should not cache when nil", func() {
+		var c *ipPoolCache
+		c.list(listFn)
+		c.list(listFn)
+		c.invalidate()
+		Expect(lists).To(Equal(2))
+	})
+
+	It("should cache the list until it expires", func() {
+		c := newIPPoolCache(50 * time.Millisecond)
+		first, err := c.list(listFn)
+		Expect(err).NotTo(HaveOccurred())
+		second, err := c.list(listFn)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(second).To(BeIdenticalTo(first))
+		Expect(lists).To(Equal(1))
+
+		time.Sleep(60 * time.Millisecond)
+		c.list(listFn)
+		Expect(lists).To(Equal(2))
+	})
+
+	It("should list again once invalidated", func() {
+		c := newIPPoolCache(time.Minute)
+		c.list(listFn)
+		c.invalidate()
+		c.list(listFn)
+		Expect(lists).To(Equal(2))
+	})
+
+	It("should not cache a list read before an invalidation", func() {
+		c := newIPPoolCache(time.Minute)
+		c.list(func() (*api.IPPoolList, error) {
+			// Simulate a pool being written while the list is read.
+			c.invalidate()
+			return listFn()
+		})
+		c.list(listFn)
+		Expect(lists).To(Equal(2))
+	})
+
+	It("should not cache errors", func() {
+		c := newIPPoolCache(time.Minute)
+		_, err := c.list(func() (*api.IPPoolList, error) {
+			return nil, goerrors.New("datastore unavailable")
+		})
+		Expect(err).To(HaveOccurred())
+		c.list(listFn)
+		Expect(lists).To(Equal(1))
+	})
+
+	It("should not cache when the TTL is 0", func() {
+		c := newIPPoolCache(time.Minute)
+		c.list(listFn)
+		c.setTTL(0)
+		c.list(listFn)
+		c.list(listFn)
+		Expect(lists).To(Equal(3))
+	})
+
+	It("should be safe for concurrent use", func() {
+		c := newIPPoolCache(time.Millisecond)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					pools, err := c.list(func() (*api.IPPoolList, error) {
+						return api.NewIPPoolList(), nil
+					})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(pools).NotTo(BeNil())
+					if j%10 == 0 {
+						c.invalidate()
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	})
+})
+
+var _ = Describe("Client IP pool cache", func() {
+	It("should serve IPAM pool lists from the cache once enabled", func() {
+		backend := newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		client := &Client{Backend: backend}
+		rw := blockReaderWriter{client: client}
+
+		// A client which was not created by New does not cache.
+		backend.storePool("10.0.1.0/24", false)
+		pools, err := rw.listPools()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pools.Items).To(HaveLen(2))
+
+		client.SetIPPoolCacheTTL(time.Minute)
+		pools, err = rw.listPools()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pools.Items).To(HaveLen(2))
+
+		// Pools written directly to the backend are not seen until the
+		// cache is invalidated.
+		backend.storePool("10.0.2.0/24", false)
+		pools, err = rw.listPools()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pools.Items).To(HaveLen(2))
+
+		client.ipPoolCache.invalidate()
+		pools, err = rw.listPools()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pools.Items).To(HaveLen(3))
+	})
+})
+
+// poolListingBackend is a fakeBlockBackend which counts the lists of IP
+// pools, and fails them while err is set.
+type poolListingBackend struct {
+	*fakeBlockBackend
+	lock  sync.Mutex
+	lists int
+	err   error
+}
+
+func (b *poolListingBackend) List(l model.ListInterface) ([]*model.KVPair, error) {
+	if _, ok := l.(model.IPPoolListOptions); ok {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.lists++
+		if b.err != nil {
+			return nil, b.err
+		}
+	}
+	return b.fakeBlockBackend.List(l)
+}
+
+func (b *poolListingBackend) numLists() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.lists
+}
+
+var _ = Describe("IP pool cache pre-warming", func() {
+	var backend *poolListingBackend
+	var client *Client
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend = &poolListingBackend{fakeBlockBackend: newFakeBlockBackend()}
+		backend.storePool("10.0.0.0/24", false)
+		client = &Client{Backend: backend}
+		client.SetIPPoolCacheTTL(time.Minute)
+		rw = blockReaderWriter{client: client}
+	})
+
+	It("should load the pools in the background", func() {
+		client.PrewarmIPPoolCache()
+		Eventually(backend.numLists).Should(Equal(1))
+
+		pools, err := rw.listPools()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pools.Items).To(HaveLen(1))
+		Expect(backend.numLists()).To(Equal(1))
+	})
+
+	It("should leave the cache cold if the pools cannot be read", func() {
+		backend.err = goerrors.New("datastore unavailable")
+		client.PrewarmIPPoolCache()
+		Eventually(backend.numLists).Should(Equal(1))
+
+		backend.lock.Lock()
+		backend.err = nil
+		backend.lock.Unlock()
+		pools, err := rw.listPools()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pools.Items).To(HaveLen(1))
+		Expect(backend.numLists()).To(Equal(2))
+	})
+
+	It("should replace the cached pools when refreshed", func() {
+		_, err := rw.listPools()
+		Expect(err).NotTo(HaveOccurred())
+		backend.storePool("10.0.1.0/24", false)
+
+		Expect(client.RefreshIPPoolCache()).To(Succeed())
+		pools, err := rw.listPools()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pools.Items).To(HaveLen(2))
+		Expect(backend.numLists()).To(Equal(2))
+
+		backend.err = goerrors.New("datastore unavailable")
+		Expect(client.RefreshIPPoolCache()).To(MatchError("datastore unavailable"))
+	})
+})
@@ -0,0 +1,290 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// PoolState is the complete IPAM state of an IP pool: its blocks, with their
+// allocations and attributes, the block affinities, and the handles with
+// addresses assigned from the pool.  It can be serialized, so that the state
+// can be exported from one datastore and imported into another.  The pool
+// itself is not included, and must be created separately.
+type PoolState struct {
+	Pool       cnet.IPNet              `json:"pool"`
+	Blocks     []model.AllocationBlock `json:"blocks"`
+	Affinities []PoolStateAffinity     `json:"affinities"`
+	Handles    []PoolStateHandle       `json:"handles"`
+}
+
+// PoolStateAffinity is a host's affinity for a block in a PoolState.
+type PoolStateAffinity struct {
+	Host string     `json:"host"`
+	CIDR cnet.IPNet `json:"cidr"`
+}
+
+// PoolStateHandle is a handle in a PoolState.  Blocks holds the handle's
+// counts for the pool's blocks only, keyed by block CIDR, so that importing
+// the state leaves the handle's counts for other pools untouched.
+type PoolStateHandle struct {
+	HandleID string         `json:"handleID"`
+	Owner    string         `json:"owner,omitempty"`
+	Blocks   map[string]int `json:"blocks"`
+}
+
+// ExportPoolState reads the complete IPAM state of the pool.  The blocks and
+// affinities are read a page at a time.  Nothing is locked while the state is
+// read, so addresses assigned or released during the export may be captured
+// only in part; export from a datastore that is not in use.
+func (c ipams) ExportPoolState(pool cnet.IPNet) (PoolState, error) {
+	logContext := c.requestLog().WithField("pool", pool.String())
+	state := PoolState{Pool: pool}
+	version := getIPVersion(cnet.IP{pool.IP})
+
+	objs, err := c.blockReaderWriter.listAll(model.BlockListOptions{IPVersion: version.Number, Pool: pool}, ipamListPageSize)
+	if err != nil && !errors.IsNotExist(err) {
+		logContext.WithError(err).Error("Error listing blocks")
+		return PoolState{}, err
+	}
+	listed := map[string]bool{}
+	exported := map[string]bool{}
+	handleIDs := map[string]bool{}
+	for _, obj := range objs {
+		if err := checkBlockCIDR(obj.Key, obj); err != nil {
+			return PoolState{}, err
+		}
+		b := obj.Value.(*model.AllocationBlock)
+		listed[b.CIDR.String()] = true
+		if !blockBelongsToPool(b, pool) {
+			continue
+		}
+		exported[b.CIDR.String()] = true
+		state.Blocks = append(state.Blocks, *b)
+		for _, a := range b.Attributes {
+			if a.AttrPrimary != nil {
+				handleIDs[*a.AttrPrimary] = true
+			}
+		}
+	}
+
+	// Include the affinities for the exported blocks, and those within the
+	// pool whose block was never written, since a later claim completes
+	// them.
+	objs, err = c.blockReaderWriter.listAll(model.BlockAffinityListOptions{IPVersion: version.Number}, ipamListPageSize)
+	if err != nil && !errors.IsNotExist(err) {
+		logContext.WithError(err).Error("Error listing block affinities")
+		return PoolState{}, err
+	}
+	for _, obj := range objs {
+		k := obj.Key.(model.BlockAffinityKey)
+		if exported[k.CIDR.String()] || (!listed[k.CIDR.String()] && pool.Contains(k.CIDR.IP)) {
+			state.Affinities = append(state.Affinities, PoolStateAffinity{Host: k.Host, CIDR: k.CIDR})
+		}
+	}
+
+	ids := []string{}
+	for id := range handleIDs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		obj, err := c.client.Backend.Get(model.IPAMHandleKey{HandleID: id})
+		if err != nil {
+			if errors.IsNotExist(err) {
+				continue
+			}
+			logContext.WithError(err).WithField("handle", id).Error("Error reading handle")
+			return PoolState{}, err
+		}
+		handle := obj.Value.(*model.IPAMHandle)
+		h := PoolStateHandle{HandleID: id, Owner: handle.Owner, Blocks: map[string]int{}}
+		for cidr, num := range handle.Block {
+			if exported[cidr] {
+				h.Blocks[cidr] = num
+			}
+		}
+		if len(h.Blocks) > 0 {
+			state.Handles = append(state.Handles, h)
+		}
+	}
+
+	logContext.WithFields(log.Fields{
+		"blocks":     len(state.Blocks),
+		"affinities": len(state.Affinities),
+		"handles":    len(state.Handles),
+	}).Info("Exported pool state")
+	return state, nil
+}
+
+// ImportPoolState writes the state exported by ExportPoolState.  State which
+// already exists and is identical is left as it is, so if ImportPoolState
+// fails part way through, importing the state again completes the import.
+// Existing state which differs is only overwritten if force is set, which
+// the IPAM configuration must allow as a destructive operation; otherwise a
+// poolStateConflictError is returned.
+//
+// As when assigning, the handles are written before the affinities and the
+// blocks, so that an interrupted import never leaves an address in a block
+// without its handle.
+func (c ipams) ImportPoolState(state PoolState, force bool) error {
+	logContext := c.requestLog().WithFields(log.Fields{"pool": state.Pool.String(), "force": force})
+	if force {
+		if err := c.blockReaderWriter.checkDestructiveOpsAllowed("ImportPoolState"); err != nil {
+			return err
+		}
+	}
+	for _, b := range state.Blocks {
+		if !state.Pool.Contains(b.CIDR.IP) {
+			return fmt.Errorf("block %s is not within pool %s", b.CIDR, state.Pool)
+		}
+	}
+
+	for _, h := range state.Handles {
+		// merged returns the handle with the imported counts added to the
+		// given counts, so that the counts for other pools are kept.
+		merged := func(counts map[string]int) *model.IPAMHandle {
+			handle := &model.IPAMHandle{HandleID: h.HandleID, Owner: h.Owner, Block: map[string]int{}}
+			for cidr, num := range counts {
+				handle.Block[cidr] = num
+			}
+			for cidr, num := range h.Blocks {
+				handle.Block[cidr] = num
+			}
+			return handle
+		}
+		kvp := &model.KVPair{Key: model.IPAMHandleKey{HandleID: h.HandleID}, Value: merged(nil)}
+		err := c.importObject(kvp, force, func(existing interface{}) (interface{}, bool) {
+			// Adding counts for blocks the handle has none for loses
+			// nothing, but changing its owner or its counts does.
+			old := existing.(*model.IPAMHandle)
+			overwrites := old.Owner != "" && old.Owner != h.Owner
+			for cidr, num := range h.Blocks {
+				if n, ok := old.Block[cidr]; ok && n != num {
+					overwrites = true
+				}
+			}
+			return merged(old.Block), overwrites
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, a := range state.Affinities {
+		kvp := &model.KVPair{
+			Key:   model.BlockAffinityKey{Host: a.Host, CIDR: a.CIDR},
+			Value: model.BlockAffinityValue,
+		}
+		err := c.importObject(kvp, force, func(existing interface{}) (interface{}, bool) {
+			// The affinity's value holds no information.
+			return existing, false
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for i := range state.Blocks {
+		b := state.Blocks[i]
+		kvp := &model.KVPair{Key: model.BlockKey{CIDR: b.CIDR}, Value: &b}
+		err := c.importObject(kvp, force, func(existing interface{}) (interface{}, bool) {
+			return &b, true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	logContext.WithFields(log.Fields{
+		"blocks":     len(state.Blocks),
+		"affinities": len(state.Affinities),
+		"handles":    len(state.Handles),
+	}).Info("Imported pool state")
+	return nil
+}
+
+// importObject creates the object.  If it already exists, merge returns the
+// value which the import would write given the existing value, and whether
+// writing it would overwrite existing state.  If the value is identical to
+// the existing value nothing is written, and existing state is only
+// overwritten if force is set.
+func (c ipams) importObject(kvp *model.KVPair, force bool, merge func(existing interface{}) (interface{}, bool)) error {
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	retry := cfg.Retry.start()
+	for i := 0; i < retry.maxAttempts(); i++ {
+		if !c.blockReaderWriter.waitForRetry(retry, i, kvp.Key) {
+			break
+		}
+		existing, err := c.client.Backend.Get(kvp.Key)
+		if errors.IsNotExist(err) {
+			_, err = c.client.Backend.Create(kvp)
+			if errors.IsAlreadyExists(err) {
+				lastErr = err
+				continue
+			}
+			return err
+		} else if err != nil {
+			return err
+		}
+
+		value, overwrites := merge(existing.Value)
+		same, err := sameValue(existing.Key, existing.Value, value)
+		if err != nil {
+			return err
+		} else if same {
+			return nil
+		} else if overwrites {
+			if !force {
+				return poolStateConflictError{Key: kvp.Key}
+			}
+			c.requestLog().WithField("key", kvp.Key.String()).Warning("Overwriting existing state")
+		}
+		existing.Value = value
+		if _, err := c.client.Backend.Update(existing); err != nil {
+			if errors.IsRetryable(err) {
+				lastErr = err
+				continue
+			}
+			return err
+		}
+		return nil
+	}
+	return maxRetriesError{Key: kvp.Key, Err: lastErr}
+}
+
+// sameValue returns whether the two values for the key serialize the same, so
+// that values which differ only in ways the datastore does not store, such
+// as an empty slice and a nil one, are treated as identical.
+func sameValue(key model.Key, a, b interface{}) (bool, error) {
+	aData, err := model.SerializeValue(&model.KVPair{Key: key, Value: a})
+	if err != nil {
+		return false, err
+	}
+	bData, err := model.SerializeValue(&model.KVPair{Key: key, Value: b})
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aData, bData), nil
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	goerrors "errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// blockCreateFailingBackend is a fakeBlockBackend which fails to create
+// blocks.
+type blockCreateFailingBackend struct {
+	*fakeBlockBackend
+}
+
+func (f blockCreateFailingBackend) Create(kvp *model.KVPair) (*model.KVPair, error) {
+	if _, ok := kvp.Key.(model.BlockKey); ok {
+		return nil, errors.ErrorDatastoreError{Err: goerrors.New("injected failure"), Identifier: kvp.Key}
+	}
+	return f.fakeBlockBackend.Create(kvp)
+}
+
+var _ = Describe("Pool state export and import", func() {
+	pool := cnet.MustParseNetwork("10.0.0.0/24")
+	otherPool := cnet.MustParseNetwork("10.1.0.0/24")
+
+	var source, dest *fakeBlockBackend
+	var src, dst *ipams
+
+	newBackend := func() *fakeBlockBackend {
+		backend := newFakeBlockBackend()
+		backend.storePool(pool.String(), false)
+		backend.storePool(otherPool.String(), false)
+		return backend
+	}
+
+	assign := func(ic *ipams, num int, host, handle string, p cnet.IPNet) {
+		_, _, err := ic.AutoAssign(AutoAssignArgs{
+			Num4:      num,
+			Hostname:  host,
+			HandleID:  &handle,
+			Attrs:     map[string]string{"host": host},
+			IPv4Pools: []cnet.IPNet{p},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	// export exports the pool's state and passes it through JSON, as a
+	// backup would.
+	export := func(ic *ipams) PoolState {
+		state, err := ic.ExportPoolState(pool)
+		Expect(err).NotTo(HaveOccurred())
+		data, err := json.Marshal(state)
+		Expect(err).NotTo(HaveOccurred())
+		var decoded PoolState
+		Expect(json.Unmarshal(data, &decoded)).To(Succeed())
+		return decoded
+	}
+
+	asJSON := func(state PoolState) string {
+		data, err := json.Marshal(state)
+		Expect(err).NotTo(HaveOccurred())
+		return string(data)
+	}
+
+	BeforeEach(func() {
+		source = newBackend()
+		src = newIPAM(&Client{Backend: source})
+		assign(src, 3, "host-a", "handle-a", pool)
+		assign(src, 70, "host-b", "handle-b", pool)
+		assign(src, 2, "host-a", "handle-b", otherPool)
+		Expect(src.ReleaseIPs([]cnet.IP{cnet.MustParseIP("10.0.0.1")})).To(BeEmpty())
+
+		// An affinity whose block was never written.
+		source.store(&model.KVPair{
+			Key:   model.BlockAffinityKey{Host: "host-c", CIDR: cnet.MustParseNetwork("10.0.0.192/26")},
+			Value: model.BlockAffinityValue,
+		})
+
+		dest = newBackend()
+		dst = newIPAM(&Client{Backend: dest})
+	})
+
+	It("should export only the pool's state", func() {
+		state := export(src)
+		Expect(state.Pool).To(Equal(pool))
+		Expect(state.Blocks).To(HaveLen(3))
+		Expect(state.Affinities).To(HaveLen(4))
+		Expect(state.Handles).To(HaveLen(2))
+		for _, h := range state.Handles {
+			for cidr := range h.Blocks {
+				_, blockCIDR, err := cnet.ParseCIDR(cidr)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(pool.Contains(blockCIDR.IP)).To(BeTrue())
+			}
+		}
+	})
+
+	It("should round trip the state without loss", func() {
+		state := export(src)
+		Expect(dst.ImportPoolState(state, false)).To(Succeed())
+		Expect(asJSON(export(dst))).To(Equal(asJSON(state)))
+
+		ips, err := dst.IPsByHandle("handle-b")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(70))
+		attrs, err := dst.GetAssignmentAttributes(cnet.MustParseIP("10.0.0.0"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(attrs).To(Equal(map[string]string{"host": "host-a"}))
+
+		// Addresses can be assigned from the imported blocks.
+		assign(dst, 1, "host-a", "handle-a", pool)
+		ips, err = dst.IPsByHandle("handle-a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ips).To(HaveLen(3))
+	})
+
+	It("should keep a handle's counts for other pools", func() {
+		// The handle has the same owner in both datastores, so adding
+		// the pool's counts overwrites nothing.
+		assign(dst, 2, "host-b", "handle-b", otherPool)
+		state := export(src)
+		Expect(dst.ImportPoolState(state, false)).To(Succeed())
+
+		obj, err := dest.Get(model.IPAMHandleKey{HandleID: "handle-b"})
+		Expect(err).NotTo(HaveOccurred())
+		inPool := map[string]int{}
+		inOtherPool := 0
+		for cidr, num := range obj.Value.(*model.IPAMHandle).Block {
+			_, blockCIDR, err := cnet.ParseCIDR(cidr)
+			Expect(err).NotTo(HaveOccurred())
+			if otherPool.Contains(blockCIDR.IP) {
+				inOtherPool += num
+			} else {
+				inPool[cidr] = num
+			}
+		}
+		Expect(inOtherPool).To(Equal(2))
+		for _, h := range state.Handles {
+			if h.HandleID == "handle-b" {
+				Expect(inPool).To(Equal(h.Blocks))
+			}
+		}
+	})
+
+	It("should complete an interrupted import when imported again", func() {
+		state := export(src)
+		dst.client.Backend = blockCreateFailingBackend{dest}
+		Expect(dst.ImportPoolState(state, false)).NotTo(Succeed())
+
+		dst.client.Backend = dest
+		Expect(dst.ImportPoolState(state, false)).To(Succeed())
+		Expect(dst.ImportPoolState(state, false)).To(Succeed())
+		Expect(asJSON(export(dst))).To(Equal(asJSON(state)))
+	})
+
+	It("should only overwrite differing state when forced", func() {
+		state := export(src)
+		Expect(dst.ImportPoolState(state, false)).To(Succeed())
+		Expect(dst.ReleaseIPs([]cnet.IP{cnet.MustParseIP("10.0.0.2")})).To(BeEmpty())
+
+		err := dst.ImportPoolState(state, false)
+		Expect(err).To(BeAssignableToTypeOf(poolStateConflictError{}))
+		err = dst.ImportPoolState(state, true)
+		Expect(err).To(Equal(destructiveOpsDisabledError{Op: "ImportPoolState"}))
+
+		dest.allowDestructiveOps()
+		Expect(dst.ImportPoolState(state, true)).To(Succeed())
+		Expect(asJSON(export(dst))).To(Equal(asJSON(state)))
+	})
+})
@@ -0,0 +1,51 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	log "github.com/Sirupsen/logrus"
+	uuid "github.com/satori/go.uuid"
+)
+
+// requestIDField is the log field holding the ID of the IPAM request that
+// logged a line, so that the lines logged by a request, including its
+// retries, can be correlated.
+const requestIDField = "requestID"
+
+// withRequestID returns a copy of c whose log lines carry the given request
+// ID, or a newly generated ID if it is empty.  Each high-level operation
+// calls this first, so that every line it logs, down to the retry loops,
+// carries the same ID.
+func (c ipams) withRequestID(id string) ipams {
+	if id == "" {
+		id = uuid.NewV4().String()
+	}
+	c.blockReaderWriter.requestID = id
+	return c
+}
+
+// requestLog returns the log entry for the current request.
+func (c ipams) requestLog() *log.Entry {
+	return c.blockReaderWriter.requestLog()
+}
+
+// requestLog returns the log entry for the current request, which carries
+// its request ID if it has one.
+func (rw blockReaderWriter) requestLog() *log.Entry {
+	if rw.requestID == "" {
+		return log.NewEntry(log.StandardLogger())
+	}
+	return log.WithField(requestIDField, rw.requestID)
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// recordingHook records the entries logged while it is added to the logger.
+type recordingHook struct {
+	entries []*log.Entry
+}
+
+func (h *recordingHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *recordingHook) Fire(e *log.Entry) error {
+	h.entries = append(h.entries, e)
+	return nil
+}
+
+// retryingBackend is a fakeBlockBackend whose first updates fail with a
+// conflict, so that they are retried.
+type retryingBackend struct {
+	*fakeBlockBackend
+	conflicts int
+}
+
+func (r *retryingBackend) Update(kvp *model.KVPair) (*model.KVPair, error) {
+	if r.conflicts > 0 {
+		r.conflicts--
+		return nil, errors.ErrorResourceUpdateConflict{Identifier: kvp.Key}
+	}
+	return r.fakeBlockBackend.Update(kvp)
+}
+
+var _ = Describe("IPAM request IDs", func() {
+	var backend *fakeBlockBackend
+	var ic *ipams
+	var hook *recordingHook
+	var savedHooks log.LevelHooks
+	var savedLevel log.Level
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		backend.storePool("10.0.0.0/24", false)
+		ic = newIPAM(&Client{Backend: backend})
+
+		hook = &recordingHook{}
+		savedHooks = log.StandardLogger().Hooks
+		savedLevel = log.GetLevel()
+		log.StandardLogger().Hooks = log.LevelHooks{}
+		log.AddHook(hook)
+		log.SetLevel(log.DebugLevel)
+	})
+
+	AfterEach(func() {
+		log.StandardLogger().Hooks = savedHooks
+		log.SetLevel(savedLevel)
+	})
+
+	// requestIDs returns the request IDs of the recorded entries.  Lines
+	// logged below the IPAM client, for example by the backend, do not
+	// carry a request ID, so they are skipped.
+	requestIDs := func() map[interface{}]int {
+		ids := map[interface{}]int{}
+		for _, e := range hook.entries {
+			if id, ok := e.Data[requestIDField]; ok {
+				ids[id]++
+			}
+		}
+		return ids
+	}
+
+	It("should log the given request ID on the request's lines, including retries", func() {
+		// Claim the block first, so that only the assignment conflicts.
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.1"), Hostname: "host-a"})).To(Succeed())
+		hook.entries = nil
+
+		ic.client.Backend = &retryingBackend{fakeBlockBackend: backend, conflicts: 2}
+		Expect(ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.2"), Hostname: "host-a", RequestID: "request-1"})).To(Succeed())
+
+		Expect(requestIDs()).To(HaveLen(1))
+		Expect(requestIDs()).To(HaveKey("request-1"))
+		retries := 0
+		for _, e := range hook.entries {
+			if e.Message == "Retrying update" {
+				Expect(e.Data[requestIDField]).To(Equal("request-1"))
+				retries++
+			}
+		}
+		Expect(retries).To(Equal(2))
+	})
+
+	It("should generate a different request ID for each request", func() {
+		_, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		first := requestIDs()
+		Expect(first).To(HaveLen(1))
+		Expect(first).NotTo(HaveKey(""))
+
+		hook.entries = nil
+		_, _, err = ic.AutoAssign(AutoAssignArgs{Num4: 1, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		second := requestIDs()
+		Expect(second).To(HaveLen(1))
+		for id := range first {
+			Expect(second).NotTo(HaveKey(id))
+		}
+	})
+
+	It("should use one request ID for the addresses assigned by AssignPreferred", func() {
+		preferred := []cnet.IP{cnet.MustParseIP("10.0.0.5")}
+		result, err := ic.AssignPreferred(preferred, AutoAssignArgs{Num4: 2, Hostname: "host-a", RequestID: "request-2"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Honored).To(HaveLen(1))
+		Expect(result.IPv4).To(HaveLen(1))
+		Expect(requestIDs()).To(HaveLen(1))
+		Expect(requestIDs()).To(HaveKey("request-2"))
+	})
+})
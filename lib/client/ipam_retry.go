@@ -0,0 +1,178 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	goerrors "errors"
+	"math/rand"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+// maxAttempts returns the maximum number of attempts to make at an update.
+func (r RetryConfig) maxAttempts() int {
+	if r.MaxAttempts > 0 {
+		return r.MaxAttempts
+	}
+	return ipamEtcdRetries
+}
+
+// backoff returns the delay before the given attempt, where attempt 0 is the
+// first attempt and is never delayed.
+func (r RetryConfig) backoff(attempt int) time.Duration {
+	if attempt == 0 || r.BaseBackoff <= 0 {
+		return 0
+	}
+	max := r.MaxBackoff
+	if max <= 0 {
+		max = ipamRetryMaxBackoff
+	}
+
+	// Double the delay for each retry, stopping at the maximum before the
+	// delay can overflow.
+	d := r.BaseBackoff
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+
+	if r.Jitter > 0 {
+		d += time.Duration(r.Jitter * (2*rand.Float64() - 1) * float64(d))
+	}
+	return d
+}
+
+// start returns a copy of r for a new update, whose attempts must start
+// within the retry timeout from now.
+func (r RetryConfig) start() RetryConfig {
+	if r.Timeout > 0 {
+		r.deadline = time.Now().Add(r.Timeout)
+	}
+	return r
+}
+
+// wait sleeps for the backoff before the given attempt, logging the delay to
+// the given log entry.  Returns false without sleeping if the attempt would
+// start after the deadline set by start.  The first attempt is always made.
+func (r RetryConfig) wait(attempt int, logContext *log.Entry) bool {
+	d := r.backoff(attempt)
+	if attempt > 0 && !r.deadline.IsZero() && time.Now().Add(d).After(r.deadline) {
+		logContext.WithField("timeout", r.Timeout).Warning("Retry timeout reached, giving up")
+		return false
+	}
+	if d > 0 {
+		logContext.Debugf("Waiting %v before retrying", d)
+		time.Sleep(d)
+	}
+	return true
+}
+
+// withIPAMConfig returns a copy of c which uses the global IPAM
+// configuration read now for the rest of the operation, so that the
+// configuration is read once per operation however many options the
+// operation consults.  If c already holds the configuration it is kept.
+func (c ipams) withIPAMConfig() (ipams, error) {
+	cfg, err := c.blockReaderWriter.ipamConfig()
+	if err != nil {
+		return c, err
+	}
+	c.blockReaderWriter.config = cfg
+	return c, nil
+}
+
+// ipamConfig returns the IPAM configuration of the operation being served,
+// or reads the global IPAM configuration if the operation has not read it.
+// The result must not be modified.
+func (rw blockReaderWriter) ipamConfig() (*IPAMConfig, error) {
+	if rw.config != nil {
+		return rw.config, nil
+	}
+	return rw.getIPAMConfig()
+}
+
+// bulkConcurrency returns the number of blocks which bulk operations read and
+// write at once.
+func (cfg IPAMConfig) bulkConcurrency() int {
+	if cfg.BulkConcurrency > 0 {
+		return cfg.BulkConcurrency
+	}
+	return defaultBulkConcurrency
+}
+
+// errSkipUpdate may be returned by the mutate function passed to
+// updateWithRetry to finish without writing the object back.
+var errSkipUpdate = goerrors.New("skip update")
+
+// updateWithRetry reads the object with the given key, applies mutate to it
+// and writes it back with a compare-and-swap update.  If the update conflicts
+// with another writer the object is read again and mutate is reapplied, up to
+// the configured number of attempts.  Errors from reading the object or from
+// mutate are returned without retrying.
+func (rw blockReaderWriter) updateWithRetry(key model.Key, mutate func(*model.KVPair) error) error {
+	return rw.writeWithRetry(key, mutate, func(obj *model.KVPair) error {
+		_, err := rw.client.Backend.Update(obj)
+		return err
+	})
+}
+
+// writeWithRetry is updateWithRetry with the write done by the given
+// function, which must compare-and-swap against the revision of the object
+// it is passed, for example by updating or deleting it.  mutate is applied to
+// a copy of the object read, so that a failed write leaves it unchanged.
+func (rw blockReaderWriter) writeWithRetry(key model.Key, mutate func(*model.KVPair) error, write func(*model.KVPair) error) error {
+	logContext := rw.requestLog().WithField("key", key.String())
+	cfg, err := rw.ipamConfig()
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	retry := cfg.Retry.start()
+	for i := 0; i < retry.maxAttempts(); i++ {
+		if !rw.waitForRetry(retry, i, key) {
+			break
+		}
+		obj, err := rw.client.Backend.Get(key)
+		if err != nil {
+			logContext.WithError(err).Debug("Error reading object for update")
+			return err
+		}
+		if err := checkBlockCIDR(key, obj); err != nil {
+			return err
+		}
+		obj = obj.Clone()
+		if err := mutate(obj); err != nil {
+			if err == errSkipUpdate {
+				return nil
+			}
+			return err
+		}
+		if err := write(obj); err != nil {
+			if errors.IsRetryable(err) {
+				logContext.WithError(err).Debug("Update conflicted, retrying")
+				lastErr = err
+				continue
+			}
+			logContext.WithError(err).Error("Error writing object")
+			return err
+		}
+		return nil
+	}
+	return maxRetriesError{Key: key, Err: lastErr}
+}
@@ -0,0 +1,462 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	goerrors "errors"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/fake"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// conflictingBackend is a fakeBlockBackend for which every update conflicts.
+type conflictingBackend struct {
+	*fakeBlockBackend
+	updates int
+}
+
+func (c *conflictingBackend) Update(kvp *model.KVPair) (*model.KVPair, error) {
+	c.updates++
+	return nil, errors.ErrorResourceUpdateConflict{Identifier: kvp.Key}
+}
+
+// configCountingBackend is a fakeBlockBackend which counts the reads of the
+// IPAM configuration.
+type configCountingBackend struct {
+	*fakeBlockBackend
+	gets int
+}
+
+func (c *configCountingBackend) Get(k model.Key) (*model.KVPair, error) {
+	if _, ok := k.(model.IPAMConfigKey); ok {
+		c.gets++
+	}
+	return c.fakeBlockBackend.Get(k)
+}
+
+// sharingConflictBackend is a fakeBlockBackend whose first updates fail with
+// a conflict.  It keeps the last block returned by Get, as a backend which
+// shared its values with the caller would store it, and records whether that
+// block was modified by a failed update.
+type sharingConflictBackend struct {
+	*fakeBlockBackend
+	conflicts int
+	modified  bool
+	read      *model.AllocationBlock
+}
+
+func (c *sharingConflictBackend) Get(k model.Key) (*model.KVPair, error) {
+	kvp, err := c.fakeBlockBackend.Get(k)
+	if err == nil {
+		if b, ok := kvp.Value.(*model.AllocationBlock); ok {
+			c.read = b
+		}
+	}
+	return kvp, err
+}
+
+func (c *sharingConflictBackend) Update(kvp *model.KVPair) (*model.KVPair, error) {
+	if c.conflicts > 0 {
+		c.conflicts--
+		if c.read.Affinity == nil {
+			c.modified = true
+		}
+		return nil, errors.ErrorResourceUpdateConflict{Identifier: kvp.Key}
+	}
+	return c.fakeBlockBackend.Update(kvp)
+}
+
+var _ = DescribeTable("RetryConfig backoff",
+	func(r RetryConfig, attempt int, expected time.Duration) {
+		Expect(r.backoff(attempt)).To(Equal(expected))
+	},
+	Entry("zero config never waits", RetryConfig{}, 5, time.Duration(0)),
+	Entry("first attempt never waits", RetryConfig{BaseBackoff: time.Second}, 0, time.Duration(0)),
+	Entry("first retry waits the base backoff", RetryConfig{BaseBackoff: time.Second}, 1, time.Second),
+	Entry("later retries double the backoff", RetryConfig{BaseBackoff: time.Second, MaxBackoff: time.Minute}, 4, 8*time.Second),
+	Entry("backoff is capped at the maximum", RetryConfig{BaseBackoff: time.Second, MaxBackoff: 3 * time.Second}, 4, 3*time.Second),
+	Entry("backoff is capped at the default maximum", RetryConfig{BaseBackoff: time.Second}, 99, ipamRetryMaxBackoff),
+)
+
+var _ = Describe("RetryConfig", func() {
+	It("should default to the package retry limit", func() {
+		Expect(RetryConfig{}.maxAttempts()).To(Equal(ipamEtcdRetries))
+		Expect(RetryConfig{MaxAttempts: 3}.maxAttempts()).To(Equal(3))
+	})
+
+	It("should vary the backoff by at most the jitter", func() {
+		r := RetryConfig{BaseBackoff: time.Second, Jitter: 0.5}
+		for i := 0; i < 100; i++ {
+			d := r.backoff(1)
+			Expect(d).To(BeNumerically(">=", 500*time.Millisecond))
+			Expect(d).To(BeNumerically("<=", 1500*time.Millisecond))
+		}
+	})
+
+	It("should limit the attempts made by a CAS loop", func() {
+		subnet := cnet.MustParseNetwork("10.0.0.0/26")
+		backend := &conflictingBackend{fakeBlockBackend: newFakeBlockBackend()}
+		rw := blockReaderWriter{client: &Client{Backend: backend}}
+		backend.store(&model.KVPair{
+			Key:   model.IPAMConfigKey{},
+			Value: &model.IPAMConfig{AutoAllocateBlocks: true, RetryMaxAttempts: 3},
+		})
+		b := newBlock(subnet)
+		affinity := "host:host-a"
+		b.Affinity = &affinity
+		Expect(b.assign(cnet.MustParseIP("10.0.0.1"), nil, nil, "host-a")).To(Succeed())
+		backend.store(&model.KVPair{Key: model.BlockKey{CIDR: subnet}, Value: b.AllocationBlock})
+
+		err := rw.releaseBlockAffinity("host-a", subnet)
+		Expect(err).To(BeAssignableToTypeOf(maxRetriesError{}))
+		Expect(backend.updates).To(Equal(3))
+
+		// The error from the last attempt is retained.
+		Expect(errors.IsUpdateConflict(err.(maxRetriesError).Unwrap())).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("10.0.0.0/26"))
+	})
+
+	It("should limit the attempts made to update a handle", func() {
+		c := newFakeBlockBackend()
+		ic := newIPAM(&Client{Backend: c})
+		key := model.IPAMHandleKey{HandleID: "handle-a"}
+		_, err := c.Create(&model.KVPair{Key: model.IPAMConfigKey{}, Value: &model.IPAMConfig{AutoAllocateBlocks: true, RetryMaxAttempts: 3}})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = c.Create(&model.KVPair{Key: key, Value: &model.IPAMHandle{HandleID: "handle-a", Block: map[string]int{"10.0.0.0/26": 1}}})
+		Expect(err).NotTo(HaveOccurred())
+		c.InjectError(fake.OperationUpdate, key, errors.ErrorResourceUpdateConflict{Identifier: key}, -1)
+
+		err = ic.setHandleBlockCount("handle-a", cnet.MustParseNetwork("10.0.0.0/26"), 2)
+		Expect(err).To(BeAssignableToTypeOf(maxRetriesError{}))
+		Expect(errors.IsUpdateConflict(err.(maxRetriesError).Unwrap())).To(BeTrue())
+	})
+
+	It("should limit the attempts made to assign a given address", func() {
+		subnet := cnet.MustParseNetwork("10.0.0.0/26")
+		backend := &conflictingBackend{fakeBlockBackend: newFakeBlockBackend()}
+		backend.storePool("10.0.0.0/24", false)
+		backend.store(&model.KVPair{
+			Key:   model.IPAMConfigKey{},
+			Value: &model.IPAMConfig{AutoAllocateBlocks: true, RetryMaxAttempts: 3},
+		})
+		b := newBlock(subnet)
+		affinity := "host:host-a"
+		b.Affinity = &affinity
+		backend.store(&model.KVPair{Key: model.BlockKey{CIDR: subnet}, Value: b.AllocationBlock})
+		ic := newIPAM(&Client{Backend: backend})
+
+		err := ic.AssignIP(AssignIPArgs{IP: cnet.MustParseIP("10.0.0.1"), Hostname: "host-a"})
+		Expect(err).To(BeAssignableToTypeOf(maxRetriesError{}))
+		Expect(backend.updates).To(Equal(3))
+		Expect(errors.IsUpdateConflict(err.(maxRetriesError).Unwrap())).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("10.0.0.0/26"))
+	})
+
+	It("should not start a retry which would end after the timeout", func() {
+		subnet := cnet.MustParseNetwork("10.0.0.0/26")
+		backend := &conflictingBackend{fakeBlockBackend: newFakeBlockBackend()}
+		rw := blockReaderWriter{client: &Client{Backend: backend}}
+		backend.store(&model.KVPair{
+			Key: model.IPAMConfigKey{},
+			Value: &model.IPAMConfig{
+				AutoAllocateBlocks: true,
+				RetryBaseBackoff:   20 * time.Millisecond,
+				RetryMaxBackoff:    20 * time.Millisecond,
+				RetryTimeout:       50 * time.Millisecond,
+			},
+		})
+		b := newBlock(subnet)
+		affinity := "host:host-a"
+		b.Affinity = &affinity
+		Expect(b.assign(cnet.MustParseIP("10.0.0.1"), nil, nil, "host-a")).To(Succeed())
+		backend.store(&model.KVPair{Key: model.BlockKey{CIDR: subnet}, Value: b.AllocationBlock})
+
+		// Attempts start after 0, 20 and 40ms; the next would start
+		// after 60ms.
+		err := rw.releaseBlockAffinity("host-a", subnet)
+		Expect(err).To(BeAssignableToTypeOf(maxRetriesError{}))
+		Expect(errors.IsUpdateConflict(err.(maxRetriesError).Unwrap())).To(BeTrue())
+		Expect(backend.updates).To(BeNumerically("<=", 3))
+	})
+
+	It("should always make the first attempt", func() {
+		r := RetryConfig{Timeout: time.Nanosecond}.start()
+		time.Sleep(time.Millisecond)
+		Expect(r.wait(0, log.WithField("attempt", 0))).To(BeTrue())
+		Expect(r.wait(1, log.WithField("attempt", 1))).To(BeFalse())
+	})
+
+	It("should read the retry config from the IPAM config", func() {
+		backend := newFakeBlockBackend()
+		ic := newIPAM(&Client{Backend: backend})
+		cfg, err := ic.blockReaderWriter.ipamConfig()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Retry).To(Equal(RetryConfig{}))
+
+		retry := RetryConfig{MaxAttempts: 5, BaseBackoff: time.Millisecond, MaxBackoff: time.Second, Jitter: 0.1, Timeout: time.Minute}
+		backend.store(&model.KVPair{
+			Key:   model.IPAMConfigKey{},
+			Value: ic.convertIPAMConfigToBackend(&IPAMConfig{AutoAllocateBlocks: true, Retry: retry}),
+		})
+		cfg, err = ic.blockReaderWriter.ipamConfig()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.Retry).To(Equal(retry))
+	})
+
+	It("should read the IPAM config once per operation", func() {
+		backend := &configCountingBackend{fakeBlockBackend: newFakeBlockBackend()}
+		backend.storePool("10.0.0.0/24", false)
+		ic := newIPAM(&Client{Backend: backend})
+
+		v4, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 2, Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(v4).To(HaveLen(2))
+		Expect(backend.gets).To(Equal(1))
+
+		_, err = ic.ReleaseIPs(v4)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(backend.gets).To(Equal(2))
+	})
+
+	It("should return the error reading the IPAM config", func() {
+		c := newFakeBlockBackend()
+		ic := newIPAM(&Client{Backend: c})
+		readErr := errors.ErrorDatastoreError{Err: goerrors.New("datastore unavailable")}
+		c.InjectError(fake.OperationGet, model.IPAMConfigKey{}, readErr, -1)
+
+		Expect(ic.ReleaseByHandle("handle-a")).To(Equal(readErr))
+		_, _, err := ic.AutoAssign(AutoAssignArgs{Num4: 1, Hostname: "host-a"})
+		Expect(err).To(Equal(readErr))
+	})
+
+	It("should return the error listing blocks when changing the IPAM config", func() {
+		c := newFakeBlockBackend()
+		ic := newIPAM(&Client{Backend: c})
+		listErr := errors.ErrorDatastoreError{Err: goerrors.New("datastore unavailable")}
+		c.InjectError(fake.OperationList, nil, listErr, 1)
+
+		Expect(ic.SetIPAMConfig(IPAMConfig{StrictAffinity: true, AutoAllocateBlocks: true})).To(Equal(listErr))
+		cfg, err := ic.GetIPAMConfig()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cfg.StrictAffinity).To(BeFalse())
+	})
+})
+
+var _ = Describe("updateWithRetry", func() {
+	key := model.BlockKey{CIDR: cnet.MustParseNetwork("10.0.0.0/26")}
+
+	var backend *fakeBlockBackend
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+		b := newBlock(key.CIDR)
+		backend.store(&model.KVPair{Key: key, Value: b.AllocationBlock})
+	})
+
+	It("should apply the mutation and update the object", func() {
+		affinity := "host:host-a"
+		Expect(rw.updateWithRetry(key, func(obj *model.KVPair) error {
+			obj.Value.(*model.AllocationBlock).Affinity = &affinity
+			return nil
+		})).To(Succeed())
+
+		obj, err := backend.Get(key)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*obj.Value.(*model.AllocationBlock).Affinity).To(Equal(affinity))
+	})
+
+	It("should reapply the mutation to a freshly read object after a conflict", func() {
+		revisions := []interface{}{}
+		Expect(rw.updateWithRetry(key, func(obj *model.KVPair) error {
+			revisions = append(revisions, obj.Revision)
+			if len(revisions) == 1 {
+				// Simulate another writer updating the object.
+				backend.store(&model.KVPair{Key: key, Value: obj.Value})
+			}
+			return nil
+		})).To(Succeed())
+		Expect(revisions).To(HaveLen(2))
+		Expect(revisions[1]).NotTo(Equal(revisions[0]))
+	})
+
+	It("should return errors from the mutation without updating", func() {
+		conflicting := &conflictingBackend{fakeBlockBackend: backend}
+		rw = blockReaderWriter{client: &Client{Backend: conflicting}}
+		Expect(rw.updateWithRetry(key, func(obj *model.KVPair) error {
+			return notAssignedError{}
+		})).To(Equal(notAssignedError{}))
+		Expect(rw.updateWithRetry(key, func(obj *model.KVPair) error {
+			return errSkipUpdate
+		})).To(Succeed())
+		Expect(conflicting.updates).To(Equal(0))
+	})
+
+	It("should return the error when the object does not exist", func() {
+		err := rw.updateWithRetry(model.BlockKey{CIDR: cnet.MustParseNetwork("10.0.0.64/26")}, func(obj *model.KVPair) error {
+			return nil
+		})
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("should retry updates which the datastore fails with a conflict", func() {
+		c := newFakeBlockBackend()
+		_, err := c.Create(&model.KVPair{Key: key, Value: newBlock(key.CIDR).AllocationBlock})
+		Expect(err).NotTo(HaveOccurred())
+		c.InjectError(fake.OperationUpdate, key, errors.ErrorResourceUpdateConflict{Identifier: key}, 2)
+		rw = blockReaderWriter{client: &Client{Backend: c}}
+
+		attempts := 0
+		Expect(rw.updateWithRetry(key, func(obj *model.KVPair) error {
+			attempts++
+			return nil
+		})).To(Succeed())
+		Expect(attempts).To(Equal(3))
+	})
+
+	It("should retry deletes which the datastore fails with a conflict", func() {
+		c := newFakeBlockBackend()
+		_, err := c.Create(&model.KVPair{Key: key, Value: newBlock(key.CIDR).AllocationBlock})
+		Expect(err).NotTo(HaveOccurred())
+		c.InjectError(fake.OperationDelete, key, errors.ErrorResourceUpdateConflict{Identifier: key}, 2)
+		ic := newIPAM(&Client{Backend: c})
+
+		_, drained, err := ic.drainBlock(key.CIDR)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(drained).To(BeTrue())
+		_, err = c.Get(key)
+		Expect(errors.IsNotExist(err)).To(BeTrue())
+	})
+})
+
+// racingClaimBackend is a fake backend which, on the first update of a
+// block, writes the same update first, as if another process on the same
+// host had made the same claim just before us.
+type racingClaimBackend struct {
+	*fakeBlockBackend
+	raced bool
+}
+
+func (r *racingClaimBackend) Update(kvp *model.KVPair) (*model.KVPair, error) {
+	if _, ok := kvp.Key.(model.BlockKey); ok && !r.raced {
+		r.raced = true
+		if _, err := r.fakeBlockBackend.Update(kvp); err != nil {
+			return nil, err
+		}
+	}
+	return r.fakeBlockBackend.Update(kvp)
+}
+
+var _ = Describe("Concurrent block claims by the same host", func() {
+	subnet := cnet.MustParseNetwork("10.0.0.0/26")
+
+	var c *fakeBlockBackend
+	var rw blockReaderWriter
+
+	BeforeEach(func() {
+		c = newFakeBlockBackend()
+		rw = blockReaderWriter{client: &Client{Backend: c}}
+	})
+
+	claimConcurrently := func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				Expect(rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+			}()
+		}
+		wg.Wait()
+
+		blocks, err := c.List(model.BlockListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(blocks).To(HaveLen(1))
+		b := blocks[0].Value.(*model.AllocationBlock)
+		Expect(*b.Affinity).To(Equal("host:host-a"))
+
+		affinities, err := c.List(model.BlockAffinityListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(affinities).To(HaveLen(1))
+		Expect(affinities[0].Key).To(Equal(model.BlockAffinityKey{Host: "host-a", CIDR: subnet}))
+	}
+
+	It("should leave exactly one block and affinity when claiming a new block", func() {
+		claimConcurrently()
+	})
+
+	It("should leave exactly one block and affinity when taking over a retained empty block", func() {
+		_, err := c.Create(&model.KVPair{Key: model.BlockKey{CIDR: subnet}, Value: newBlock(subnet).AllocationBlock})
+		Expect(err).NotTo(HaveOccurred())
+		claimConcurrently()
+	})
+
+	It("should keep the affinity when another process on the host takes over a retained empty block first", func() {
+		_, err := c.Create(&model.KVPair{Key: model.BlockKey{CIDR: subnet}, Value: newBlock(subnet).AllocationBlock})
+		Expect(err).NotTo(HaveOccurred())
+		racing := &racingClaimBackend{fakeBlockBackend: c}
+		rw = blockReaderWriter{client: &Client{Backend: racing}}
+
+		Expect(rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+		Expect(racing.raced).To(BeTrue())
+		_, err = c.Get(model.BlockAffinityKey{Host: "host-a", CIDR: subnet})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should recreate a missing affinity for a block already affine to the host", func() {
+		Expect(rw.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+		Expect(c.Delete(&model.KVPair{Key: model.BlockAffinityKey{Host: "host-a", CIDR: subnet}})).To(Succeed())
+
+		Expect(rw.createAffineBlock(subnet, nil, "host-a", IPAMConfig{})).To(Succeed())
+		_, err := c.Get(model.BlockAffinityKey{Host: "host-a", CIDR: subnet})
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
+
+var _ = Describe("releaseBlockAffinity conflicts", func() {
+	It("should not modify the block it read when an update conflicts", func() {
+		subnet := cnet.MustParseNetwork("10.0.0.0/26")
+		backend := &sharingConflictBackend{fakeBlockBackend: newFakeBlockBackend()}
+		ic := newIPAM(&Client{Backend: backend})
+		Expect(ic.blockReaderWriter.claimBlockAffinity(subnet, "host-a", IPAMConfig{})).To(Succeed())
+		_, err := ic.assignFromExistingBlock(subnet, 1, nil, nil, "host-a", true, false, false)
+		Expect(err).NotTo(HaveOccurred())
+
+		obj, err := backend.Get(model.BlockKey{CIDR: subnet})
+		Expect(err).NotTo(HaveOccurred())
+		expected := obj.Value.(*model.AllocationBlock).Clone()
+		expected.Affinity = nil
+
+		backend.conflicts = 2
+		Expect(ic.blockReaderWriter.releaseBlockAffinity("host-a", subnet)).To(Succeed())
+		Expect(backend.conflicts).To(Equal(0))
+		Expect(backend.modified).To(BeFalse())
+
+		obj, err = backend.Get(model.BlockKey{CIDR: subnet})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.Value).To(Equal(expected))
+	})
+})
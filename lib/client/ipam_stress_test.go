@@ -0,0 +1,131 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+)
+
+var _ = Describe("Concurrent assignment stress", func() {
+	const (
+		numHosts          = 4
+		workersPerHost    = 3
+		iterations        = 40
+		releaseAffEvery   = 7
+		maxAddrsPerAssign = 3
+	)
+
+	var backend *fakeBlockBackend
+	var ic *ipams
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		// A small pool of eight blocks, so that the hosts contend for
+		// blocks and addresses.
+		backend.storePoolWithBlockSize("10.0.0.0/26", 29)
+		ic = newIPAM(&Client{Backend: backend})
+	})
+
+	It("should keep the IPAM data consistent while many hosts assign and release", func() {
+		var lock sync.Mutex
+		held := map[string]string{}
+		failures := []string{}
+		fail := func(format string, args ...interface{}) {
+			lock.Lock()
+			defer lock.Unlock()
+			failures = append(failures, fmt.Sprintf(format, args...))
+		}
+
+		var wg sync.WaitGroup
+		for h := 0; h < numHosts; h++ {
+			for w := 0; w < workersPerHost; w++ {
+				wg.Add(1)
+				go func(host string, worker int, r *rand.Rand) {
+					defer GinkgoRecover()
+					defer wg.Done()
+					for i := 0; i < iterations; i++ {
+						handle := fmt.Sprintf("%s-%d-%d", host, worker, i)
+						ips, _, _ := ic.AutoAssign(AutoAssignArgs{
+							Num4:     1 + r.Intn(maxAddrsPerAssign),
+							HandleID: &handle,
+							Hostname: host,
+						})
+						if len(ips) == 0 {
+							// The pool is full for now.  Otherwise release
+							// whatever was assigned, even on error.
+							continue
+						}
+
+						lock.Lock()
+						for _, ip := range ips {
+							if owner, ok := held[ip.String()]; ok {
+								failures = append(failures, fmt.Sprintf("%s assigned to %s and %s", ip, owner, handle))
+							}
+							held[ip.String()] = handle
+						}
+						lock.Unlock()
+
+						// Stop holding the addresses before they are
+						// released, since they may then be assigned
+						// again at once.
+						lock.Lock()
+						for _, ip := range ips {
+							delete(held, ip.String())
+						}
+						lock.Unlock()
+						if err := ic.ReleaseByHandle(handle); err != nil {
+							fail("releasing %s: %v", handle, err)
+						}
+						if i%releaseAffEvery == releaseAffEvery-1 {
+							if err := ic.ReleaseHostAffinities(host); err != nil {
+								fail("releasing affinities of %s: %v", host, err)
+							}
+						}
+					}
+				}(fmt.Sprintf("host-%d", h), w, rand.New(rand.NewSource(int64(h*workersPerHost+w))))
+			}
+		}
+		wg.Wait()
+		Expect(failures).To(BeEmpty())
+
+		doubles, err := ic.blockReaderWriter.findDoubleAllocations()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(doubles).To(BeEmpty())
+
+		report, err := ic.blockReaderWriter.checkBlockConsistency(false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(report.OrphanedAffinities).To(BeEmpty())
+		Expect(report.OrphanedBlocks).To(BeEmpty())
+		Expect(report.MismatchedAffinities).To(BeEmpty())
+		Expect(report.MismatchedBlocks).To(BeEmpty())
+
+		// Every address was released, so no handles remain.
+		handles, err := backend.List(model.IPAMHandleListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(handles).To(BeEmpty())
+		blocks, err := backend.List(model.BlockListOptions{})
+		Expect(err).NotTo(HaveOccurred())
+		for _, b := range blocks {
+			Expect(allocationBlock{b.Value.(*model.AllocationBlock)}.empty()).To(BeTrue())
+		}
+	})
+})
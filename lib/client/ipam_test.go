@@ -224,6 +224,42 @@ var _ = testutils.E2eDatastoreDescribe("IPAM tests", testutils.DatastoreEtcdV2,
 		})
 	})
 
+	Describe("IPAM AutoAssign with MaxBlocksPerHost", func() {
+		c := testutils.CreateCleanClient(config)
+		ic := c.IPAM()
+		ic.SetIPAMConfig(client.IPAMConfig{
+			StrictAffinity:     false,
+			AutoAllocateBlocks: true,
+			MaxBlocksPerHost:   1,
+		})
+
+		testutils.CreateNewIPPool(*c, "10.0.0.0/24", false, false, true)
+
+		// Fill the first block on the host, then request one more address.
+		// The host is only allowed one affine block, so it must not claim
+		// another.
+		Context("AutoAssign 65 IPs on a host limited to one block", func() {
+			args := client.AutoAssignArgs{
+				Num4:     64,
+				Num6:     0,
+				Hostname: "host-A",
+			}
+			v4, _, outErr := ic.AutoAssign(args)
+			It("should assign a full block of addresses", func() {
+				Expect(outErr).NotTo(HaveOccurred())
+				Expect(len(v4)).To(Equal(64))
+			})
+
+			args.Num4 = 1
+			_, _, outErr = ic.AutoAssign(args)
+			blocks := getAffineBlocks("host-A")
+			It("should not claim a second affine block", func() {
+				Expect(outErr).NotTo(HaveOccurred())
+				Expect(len(blocks)).To(Equal(1))
+			})
+		})
+	})
+
 	Describe("IPAM AutoAssign from different pools", func() {
 		c := testutils.CreateCleanClient(config)
 		ic := setupIPAMClient(c, true)
@@ -15,6 +15,8 @@
 package client
 
 import (
+	"time"
+
 	"github.com/projectcalico/libcalico-go/lib/net"
 )
 
@@ -34,6 +36,17 @@ type AssignIPArgs struct {
 	// will be allocated.  If not specified, this will default
 	// to the value provided by os.Hostname.
 	Hostname string
+
+	// If specified, the ID of the request, which is logged with every line
+	// logged while assigning the address so that the lines can be
+	// correlated, for example with the caller's own logs.  If not
+	// specified, an ID is generated.
+	RequestID string
+
+	// If greater than 0, the address is assigned with a lease which
+	// expires after TTL, so that it is freed by ReleaseExpiredAllocations
+	// if it is not released first.  If 0, the address never expires.
+	TTL time.Duration
 }
 
 // AutoAssignArgs defines the set of arguments for assigning one or more
@@ -64,19 +77,361 @@ type AutoAssignArgs struct {
 	// If specified, the previously configured IPv6 pools from which
 	// to assign IPv6 addresses.  If not specified, this defaults to all IPv6 pools.
 	IPv6Pools []net.IPNet
+
+	// If true, the IPv4 addresses and the IPv6 addresses are each assigned
+	// as a single run of contiguous addresses from one block.  When the
+	// number of addresses is a power of two, the run covers a CIDR.  An
+	// error is returned if no block has a large enough run of free addresses.
+	Contiguous bool
+
+	// If specified, the zone of the host.  When claiming a new block, pools
+	// in the same zone are tried before pools in other zones.
+	Zone string
+
+	// If specified, the ID of the request, which is logged with every line
+	// logged while assigning the addresses so that the lines can be
+	// correlated, for example with the caller's own logs.  If not
+	// specified, an ID is generated.
+	RequestID string
+
+	// If greater than 0, the addresses are assigned with a lease which
+	// expires after TTL, so that they are freed by
+	// ReleaseExpiredAllocations if they are not released first.  If 0, the addresses never expire.
+	TTL time.Duration
+}
+
+// PreferredAssignResult holds the outcome of AssignPreferred.
+type PreferredAssignResult struct {
+	// The preferred addresses that were assigned, in the order they were
+	// preferred.
+	Honored []net.IP
+
+	// The IPv4 addresses that were auto-assigned because too few preferred
+	// IPv4 addresses could be assigned.
+	IPv4 []net.IP
+
+	// The IPv6 addresses that were auto-assigned because too few preferred
+	// IPv6 addresses could be assigned.
+	IPv6 []net.IP
+}
+
+// HandleInfo summarizes the addresses assigned with a handle.
+type HandleInfo struct {
+	HandleID string
+
+	// The number of addresses assigned with the handle.
+	NumIPs int
+
+	// The number of blocks the addresses are assigned from.
+	NumBlocks int
+
+	// The IP versions of the addresses, in ascending order.
+	IPVersions []int
+}
+
+// DualStackAssignResult holds the outcome of a dual-stack assignment.  The
+// addresses assigned for one IP version are returned even if assignment for
+// the other IP version failed.
+type DualStackAssignResult struct {
+	// The assigned IPv4 addresses.
+	IPv4 []net.IP
+
+	// The error assigning IPv4 addresses, if fewer than the requested
+	// number could be assigned.
+	IPv4Error error
+
+	// The assigned IPv6 addresses.
+	IPv6 []net.IP
+
+	// The error assigning IPv6 addresses, if fewer than the requested
+	// number could be assigned.
+	IPv6Error error
+}
+
+// IPNets returns the assigned IPv4 and IPv6 addresses collapsed into the
+// smallest sets of CIDRs that cover them, which is the compact form for
+// programming routes to contiguous assignments.
+func (r DualStackAssignResult) IPNets() ([]net.IPNet, []net.IPNet) {
+	return net.CollapseToIPNets(r.IPv4), net.CollapseToIPNets(r.IPv6)
+}
+
+// AssignedIP describes an address assigned by AutoAssignWithResult or
+// AssignIPWithResult, or listed by ListAssignedIPs.  Apart from its
+// encapsulation, it is recorded from the block as the address is assigned, so
+// describing an address never needs another read.
+type AssignedIP struct {
+	IP net.IP
+
+	// The IP pool the block was claimed from.  It is unset if the block
+	// was claimed before blocks recorded their pool.
+	Pool net.IPNet
+
+	// The block the address was assigned from.
+	Block net.IPNet
+
+	// The handle the address was assigned with, if any.
+	HandleID *string
+
+	// Whether the block was claimed for the host to assign the address,
+	// rather than the address being assigned from an existing block.
+	ClaimedBlock bool
+
+	// The encapsulation used to route to the address, from its pool.  It
+	// is unset if the pool could not be read, for example because the pool
+	// was disabled just after the address was assigned.
+	Encap EncapMode
+}
+
+// AssignmentResult holds the outcome of AutoAssignWithResult or
+// AssignIPWithResult.
+type AssignmentResult struct {
+	// The assigned IPv4 addresses.
+	IPv4 []AssignedIP
+
+	// The assigned IPv6 addresses.
+	IPv6 []AssignedIP
 }
 
+// IPs returns just the assigned IPv4 and IPv6 addresses, as returned by
+// AutoAssign.
+func (r AssignmentResult) IPs() ([]net.IP, []net.IP) {
+	return assignedIPs(r.IPv4), assignedIPs(r.IPv6)
+}
+
+// assignedIPs returns just the addresses of the given assignments.
+func assignedIPs(assigned []AssignedIP) []net.IP {
+	if assigned == nil {
+		return nil
+	}
+	ips := []net.IP{}
+	for _, a := range assigned {
+		ips = append(ips, a.IP)
+	}
+	return ips
+}
+
+// AssignmentStrategy determines the order in which a host walks the blocks
+// of an IP pool when looking for a new block to claim.
+type AssignmentStrategy string
+
+const (
+	// AssignmentStrategyRandom walks the blocks in a pool starting from a
+	// random, host-specific offset.  This reduces contention between hosts
+	// claiming blocks at the same time, and is recommended for large clusters.
+	AssignmentStrategyRandom AssignmentStrategy = "random"
+
+	// AssignmentStrategySequential walks the blocks in a pool in order,
+	// starting from the first block in the pool.
+	AssignmentStrategySequential AssignmentStrategy = "sequential"
+)
+
+// AssignOrder determines which of a block's free addresses are assigned
+// first.
+type AssignOrder string
+
+const (
+	// AssignOrderLowest assigns the free address with the lowest ordinal
+	// in the block first.
+	AssignOrderLowest AssignOrder = "lowest"
+
+	// AssignOrderHighest assigns the free address with the highest ordinal
+	// in the block first, leaving the low addresses free for longest.
+	AssignOrderHighest AssignOrder = "highest"
+
+	// AssignOrderRandom assigns the block's free addresses in a random
+	// order.
+	AssignOrderRandom AssignOrder = "random"
+)
+
+// PoolDistribution determines how a host's new blocks are spread across the
+// IP pools it may claim blocks from.
+type PoolDistribution string
+
+const (
+	// PoolDistributionSequential claims blocks from the pools in order of
+	// their CIDRs, lowest first, only moving on to the next pool once every
+	// block in the previous pool has been claimed.
+	PoolDistributionSequential PoolDistribution = "sequential"
+
+	// PoolDistributionBalanced claims each block from the pool with the
+	// most free blocks, so that successive claims are spread across the
+	// pools in proportion to their remaining capacity.  Hosts still assign
+	// from their affine blocks before claiming a new block, whichever pools
+	// the blocks are in.  Pools with the same number of free blocks are
+	// tried lowest CIDR first.
+	PoolDistributionBalanced PoolDistribution = "balanced"
+
+	// PoolDistributionPriority claims blocks from the pools in order of
+	// their Priority, highest first, and otherwise like
+	// PoolDistributionSequential.  Pools with the same priority are tried
+	// lowest CIDR first.
+	PoolDistributionPriority PoolDistribution = "priority"
+)
+
+// EncapMode is the encapsulation used to route to the addresses of an IP
+// pool.
+type EncapMode string
+
+const (
+	// EncapNone routes to the pool's addresses without encapsulation.
+	EncapNone EncapMode = "none"
+
+	// EncapIPIPAlways uses IPIP to route to the pool's addresses on every
+	// other node.
+	EncapIPIPAlways EncapMode = "ipip-always"
+
+	// EncapIPIPCrossSubnet uses IPIP to route to the pool's addresses only
+	// on nodes in a different subnet to the originating node.
+	EncapIPIPCrossSubnet EncapMode = "ipip-cross-subnet"
+)
+
 // IPAMConfig contains global configuration options for Calico IPAM.
 // This IPAM configuration is stored in the datastore and configures the behavior
 // of Calico IPAM across an entire Calico cluster.
+//
+// Only Retry, AssignOrder, PoolDistribution, RetainEmptyBlocks,
+// EmptyBlockLinger, UniqueHandles, RequiredAttributes, AutoCreateDefaultPool,
+// DefaultPoolCIDR, DestructiveOpsAllowed and BulkConcurrency may be changed
+// while allocations exist, since they do not affect existing allocations.
 type IPAMConfig struct {
 	// When StrictAffinity is true, addresses from a given block can only be
 	// assigned by hosts with the blocks affinity.  If false, then AutoAllocateBlocks
-	// must be true.  The default value is false.
+	// must be true.  The default value is false.  Each block records the
+	// value when it is claimed, and it is the block's own value that is
+	// enforced, so changing it does not affect existing blocks until they
+	// are updated with SetBlockStrictAffinity.  It also stops a host which
+	// has run out of affine blocks from looking for addresses in other
+	// blocks.
 	StrictAffinity bool
 
 	// When AutoAllocateBlocks is true, Calico will automatically
 	// allocate blocks of IP address to hosts as needed to assign addresses.
 	// If false, then StrictAffinity must be true.  The default value is true.
 	AutoAllocateBlocks bool
+
+	// MaxBlocksPerHost is the maximum number of blocks of each IP version
+	// that a single host may claim affinity for.  Once the limit is reached
+	// the host may only assign from non-affine blocks, and only if
+	// StrictAffinity is false.  A value of 0 means there is no limit.
+	MaxBlocksPerHost int
+
+	// AssignmentStrategy determines the order in which blocks are claimed
+	// from an IP pool.  If not specified, AssignmentStrategyRandom is used.
+	AssignmentStrategy AssignmentStrategy
+
+	// AssignOrder determines which of a block's free addresses are assigned
+	// first.  If not specified, addresses are assigned in the order they
+	// became free, which is lowest first for a new block, followed by
+	// released addresses in the order they were released.
+	AssignOrder AssignOrder
+
+	// PoolDistribution determines how new blocks are spread across the
+	// pools a host may claim blocks from.  Pools which prefer the host,
+	// then pools in the host's zone, are always tried first.  If not
+	// specified, PoolDistributionSequential is used.
+	PoolDistribution PoolDistribution
+
+	// Retry controls how IPAM operations are retried when an update
+	// conflicts with an update from another client.
+	Retry RetryConfig
+
+	// When RetainEmptyBlocks is true, empty blocks are kept, and releasing
+	// a block's affinity only removes the affinity.  A kept block is reused
+	// by the next host to claim it, which avoids repeatedly deleting and
+	// re-creating blocks when workloads churn.  If false, the default,
+	// blocks are deleted once they are empty and no longer affine to a
+	// host.
+	RetainEmptyBlocks bool
+
+	// When UniqueHandles is true, a handle may only be used to assign
+	// addresses by the host that first assigned addresses with it, and an
+	// assignment on any other host returns a handleInUseError, so that
+	// releasing the handle cannot release another workload's addresses.
+	// The host that owns a handle may assign further addresses with it.  The
+	// default value is false, allowing handles to be shared.
+	UniqueHandles bool
+
+	// RequiredAttributes lists the attribute keys that every assignment
+	// must supply.  An assignment whose attributes lack any of them returns
+	// a missingAttributesError, and while any are required, an attribute
+	// value longer than maxAttributeValueLength returns an
+	// attributeTooLongError.  The default is to require no attributes.
+	RequiredAttributes []string
+
+	// IPv4BlockSize is the prefix length of the blocks claimed from IPv4
+	// pools, and must be between 20 and 32.  IPv6BlockSize is the prefix
+	// length of the blocks claimed from IPv6 pools, and must be between
+	// 116 and 128.  A value of 0 selects the default of /26 for IPv4 and
+	// /122 for IPv6.  Pools smaller than a block form a single block.
+	IPv4BlockSize int
+	IPv6BlockSize int
+
+	// When AutoCreateDefaultPool is true and no IP pools exist, the first
+	// assignment of an address of the same IP version as DefaultPoolCIDR
+	// creates a pool with that CIDR and assigns from it.  AssignIP only
+	// creates the pool for an address within it.  If DefaultPoolCIDR is nil,
+	// 192.168.0.0/16 is used.  If several hosts assign at the same
+	// time, only one of them creates the pool.  The default value is false,
+	// so that pools are only created explicitly.
+	AutoCreateDefaultPool bool
+	DefaultPoolCIDR       *net.IPNet
+
+	// When DestructiveOpsAllowed is false, DrainPool, Compact and
+	// ForceReleaseBlockAffinity fail with a destructiveOpsDisabledError, as
+	// do ImportPoolState and DeletePoolBlocks when forced, since each can
+	// free addresses or blocks that may still be in use.  No other
+	// operation checks it, so releasing addresses with ReleaseIPs or
+	// ReleaseByHandle is not affected.  The default value is false.
+	DestructiveOpsAllowed bool
+
+	// BulkConcurrency is the number of blocks which the bulk operations,
+	// such as claiming the blocks of a CIDR or draining a pool, read and
+	// write at once.  It is bounded so that a large operation does not
+	// overwhelm the datastore.  The default value of 0 uses a small
+	// default.
+	BulkConcurrency int
+
+	// EmptyBlockLinger is how long a host keeps the affinity for a block
+	// after its last address is released, so that a workload restarting on
+	// the host reuses the block rather than the block being deleted and
+	// claimed again.  Empty blocks are released by ReleaseLingeringBlocks,
+	// which skips a block until its linger has expired.  The default value
+	// of 0 lets empty blocks be released at once.
+	EmptyBlockLinger time.Duration
+}
+
+// RetryConfig controls how IPAM operations are retried when an update to the
+// datastore conflicts with an update from another client.  Zero values use
+// the defaults.
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of attempts made at an update
+	// before giving up.  The default is 100.
+	MaxAttempts int
+
+	// BaseBackoff is the delay before the first retry.  The delay doubles
+	// for each subsequent retry, up to MaxBackoff.  The default is to retry
+	// immediately.
+	BaseBackoff time.Duration
+
+	// MaxBackoff is the maximum delay between retries.  The default is 5
+	// seconds.
+	MaxBackoff time.Duration
+
+	// Jitter is the fraction, between 0 and 1, by which each delay is
+	// randomly varied to avoid clients retrying in lock step.  The default
+	// is no jitter.
+	Jitter float64
+
+	// Timeout bounds the time spent retrying an update, measured from its
+	// first attempt.  A retry is not started if its backoff would end after
+	// the timeout, and the update fails with the last conflict instead, so
+	// an update never stops part way through an attempt.  Each datastore
+	// call within an attempt is bounded only by the datastore client's own
+	// request timeout, since the datastore API does not take a deadline.
+	// The default is no timeout, so only MaxAttempts limits the retries.
+	Timeout time.Duration
+
+	// deadline is the time by which each attempt of the update being
+	// retried must start, set by start.
+	deadline time.Time
 }
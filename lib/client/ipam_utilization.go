@@ -0,0 +1,103 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"sort"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/errors"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// BlockUtil describes how much of a block is in use.
+type BlockUtil struct {
+	CIDR cnet.IPNet
+
+	// Allocated is the number of addresses allocated from the block, and
+	// Capacity the number of addresses in the block.
+	Allocated int
+	Capacity  int
+}
+
+// blocksByUtilization returns the utilization of the blocks of the given IP
+// version, ordered from the least utilized to the most utilized, or the
+// reverse if fullestFirst is set.  Blocks with the same utilization are
+// ordered by CIDR.  If a pool is given, only the blocks within it are
+// included, and if limit is greater than 0, only the first limit blocks are
+// returned.  The blocks are listed a page at a time.
+func (rw blockReaderWriter) blocksByUtilization(pool *cnet.IPNet, version ipVersion, limit int, fullestFirst bool) ([]BlockUtil, error) {
+	opts := model.BlockListOptions{IPVersion: version.Number}
+	if pool != nil {
+		opts.Pool = *pool
+	}
+
+	utils := []BlockUtil{}
+	token := ""
+	for {
+		page, next, err := rw.client.Backend.ListPage(opts, ipamListPageSize, token)
+		if err != nil {
+			if errors.IsNotExist(err) {
+				break
+			}
+			rw.requestLog().WithField("version", version.Number).WithError(err).Error("Error listing blocks")
+			return nil, err
+		}
+		for _, kvp := range page {
+			utils = append(utils, blockUtil(kvp.Value.(*model.AllocationBlock)))
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	if fullestFirst {
+		sort.Sort(sort.Reverse(blockUtilsByUtilization(utils)))
+	} else {
+		sort.Sort(blockUtilsByUtilization(utils))
+	}
+	if limit > 0 && len(utils) > limit {
+		utils = utils[:limit]
+	}
+	return utils, nil
+}
+
+// blockUtil returns the utilization of the block.
+func blockUtil(b *model.AllocationBlock) BlockUtil {
+	u := BlockUtil{CIDR: b.CIDR, Capacity: len(b.Allocations)}
+	for _, a := range b.Allocations {
+		if a != nil {
+			u.Allocated++
+		}
+	}
+	return u
+}
+
+// blockUtilsByUtilization sorts blocks by the fraction of their addresses
+// which are allocated, least first, and then by CIDR.
+type blockUtilsByUtilization []BlockUtil
+
+func (s blockUtilsByUtilization) Len() int      { return len(s) }
+func (s blockUtilsByUtilization) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s blockUtilsByUtilization) Less(i, j int) bool {
+	// Compare Allocated/Capacity without dividing.
+	li := s[i].Allocated * s[j].Capacity
+	lj := s[j].Allocated * s[i].Capacity
+	if li != lj {
+		return li < lj
+	}
+	return compareCIDRs(s[i].CIDR, s[j].CIDR) < 0
+}
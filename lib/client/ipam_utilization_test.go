@@ -0,0 +1,96 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+var _ = Describe("blocksByUtilization", func() {
+	var rw blockReaderWriter
+
+	// storeBlock stores a block with the first num of its addresses
+	// allocated.
+	var storeBlock func(cidr string, num int)
+
+	BeforeEach(func() {
+		backend := newFakeBlockBackend()
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+		storeBlock = func(cidr string, num int) {
+			b := newBlock(cnet.MustParseNetwork(cidr))
+			b.autoAssign(num, nil, "host-a", nil, false, false, nil, "")
+			backend.store(&model.KVPair{Key: model.BlockKey{CIDR: b.CIDR}, Value: b.AllocationBlock})
+		}
+		storeBlock("10.0.0.0/26", 32)
+		storeBlock("10.0.0.64/26", 2)
+		storeBlock("10.0.0.128/28", 8)
+		storeBlock("10.0.1.0/26", 60)
+		storeBlock("fd00::/122", 1)
+	})
+
+	summarize := func(utils []BlockUtil) []string {
+		s := []string{}
+		for _, u := range utils {
+			s = append(s, u.CIDR.String())
+		}
+		return s
+	}
+
+	It("should order the blocks from least to most utilized", func() {
+		utils, err := rw.blocksByUtilization(nil, ipv4, 0, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summarize(utils)).To(Equal([]string{"10.0.0.64/26", "10.0.0.0/26", "10.0.0.128/28", "10.0.1.0/26"}))
+		Expect(utils[0]).To(Equal(BlockUtil{CIDR: cnet.MustParseNetwork("10.0.0.64/26"), Allocated: 2, Capacity: 64}))
+		Expect(utils[2].Capacity).To(Equal(16))
+	})
+
+	It("should return the most utilized blocks first", func() {
+		utils, err := rw.blocksByUtilization(nil, ipv4, 2, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summarize(utils)).To(Equal([]string{"10.0.1.0/26", "10.0.0.128/28"}))
+	})
+
+	It("should limit the result to the least utilized blocks", func() {
+		utils, err := rw.blocksByUtilization(nil, ipv4, 1, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summarize(utils)).To(Equal([]string{"10.0.0.64/26"}))
+	})
+
+	It("should only include blocks within the pool", func() {
+		pool := cnet.MustParseNetwork("10.0.1.0/24")
+		utils, err := rw.blocksByUtilization(&pool, ipv4, 0, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summarize(utils)).To(Equal([]string{"10.0.1.0/26"}))
+
+		utils, err = rw.blocksByUtilization(nil, ipv6, 0, false)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summarize(utils)).To(Equal([]string{"fd00::/122"}))
+	})
+
+	It("should return the utilization of a pool through the IPAM interface", func() {
+		var ic IPAMInterface = newIPAM(rw.client)
+		utils, err := ic.GetUtilization(cnet.MustParseNetwork("10.0.0.0/24"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summarize(utils)).To(Equal([]string{"10.0.0.64/26", "10.0.0.0/26", "10.0.0.128/28"}))
+
+		utils, err = ic.GetUtilization(cnet.MustParseNetwork("fd00::/120"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summarize(utils)).To(Equal([]string{"fd00::/122"}))
+	})
+})
@@ -20,6 +20,7 @@ import (
 	"github.com/projectcalico/libcalico-go/lib/api/unversioned"
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
 	"github.com/projectcalico/libcalico-go/lib/ipip"
+	"github.com/projectcalico/libcalico-go/lib/net"
 )
 
 // PoolInterface has methods to work with Pool resources.
@@ -42,18 +43,30 @@ func newIPPools(c *Client) IPPoolInterface {
 	return &ipPools{c}
 }
 
-// Create creates a new IP pool.
+// Create creates a new IP pool.  Its block size must match any blocks left
+// within its CIDR by a deleted pool.
 func (h *ipPools) Create(a *api.IPPool) (*api.IPPool, error) {
+	a.Metadata.CIDR = poolNetwork(a.Metadata.CIDR)
+	if err := h.checkBlockSize(a); err != nil {
+		return a, err
+	}
 	err := h.c.create(*a, h)
+	h.c.ipPoolCache.invalidate()
 	if err == nil {
 		err = h.maybeEnableIPIP(a)
 	}
 	return a, err
 }
 
-// Update updates an existing IP pool.
+// Update updates an existing IP pool.  The block size of a pool can't be
+// changed once blocks have been allocated from it.
 func (h *ipPools) Update(a *api.IPPool) (*api.IPPool, error) {
+	a.Metadata.CIDR = poolNetwork(a.Metadata.CIDR)
+	if err := h.checkBlockSize(a); err != nil {
+		return a, err
+	}
 	err := h.c.update(*a, h)
+	h.c.ipPoolCache.invalidate()
 	if err == nil {
 		err = h.maybeEnableIPIP(a)
 	}
@@ -62,14 +75,21 @@ func (h *ipPools) Update(a *api.IPPool) (*api.IPPool, error) {
 
 // Apply updates an IP pool if it exists, or creates a new pool if it does not exist.
 func (h *ipPools) Apply(a *api.IPPool) (*api.IPPool, error) {
+	a.Metadata.CIDR = poolNetwork(a.Metadata.CIDR)
+	if err := h.checkBlockSize(a); err != nil {
+		return a, err
+	}
 	err := h.c.apply(*a, h)
+	h.c.ipPoolCache.invalidate()
 	if err == nil {
 		err = h.maybeEnableIPIP(a)
 	}
 	return a, err
 }
 
-// Delete deletes an existing IP pool.
+// Delete deletes an existing IP pool.  The blocks allocated from the pool are
+// not deleted, use IPAM().DeletePoolBlocks to delete them once the addresses
+// in the pool have been released.
 func (h *ipPools) Delete(metadata api.IPPoolMetadata) error {
 	// Deleting a pool requires a little care because of existing endpoints
 	// using IP addresses allocated in the pool.  We do the deletion in
@@ -80,6 +100,7 @@ func (h *ipPools) Delete(metadata api.IPPoolMetadata) error {
 
 	// Start by getting the current pool data and then setting the disabled
 	// flag.
+	metadata.CIDR = poolNetwork(metadata.CIDR)
 	if pool, err := h.Get(metadata); err != nil {
 		return err
 	} else {
@@ -99,7 +120,9 @@ func (h *ipPools) Delete(metadata api.IPPoolMetadata) error {
 
 	// And finally, delete the pool.
 	log.Debugf("Deleting pool %s", metadata.CIDR)
-	return h.c.delete(metadata, h)
+	err = h.c.delete(metadata, h)
+	h.c.ipPoolCache.invalidate()
+	return err
 }
 
 // Get returns information about a particular IP pool.
@@ -119,12 +142,35 @@ func (h *ipPools) List(metadata api.IPPoolMetadata) (*api.IPPoolList, error) {
 	return l, err
 }
 
+// checkBlockSize returns an error if blocks of a different size from the
+// pool's block size already exist within the pool.
+func (h *ipPools) checkBlockSize(a *api.IPPool) error {
+	if a.Metadata.CIDR.IP == nil {
+		// Left for validation to reject.
+		return nil
+	}
+	return newIPAM(h.c).blockReaderWriter.checkPoolBlockSize(*a)
+}
+
+// poolNetwork returns the network address of the pool CIDR, so that a pool
+// given with host bits set, such as 10.0.0.5/24, is treated as 10.0.0.0/24.
+// Blocks are walked from the pool's base address, so this must be masked.
+func poolNetwork(cidr net.IPNet) net.IPNet {
+	if cidr.IP == nil {
+		return cidr
+	}
+	if n := cidr.Network(); n != nil {
+		return *n
+	}
+	return cidr
+}
+
 // convertMetadataToListInterface converts an IPPoolMetadata to an IPPoolListOptions.
 // This is part of the conversionHelper interface.
 func (h *ipPools) convertMetadataToListInterface(m unversioned.ResourceMetadata) (model.ListInterface, error) {
 	pm := m.(api.IPPoolMetadata)
 	l := model.IPPoolListOptions{
-		CIDR: pm.CIDR,
+		CIDR: poolNetwork(pm.CIDR),
 	}
 	return l, nil
 }
@@ -134,7 +180,7 @@ func (h *ipPools) convertMetadataToListInterface(m unversioned.ResourceMetadata)
 func (h *ipPools) convertMetadataToKey(m unversioned.ResourceMetadata) (model.Key, error) {
 	pm := m.(api.IPPoolMetadata)
 	k := model.IPPoolKey{
-		CIDR: pm.CIDR,
+		CIDR: poolNetwork(pm.CIDR),
 	}
 	return k, nil
 }
@@ -164,12 +210,19 @@ func (h *ipPools) convertAPIToKVPair(a unversioned.Resource) (*model.KVPair, err
 	d := model.KVPair{
 		Key: k,
 		Value: &model.IPPool{
-			CIDR:          ap.Metadata.CIDR,
-			IPIPInterface: ipipInterface,
-			IPIPMode:      ipipMode,
-			Masquerade:    ap.Spec.NATOutgoing,
-			IPAM:          !ap.Spec.Disabled,
-			Disabled:      ap.Spec.Disabled,
+			CIDR:              poolNetwork(ap.Metadata.CIDR),
+			IPIPInterface:     ipipInterface,
+			IPIPMode:          ipipMode,
+			Masquerade:        ap.Spec.NATOutgoing,
+			IPAM:              !ap.Spec.Disabled,
+			Disabled:          ap.Spec.Disabled,
+			PreferredHosts:    ap.Spec.PreferredHosts,
+			BlockSize:         ap.Spec.BlockSize,
+			ExcludedCIDRs:     ap.Spec.ExcludedCIDRs,
+			ReservedAddresses: ap.Spec.ReservedAddresses,
+			NodeSelector:      ap.Spec.NodeSelector,
+			Zone:              ap.Spec.Zone,
+			Priority:          ap.Spec.Priority,
 		},
 	}
 
@@ -183,9 +236,16 @@ func (h *ipPools) convertKVPairToAPI(d *model.KVPair) (unversioned.Resource, err
 	backendPool := d.Value.(*model.IPPool)
 
 	apiPool := api.NewIPPool()
-	apiPool.Metadata.CIDR = backendPool.CIDR
+	apiPool.Metadata.CIDR = poolNetwork(backendPool.CIDR)
 	apiPool.Spec.NATOutgoing = backendPool.Masquerade
 	apiPool.Spec.Disabled = backendPool.Disabled
+	apiPool.Spec.PreferredHosts = backendPool.PreferredHosts
+	apiPool.Spec.BlockSize = backendPool.BlockSize
+	apiPool.Spec.ExcludedCIDRs = backendPool.ExcludedCIDRs
+	apiPool.Spec.ReservedAddresses = backendPool.ReservedAddresses
+	apiPool.Spec.NodeSelector = backendPool.NodeSelector
+	apiPool.Spec.Zone = backendPool.Zone
+	apiPool.Spec.Priority = backendPool.Priority
 
 	// If any IPIP configuration is present then include the IPIP spec..
 	if backendPool.IPIPInterface != "" || backendPool.IPIPMode != ipip.Undefined {
@@ -0,0 +1,149 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/api"
+	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/ipip"
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+var _ = Describe("IP pool with host bits set", func() {
+	sloppy := cnet.MustParseCIDR("10.0.0.5/24")
+	network := cnet.MustParseNetwork("10.0.0.0/24")
+
+	var backend *fakeBlockBackend
+	var client *Client
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		client = &Client{Backend: backend}
+		pool := api.NewIPPool()
+		pool.Metadata.CIDR = sloppy
+		created, err := client.IPPools().Create(pool)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(created.Metadata.CIDR).To(Equal(network))
+	})
+
+	It("should store the pool under its network address", func() {
+		obj, err := backend.Get(model.IPPoolKey{CIDR: network})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(obj.Value.(*model.IPPool).CIDR).To(Equal(network))
+	})
+
+	It("should get and list the pool by either form of its CIDR", func() {
+		for _, cidr := range []cnet.IPNet{sloppy, network} {
+			pool, err := client.IPPools().Get(api.IPPoolMetadata{CIDR: cidr})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pool.Metadata.CIDR).To(Equal(network))
+
+			pools, err := client.IPPools().List(api.IPPoolMetadata{CIDR: cidr})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pools.Items).To(HaveLen(1))
+			Expect(pools.Items[0].Metadata.CIDR).To(Equal(network))
+		}
+	})
+
+	It("should read a pool stored with host bits set as its network", func() {
+		backend.store(&model.KVPair{
+			Key:   model.IPPoolKey{CIDR: network},
+			Value: &model.IPPool{CIDR: sloppy, IPAM: true},
+		})
+		pool, err := client.IPPools().Get(api.IPPoolMetadata{CIDR: network})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pool.Metadata.CIDR).To(Equal(network))
+	})
+
+	It("should assign from blocks within the pool's network", func() {
+		rw := blockReaderWriter{client: client}
+		Expect(rw.withinConfiguredPools(cnet.MustParseIP("10.0.0.1"))).To(BeTrue())
+		Expect(rw.withinConfiguredPools(cnet.MustParseIP("10.0.1.1"))).To(BeFalse())
+
+		b, err := rw.claimNewAffineBlock("host-a", "", ipv4, []cnet.IPNet{sloppy}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(b.String()).To(Equal("10.0.0.0/26"))
+	})
+})
+
+var _ = Describe("encapForIP", func() {
+	var backend *fakeBlockBackend
+	var rw blockReaderWriter
+
+	storePool := func(cidr, ipipInterface string, mode ipip.Mode) {
+		pool := cnet.MustParseNetwork(cidr)
+		backend.store(&model.KVPair{
+			Key:   model.IPPoolKey{CIDR: pool},
+			Value: &model.IPPool{CIDR: pool, IPAM: true, IPIPInterface: ipipInterface, IPIPMode: mode},
+		})
+	}
+
+	BeforeEach(func() {
+		backend = newFakeBlockBackend()
+		rw = blockReaderWriter{client: &Client{Backend: backend}}
+		storePool("10.0.0.0/24", "", ipip.Undefined)
+		storePool("10.0.1.0/24", "tunl0", ipip.Undefined)
+		storePool("10.0.2.0/24", "tunl0", ipip.Always)
+		storePool("10.0.3.0/24", "tunl0", ipip.CrossSubnet)
+		// A mode without IPIP enabled does not encapsulate.
+		storePool("10.0.4.0/24", "", ipip.CrossSubnet)
+		// A more specific pool within an IPIP pool.
+		storePool("10.0.2.128/25", "", ipip.Undefined)
+	})
+
+	DescribeTable("should return the encapsulation of the pool containing the IP",
+		func(ip string, expected EncapMode) {
+			mode, err := rw.encapForIP(cnet.MustParseIP(ip))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mode).To(Equal(expected))
+		},
+		Entry("no IPIP", "10.0.0.1", EncapNone),
+		Entry("IPIP with the default mode", "10.0.1.1", EncapIPIPAlways),
+		Entry("IPIP always", "10.0.2.1", EncapIPIPAlways),
+		Entry("IPIP cross-subnet", "10.0.3.1", EncapIPIPCrossSubnet),
+		Entry("IPIP mode without IPIP enabled", "10.0.4.1", EncapNone),
+		Entry("most specific pool", "10.0.2.129", EncapNone),
+	)
+
+	It("should describe the encapsulation of each assigned address", func() {
+		ic := newIPAM(&Client{Backend: backend})
+		result, err := ic.AutoAssignWithResult(AutoAssignArgs{
+			Num4:      2,
+			Hostname:  "host-a",
+			IPv4Pools: []cnet.IPNet{cnet.MustParseNetwork("10.0.3.0/24")},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPv4).To(HaveLen(2))
+		for _, a := range result.IPv4 {
+			Expect(a.Encap).To(Equal(EncapIPIPCrossSubnet))
+		}
+
+		result, err = ic.AssignIPWithResult(AssignIPArgs{IP: cnet.MustParseIP("10.0.2.5"), Hostname: "host-a"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.IPv4[0].Encap).To(Equal(EncapIPIPAlways))
+	})
+
+	It("should return a notInAnyPoolError for an IP in no enabled pool", func() {
+		backend.storePool("10.0.5.0/24", true)
+		for _, ip := range []string{"10.0.5.1", "10.1.0.1"} {
+			_, err := rw.encapForIP(cnet.MustParseIP(ip))
+			Expect(err).To(Equal(notInAnyPoolError{IP: cnet.MustParseIP(ip)}))
+		}
+	})
+})
@@ -6,6 +6,7 @@ import (
 	"net"
 
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
 	. "github.com/onsi/gomega"
 	cnet "github.com/projectcalico/libcalico-go/lib/net"
 )
@@ -22,6 +23,101 @@ var _ = Describe("Random Block Generator", func() {
 
 })
 
+var _ = Describe("Block generator strategies", func() {
+	pool := cnet.MustParseNetwork("10.10.0.0/24")
+
+	collect := func(blocks func() *cnet.IPNet) []string {
+		cidrs := []string{}
+		for blk := blocks(); blk != nil; blk = blocks() {
+			cidrs = append(cidrs, blk.String())
+		}
+		return cidrs
+	}
+
+	It("should walk the pool in order for the sequential strategy", func() {
+		blocks := newBlockGenerator(AssignmentStrategySequential, pool, 26, "testHost")
+		Expect(collect(blocks)).To(Equal([]string{
+			"10.10.0.0/26", "10.10.0.64/26", "10.10.0.128/26", "10.10.0.192/26",
+		}))
+	})
+
+	It("should match the seeded random generator for the random strategy", func() {
+		blocks := newBlockGenerator(AssignmentStrategyRandom, pool, 26, "testHost")
+		Expect(collect(blocks)).To(Equal(collect(randomBlockGenerator(pool, 26, "testHost"))))
+	})
+
+	It("should default to the random strategy", func() {
+		blocks := newBlockGenerator("", pool, 26, "testHost")
+		Expect(collect(blocks)).To(Equal(collect(randomBlockGenerator(pool, 26, "testHost"))))
+	})
+
+	It("should return every block exactly once for the random strategy", func() {
+		blocks := newBlockGenerator(AssignmentStrategyRandom, pool, 26, "testHost")
+		Expect(collect(blocks)).To(ConsistOf(
+			"10.10.0.0/26", "10.10.0.64/26", "10.10.0.128/26", "10.10.0.192/26",
+		))
+	})
+
+	It("should skip existing blocks when only unclaimed blocks are wanted", func() {
+		existing := []cnet.IPNet{
+			cnet.MustParseNetwork("10.10.0.64/26"),
+			cnet.MustParseNetwork("10.10.0.192/26"),
+		}
+		blocks := unclaimedBlockGenerator(newBlockGenerator(AssignmentStrategySequential, pool, 26, "testHost"), existing)
+		Expect(collect(blocks)).To(Equal([]string{"10.10.0.0/26", "10.10.0.128/26"}))
+
+		random := collect(randomBlockGenerator(pool, 26, "testHost"))
+		unclaimed := collect(unclaimedBlockGenerator(randomBlockGenerator(pool, 26, "testHost"), existing))
+		Expect(unclaimed).To(HaveLen(2))
+		Expect(random).To(ContainElement(unclaimed[0]))
+		Expect(unclaimed).NotTo(ContainElement("10.10.0.64/26"))
+		Expect(unclaimed).NotTo(ContainElement("10.10.0.192/26"))
+	})
+})
+
+var _ = DescribeTable("Block generators with awkward pool sizes",
+	func(pool cnet.IPNet, expected []string) {
+		prefix := getIPVersion(cnet.IP{pool.IP}).BlockPrefixLength
+		for _, blocks := range []func() *cnet.IPNet{
+			blockGenerator(pool, prefix),
+			randomBlockGenerator(pool, prefix, "testHost"),
+		} {
+			cidrs := []string{}
+			for blk := blocks(); blk != nil; blk = blocks() {
+				cidrs = append(cidrs, blk.String())
+			}
+			Expect(cidrs).To(ConsistOf(expected))
+		}
+	},
+	Entry("IPv4 pool of exactly one block", cnet.MustParseNetwork("10.0.0.0/26"), []string{"10.0.0.0/26"}),
+	Entry("IPv4 pool smaller than a block", cnet.MustParseNetwork("10.0.0.32/27"), []string{"10.0.0.32/27"}),
+	Entry("IPv4 pool of a single address", cnet.MustParseNetwork("10.0.0.7/32"), []string{"10.0.0.7/32"}),
+	Entry("IPv4 pool with unmasked address", cnet.MustParseCIDR("10.0.0.5/25"), []string{"10.0.0.0/26", "10.0.0.64/26"}),
+	Entry("IPv4 pool with unmasked address in its last block", cnet.MustParseCIDR("10.0.0.200/24"), []string{"10.0.0.0/26", "10.0.0.64/26", "10.0.0.128/26", "10.0.0.192/26"}),
+	Entry("IPv6 pool with unmasked address", cnet.MustParseCIDR("fd80:24e2:f998:72d6::41/121"), []string{"fd80:24e2:f998:72d6::/122", "fd80:24e2:f998:72d6::40/122"}),
+	Entry("IPv6 pool smaller than a block", cnet.MustParseNetwork("fd80:24e2:f998:72d6::8/125"), []string{"fd80:24e2:f998:72d6::8/125"}),
+	Entry("IPv6 pool of two blocks", cnet.MustParseNetwork("fd80:24e2:f998:72d6::/121"), []string{"fd80:24e2:f998:72d6::/122", "fd80:24e2:f998:72d6::40/122"}),
+)
+
+var _ = DescribeTable("Block generators with a configured block prefix length",
+	func(pool cnet.IPNet, prefix int, expected []string) {
+		for _, blocks := range []func() *cnet.IPNet{
+			blockGenerator(pool, prefix),
+			randomBlockGenerator(pool, prefix, "testHost"),
+		} {
+			cidrs := []string{}
+			for blk := blocks(); blk != nil; blk = blocks() {
+				cidrs = append(cidrs, blk.String())
+			}
+			Expect(cidrs).To(ConsistOf(expected))
+		}
+	},
+	Entry("IPv4 /28 blocks", cnet.MustParseNetwork("10.0.0.0/26"), 28, []string{"10.0.0.0/28", "10.0.0.16/28", "10.0.0.32/28", "10.0.0.48/28"}),
+	Entry("IPv4 /24 blocks", cnet.MustParseNetwork("10.0.0.0/23"), 24, []string{"10.0.0.0/24", "10.0.1.0/24"}),
+	Entry("IPv6 /120 blocks", cnet.MustParseNetwork("fd80:24e2:f998:72d6::/119"), 120, []string{"fd80:24e2:f998:72d6::/120", "fd80:24e2:f998:72d6::100/120"}),
+	Entry("IPv6 /116 blocks in a pool of one block", cnet.MustParseNetwork("fd80:24e2:f998:72d6::/116"), 116, []string{"fd80:24e2:f998:72d6::/116"}),
+)
+
 func poolTest(cidr string) {
 	_, subnet, err := net.ParseCIDR(cidr)
 	if err != nil {
@@ -36,7 +132,7 @@ func poolTest(cidr string) {
 		ones, size := pool.Mask.Size()
 		prefixLen := size - ones
 		numIP := new(big.Int).Exp(big.NewInt(2), big.NewInt(int64(prefixLen)), nil)
-		blocks := randomBlockGenerator(pool, host)
+		blocks := randomBlockGenerator(pool, getIPVersion(cnet.IP{pool.IP}).BlockPrefixLength, host)
 
 		blockCount := big.NewInt(0)
 		for blk := blocks(); blk != nil; blk = blocks() {
@@ -16,6 +16,9 @@ package errors
 
 import (
 	"fmt"
+	"net"
+
+	"golang.org/x/net/context"
 )
 
 // Error indicating a problem connecting to the backend.
@@ -69,6 +72,18 @@ func (e ErrorConnectionUnauthorized) Error() string {
 	return "connection is unauthorized"
 }
 
+// Error indicating that the datastore could not be reached.  Unlike an
+// ErrorDatastoreError, this is not the result of a specific operation failing
+// but indicates that no operation is likely to succeed until the datastore
+// becomes reachable.
+type ErrorDatastoreUnavailable struct {
+	Err error
+}
+
+func (e ErrorDatastoreUnavailable) Error() string {
+	return fmt.Sprintf("datastore is unavailable: %v", e.Err)
+}
+
 // Validation error containing the fields that are failed validation.
 type ErrorValidation struct {
 	ErroredFields []ErroredField
@@ -127,6 +142,44 @@ func (e ErrorResourceUpdateConflict) Error() string {
 	return fmt.Sprintf("update conflict: '%s'", e.Identifier)
 }
 
+// Error indicating that a continue token supplied on a paginated list request
+// is not valid for the list, either because it is malformed, was issued for a
+// different list, or has expired.
+type ErrorInvalidContinueToken struct {
+	Token  string
+	Reason string
+}
+
+func (e ErrorInvalidContinueToken) Error() string {
+	return fmt.Sprintf("invalid continue token '%s': %s", e.Token, e.Reason)
+}
+
+// Error indicating that the datastore cannot perform a transaction
+// atomically.  No changes are made.
+type ErrorTransactionNotAtomic struct {
+	Reason string
+}
+
+func (e ErrorTransactionNotAtomic) Error() string {
+	return fmt.Sprintf("transaction cannot be performed atomically: %s", e.Reason)
+}
+
+// Error indicating that a list could only read some of the matching entries.
+// It is returned along with the entries that were read, so that the caller
+// may decide whether to carry on without the others.  Errs holds the error
+// for each entry that could not be read.
+type ErrorPartialList struct {
+	Identifier interface{}
+	Errs       []error
+}
+
+func (e ErrorPartialList) Error() string {
+	if len(e.Errs) == 0 {
+		return fmt.Sprintf("list of '%v' is incomplete", e.Identifier)
+	}
+	return fmt.Sprintf("list of '%v' is incomplete, %d entries could not be read: %v", e.Identifier, len(e.Errs), e.Errs[0])
+}
+
 // UpdateErrorIdentifier modifies the supplied error to use the new resource
 // identifier.
 func UpdateErrorIdentifier(err error, id interface{}) error {
@@ -150,6 +203,81 @@ func UpdateErrorIdentifier(err error, id interface{}) error {
 	case ErrorResourceUpdateConflict:
 		e.Identifier = id
 		err = e
+	case ErrorPartialList:
+		e.Identifier = id
+		err = e
 	}
 	return err
 }
+
+// IsNotExist returns true if the error indicates that a resource does not
+// exist.
+func IsNotExist(err error) bool {
+	_, ok := err.(ErrorResourceDoesNotExist)
+	return ok
+}
+
+// IsAlreadyExists returns true if the error indicates that a resource
+// already exists.
+func IsAlreadyExists(err error) bool {
+	_, ok := err.(ErrorResourceAlreadyExists)
+	return ok
+}
+
+// IsUpdateConflict returns true if the error indicates that a resource
+// could not be updated because it was modified by another client.
+func IsUpdateConflict(err error) bool {
+	_, ok := err.(ErrorResourceUpdateConflict)
+	return ok
+}
+
+// IsTransactionNotAtomic returns true if the error indicates that the
+// datastore cannot perform a transaction atomically.
+func IsTransactionNotAtomic(err error) bool {
+	_, ok := err.(ErrorTransactionNotAtomic)
+	return ok
+}
+
+// IsPartialList returns true if the error indicates that a list returned
+// only some of the matching entries.
+func IsPartialList(err error) bool {
+	_, ok := err.(ErrorPartialList)
+	return ok
+}
+
+// IsDatastoreUnavailable returns true if the error indicates that the
+// datastore could not be reached.
+func IsDatastoreUnavailable(err error) bool {
+	_, ok := err.(ErrorDatastoreUnavailable)
+	return ok
+}
+
+// IsRetryable returns true if the failed operation may succeed when
+// retried.  This is the case for update conflicts, where the resource should
+// be re-read before retrying, and for failures to connect to the datastore
+// or timeouts.  Other datastore errors, such as a request the datastore
+// rejects, fail again however often they are retried.
+func IsRetryable(err error) bool {
+	switch e := err.(type) {
+	case ErrorResourceUpdateConflict, ErrorDatastoreUnavailable:
+		return true
+	case ErrorDatastoreError:
+		return isConnectionOrTimeout(e.Err)
+	}
+	return false
+}
+
+// isConnectionOrTimeout returns true if the error is a network error, such
+// as a refused connection, or a timeout.
+func isConnectionOrTimeout(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	t, ok := err.(interface {
+		Timeout() bool
+	})
+	return ok && t.Timeout()
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2016 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package errors_test
+
+import (
+	goerrors "errors"
+	"net"
+
+	"golang.org/x/net/context"
+
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	"github.com/projectcalico/libcalico-go/lib/errors"
+)
+
+var _ = DescribeTable("Error predicates",
+	func(err error, notExist, alreadyExists, updateConflict, unavailable, retryable bool) {
+		Expect(errors.IsNotExist(err)).To(Equal(notExist))
+		Expect(errors.IsAlreadyExists(err)).To(Equal(alreadyExists))
+		Expect(errors.IsUpdateConflict(err)).To(Equal(updateConflict))
+		Expect(errors.IsDatastoreUnavailable(err)).To(Equal(unavailable))
+		Expect(errors.IsRetryable(err)).To(Equal(retryable))
+	},
+	Entry("resource does not exist", errors.ErrorResourceDoesNotExist{}, true, false, false, false, false),
+	Entry("resource already exists", errors.ErrorResourceAlreadyExists{}, false, true, false, false, false),
+	Entry("update conflict", errors.ErrorResourceUpdateConflict{}, false, false, true, false, true),
+	Entry("datastore error", errors.ErrorDatastoreError{Err: goerrors.New("bad request")}, false, false, false, false, false),
+	Entry("datastore connection error", errors.ErrorDatastoreError{Err: &net.OpError{Op: "dial", Err: goerrors.New("connection refused")}}, false, false, false, false, true),
+	Entry("datastore timeout", errors.ErrorDatastoreError{Err: context.DeadlineExceeded}, false, false, false, false, true),
+	Entry("datastore unavailable", errors.ErrorDatastoreUnavailable{Err: goerrors.New("connection refused")}, false, false, false, true, true),
+	Entry("validation error", errors.ErrorValidation{}, false, false, false, false, false),
+	Entry("partial list", errors.ErrorPartialList{Errs: []error{goerrors.New("bad entry")}}, false, false, false, false, false),
+	Entry("untyped error", goerrors.New("error"), false, false, false, false, false),
+	Entry("nil error", nil, false, false, false, false, false),
+)
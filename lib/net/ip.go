@@ -53,27 +53,55 @@ func ParseIP(ip string) *IP {
 
 // Version returns the IP version for an IP, or 0 if the IP is not valid.
 func (i IP) Version() int {
-	if i.To4() != nil {
+	if i.IsIPv4() {
 		return 4
-	} else if len(i.IP) == net.IPv6len {
+	} else if i.IsIPv6() {
 		return 6
 	}
 	return 0
 }
 
+// IsIPv4 returns true if the IP is an IPv4 address, in either 4-byte or
+// 16-byte form.  IPv4-mapped IPv6 addresses, such as ::ffff:192.0.2.1, are
+// IPv4.  Returns false for a nil IP.
+func (i IP) IsIPv4() bool {
+	return i.To4() != nil
+}
+
+// IsIPv6 returns true if the IP is an IPv6 address that is not an IPv4-mapped
+// address.  Returns false for a nil IP.
+func (i IP) IsIPv6() bool {
+	return len(i.IP) == net.IPv6len && i.To4() == nil
+}
+
+// Normalize returns the canonical form of the IP: the 4-byte form for IPv4
+// addresses, including IPv4 addresses held in 16-byte form, and the 16-byte
+// form for IPv6 addresses.  The same address may otherwise be held in either
+// form, so callers should normalize an IP before comparing or using its bytes
+// as a map key.
+func (i IP) Normalize() IP {
+	if ip4 := i.To4(); ip4 != nil {
+		return IP{ip4}
+	}
+	return IP{i.To16()}
+}
+
 // Network returns the IP address as a fully masked IPNet type.
 func (i *IP) Network() *IPNet {
+	n := HostIPNet(*i)
+	return &n
+}
+
+// HostIPNet returns the fully masked IPNet containing only the given IP, that
+// is a /32 for an IPv4 address or a /128 for an IPv6 address.  An IPv4
+// address held in 16-byte form, including an IPv4-mapped IPv6 address, is
+// treated as IPv4 and returns a /32.
+func HostIPNet(ip IP) IPNet {
 	// Unmarshaling an IPv4 address returns a 16-byte format of the
 	// address, so convert to 4-byte format to match the mask.
-	n := &IPNet{}
-	if i.Version() == 4 {
-		n.IP = i.IP.To4()
-		n.Mask = net.CIDRMask(net.IPv4len*8, net.IPv4len*8)
-	} else {
-		n.IP = i.IP
-		n.Mask = net.CIDRMask(net.IPv6len*8, net.IPv6len*8)
-	}
-	return n
+	ip = ip.Normalize()
+	bits := len(ip.IP) * 8
+	return IPNet{net.IPNet{IP: ip.IP, Mask: net.CIDRMask(bits, bits)}}
 }
 
 // MustParseIP parses the string into a IP.
@@ -0,0 +1,64 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net_test
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+var _ = Describe("IP Normalize", func() {
+	It("should return the same 4-byte form for IPv4 addresses held either way", func() {
+		ip4 := cnet.IP{net.ParseIP("10.0.0.1").To4()}
+		ip16 := cnet.IP{net.ParseIP("10.0.0.1").To16()}
+		Expect(ip4.IP).NotTo(Equal(ip16.IP))
+
+		Expect(ip4.Normalize()).To(Equal(ip16.Normalize()))
+		Expect(ip16.Normalize().IP).To(HaveLen(net.IPv4len))
+		Expect(string(ip4.Normalize().IP)).To(Equal(string(ip16.Normalize().IP)))
+	})
+
+	It("should return the 16-byte form for IPv6 addresses", func() {
+		ip := cnet.MustParseIP("fd80:24e2:f998:72d6::1")
+		Expect(ip.Normalize().IP).To(HaveLen(net.IPv6len))
+		Expect(ip.Normalize().String()).To(Equal("fd80:24e2:f998:72d6::1"))
+	})
+
+	It("should produce the same string for IPv4 addresses held either way", func() {
+		ip4 := cnet.IP{net.ParseIP("192.168.0.1").To4()}
+		ip16 := cnet.IP{net.ParseIP("192.168.0.1").To16()}
+		Expect(ip4.Normalize().String()).To(Equal(ip16.Normalize().String()))
+	})
+})
+
+var _ = DescribeTable("IP version",
+	func(ip cnet.IP, isIPv4, isIPv6 bool, version int) {
+		Expect(ip.IsIPv4()).To(Equal(isIPv4))
+		Expect(ip.IsIPv6()).To(Equal(isIPv6))
+		Expect(ip.Version()).To(Equal(version))
+	},
+	Entry("IPv4 in 4-byte form", cnet.IP{net.ParseIP("192.0.2.1").To4()}, true, false, 4),
+	Entry("IPv4 in 16-byte form", cnet.IP{net.ParseIP("192.0.2.1").To16()}, true, false, 4),
+	Entry("IPv4-mapped IPv6", cnet.MustParseIP("::ffff:192.0.2.1"), true, false, 4),
+	Entry("IPv6", cnet.MustParseIP("2001:db8::1"), false, true, 6),
+	Entry("IPv6 unspecified", cnet.MustParseIP("::"), false, true, 6),
+	Entry("nil", cnet.IP{}, false, false, 0),
+	Entry("invalid length", cnet.IP{net.IP{1, 2, 3}}, false, false, 0),
+)
@@ -16,7 +16,11 @@ package net
 
 import (
 	"encoding/json"
+	"fmt"
+	"math/big"
 	"net"
+	"sort"
+	"strings"
 )
 
 // Sub class net.IPNet so that we can add JSON marshalling and unmarshalling.
@@ -58,14 +62,48 @@ func (i *IPNet) UnmarshalJSON(b []byte) error {
 
 // Version returns the IP version for an IPNet, or 0 if not a valid IP net.
 func (i *IPNet) Version() int {
-	if i.IP.To4() != nil {
+	ip := IP{i.IP}
+	if ip.IsIPv4() {
 		return 4
-	} else if len(i.IP) == net.IPv6len {
+	} else if ip.IsIPv6() {
 		return 6
 	}
 	return 0
 }
 
+// Equal returns true if the two IPNets represent the same network.  The IP
+// addresses are compared after normalizing their length and applying the
+// mask, so an IPv4 network held in a 4-byte or 16-byte IP compares equal.
+func (i IPNet) Equal(n IPNet) bool {
+	if i.Version() != n.Version() {
+		return false
+	}
+	iOnes, iBits := normalizedMask(i).Size()
+	nOnes, nBits := normalizedMask(n).Size()
+	if iOnes != nOnes || iBits != nBits {
+		return false
+	}
+	iIP := IP{i.IP.Mask(i.Mask)}.Normalize()
+	nIP := IP{n.IP.Mask(n.Mask)}.Normalize()
+	return iIP.Equal(nIP.IP)
+}
+
+// normalizedMask returns the mask of the IPNet sized to match the IP
+// version of the network.
+func normalizedMask(n IPNet) net.IPMask {
+	if n.Version() == 4 && len(n.Mask) == net.IPv6len {
+		return n.Mask[12:]
+	}
+	return n.Mask
+}
+
+// IsSingleAddress returns true if the IPNet contains exactly one address, that
+// is it is a /32 for IPv4 or a /128 for IPv6.
+func (i IPNet) IsSingleAddress() bool {
+	ones, bits := normalizedMask(i).Size()
+	return bits != 0 && ones == bits
+}
+
 // IsNetOverlap is a utility function that returns true if the two subnet have an overlap.
 func (i IPNet) IsNetOverlap(n net.IPNet) bool {
 	return n.Contains(i.IP) || i.Contains(n.IP)
@@ -77,6 +115,129 @@ func (i *IPNet) Network() *IPNet {
 	return n
 }
 
+// SplitIPNet splits the network into count equally sized subnets, returned in
+// ascending order.  The count must be a power of two, and no larger than the
+// number of addresses in the network.
+func SplitIPNet(n IPNet, count int) ([]IPNet, error) {
+	if count < 1 || count&(count-1) != 0 {
+		return nil, fmt.Errorf("cannot split %s into %d subnets: count must be a power of two", n, count)
+	}
+	mask := normalizedMask(n)
+	ones, bits := mask.Size()
+	if bits == 0 {
+		return nil, fmt.Errorf("cannot split %s: invalid network mask", n)
+	}
+	prefix := ones
+	for c := count; c > 1; c >>= 1 {
+		prefix++
+	}
+	if prefix > bits {
+		return nil, fmt.Errorf("cannot split %s into %d subnets: exceeds the address space of the network", n, count)
+	}
+
+	subnetMask := net.CIDRMask(prefix, bits)
+	step := new(big.Int).Lsh(big.NewInt(1), uint(bits-prefix))
+	base := ipToBigInt(IP{n.IP.Mask(mask)})
+	subnets := make([]IPNet, 0, count)
+	for i := 0; i < count; i++ {
+		subnets = append(subnets, IPNet{net.IPNet{IP: bigIntToIP(base, bits/8), Mask: subnetMask}})
+		base.Add(base, step)
+	}
+	return subnets, nil
+}
+
+// maxUnlimitedHostBits is the largest number of host bits in a network whose
+// addresses ForEachIP may enumerate without a limit.
+const maxUnlimitedHostBits = 16
+
+// ForEachIP calls fn for each address in the network in ascending order,
+// starting from the network address, until fn returns false or limit
+// addresses have been visited.  A limit of 0 or less visits every address,
+// but is only allowed for networks of at most 65536 addresses, so that a
+// large IPv6 network is not enumerated by mistake.
+func (i IPNet) ForEachIP(limit int, fn func(IP) bool) error {
+	mask := normalizedMask(i)
+	ones, bits := mask.Size()
+	if bits == 0 {
+		return fmt.Errorf("cannot enumerate %s: invalid network mask", i)
+	}
+	if limit <= 0 && bits-ones > maxUnlimitedHostBits {
+		return fmt.Errorf("cannot enumerate %s without a limit: it has more than %d addresses", i, 1<<maxUnlimitedHostBits)
+	}
+
+	ip := ipToBigInt(IP{i.IP.Mask(mask)})
+	end := new(big.Int).Add(ip, new(big.Int).Lsh(big.NewInt(1), uint(bits-ones)))
+	one := big.NewInt(1)
+	for n := 0; ip.Cmp(end) < 0 && (limit <= 0 || n < limit); n++ {
+		if !fn(IP{bigIntToIP(ip, bits/8)}) {
+			break
+		}
+		ip.Add(ip, one)
+	}
+	return nil
+}
+
+// CollapseToIPNets returns the smallest set of aligned CIDRs that covers
+// exactly the given addresses, which is the inverse of enumerating the
+// addresses of each CIDR.  Duplicate addresses are ignored, and the addresses
+// need not be sorted.  The IPv4 CIDRs are returned first, then the IPv6
+// CIDRs, each in ascending order.
+func CollapseToIPNets(ips []IP) []IPNet {
+	nets := []IPNet{}
+	for _, bits := range []int{8 * net.IPv4len, 8 * net.IPv6len} {
+		values := []*big.Int{}
+		for _, ip := range ips {
+			if (bits == 8*net.IPv4len) == (ip.Version() == 4) {
+				values = append(values, ipToBigInt(ip))
+			}
+		}
+		sort.Sort(bigInts(values))
+
+		// Collapse each run of consecutive addresses in turn.
+		one := big.NewInt(1)
+		for i := 0; i < len(values); {
+			start := values[i]
+			end := new(big.Int).Set(start)
+			for i++; i < len(values) && values[i].Cmp(new(big.Int).Add(end, one)) <= 0; i++ {
+				if values[i].Cmp(end) > 0 {
+					end.Set(values[i])
+				}
+			}
+			nets = append(nets, rangeToIPNets(start, end, bits)...)
+		}
+	}
+	return nets
+}
+
+type bigInts []*big.Int
+
+func (s bigInts) Len() int           { return len(s) }
+func (s bigInts) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bigInts) Less(i, j int) bool { return s[i].Cmp(s[j]) < 0 }
+
+// rangeToIPNets returns the smallest set of aligned CIDRs that covers the
+// inclusive range of addresses from start to end, in ascending order.
+func rangeToIPNets(start, end *big.Int, bits int) []IPNet {
+	nets := []IPNet{}
+	base := new(big.Int).Set(start)
+	for base.Cmp(end) <= 0 {
+		// Find the largest CIDR that starts at base, is aligned and
+		// does not extend beyond the end of the range.
+		hostBits := 0
+		for hostBits < bits && base.Bit(hostBits) == 0 {
+			last := new(big.Int).Lsh(big.NewInt(1), uint(hostBits+1))
+			last.Add(last, base).Sub(last, big.NewInt(1))
+			if last.Cmp(end) > 0 {
+				break
+			}
+			hostBits++
+		}
+		nets = append(nets, IPNet{net.IPNet{IP: bigIntToIP(base, bits/8), Mask: net.CIDRMask(bits-hostBits, bits)}})
+		base.Add(base, new(big.Int).Lsh(big.NewInt(1), uint(hostBits)))
+	}
+	return nets
+}
+
 func ParseCIDR(c string) (*IP, *IPNet, error) {
 	netIP, netIPNet, e := net.ParseCIDR(c)
 	if netIPNet == nil || e != nil {
@@ -97,6 +258,27 @@ func ParseCIDR(c string) (*IP, *IPNet, error) {
 	return ip, ipnet, nil
 }
 
+// ParseCIDROrIP parses a string which is either a CIDR or a bare IP address.
+// It returns the IP address and the network containing it.  For a CIDR the
+// network is masked, as with ParseCIDR.  For a bare IP address the network is
+// the /32 or /128 containing only that address.
+func ParseCIDROrIP(s string) (IP, *IPNet, error) {
+	if strings.Contains(s, "/") {
+		ip, ipnet, err := ParseCIDR(s)
+		if err != nil {
+			return IP{}, nil, fmt.Errorf("invalid CIDR %q: %v", s, err)
+		}
+		return *ip, ipnet, nil
+	}
+
+	ip := ParseIP(s)
+	if ip == nil {
+		return IP{}, nil, fmt.Errorf("invalid IP address or CIDR %q", s)
+	}
+	*ip = ip.Normalize()
+	return *ip, ip.Network(), nil
+}
+
 // String returns a friendly name for the network.  The standard net package
 // implements String() on the pointer, which means it will not be invoked on a
 // struct type, so we re-implement on the struct type.
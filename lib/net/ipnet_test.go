@@ -0,0 +1,222 @@
+// Copyright (c) 2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net_test
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+// ipNet16 returns the IPv4 network with the IP held in 16-byte form.
+func ipNet16(c string) cnet.IPNet {
+	n := cnet.MustParseNetwork(c)
+	n.IP = n.IP.To16()
+	return n
+}
+
+// ipNet16Mask returns the IPv4 network with both the IP and mask held in
+// 16-byte form.
+func ipNet16Mask(c string) cnet.IPNet {
+	n := cnet.MustParseNetwork(c)
+	ones, _ := n.Mask.Size()
+	n.IP = n.IP.To16()
+	n.Mask = net.CIDRMask(ones+96, 128)
+	return n
+}
+
+var _ = DescribeTable("IPNet Equal",
+	func(a, b cnet.IPNet, expected bool) {
+		Expect(a.Equal(b)).To(Equal(expected))
+		Expect(b.Equal(a)).To(Equal(expected))
+	},
+	Entry("identical IPv4 networks", cnet.MustParseNetwork("10.0.0.0/24"), cnet.MustParseNetwork("10.0.0.0/24"), true),
+	Entry("IPv4 network with 4-byte and 16-byte IP", cnet.MustParseNetwork("10.0.0.0/24"), ipNet16("10.0.0.0/24"), true),
+	Entry("IPv4 network with 16-byte IP and mask", cnet.MustParseNetwork("10.0.0.0/24"), ipNet16Mask("10.0.0.0/24"), true),
+	Entry("unmasked IPv4 network", cnet.MustParseNetwork("10.0.0.0/24"), cnet.MustParseCIDR("10.0.0.1/24"), true),
+	Entry("different IPv4 prefix lengths", cnet.MustParseNetwork("10.0.0.0/24"), cnet.MustParseNetwork("10.0.0.0/25"), false),
+	Entry("different IPv4 networks", cnet.MustParseNetwork("10.0.0.0/24"), cnet.MustParseNetwork("10.0.1.0/24"), false),
+	Entry("identical IPv6 networks", cnet.MustParseNetwork("fd80:24e2:f998:72d6::/120"), cnet.MustParseNetwork("fd80:24e2:f998:72d6::/120"), true),
+	Entry("different IPv6 networks", cnet.MustParseNetwork("fd80:24e2:f998:72d6::/120"), cnet.MustParseNetwork("fd80:24e2:f998:72d7::/120"), false),
+	Entry("IPv4 and IPv6 networks", cnet.MustParseNetwork("10.0.0.0/24"), cnet.MustParseNetwork("a00::/24"), false),
+)
+
+var _ = DescribeTable("IPNet Network",
+	func(n cnet.IPNet, expected string) {
+		network := n.Network()
+		Expect(network.String()).To(Equal(expected))
+		Expect(network.Equal(n)).To(BeTrue())
+		Expect(network.Contains(n.IP)).To(BeTrue())
+	},
+	Entry("masked IPv4 network", cnet.MustParseNetwork("10.0.0.0/24"), "10.0.0.0/24"),
+	Entry("IPv4 network with host bits set", cnet.MustParseCIDR("10.0.0.5/24"), "10.0.0.0/24"),
+	Entry("IPv4 network with 16-byte IP and mask", ipNet16Mask("10.0.0.5/24"), "10.0.0.0/24"),
+	Entry("IPv6 network with host bits set", cnet.MustParseCIDR("fd80:24e2:f998:72d6::5/120"), "fd80:24e2:f998:72d6::/120"),
+)
+
+var _ = DescribeTable("IPNet IsSingleAddress",
+	func(n cnet.IPNet, expected bool) {
+		Expect(n.IsSingleAddress()).To(Equal(expected))
+	},
+	Entry("IPv4 /32", cnet.MustParseNetwork("10.0.0.1/32"), true),
+	Entry("IPv4 /32 with 16-byte IP and mask", ipNet16Mask("10.0.0.1/32"), true),
+	Entry("IPv4 /31", cnet.MustParseNetwork("10.0.0.0/31"), false),
+	Entry("IPv6 /128", cnet.MustParseNetwork("fd80:24e2:f998:72d6::1/128"), true),
+	Entry("IPv6 /127", cnet.MustParseNetwork("fd80:24e2:f998:72d6::/127"), false),
+	Entry("IPNet without a mask", cnet.IPNet{}, false),
+)
+
+var _ = DescribeTable("HostIPNet",
+	func(ip cnet.IP, expected string) {
+		n := cnet.HostIPNet(ip)
+		Expect(n.String()).To(Equal(expected))
+		Expect(n.IsSingleAddress()).To(BeTrue())
+	},
+	Entry("IPv4 address", cnet.IP{net.ParseIP("10.0.0.1").To4()}, "10.0.0.1/32"),
+	Entry("IPv4 address in 16-byte form", cnet.IP{net.ParseIP("10.0.0.1").To16()}, "10.0.0.1/32"),
+	Entry("IPv4-mapped IPv6 address", cnet.MustParseIP("::ffff:10.0.0.1"), "10.0.0.1/32"),
+	Entry("IPv6 address", cnet.MustParseIP("fd80:24e2:f998:72d6::1"), "fd80:24e2:f998:72d6::1/128"),
+)
+
+var _ = DescribeTable("ParseCIDROrIP",
+	func(s, expectedIP, expectedNet string) {
+		ip, n, err := cnet.ParseCIDROrIP(s)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ip.String()).To(Equal(expectedIP))
+		Expect(n.String()).To(Equal(expectedNet))
+	},
+	Entry("IPv4 address", "10.0.0.1", "10.0.0.1", "10.0.0.1/32"),
+	Entry("IPv4 CIDR", "10.0.0.0/24", "10.0.0.0", "10.0.0.0/24"),
+	Entry("IPv4 CIDR with host bits set", "10.0.0.5/24", "10.0.0.5", "10.0.0.0/24"),
+	Entry("IPv6 address", "fd80:24e2:f998:72d6::1", "fd80:24e2:f998:72d6::1", "fd80:24e2:f998:72d6::1/128"),
+	Entry("IPv6 CIDR", "fd80:24e2:f998:72d6::5/120", "fd80:24e2:f998:72d6::5", "fd80:24e2:f998:72d6::/120"),
+)
+
+var _ = DescribeTable("ParseCIDROrIP invalid input",
+	func(s string) {
+		_, n, err := cnet.ParseCIDROrIP(s)
+		Expect(err).To(HaveOccurred())
+		Expect(n).To(BeNil())
+	},
+	Entry("empty string", ""),
+	Entry("hostname", "host-a"),
+	Entry("IPv4 address out of range", "10.0.0.256"),
+	Entry("prefix length too long", "10.0.0.0/33"),
+	Entry("missing prefix length", "10.0.0.0/"),
+	Entry("resource name", "10-0-0-0-24"),
+)
+
+var _ = DescribeTable("SplitIPNet",
+	func(n string, count int, expected []string) {
+		subnets, err := cnet.SplitIPNet(cnet.MustParseCIDR(n), count)
+		Expect(err).NotTo(HaveOccurred())
+		actual := []string{}
+		for _, s := range subnets {
+			actual = append(actual, s.String())
+		}
+		Expect(actual).To(Equal(expected))
+	},
+	Entry("IPv4 into one", "10.0.0.0/24", 1, []string{"10.0.0.0/24"}),
+	Entry("IPv4 into four", "10.0.0.0/24", 4, []string{"10.0.0.0/26", "10.0.0.64/26", "10.0.0.128/26", "10.0.0.192/26"}),
+	Entry("IPv4 with host bits set", "10.0.0.5/24", 2, []string{"10.0.0.0/25", "10.0.0.128/25"}),
+	Entry("IPv4 into single addresses", "10.0.0.0/31", 2, []string{"10.0.0.0/32", "10.0.0.1/32"}),
+	Entry("IPv6 into two", "fd80:24e2:f998:72d6::/64", 2, []string{"fd80:24e2:f998:72d6::/65", "fd80:24e2:f998:72d6:8000::/65"}),
+	Entry("IPv6 into eight", "fd80::/120", 8, []string{
+		"fd80::/123", "fd80::20/123", "fd80::40/123", "fd80::60/123",
+		"fd80::80/123", "fd80::a0/123", "fd80::c0/123", "fd80::e0/123",
+	}),
+)
+
+var _ = DescribeTable("SplitIPNet invalid count",
+	func(n string, count int) {
+		subnets, err := cnet.SplitIPNet(cnet.MustParseNetwork(n), count)
+		Expect(err).To(HaveOccurred())
+		Expect(subnets).To(BeNil())
+	},
+	Entry("zero", "10.0.0.0/24", 0),
+	Entry("negative", "10.0.0.0/24", -2),
+	Entry("not a power of two", "10.0.0.0/24", 6),
+	Entry("IPv4 beyond the address space", "10.0.0.0/31", 4),
+	Entry("IPv4 single address", "10.0.0.1/32", 2),
+	Entry("IPv6 beyond the address space", "fd80::/127", 4),
+)
+
+var _ = DescribeTable("IPNet ForEachIP",
+	func(n string, limit, stopAfter int, expected []string) {
+		actual := []string{}
+		err := cnet.MustParseCIDR(n).ForEachIP(limit, func(ip cnet.IP) bool {
+			actual = append(actual, ip.String())
+			return len(actual) != stopAfter
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(actual).To(Equal(expected))
+	},
+	Entry("IPv4 without a limit", "10.0.0.0/30", 0, 0, []string{"10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3"}),
+	Entry("IPv4 with host bits set", "10.0.0.7/31", 0, 0, []string{"10.0.0.6", "10.0.0.7"}),
+	Entry("IPv4 single address", "10.0.0.1/32", 0, 0, []string{"10.0.0.1"}),
+	Entry("IPv4 with a limit", "10.0.0.0/24", 3, 0, []string{"10.0.0.0", "10.0.0.1", "10.0.0.2"}),
+	Entry("IPv4 with a limit beyond the network", "10.0.0.254/31", 5, 0, []string{"10.0.0.254", "10.0.0.255"}),
+	Entry("IPv4 stopped early", "10.0.0.0/24", 0, 2, []string{"10.0.0.0", "10.0.0.1"}),
+	Entry("IPv6 with a limit", "fd80::/64", 2, 0, []string{"fd80::", "fd80::1"}),
+	Entry("IPv6 stopped early", "fd80::/120", 10, 1, []string{"fd80::"}),
+)
+
+var _ = DescribeTable("IPNet ForEachIP without a limit on a large network",
+	func(n string) {
+		called := false
+		err := cnet.MustParseNetwork(n).ForEachIP(0, func(ip cnet.IP) bool {
+			called = true
+			return true
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(called).To(BeFalse())
+	},
+	Entry("IPv4", "10.0.0.0/15"),
+	Entry("IPv6", "fd80::/64"),
+)
+
+var _ = DescribeTable("CollapseToIPNets",
+	func(ips []string, expected []string) {
+		addrs := []cnet.IP{}
+		for _, ip := range ips {
+			addrs = append(addrs, cnet.MustParseIP(ip))
+		}
+		actual := []string{}
+		for _, n := range cnet.CollapseToIPNets(addrs) {
+			actual = append(actual, n.String())
+		}
+		Expect(actual).To(Equal(expected))
+	},
+	Entry("no addresses", []string{}, []string{}),
+	Entry("single IPv4 address", []string{"10.0.0.5"}, []string{"10.0.0.5/32"}),
+	Entry("aligned IPv4 run", []string{"10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.7"}, []string{"10.0.0.4/30"}),
+	Entry("unaligned IPv4 run", []string{"10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.7", "10.0.0.8"},
+		[]string{"10.0.0.3/32", "10.0.0.4/30", "10.0.0.8/32"}),
+	Entry("run across an octet boundary", []string{"10.0.0.254", "10.0.0.255", "10.0.1.0", "10.0.1.1"},
+		[]string{"10.0.0.254/31", "10.0.1.0/31"}),
+	Entry("gapped IPv4 addresses", []string{"10.0.0.0", "10.0.0.1", "10.0.0.3", "10.0.0.8"},
+		[]string{"10.0.0.0/31", "10.0.0.3/32", "10.0.0.8/32"}),
+	Entry("unsorted addresses with duplicates", []string{"10.0.0.3", "10.0.0.1", "10.0.0.2", "10.0.0.0", "10.0.0.2"},
+		[]string{"10.0.0.0/30"}),
+	Entry("IPv6 run", []string{"fd80::10", "fd80::11", "fd80::12", "fd80::13", "fd80::14"},
+		[]string{"fd80::10/126", "fd80::14/128"}),
+	Entry("mixed IP versions", []string{"fd80::1", "10.0.0.1", "fd80::", "10.0.0.0"},
+		[]string{"10.0.0.0/31", "fd80::/127"}),
+	Entry("top of the IPv4 address space", []string{"255.255.255.254", "255.255.255.255"},
+		[]string{"255.255.255.254/31"}),
+)
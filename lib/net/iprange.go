@@ -0,0 +1,109 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+)
+
+// IPRange is an inclusive range of IP addresses of a single IP version.
+type IPRange struct {
+	Start IP
+	End   IP
+}
+
+// ParseIPRange parses a range of IP addresses in the form "start-end", for
+// example "10.0.0.10-10.0.0.20".  The start and end addresses must be of the
+// same IP version, and start must not be greater than end.
+func ParseIPRange(s string) (IP, IP, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return IP{}, IP{}, fmt.Errorf("invalid IP range '%s': expected the form <start>-<end>", s)
+	}
+	start := ParseIP(strings.TrimSpace(parts[0]))
+	if start == nil {
+		return IP{}, IP{}, fmt.Errorf("invalid IP range '%s': invalid start address '%s'", s, parts[0])
+	}
+	end := ParseIP(strings.TrimSpace(parts[1]))
+	if end == nil {
+		return IP{}, IP{}, fmt.Errorf("invalid IP range '%s': invalid end address '%s'", s, parts[1])
+	}
+	if start.Version() != end.Version() {
+		return IP{}, IP{}, fmt.Errorf("invalid IP range '%s': start and end addresses are different IP versions", s)
+	}
+	if ipToBigInt(*start).Cmp(ipToBigInt(*end)) > 0 {
+		return IP{}, IP{}, fmt.Errorf("invalid IP range '%s': start address is greater than end address", s)
+	}
+	return *start, *end, nil
+}
+
+// MustParseIPRange parses the string into an IPRange.
+func MustParseIPRange(s string) IPRange {
+	start, end, err := ParseIPRange(s)
+	if err != nil {
+		panic(err)
+	}
+	return IPRange{Start: start, End: end}
+}
+
+// String returns the range in the form "start-end".
+func (r IPRange) String() string {
+	return r.Start.String() + "-" + r.End.String()
+}
+
+// Contains returns true if the given IP is within the range.
+func (r IPRange) Contains(ip IP) bool {
+	if ip.Version() != r.Start.Version() {
+		return false
+	}
+	i := ipToBigInt(ip)
+	return ipToBigInt(r.Start).Cmp(i) <= 0 && i.Cmp(ipToBigInt(r.End)) <= 0
+}
+
+// BlockCIDRs returns the CIDRs of all blocks with the given prefix length
+// that intersect the range, in ascending order.
+func (r IPRange) BlockCIDRs(blockPrefixLength int) []IPNet {
+	bits := 8 * net.IPv4len
+	if r.Start.Version() == 6 {
+		bits = 8 * net.IPv6len
+	}
+	mask := net.CIDRMask(blockPrefixLength, bits)
+	step := new(big.Int).Lsh(big.NewInt(1), uint(bits-blockPrefixLength))
+
+	blocks := []IPNet{}
+	end := ipToBigInt(r.End)
+	base := ipToBigInt(IP{r.Start.Mask(mask)})
+	for ; base.Cmp(end) <= 0; base.Add(base, step) {
+		blocks = append(blocks, IPNet{net.IPNet{IP: bigIntToIP(base, bits/8), Mask: mask}})
+	}
+	return blocks
+}
+
+// ipToBigInt returns the integer value of the given IP.
+func ipToBigInt(ip IP) *big.Int {
+	return new(big.Int).SetBytes(ip.Normalize().IP)
+}
+
+// bigIntToIP returns the IP with the given integer value, padded to the
+// given number of bytes.
+func bigIntToIP(i *big.Int, length int) net.IP {
+	b := i.Bytes()
+	ip := make(net.IP, length)
+	copy(ip[length-len(b):], b)
+	return ip
+}
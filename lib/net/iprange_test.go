@@ -0,0 +1,87 @@
+// Copyright (c) 2016-2017 Tigera, Inc. All rights reserved.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+
+	cnet "github.com/projectcalico/libcalico-go/lib/net"
+)
+
+var _ = DescribeTable("ParseIPRange",
+	func(s string, start, end string, valid bool) {
+		outStart, outEnd, err := cnet.ParseIPRange(s)
+		if !valid {
+			Expect(err).To(HaveOccurred())
+			return
+		}
+		Expect(err).NotTo(HaveOccurred())
+		Expect(outStart.String()).To(Equal(start))
+		Expect(outEnd.String()).To(Equal(end))
+	},
+	Entry("IPv4 range", "10.0.0.10-10.0.0.20", "10.0.0.10", "10.0.0.20", true),
+	Entry("IPv4 single address range", "10.0.0.10-10.0.0.10", "10.0.0.10", "10.0.0.10", true),
+	Entry("IPv6 range", "fd00::10-fd00::1:0", "fd00::10", "fd00::1:0", true),
+	Entry("range with spaces", "10.0.0.10 - 10.0.0.20", "10.0.0.10", "10.0.0.20", true),
+	Entry("start greater than end", "10.0.0.20-10.0.0.10", "", "", false),
+	Entry("mixed IP versions", "10.0.0.10-fd00::10", "", "", false),
+	Entry("missing end", "10.0.0.10", "", "", false),
+	Entry("too many parts", "10.0.0.10-10.0.0.20-10.0.0.30", "", "", false),
+	Entry("invalid start", "10.0.0-10.0.0.20", "", "", false),
+	Entry("invalid end", "10.0.0.10-bad", "", "", false),
+)
+
+var _ = Describe("IPRange", func() {
+	It("should contain addresses within the range", func() {
+		r := cnet.MustParseIPRange("10.0.0.10-10.0.0.20")
+		Expect(r.Contains(cnet.MustParseIP("10.0.0.10"))).To(BeTrue())
+		Expect(r.Contains(cnet.MustParseIP("10.0.0.20"))).To(BeTrue())
+		Expect(r.Contains(cnet.MustParseIP("10.0.0.9"))).To(BeFalse())
+		Expect(r.Contains(cnet.MustParseIP("10.0.0.21"))).To(BeFalse())
+		Expect(r.Contains(cnet.MustParseIP("fd00::10"))).To(BeFalse())
+	})
+
+	It("should return the single block containing a small range", func() {
+		r := cnet.MustParseIPRange("10.0.0.10-10.0.0.20")
+		Expect(r.BlockCIDRs(26)).To(Equal([]cnet.IPNet{
+			cnet.MustParseNetwork("10.0.0.0/26"),
+		}))
+	})
+
+	It("should return every block intersected by a range", func() {
+		r := cnet.MustParseIPRange("10.0.0.60-10.0.1.0")
+		Expect(r.BlockCIDRs(26)).To(Equal([]cnet.IPNet{
+			cnet.MustParseNetwork("10.0.0.0/26"),
+			cnet.MustParseNetwork("10.0.0.64/26"),
+			cnet.MustParseNetwork("10.0.0.128/26"),
+			cnet.MustParseNetwork("10.0.0.192/26"),
+			cnet.MustParseNetwork("10.0.1.0/26"),
+		}))
+	})
+
+	It("should return blocks for IPv6 ranges", func() {
+		r := cnet.MustParseIPRange("fd00::ff-fd00::100")
+		Expect(r.BlockCIDRs(122)).To(Equal([]cnet.IPNet{
+			cnet.MustParseNetwork("fd00::c0/122"),
+			cnet.MustParseNetwork("fd00::100/122"),
+		}))
+	})
+
+	It("should format as start-end", func() {
+		Expect(cnet.MustParseIPRange("10.0.0.10-10.0.0.20").String()).To(Equal("10.0.0.10-10.0.0.20"))
+	})
+})
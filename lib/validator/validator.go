@@ -15,6 +15,7 @@
 package validator
 
 import (
+	"fmt"
 	"net"
 	"reflect"
 	"regexp"
@@ -23,6 +24,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/projectcalico/libcalico-go/lib/api"
 	"github.com/projectcalico/libcalico-go/lib/errors"
+	"github.com/projectcalico/libcalico-go/lib/ipip"
 	calinet "github.com/projectcalico/libcalico-go/lib/net"
 	"github.com/projectcalico/libcalico-go/lib/numorstring"
 	"github.com/projectcalico/libcalico-go/lib/scope"
@@ -51,6 +53,14 @@ var (
 	poolUnstictCIDR     = "IP pool CIDR is not strictly masked"
 	overlapsV4LinkLocal = "IP pool range overlaps with IPv4 Link Local range 169.254.0.0/16"
 	overlapsV6LinkLocal = "IP pool range overlaps with IPv6 Link Local range fe80::/10"
+	poolIPIPModeIPv6    = "IPIP mode is not supported on an IPv6 IP pool"
+	poolSmallIPIPCross  = "IP pool size is too small (min /26) for use with cross-subnet IPIP"
+	poolBlockSizeIPv4   = "IP pool block size must be between /20 and /32 for an IPv4 IP pool"
+	poolBlockSizeIPv6   = "IP pool block size must be between /116 and /128 for an IPv6 IP pool"
+	poolSmallBlockSize  = "IP pool size is too small for its block size"
+	poolExcludedCIDR    = "IP pool excluded CIDR is not within the IP pool"
+	poolReservedAddress = "IP pool reserved address is not within the IP pool"
+	poolNodeSelector    = "IP pool node selector is not valid"
 
 	ipv4LinkLocalNet = net.IPNet{
 		IP:   net.ParseIP("169.254.0.0"),
@@ -61,6 +71,16 @@ var (
 		IP:   net.ParseIP("fe80::"),
 		Mask: net.CIDRMask(10, 128),
 	}
+
+	// Private address ranges.  NAT outgoing is normally only required for
+	// pools within these ranges.
+	privateNets = []net.IPNet{
+		{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(8, 32)},
+		{IP: net.ParseIP("172.16.0.0"), Mask: net.CIDRMask(12, 32)},
+		{IP: net.ParseIP("192.168.0.0"), Mask: net.CIDRMask(16, 32)},
+		{IP: net.ParseIP("100.64.0.0"), Mask: net.CIDRMask(10, 32)},
+		{IP: net.ParseIP("fc00::"), Mask: net.CIDRMask(7, 128)},
+	}
 )
 
 // Validate is used to validate the supplied structure according to the
@@ -268,8 +288,7 @@ func validateWorkloadEndpointSpec(v *validator.Validate, structLevel *validator.
 
 	// The configured networks only support /32 (for IPv4) and /128 (for IPv6) at present.
 	for _, netw := range w.IPNetworks {
-		ones, bits := netw.Mask.Size()
-		if bits != ones {
+		if !netw.IsSingleAddress() {
 			structLevel.ReportError(reflect.ValueOf(w.IPNetworks),
 				"IPNetworks", "", reason("IP network contains multiple addresses"))
 		}
@@ -324,6 +343,14 @@ func validateHostEndpointSpec(v *validator.Validate, structLevel *validator.Stru
 func validateIPPool(v *validator.Validate, structLevel *validator.StructLevel) {
 	pool := structLevel.CurrentStruct.Interface().(api.IPPool)
 
+	// The node selector must parse.
+	if pool.Spec.NodeSelector != "" {
+		if _, err := selector.Parse(pool.Spec.NodeSelector); err != nil {
+			structLevel.ReportError(reflect.ValueOf(pool.Spec.NodeSelector),
+				"NodeSelector", "", reason(fmt.Sprintf("%s: %v", poolNodeSelector, err)))
+		}
+	}
+
 	// Validation of the data occurs before checking whether Metadata
 	// fields are complete, so need to check whether CIDR is assigned before
 	// performing cross-checks.  If CIDR is not assigned this will be
@@ -335,9 +362,71 @@ func validateIPPool(v *validator.Validate, structLevel *validator.StructLevel) {
 				"IPIP.Enabled", "", reason("IPIP is not supported on an IPv6 IP pool"))
 		}
 
+		// Nor can an IPIP mode be configured for IPv6.
+		if pool.Metadata.CIDR.Version() == 6 && pool.Spec.IPIP != nil && pool.Spec.IPIP.Mode != ipip.Undefined {
+			structLevel.ReportError(reflect.ValueOf(pool.Spec.IPIP.Mode),
+				"IPIP.Mode", "", reason(poolIPIPModeIPv6))
+		}
+
+		// Cross-subnet IPIP requires the pool to be large enough to
+		// allocate at least one block for the tunnel addresses.  This is
+		// only an additional check for disabled pools, since enabled pools
+		// are subject to the minimum size check below.
+		if pool.Metadata.CIDR.Version() == 4 && pool.Spec.IPIP != nil && pool.Spec.IPIP.Enabled &&
+			pool.Spec.IPIP.Mode == ipip.CrossSubnet {
+			ones, bits := pool.Metadata.CIDR.Mask.Size()
+			if bits-ones < 6 {
+				structLevel.ReportError(reflect.ValueOf(pool.Metadata.CIDR),
+					"CIDR", "", reason(poolSmallIPIPCross))
+			}
+		}
+
+		// NAT outgoing on a publicly routable pool is permitted, but is
+		// unusual enough that it is likely to be a mistake.
+		if pool.Spec.NATOutgoing && !isPrivateNet(pool.Metadata.CIDR) {
+			log.Warningf("NAT outgoing is enabled on IP pool %s which is not a private range", pool.Metadata.CIDR)
+		}
+
+		// A block size configured on the pool must be valid for the pool's IP
+		// version, and the pool must hold at least one whole block.
+		if pool.Spec.BlockSize != nil {
+			blockSize := *pool.Spec.BlockSize
+			if pool.Metadata.CIDR.Version() == 4 && (blockSize < 20 || blockSize > 32) {
+				structLevel.ReportError(reflect.ValueOf(blockSize),
+					"BlockSize", "", reason(poolBlockSizeIPv4))
+			} else if pool.Metadata.CIDR.Version() == 6 && (blockSize < 116 || blockSize > 128) {
+				structLevel.ReportError(reflect.ValueOf(blockSize),
+					"BlockSize", "", reason(poolBlockSizeIPv6))
+			} else if ones, _ := pool.Metadata.CIDR.Mask.Size(); ones > blockSize {
+				structLevel.ReportError(reflect.ValueOf(pool.Metadata.CIDR),
+					"CIDR", "", reason(poolSmallBlockSize))
+			}
+		}
+
+		// Excluded CIDRs must lie entirely within the pool.
+		poolOnes, _ := pool.Metadata.CIDR.Mask.Size()
+		for _, excluded := range pool.Spec.ExcludedCIDRs {
+			ones, _ := excluded.Mask.Size()
+			if excluded.Version() != pool.Metadata.CIDR.Version() ||
+				!pool.Metadata.CIDR.Contains(excluded.IP) || ones < poolOnes {
+				structLevel.ReportError(reflect.ValueOf(excluded),
+					"ExcludedCIDRs", "", reason(poolExcludedCIDR))
+			}
+		}
+
+		// Reserved addresses must lie within the pool.
+		for _, reserved := range pool.Spec.ReservedAddresses {
+			if reserved.Version() != pool.Metadata.CIDR.Version() || !pool.Metadata.CIDR.Contains(reserved.IP) {
+				structLevel.ReportError(reflect.ValueOf(reserved),
+					"ReservedAddresses", "", reason(poolReservedAddress))
+			}
+		}
+
 		// The Calico IPAM places restrictions on the minimum IP pool size.  If
-		// the pool is enabled, check that the pool is at least the minimum size.
-		if !pool.Spec.Disabled {
+		// the pool is enabled and does not configure its own block size, check
+		// that the pool is at least the minimum size so that it consists of a
+		// whole number of blocks.
+		if !pool.Spec.Disabled && pool.Spec.BlockSize == nil {
 			ones, bits := pool.Metadata.CIDR.Mask.Size()
 			log.Debugf("Pool CIDR: %s, num bits: %d", pool.Metadata.CIDR, bits-ones)
 			if bits-ones < 6 {
@@ -351,7 +440,8 @@ func validateIPPool(v *validator.Validate, structLevel *validator.StructLevel) {
 			}
 		}
 
-		// The Calico CIDR should be strictly masked
+		// The Calico CIDR should be strictly masked.  Together with the minimum
+		// size check above, this ensures that the pool is block aligned.
 		ip, ipNet, _ := net.ParseCIDR(pool.Metadata.CIDR.String())
 		log.Debugf("Pool CIDR: %s, Masked IP: %d", pool.Metadata.CIDR, ipNet.IP)
 		if ipNet.IP.String() != ip.String() {
@@ -372,6 +462,19 @@ func validateIPPool(v *validator.Validate, structLevel *validator.StructLevel) {
 	}
 }
 
+// isPrivateNet returns true if the network is contained within one of the
+// private address ranges.
+func isPrivateNet(n calinet.IPNet) bool {
+	ones, _ := n.Mask.Size()
+	for _, p := range privateNets {
+		pOnes, _ := p.Mask.Size()
+		if p.Contains(n.IP) && ones >= pOnes {
+			return true
+		}
+	}
+	return false
+}
+
 func validateICMPFields(v *validator.Validate, structLevel *validator.StructLevel) {
 	icmp := structLevel.CurrentStruct.Interface().(api.ICMPFields)
 
@@ -21,6 +21,7 @@ import (
 	. "github.com/onsi/gomega"
 	"github.com/projectcalico/libcalico-go/lib/api"
 	"github.com/projectcalico/libcalico-go/lib/backend/model"
+	"github.com/projectcalico/libcalico-go/lib/ipip"
 	"github.com/projectcalico/libcalico-go/lib/net"
 	"github.com/projectcalico/libcalico-go/lib/numorstring"
 	"github.com/projectcalico/libcalico-go/lib/scope"
@@ -53,6 +54,11 @@ func init() {
 
 	protoTCP := numorstring.ProtocolFromString("tcp")
 
+	blockSize16 := 16
+	blockSize24 := 24
+	blockSize28 := 28
+	blockSize124 := 124
+
 	// Perform basic validation of different fields and structures to test simple valid/invalid
 	// scenarios.  This does not test precise error strings - but does cover a lot of the validation
 	// code paths.
@@ -304,10 +310,123 @@ func init() {
 					IPIP: &api.IPIPConfiguration{Enabled: true},
 				},
 			}, false),
+		Entry("should reject IPIP mode on an IPv6 IP pool",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: netv6_3},
+				Spec: api.IPPoolSpec{
+					IPIP: &api.IPIPConfiguration{Mode: ipip.Always},
+				},
+			}, false),
+		Entry("should accept cross-subnet IPIP on an IPv4 pool",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: netv4_3},
+				Spec: api.IPPoolSpec{
+					IPIP: &api.IPIPConfiguration{Enabled: true, Mode: ipip.CrossSubnet},
+				},
+			}, true),
+		Entry("should reject cross-subnet IPIP on a disabled IPv4 pool smaller than /26",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: netv4_5},
+				Spec: api.IPPoolSpec{
+					IPIP:     &api.IPIPConfiguration{Enabled: true, Mode: ipip.CrossSubnet},
+					Disabled: true,
+				},
+			}, false),
+		Entry("should accept NAT outgoing on a public IPv4 pool",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: netv4_4},
+				Spec:     api.IPPoolSpec{NATOutgoing: true},
+			}, true),
 		Entry("should reject IPv4 pool with a CIDR range overlapping with Link Local range",
 			api.IPPool{Metadata: api.IPPoolMetadata{CIDR: net.MustParseCIDR("169.254.5.0/24")}}, false),
 		Entry("should reject IPv6 pool with a CIDR range overlapping with Link Local range",
 			api.IPPool{Metadata: api.IPPoolMetadata{CIDR: net.MustParseCIDR("fe80::/120")}}, false),
+		Entry("should reject IPv4 pool whose base address is not block aligned",
+			api.IPPool{Metadata: api.IPPoolMetadata{CIDR: net.MustParseCIDR("10.0.0.32/24")}}, false),
+		Entry("should reject IPv6 pool whose base address is not block aligned",
+			api.IPPool{Metadata: api.IPPoolMetadata{CIDR: net.MustParseCIDR("fd80:24e2:f998:72d6::40/120")}}, false),
+		Entry("should reject IPv4 pool that is not a whole number of blocks",
+			api.IPPool{Metadata: api.IPPoolMetadata{CIDR: net.MustParseCIDR("10.0.0.0/28")}}, false),
+		Entry("should accept IPv4 pool smaller than /26 with a smaller block size",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: net.MustParseCIDR("10.0.0.0/28")},
+				Spec:     api.IPPoolSpec{BlockSize: &blockSize28},
+			}, true),
+		Entry("should accept IPv6 pool with a block size",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: netv6_4},
+				Spec:     api.IPPoolSpec{BlockSize: &blockSize124},
+			}, true),
+		Entry("should reject IPv4 pool with a block size shorter than /20",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: netv4_4},
+				Spec:     api.IPPoolSpec{BlockSize: &blockSize16},
+			}, false),
+		Entry("should reject IPv6 pool with an IPv4 block size",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: netv6_4},
+				Spec:     api.IPPoolSpec{BlockSize: &blockSize28},
+			}, false),
+		Entry("should reject IPv4 pool smaller than its block size",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: netv4_3},
+				Spec:     api.IPPoolSpec{BlockSize: &blockSize24},
+			}, false),
+		Entry("should accept IPv4 pool with an excluded CIDR within the pool",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: net.MustParseNetwork("10.0.0.0/16")},
+				Spec:     api.IPPoolSpec{ExcludedCIDRs: []net.IPNet{net.MustParseNetwork("10.0.1.0/24")}},
+			}, true),
+		Entry("should accept IPv6 pool with an excluded CIDR within the pool",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: net.MustParseNetwork("fd80:24e2:f998:72d6::/64")},
+				Spec:     api.IPPoolSpec{ExcludedCIDRs: []net.IPNet{net.MustParseNetwork("fd80:24e2:f998:72d6::100/120")}},
+			}, true),
+		Entry("should reject IPv4 pool with an excluded CIDR outside the pool",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: net.MustParseNetwork("10.0.0.0/16")},
+				Spec:     api.IPPoolSpec{ExcludedCIDRs: []net.IPNet{net.MustParseNetwork("10.1.0.0/24")}},
+			}, false),
+		Entry("should reject IPv4 pool with an excluded CIDR larger than the pool",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: net.MustParseNetwork("10.0.0.0/16")},
+				Spec:     api.IPPoolSpec{ExcludedCIDRs: []net.IPNet{net.MustParseNetwork("10.0.0.0/8")}},
+			}, false),
+		Entry("should reject IPv4 pool with an IPv6 excluded CIDR",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: net.MustParseNetwork("10.0.0.0/16")},
+				Spec:     api.IPPoolSpec{ExcludedCIDRs: []net.IPNet{net.MustParseNetwork("::a00:0/120")}},
+			}, false),
+		Entry("should accept IPv4 pool with a reserved address within the pool",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: net.MustParseNetwork("10.0.0.0/16")},
+				Spec:     api.IPPoolSpec{ReservedAddresses: []net.IP{net.MustParseIP("10.0.0.1")}},
+			}, true),
+		Entry("should accept IPv6 pool with a reserved address within the pool",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: net.MustParseNetwork("fd80:24e2:f998:72d6::/64")},
+				Spec:     api.IPPoolSpec{ReservedAddresses: []net.IP{net.MustParseIP("fd80:24e2:f998:72d6::1")}},
+			}, true),
+		Entry("should reject IPv4 pool with a reserved address outside the pool",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: net.MustParseNetwork("10.0.0.0/16")},
+				Spec:     api.IPPoolSpec{ReservedAddresses: []net.IP{net.MustParseIP("10.1.0.1")}},
+			}, false),
+		Entry("should reject IPv6 pool with an IPv4 reserved address",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: net.MustParseNetwork("::a00:0/120")},
+				Spec:     api.IPPoolSpec{ReservedAddresses: []net.IP{net.MustParseIP("10.0.0.1")}},
+			}, false),
+		Entry("should accept IP pool with a valid node selector",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: net.MustParseNetwork("10.0.0.0/16")},
+				Spec:     api.IPPoolSpec{NodeSelector: `zone in {"a", "b"} && has(gpu)`},
+			}, true),
+		Entry("should reject IP pool with an invalid node selector",
+			api.IPPool{
+				Metadata: api.IPPoolMetadata{CIDR: net.MustParseNetwork("10.0.0.0/16")},
+				Spec:     api.IPPoolSpec{NodeSelector: "zone =="},
+			}, false),
 
 		// (API) IPIPConfiguration
 		Entry("should accept IPIP disabled", api.IPIPConfiguration{Enabled: false}, true),